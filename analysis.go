@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/pe"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Static analysis modes (STATIC_ANALYSIS)
+const (
+	analysisOff     = "off"
+	analysisThreats = "threats" // Infected files only
+	analysisAll     = "all"     // Every scanned file, listed in the response
+)
+
+// FileAnalysis is static triage context for a file, so responders can
+// judge a detection without re-downloading the sample
+type FileAnalysis struct {
+	File     string   `json:"file,omitempty"` // Path within the upload (file listing only)
+	Size     int64    `json:"size"`
+	Entropy  float64  `json:"entropy"`        // Shannon entropy in bits per byte (0-8); packed or encrypted data is close to 8
+	Type     string   `json:"type,omitempty"` // Format from magic bytes: pe, elf, macho, ole, zip, pdf, script
+	MIMEType string   `json:"mime_type"`
+	PE       *PEInfo  `json:"pe,omitempty"`
+	ELF      *ELFInfo `json:"elf,omitempty"`
+}
+
+// PEInfo holds Windows executable header basics
+type PEInfo struct {
+	Machine   string    `json:"machine"` // amd64, i386, arm64, arm or the raw value
+	DLL       bool      `json:"dll"`
+	Subsystem string    `json:"subsystem,omitempty"` // gui, console, native, efi
+	Sections  []string  `json:"sections"`
+	Timestamp time.Time `json:"timestamp"` // Link time from the header (easily forged)
+}
+
+// ELFInfo holds Linux/Unix executable header basics
+type ELFInfo struct {
+	Class       string `json:"class"`   // ELFCLASS32 or ELFCLASS64
+	Machine     string `json:"machine"` // e.g. EM_X86_64
+	Type        string `json:"type"`    // e.g. ET_EXEC, ET_DYN
+	Interpreter string `json:"interpreter,omitempty"`
+	Sections    int    `json:"sections"`
+}
+
+// fileMagic maps leading bytes to the format reported as FileAnalysis.Type
+var fileMagic = []struct {
+	magic    []byte
+	fileType string
+}{
+	{[]byte("MZ"), "pe"},
+	{[]byte("\x7fELF"), "elf"},
+	{[]byte{0xfe, 0xed, 0xfa, 0xce}, "macho"},
+	{[]byte{0xfe, 0xed, 0xfa, 0xcf}, "macho"},
+	{[]byte{0xce, 0xfa, 0xed, 0xfe}, "macho"},
+	{[]byte{0xcf, 0xfa, 0xed, 0xfe}, "macho"},
+	{[]byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}, "ole"},
+	{[]byte("PK\x03\x04"), "zip"},
+	{[]byte("%PDF-"), "pdf"},
+	{[]byte("#!"), "script"},
+}
+
+// PE header values reported by name
+var (
+	peMachines = map[uint16]string{
+		pe.IMAGE_FILE_MACHINE_I386:  "i386",
+		pe.IMAGE_FILE_MACHINE_AMD64: "amd64",
+		pe.IMAGE_FILE_MACHINE_ARM64: "arm64",
+		pe.IMAGE_FILE_MACHINE_ARMNT: "arm",
+	}
+	peSubsystems = map[uint16]string{
+		pe.IMAGE_SUBSYSTEM_NATIVE:                  "native",
+		pe.IMAGE_SUBSYSTEM_WINDOWS_GUI:             "gui",
+		pe.IMAGE_SUBSYSTEM_WINDOWS_CUI:             "console",
+		pe.IMAGE_SUBSYSTEM_EFI_APPLICATION:         "efi",
+		pe.IMAGE_SUBSYSTEM_EFI_BOOT_SERVICE_DRIVER: "efi",
+		pe.IMAGE_SUBSYSTEM_EFI_RUNTIME_DRIVER:      "efi",
+	}
+)
+
+// analyzeFile reads a file once for its entropy and type, then parses
+// executable headers. Files that merely start with a magic number but do
+// not parse get no header details.
+func analyzeFile(path string) (*FileAnalysis, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var counts [256]int64
+	var head []byte
+	buf := make([]byte, 32<<10)
+	var size int64
+	for {
+		n, err := f.Read(buf)
+		if len(head) < 512 {
+			head = append(head, buf[:min(n, 512-len(head))]...)
+		}
+		for _, b := range buf[:n] {
+			counts[b]++
+		}
+		size += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	analysis := &FileAnalysis{
+		Size:     size,
+		Entropy:  shannonEntropy(&counts, size),
+		MIMEType: http.DetectContentType(head),
+	}
+	for _, m := range fileMagic {
+		if bytes.HasPrefix(head, m.magic) {
+			analysis.Type = m.fileType
+			break
+		}
+	}
+
+	switch analysis.Type {
+	case "pe":
+		analysis.PE = peInfo(f)
+	case "elf":
+		analysis.ELF = elfInfo(f)
+	}
+	return analysis, nil
+}
+
+// shannonEntropy computes the entropy in bits per byte, rounded to three
+// decimals
+func shannonEntropy(counts *[256]int64, size int64) float64 {
+	if size == 0 {
+		return 0
+	}
+	var entropy float64
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(size)
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return math.Round(entropy*1000) / 1000
+}
+
+// peInfo parses PE headers; returns nil if r is not a valid PE file
+func peInfo(r io.ReaderAt) *PEInfo {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	info := &PEInfo{
+		Machine:   peMachines[f.Machine],
+		DLL:       f.Characteristics&pe.IMAGE_FILE_DLL != 0,
+		Timestamp: time.Unix(int64(f.TimeDateStamp), 0).UTC(),
+		Sections:  []string{},
+	}
+	if info.Machine == "" {
+		info.Machine = fmt.Sprintf("0x%x", f.Machine)
+	}
+	switch header := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		info.Subsystem = peSubsystems[header.Subsystem]
+	case *pe.OptionalHeader64:
+		info.Subsystem = peSubsystems[header.Subsystem]
+	}
+	for _, section := range f.Sections {
+		info.Sections = append(info.Sections, section.Name)
+	}
+	return info
+}
+
+// elfInfo parses ELF headers; returns nil if r is not a valid ELF file
+func elfInfo(r io.ReaderAt) *ELFInfo {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	info := &ELFInfo{
+		Class:    f.Class.String(),
+		Machine:  f.Machine.String(),
+		Type:     f.Type.String(),
+		Sections: len(f.Sections),
+	}
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			interp, err := io.ReadAll(io.LimitReader(prog.Open(), 256))
+			if err == nil {
+				info.Interpreter = string(bytes.TrimRight(interp, "\x00"))
+			}
+			break
+		}
+	}
+	return info
+}
+
+// analyzeFiles analyzes every regular file below dir, with paths relative
+// to it as in threat entries
+func analyzeFiles(dir string) []*FileAnalysis {
+	var files []*FileAnalysis
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		analysis, err := analyzeFile(path)
+		if err != nil {
+			return nil
+		}
+		analysis.File, _ = filepath.Rel(dir, path)
+		files = append(files, analysis)
+		return nil
+	})
+	return files
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// minimalPE builds a 64-bit PE header with one section, enough for debug/pe
+func minimalPE(t *testing.T, characteristics uint16) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	dos := make([]byte, 64)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], 64) // e_lfanew
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+
+	binary.Write(&buf, binary.LittleEndian, pe.FileHeader{
+		Machine:              pe.IMAGE_FILE_MACHINE_AMD64,
+		NumberOfSections:     1,
+		TimeDateStamp:        1700000000,
+		SizeOfOptionalHeader: uint16(binary.Size(pe.OptionalHeader64{})),
+		Characteristics:      characteristics,
+	})
+	binary.Write(&buf, binary.LittleEndian, pe.OptionalHeader64{
+		Magic:               0x20b,
+		Subsystem:           pe.IMAGE_SUBSYSTEM_WINDOWS_GUI,
+		NumberOfRvaAndSizes: 16,
+	})
+	section := pe.SectionHeader32{}
+	copy(section.Name[:], ".text")
+	binary.Write(&buf, binary.LittleEndian, section)
+	return buf.Bytes()
+}
+
+func TestAnalyzeFile(t *testing.T) {
+	dir := t.TempDir()
+	random := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []struct {
+		name        string
+		content     []byte
+		wantType    string
+		wantMIME    string
+		minEntropy  float64
+		maxEntropy  float64
+		wantDetails bool
+	}{
+		{"empty", nil, "", "text/plain; charset=utf-8", 0, 0, false},
+		{"zeros", make([]byte, 4096), "", "application/octet-stream", 0, 0, false},
+		{"random", random, "", "application/octet-stream", 7.99, 8, false},
+		{"text", []byte("hello hello hello"), "", "text/plain; charset=utf-8", 1, 3, false},
+		{"script", []byte("#!/bin/sh\nrm -rf /\n"), "script", "text/plain; charset=utf-8", 1, 5, false},
+		{"pdf", []byte("%PDF-1.7\n"), "pdf", "application/pdf", 1, 5, false},
+		{"truncated pe", []byte("MZ\x90\x00"), "pe", "application/octet-stream", 0, 3, false},
+		{"pe", minimalPE(t, pe.IMAGE_FILE_EXECUTABLE_IMAGE|pe.IMAGE_FILE_DLL), "pe", "application/octet-stream", 0, 8, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, tt.content, 0644); err != nil {
+				t.Fatalf("failed to write file: %v", err)
+			}
+
+			analysis, err := analyzeFile(path)
+			if err != nil {
+				t.Fatalf("analyzeFile() error: %v", err)
+			}
+			if analysis.Size != int64(len(tt.content)) {
+				t.Errorf("Size = %d, want %d", analysis.Size, len(tt.content))
+			}
+			if analysis.Type != tt.wantType || analysis.MIMEType != tt.wantMIME {
+				t.Errorf("type = %q (%s), want %q (%s)", analysis.Type, analysis.MIMEType, tt.wantType, tt.wantMIME)
+			}
+			if analysis.Entropy < tt.minEntropy || analysis.Entropy > tt.maxEntropy {
+				t.Errorf("Entropy = %v, want %v-%v", analysis.Entropy, tt.minEntropy, tt.maxEntropy)
+			}
+			if (analysis.PE != nil) != tt.wantDetails {
+				t.Errorf("PE = %+v, want details: %v", analysis.PE, tt.wantDetails)
+			}
+		})
+	}
+}
+
+func TestAnalyzeFilePE(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sample.dll")
+	writeTestFile(t, path, string(minimalPE(t, pe.IMAGE_FILE_EXECUTABLE_IMAGE|pe.IMAGE_FILE_DLL)))
+
+	analysis, err := analyzeFile(path)
+	if err != nil || analysis.PE == nil {
+		t.Fatalf("analyzeFile() = %+v, %v", analysis, err)
+	}
+	info := analysis.PE
+	if info.Machine != "amd64" || !info.DLL || info.Subsystem != "gui" {
+		t.Errorf("PE = %+v", info)
+	}
+	if len(info.Sections) != 1 || info.Sections[0] != ".text" {
+		t.Errorf("Sections = %v, want [.text]", info.Sections)
+	}
+	if !info.Timestamp.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Timestamp = %v", info.Timestamp)
+	}
+}
+
+func TestAnalyzeFileELF(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("test binary is not ELF")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		t.Skipf("no executable path: %v", err)
+	}
+
+	analysis, err := analyzeFile(executable)
+	if err != nil || analysis.ELF == nil {
+		t.Fatalf("analyzeFile() = %+v, %v", analysis, err)
+	}
+	if analysis.Type != "elf" || analysis.ELF.Type == "" || analysis.ELF.Machine == "" || analysis.ELF.Sections == 0 {
+		t.Errorf("ELF = %+v", analysis.ELF)
+	}
+}
+
+func TestAnalyzeFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "a.txt"), "alpha")
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	writeTestFile(t, filepath.Join(dir, "sub", "b.sh"), "#!/bin/sh\n")
+
+	files := analyzeFiles(dir)
+	if len(files) != 2 || files[0].File != "a.txt" || files[1].File != filepath.Join("sub", "b.sh") || files[1].Type != "script" {
+		t.Errorf("files = %+v", files)
+	}
+}
+
+func TestScanHandlerStaticAnalysis(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+
+	tests := []struct {
+		mode          string
+		wantThreat    bool
+		wantFileCount int
+	}{
+		{analysisOff, false, 0},
+		{analysisThreats, true, 0},
+		{analysisAll, true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			cfg.StaticAnalysis = tt.mode
+			body, contentType := multipartUpload(t, "eicar.com", []byte("EICAR"))
+			req := httptest.NewRequest(http.MethodPost, "/scan", body)
+			req.Header.Set("Content-Type", contentType)
+			recorder := httptest.NewRecorder()
+
+			handleScan(recorder, req, cfg, NewScanner(cfg))
+
+			var response ScanResponse
+			json.NewDecoder(recorder.Body).Decode(&response)
+			if len(response.Threats) != 1 {
+				t.Fatalf("threats = %+v", response.Threats)
+			}
+			if analysis := response.Threats[0].Analysis; (analysis != nil) != tt.wantThreat || analysis != nil && analysis.Size != 5 {
+				t.Errorf("threat analysis = %+v", analysis)
+			}
+			if len(response.Files) != tt.wantFileCount {
+				t.Errorf("files = %+v, want %d", response.Files, tt.wantFileCount)
+			}
+		})
+	}
+}
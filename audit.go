@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit event types
+const (
+	auditEventDetection      = "detection"
+	auditEventRetroDetection = "retrospective_detection" // Stored file detected after a signature update
+)
+
+// AuditRecord is one append-only audit entry
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	ClientIP   string    `json:"client_ip"`
+	Identity   string    `json:"identity,omitempty"`    // API key name, user, token subject or cert CN
+	AuthMethod string    `json:"auth_method,omitempty"` // Authenticator that accepted the request
+	Route      string    `json:"route"`
+	Filename   string    `json:"filename"` // Client-supplied name (JSON-escaped)
+	FileSize   int64     `json:"file_size"`
+	FileSHA256 string    `json:"file_sha256,omitempty"` // Hash of the uploaded file
+	Threats    []Threat  `json:"threats"`               // Signatures with per-file hashes
+
+	Metadata json.RawMessage `json:"metadata,omitempty"` // Caller metadata sent with the scan
+}
+
+// AuditLogger writes audit records to a JSON lines file and/or syslog,
+// separate from the application log
+type AuditLogger struct {
+	mu     sync.Mutex
+	file   *os.File
+	syslog *SyslogWriter
+}
+
+// Global audit logger (nil when auditing is disabled)
+var auditLog *AuditLogger
+
+// NewAuditLogger opens the configured audit destinations.
+// Returns nil when no destination is configured.
+func NewAuditLogger(config *Config) (*AuditLogger, error) {
+	if config.AuditLogFile == "" && config.AuditSyslogAddress == "" {
+		return nil, nil
+	}
+
+	a := &AuditLogger{}
+
+	if config.AuditLogFile != "" {
+		// Append-only, readable by the service user only
+		f, err := os.OpenFile(config.AuditLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		a.file = f
+	}
+
+	if config.AuditSyslogAddress != "" {
+		w, err := NewSyslogWriter(config.AuditSyslogAddress, config.AuditSyslogFacility, "clamav-rest", nil)
+		if err != nil {
+			return nil, err
+		}
+		a.syslog = w
+	}
+
+	return a, nil
+}
+
+// Record writes an audit record to every destination.
+// Failures are logged but never fail the scan request.
+func (a *AuditLogger) Record(record *AuditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Warning: failed to encode audit record: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file != nil {
+		if _, err := a.file.Write(append(line, '\n')); err != nil {
+			log.Printf("Warning: failed to write audit log: %v", err)
+		} else if err := a.file.Sync(); err != nil {
+			log.Printf("Warning: failed to sync audit log: %v", err)
+		}
+	}
+
+	if a.syslog != nil {
+		if err := a.syslog.Write(syslogSeverityWarning, record.Event, string(line)); err != nil {
+			log.Printf("Warning: failed to send audit record to syslog: %v", err)
+		}
+	}
+}
+
+// reportDetection sends an infected verdict for the request to the audit
+// log, SIEM and notifier, if enabled
+func reportDetection(r *http.Request, upload *uploadedFile, threats []Threat) {
+	reportEvent(r, auditEventDetection, upload, threats)
+}
+
+// reportEvent sends a detection event of the given type to the audit log,
+// SIEM and notifier, if enabled
+func reportEvent(r *http.Request, event string, upload *uploadedFile, threats []Threat) {
+	if auditLog == nil && siem == nil && notifier == nil {
+		return
+	}
+
+	record := &AuditRecord{
+		Time:     time.Now().UTC(),
+		Event:    event,
+		ClientIP: clientIP(r),
+		Route:    r.URL.Path,
+		Filename: upload.filename,
+		FileSize: upload.size,
+		Threats:  threats,
+		Metadata: upload.metadata,
+	}
+	if identity := identityFromContext(r.Context()); identity != nil {
+		record.Identity = identity.Name
+		record.AuthMethod = identity.Method
+	}
+	if hash, err := upload.fileHash(); err == nil {
+		record.FileSHA256 = hash
+	}
+
+	if auditLog != nil {
+		auditLog.Record(record)
+	}
+	if siem != nil {
+		siem.Forward(record)
+	}
+	if notifier != nil {
+		notifier.Notify(record)
+	}
+}
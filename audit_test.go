@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewAuditLoggerDisabled(t *testing.T) {
+	a, err := NewAuditLogger(&Config{})
+	if err != nil {
+		t.Fatalf("NewAuditLogger() error: %v", err)
+	}
+	if a != nil {
+		t.Error("expected nil logger without destinations")
+	}
+}
+
+func TestNewAuditLoggerInvalidSyslog(t *testing.T) {
+	_, err := NewAuditLogger(&Config{AuditSyslogAddress: "http://host:514", AuditSyslogFacility: "auth"})
+	if err == nil {
+		t.Error("expected error for unsupported syslog scheme")
+	}
+}
+
+func TestReportDetection(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "audit.log")
+
+	a, err := NewAuditLogger(&Config{AuditLogFile: logPath})
+	if err != nil {
+		t.Fatalf("NewAuditLogger() error: %v", err)
+	}
+	auditLog = a
+	t.Cleanup(func() { auditLog = nil })
+
+	uploadPath := filepath.Join(tmpDir, "upload")
+	writeTestFile(t, uploadPath, "payload")
+
+	req := httptest.NewRequest("POST", "/scan", nil)
+	req.RemoteAddr = "192.0.2.10:54321"
+	req = req.WithContext(context.WithValue(req.Context(), identityKey{}, &Identity{Name: "ci", Method: "apikey"}))
+
+	upload := &uploadedFile{path: uploadPath, filename: "evil\n.zip", safeFilename: "evil_.zip", size: 7, metadata: json.RawMessage(`{"ticket":"T-1"}`)}
+	threats := []Threat{{Name: "Eicar-Test-Signature", File: "eicar.com", FileHash: "abc"}}
+
+	// Two detections must produce two appended lines
+	reportDetection(req, upload, threats)
+	reportDetection(req, upload, threats)
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+	defer f.Close()
+
+	var records []AuditRecord
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(lines.Bytes(), &record); err != nil {
+			t.Fatalf("invalid audit line %q: %v", lines.Text(), err)
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	record := records[0]
+	if record.Event != auditEventDetection {
+		t.Errorf("Event = %q, want %q", record.Event, auditEventDetection)
+	}
+	if record.ClientIP != "192.0.2.10" {
+		t.Errorf("ClientIP = %q, want 192.0.2.10", record.ClientIP)
+	}
+	if record.Identity != "ci" || record.AuthMethod != "apikey" {
+		t.Errorf("identity = %q/%q, want ci/apikey", record.Identity, record.AuthMethod)
+	}
+	if record.Filename != "evil\n.zip" {
+		t.Errorf("Filename = %q, want original client name", record.Filename)
+	}
+	if record.FileSHA256 == "" {
+		t.Error("FileSHA256 should be set")
+	}
+	if len(record.Threats) != 1 || record.Threats[0].Name != "Eicar-Test-Signature" {
+		t.Errorf("Threats = %+v", record.Threats)
+	}
+	if string(record.Metadata) != `{"ticket":"T-1"}` {
+		t.Errorf("Metadata = %s, want the caller metadata", record.Metadata)
+	}
+}
+
+func TestReportDetectionDisabled(t *testing.T) {
+	auditLog = nil
+	siem = nil
+
+	// Must not touch the upload or panic when reporting is off
+	req := httptest.NewRequest("POST", "/scan", nil)
+	reportDetection(req, &uploadedFile{path: "/nonexistent"}, nil)
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authentication method names accepted in AUTH_METHODS
+const (
+	AuthMethodNone   = "none"
+	AuthMethodAPIKey = "api-key"
+	AuthMethodBasic  = "basic"
+	AuthMethodJWT    = "jwt"
+	AuthMethodMTLS   = "mtls"
+)
+
+// authMethods lists the methods AUTH_METHODS and AUTH_SCOPES may name
+var authMethods = []string{AuthMethodNone, AuthMethodAPIKey, AuthMethodBasic, AuthMethodJWT, AuthMethodMTLS}
+
+// Header carrying API keys
+const apiKeyHeader = "X-API-Key"
+
+// Allowed clock skew when validating JWT time claims
+const jwtLeeway = 60 * time.Second
+
+// How long fetched JWKS keys are trusted before refreshing
+const jwksRefreshInterval = time.Hour
+
+// Minimum time between JWKS refreshes triggered by unknown key IDs
+const jwksMinRefreshInterval = time.Minute
+
+// errNoCredentials is returned by an Authenticator when the request carries
+// no credentials of its kind. Chains treat it as "try the next one".
+var errNoCredentials = errors.New("no credentials provided")
+
+// errInvalidCredentials is returned when credentials are present but rejected.
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// Identity describes an authenticated caller
+type Identity struct {
+	Name   string   // API key name, username, token subject or certificate CN
+	Method string   // Authenticator that accepted the request
+	Scopes []string // Granted scopes (from AUTH_SCOPES or the token "scope" claim)
+}
+
+// Key identifies the caller as "method:name", so a token subject and an
+// API key of the same name stay apart
+func (id *Identity) Key() string {
+	return id.Method + ":" + id.Name
+}
+
+// HasScope reports whether the identity was granted a scope
+func (id *Identity) HasScope(scope string) bool {
+	return containsString(id.Scopes, scope)
+}
+
+// Authenticator verifies the credentials carried by a request.
+//
+// Implementations return errNoCredentials when the request has no credentials
+// they understand, and any other error when credentials are present but invalid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// NewAuthenticator builds the authenticator chain described by the config.
+// Returns an error for unknown methods or methods missing required settings.
+func NewAuthenticator(config *Config) (Authenticator, error) {
+	methods := config.AuthMethods
+	if len(methods) == 0 {
+		methods = []string{AuthMethodNone}
+	}
+
+	var chain ChainAuthenticator
+	for _, method := range methods {
+		auth, err := newMethodAuthenticator(method, config)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, auth)
+	}
+
+	var auth Authenticator = chain
+	if len(chain) == 1 {
+		auth = chain[0]
+	}
+
+	if len(config.AuthScopes) > 0 {
+		auth = &scopedAuthenticator{next: auth, scopes: config.AuthScopes}
+	}
+	return auth, nil
+}
+
+// newMethodAuthenticator creates a single built-in authenticator
+func newMethodAuthenticator(method string, config *Config) (Authenticator, error) {
+	switch strings.ToLower(method) {
+	case AuthMethodNone:
+		return noneAuthenticator{}, nil
+
+	case AuthMethodAPIKey:
+		if len(config.APIKeys) == 0 {
+			return nil, fmt.Errorf("auth method %q requires %s", method, EnvAPIKeys)
+		}
+		return &APIKeyAuthenticator{keys: config.APIKeys}, nil
+
+	case AuthMethodBasic:
+		if len(config.BasicAuthUsers) == 0 {
+			return nil, fmt.Errorf("auth method %q requires %s", method, EnvBasicAuthUsers)
+		}
+		return &BasicAuthenticator{users: config.BasicAuthUsers}, nil
+
+	case AuthMethodJWT:
+		if config.JWTSecret == "" && config.JWTJWKSURL == "" && config.JWTIssuer == "" {
+			return nil, fmt.Errorf("auth method %q requires %s, %s or %s",
+				method, EnvJWTSecret, EnvJWTJWKSURL, EnvJWTIssuer)
+		}
+		return &JWTAuthenticator{
+			secret:   []byte(config.JWTSecret),
+			jwksURL:  config.JWTJWKSURL,
+			issuer:   config.JWTIssuer,
+			audience: config.JWTAudience,
+			client:   newOutboundClient(10 * time.Second),
+		}, nil
+
+	case AuthMethodMTLS:
+		if config.TLSCertFile == "" || config.TLSClientCAFile == "" {
+			return nil, fmt.Errorf("auth method %q requires %s and %s",
+				method, EnvTLSCertFile, EnvTLSClientCAFile)
+		}
+		return &MTLSAuthenticator{allowedSubjects: config.MTLSAllowedSubjects}, nil
+	}
+
+	return nil, fmt.Errorf("unknown auth method %q", method)
+}
+
+// ChainAuthenticator tries each authenticator in order.
+// The first one that finds credentials decides the outcome, so a deployment
+// can accept several schemes at once while migrating between them.
+type ChainAuthenticator []Authenticator
+
+// Authenticate implements Authenticator
+func (c ChainAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	for _, auth := range c {
+		identity, err := auth.Authenticate(r)
+		if errors.Is(err, errNoCredentials) {
+			continue
+		}
+		return identity, err
+	}
+	return nil, errNoCredentials
+}
+
+// scopedAuthenticator adds configured scopes to identities by key
+type scopedAuthenticator struct {
+	next   Authenticator
+	scopes map[string][]string // identity key (method:name) -> scopes
+}
+
+// Authenticate implements Authenticator
+func (a *scopedAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	identity, err := a.next.Authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+	identity.Scopes = append(identity.Scopes, a.scopes[identity.Key()]...)
+	return identity, nil
+}
+
+// noneAuthenticator accepts every request as anonymous
+type noneAuthenticator struct{}
+
+// Authenticate implements Authenticator
+func (noneAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	return &Identity{Name: "anonymous", Method: AuthMethodNone}, nil
+}
+
+// APIKeyAuthenticator checks the X-API-Key header against configured keys
+type APIKeyAuthenticator struct {
+	keys map[string]string // key -> name
+}
+
+// Authenticate implements Authenticator
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	presented := r.Header.Get(apiKeyHeader)
+	if presented == "" {
+		return nil, errNoCredentials
+	}
+
+	// Compare against every key in constant time to avoid leaking
+	// which prefix matched through response timing
+	var name string
+	for key, keyName := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(key)) == 1 {
+			name = keyName
+		}
+	}
+
+	if name == "" {
+		return nil, errInvalidCredentials
+	}
+	return &Identity{Name: name, Method: AuthMethodAPIKey}, nil
+}
+
+// BasicAuthenticator checks HTTP Basic credentials against configured users
+type BasicAuthenticator struct {
+	users map[string]string // username -> password
+}
+
+// Authenticate implements Authenticator
+func (a *BasicAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, errNoCredentials
+	}
+
+	expected, found := a.users[username]
+	if !found {
+		// Still do a comparison so unknown users take the same time
+		expected = "\x00"
+	}
+
+	if subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 || !found {
+		return nil, errInvalidCredentials
+	}
+	return &Identity{Name: username, Method: AuthMethodBasic}, nil
+}
+
+// MTLSAuthenticator accepts requests with a verified client certificate.
+// Requires the server to be started with TLS and a client CA.
+type MTLSAuthenticator struct {
+	allowedSubjects []string // Allowed certificate CNs (empty = any)
+}
+
+// Authenticate implements Authenticator
+func (a *MTLSAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, errNoCredentials
+	}
+
+	subject := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if len(a.allowedSubjects) > 0 && !containsString(a.allowedSubjects, subject) {
+		return nil, errInvalidCredentials
+	}
+	return &Identity{Name: subject, Method: AuthMethodMTLS}, nil
+}
+
+// JWTAuthenticator validates bearer tokens signed with HS256 (shared secret)
+// or RS256 (keys from a JWKS endpoint, discovered via OIDC if only the issuer is set).
+type JWTAuthenticator struct {
+	secret   []byte
+	jwksURL  string
+	issuer   string
+	audience string
+	client   *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey // kid -> key
+	keysFetched time.Time
+	refreshing  chan struct{} // Closed when the JWKS fetch in flight ends (nil = none)
+}
+
+// jwtHeader is the decoded JOSE header
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims holds the registered claims we validate
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Scope     string          `json:"scope"` // Space-separated OAuth2 scopes
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"` // string or array of strings
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+// Authenticate implements Authenticator
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	authHeader := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(authHeader, "Bearer ")
+	if !ok || token == "" {
+		return nil, errNoCredentials
+	}
+
+	claims, err := a.verify(token)
+	if err != nil {
+		log.Printf("JWT rejected: %v", err)
+		return nil, errInvalidCredentials
+	}
+	return &Identity{
+		Name:   claims.Subject,
+		Method: AuthMethodJWT,
+		Scopes: strings.Fields(claims.Scope),
+	}, nil
+}
+
+// verify checks the token signature and claims
+func (a *JWTAuthenticator) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+
+	signingInput := parts[0] + "." + parts[1]
+	switch header.Alg {
+	case "HS256":
+		if len(a.secret) == 0 {
+			return nil, fmt.Errorf("HS256 not configured")
+		}
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, fmt.Errorf("signature mismatch")
+		}
+
+	case "RS256":
+		key, err := a.publicKey(header.Kid)
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.Sum256([]byte(signingInput))
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, fmt.Errorf("signature mismatch")
+		}
+
+	default:
+		// Never accept "none" or algorithms we don't explicitly support
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %w", err)
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt != nil && now.After(unixFloat(*claims.ExpiresAt).Add(jwtLeeway)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(unixFloat(*claims.NotBefore)) {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if a.audience != "" && !audienceContains(claims.Audience, a.audience) {
+		return nil, fmt.Errorf("unexpected audience")
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("missing subject")
+	}
+
+	return &claims, nil
+}
+
+// publicKey returns the RSA key for a key ID, refreshing the JWKS if needed.
+// The JWKS is fetched without holding a.mu, so requests with cached keys
+// aren't held up by a slow identity provider.
+func (a *JWTAuthenticator) publicKey(kid string) (*rsa.PublicKey, error) {
+	a.mu.Lock()
+	age := time.Since(a.keysFetched)
+	key, found := a.keys[kid]
+	inFlight := a.refreshing
+
+	// Refresh periodically, or early when an unknown key shows up (key rotation)
+	if inFlight == nil && (age > jwksRefreshInterval || (!found && age > jwksMinRefreshInterval)) {
+		done := make(chan struct{})
+		a.refreshing, a.keysFetched = done, time.Now()
+		a.mu.Unlock()
+
+		keys, err := a.fetchKeys()
+		a.mu.Lock()
+		if err == nil {
+			a.keys = keys
+		}
+		a.refreshing = nil
+		a.mu.Unlock()
+		close(done)
+
+		if err != nil {
+			if found {
+				log.Printf("Warning: JWKS refresh failed, using cached keys: %v", err)
+				return key, nil
+			}
+			return nil, err
+		}
+		key, found = keys[kid]
+	} else {
+		a.mu.Unlock()
+		if !found && inFlight != nil {
+			// The fetch in flight may bring the key
+			<-inFlight
+			a.mu.Lock()
+			key, found = a.keys[kid]
+			a.mu.Unlock()
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+// fetchKeys fetches the JWKS and returns its RSA keys by key ID
+func (a *JWTAuthenticator) fetchKeys() (map[string]*rsa.PublicKey, error) {
+	jwksURL := a.jwksURL
+	if jwksURL == "" {
+		discovered, err := a.discoverJWKSURL()
+		if err != nil {
+			return nil, err
+		}
+		jwksURL = discovered
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := a.getJSON(jwksURL, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return keys, nil
+}
+
+// discoverJWKSURL reads jwks_uri from the issuer's OIDC discovery document
+func (a *JWTAuthenticator) discoverJWKSURL() (string, error) {
+	if a.issuer == "" {
+		return "", fmt.Errorf("no JWKS URL or issuer configured")
+	}
+
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	url := strings.TrimSuffix(a.issuer, "/") + "/.well-known/openid-configuration"
+	if err := a.getJSON(url, &discovery); err != nil {
+		return "", fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	if discovery.JWKSURI == "" {
+		return "", fmt.Errorf("OIDC discovery document has no jwks_uri")
+	}
+
+	// Remember it so we don't rediscover on every refresh
+	a.jwksURL = discovery.JWKSURI
+	return a.jwksURL, nil
+}
+
+// getJSON fetches and decodes a JSON document
+func (a *JWTAuthenticator) getJSON(url string, v interface{}) error {
+	resp, err := a.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// decodeJWTSegment base64url-decodes and unmarshals a token segment
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audienceContains reports whether the "aud" claim includes the expected value
+func audienceContains(raw json.RawMessage, expected string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == expected
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return containsString(list, expected)
+	}
+	return false
+}
+
+// unixFloat converts a NumericDate claim to time.Time
+func unixFloat(seconds float64) time.Time {
+	return time.Unix(int64(seconds), 0)
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// identityKey is the context key for the authenticated Identity
+type identityKey struct{}
+
+// identityFromContext returns the caller identity set by requireAuth, if any
+func identityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// requireAuth wraps a handler so it only runs for authenticated requests.
+// Responds with 401 when credentials are missing or invalid, and 429 when
+// the client IP has made too many failed attempts (see limitAuthFailures).
+func requireAuth(auth Authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := auth.Authenticate(r)
+		var limited *authRateLimitedError
+		if errors.As(err, &limited) {
+			sendRateLimited(w, r, limited.wait, "Too many failed authentication attempts")
+			return
+		}
+		if err != nil {
+			log.Printf("Authentication failed from %s: %v", clientIP(r), err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="clamav-rest"`)
+			sendErrorStatus(w, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), identityKey{}, identity)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
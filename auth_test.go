@@ -0,0 +1,493 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewAuthenticator(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *Config
+		wantErr bool
+	}{
+		{
+			name:   "defaults to none",
+			config: &Config{},
+		},
+		{
+			name:   "api-key with keys",
+			config: &Config{AuthMethods: []string{"api-key"}, APIKeys: map[string]string{"secret": "ci"}},
+		},
+		{
+			name:    "api-key without keys",
+			config:  &Config{AuthMethods: []string{"api-key"}},
+			wantErr: true,
+		},
+		{
+			name:    "basic without users",
+			config:  &Config{AuthMethods: []string{"basic"}},
+			wantErr: true,
+		},
+		{
+			name:    "jwt without secret or jwks",
+			config:  &Config{AuthMethods: []string{"jwt"}},
+			wantErr: true,
+		},
+		{
+			name:    "mtls without client CA",
+			config:  &Config{AuthMethods: []string{"mtls"}, TLSCertFile: "cert.pem"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown method",
+			config:  &Config{AuthMethods: []string{"kerberos"}},
+			wantErr: true,
+		},
+		{
+			name: "chain",
+			config: &Config{
+				AuthMethods: []string{"api-key", "none"},
+				APIKeys:     map[string]string{"secret": "ci"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAuthenticator(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewAuthenticator() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	auth := &APIKeyAuthenticator{keys: map[string]string{"key-123": "ci-pipeline"}}
+
+	t.Run("valid key", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+		req.Header.Set(apiKeyHeader, "key-123")
+
+		identity, err := auth.Authenticate(req)
+		if err != nil {
+			t.Fatalf("Authenticate() error: %v", err)
+		}
+		if identity.Name != "ci-pipeline" {
+			t.Errorf("identity.Name = %q, want ci-pipeline", identity.Name)
+		}
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+		req.Header.Set(apiKeyHeader, "wrong")
+
+		if _, err := auth.Authenticate(req); !errors.Is(err, errInvalidCredentials) {
+			t.Errorf("err = %v, want errInvalidCredentials", err)
+		}
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+
+		if _, err := auth.Authenticate(req); !errors.Is(err, errNoCredentials) {
+			t.Errorf("err = %v, want errNoCredentials", err)
+		}
+	})
+}
+
+func TestBasicAuthenticator(t *testing.T) {
+	auth := &BasicAuthenticator{users: map[string]string{"alice": "s3cret"}}
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		setAuth  bool
+		wantErr  error
+	}{
+		{name: "valid", user: "alice", password: "s3cret", setAuth: true},
+		{name: "wrong password", user: "alice", password: "nope", setAuth: true, wantErr: errInvalidCredentials},
+		{name: "unknown user", user: "bob", password: "s3cret", setAuth: true, wantErr: errInvalidCredentials},
+		{name: "no credentials", wantErr: errNoCredentials},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+			if tt.setAuth {
+				req.SetBasicAuth(tt.user, tt.password)
+			}
+
+			identity, err := auth.Authenticate(req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && identity.Name != tt.user {
+				t.Errorf("identity.Name = %q, want %q", identity.Name, tt.user)
+			}
+		})
+	}
+}
+
+func TestMTLSAuthenticator(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "billing-service"}}
+	withCert := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return req
+	}
+
+	t.Run("any verified cert", func(t *testing.T) {
+		identity, err := (&MTLSAuthenticator{}).Authenticate(withCert())
+		if err != nil {
+			t.Fatalf("Authenticate() error: %v", err)
+		}
+		if identity.Name != "billing-service" {
+			t.Errorf("identity.Name = %q, want billing-service", identity.Name)
+		}
+	})
+
+	t.Run("subject not allowed", func(t *testing.T) {
+		auth := &MTLSAuthenticator{allowedSubjects: []string{"other"}}
+		if _, err := auth.Authenticate(withCert()); !errors.Is(err, errInvalidCredentials) {
+			t.Errorf("err = %v, want errInvalidCredentials", err)
+		}
+	})
+
+	t.Run("no TLS", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+		if _, err := (&MTLSAuthenticator{}).Authenticate(req); !errors.Is(err, errNoCredentials) {
+			t.Errorf("err = %v, want errNoCredentials", err)
+		}
+	})
+}
+
+func TestJWTAuthenticatorHS256(t *testing.T) {
+	secret := []byte("test-secret")
+	auth := &JWTAuthenticator{secret: secret, issuer: "https://issuer", audience: "clamav-rest"}
+
+	valid := map[string]interface{}{
+		"sub":   "svc-upload",
+		"scope": "uploads ci",
+		"iss":   "https://issuer",
+		"aud":   []string{"clamav-rest"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "valid token", token: signHS256(t, secret, valid)},
+		{name: "wrong secret", token: signHS256(t, []byte("other"), valid), wantErr: true},
+		{
+			name:    "expired token",
+			token:   signHS256(t, secret, withClaim(valid, "exp", time.Now().Add(-time.Hour).Unix())),
+			wantErr: true,
+		},
+		{
+			name:    "wrong issuer",
+			token:   signHS256(t, secret, withClaim(valid, "iss", "https://evil")),
+			wantErr: true,
+		},
+		{
+			name:    "wrong audience",
+			token:   signHS256(t, secret, withClaim(valid, "aud", "other")),
+			wantErr: true,
+		},
+		{
+			name:    "alg none rejected",
+			token:   encodeJWT(t, map[string]string{"alg": "none"}, valid) + ".",
+			wantErr: true,
+		},
+		{name: "malformed", token: "not-a-jwt", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+
+			identity, err := auth.Authenticate(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && identity.Name != "svc-upload" {
+				t.Errorf("identity.Name = %q, want svc-upload", identity.Name)
+			}
+			if err == nil && !identity.HasScope("ci") {
+				t.Errorf("identity.Scopes = %v, want ci", identity.Scopes)
+			}
+		})
+	}
+}
+
+func TestJWTAuthenticatorRS256WithOIDCDiscovery(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"jwks_uri": server.URL + "/jwks"})
+		case "/jwks":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []map[string]string{{
+					"kty": "RSA",
+					"kid": "key-1",
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				}},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	auth := &JWTAuthenticator{issuer: server.URL, client: server.Client()}
+
+	signingInput := encodeJWT(t, map[string]string{"alg": "RS256", "kid": "key-1"}, map[string]interface{}{
+		"sub": "svc-oidc",
+		"iss": server.URL,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	token := signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+
+	req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	identity, err := auth.Authenticate(req)
+	if err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+	if identity.Name != "svc-oidc" {
+		t.Errorf("identity.Name = %q, want svc-oidc", identity.Name)
+	}
+}
+
+func TestChainAuthenticator(t *testing.T) {
+	chain := ChainAuthenticator{
+		&APIKeyAuthenticator{keys: map[string]string{"key-123": "ci"}},
+		&BasicAuthenticator{users: map[string]string{"alice": "s3cret"}},
+	}
+
+	t.Run("second method accepts", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+		req.SetBasicAuth("alice", "s3cret")
+
+		identity, err := chain.Authenticate(req)
+		if err != nil {
+			t.Fatalf("Authenticate() error: %v", err)
+		}
+		if identity.Method != AuthMethodBasic {
+			t.Errorf("identity.Method = %q, want %q", identity.Method, AuthMethodBasic)
+		}
+	})
+
+	t.Run("invalid credentials stop the chain", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+		req.Header.Set(apiKeyHeader, "wrong")
+		req.SetBasicAuth("alice", "s3cret")
+
+		if _, err := chain.Authenticate(req); !errors.Is(err, errInvalidCredentials) {
+			t.Errorf("err = %v, want errInvalidCredentials", err)
+		}
+	})
+
+	t.Run("no credentials", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+
+		if _, err := chain.Authenticate(req); !errors.Is(err, errNoCredentials) {
+			t.Errorf("err = %v, want errNoCredentials", err)
+		}
+	})
+
+	t.Run("none as fallback allows anonymous", func(t *testing.T) {
+		optional := append(chain, noneAuthenticator{})
+		req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+
+		identity, err := optional.Authenticate(req)
+		if err != nil {
+			t.Fatalf("Authenticate() error: %v", err)
+		}
+		if identity.Method != AuthMethodNone {
+			t.Errorf("identity.Method = %q, want %q", identity.Method, AuthMethodNone)
+		}
+	})
+}
+
+func TestRequireAuth(t *testing.T) {
+	auth := &APIKeyAuthenticator{keys: map[string]string{"key-123": "ci"}}
+
+	var gotIdentity *Identity
+	handler := requireAuth(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotIdentity = identityFromContext(r.Context())
+	}))
+
+	t.Run("rejects unauthenticated", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+		recorder := httptest.NewRecorder()
+
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("status = %d, want %d", recorder.Code, http.StatusUnauthorized)
+		}
+		if recorder.Header().Get("WWW-Authenticate") == "" {
+			t.Error("missing WWW-Authenticate header")
+		}
+	})
+
+	t.Run("passes identity to handler", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+		req.Header.Set(apiKeyHeader, "key-123")
+		recorder := httptest.NewRecorder()
+
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusOK {
+			t.Errorf("status = %d, want %d", recorder.Code, http.StatusOK)
+		}
+		if gotIdentity == nil || gotIdentity.Name != "ci" {
+			t.Errorf("identity = %+v, want name ci", gotIdentity)
+		}
+	})
+}
+
+// Helper function to encode a JWT header and claims (without signature)
+func encodeJWT(t *testing.T, header interface{}, claims interface{}) string {
+	t.Helper()
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatalf("failed to marshal header: %v", err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed to marshal claims: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+}
+
+// Helper function to create an HS256-signed JWT
+func signHS256(t *testing.T, secret []byte, claims interface{}) string {
+	t.Helper()
+
+	signingInput := encodeJWT(t, map[string]string{"alg": "HS256", "typ": "JWT"}, claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Helper function to copy claims with one value replaced
+func withClaim(claims map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(claims))
+	for k, v := range claims {
+		copied[k] = v
+	}
+	copied[key] = value
+	return copied
+}
+
+func TestScopedAuthenticator(t *testing.T) {
+	auth, err := NewAuthenticator(&Config{
+		AuthMethods:    []string{"api-key", "basic"},
+		APIKeys:        map[string]string{"key-123": "mail-gateway"},
+		BasicAuthUsers: map[string]string{"mail-gateway": "s3cret"},
+		AuthScopes:     map[string][]string{"api-key:mail-gateway": {"mail"}},
+	})
+	if err != nil {
+		t.Fatalf("NewAuthenticator() error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/scan/mail", nil)
+	req.Header.Set(apiKeyHeader, "key-123")
+
+	identity, err := auth.Authenticate(req)
+	if err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+	if !identity.HasScope("mail") {
+		t.Errorf("identity.Scopes = %v, want mail", identity.Scopes)
+	}
+	if identity.HasScope("ci") {
+		t.Error("identity unexpectedly has scope ci")
+	}
+
+	// Scopes are granted per method: a user of the same name doesn't get them
+	req = httptest.NewRequest(http.MethodPost, "/scan/mail", nil)
+	req.SetBasicAuth("mail-gateway", "s3cret")
+	if identity, err := auth.Authenticate(req); err != nil || identity.HasScope("mail") {
+		t.Errorf("basic auth identity = %+v, %v, want no mail scope", identity, err)
+	}
+}
+
+func TestJWTPublicKeyRefreshDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	fetching := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetching <- struct{}{}
+		<-release
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{}})
+	}))
+	defer server.Close()
+
+	cached := &rsa.PublicKey{N: big.NewInt(1), E: 3}
+	auth := &JWTAuthenticator{
+		jwksURL:     server.URL,
+		client:      server.Client(),
+		keys:        map[string]*rsa.PublicKey{"key-1": cached},
+		keysFetched: time.Now().Add(-2 * jwksRefreshInterval),
+	}
+
+	// The first caller refreshes the stale JWKS; others use the cached key
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		auth.publicKey("key-1")
+	}()
+	<-fetching
+
+	done := make(chan struct{})
+	go func() {
+		if key, err := auth.publicKey("key-1"); err != nil || key != cached {
+			t.Errorf("publicKey() during refresh = %v, %v", key, err)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("publicKey() waited for the JWKS fetch")
+	}
+	close(release)
+	wg.Wait()
+}
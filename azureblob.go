@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Blob service REST API version requests are made with
+const azureAPIVersion = "2021-08-06"
+
+var (
+	azureAccountPattern   = regexp.MustCompile(`^[a-z0-9]{3,24}$`)
+	azureContainerPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+)
+
+// azureStore reads blobs from one storage account, authenticated with the
+// account's shared key, a SAS token, or anonymously for public containers
+type azureStore struct {
+	client   *http.Client
+	account  string
+	endpoint string // Blob service URL (overridden in tests)
+	key      []byte // Decoded shared key (nil = none)
+	sas      url.Values
+}
+
+// newAzureStore creates the Azure Blob store for the configured account
+func newAzureStore(config *Config) (*azureStore, error) {
+	account := config.AzureStorageAccount
+	if !azureAccountPattern.MatchString(account) {
+		return nil, fmt.Errorf("%s: invalid storage account name %q", EnvAzureStorageAccount, account)
+	}
+	s := &azureStore{
+		client:   newOutboundClient(0),
+		account:  account,
+		endpoint: "https://" + account + ".blob.core.windows.net",
+	}
+	if config.AzureStorageKey != "" {
+		key, err := base64.StdEncoding.DecodeString(config.AzureStorageKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid key: %w", EnvAzureStorageKey, err)
+		}
+		s.key = key
+	}
+	if config.AzureStorageSASToken != "" {
+		sas, err := url.ParseQuery(strings.TrimPrefix(config.AzureStorageSASToken, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid token: %w", EnvAzureStorageSASToken, err)
+		}
+		s.sas = sas
+	}
+	return s, nil
+}
+
+// Locate checks the container and blob names
+func (s *azureStore) Locate(container, blob string) (string, error) {
+	if !azureContainerPattern.MatchString(container) || strings.Contains(container, "--") {
+		return "", errors.New("invalid container name")
+	}
+	if blob == "" || len(blob) > 1024 || strings.ContainsAny(blob, "\r\n") {
+		return "", errors.New("invalid blob name")
+	}
+	return "azure://" + s.account + "/" + container + "/" + blob, nil
+}
+
+// Open downloads the blob's contents
+func (s *azureStore) Open(ctx context.Context, container, blob string) (io.ReadCloser, error) {
+	path := "/" + container + "/" + escapeBlobName(blob)
+	rawURL := s.endpoint + path
+	if s.sas != nil {
+		rawURL += "?" + s.sas.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	if s.key != nil {
+		req.Header.Set("Authorization", "SharedKey "+s.account+":"+s.sign(req.Header, path))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStorageResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// escapeBlobName escapes each segment of a blob name, keeping the slashes
+// of virtual directories
+func escapeBlobName(blob string) string {
+	segments := strings.Split(blob, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// sign returns the Shared Key signature of a GET request without a body:
+// the standard headers are all empty, followed by the x-ms-* headers and
+// the canonicalized resource. The SAS query is not part of the resource,
+// as a request is never signed with both.
+func (s *azureStore) sign(header http.Header, path string) string {
+	var b strings.Builder
+	b.WriteString(http.MethodGet + "\n")
+	b.WriteString(strings.Repeat("\n", 11))
+
+	var names []string
+	for name := range header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.WriteString(name + ":" + strings.TrimSpace(header.Get(name)) + "\n")
+	}
+	b.WriteString("/" + s.account + path)
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(b.String()))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
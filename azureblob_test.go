@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newFakeBlobService serves one blob, requiring a valid Shared Key
+// signature or the SAS signature "sig"
+func newFakeBlobService(t *testing.T, s *azureStore) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-ms-version") != azureAPIVersion || r.Header.Get("x-ms-date") == "" {
+			http.Error(w, "missing headers", http.StatusBadRequest)
+			return
+		}
+		authorized := r.URL.Query().Get("sig") == "sig"
+		if s.key != nil {
+			authorized = r.Header.Get("Authorization") == "SharedKey scans:"+s.sign(r.Header, r.URL.EscapedPath())
+		}
+		if !authorized {
+			http.Error(w, "AuthenticationFailed", http.StatusForbidden)
+			return
+		}
+		if r.URL.EscapedPath() != "/uploads/2024/q1%20report.pdf" {
+			http.Error(w, "BlobNotFound", http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, "blob contents")
+	}))
+	t.Cleanup(server.Close)
+	s.endpoint = server.URL
+	return server
+}
+
+func TestAzureStoreOpen(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("account key"))
+	tests := []struct {
+		name   string
+		config *Config
+		want   int
+	}{
+		{name: "shared key", config: &Config{AzureStorageAccount: "scans", AzureStorageKey: key}, want: http.StatusOK},
+		{name: "SAS token", config: &Config{AzureStorageAccount: "scans", AzureStorageSASToken: "?sv=2021-08-06&sp=r&sig=sig"}, want: http.StatusOK},
+		{name: "anonymous", config: &Config{AzureStorageAccount: "scans"}, want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		s, err := newAzureStore(tt.config)
+		if err != nil {
+			t.Fatalf("%s: newAzureStore() error: %v", tt.name, err)
+		}
+		newFakeBlobService(t, s)
+
+		body, err := s.Open(context.Background(), "uploads", "2024/q1 report.pdf")
+		if tt.want != http.StatusOK {
+			if got := storageRequestError(err); got.status != tt.want {
+				t.Errorf("%s: Open() error = %v, want %d", tt.name, err, tt.want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: Open() error: %v", tt.name, err)
+		}
+		data, _ := io.ReadAll(body)
+		body.Close()
+		if string(data) != "blob contents" {
+			t.Errorf("%s: Open() = %q", tt.name, data)
+		}
+	}
+}
+
+func TestAzureStoreLocate(t *testing.T) {
+	s := &azureStore{account: "scans"}
+	tests := []struct {
+		container, blob string
+		want            string
+		wantErr         bool
+	}{
+		{container: "uploads", blob: "2024/report.pdf", want: "azure://scans/uploads/2024/report.pdf"},
+		{container: "up-loads", blob: "x", want: "azure://scans/up-loads/x"},
+		{container: "up--loads", blob: "x", wantErr: true},
+		{container: "-uploads", blob: "x", wantErr: true},
+		{container: "Uploads", blob: "x", wantErr: true},
+		{container: "ab", blob: "x", wantErr: true},
+		{container: "uploads", blob: "", wantErr: true},
+		{container: "uploads", blob: strings.Repeat("x", 1025), wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := s.Locate(tt.container, tt.blob)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("Locate(%q, %q) = %q, %v", tt.container, tt.blob, got, err)
+		}
+	}
+}
+
+func TestNewAzureStoreErrors(t *testing.T) {
+	tests := []*Config{
+		{AzureStorageAccount: "Invalid_Account"},
+		{AzureStorageAccount: "scans", AzureStorageKey: "not base64!"},
+	}
+	for _, cfg := range tests {
+		if _, err := newAzureStore(cfg); err == nil {
+			t.Errorf("newAzureStore(%+v) accepted an invalid config", cfg)
+		}
+	}
+}
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Backup archive format:
+//
+//	magic (8 bytes) | base nonce (12 bytes) | chunk...
+//	chunk = length (4 bytes, big endian) | AES-256-GCM ciphertext
+//
+// The plaintext is a gzipped tar stream. Each chunk is sealed with the base
+// nonce XOR the chunk counter, and the last chunk is authenticated with a
+// final flag so truncated archives are detected.
+const backupMagic = "CRBKUP01"
+
+// Plaintext size of each encrypted chunk
+const backupChunkSize = 64 << 10
+
+// Name of the manifest entry inside the archive
+const backupManifestName = "manifest.json"
+
+// Signature database files managed by freshclam; these are re-downloaded
+// after a restore and are not included in backups.
+var officialSignatureExts = []string{".cvd", ".cld", ".cdiff", ".dat", ".tmp"}
+
+// BackupManifest describes the archive contents
+type BackupManifest struct {
+	CreatedAt time.Time `json:"created_at"`
+	Sources   []string  `json:"sources"`
+	Files     int       `json:"files"`
+}
+
+// backupSource is a piece of service state included in backups.
+// Entries are stored in the archive under "<name>/<relative path>".
+type backupSource struct {
+	name    string
+	dir     string                 // Directory holding the state
+	include func(name string) bool // Which files in dir belong to the backup
+	private bool                   // Restored readable by the owner only (keys, malware)
+	tree    bool                   // Includes files in subdirectories
+}
+
+// backupSources returns the state that exists for the given config.
+// New subsystems with on-disk state register themselves here.
+func backupSources(config *Config) []backupSource {
+	var sources []backupSource
+
+	if config.SignatureDir != "" {
+		sources = append(sources, backupSource{
+			name:    "signatures",
+			dir:     config.SignatureDir,
+			include: isCustomSignatureFile,
+		})
+	}
+
+	if config.ScanRoutesFile != "" {
+		sources = append(sources, fileBackupSource("routes", config.ScanRoutesFile))
+	}
+
+	if config.TenantsFile != "" {
+		sources = append(sources, fileBackupSource("tenants", config.TenantsFile))
+	}
+
+	if config.ThreatClassesFile != "" {
+		sources = append(sources, fileBackupSource("threat-classes", config.ThreatClassesFile))
+	}
+
+	if config.ThreatTagsFile != "" {
+		sources = append(sources, fileBackupSource("threat-tags", config.ThreatTagsFile))
+	}
+
+	// Quarantined files keep their modification time, which
+	// QUARANTINE_RETENTION counts from
+	if config.WatchQuarantineDir != "" {
+		sources = append(sources, backupSource{
+			name:    "quarantine",
+			dir:     config.WatchQuarantineDir,
+			include: func(name string) bool { return true },
+			private: true,
+			tree:    true,
+		})
+	}
+
+	// Records name files and identities. The running service keeps its own
+	// copy in memory and reloads the file at startup
+	if config.ScanHistoryFile != "" {
+		source := fileBackupSource("history", config.ScanHistoryFile)
+		source.private = true
+		sources = append(sources, source)
+	}
+
+	if config.ResultTokenKeyFile != "" {
+		source := fileBackupSource("result-token-key", config.ResultTokenKeyFile)
+		source.private = true
+		sources = append(sources, source)
+	}
+
+	return sources
+}
+
+// files lists the files of a source, as slash-separated paths relative to
+// its directory
+func (source *backupSource) files() ([]string, error) {
+	if !source.tree {
+		entries, err := os.ReadDir(source.dir)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, f := range entries {
+			if f.Type().IsRegular() && source.include(f.Name()) {
+				files = append(files, f.Name())
+			}
+		}
+		return files, nil
+	}
+
+	var files []string
+	err := filepath.WalkDir(source.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && source.include(d.Name()) {
+			rel, _ := filepath.Rel(source.dir, p)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return files, err
+}
+
+// validName reports whether an archive entry's path is one the source could
+// have written: a file name, or for trees a relative path inside dir
+func (source *backupSource) validName(fileName string) bool {
+	if fileName == "" || fileName == "." || fileName == ".." || path.Clean(fileName) != fileName || path.IsAbs(fileName) || !source.include(path.Base(fileName)) {
+		return false
+	}
+	if !source.tree {
+		return fileName == path.Base(fileName)
+	}
+	for _, element := range strings.Split(fileName, "/") {
+		if element == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// fileBackupSource returns a source holding a single file
+func fileBackupSource(name, file string) backupSource {
+	base := filepath.Base(file)
+	return backupSource{
+		name:    name,
+		dir:     filepath.Dir(file),
+		include: func(name string) bool { return name == base },
+	}
+}
+
+// isCustomSignatureFile reports whether a signature directory entry is a
+// locally maintained signature (not a freshclam-managed database)
+func isCustomSignatureFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == "" || containsString(officialSignatureExts, ext) {
+		return false
+	}
+	return !strings.HasPrefix(name, ".")
+}
+
+// parseBackupKey decodes the hex-encoded 256-bit backup key
+func parseBackupKey(hexKey string) ([]byte, error) {
+	if hexKey == "" {
+		return nil, fmt.Errorf("%s is not set", EnvBackupKey)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(hexKey))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must be 64 hex characters (256-bit key)", EnvBackupKey)
+	}
+	return key, nil
+}
+
+// WriteBackup writes an encrypted backup of all state sources to w.
+// Returns the number of files archived.
+func WriteBackup(w io.Writer, config *Config) (int, error) {
+	key, err := parseBackupKey(config.BackupKey)
+	if err != nil {
+		return 0, err
+	}
+
+	encWriter, err := newBackupEncrypter(w, key)
+	if err != nil {
+		return 0, err
+	}
+	gzWriter := gzip.NewWriter(encWriter)
+	tarWriter := tar.NewWriter(gzWriter)
+
+	sources := backupSources(config)
+	manifest := BackupManifest{CreatedAt: time.Now().UTC()}
+
+	var entries []string
+	for _, source := range sources {
+		manifest.Sources = append(manifest.Sources, source.name)
+		files, err := source.files()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, fmt.Errorf("failed to read %s: %w", source.name, err)
+		}
+		for _, f := range files {
+			entries = append(entries, source.name+"/"+f)
+		}
+	}
+	manifest.Files = len(entries)
+
+	// Manifest goes first so restore can validate before touching anything
+	manifestJSON, _ := json.MarshalIndent(manifest, "", "  ")
+	if err := writeTarEntry(tarWriter, backupManifestName, bytes.NewReader(manifestJSON), int64(len(manifestJSON)), manifest.CreatedAt); err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		sourceName, fileName, _ := strings.Cut(entry, "/")
+		source := findBackupSource(sources, sourceName)
+		if err := archiveFile(tarWriter, entry, filepath.Join(source.dir, fileName)); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return 0, err
+	}
+	if err := gzWriter.Close(); err != nil {
+		return 0, err
+	}
+	if err := encWriter.Close(); err != nil {
+		return 0, err
+	}
+
+	return len(entries), nil
+}
+
+// RestoreBackup decrypts an archive from r and restores its files.
+// Only sources configured on this instance are restored. The archive is fully
+// authenticated, and every entry checked, before any file is written.
+func RestoreBackup(r io.Reader, config *Config) (*BackupManifest, error) {
+	key, err := parseBackupKey(config.BackupKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decrypt into a temp file first: an archive that fails authentication
+	// part-way must not leave a half-restored state behind. It is staged in
+	// SCAN_TMP_DIR like uploads, keeping SCAN_TMP_MIN_FREE_MB free there.
+	stagingDir := config.ScanTmpDir
+	if stagingDir == "" {
+		stagingDir = os.TempDir()
+	}
+	if err := checkDiskSpace(stagingDir, 0, config.ScanTmpMinFree); err != nil {
+		return nil, err
+	}
+	plain, err := os.CreateTemp(stagingDir, "clamav-restore-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(plain.Name())
+	defer plain.Close()
+
+	if _, err := io.Copy(plain, newBackupDecrypter(r, key)); err != nil {
+		return nil, fmt.Errorf("failed to decrypt backup: %w", err)
+	}
+
+	// Check every entry before writing any, so a bad entry late in the
+	// archive doesn't leave the ones before it restored
+	sources := backupSources(config)
+	manifest, err := readBackupEntries(plain, sources, func(header *tar.Header, source *backupSource, fileName string, r io.Reader) error {
+		if source == nil {
+			log.Printf("Restore: skipping %s (source not configured)", header.Name)
+			return nil
+		}
+		// Security check: archive entries must stay inside the source's directory
+		if !source.validName(fileName) {
+			return fmt.Errorf("invalid entry in backup: %s", header.Name)
+		}
+		if header.Typeflag != tar.TypeReg || header.Size < 0 {
+			return fmt.Errorf("invalid entry in backup: %s is not a regular file", header.Name)
+		}
+		// Reading it through catches entries cut short
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return fmt.Errorf("invalid backup archive: %s: %w", header.Name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = readBackupEntries(plain, sources, func(header *tar.Header, source *backupSource, fileName string, r io.Reader) error {
+		if source == nil {
+			return nil
+		}
+		targetPath := filepath.Join(source.dir, filepath.FromSlash(fileName))
+		dirMode, mode := os.FileMode(0755), os.FileMode(0644)
+		if source.private {
+			dirMode, mode = 0750, 0600
+		}
+		if err := os.MkdirAll(filepath.Dir(targetPath), dirMode); err != nil {
+			return err
+		}
+		if err := restoreFile(r, targetPath, mode); err != nil {
+			return err
+		}
+		os.Chtimes(targetPath, header.ModTime, header.ModTime)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// readBackupEntries reads the decrypted archive in plain from the start: the
+// manifest, then each file entry, passed to fn with its source (nil if not
+// configured here) and its name within the source
+func readBackupEntries(plain io.ReadSeeker, sources []backupSource, fn func(header *tar.Header, source *backupSource, fileName string, r io.Reader) error) (*BackupManifest, error) {
+	if _, err := plain.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	gzReader, err := gzip.NewReader(plain)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup archive: %w", err)
+	}
+	tarReader := tar.NewReader(gzReader)
+
+	header, err := tarReader.Next()
+	if err != nil || header.Name != backupManifestName {
+		return nil, fmt.Errorf("invalid backup archive: missing manifest")
+	}
+	var manifest BackupManifest
+	if err := json.NewDecoder(tarReader).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid backup manifest: %w", err)
+	}
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid backup archive: %w", err)
+		}
+
+		sourceName, fileName, ok := strings.Cut(header.Name, "/")
+		source := findBackupSource(sources, sourceName)
+		if !ok {
+			source = nil
+		}
+		if err := fn(header, source, fileName, tarReader); err != nil {
+			return nil, err
+		}
+	}
+	return &manifest, nil
+}
+
+// findBackupSource returns the source with the given name, or nil
+func findBackupSource(sources []backupSource, name string) *backupSource {
+	for i := range sources {
+		if sources[i].name == name {
+			return &sources[i]
+		}
+	}
+	return nil
+}
+
+// archiveFile adds a file from disk to the tar stream
+func archiveFile(tw *tar.Writer, name, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return writeTarEntry(tw, name, f, info.Size(), info.ModTime())
+}
+
+// writeTarEntry writes a regular file entry to the tar stream
+func writeTarEntry(tw *tar.Writer, name string, r io.Reader, size int64, modTime time.Time) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+// restoreFile writes a file atomically (temp file + rename)
+func restoreFile(r io.Reader, targetPath string, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(targetPath), ".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), targetPath)
+}
+
+// backupEncrypter encrypts a stream in authenticated chunks
+type backupEncrypter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	buf     []byte
+}
+
+// newBackupEncrypter writes the archive header and returns a chunk writer.
+// Close must be called to write the final chunk.
+func newBackupEncrypter(w io.Writer, key []byte) (*backupEncrypter, error) {
+	aead, err := newBackupAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(append([]byte(backupMagic), nonce...)); err != nil {
+		return nil, err
+	}
+
+	return &backupEncrypter{
+		w:     w,
+		aead:  aead,
+		nonce: nonce,
+		buf:   make([]byte, 0, backupChunkSize),
+	}, nil
+}
+
+// Write implements io.Writer
+func (e *backupEncrypter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Only flush a full chunk once more data arrives, so the final
+		// chunk written by Close is never empty unless the stream is
+		if len(e.buf) == backupChunkSize {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(e.buf[len(e.buf):backupChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes the final chunk
+func (e *backupEncrypter) Close() error {
+	return e.flush(true)
+}
+
+// flush seals and writes the buffered chunk
+func (e *backupEncrypter) flush(final bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.nonce, e.counter), e.buf, chunkAD(final))
+	e.counter++
+	e.buf = e.buf[:0]
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := e.w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// backupDecrypter decrypts a chunked archive stream
+type backupDecrypter struct {
+	r       io.Reader
+	key     []byte
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	buf     []byte
+	done    bool
+	err     error
+}
+
+// newBackupDecrypter returns a reader yielding the decrypted plaintext.
+// Reads fail if the archive is tampered with or truncated.
+func newBackupDecrypter(r io.Reader, key []byte) io.Reader {
+	return &backupDecrypter{r: r, key: key}
+}
+
+// Read implements io.Reader
+func (d *backupDecrypter) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.readChunk()
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// readChunk reads and opens the next chunk (or the header on first call)
+func (d *backupDecrypter) readChunk() error {
+	if d.aead == nil {
+		aead, err := newBackupAEAD(d.key)
+		if err != nil {
+			return err
+		}
+		header := make([]byte, len(backupMagic)+aead.NonceSize())
+		if _, err := io.ReadFull(d.r, header); err != nil || string(header[:len(backupMagic)]) != backupMagic {
+			return fmt.Errorf("not a backup archive")
+		}
+		d.aead = aead
+		d.nonce = header[len(backupMagic):]
+	}
+
+	var length [4]byte
+	if _, err := io.ReadFull(d.r, length[:]); err != nil {
+		return fmt.Errorf("backup archive is truncated")
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > backupChunkSize+uint32(d.aead.Overhead()) {
+		return fmt.Errorf("backup archive is corrupt")
+	}
+
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return fmt.Errorf("backup archive is truncated")
+	}
+
+	nonce := chunkNonce(d.nonce, d.counter)
+	d.counter++
+
+	// Try as a regular chunk first, then as the final chunk
+	plain, err := d.aead.Open(nil, nonce, sealed, chunkAD(false))
+	if err != nil {
+		plain, err = d.aead.Open(nil, nonce, sealed, chunkAD(true))
+		if err != nil {
+			return errors.New("backup archive failed authentication (wrong key or corrupt)")
+		}
+		d.done = true
+	}
+
+	d.buf = plain
+	return nil
+}
+
+// newBackupAEAD creates the AES-256-GCM cipher
+func newBackupAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce derives the nonce for a chunk from the base nonce and counter
+func chunkNonce(base []byte, counter uint64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+	var ctr [8]byte
+	binary.BigEndian.PutUint64(ctr[:], counter)
+	for i := range ctr {
+		nonce[len(nonce)-8+i] ^= ctr[i]
+	}
+	return nonce
+}
+
+// chunkAD returns the additional data marking final and non-final chunks
+func chunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// backupHandler streams an encrypted backup (GET /admin/backup)
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := parseBackupKey(config.BackupKey); err != nil {
+		log.Printf("Backup unavailable: %v", err)
+		sendErrorStatus(w, http.StatusServiceUnavailable, "Backups are not configured")
+		return
+	}
+
+	filename := fmt.Sprintf("clamav-rest-backup-%s.bin", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	count, err := WriteBackup(w, config)
+	if err != nil {
+		// Headers are already sent; the truncated archive will fail authentication
+		log.Printf("Backup failed: %v", err)
+		return
+	}
+	log.Printf("Backup created: %d files", count)
+}
+
+// restoreHandler restores an uploaded backup archive (POST /admin/restore)
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Fail fast when the archive (if its size is declared) won't fit on disk
+	if err := checkDiskSpace(tempDir(), max(r.ContentLength, 0), config.ScanTmpMinFree); err != nil {
+		log.Printf("Rejected restore: %v", err)
+		sendErrorStatus(w, http.StatusInsufficientStorage, "Not enough disk space to restore the backup")
+		return
+	}
+
+	manifest, err := RestoreBackup(r.Body, config)
+	if errors.Is(err, errInsufficientSpace) {
+		log.Printf("Restore failed: %v", err)
+		sendErrorStatus(w, http.StatusInsufficientStorage, "Not enough disk space to restore the backup")
+		return
+	}
+	if err != nil {
+		log.Printf("Restore failed: %v", err)
+		sendErrorStatus(w, http.StatusBadRequest, "Restore failed")
+		return
+	}
+
+	log.Printf("Restored backup from %s (%d files); reload clamd to apply restored signatures",
+		manifest.CreatedAt.Format(time.RFC3339), manifest.Files)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifest)
+}
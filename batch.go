@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BatchItem is one file of a batch: a remote URL (as for /scan/remote) or
+// an object reference (as for /scan/object)
+type BatchItem struct {
+	URL      string `json:"url,omitempty"` // sftp:// or ftps:// URL
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	Provider string `json:"provider,omitempty"` // Object storage provider
+	Bucket   string `json:"bucket,omitempty"`
+	Object   string `json:"object,omitempty"`
+}
+
+// BatchScanRequest is the body of POST /scan/batch
+type BatchScanRequest struct {
+	Items []BatchItem `json:"items"`
+}
+
+// BatchItemResult is the scan result of one item. Items that could not be
+// fetched or scanned have status "error" and the HTTP status the single
+// item endpoint would have returned.
+type BatchItemResult struct {
+	Source string `json:"source"` // The item's URL or object reference
+	*ScanResponse
+	ErrorStatus int `json:"error_status,omitempty"`
+}
+
+// BatchScanResponse is the result of a batch scan. The batch is infected
+// if any item is, "error" if any other item failed or was rejected,
+// "suspicious" if any other item was flagged, and "clean_with_skips" if
+// entries of an otherwise clean item were skipped.
+type BatchScanResponse struct {
+	Status     string            `json:"status"`  // "clean", "clean_with_skips", "infected", "suspicious", "error"
+	Results    []BatchItemResult `json:"results"` // In request order
+	ScanTimeMs int64             `json:"scan_time_ms"`
+}
+
+// batchScanHandler handles POST /scan/batch. Small batches are answered
+// directly; large ones should be sent with ?async=true and their results
+// collected from the job.
+func batchScanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	startTime := time.Now()
+	if rejectWhileStarting(w, r, startTime) {
+		return
+	}
+
+	var request BatchScanRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		sendErrorStatus(w, http.StatusBadRequest, "Invalid batch scan request")
+		return
+	}
+	if len(request.Items) == 0 || len(request.Items) > config.BatchMaxItems {
+		sendErrorStatus(w, http.StatusBadRequest, fmt.Sprintf("A batch must have 1 to %d items", config.BatchMaxItems))
+		return
+	}
+	for i, item := range request.Items {
+		if (item.URL != "") == (item.Provider != "") {
+			sendErrorStatus(w, http.StatusBadRequest, fmt.Sprintf("Item %d must have either a url or a provider", i))
+			return
+		}
+	}
+
+	if wantsAsync(r) && jobs != nil {
+		submitBatchJob(w, r, request.Items, startTime)
+		return
+	}
+	response := scanBatch(r.Context(), r, request.Items, startTime, nil)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// submitBatchJob starts an async batch scan and responds with 202 Accepted
+// and the job's status and events URLs. The job's percent counts finished
+// items.
+func submitBatchJob(w http.ResponseWriter, r *http.Request, items []BatchItem, startTime time.Time) {
+	key, reqErr := idempotencyKey(r)
+	if reqErr != nil {
+		sendRequestError(w, reqErr)
+		return
+	}
+	job, existing := jobs.CreateOnce(jobOwner(r), config.BasePath, key)
+	if existing {
+		log.Printf("Replaying async job %s for a repeated Idempotency-Key", job.ID)
+		acceptJob(w, job, true)
+		return
+	}
+	if job == nil {
+		log.Printf("Async job limit reached, rejecting batch of %d items", len(items))
+		sendRequestError(w, &requestError{status: http.StatusServiceUnavailable, message: "Too many scan jobs, try again later", retryAfter: config.ScanQueueWait})
+		return
+	}
+
+	lease := coordinator.Hold(job)
+	err := jobs.persistBatch(job, r, items)
+	if err != nil {
+		log.Printf("Failed to save async job %s, it won't survive a restart: %v", job.ID, err)
+	}
+	if err == nil && lease.Share() {
+		log.Printf("Accepted async batch job %s (%d items), shared with the cluster", job.ID, len(items))
+		acceptJob(w, job, false)
+		return
+	}
+
+	ctx := job.start(r.Context())
+	jobRequest := r.Clone(ctx)
+	release := detachTenantSlot(r.Context())
+	jobs.Go(job, func() {
+		if release != nil {
+			defer release()
+		}
+		defer lease.Release()
+		runBatchJob(ctx, job, jobRequest, items, startTime)
+	})
+
+	log.Printf("Accepted async batch job %s (%d items)", job.ID, len(items))
+	acceptJob(w, job, false)
+}
+
+// runBatchJob scans an async batch job's items and records the results
+func runBatchJob(ctx context.Context, job *ScanJob, r *http.Request, items []BatchItem, startTime time.Time) {
+	job.setProgress(stageScanning, 0)
+	job.finishBatch(scanBatch(ctx, r, items, startTime, func(done int) {
+		job.setProgress(stageScanning, done*100/len(items))
+	}))
+	jobs.persistFinished(job)
+}
+
+// scanBatch fetches and scans the items, BatchConcurrency at a time.
+// progress (if set) is called with the number of finished items.
+func scanBatch(ctx context.Context, r *http.Request, items []BatchItem, startTime time.Time, progress func(done int)) *BatchScanResponse {
+	results := make([]BatchItemResult, len(items))
+	slots := make(chan struct{}, config.BatchConcurrency)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	done := 0
+	for i := range items {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() { <-slots; wg.Done() }()
+			results[i] = scanBatchItem(ctx, r, &items[i])
+			if progress != nil {
+				mu.Lock()
+				done++
+				progress(done)
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	response := &BatchScanResponse{Status: "clean", Results: results, ScanTimeMs: time.Since(startTime).Milliseconds()}
+	for _, result := range results {
+		switch {
+		case result.Status == "infected" || result.Status == "timeout" && len(result.Threats) > 0:
+			response.Status = "infected"
+		case (result.Status == "error" || result.Status == "rejected" || result.Status == "timeout") && response.Status != "infected":
+			response.Status = "error"
+		case result.Status == "suspicious" && (response.Status == "clean" || response.Status == "clean_with_skips"):
+			response.Status = "suspicious"
+		case result.Status == "clean_with_skips" && response.Status == "clean":
+			response.Status = "clean_with_skips"
+		}
+	}
+	metrics.Count("batch.items", int64(len(items)))
+	log.Printf("Batch scan completed: %d items - %s (%dms)", len(items), response.Status, response.ScanTimeMs)
+	return response
+}
+
+// scanBatchItem fetches and scans one item, recording it like a single scan
+func scanBatchItem(ctx context.Context, r *http.Request, item *BatchItem) BatchItemResult {
+	startTime := time.Now()
+	source, upload, reqErr := fetchBatchItem(ctx, item)
+	var response *ScanResponse
+	if reqErr == nil {
+		response, reqErr = executeScan(ctx, r, config, scanner, upload, startTime)
+		upload.remove()
+	} else {
+		recordScan(scanTags(r), "error", time.Since(startTime), 0, nil)
+	}
+	if reqErr != nil {
+		response = &ScanResponse{Status: "error", Error: reqErr.message, ScanTimeMs: time.Since(startTime).Milliseconds()}
+		return BatchItemResult{Source: source, ScanResponse: response, ErrorStatus: reqErr.status}
+	}
+	return BatchItemResult{Source: source, ScanResponse: response}
+}
+
+// fetchBatchItem downloads an item with the scanner for its kind, returning
+// the item's source for the result
+func fetchBatchItem(ctx context.Context, item *BatchItem) (string, *uploadedFile, *requestError) {
+	if item.URL != "" {
+		if remoteScanner == nil {
+			return item.URL, nil, &requestError{status: http.StatusBadRequest, message: "Remote scanning is disabled"}
+		}
+		request := &RemoteScanRequest{URL: item.URL, Username: item.Username, Password: item.Password}
+		u, reqErr := remoteScanner.Resolve(request)
+		if reqErr != nil {
+			return item.URL, nil, reqErr
+		}
+		upload, reqErr := remoteScanner.Fetch(ctx, u, request, config.MaxUploadSize)
+		return item.URL, upload, reqErr
+	}
+
+	source := item.Provider + ":" + item.Bucket + "/" + item.Object
+	if objectScanner == nil {
+		return source, nil, &requestError{status: http.StatusBadRequest, message: "Object storage scanning is disabled"}
+	}
+	request := &ObjectScanRequest{Provider: item.Provider, Bucket: item.Bucket, Object: item.Object}
+	upload, reqErr := objectScanner.Fetch(ctx, request, config.MaxUploadSize)
+	return source, upload, reqErr
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useBatchScanner enables remote scans (fake curl) and object scans (fake
+// store) for /scan/batch
+func useBatchScanner(t *testing.T) *Config {
+	t.Helper()
+	cfg, _ := useRemoteScanner(t)
+	cfg.BatchMaxItems = 3
+	cfg.BatchConcurrency = 2
+
+	oldObjectScanner := objectScanner
+	objectScanner = &ObjectScanner{stores: map[string]ObjectStore{storageGCS: &fakeStore{objects: map[string]string{
+		"uploads/clean.txt": "hello",
+		"uploads/eicar.com": "EICAR test",
+	}}}}
+	t.Cleanup(func() { objectScanner = oldObjectScanner })
+	return cfg
+}
+
+func postBatchScan(t *testing.T, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	batchScanHandler(recorder, req)
+	return recorder
+}
+
+func TestBatchScanHandler(t *testing.T) {
+	useBatchScanner(t)
+
+	recorder := postBatchScan(t, "/scan/batch", `{"items": [
+		{"url": "sftp://sftp.example.com/outbound/order.edi"},
+		{"provider": "gcs", "bucket": "uploads", "object": "eicar.com"},
+		{"provider": "gcs", "bucket": "uploads", "object": "missing"}
+	]}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+	var response BatchScanResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if response.Status != "infected" || len(response.Results) != 3 {
+		t.Fatalf("response = %+v", response)
+	}
+
+	want := []struct {
+		source      string
+		status      string
+		errorStatus int
+	}{
+		{source: "sftp://sftp.example.com/outbound/order.edi", status: "clean"},
+		{source: "gcs:uploads/eicar.com", status: "infected"},
+		{source: "gcs:uploads/missing", status: "error", errorStatus: http.StatusNotFound},
+	}
+	for i, w := range want {
+		result := response.Results[i]
+		if result.Source != w.source || result.Status != w.status || result.ErrorStatus != w.errorStatus {
+			t.Errorf("results[%d] = %+v %+v, want %+v", i, result, result.ScanResponse, w)
+		}
+	}
+}
+
+func TestBatchScanHandlerErrors(t *testing.T) {
+	useBatchScanner(t)
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "invalid JSON", body: `{"items":`},
+		{name: "no items", body: `{"items": []}`},
+		{name: "too many items", body: `{"items": [{"url": "sftp://a/1"}, {"url": "sftp://a/2"}, {"url": "sftp://a/3"}, {"url": "sftp://a/4"}]}`},
+		{name: "url and object", body: `{"items": [{"url": "sftp://a/1", "provider": "gcs", "bucket": "b", "object": "o"}]}`},
+		{name: "neither", body: `{"items": [{"bucket": "b"}]}`},
+	}
+	for _, tt := range tests {
+		if recorder := postBatchScan(t, "/scan/batch", tt.body); recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", tt.name, recorder.Code)
+		}
+	}
+}
+
+func TestAsyncBatchScan(t *testing.T) {
+	useBatchScanner(t)
+	useJobStore(t, NewJobStore(10, time.Minute))
+
+	recorder := postBatchScan(t, "/scan/batch?async=true", `{"items": [
+		{"provider": "gcs", "bucket": "uploads", "object": "clean.txt"},
+		{"url": "ftps://ftp.example.com/pub/report.pdf"}
+	]}`)
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", recorder.Code, recorder.Body)
+	}
+	var accepted JobResponse
+	json.NewDecoder(recorder.Body).Decode(&accepted)
+
+	var status JobResponse
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		recorder := httptest.NewRecorder()
+		jobStatusHandler(recorder, httptest.NewRequest(http.MethodGet, "/scan/jobs/"+accepted.ID, nil))
+		status = JobResponse{}
+		json.NewDecoder(recorder.Body).Decode(&status)
+		if status.Stage == stageDone {
+			break
+		}
+	}
+	if status.Batch == nil || status.Batch.Status != "clean" || len(status.Batch.Results) != 2 {
+		t.Errorf("job = %+v, want clean batch of 2", status)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Actions for archives that look like decompression bombs (ARCHIVE_BOMB_ACTION)
+const (
+	bombActionReject = "reject" // Answer 422 without scanning
+	bombActionFlag   = "flag"   // Scan the archive as a single file and mark it suspicious
+)
+
+// Decompression bomb checks, as reported in RejectedReason.Check
+const (
+	bombCompressionRatio = "compression_ratio"   // Uncompressed size far larger than the archive
+	bombOverlappingFiles = "overlapping_entries" // Entries sharing compressed data
+	bombNestedDuplicates = "nested_duplicates"   // Many identical nested archives
+	bombRequestBudget    = "request_budget"      // The request's decompression budget is spent
+)
+
+// ratioMinExtractedSize is the uncompressed size below which the
+// compression ratio isn't checked; small files of zeros or repeated text
+// compress far better than any sensible limit
+const ratioMinExtractedSize = 1 << 20
+
+// nestedArchiveExtensions are the entry names counted as nested archives
+var nestedArchiveExtensions = map[string]bool{
+	".zip": true, ".jar": true, ".gz": true, ".tgz": true, ".tar": true,
+	".bz2": true, ".xz": true, ".7z": true, ".rar": true,
+}
+
+// RejectedReason explains why an archive was rejected (or, with
+// ARCHIVE_BOMB_ACTION=flag, marked suspicious) as a likely decompression bomb
+type RejectedReason struct {
+	Check  string  `json:"check"`           // compression_ratio, overlapping_entries, nested_duplicates or request_budget
+	Detail string  `json:"detail"`          // Human-readable explanation
+	Value  float64 `json:"value,omitempty"` // Measured ratio, duplicate count or amount extracted
+	Limit  float64 `json:"limit,omitempty"` // The configured threshold
+}
+
+// bombError stops the extraction of an archive that looks like a
+// decompression bomb
+type bombError struct {
+	reason *RejectedReason
+}
+
+func (e *bombError) Error() string {
+	return "possible decompression bomb: " + e.reason.Detail
+}
+
+// checkCompressionRatio returns a reason if extracted bytes from an
+// archive of size bytes exceed ARCHIVE_MAX_RATIO
+func checkCompressionRatio(config *Config, size, extracted int64) *RejectedReason {
+	if config.ArchiveMaxRatio <= 0 || extracted < ratioMinExtractedSize {
+		return nil
+	}
+	ratio := float64(extracted) / float64(max(size, 1))
+	if ratio <= float64(config.ArchiveMaxRatio) {
+		return nil
+	}
+	return &RejectedReason{
+		Check:  bombCompressionRatio,
+		Detail: fmt.Sprintf("%d bytes expand to %d bytes (ratio %.0f, limit %d)", size, extracted, ratio, config.ArchiveMaxRatio),
+		Value:  ratio,
+		Limit:  float64(config.ArchiveMaxRatio),
+	}
+}
+
+// checkZipBomb inspects a ZIP's central directory before extraction: the
+// declared compression ratio, entries whose compressed data overlaps (a
+// non-recursive bomb), and repeated identical nested archives (a recursive
+// one, like 42.zip)
+func checkZipBomb(config *Config, reader *zip.Reader, size int64) *RejectedReason {
+	var declared int64
+	for _, file := range reader.File {
+		declared += int64(file.UncompressedSize64)
+	}
+	if reason := checkCompressionRatio(config, size, declared); reason != nil {
+		return reason
+	}
+
+	type span struct {
+		name       string
+		start, end int64
+	}
+	spans := make([]span, 0, len(reader.File))
+	for _, file := range reader.File {
+		offset, err := file.DataOffset()
+		if err != nil || file.CompressedSize64 == 0 {
+			continue
+		}
+		spans = append(spans, span{file.Name, offset, offset + int64(file.CompressedSize64)})
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	for i := 1; i < len(spans); i++ {
+		if spans[i].start < spans[i-1].end {
+			return &RejectedReason{
+				Check:  bombOverlappingFiles,
+				Detail: fmt.Sprintf("entries %s and %s share compressed data", sanitizeFilename(spans[i-1].name), sanitizeFilename(spans[i].name)),
+			}
+		}
+	}
+
+	if config.ArchiveMaxNestedDuplicates <= 0 {
+		return nil
+	}
+	type content struct {
+		crc  uint32
+		size uint64
+	}
+	nested := make(map[content]int)
+	for _, file := range reader.File {
+		if !nestedArchiveExtensions[strings.ToLower(filepath.Ext(file.Name))] {
+			continue
+		}
+		key := content{file.CRC32, file.UncompressedSize64}
+		nested[key]++
+		if count := nested[key]; count > config.ArchiveMaxNestedDuplicates {
+			return &RejectedReason{
+				Check:  bombNestedDuplicates,
+				Detail: fmt.Sprintf("%d identical nested archives (limit %d)", count, config.ArchiveMaxNestedDuplicates),
+				Value:  float64(count),
+				Limit:  float64(config.ArchiveMaxNestedDuplicates),
+			}
+		}
+	}
+	return nil
+}
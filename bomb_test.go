@@ -0,0 +1,123 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// zipBytes builds a ZIP with the entries in order, deflated or stored
+func zipBytes(t *testing.T, method uint16, entries ...[2]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: entry[0], Method: method})
+		if err != nil {
+			t.Fatalf("failed to create zip entry: %v", err)
+		}
+		w.Write([]byte(entry[1]))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestCheckZipBomb(t *testing.T) {
+	cfg := &Config{ArchiveMaxRatio: 100, ArchiveMaxNestedDuplicates: 3}
+
+	zeros := zipBytes(t, zip.Deflate, [2]string{"zeros.bin", strings.Repeat("\x00", 2<<20)})
+
+	var nested [][2]string
+	for i := 0; i < 4; i++ {
+		nested = append(nested, [2]string{fmt.Sprintf("level%d.zip", i), "PK inner archive"})
+	}
+
+	// Point the second entry's central directory record at the first
+	// entry's data, as non-overlapping bombs do
+	overlapping := zipBytes(t, zip.Store, [2]string{"a.txt", "same data"}, [2]string{"b.txt", "same data"})
+	second := bytes.LastIndex(overlapping, []byte("PK\x01\x02"))
+	binary.LittleEndian.PutUint32(overlapping[second+42:], 0)
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "compression ratio", data: zeros, want: bombCompressionRatio},
+		{name: "nested duplicates", data: zipBytes(t, zip.Deflate, nested...), want: bombNestedDuplicates},
+		{name: "overlapping entries", data: overlapping, want: bombOverlappingFiles},
+		{name: "normal", data: zipBytes(t, zip.Deflate, [2]string{"a.txt", "hello"}, [2]string{"b.zip", "PK"}, [2]string{"c.zip", "PK"})},
+	}
+	for _, tt := range tests {
+		reader, err := zip.NewReader(bytes.NewReader(tt.data), int64(len(tt.data)))
+		if err != nil {
+			t.Fatalf("%s: invalid zip: %v", tt.name, err)
+		}
+		reason := checkZipBomb(cfg, reader, int64(len(tt.data)))
+		switch {
+		case tt.want == "" && reason != nil:
+			t.Errorf("%s: checkZipBomb() = %+v, want none", tt.name, reason)
+		case tt.want != "" && (reason == nil || reason.Check != tt.want):
+			t.Errorf("%s: checkZipBomb() = %+v, want %s", tt.name, reason, tt.want)
+		}
+	}
+
+	// Unchecked with a zero ratio
+	reader, _ := zip.NewReader(bytes.NewReader(zeros), int64(len(zeros)))
+	if reason := checkZipBomb(&Config{}, reader, int64(len(zeros))); reason != nil {
+		t.Errorf("checkZipBomb() with checks off = %+v", reason)
+	}
+}
+
+func TestScanHandlerZipBomb(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.MaxUploadSize = 4 << 20
+	cfg.MaxExtractedSize = 4 << 20
+	cfg.ArchiveMaxRatio = 100
+	bomb := zipBytes(t, zip.Deflate, [2]string{"zeros.bin", strings.Repeat("\x00", 2<<20)})
+
+	scan := func() (*httptest.ResponseRecorder, ScanResponse) {
+		body, contentType := multipartUpload(t, "bomb.zip", bomb)
+		req := httptest.NewRequest(http.MethodPost, "/scan", body)
+		req.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+		handleScan(recorder, req, cfg, NewScanner(cfg))
+		var response ScanResponse
+		json.NewDecoder(bytes.NewReader(recorder.Body.Bytes())).Decode(&response)
+		return recorder, response
+	}
+
+	cfg.ArchiveBombAction = bombActionReject
+	recorder, response := scan()
+	if recorder.Code != http.StatusUnprocessableEntity || response.Status != "rejected" ||
+		response.RejectedReason == nil || response.RejectedReason.Check != bombCompressionRatio {
+		t.Errorf("reject: status %d, response %+v", recorder.Code, response)
+	}
+
+	cfg.ArchiveBombAction = bombActionFlag
+	recorder, response = scan()
+	if recorder.Code != http.StatusOK || response.Status != "suspicious" || response.ScannedFiles != 1 ||
+		response.RejectedReason == nil || response.RejectedReason.Check != bombCompressionRatio {
+		t.Errorf("flag: status %d, response %+v", recorder.Code, response)
+	}
+}
+
+func TestReceiveTarUploadRatio(t *testing.T) {
+	cfg := &Config{MaxFileCount: 10, MaxSingleFileSize: 4 << 20, MaxExtractedSize: 4 << 20, ArchiveMaxRatio: 100}
+	archive := testLayer(t, map[string]string{"zeros.bin": strings.Repeat("\x00", 2<<20)})
+
+	upload, reqErr := receiveTarUpload(bytes.NewReader(archive), true, cfg, nil)
+	if reqErr != nil {
+		t.Fatalf("receiveTarUpload() error: %+v", reqErr)
+	}
+	defer upload.remove()
+	if upload.rejected == nil || upload.rejected.Check != bombCompressionRatio {
+		t.Errorf("rejected = %+v, want compression ratio", upload.rejected)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// Retry backoff for transient clamd errors
+const (
+	clamdRetryBaseDelay = 200 * time.Millisecond
+	clamdRetryMaxDelay  = 5 * time.Second
+)
+
+// errClamdUnavailable marks errors reaching clamd (as opposed to scan errors)
+var errClamdUnavailable = errors.New("clamd unavailable")
+
+// errCircuitOpen is returned while the breaker rejects clamd calls
+var errCircuitOpen = errors.New("clamd circuit breaker open")
+
+// CircuitBreaker stops calling clamd after repeated transient failures,
+// so requests fail fast while clamd restarts or reloads signatures.
+// After the cooldown one probe call is let through; its outcome closes or
+// re-opens the circuit.
+type CircuitBreaker struct {
+	threshold int           // Consecutive failures that open the circuit
+	cooldown  time.Duration // Time before a probe is allowed
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool // A half-open probe is in flight
+}
+
+// Global clamd circuit breaker (nil when disabled)
+var clamdBreaker *CircuitBreaker
+
+// NewCircuitBreaker creates a closed breaker. Returns nil when threshold is
+// not positive (disabled).
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now, state: circuitClosed}
+}
+
+// Allow reports whether a call may proceed
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return errCircuitOpen
+		}
+		b.setState(circuitHalfOpen)
+		b.probing = true
+		return nil
+	case circuitHalfOpen:
+		if b.probing {
+			return errCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Record reports the outcome of an allowed call. Only transient clamd
+// errors count as failures; scan errors say nothing about clamd health.
+func (b *CircuitBreaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !isTransientClamdError(err) {
+		b.failures = 0
+		b.setState(circuitClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.setState(circuitOpen)
+	}
+}
+
+// State returns the current state
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// setState changes state and reports it. Caller holds b.mu.
+func (b *CircuitBreaker) setState(state string) {
+	if state == b.state {
+		return
+	}
+	b.state = state
+	open := 0.0
+	if state == circuitOpen {
+		open = 1
+	}
+	metrics.Gauge("clamd.circuit_open", open)
+}
+
+// isTransientClamdError reports whether err means clamd could not be
+// reached or dropped the connection (e.g. while reloading signatures)
+func isTransientClamdError(err error) bool {
+	return errors.Is(err, errClamdUnavailable) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// callClamd runs fn through the circuit breaker, retrying transient errors
+// with exponential backoff and jitter
+func callClamd(ctx context.Context, retries int, fn func() error) error {
+	delay := clamdRetryBaseDelay
+	for attempt := 0; ; attempt++ {
+		if clamdBreaker != nil {
+			if err := clamdBreaker.Allow(); err != nil {
+				return err
+			}
+		}
+
+		err := fn()
+		if clamdBreaker != nil {
+			clamdBreaker.Record(err)
+		}
+		if err == nil || !isTransientClamdError(err) || attempt >= retries {
+			return err
+		}
+
+		metrics.Count("clamd.retries", 1)
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay)))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		if delay *= 2; delay > clamdRetryMaxDelay {
+			delay = clamdRetryMaxDelay
+		}
+	}
+}
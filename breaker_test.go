@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestBreaker returns a breaker driven by a manual clock
+func newTestBreaker(threshold int, cooldown time.Duration) (*CircuitBreaker, *time.Time) {
+	b := NewCircuitBreaker(threshold, cooldown)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+// useBreaker installs b as the global breaker for the test
+func useBreaker(t *testing.T, b *CircuitBreaker) {
+	t.Helper()
+	clamdBreaker = b
+	t.Cleanup(func() { clamdBreaker = nil })
+}
+
+func TestNewCircuitBreakerDisabled(t *testing.T) {
+	if b := NewCircuitBreaker(0, time.Second); b != nil {
+		t.Error("expected nil breaker for zero threshold")
+	}
+}
+
+func TestIsTransientClamdError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("%w: Could not connect", errClamdUnavailable), true},
+		{fmt.Errorf("clamd error: %w", syscall.ECONNREFUSED), true},
+		{fmt.Errorf("write: %w", syscall.EPIPE), true},
+		{syscall.ECONNRESET, true},
+		{errors.New("ClamAV error: file: Access denied ERROR"), false},
+		{context.DeadlineExceeded, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isTransientClamdError(tt.err); got != tt.want {
+			t.Errorf("isTransientClamdError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	b, now := newTestBreaker(2, 30*time.Second)
+	failure := fmt.Errorf("%w: refused", errClamdUnavailable)
+
+	for i := 0; i < 2; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("call %d rejected while closed: %v", i+1, err)
+		}
+		b.Record(failure)
+	}
+	if got := b.State(); got != circuitOpen {
+		t.Fatalf("state = %q after threshold failures, want open", got)
+	}
+	if err := b.Allow(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("Allow() = %v while open, want errCircuitOpen", err)
+	}
+
+	// After the cooldown a single probe is let through
+	*now = now.Add(30 * time.Second)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("probe rejected after cooldown: %v", err)
+	}
+	if err := b.Allow(); !errors.Is(err, errCircuitOpen) {
+		t.Error("second call allowed while probe in flight")
+	}
+
+	// A failed probe re-opens the circuit immediately
+	b.Record(failure)
+	if got := b.State(); got != circuitOpen {
+		t.Fatalf("state = %q after failed probe, want open", got)
+	}
+
+	*now = now.Add(30 * time.Second)
+	b.Allow()
+	b.Record(nil)
+	if got := b.State(); got != circuitClosed {
+		t.Errorf("state = %q after successful probe, want closed", got)
+	}
+}
+
+func TestCircuitBreakerIgnoresScanErrors(t *testing.T) {
+	b, _ := newTestBreaker(1, time.Second)
+
+	b.Allow()
+	b.Record(errors.New("ClamAV error: Access denied"))
+	if got := b.State(); got != circuitClosed {
+		t.Errorf("state = %q after scan error, want closed", got)
+	}
+}
+
+func TestCallClamdRetriesTransientErrors(t *testing.T) {
+	calls := 0
+	err := callClamd(context.Background(), 1, func() error {
+		calls++
+		if calls == 1 {
+			return syscall.ECONNREFUSED
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("callClamd() error = %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+}
+
+func TestCallClamdDoesNotRetryScanErrors(t *testing.T) {
+	calls := 0
+	scanErr := errors.New("ClamAV error")
+	err := callClamd(context.Background(), 3, func() error {
+		calls++
+		return scanErr
+	})
+	if !errors.Is(err, scanErr) {
+		t.Fatalf("callClamd() error = %v, want scan error", err)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
+
+func TestCallClamdFailsFastWhenOpen(t *testing.T) {
+	b, _ := newTestBreaker(1, time.Minute)
+	useBreaker(t, b)
+
+	err := callClamd(context.Background(), 3, func() error { return syscall.ECONNREFUSED })
+	if !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("callClamd() error = %v, want errCircuitOpen after breaker opened", err)
+	}
+
+	called := false
+	callClamd(context.Background(), 3, func() error { called = true; return nil })
+	if called {
+		t.Error("call ran while circuit open")
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	b, _ := newTestBreaker(1, time.Minute)
+	useBreaker(t, b)
+
+	recorder := httptest.NewRecorder()
+	readyzHandler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status = %d while closed, want 200", recorder.Code)
+	}
+
+	b.Allow()
+	b.Record(syscall.ECONNREFUSED)
+
+	recorder = httptest.NewRecorder()
+	readyzHandler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d while open, want 503", recorder.Code)
+	}
+	var response ReadyResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if response.Circuit != circuitOpen {
+		t.Errorf("circuit = %q, want open", response.Circuit)
+	}
+}
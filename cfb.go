@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf16"
+)
+
+// OLE compound file (MS-CFB) constants
+const (
+	cfbHeaderSize      = 512
+	cfbDirEntrySize    = 128
+	cfbMiniSectorSize  = 64
+	cfbHeaderDIFATSize = 109
+	cfbMaxRegSect      = 0xfffffffa
+	cfbEndOfChain      = 0xfffffffe
+	cfbNoStream        = 0xffffffff
+
+	cfbTypeStorage = 1
+	cfbTypeStream  = 2
+	cfbTypeRoot    = 5
+)
+
+// cfbMagic starts every compound file
+var cfbMagic = []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}
+
+// errCFBCorrupt is returned for compound files whose structures are
+// inconsistent (chains that loop or point outside the file)
+var errCFBCorrupt = errors.New("corrupt compound file")
+
+// cfbFile is a read-only OLE compound file: the container of Office
+// 97-2003 documents and Outlook .msg files. It holds storages (directories)
+// and streams (files).
+type cfbFile struct {
+	r          io.ReaderAt
+	size       int64
+	sectorSize int
+	miniCutoff uint64
+	fat        []uint32
+	miniFAT    []uint32
+	miniStream []byte // The root entry's stream, holding small streams
+	entries    []*cfbEntry
+}
+
+// cfbEntry is a storage or stream, named by its full path from the root
+// ("__attach_version1.0_#00000000/__substg1.0_37010102")
+type cfbEntry struct {
+	Path  string
+	Type  byte
+	Size  uint64
+	start uint32
+
+	name               string
+	left, right, child uint32
+}
+
+// openCFB parses the header, allocation tables and directory of a
+// compound file
+func openCFB(r io.ReaderAt, size int64) (*cfbFile, error) {
+	header := make([]byte, cfbHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:8], cfbMagic) {
+		return nil, fmt.Errorf("not a compound file")
+	}
+
+	le := binary.LittleEndian
+	shift := le.Uint16(header[0x1e:])
+	if shift != 9 && shift != 12 {
+		return nil, fmt.Errorf("%w: sector shift %d", errCFBCorrupt, shift)
+	}
+	f := &cfbFile{
+		r:          r,
+		size:       size,
+		sectorSize: 1 << shift,
+		miniCutoff: uint64(le.Uint32(header[0x38:])),
+	}
+
+	// The FAT's own sectors are listed in the header, then in a chain of
+	// DIFAT sectors
+	var fatSectors []uint32
+	for i := 0; i < cfbHeaderDIFATSize; i++ {
+		if sector := le.Uint32(header[0x4c+4*i:]); sector <= cfbMaxRegSect {
+			fatSectors = append(fatSectors, sector)
+		}
+	}
+	perSector := f.sectorSize/4 - 1
+	for sector, n := le.Uint32(header[0x44:]), 0; sector <= cfbMaxRegSect; n++ {
+		if n > int(size)/f.sectorSize {
+			return nil, errCFBCorrupt
+		}
+		data, err := f.readSector(sector)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < perSector; i++ {
+			if fatSector := le.Uint32(data[4*i:]); fatSector <= cfbMaxRegSect {
+				fatSectors = append(fatSectors, fatSector)
+			}
+		}
+		sector = le.Uint32(data[4*perSector:])
+	}
+	for _, sector := range fatSectors {
+		data, err := f.readSector(sector)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < len(data); i += 4 {
+			f.fat = append(f.fat, le.Uint32(data[i:]))
+		}
+	}
+
+	miniFAT, err := f.readChain(le.Uint32(header[0x3c:]), 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i+4 <= len(miniFAT); i += 4 {
+		f.miniFAT = append(f.miniFAT, le.Uint32(miniFAT[i:]))
+	}
+
+	dir, err := f.readChain(le.Uint32(header[0x30:]), 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.parseDirectory(dir); err != nil {
+		return nil, err
+	}
+
+	root := f.entries[0]
+	if f.miniStream, err = f.readChain(root.start, root.Size); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// readSector reads one regular sector
+func (f *cfbFile) readSector(sector uint32) ([]byte, error) {
+	offset := (int64(sector) + 1) * int64(f.sectorSize)
+	if offset+int64(f.sectorSize) > f.size {
+		return nil, fmt.Errorf("%w: sector %d beyond end of file", errCFBCorrupt, sector)
+	}
+	data := make([]byte, f.sectorSize)
+	if _, err := f.r.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readChain reads the sectors of a FAT chain. A size of 0 reads the whole
+// chain; otherwise the data is cut to size.
+func (f *cfbFile) readChain(start uint32, size uint64) ([]byte, error) {
+	var data []byte
+	for sector := start; sector != cfbEndOfChain && sector != cfbNoStream; sector = f.fat[sector] {
+		if int(sector) >= len(f.fat) || len(data) > int(f.size) {
+			return nil, errCFBCorrupt
+		}
+		chunk, err := f.readSector(sector)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+		if size > 0 && uint64(len(data)) >= size {
+			break
+		}
+	}
+	if size > 0 {
+		if uint64(len(data)) < size {
+			return nil, fmt.Errorf("%w: stream shorter than its size", errCFBCorrupt)
+		}
+		data = data[:size]
+	}
+	return data, nil
+}
+
+// parseDirectory reads the directory entries and resolves their paths by
+// walking the tree of siblings and children from the root
+func (f *cfbFile) parseDirectory(dir []byte) error {
+	le := binary.LittleEndian
+	for i := 0; i+cfbDirEntrySize <= len(dir); i += cfbDirEntrySize {
+		raw := dir[i : i+cfbDirEntrySize]
+		nameLen := int(le.Uint16(raw[64:]))
+		if nameLen > 64 {
+			nameLen = 64
+		}
+		var units []uint16
+		for j := 0; j+1 < nameLen; j += 2 {
+			if unit := le.Uint16(raw[j:]); unit != 0 {
+				units = append(units, unit)
+			}
+		}
+		f.entries = append(f.entries, &cfbEntry{
+			name:  string(utf16.Decode(units)),
+			Type:  raw[66],
+			left:  le.Uint32(raw[68:]),
+			right: le.Uint32(raw[72:]),
+			child: le.Uint32(raw[76:]),
+			start: le.Uint32(raw[116:]),
+			Size:  le.Uint64(raw[120:]),
+		})
+	}
+	if f.sectorSize == 512 {
+		// Version 3 files may have garbage in the high half of the size
+		for _, entry := range f.entries {
+			entry.Size &= 0xffffffff
+		}
+	}
+	if len(f.entries) == 0 || f.entries[0].Type != cfbTypeRoot {
+		return fmt.Errorf("%w: no root entry", errCFBCorrupt)
+	}
+
+	visited := make(map[uint32]bool)
+	var walk func(id uint32, parent string) error
+	walk = func(id uint32, parent string) error {
+		if id == cfbNoStream {
+			return nil
+		}
+		if int(id) >= len(f.entries) || visited[id] {
+			return errCFBCorrupt
+		}
+		visited[id] = true
+		entry := f.entries[id]
+		entry.Path = entry.name
+		if parent != "" {
+			entry.Path = parent + "/" + entry.name
+		}
+		if err := walk(entry.left, parent); err != nil {
+			return err
+		}
+		if err := walk(entry.right, parent); err != nil {
+			return err
+		}
+		return walk(entry.child, entry.Path)
+	}
+	return walk(f.entries[0].child, "")
+}
+
+// Entries returns the storages and streams below the root, in directory order
+func (f *cfbFile) Entries() []*cfbEntry {
+	var entries []*cfbEntry
+	for _, entry := range f.entries[1:] {
+		if entry.Path != "" && (entry.Type == cfbTypeStorage || entry.Type == cfbTypeStream) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Find returns the entry at path, or nil
+func (f *cfbFile) Find(path string) *cfbEntry {
+	for _, entry := range f.Entries() {
+		if entry.Path == path {
+			return entry
+		}
+	}
+	return nil
+}
+
+// ReadStream returns the contents of a stream of at most maxSize bytes
+func (f *cfbFile) ReadStream(entry *cfbEntry, maxSize uint64) ([]byte, error) {
+	if entry.Type != cfbTypeStream {
+		return nil, fmt.Errorf("%s is not a stream", entry.Path)
+	}
+	if entry.Size > maxSize {
+		return nil, fmt.Errorf("stream %s exceeds size limit (%d > %d bytes)", entry.Path, entry.Size, maxSize)
+	}
+	if entry.Size == 0 {
+		return []byte{}, nil
+	}
+	if entry.Size >= f.miniCutoff {
+		return f.readChain(entry.start, entry.Size)
+	}
+
+	// Small streams live in the mini stream, chained through the mini FAT
+	var data []byte
+	for sector := entry.start; uint64(len(data)) < entry.Size; sector = f.miniFAT[sector] {
+		offset := int(sector) * cfbMiniSectorSize
+		if int(sector) >= len(f.miniFAT) || offset+cfbMiniSectorSize > len(f.miniStream) {
+			return nil, errCFBCorrupt
+		}
+		data = append(data, f.miniStream[offset:offset+cfbMiniSectorSize]...)
+	}
+	return data[:entry.Size], nil
+}
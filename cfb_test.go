@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// buildCFB writes a version 3 compound file holding the given streams.
+// Paths containing "/" create storages; streams under 4096 bytes go to the
+// mini stream. Siblings are chained to the right, which is a valid
+// (unbalanced) directory tree.
+func buildCFB(t *testing.T, streams map[string][]byte) []byte {
+	t.Helper()
+	const sectorSize = 512
+	le := binary.LittleEndian
+
+	type node struct {
+		name     string
+		typ      byte
+		data     []byte
+		children []int
+		start    uint32
+	}
+	nodes := []*node{{name: "Root Entry", typ: cfbTypeRoot}}
+	lookup := map[string]int{"": 0}
+	var ensure func(path string, typ byte) int
+	ensure = func(path string, typ byte) int {
+		if id, ok := lookup[path]; ok {
+			return id
+		}
+		parent, name := "", path
+		if i := strings.LastIndex(path, "/"); i >= 0 {
+			parent, name = path[:i], path[i+1:]
+		}
+		parentID := ensure(parent, cfbTypeStorage)
+		nodes = append(nodes, &node{name: name, typ: typ})
+		id := len(nodes) - 1
+		nodes[parentID].children = append(nodes[parentID].children, id)
+		lookup[path] = id
+		return id
+	}
+	paths := make([]string, 0, len(streams))
+	for path := range streams {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		nodes[ensure(path, cfbTypeStream)].data = streams[path]
+	}
+
+	// Sector 0 holds the FAT; everything else is allocated after it
+	fat := []uint32{0xfffffffd}
+	var body []byte
+	alloc := func(data []byte) uint32 {
+		if len(data) == 0 {
+			return cfbEndOfChain
+		}
+		start := uint32(len(fat))
+		n := (len(data) + sectorSize - 1) / sectorSize
+		for i := 0; i < n; i++ {
+			fat = append(fat, uint32(len(fat))+1)
+		}
+		fat[len(fat)-1] = cfbEndOfChain
+		padded := make([]byte, n*sectorSize)
+		copy(padded, data)
+		body = append(body, padded...)
+		return start
+	}
+
+	var miniStream []byte
+	var miniFAT []uint32
+	for _, n := range nodes[1:] {
+		switch {
+		case n.typ != cfbTypeStream || len(n.data) == 0:
+			n.start = cfbEndOfChain
+		case len(n.data) < 4096:
+			n.start = uint32(len(miniFAT))
+			count := (len(n.data) + cfbMiniSectorSize - 1) / cfbMiniSectorSize
+			for i := 0; i < count; i++ {
+				miniFAT = append(miniFAT, uint32(len(miniFAT))+1)
+			}
+			miniFAT[len(miniFAT)-1] = cfbEndOfChain
+			padded := make([]byte, count*cfbMiniSectorSize)
+			copy(padded, n.data)
+			miniStream = append(miniStream, padded...)
+		default:
+			n.start = alloc(n.data)
+		}
+	}
+	nodes[0].start = alloc(miniStream)
+	nodes[0].data = miniStream
+	miniFATBytes := make([]byte, 4*len(miniFAT))
+	for i, v := range miniFAT {
+		le.PutUint32(miniFATBytes[4*i:], v)
+	}
+	miniFATStart := alloc(miniFATBytes)
+
+	dir := make([]byte, cfbDirEntrySize*len(nodes))
+	for id, n := range nodes {
+		raw := dir[id*cfbDirEntrySize:]
+		name := utf16.Encode([]rune(n.name))
+		for i, unit := range name {
+			le.PutUint16(raw[2*i:], unit)
+		}
+		le.PutUint16(raw[64:], uint16(2*len(name)+2))
+		raw[66] = n.typ
+		le.PutUint32(raw[68:], cfbNoStream)
+		le.PutUint32(raw[72:], cfbNoStream)
+		le.PutUint32(raw[76:], cfbNoStream)
+		if len(n.children) > 0 {
+			le.PutUint32(raw[76:], uint32(n.children[0]))
+		}
+		le.PutUint32(raw[116:], n.start)
+		le.PutUint32(raw[120:], uint32(len(n.data)))
+	}
+	for _, n := range nodes {
+		for i := 0; i+1 < len(n.children); i++ {
+			le.PutUint32(dir[n.children[i]*cfbDirEntrySize+72:], uint32(n.children[i+1]))
+		}
+	}
+	dirStart := alloc(dir)
+
+	if len(fat) > sectorSize/4 {
+		t.Fatalf("buildCFB: %d sectors do not fit one FAT sector", len(fat))
+	}
+	fatSector := make([]byte, sectorSize)
+	for i := range fatSector {
+		fatSector[i] = 0xff
+	}
+	for i, v := range fat {
+		le.PutUint32(fatSector[4*i:], v)
+	}
+
+	header := make([]byte, cfbHeaderSize)
+	copy(header, cfbMagic)
+	le.PutUint16(header[0x18:], 0x3e)
+	le.PutUint16(header[0x1a:], 3)
+	le.PutUint16(header[0x1c:], 0xfffe)
+	le.PutUint16(header[0x1e:], 9)
+	le.PutUint16(header[0x20:], 6)
+	le.PutUint32(header[0x2c:], 1)
+	le.PutUint32(header[0x30:], dirStart)
+	le.PutUint32(header[0x38:], 4096)
+	le.PutUint32(header[0x3c:], miniFATStart)
+	le.PutUint32(header[0x40:], uint32(len(miniFAT)*4+sectorSize-1)/sectorSize)
+	le.PutUint32(header[0x44:], cfbEndOfChain)
+	for i := 0; i < cfbHeaderDIFATSize; i++ {
+		le.PutUint32(header[0x4c+4*i:], cfbNoStream)
+	}
+	le.PutUint32(header[0x4c:], 0)
+
+	return append(append(header, fatSector...), body...)
+}
+
+func TestOpenCFB(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 600) // 9600 bytes, regular sectors
+	data := buildCFB(t, map[string][]byte{
+		"small":         []byte("hello compound file"),
+		"storage/inner": []byte("nested"),
+		"storage/large": large,
+		"empty":         nil,
+	})
+
+	cfb, err := openCFB(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("openCFB() error: %v", err)
+	}
+
+	var paths []string
+	for _, entry := range cfb.Entries() {
+		paths = append(paths, entry.Path)
+	}
+	sort.Strings(paths)
+	if want := "empty,small,storage,storage/inner,storage/large"; strings.Join(paths, ",") != want {
+		t.Errorf("entries = %v, want %s", paths, want)
+	}
+
+	tests := []struct {
+		path string
+		want []byte
+	}{
+		{"small", []byte("hello compound file")},
+		{"storage/inner", []byte("nested")},
+		{"storage/large", large},
+		{"empty", []byte{}},
+	}
+	for _, tt := range tests {
+		entry := cfb.Find(tt.path)
+		if entry == nil {
+			t.Fatalf("Find(%q) = nil", tt.path)
+		}
+		got, err := cfb.ReadStream(entry, 1<<20)
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("ReadStream(%q) = %d bytes, %v; want %d bytes", tt.path, len(got), err, len(tt.want))
+		}
+	}
+
+	if cfb.Find("missing") != nil {
+		t.Error("Find() should return nil for a missing path")
+	}
+	if _, err := cfb.ReadStream(cfb.Find("storage"), 1<<20); err == nil {
+		t.Error("ReadStream() should fail for a storage")
+	}
+	if _, err := cfb.ReadStream(cfb.Find("storage/large"), 100); err == nil {
+		t.Error("ReadStream() should enforce the size limit")
+	}
+}
+
+func TestOpenCFBInvalid(t *testing.T) {
+	valid := buildCFB(t, map[string][]byte{"stream": []byte("data")})
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not a compound file", append([]byte("PK\x03\x04"), make([]byte, 1024)...)},
+		{"truncated", valid[:600]},
+		{"bad sector shift", func() []byte {
+			data := append([]byte{}, valid...)
+			data[0x1e] = 7
+			return data
+		}()},
+		{"directory outside file", func() []byte {
+			data := append([]byte{}, valid...)
+			binary.LittleEndian.PutUint32(data[0x30:], 1000)
+			return data
+		}()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := openCFB(bytes.NewReader(tt.data), int64(len(tt.data))); err == nil {
+				t.Error("openCFB() should fail")
+			}
+		})
+	}
+}
+
+func TestOpenCFBBrokenChain(t *testing.T) {
+	data := buildCFB(t, map[string][]byte{"stream": bytes.Repeat([]byte("x"), 5000)})
+	cfb, err := openCFB(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("openCFB() error: %v", err)
+	}
+
+	// Point the stream's first sector outside the allocation table
+	entry := cfb.Find("stream")
+	cfb.fat[entry.start] = 5000
+	if _, err := cfb.ReadStream(entry, 1<<20); !errors.Is(err, errCFBCorrupt) {
+		t.Errorf("ReadStream() error = %v, want errCFBCorrupt", err)
+	}
+}
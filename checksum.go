@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Headers carrying a checksum of the upload as the caller sent it
+const (
+	contentSHA256Header = "X-Content-SHA256" // Hex SHA-256
+	contentMD5Header    = "Content-MD5"      // Base64 MD5 (RFC 1864)
+)
+
+// uploadChecksum is a checksum sent with an upload, and the hash of the
+// bytes received
+type uploadChecksum struct {
+	header string
+	want   []byte
+	hash   hash.Hash
+}
+
+// uploadChecksums hashes an upload as it is received (as an io.Writer) to
+// check it against the checksums sent with it
+type uploadChecksums []*uploadChecksum
+
+// requestChecksums returns the checksums sent with a request (nil = none),
+// or an error if one is malformed
+func requestChecksums(r *http.Request) (uploadChecksums, *requestError) {
+	var checksums uploadChecksums
+	if value := r.Header.Get(contentSHA256Header); value != "" {
+		want, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(want) != sha256.Size {
+			return nil, &requestError{status: http.StatusBadRequest, message: "Invalid " + contentSHA256Header + " header: expected a hex SHA-256 digest"}
+		}
+		checksums = append(checksums, &uploadChecksum{header: contentSHA256Header, want: want, hash: sha256.New()})
+	}
+	if value := r.Header.Get(contentMD5Header); value != "" {
+		want, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(want) != md5.Size {
+			return nil, &requestError{status: http.StatusBadRequest, message: "Invalid " + contentMD5Header + " header: expected a base64 MD5 digest"}
+		}
+		checksums = append(checksums, &uploadChecksum{header: contentMD5Header, want: want, hash: md5.New()})
+	}
+	return checksums, nil
+}
+
+func (c uploadChecksums) Write(p []byte) (int, error) {
+	for _, checksum := range c {
+		checksum.hash.Write(p)
+	}
+	return len(p), nil
+}
+
+// verify returns an error if the received bytes don't match a checksum
+func (c uploadChecksums) verify(safeFilename string) *requestError {
+	for _, checksum := range c {
+		if got := checksum.hash.Sum(nil); !bytes.Equal(got, checksum.want) {
+			log.Printf("Rejected %s: %s mismatch (received %x, expected %x)", safeFilename, checksum.header, got, checksum.want)
+			metrics.Count("upload.checksum_mismatch", 1, "header:"+strings.ToLower(checksum.header))
+			return &requestError{status: http.StatusBadRequest, message: "Upload corrupted: " + checksum.header + " does not match the received file"}
+		}
+	}
+	return nil
+}
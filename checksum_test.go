@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestChecksums(t *testing.T) {
+	sum := sha256.Sum256([]byte("data"))
+	md5sum := md5.Sum([]byte("data"))
+	tests := []struct {
+		name    string
+		header  string
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"none", "", "", 0, false},
+		{"sha256", contentSHA256Header, hex.EncodeToString(sum[:]), 1, false},
+		{"sha256 upper case", contentSHA256Header, strings.ToUpper(hex.EncodeToString(sum[:])), 1, false},
+		{"md5", contentMD5Header, base64.StdEncoding.EncodeToString(md5sum[:]), 1, false},
+		{"sha256 not hex", contentSHA256Header, "not-a-digest", 0, true},
+		{"sha256 too short", contentSHA256Header, "abcd", 0, true},
+		{"md5 as hex", contentMD5Header, hex.EncodeToString(md5sum[:]), 0, true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPut, "/scan/file", nil)
+		if tt.header != "" {
+			req.Header.Set(tt.header, tt.value)
+		}
+		checksums, reqErr := requestChecksums(req)
+		if len(checksums) != tt.want || (reqErr != nil) != tt.wantErr {
+			t.Errorf("%s: got %d checksums, error %v; want %d, error %v", tt.name, len(checksums), reqErr, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestScanHandlerChecksum(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	handler := scanByName("/scan", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleScan(w, r, cfg, NewScanner(cfg))
+	}))
+	content := "clean document"
+	sum := sha256.Sum256([]byte(content))
+	md5sum := md5.Sum([]byte(content))
+	otherSum := sha256.Sum256([]byte("something else"))
+
+	tests := []struct {
+		name       string
+		header     string
+		value      string
+		wantStatus int
+	}{
+		{"sha256 match", contentSHA256Header, hex.EncodeToString(sum[:]), http.StatusOK},
+		{"md5 match", contentMD5Header, base64.StdEncoding.EncodeToString(md5sum[:]), http.StatusOK},
+		{"sha256 mismatch", contentSHA256Header, hex.EncodeToString(otherSum[:]), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPut, "/scan/doc.txt", strings.NewReader(content))
+		req.Header.Set(tt.header, tt.value)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, recorder.Code, tt.wantStatus, recorder.Body)
+		}
+	}
+
+	// Multipart uploads are checked against the file, not the form
+	body, contentType := multipartUpload(t, "doc.txt", []byte(content))
+	req := httptest.NewRequest(http.MethodPost, "/scan", body)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(contentSHA256Header, hex.EncodeToString(sum[:]))
+	recorder := httptest.NewRecorder()
+	handleScan(recorder, req, cfg, NewScanner(cfg))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("multipart: status = %d: %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestScanHandlerChecksumStreamExtraction(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.StreamExtraction = true
+	archive := testLayer(t, map[string]string{"docs/readme.txt": "hello"})
+	sum := sha256.Sum256(archive)
+
+	for _, tt := range []struct {
+		name       string
+		digest     []byte
+		wantStatus int
+	}{
+		{"match", sum[:], http.StatusOK},
+		{"mismatch", make([]byte, sha256.Size), http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodPut, "/scan/release.tar.gz", strings.NewReader(string(archive)))
+		req.Header.Set(contentSHA256Header, hex.EncodeToString(tt.digest))
+		recorder := httptest.NewRecorder()
+		scanByName("/scan", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handleScan(w, r, cfg, NewScanner(cfg))
+		})).ServeHTTP(recorder, req)
+
+		if recorder.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, recorder.Code, tt.wantStatus, recorder.Body)
+		}
+		var response ScanResponse
+		json.NewDecoder(recorder.Body).Decode(&response)
+		if tt.wantStatus == http.StatusBadRequest && !strings.Contains(response.Error, contentSHA256Header) {
+			t.Errorf("%s: error = %q", tt.name, response.Error)
+		}
+	}
+}
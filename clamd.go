@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Timeout for clamd commands when the context has no deadline
+const clamdTimeout = 30 * time.Second
+
+// Idle connections are pinged before reuse after this long. clamd closes
+// sessions idle for longer than its IdleTimeout (default 30s).
+const clamdHealthCheckAfter = 10 * time.Second
+
+// errClamdProtocol reports an unexpected reply from clamd
+var errClamdProtocol = errors.New("unexpected clamd reply")
+
+// ClamdPool keeps persistent clamd sessions (IDSESSION) open and hands them
+// out to scans, so each scan skips connection setup and process spawning.
+// Idle sessions are health checked with PING and replaced when broken.
+type ClamdPool struct {
+	network string
+	address string
+	slots   chan struct{}   // One per checked-out connection
+	idle    chan *clamdConn // Connections ready for reuse
+}
+
+// clamdConn is one clamd session
+type clamdConn struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	seq      int // Request number; replies are prefixed with it
+	lastUsed time.Time
+}
+
+// Global clamd connection pool (nil = scan with clamdscan)
+var clamdPool *ClamdPool
+
+// NewClamdPool creates a pool of up to size connections to the clamd
+// address (tcp://host:port or unix:///path). Connections are opened lazily.
+func NewClamdPool(address string, size int) (*ClamdPool, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clamd address %q: %w", address, err)
+	}
+
+	p := &ClamdPool{}
+	switch u.Scheme {
+	case "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid clamd address %q: missing host", address)
+		}
+		p.network, p.address = "tcp", u.Host
+	case "unix":
+		p.network, p.address = "unix", u.Path
+	default:
+		return nil, fmt.Errorf("unsupported clamd scheme %q (use tcp or unix)", u.Scheme)
+	}
+
+	if size < 1 {
+		return nil, fmt.Errorf("%s must be positive", EnvClamdPoolSize)
+	}
+	p.slots = make(chan struct{}, size)
+	p.idle = make(chan *clamdConn, size)
+
+	return p, nil
+}
+
+// get checks out a healthy connection, waiting for a free slot if all
+// connections are in use
+func (p *ClamdPool) get(ctx context.Context) (*clamdConn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for {
+		select {
+		case c := <-p.idle:
+			if time.Since(c.lastUsed) < clamdHealthCheckAfter {
+				return c, nil
+			}
+			if reply, err := c.command(ctx, "PING"); err == nil && reply == "PONG" {
+				return c, nil
+			}
+			c.conn.Close()
+			metrics.Count("clamd.reconnects", 1)
+		default:
+			c, err := p.dial(ctx)
+			if err != nil {
+				<-p.slots
+				return nil, err
+			}
+			return c, nil
+		}
+	}
+}
+
+// put returns a connection to the pool. Connections that failed are closed,
+// since their session state is unknown.
+func (p *ClamdPool) put(c *clamdConn, err error) {
+	if err != nil {
+		c.conn.Close()
+	} else {
+		c.lastUsed = time.Now()
+		p.idle <- c
+	}
+	<-p.slots
+}
+
+// dial opens a connection and starts a session
+func (p *ClamdPool) dial(ctx context.Context) (*clamdConn, error) {
+	dialer := &net.Dialer{Timeout: clamdTimeout}
+	conn, err := dialer.DialContext(ctx, p.network, p.address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errClamdUnavailable, err)
+	}
+
+	// IDSESSION has no reply
+	conn.SetWriteDeadline(time.Now().Add(clamdTimeout))
+	if _, err := conn.Write([]byte("zIDSESSION\x00")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %w", errClamdUnavailable, err)
+	}
+
+	return &clamdConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// command sends a command in the session and returns its reply without
+// the request number prefix
+func (c *clamdConn) command(ctx context.Context, cmd string) (string, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(clamdTimeout)
+	}
+	c.conn.SetDeadline(deadline)
+	defer c.abortOn(ctx)()
+
+	if _, err := c.conn.Write([]byte("z" + cmd + "\x00")); err != nil {
+		return "", err
+	}
+	c.seq++
+
+	reply, err := c.reader.ReadString(0)
+	if err != nil {
+		return "", err
+	}
+	reply = strings.TrimSuffix(reply, "\x00")
+
+	prefix := strconv.Itoa(c.seq) + ": "
+	if !strings.HasPrefix(reply, prefix) {
+		return "", fmt.Errorf("%w: %q", errClamdProtocol, reply)
+	}
+	return strings.TrimPrefix(reply, prefix), nil
+}
+
+// abortOn interrupts the connection's reads and writes once ctx is
+// canceled, so a canceled scan doesn't wait for clamd's reply. The failed
+// connection is closed by put, which makes clamd stop the scan. Returns a
+// function to call when the operation is over.
+func (c *clamdConn) abortOn(ctx context.Context) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		c.conn.SetDeadline(time.Unix(1, 0))
+	})
+}
+
+// Command runs one command on a pooled connection
+func (p *ClamdPool) Command(ctx context.Context, cmd string) (string, error) {
+	c, err := p.get(ctx)
+	if err != nil {
+		return "", err
+	}
+	reply, err := c.command(ctx, cmd)
+	p.put(c, err)
+	return reply, err
+}
+
+// clamdCommand runs one command on a new connection outside a session, for
+// commands clamd only accepts there (STATS, VERSIONCOMMANDS)
+func clamdCommand(ctx context.Context, network, address, cmd string) (string, error) {
+	dialer := &net.Dialer{Timeout: clamdTimeout}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errClamdUnavailable, err)
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(clamdTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write([]byte("z" + cmd + "\x00")); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(reply, "\x00"), nil
+}
+
+// ScanPaths scans each file on one pooled connection and returns the
+// replies, one per line, in clamdscan output format ("path: Name FOUND").
+// clamd must be able to read the files. On error, the replies received
+// before it are returned with it.
+func (p *ClamdPool) ScanPaths(ctx context.Context, paths []string) (string, error) {
+	c, err := p.get(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var output strings.Builder
+	for _, path := range paths {
+		var reply string
+		reply, err = c.command(ctx, "SCAN "+path)
+		if err != nil {
+			break
+		}
+		output.WriteString(reply)
+		output.WriteByte('\n')
+	}
+
+	p.put(c, err)
+	return output.String(), err
+}
+
+// Largest INSTREAM chunk sent to clamd
+const clamdChunkSize = 64 << 10
+
+// instream sends a file's contents with INSTREAM, as length-prefixed chunks
+// ending with an empty one, and returns the reply ("stream: OK" or
+// "stream: Name FOUND")
+func (c *clamdConn) instream(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(clamdTimeout)
+	}
+	c.conn.SetDeadline(deadline)
+	defer c.abortOn(ctx)()
+
+	writer := bufio.NewWriterSize(c.conn, clamdChunkSize+4)
+	writer.WriteString("zINSTREAM\x00")
+	c.seq++
+	chunk := make([]byte, 4+clamdChunkSize)
+	for {
+		n, readErr := f.Read(chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk, uint32(n))
+			if _, err := writer.Write(chunk[:4+n]); err != nil {
+				return "", err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			// The session is mid-stream and can't be reused; the caller
+			// closes the connection on error
+			return "", readErr
+		}
+	}
+	writer.Write([]byte{0, 0, 0, 0})
+	if err := writer.Flush(); err != nil {
+		return "", err
+	}
+
+	reply, err := c.reader.ReadString(0)
+	if err != nil {
+		return "", err
+	}
+	reply = strings.TrimSuffix(reply, "\x00")
+
+	prefix := strconv.Itoa(c.seq) + ": "
+	if !strings.HasPrefix(reply, prefix) {
+		return "", fmt.Errorf("%w: %q", errClamdProtocol, reply)
+	}
+	return strings.TrimPrefix(reply, prefix), nil
+}
+
+// StreamPaths sends each file's contents with INSTREAM over up to workers
+// pooled connections at once, so clamd scans them in parallel and needn't
+// be able to read them. The replies are returned as for ScanPaths, in the
+// order of paths, including on error.
+func (p *ClamdPool) StreamPaths(ctx context.Context, paths []string, workers int) (string, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	replies := make([]string, len(paths))
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, len(paths)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.streamFiles(ctx, paths, replies, &next); err != nil {
+				cancel(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// On failure, the replies received so far
+	var output strings.Builder
+	for _, reply := range replies {
+		if reply != "" {
+			output.WriteString(reply)
+			output.WriteByte('\n')
+		}
+	}
+	return output.String(), context.Cause(ctx)
+}
+
+// streamFiles streams files on one connection, taking the index of the
+// next one from next, until all have been sent or another worker failed
+func (p *ClamdPool) streamFiles(ctx context.Context, paths []string, replies []string, next *atomic.Int64) error {
+	c, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+	for ctx.Err() == nil {
+		i := int(next.Add(1) - 1)
+		if i >= len(paths) {
+			break
+		}
+		var reply string
+		reply, err = c.instream(ctx, paths[i])
+		if err != nil {
+			break
+		}
+		replies[i] = paths[i] + ": " + strings.TrimPrefix(reply, "stream: ")
+	}
+	p.put(c, err)
+	return err
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClamd is a minimal clamd speaking the IDSESSION protocol. Outside a
+// session it answers one command without a request number and hangs up.
+// Files containing "EICAR" are reported as infected; those containing "SLOW"
+// take two seconds to scan.
+type fakeClamd struct {
+	listener net.Listener
+	dials    atomic.Int32
+	updated  atomic.Bool // Newer signatures: files containing "NEWSIG" are infected too
+
+	streams    atomic.Int32 // INSTREAM scans in progress
+	maxStreams atomic.Int32 // Most INSTREAM scans seen at once
+}
+
+func newFakeClamd(t *testing.T) *fakeClamd {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	f := &fakeClamd{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go f.serve()
+	return f
+}
+
+func (f *fakeClamd) address() string {
+	return "tcp://" + f.listener.Addr().String()
+}
+
+func (f *fakeClamd) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.dials.Add(1)
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	seq := 0
+	session := false
+	for {
+		cmd, err := reader.ReadString(0)
+		if err != nil {
+			return
+		}
+		cmd = strings.TrimSuffix(strings.TrimPrefix(cmd, "z"), "\x00")
+
+		var reply string
+		switch {
+		case cmd == "IDSESSION":
+			session = true
+			continue
+		case cmd == "END":
+			return
+		case cmd == "PING":
+			reply = "PONG"
+		case cmd == "VERSION" && f.updated.Load():
+			reply = "ClamAV 1.2.0/27001/Tue Jan 2 12:00:00 2024"
+		case cmd == "VERSION":
+			reply = "ClamAV 1.2.0/27000/Mon Jan 1 12:00:00 2024"
+		case cmd == "VERSIONCOMMANDS":
+			reply = "ClamAV 1.2.0/27000/Mon Jan 1 12:00:00 2024| COMMANDS: SCAN PING VERSION STATS IDSESSION"
+		case cmd == "STATS":
+			reply = testClamdStats
+		case cmd == "RELOAD":
+			reply = "RELOADING"
+			f.updated.Store(true)
+		case cmd == "DISCONNECT":
+			// Test hook: drop the session like a clamd reload does
+			return
+		case cmd == "INSTREAM":
+			data, err := f.readStream(reader)
+			if err != nil {
+				return
+			}
+			reply = "stream: " + f.verdict(data)
+		case strings.HasPrefix(cmd, "SCAN "):
+			path := strings.TrimPrefix(cmd, "SCAN ")
+			data, err := os.ReadFile(path)
+			if err != nil {
+				reply = path + ": lstat() failed ERROR"
+			} else {
+				reply = path + ": " + f.verdict(data)
+			}
+		default:
+			reply = "UNKNOWN COMMAND"
+		}
+		if !session {
+			fmt.Fprintf(conn, "%s\x00", reply)
+			return
+		}
+		seq++
+		fmt.Fprintf(conn, "%d: %s\x00", seq, reply)
+	}
+}
+
+// verdict returns the scan reply for a file's contents
+func (f *fakeClamd) verdict(data []byte) string {
+	if strings.Contains(string(data), "SLOW") {
+		time.Sleep(2 * time.Second)
+	}
+	switch {
+	case strings.Contains(string(data), "EICAR"):
+		return "Eicar-Test-Signature FOUND"
+	case f.updated.Load() && strings.Contains(string(data), "NEWSIG"):
+		return "New-Test-Signature FOUND"
+	}
+	return "OK"
+}
+
+// readStream reads INSTREAM chunks up to the empty one, lingering a little
+// so that parallel streams overlap
+func (f *fakeClamd) readStream(reader *bufio.Reader) ([]byte, error) {
+	streams := f.streams.Add(1)
+	defer f.streams.Add(-1)
+	for {
+		seen := f.maxStreams.Load()
+		if streams <= seen || f.maxStreams.CompareAndSwap(seen, streams) {
+			break
+		}
+	}
+
+	var data []byte
+	for {
+		var size uint32
+		if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			time.Sleep(20 * time.Millisecond)
+			return data, nil
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+}
+
+func TestNewClamdPool(t *testing.T) {
+	tests := []struct {
+		address string
+		size    int
+		wantErr bool
+	}{
+		{address: "tcp://127.0.0.1:3310", size: 4},
+		{address: "unix:///run/clamd.sock", size: 1},
+		{address: "tcp://", size: 4, wantErr: true},
+		{address: "http://127.0.0.1:3310", size: 4, wantErr: true},
+		{address: "tcp://127.0.0.1:3310", size: 0, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		_, err := NewClamdPool(tt.address, tt.size)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewClamdPool(%q, %d) error = %v, wantErr %v", tt.address, tt.size, err, tt.wantErr)
+		}
+	}
+}
+
+func TestClamdPoolReusesConnections(t *testing.T) {
+	server := newFakeClamd(t)
+	pool, err := NewClamdPool(server.address(), 2)
+	if err != nil {
+		t.Fatalf("NewClamdPool() error: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		reply, err := pool.Command(context.Background(), "PING")
+		if err != nil || reply != "PONG" {
+			t.Fatalf("Command(PING) = %q, %v", reply, err)
+		}
+	}
+
+	if got := server.dials.Load(); got != 1 {
+		t.Errorf("dials = %d, want 1 (connection reused)", got)
+	}
+}
+
+func TestClamdCommandCanceled(t *testing.T) {
+	// A clamd that reads the command but never replies
+	server, client := net.Pipe()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+	c := &clamdConn{conn: client, reader: bufio.NewReader(client)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	done := make(chan error)
+	go func() {
+		_, err := c.command(ctx, "SCAN /tmp/big.iso")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("canceled command() succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("command() kept waiting for clamd after its context was canceled")
+	}
+}
+
+func TestClamdPoolReconnectsBrokenSession(t *testing.T) {
+	server := newFakeClamd(t)
+	pool, err := NewClamdPool(server.address(), 1)
+	if err != nil {
+		t.Fatalf("NewClamdPool() error: %v", err)
+	}
+
+	// The server drops the session; the failed connection is discarded
+	if _, err := pool.Command(context.Background(), "DISCONNECT"); err == nil {
+		t.Fatal("expected error when clamd drops the session")
+	}
+
+	reply, err := pool.Command(context.Background(), "VERSION")
+	if err != nil || !strings.HasPrefix(reply, "ClamAV 1.2.0") {
+		t.Fatalf("Command(VERSION) after reconnect = %q, %v", reply, err)
+	}
+	if got := server.dials.Load(); got != 2 {
+		t.Errorf("dials = %d, want 2", got)
+	}
+}
+
+func TestClamdPoolHealthCheck(t *testing.T) {
+	server := newFakeClamd(t)
+	pool, err := NewClamdPool(server.address(), 1)
+	if err != nil {
+		t.Fatalf("NewClamdPool() error: %v", err)
+	}
+
+	if _, err := pool.Command(context.Background(), "PING"); err != nil {
+		t.Fatalf("Command() error: %v", err)
+	}
+
+	// Age the idle connection and close it server-side: the PING health
+	// check fails and a fresh connection is used transparently
+	c := <-pool.idle
+	c.lastUsed = time.Now().Add(-2 * clamdHealthCheckAfter)
+	c.command(context.Background(), "DISCONNECT")
+	pool.idle <- c
+
+	if _, err := pool.Command(context.Background(), "VERSION"); err != nil {
+		t.Fatalf("Command() after stale connection error: %v", err)
+	}
+	if got := server.dials.Load(); got != 2 {
+		t.Errorf("dials = %d, want 2", got)
+	}
+}
+
+func TestScannerRunClamd(t *testing.T) {
+	server := newFakeClamd(t)
+	pool, err := NewClamdPool(server.address(), 1)
+	if err != nil {
+		t.Fatalf("NewClamdPool() error: %v", err)
+	}
+	clamdPool = pool
+	t.Cleanup(func() { clamdPool = nil })
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "clean.txt"), "hello")
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	writeTestFile(t, filepath.Join(dir, "sub", "eicar.com"), "EICAR")
+
+	s := NewScanner(&Config{ScanTimeout: time.Minute})
+	threats, err := s.runClamAV(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("runClamAV() error: %v", err)
+	}
+	if len(threats) != 1 || threats[0].Name != "Eicar-Test-Signature" || threats[0].File != filepath.Join("sub", "eicar.com") {
+		t.Errorf("threats = %+v, want EICAR in sub/eicar.com", threats)
+	}
+
+	version, dbVersion, err := s.GetVersion()
+	if err != nil || version != "1.2.0" || dbVersion != "27000" {
+		t.Errorf("GetVersion() = %q, %q, %v", version, dbVersion, err)
+	}
+}
+
+func TestScannerRunClamdTimeout(t *testing.T) {
+	server := newFakeClamd(t)
+	pool, err := NewClamdPool(server.address(), 1)
+	if err != nil {
+		t.Fatalf("NewClamdPool() error: %v", err)
+	}
+	clamdPool = pool
+	t.Cleanup(func() { clamdPool = nil })
+
+	// Scanned in name order: the slow file is cut short by the timeout
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "a.com"), "EICAR")
+	writeTestFile(t, filepath.Join(dir, "b.txt"), "hello")
+	writeTestFile(t, filepath.Join(dir, "c.bin"), "SLOW")
+
+	s := NewScanner(&Config{ScanTimeout: 300 * time.Millisecond})
+	_, err = s.runClamAV(context.Background(), dir)
+	var timeout *scanTimeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("runClamAV() error = %v, want a scan timeout", err)
+	}
+	if len(timeout.threats) != 1 || timeout.threats[0].File != "a.com" || timeout.scanned != 2 {
+		t.Errorf("timeout = %+v, want EICAR in a.com after 2 files", timeout)
+	}
+}
+
+func TestClamdPoolStreamPaths(t *testing.T) {
+	server := newFakeClamd(t)
+	pool, err := NewClamdPool(server.address(), 4)
+	if err != nil {
+		t.Fatalf("NewClamdPool() error: %v", err)
+	}
+
+	dir := t.TempDir()
+	var paths []string
+	for i := 0; i < 8; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("file%d", i))
+		content := "clean"
+		if i == 5 {
+			// Larger than one chunk
+			content = strings.Repeat("x", clamdChunkSize) + "EICAR"
+		}
+		writeTestFile(t, path, content)
+		paths = append(paths, path)
+	}
+
+	output, err := pool.StreamPaths(context.Background(), paths, 3)
+	if err != nil {
+		t.Fatalf("StreamPaths() error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	if len(lines) != len(paths) {
+		t.Fatalf("output = %q, want one line per file", output)
+	}
+	for i, line := range lines {
+		want := paths[i] + ": OK"
+		if i == 5 {
+			want = paths[i] + ": Eicar-Test-Signature FOUND"
+		}
+		if line != want {
+			t.Errorf("line %d = %q, want %q", i, line, want)
+		}
+	}
+	if got := server.maxStreams.Load(); got < 2 || got > 3 {
+		t.Errorf("max parallel streams = %d, want 2-3", got)
+	}
+
+	// The connections are returned to the pool for reuse
+	if _, err := pool.StreamPaths(context.Background(), paths[:2], 3); err != nil {
+		t.Fatalf("StreamPaths() error: %v", err)
+	}
+	if got := server.dials.Load(); got != 3 {
+		t.Errorf("dials = %d, want 3", got)
+	}
+
+	// A file that can't be read fails the scan
+	if _, err := pool.StreamPaths(context.Background(), []string{filepath.Join(dir, "missing")}, 3); err == nil {
+		t.Error("StreamPaths() of a missing file succeeded")
+	}
+}
+
+func TestScannerRunClamdStreaming(t *testing.T) {
+	server := newFakeClamd(t)
+	pool, err := NewClamdPool(server.address(), 2)
+	if err != nil {
+		t.Fatalf("NewClamdPool() error: %v", err)
+	}
+	clamdPool = pool
+	t.Cleanup(func() { clamdPool = nil })
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "clean.txt"), "hello")
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	writeTestFile(t, filepath.Join(dir, "sub", "eicar.com"), "EICAR")
+	writeTestFile(t, filepath.Join(dir, "sub", "readme.md"), "docs")
+
+	s := NewScanner(&Config{ScanTimeout: time.Minute, ClamdStreamWorkers: 2})
+	threats, err := s.runClamAV(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("runClamAV() error: %v", err)
+	}
+	if len(threats) != 1 || threats[0].Name != "Eicar-Test-Signature" || threats[0].File != filepath.Join("sub", "eicar.com") {
+		t.Errorf("threats = %+v, want EICAR in sub/eicar.com", threats)
+	}
+	if server.maxStreams.Load() == 0 {
+		t.Error("files were not streamed")
+	}
+}
+
+func TestScannerEngine(t *testing.T) {
+	server := newFakeClamd(t)
+	pool, err := NewClamdPool(server.address(), 1)
+	if err != nil {
+		t.Fatalf("NewClamdPool() error: %v", err)
+	}
+	clamdPool = pool
+	t.Cleanup(func() { clamdPool = nil })
+
+	s := NewScanner(&Config{ScanTimeout: time.Minute})
+	want := EngineInfo{Engine: "1.2.0", DBVersion: "27000", DBDate: "Mon Jan 1 12:00:00 2024"}
+	if info := s.Engine(); info != want {
+		t.Fatalf("Engine() = %+v, want %+v", info, want)
+	}
+
+	// Cached until stale, then asked again
+	server.updated.Store(true)
+	if info := s.Engine(); info.DBVersion != "27000" {
+		t.Errorf("Engine() within the TTL = %+v, want the cached versions", info)
+	}
+	s.versionAt = time.Now().Add(-engineVersionTTL)
+	if info := s.Engine(); info.DBVersion != "27001" {
+		t.Errorf("stale Engine() = %+v, want the updated signatures", info)
+	}
+
+	// The last known versions outlive clamd outages
+	clamdPool, _ = NewClamdPool("unix://"+filepath.Join(t.TempDir(), "missing.sock"), 1)
+	s.versionAt = time.Now().Add(-engineVersionTTL)
+	if info := s.Engine(); info.DBVersion != "27001" {
+		t.Errorf("Engine() while clamd is down = %+v, want the last known versions", info)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Exit code for "clamav-rest scan" when a threat was found
+const exitInfected = 1
+
+// Environment variables read by the scan client
+const (
+	EnvClientURL    = "CLAMAV_REST_URL"
+	EnvClientAPIKey = "CLAMAV_REST_API_KEY"
+)
+
+// Default server URL for the scan client
+const DefaultClientURL = "http://localhost:9000"
+
+// ScanClient submits files to a running clamav-rest instance
+type ScanClient struct {
+	BaseURL string
+	APIKey  string
+	Client  *http.Client
+}
+
+// ScanReader uploads content as a multipart form and returns the parsed response.
+// The upload is streamed, so large files are not buffered in memory.
+func (c *ScanClient) ScanReader(filename string, content io.Reader) (*ScanResponse, error) {
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+
+	go func() {
+		part, err := form.CreateFormFile("file", filename)
+		if err == nil {
+			_, err = io.Copy(part, content)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.BaseURL, "/")+"/scan", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if c.APIKey != "" {
+		req.Header.Set(apiKeyHeader, c.APIKey)
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result ScanResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("unexpected response (HTTP %d)", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK && result.Error == "" {
+		result.Error = fmt.Sprintf("HTTP %d", resp.StatusCode)
+	}
+	if result.Error != "" && result.Status != "timeout" {
+		result.Status = "error"
+	}
+	return &result, nil
+}
+
+// scanCommandResult is one entry of the JSON output of "clamav-rest scan"
+type scanCommandResult struct {
+	File string `json:"file"`
+	ScanResponse
+}
+
+// runScanCommand implements "clamav-rest scan [flags] [file...]".
+// Reads stdin when no files (or "-") are given.
+// Exit codes: 0 all clean, 1 any infected, 2 any error.
+func runScanCommand(args []string) int {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	url := flags.String("url", getEnvStr(EnvClientURL, DefaultClientURL), "Server URL (env "+EnvClientURL+")")
+	apiKey := flags.String("api-key", os.Getenv(EnvClientAPIKey), "API key (env "+EnvClientAPIKey+")")
+	jsonOutput := flags.Bool("json", false, "Print results as JSON")
+	timeout := flags.Duration("timeout", 10*time.Minute, "Timeout per file")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	client := &ScanClient{
+		BaseURL: *url,
+		APIKey:  *apiKey,
+		Client:  &http.Client{Timeout: *timeout},
+	}
+
+	var results []scanCommandResult
+	exitCode := exitOK
+	for _, file := range files {
+		result := scanCommandFile(client, file)
+		results = append(results, result)
+
+		switch {
+		case result.Status == "error" || result.Status == "timeout":
+			exitCode = exitError
+		case result.Status == "infected" && exitCode == exitOK:
+			exitCode = exitInfected
+		}
+
+		if !*jsonOutput {
+			printScanResult(os.Stdout, result)
+		}
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(results)
+	}
+
+	return exitCode
+}
+
+// scanCommandFile scans one file (or stdin for "-")
+func scanCommandFile(client *ScanClient, file string) scanCommandResult {
+	name := "stdin"
+	var content io.Reader = os.Stdin
+
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return scanCommandResult{File: file, ScanResponse: ScanResponse{Status: "error", Error: err.Error()}}
+		}
+		defer f.Close()
+		name = filepath.Base(file)
+		content = f
+	}
+
+	response, err := client.ScanReader(name, content)
+	if err != nil {
+		return scanCommandResult{File: file, ScanResponse: ScanResponse{Status: "error", Error: err.Error()}}
+	}
+	return scanCommandResult{File: file, ScanResponse: *response}
+}
+
+// printScanResult prints a clamscan-style human-readable result
+func printScanResult(w io.Writer, result scanCommandResult) {
+	switch result.Status {
+	case "clean":
+		fmt.Fprintf(w, "%s: OK (%d files, %dms)\n", result.File, result.ScannedFiles, result.ScanTimeMs)
+	case "clean_with_skips":
+		fmt.Fprintf(w, "%s: OK (%d files, %dms)\n", result.File, result.ScannedFiles, result.ScanTimeMs)
+		for _, skipped := range result.SkippedFiles {
+			if unscannedSkip(skipped.Reason) {
+				fmt.Fprintf(w, "%s: SKIPPED %s (%s)\n", result.File, skipped.File, skipped.Reason)
+			}
+		}
+	case "infected":
+		for _, threat := range result.Threats {
+			fmt.Fprintf(w, "%s: %s FOUND in %s\n", result.File, threat.Name, threat.File)
+		}
+	case "timeout":
+		// Threats found before the timeout are still reported
+		for _, threat := range result.Threats {
+			fmt.Fprintf(w, "%s: %s FOUND in %s\n", result.File, threat.Name, threat.File)
+		}
+		fmt.Fprintf(w, "%s: TIMEOUT after %d files\n", result.File, result.ScannedFiles)
+	case "suspicious":
+		detail := "possible decompression bomb"
+		if result.RejectedReason != nil {
+			detail = result.RejectedReason.Detail
+		}
+		fmt.Fprintf(w, "%s: SUSPICIOUS %s\n", result.File, detail)
+	default:
+		fmt.Fprintf(w, "%s: ERROR %s\n", result.File, result.Error)
+	}
+}
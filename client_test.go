@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newFakeScanServer returns a server that reports files named "eicar*" as infected
+// and files named "fail*" as errors
+func newFakeScanServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(apiKeyHeader) != "test-key" {
+			sendErrorStatus(w, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			sendError(w, "No file provided in request")
+			return
+		}
+		io.Copy(io.Discard, file)
+
+		switch {
+		case strings.HasPrefix(header.Filename, "eicar"):
+			json.NewEncoder(w).Encode(ScanResponse{
+				Status:       "infected",
+				Threats:      []Threat{{Name: "Win.Test.EICAR_HDB-1", File: "file", Severity: "critical"}},
+				ScannedFiles: 1,
+			})
+		case strings.HasPrefix(header.Filename, "fail"):
+			sendError(w, "Scan operation failed")
+		default:
+			json.NewEncoder(w).Encode(ScanResponse{Status: "clean", Threats: []Threat{}, ScannedFiles: 1})
+		}
+	}))
+}
+
+func TestScanClient(t *testing.T) {
+	server := newFakeScanServer(t)
+	defer server.Close()
+
+	client := &ScanClient{BaseURL: server.URL, APIKey: "test-key", Client: server.Client()}
+
+	t.Run("clean", func(t *testing.T) {
+		result, err := client.ScanReader("doc.pdf", strings.NewReader("content"))
+		if err != nil {
+			t.Fatalf("ScanReader() error: %v", err)
+		}
+		if result.Status != "clean" {
+			t.Errorf("Status = %q, want clean", result.Status)
+		}
+	})
+
+	t.Run("infected", func(t *testing.T) {
+		result, err := client.ScanReader("eicar.txt", strings.NewReader("content"))
+		if err != nil {
+			t.Fatalf("ScanReader() error: %v", err)
+		}
+		if result.Status != "infected" || len(result.Threats) != 1 {
+			t.Errorf("result = %+v, want one threat", result)
+		}
+	})
+
+	t.Run("unauthorized is an error", func(t *testing.T) {
+		noKey := &ScanClient{BaseURL: server.URL, Client: server.Client()}
+		result, err := noKey.ScanReader("doc.pdf", strings.NewReader("content"))
+		if err != nil {
+			t.Fatalf("ScanReader() error: %v", err)
+		}
+		if result.Status != "error" {
+			t.Errorf("Status = %q, want error", result.Status)
+		}
+	})
+}
+
+func TestRunScanCommandExitCodes(t *testing.T) {
+	server := newFakeScanServer(t)
+	defer server.Close()
+
+	dir := t.TempDir()
+	clean := filepath.Join(dir, "clean.txt")
+	infected := filepath.Join(dir, "eicar.txt")
+	failing := filepath.Join(dir, "fail.txt")
+	for _, path := range []string{clean, infected, failing} {
+		writeTestFile(t, path, "content")
+	}
+
+	tests := []struct {
+		name  string
+		files []string
+		want  int
+	}{
+		{name: "clean", files: []string{clean}, want: exitOK},
+		{name: "infected", files: []string{clean, infected}, want: exitInfected},
+		{name: "error wins over infected", files: []string{infected, failing}, want: exitError},
+		{name: "missing file", files: []string{filepath.Join(dir, "missing")}, want: exitError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"-url", server.URL, "-api-key", "test-key", "-json"}, tt.files...)
+			if code := runScanCommand(args); code != tt.want {
+				t.Errorf("exit code = %d, want %d", code, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintScanResult(t *testing.T) {
+	var out strings.Builder
+	printScanResult(&out, scanCommandResult{
+		File: "archive.zip",
+		ScanResponse: ScanResponse{
+			Status:  "infected",
+			Threats: []Threat{{Name: "Virus.A", File: "dir/a.exe"}},
+		},
+	})
+
+	if got := out.String(); got != "archive.zip: Virus.A FOUND in dir/a.exe\n" {
+		t.Errorf("output = %q", got)
+	}
+}
+
+func TestPrintScanResultTimeout(t *testing.T) {
+	var out strings.Builder
+	printScanResult(&out, scanCommandResult{
+		File: "archive.zip",
+		ScanResponse: ScanResponse{
+			Status:       "timeout",
+			Threats:      []Threat{{Name: "Virus.A", File: "dir/a.exe"}},
+			ScannedFiles: 3,
+		},
+	})
+
+	want := "archive.zip: Virus.A FOUND in dir/a.exe\narchive.zip: TIMEOUT after 3 files\n"
+	if got := out.String(); got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+func TestPrintScanResultSkips(t *testing.T) {
+	var out strings.Builder
+	printScanResult(&out, scanCommandResult{
+		File: "archive.zip",
+		ScanResponse: ScanResponse{
+			Status:       "clean_with_skips",
+			ScannedFiles: 2,
+			SkippedFiles: []SkippedFile{{File: "copy.txt", Reason: skipDuplicate}, {File: "secret.docx", Reason: skipEncrypted}},
+		},
+	})
+
+	want := "archive.zip: OK (2 files, 0ms)\narchive.zip: SKIPPED secret.docx (encrypted)\n"
+	if got := out.String(); got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Exit codes for subcommands
+const (
+	exitOK    = 0
+	exitError = 2
+)
+
+// command is a CLI subcommand (e.g. "clamav-rest backup")
+type command struct {
+	summary string
+	run     func(args []string) int
+}
+
+// commands lists the available subcommands; without one the server starts
+var commands = map[string]command{
+	"backup":  {summary: "Write an encrypted backup of service state", run: runBackupCommand},
+	"restore": {summary: "Restore service state from an encrypted backup", run: runRestoreCommand},
+	"scan":    {summary: "Scan files or stdin using a running instance", run: runScanCommand},
+}
+
+// runCommand dispatches a subcommand and returns the process exit code
+func runCommand(name string, args []string) int {
+	if name == "help" {
+		printUsage(os.Stdout)
+		return exitOK
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		printUsage(os.Stderr)
+		return exitError
+	}
+	return cmd.run(args)
+}
+
+// printUsage lists the available subcommands
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: clamav-rest [command] [flags]\n\n")
+	fmt.Fprintf(w, "Without a command, the REST server is started.\n\n")
+	fmt.Fprintf(w, "Commands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-10s %s\n", name, commands[name].summary)
+	}
+}
+
+// commandConfig loads the configuration for a subcommand, layered over
+// configFile (its -config flag) like the server's
+func commandConfig(configFile string) (*Config, bool) {
+	if configFile != "" {
+		if err := LoadConfigFile(configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid config file: %v\n", err)
+			return nil, false
+		}
+	}
+	return LoadConfig(), true
+}
+
+// runBackupCommand implements "clamav-rest backup [-config file] [-o file]"
+func runBackupCommand(args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	configFile := flags.String("config", "", "JSON or YAML config file (environment variables override its settings)")
+	output := flags.String("o", "-", "Output file (- for stdout)")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	config, ok := commandConfig(*configFile)
+	if !ok {
+		return exitError
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitError
+		}
+		defer f.Close()
+		out = f
+	}
+
+	count, err := WriteBackup(out, config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Backup failed: %v\n", err)
+		return exitError
+	}
+
+	fmt.Fprintf(os.Stderr, "Backup complete: %d files\n", count)
+	return exitOK
+}
+
+// runRestoreCommand implements "clamav-rest restore [-config file] [-i file]"
+func runRestoreCommand(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	configFile := flags.String("config", "", "JSON or YAML config file (environment variables override its settings)")
+	input := flags.String("i", "-", "Input file (- for stdin)")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	config, ok := commandConfig(*configFile)
+	if !ok {
+		return exitError
+	}
+
+	in := os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitError
+		}
+		defer f.Close()
+		in = f
+	}
+
+	manifest, err := RestoreBackup(in, config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Restore failed: %v\n", err)
+		return exitError
+	}
+
+	fmt.Fprintf(os.Stderr, "Restore complete: %d files from backup created %s\n",
+		manifest.Files, manifest.CreatedAt.Format("2006-01-02 15:04:05 MST"))
+	fmt.Fprintf(os.Stderr, "Reload clamd to apply restored signatures.\n")
+	return exitOK
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+	t.Run("unknown command", func(t *testing.T) {
+		if code := runCommand("frobnicate", nil); code != exitError {
+			t.Errorf("exit code = %d, want %d", code, exitError)
+		}
+	})
+
+	t.Run("help", func(t *testing.T) {
+		if code := runCommand("help", nil); code != exitOK {
+			t.Errorf("exit code = %d, want %d", code, exitOK)
+		}
+	})
+
+	t.Run("backup and restore via files", func(t *testing.T) {
+		sigDir := t.TempDir()
+		writeTestFile(t, filepath.Join(sigDir, "custom.ndb"), "sig")
+		archive := filepath.Join(t.TempDir(), "backup.bin")
+
+		t.Setenv(EnvBackupKey, testBackupKey)
+		t.Setenv(EnvSignatureDir, sigDir)
+
+		if code := runCommand("backup", []string{"-o", archive}); code != exitOK {
+			t.Fatalf("backup exit code = %d, want %d", code, exitOK)
+		}
+
+		restoreDir := t.TempDir()
+		t.Setenv(EnvSignatureDir, restoreDir)
+
+		if code := runCommand("restore", []string{"-i", archive}); code != exitOK {
+			t.Fatalf("restore exit code = %d, want %d", code, exitOK)
+		}
+		if _, err := os.Stat(filepath.Join(restoreDir, "custom.ndb")); err != nil {
+			t.Errorf("custom.ndb not restored: %v", err)
+		}
+	})
+
+	t.Run("backup and restore with a config file", func(t *testing.T) {
+		sigDir := t.TempDir()
+		writeTestFile(t, filepath.Join(sigDir, "custom.ndb"), "sig")
+		archive := filepath.Join(t.TempDir(), "backup.bin")
+		t.Setenv(EnvBackupKey, "")
+		t.Setenv(EnvSignatureDir, "")
+
+		backupConfig := writeNamedConfigFile(t, "config.yaml", "backup_key: "+testBackupKey+"\nclamav_db_dir: "+sigDir+"\n")
+		if code := runCommand("backup", []string{"-config", backupConfig, "-o", archive}); code != exitOK {
+			t.Fatalf("backup exit code = %d, want %d", code, exitOK)
+		}
+
+		restoreDir := t.TempDir()
+		restoreConfig := writeNamedConfigFile(t, "config.json", `{"backup_key": "`+testBackupKey+`", "clamav_db_dir": "`+restoreDir+`"}`)
+		if code := runCommand("restore", []string{"-config", restoreConfig, "-i", archive}); code != exitOK {
+			t.Fatalf("restore exit code = %d, want %d", code, exitOK)
+		}
+		if _, err := os.Stat(filepath.Join(restoreDir, "custom.ndb")); err != nil {
+			t.Errorf("custom.ndb not restored: %v", err)
+		}
+
+		if code := runCommand("backup", []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}); code != exitError {
+			t.Errorf("exit code with a missing config file = %d, want %d", code, exitError)
+		}
+	})
+
+	t.Run("backup without key fails", func(t *testing.T) {
+		t.Setenv(EnvBackupKey, "")
+		archive := filepath.Join(t.TempDir(), "backup.bin")
+
+		if code := runCommand("backup", []string{"-o", archive}); code != exitError {
+			t.Errorf("exit code = %d, want %d", code, exitError)
+		}
+	})
+}
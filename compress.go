@@ -0,0 +1,155 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressResponses gzips responses of at least minBytes for clients that
+// accept it. Large per-file scan results compress well; small responses and
+// content that is already compressed (backups, profiles) are sent as is.
+func compressResponses(minBytes int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		// WebSocket upgrades take over the connection
+		if !acceptsGzip(r) || r.Method == http.MethodHead || isWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, minBytes: minBytes, status: http.StatusOK}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+				continue
+			}
+			// gzip;q=0 means not acceptable
+			name, q, _ := strings.Cut(params, "=")
+			if strings.TrimSpace(name) == "q" {
+				qvalue, err := strconv.ParseFloat(strings.TrimSpace(q), 64)
+				return err == nil && qvalue > 0
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// compressibleType reports whether a response content type is worth compressing
+func compressibleType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(strings.ToLower(mediaType))
+	switch {
+	case mediaType == "text/event-stream":
+		return false // streamed events must reach the client immediately
+	case strings.HasPrefix(mediaType, "text/"), strings.HasSuffix(mediaType, "json"),
+		strings.HasSuffix(mediaType, "xml"), mediaType == "application/x-ndjson":
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the start of a response until it knows whether
+// the response is large enough to compress, then commits the headers
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minBytes int
+	status   int
+	buf      []byte
+	started  bool
+	gz       *gzip.Writer
+}
+
+// WriteHeader implements http.ResponseWriter; the status is sent with the first body bytes
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if !w.started {
+		w.status = code
+	}
+}
+
+// Write implements http.ResponseWriter
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.started {
+		if w.gz != nil {
+			return w.gz.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.minBytes {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// start sends the headers and the buffered body, compressing from here on if
+// compress is set and the response qualifies
+func (w *gzipResponseWriter) start(compress bool) error {
+	w.started = true
+	header := w.Header()
+	if compress && header.Get("Content-Encoding") == "" && compressibleType(header.Get("Content-Type")) &&
+		w.status != http.StatusNoContent && w.status != http.StatusNotModified {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush implements http.Flusher. A response flushed before reaching the
+// threshold is sent uncompressed. The writers below (panic recovery,
+// tracing) only offer Unwrap, which http.ResponseController follows.
+func (w *gzipResponseWriter) Flush() {
+	if !w.started {
+		w.start(false)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Close sends any buffered response and finishes the gzip stream
+func (w *gzipResponseWriter) Close() error {
+	if !w.started {
+		// Below the threshold: send as is
+		if err := w.start(false); err != nil {
+			return err
+		}
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
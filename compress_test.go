@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.8", true},
+		{"GZIP", true},
+		{"gzip;q=0", false},
+		{"br", false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			req.Header.Set("Accept-Encoding", tt.header)
+		}
+		if got := acceptsGzip(req); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompressResponses(t *testing.T) {
+	large := strings.Repeat(`{"file":"dir/file.txt","status":"clean"},`, 100)
+	respond := func(contentType, body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, body)
+		})
+	}
+
+	tests := []struct {
+		name        string
+		handler     http.Handler
+		accept      string
+		body        string
+		wantEncoded bool
+	}{
+		{"large json", respond("application/json", large), "gzip", large, true},
+		{"small json", respond("application/json", "{}"), "gzip", "{}", false},
+		{"not accepted", respond("application/json", large), "", large, false},
+		{"binary", respond("application/octet-stream", large), "gzip", large, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept-Encoding", tt.accept)
+			}
+			recorder := httptest.NewRecorder()
+
+			compressResponses(1024, tt.handler).ServeHTTP(recorder, req)
+
+			if recorder.Code != http.StatusCreated {
+				t.Errorf("status = %d, want 201", recorder.Code)
+			}
+			if vary := recorder.Header().Get("Vary"); vary != "Accept-Encoding" {
+				t.Errorf("Vary = %q", vary)
+			}
+			encoded := recorder.Header().Get("Content-Encoding") == "gzip"
+			if encoded != tt.wantEncoded {
+				t.Fatalf("compressed = %v, want %v", encoded, tt.wantEncoded)
+			}
+
+			var body io.Reader = recorder.Body
+			if encoded {
+				zr, err := gzip.NewReader(recorder.Body)
+				if err != nil {
+					t.Fatalf("gzip error: %v", err)
+				}
+				body = zr
+			}
+			got, _ := io.ReadAll(body)
+			if string(got) != tt.body {
+				t.Errorf("body = %d bytes, want %d", len(got), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestCompressResponsesStreamsEvents(t *testing.T) {
+	// Through the middleware the server wraps every handler in, the first
+	// event must reach the client while the handler is still running
+	release := make(chan struct{})
+	events := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "event: progress\ndata: {}\n\n")
+		http.NewResponseController(w).Flush()
+		<-release
+	})
+	server := httptest.NewServer(traceRequests(recoverPanics(compressResponses(1024, events))))
+	defer server.Close()
+	defer close(release)
+
+	line := make(chan string, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			line <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		first, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- first
+	}()
+	select {
+	case first := <-line:
+		if first != "event: progress\n" {
+			t.Errorf("first line = %q, want the progress event", first)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("event not received before the handler returned")
+	}
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -12,40 +18,511 @@ import (
 // All settings can be overridden via environment variables.
 type Config struct {
 	// Server settings
-	Port      string
-	DebugMode bool
+	Port              string
+	BindAddress       string   // Interface address to listen on (empty = all)
+	BasePath          string   // Prefix for all routes, e.g. /antivirus (empty = none)
+	TrustedProxies    []string // IPs/CIDRs whose X-Forwarded-For is honored
+	OutboundProxy     string   // Proxy for requests to external services (empty = HTTP(S)_PROXY/NO_PROXY)
+	OutboundNoProxy   []string // Hosts reached without OutboundProxy
+	EgressSchemes     []string // URL schemes outbound requests may use (empty = any)
+	EgressHosts       []string // Hosts outbound requests may reach (empty = any)
+	EgressDeniedCIDRs []string // Addresses outbound connections must not reach
+	EgressCIDRs       []string // Exceptions to EgressDeniedCIDRs
+	EgressRedirects   int      // Redirects followed by outbound requests
+	IPAllowlist       []string // Client IPs/CIDRs allowed (empty = all)
+	IPDenylist        []string // Client IPs/CIDRs rejected
+	DebugMode         bool
+	EnableDiagnostics bool // Expose /debug/pprof and /debug/diagnostics
+	EnableSanitize    bool // Expose POST /sanitize
+
+	EnableTestVerdicts bool // Honor X-Test-Verdict (never in production)
+
+	// Unix domain socket listener (instead of the TCP port)
+	ListenSocket     string
+	ListenSocketMode os.FileMode
 
 	// HTTP server timeouts (prevent slow-loris and connection exhaustion)
 	ReadTimeout  time.Duration // Max time to read request headers + body
 	WriteTimeout time.Duration // Max time to write response
 	IdleTimeout  time.Duration // Max time for keep-alive connections
 
+	// HTTP protocol settings
+	EnableHTTP2                 bool // HTTP/2 over TLS and cleartext HTTP/2 (h2c)
+	EnableResponseCompression   bool // gzip responses for clients that accept it
+	ResponseCompressionMinBytes int  // Smaller responses are sent uncompressed
+
 	// Upload limits
-	MaxUploadSize int64 // Maximum size of uploaded file (bytes)
+	MaxUploadSize    int64    // Maximum size of uploaded file (bytes)
+	UploadFieldNames []string // Multipart fields that carry the file (empty = any file part)
+	MetadataMaxBytes int      // Largest caller metadata object echoed with the result
+
+	// File policy, checked before extraction and scanning (empty = any)
+	AllowedExtensions []string // e.g. .pdf, .docx
+	DeniedExtensions  []string
+	AllowedTypes      []string // MIME types detected from the content, or type/*
+	DeniedTypes       []string
 
 	// Zip bomb protection limits
 	MaxExtractedSize  int64  // Maximum total size of extracted files (bytes)
 	MaxFileCount      int    // Maximum number of files in archive
 	MaxSingleFileSize uint64 // Maximum size of single file (bytes)
+	MaxEntryPath      int    // Maximum length of an archive entry path (bytes, 0 = unlimited)
+
+	// Passwords tried on encrypted ZIP entries, after those sent with the request
+	ArchivePasswords []string
+
+	// Decompression budget of a whole request, over all its archives (0 = unlimited)
+	RequestMaxExtracted int64 // Bytes extracted
+	RequestMaxFiles     int   // Files extracted
+	RequestMaxDirs      int   // Directories created
+	RequestMaxDepth     int   // Directory levels below the extraction directory
 
 	// Scan settings
 	ScanTimeout time.Duration // Maximum time for scan operation
 	MaxThreads  int           // ClamAV MaxThreads (for conditional multiscan)
+
+	ScanTimeoutMax time.Duration // Longest scan timeout a request or tenant may set (0 = ScanTimeout)
+
+	HashAlgorithms []string // Digests reported for uploads and threats (md5, sha1, sha256)
+	FuzzyHashing   bool     // Compute ssdeep hashes of infected files
+	StaticAnalysis string   // Entropy and header triage: off, threats or all files
+
+	ThreatClassesFile string // JSON file overriding the platform/category/family parsed from signature names
+	ThreatTagsFile    string // JSON or CSV database of tags (ATT&CK techniques, aliases) per family or signature
+
+	MalwareBazaarAuthKey  string        // abuse.ch Auth-Key (empty = no MalwareBazaar lookups)
+	MalwareBazaarURL      string        // MalwareBazaar API endpoint
+	MalwareBazaarTimeout  time.Duration // Longest the lookups of one scan may take
+	MalwareBazaarCacheTTL time.Duration // How long answers are cached
+
+	HeuristicAlerts []string // ClamAV heuristic alerts turned on in clamd.conf: macros, encrypted, broken, limits or all
+
+	EmailExtraction    bool // Scan .eml/.msg attachments as separate parts
+	ImageExtraction    bool // Scan the files of ISO 9660 and UDF images separately
+	StreamExtraction   bool // Extract tar uploads while they are received
+	DedupeEntries      bool // Scan identical archive entries once
+	DocumentIndicators bool // Report and scan macros and embedded objects in Office documents
+
+	// Decompression bomb heuristics for ZIP and streamed tar.gz uploads
+	ArchiveMaxRatio            int    // Largest uncompressed/compressed size ratio (0 = unchecked)
+	ArchiveMaxNestedDuplicates int    // Most identical nested archives in a ZIP (0 = unchecked)
+	ArchiveBombAction          string // reject or flag
+
+	// Temp directory for uploads and extracted archives
+	ScanTmpDir     string // "" = TMPDIR or /tmp
+	ScanTmpMinFree int64  // Free space uploads and extraction must leave (bytes)
+
+	// Memory-bounded mode for small containers
+	MemoryBounded    bool  // Cap extraction buffers, stream tar uploads and shed load
+	MemoryBufferSize int64 // Document objects held in memory at once (bytes)
+	ShedRSS          int64 // Shed scans above this RSS (bytes; 0 = 80% of the container limit)
+	ShedTemp         int64 // Shed scans above this much scan temp data (bytes; 0 = unchecked)
+
+	// Load shedding under system pressure (0 = unchecked)
+	ShedLoadPerCPU   float64 // 1-minute load average per CPU
+	ShedMinAvailable int64   // Available system memory (bytes)
+	ShedGoroutines   int
+	ShedQueueDepth   int // Scans waiting for a worker
+
+	// Fault injection for resilience tests (0 = off)
+	FaultLatency           time.Duration // Added to scan requests
+	FaultLatencyPercent    int           // Share of scan requests delayed
+	FaultClamdErrorPercent int           // Share of clamd calls failing as if clamd were unreachable
+	FaultExtractDelay      time.Duration // Added before extracting an upload
+	FaultExtractPercent    int           // Share of uploads extracted slowly
+
+	// Container image scanning (POST /scan/image)
+	ImageRegistries     []string // Registry hosts images may be pulled from ("*" = any; empty = disabled)
+	ImageMaxLayerSize   int64    // Largest compressed layer downloaded (bytes)
+	ImageLayerCacheSize int      // Layer verdicts cached by digest (0 = no cache)
+
+	// Verdict cache shared between replicas
+	VerdictCacheRedisURL string        // redis:// or rediss:// (empty = memory only)
+	VerdictCacheTTL      time.Duration // How long shared verdicts are kept
+	VerdictCachePrefix   string        // Namespace of the Redis keys
+
+	ScanPathRoots []string // Directories POST /scan/path may scan below (empty = disabled)
+
+	// Object storage scanning (POST /scan/object)
+	ObjectStorageProviders []string // Enabled providers: gcs, azure (empty = disabled)
+	GCSCredentialsFile     string   // Service account JSON key (empty = anonymous)
+	AzureStorageAccount    string   // Storage account blobs are read from
+	AzureStorageKey        string   // Shared key (base64)
+	AzureStorageSASToken   string   // Shared access signature, instead of the key
+
+	// Remote file scanning (POST /scan/remote)
+	RemoteScanHosts   []string          // SFTP/FTPS hosts files may be fetched from ("*" = any; empty = disabled)
+	RemoteCredentials map[string]string // "user:password" by host, for requests without credentials
+	RemoteSSHHostKeys map[string]string // Pinned SFTP host key SHA-256 fingerprints (base64) by host
+	CurlPath          string            // curl binary used for the transfers
+
+	// clamdscan command
+	ClamdscanPath      string   // clamdscan binary
+	ClamdConfigFile    string   // clamd.conf passed to clamdscan
+	ClamdscanFdpass    bool     // Pass file descriptors to clamd (--fdpass)
+	ClamdscanStream    bool     // Stream file contents to clamd (--stream)
+	ClamdscanMultiscan bool     // Scan in parallel (--multiscan, needs MaxThreads >= 2)
+	ClamdscanArgs      []string // Extra arguments
+
+	// Native clamd client (instead of clamdscan)
+	ClamdAddress       string // tcp://host:port or unix:///path (empty = clamdscan)
+	ClamdPoolSize      int    // Persistent clamd connections
+	ClamdStreamWorkers int    // Connections one scan streams files over in parallel (0 = SCAN by path)
+
+	// clamd failure handling
+	ClamdRetries          int           // Retries for transient clamd errors
+	ClamdBreakerThreshold int           // Consecutive failures that open the circuit (0 = disabled)
+	ClamdBreakerCooldown  time.Duration // How long the circuit stays open
+	ClamdStartupWait      time.Duration // Max wait for clamd on startup (0 = don't wait)
+	ClamdUnreachableExit  time.Duration // Exit when clamd is down this long (0 = never)
+
+	// Worker pool
+	ScanWorkers   int           // Concurrent scans (0 = unlimited)
+	ScanQueueSize int           // Scans waiting for a worker
+	ScanQueueWait time.Duration // How long to wait for a queue slot before 503
+
+	// Async scan jobs
+	AsyncMaxJobs int           // Jobs kept at once (0 = async scans disabled)
+	AsyncJobTTL  time.Duration // How long finished results are kept
+	AsyncJobDir  string        // Where jobs are saved to survive restarts ("" = memory only)
+
+	// Coordinator mode: instances sharing ASYNC_JOB_DIR claim its jobs
+	CoordinatorRedisURL string        // redis:// or rediss:// (empty = disabled)
+	CoordinatorPrefix   string        // Namespace of the Redis keys
+	CoordinatorLease    time.Duration // How long a job stays claimed by an instance that stopped renewing
+	CoordinatorJobs     int           // Jobs this instance runs at once
+
+	// Signed async result URLs
+	ResultURLSecret string        // HMAC secret ("" = disabled)
+	ResultURLTTL    time.Duration // How long a signed URL stays valid
+
+	// Scan history (GET /stats)
+	ScanHistorySize int    // Most recent scans kept (0 = disabled)
+	ScanHistoryFile string // JSON lines file the history survives restarts in ("" = memory only)
+
+	// Retention periods (0 = no time limit)
+	ScanHistoryRetention time.Duration
+	QuarantineRetention  time.Duration // Files in WatchQuarantineDir
+
+	// Batch scans (POST /scan/batch)
+	BatchMaxItems    int // Items accepted per batch
+	BatchConcurrency int // Items of one batch fetched and scanned at once
+
+	// Resumable uploads
+	UploadSessionsMax int           // Unfinished uploads kept at once (0 = resumable uploads disabled)
+	UploadSessionTTL  time.Duration // Idle time before an unfinished upload is discarded
+
+	// Watched directories
+	WatchDirs          []string      // Drop folders scanned as files appear (empty = disabled)
+	WatchInterval      time.Duration // How often the folders are checked
+	WatchQuarantineDir string        // Infected files are moved here (empty = renamed in place)
+	WatchCleanDir      string        // Clean files are moved here (empty = left in place)
+
+	// Re-scans after signature updates
+	RescanOnUpdate bool     // Re-scan the quarantine and RescanDirs when the signatures change
+	RescanDirs     []string // Stores of previously clean files to re-scan
+
+	// Authentication settings
+	AuthMethods         []string            // Authenticators to chain, tried in order
+	APIKeys             map[string]string   // API key -> key name
+	BasicAuthUsers      map[string]string   // Username -> password
+	JWTSecret           string              // HMAC secret for HS256 tokens
+	JWTJWKSURL          string              // JWKS endpoint for RS256 tokens
+	JWTIssuer           string              // Expected "iss" claim (also used for OIDC discovery)
+	JWTAudience         string              // Expected "aud" claim
+	MTLSAllowedSubjects []string            // Allowed client certificate CNs (empty = any verified cert)
+	AuthScopes          map[string][]string // Identity key (method:name) -> granted scopes
+
+	// Additional scan endpoints with their own policy profiles
+	ScanRoutesFile string
+
+	// StatsD / DogStatsD metrics
+	StatsDAddress string   // host:port of the agent (empty = disabled)
+	StatsDPrefix  string   // Prefix for metric names
+	StatsDTags    []string // Tags added to every metric
+	DogStatsD     bool     // Send tags in DogStatsD format
+
+	// Audit log for detections
+	AuditLogFile        string // JSON lines file (empty = disabled)
+	AuditSyslogAddress  string // udp://, tcp:// or unix:// syslog address (empty = disabled)
+	AuditSyslogFacility string
+
+	// SIEM forwarding (CEF/LEEF over syslog)
+	SIEMAddress  string // udp://, tcp:// or tls:// syslog address (empty = disabled)
+	SIEMFormat   string // cef or leef
+	SIEMFacility string
+	SIEMCAFile   string            // CA bundle for tls:// (empty = system roots)
+	SIEMFieldMap map[string]string // Event field -> CEF/LEEF key overrides
+
+	// Detection notifications
+	NotifyURL       string // Slack, Teams or generic webhook URL (empty = disabled)
+	NotifyFormat    string // slack, teams or webhook
+	NotifyTemplate  string // text/template for the message text (empty = built-in)
+	NotifyInterval  int    // Batching interval in seconds
+	NotifyRateLimit int    // Maximum messages per minute
+
+	// Elasticsearch/OpenSearch result indexing
+	ElasticsearchURL       string // Cluster URL (empty = disabled)
+	ElasticsearchIndex     string // Index name, {layout} expands to the scan date
+	ElasticsearchUsername  string
+	ElasticsearchPassword  string
+	ElasticsearchAPIKey    string // Takes precedence over username/password
+	ElasticsearchBatchSize int    // Documents per bulk request
+	ElasticsearchInterval  int    // Maximum seconds between bulk requests
+
+	// Signed result tokens
+	ResultTokenSecret  string // HMAC secret for HS256 tokens
+	ResultTokenKeyFile string // PEM Ed25519 private key for EdDSA tokens
+	ResultTokenIssuer  string // "iss" claim
+
+	// Rate limiting per API key / client IP
+	RateLimitRPS   float64 // Requests per second (0 = disabled)
+	RateLimitBurst int     // Requests allowed at once before limiting
+
+	// Scan requests handled at once (0 = unlimited)
+	MaxInFlightPerIP int // Per client IP
+	MaxInFlight      int // In total
+
+	// CORS for browser uploads (disabled if no origins)
+	CORSAllowedOrigins   []string // Origins, * or https://*.example.com patterns
+	CORSAllowedMethods   []string
+	CORSAllowedHeaders   []string
+	CORSAllowCredentials bool // Allow cookies and Authorization from browsers
+	CORSMaxAge           int  // Seconds browsers may cache a preflight
+
+	// Multi-tenancy
+	TenantsFile string // JSON file mapping identities to tenants (empty = disabled)
+
+	// State and backups
+	SignatureDir string // ClamAV database directory (custom signatures are backed up)
+	BackupKey    string // Hex-encoded AES-256 key for backup archives
+
+	// TLS settings (required for mTLS authentication)
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+
+	// Values that could not be parsed while loading (reported by Validate)
+	invalidSettings []error
 }
 
 // Environment variable names
 const (
 	EnvPort             = "PORT"
 	EnvLogLevel         = "LOG_LEVEL"
+	EnvDiagnostics      = "ENABLE_DIAGNOSTICS"
+	EnvSanitize         = "ENABLE_SANITIZE"
+	EnvTestVerdicts     = "ENABLE_TEST_VERDICTS"
 	EnvReadTimeout      = "READ_TIMEOUT_SECONDS"
 	EnvWriteTimeout     = "WRITE_TIMEOUT_SECONDS"
 	EnvIdleTimeout      = "IDLE_TIMEOUT_SECONDS"
 	EnvMaxUploadSize    = "MAX_UPLOAD_SIZE_MB"
+	EnvUploadFieldNames = "UPLOAD_FIELD_NAMES"
+	EnvMetadataMaxBytes = "METADATA_MAX_BYTES"
+	EnvAllowedExt       = "UPLOAD_ALLOWED_EXTENSIONS"
+	EnvDeniedExt        = "UPLOAD_DENIED_EXTENSIONS"
+	EnvAllowedTypes     = "UPLOAD_ALLOWED_TYPES"
+	EnvDeniedTypes      = "UPLOAD_DENIED_TYPES"
 	EnvMaxExtractedSize = "MAX_EXTRACTED_SIZE_MB"
 	EnvMaxFileCount     = "MAX_FILE_COUNT"
 	EnvMaxSingleFile    = "MAX_SINGLE_FILE_MB"
+	EnvMaxEntryPath     = "MAX_ENTRY_PATH_LENGTH"
+	EnvArchivePasswords = "ARCHIVE_PASSWORDS"
+	EnvRequestExtracted = "REQUEST_MAX_EXTRACTED_MB"
+	EnvRequestFiles     = "REQUEST_MAX_FILES"
+	EnvRequestDirs      = "REQUEST_MAX_DIRECTORIES"
+	EnvRequestDepth     = "REQUEST_MAX_DEPTH"
 	EnvScanTimeout      = "SCAN_TIMEOUT_MINUTES"
+	EnvScanTimeoutMax   = "SCAN_TIMEOUT_MAX_MINUTES"
 	EnvMaxThreads       = "MAX_THREADS"
+	EnvHashAlgorithms   = "HASH_ALGORITHMS"
+	EnvFuzzyHashing     = "FUZZY_HASHING"
+	EnvStaticAnalysis   = "STATIC_ANALYSIS"
+	EnvThreatClasses    = "THREAT_CLASSES_FILE"
+	EnvThreatTags       = "THREAT_TAGS_FILE"
+
+	EnvMalwareBazaarAuthKey  = "MALWAREBAZAAR_AUTH_KEY"
+	EnvMalwareBazaarURL      = "MALWAREBAZAAR_URL"
+	EnvMalwareBazaarTimeout  = "MALWAREBAZAAR_TIMEOUT_MS"
+	EnvMalwareBazaarCacheTTL = "MALWAREBAZAAR_CACHE_HOURS"
+	EnvHeuristicAlerts       = "HEURISTIC_ALERTS"
+	EnvEmailExtraction       = "EMAIL_EXTRACTION"
+	EnvImageExtraction       = "IMAGE_EXTRACTION"
+	EnvStreamExtraction      = "STREAM_EXTRACTION"
+	EnvDedupeEntries         = "DEDUPE_ARCHIVE_ENTRIES"
+	EnvDocIndicators         = "DOCUMENT_INDICATORS"
+	EnvImageRegistries       = "IMAGE_REGISTRIES"
+	EnvImageMaxLayer         = "IMAGE_MAX_LAYER_SIZE_MB"
+	EnvImageLayerCache       = "IMAGE_LAYER_CACHE_SIZE"
+	EnvScanPathRoots         = "SCAN_PATH_ROOTS"
+	EnvClamdAddress          = "CLAMD_ADDRESS"
+	EnvClamdPoolSize         = "CLAMD_POOL_SIZE"
+	EnvClamdStreamWork       = "CLAMD_STREAM_WORKERS"
+	EnvScanWorkers           = "SCAN_WORKERS"
+	EnvScanQueueSize         = "SCAN_QUEUE_SIZE"
+	EnvScanQueueWait         = "SCAN_QUEUE_WAIT_SECONDS"
+
+	EnvVerdictCacheRedisURL = "VERDICT_CACHE_REDIS_URL"
+	EnvVerdictCacheTTL      = "VERDICT_CACHE_TTL_HOURS"
+	EnvVerdictCachePrefix   = "VERDICT_CACHE_PREFIX"
+
+	EnvArchiveMaxRatio            = "ARCHIVE_MAX_RATIO"
+	EnvArchiveMaxNestedDuplicates = "ARCHIVE_MAX_NESTED_DUPLICATES"
+	EnvArchiveBombAction          = "ARCHIVE_BOMB_ACTION"
+
+	EnvScanTmpDir     = "SCAN_TMP_DIR"
+	EnvScanTmpMinFree = "SCAN_TMP_MIN_FREE_MB"
+
+	EnvMemoryBounded    = "MEMORY_BOUNDED"
+	EnvMemoryBufferSize = "MEMORY_BUFFER_MB"
+	EnvShedRSS          = "SHED_RSS_MB"
+	EnvShedTemp         = "SHED_TEMP_MB"
+
+	EnvShedLoadPerCPU   = "SHED_LOAD_PER_CPU"
+	EnvShedMinAvailable = "SHED_MIN_AVAILABLE_MB"
+	EnvShedGoroutines   = "SHED_GOROUTINES"
+	EnvShedQueueDepth   = "SHED_QUEUE_DEPTH"
+
+	EnvFaultLatency           = "FAULT_LATENCY_MS"
+	EnvFaultLatencyPercent    = "FAULT_LATENCY_PERCENT"
+	EnvFaultClamdErrorPercent = "FAULT_CLAMD_ERROR_PERCENT"
+	EnvFaultExtractDelay      = "FAULT_EXTRACT_DELAY_MS"
+	EnvFaultExtractPercent    = "FAULT_EXTRACT_PERCENT"
+
+	EnvObjectStorageProviders = "OBJECT_STORAGE_PROVIDERS"
+	EnvGCSCredentialsFile     = "GCS_CREDENTIALS_FILE"
+	EnvAzureStorageAccount    = "AZURE_STORAGE_ACCOUNT"
+	EnvAzureStorageKey        = "AZURE_STORAGE_KEY"
+	EnvAzureStorageSASToken   = "AZURE_STORAGE_SAS_TOKEN"
+
+	EnvRemoteScanHosts   = "REMOTE_SCAN_HOSTS"
+	EnvRemoteCredentials = "REMOTE_CREDENTIALS"
+	EnvRemoteSSHHostKeys = "REMOTE_SSH_HOST_KEYS"
+	EnvCurlPath          = "CURL_PATH"
+
+	EnvClamdscanPath      = "CLAMDSCAN_PATH"
+	EnvClamdConfigFile    = "CLAMD_CONFIG_FILE"
+	EnvClamdscanFdpass    = "CLAMDSCAN_FDPASS"
+	EnvClamdscanStream    = "CLAMDSCAN_STREAM"
+	EnvClamdscanMultiscan = "CLAMDSCAN_MULTISCAN"
+	EnvClamdscanArgs      = "CLAMDSCAN_EXTRA_ARGS"
+
+	EnvClamdRetries          = "CLAMD_RETRIES"
+	EnvClamdBreakerThreshold = "CLAMD_BREAKER_THRESHOLD"
+	EnvClamdBreakerCooldown  = "CLAMD_BREAKER_COOLDOWN_SECONDS"
+	EnvClamdStartupWait      = "CLAMD_STARTUP_WAIT_SECONDS"
+	EnvClamdUnreachableExit  = "CLAMD_UNREACHABLE_EXIT_SECONDS"
+
+	EnvAuthMethods         = "AUTH_METHODS"
+	EnvAPIKeys             = "API_KEYS"
+	EnvBasicAuthUsers      = "BASIC_AUTH_USERS"
+	EnvJWTSecret           = "JWT_SECRET"
+	EnvJWTJWKSURL          = "JWT_JWKS_URL"
+	EnvJWTIssuer           = "JWT_ISSUER"
+	EnvJWTAudience         = "JWT_AUDIENCE"
+	EnvMTLSAllowedSubjects = "MTLS_ALLOWED_SUBJECTS"
+	EnvAuthScopes          = "AUTH_SCOPES"
+	EnvScanRoutesFile      = "SCAN_ROUTES_FILE"
+	EnvStatsDAddress       = "STATSD_ADDRESS"
+	EnvStatsDPrefix        = "STATSD_PREFIX"
+	EnvStatsDTags          = "STATSD_TAGS"
+	EnvDogStatsD           = "STATSD_DOGSTATSD"
+	EnvDDAgentHost         = "DD_AGENT_HOST"
+	EnvDDDogStatsDPort     = "DD_DOGSTATSD_PORT"
+	EnvAuditLogFile        = "AUDIT_LOG_FILE"
+	EnvAuditSyslogAddress  = "AUDIT_SYSLOG_ADDRESS"
+	EnvAuditSyslogFacility = "AUDIT_SYSLOG_FACILITY"
+	EnvSIEMAddress         = "SIEM_SYSLOG_ADDRESS"
+	EnvSIEMFormat          = "SIEM_FORMAT"
+	EnvSIEMFacility        = "SIEM_SYSLOG_FACILITY"
+	EnvSIEMCAFile          = "SIEM_TLS_CA_FILE"
+	EnvSIEMFieldMap        = "SIEM_FIELD_MAP"
+	EnvNotifyURL           = "NOTIFY_WEBHOOK_URL"
+	EnvNotifyFormat        = "NOTIFY_FORMAT"
+	EnvNotifyTemplate      = "NOTIFY_TEMPLATE"
+	EnvNotifyInterval      = "NOTIFY_INTERVAL"
+	EnvNotifyRateLimit     = "NOTIFY_RATE_LIMIT"
+
+	EnvElasticsearchURL       = "ELASTICSEARCH_URL"
+	EnvElasticsearchIndex     = "ELASTICSEARCH_INDEX"
+	EnvElasticsearchUsername  = "ELASTICSEARCH_USERNAME"
+	EnvElasticsearchPassword  = "ELASTICSEARCH_PASSWORD"
+	EnvElasticsearchAPIKey    = "ELASTICSEARCH_API_KEY"
+	EnvElasticsearchBatchSize = "ELASTICSEARCH_BATCH_SIZE"
+	EnvElasticsearchInterval  = "ELASTICSEARCH_FLUSH_INTERVAL"
+
+	EnvResultTokenSecret  = "RESULT_TOKEN_SECRET"
+	EnvResultTokenKeyFile = "RESULT_TOKEN_KEY_FILE"
+	EnvResultTokenIssuer  = "RESULT_TOKEN_ISSUER"
+
+	EnvRateLimitRPS    = "RATE_LIMIT_RPS"
+	EnvRateLimitBurst  = "RATE_LIMIT_BURST"
+	EnvTenantsFile     = "TENANTS_FILE"
+	EnvSignatureDir    = "CLAMAV_DB_DIR"
+	EnvBackupKey       = "BACKUP_KEY"
+	EnvTLSCertFile     = "TLS_CERT_FILE"
+	EnvTLSKeyFile      = "TLS_KEY_FILE"
+	EnvTLSClientCAFile = "TLS_CLIENT_CA_FILE"
+
+	EnvMaxInFlightPerIP = "MAX_IN_FLIGHT_PER_IP"
+	EnvMaxInFlight      = "MAX_IN_FLIGHT"
+
+	EnvHTTP2                       = "ENABLE_HTTP2"
+	EnvResponseCompression         = "ENABLE_RESPONSE_COMPRESSION"
+	EnvResponseCompressionMinBytes = "RESPONSE_COMPRESSION_MIN_BYTES"
+
+	EnvListenSocket     = "LISTEN_SOCKET"
+	EnvListenSocketMode = "LISTEN_SOCKET_MODE"
+	EnvBindAddress      = "BIND_ADDRESS"
+	EnvBasePath         = "BASE_PATH"
+	EnvTrustedProxies   = "TRUSTED_PROXIES"
+	EnvOutboundProxy    = "OUTBOUND_PROXY"
+	EnvOutboundNoProxy  = "OUTBOUND_NO_PROXY"
+	EnvEgressSchemes    = "EGRESS_ALLOWED_SCHEMES"
+	EnvEgressHosts      = "EGRESS_ALLOWED_HOSTS"
+	EnvEgressDenied     = "EGRESS_DENIED_CIDRS"
+	EnvEgressCIDRs      = "EGRESS_ALLOWED_CIDRS"
+	EnvEgressRedirects  = "EGRESS_MAX_REDIRECTS"
+	EnvIPAllowlist      = "IP_ALLOWLIST"
+	EnvIPDenylist       = "IP_DENYLIST"
+
+	EnvCORSAllowedOrigins   = "CORS_ALLOWED_ORIGINS"
+	EnvCORSAllowedMethods   = "CORS_ALLOWED_METHODS"
+	EnvCORSAllowedHeaders   = "CORS_ALLOWED_HEADERS"
+	EnvCORSAllowCredentials = "CORS_ALLOW_CREDENTIALS"
+	EnvCORSMaxAge           = "CORS_MAX_AGE_SECONDS"
+
+	EnvAsyncMaxJobs = "ASYNC_MAX_JOBS"
+	EnvAsyncJobTTL  = "ASYNC_JOB_TTL_MINUTES"
+	EnvAsyncJobDir  = "ASYNC_JOB_DIR"
+
+	EnvCoordinatorRedisURL = "COORDINATOR_REDIS_URL"
+	EnvCoordinatorPrefix   = "COORDINATOR_PREFIX"
+	EnvCoordinatorLease    = "COORDINATOR_LEASE_SECONDS"
+	EnvCoordinatorJobs     = "COORDINATOR_JOBS"
+
+	EnvResultURLSecret = "RESULT_URL_SECRET"
+	EnvResultURLTTL    = "RESULT_URL_TTL_MINUTES"
+
+	EnvScanHistorySize = "SCAN_HISTORY_SIZE"
+	EnvScanHistoryFile = "SCAN_HISTORY_FILE"
+
+	EnvScanHistoryRetention = "SCAN_HISTORY_RETENTION_DAYS"
+	EnvQuarantineRetention  = "QUARANTINE_RETENTION_DAYS"
+
+	EnvBatchMaxItems    = "BATCH_MAX_ITEMS"
+	EnvBatchConcurrency = "BATCH_CONCURRENCY"
+
+	EnvUploadSessionsMax = "UPLOAD_SESSIONS_MAX"
+	EnvUploadSessionTTL  = "UPLOAD_SESSION_TTL_MINUTES"
+
+	EnvWatchDirs          = "WATCH_DIRS"
+	EnvWatchInterval      = "WATCH_INTERVAL_SECONDS"
+	EnvWatchQuarantineDir = "WATCH_QUARANTINE_DIR"
+	EnvWatchCleanDir      = "WATCH_CLEAN_DIR"
+
+	EnvRescanOnUpdate = "RESCAN_ON_DB_UPDATE"
+	EnvRescanDirs     = "RESCAN_DIRS"
 )
 
 // Default values
@@ -55,59 +532,730 @@ const (
 	DefaultWriteTimeoutSecs = 300    // 5 minutes (scanning can take time)
 	DefaultIdleTimeoutSecs  = 60     // 60 seconds
 	DefaultMaxUploadMB      = 512    // 512MB max upload
+	DefaultMetadataMaxBytes = 4096   // 4KB of caller metadata
 	DefaultMaxExtractedMB   = 1024   // 1GB
 	DefaultMaxFileCount     = 100000 // 100k files
 	DefaultMaxSingleFileMB  = 256    // 256MB
-	DefaultScanTimeoutMins  = 5      // 5 minutes
-	DefaultMaxThreads       = 10     // ClamAV default
+	DefaultMaxEntryPath     = 1024   // 1KB
+
+	DefaultRequestExtractedMB = 4096   // 4GB over all archives of a request
+	DefaultRequestFiles       = 400000 // 400k files
+	DefaultRequestDirs        = 100000 // 100k directories
+	DefaultRequestDepth       = 64     // Directory levels
+
+	DefaultEgressSchemes   = "https,http,sftp,ftps"
+	DefaultEgressRedirects = 5
+	// Unspecified and link-local addresses, which include the cloud metadata
+	// services (169.254.169.254; fd00:ec2::254 on AWS; 100.100.100.200 on
+	// Alibaba Cloud)
+	DefaultEgressDenied = "0.0.0.0/8,169.254.0.0/16,100.100.100.200/32,::/128,fe80::/10,fd00:ec2::254/128"
+
+	DefaultImageMaxLayerMB = 2048 // 2GB compressed
+	DefaultImageLayerCache = 1000 // Layer verdicts
+	DefaultScanTimeoutMins = 5    // 5 minutes
+	DefaultMaxThreads      = 10   // ClamAV default
+	DefaultScanQueueSize   = 100
+	DefaultScanQueueWait   = 10     // seconds
+	DefaultAuthMethods     = "none" // No authentication
+	DefaultSignatureDir    = "/var/lib/clamav"
+	DefaultStatsDPrefix    = "clamav_rest."
+	DefaultDogStatsDPort   = "8125"
+	DefaultSyslogFacility  = "auth"
+	DefaultSIEMFormat      = "cef"
+	DefaultNotifyFormat    = "webhook"
+	DefaultNotifyInterval  = 10 // seconds
+	DefaultNotifyRateLimit = 6  // messages per minute
+
+	DefaultElasticsearchIndex     = "clamav-scans-{2006.01.02}"
+	DefaultElasticsearchBatchSize = 500
+	DefaultElasticsearchInterval  = 5 // seconds
+
+	DefaultArchiveMaxRatio            = 100 // Uncompressed bytes per compressed byte
+	DefaultArchiveMaxNestedDuplicates = 8
+
+	DefaultScanTmpMinFreeMB = 64
+	DefaultMemoryBufferMB   = 32
+
+	DefaultResultTokenIssuer = "clamav-rest"
+
+	DefaultRateLimitBurst = 10
+
+	DefaultClamdscanPath = "/usr/bin/clamdscan"
+	DefaultCurlPath      = "/usr/bin/curl"
+
+	// Generated by entrypoint.sh in /var/run/clamav to avoid mounting over
+	// /etc/clamav which contains required certificates
+	DefaultClamdConfigFile = "/var/run/clamav/clamd.conf"
+
+	DefaultClamdRetries          = 3
+	DefaultClamdBreakerThreshold = 5
+	DefaultClamdBreakerCooldown  = 30  // seconds
+	DefaultClamdStartupWait      = 180 // seconds
+
+	DefaultResponseCompressionMinBytes = 1024
+
+	DefaultListenSocketMode = 0660 // Owner and group (the co-located app)
+
+	DefaultCORSAllowedMethods = "GET,POST"
+	DefaultCORSAllowedHeaders = "Authorization,Content-Type,Content-Encoding,X-API-Key"
+	DefaultCORSMaxAge         = 600 // seconds
+
+	DefaultAsyncMaxJobs = 1000
+	DefaultAsyncJobTTL  = 60 // minutes
+
+	DefaultCoordinatorPrefix = "clamav-rest:"
+	DefaultCoordinatorLease  = 30 // seconds
+	DefaultCoordinatorJobs   = 4
+
+	DefaultResultURLTTL = 60 // minutes
+
+	DefaultScanHistorySize = 10000
+
+	DefaultVerdictCacheTTL = 24 // hours
+
+	DefaultMalwareBazaarTimeout  = 2000 // ms
+	DefaultMalwareBazaarCacheTTL = 24   // hours
+	DefaultVerdictCachePrefix    = "clamav-rest:"
+
+	DefaultBatchMaxItems    = 1000
+	DefaultBatchConcurrency = 4
+
+	DefaultUploadSessionsMax = 100
+	DefaultUploadSessionTTL  = 60 // minutes
+
+	DefaultWatchInterval = 5 // seconds
 )
 
-// LoadConfig loads configuration from environment variables.
+// LoadConfig loads configuration from environment variables, falling back
+// to the config file settings (see LoadConfigFile).
 // Uses sensible defaults if not specified.
 func LoadConfig() *Config {
+	invalidSettings = nil
+
+	// Memory-bounded mode changes the defaults of other settings
+	memoryBounded := getEnvBool(EnvMemoryBounded, false)
+
 	config := &Config{
 		// Server settings
-		Port:      getEnvStr(EnvPort, DefaultPort),
-		DebugMode: strings.ToLower(os.Getenv(EnvLogLevel)) == "debug",
+		Port:              getEnvStr(EnvPort, DefaultPort),
+		BindAddress:       strings.TrimSuffix(strings.TrimPrefix(getenv(EnvBindAddress), "["), "]"),
+		BasePath:          normalizeBasePath(getenv(EnvBasePath)),
+		TrustedProxies:    getEnvList(EnvTrustedProxies, ""),
+		OutboundProxy:     getenv(EnvOutboundProxy),
+		OutboundNoProxy:   getEnvList(EnvOutboundNoProxy, ""),
+		EgressSchemes:     getEnvList(EnvEgressSchemes, DefaultEgressSchemes),
+		EgressHosts:       getEnvList(EnvEgressHosts, ""),
+		EgressDeniedCIDRs: getEnvList(EnvEgressDenied, DefaultEgressDenied),
+		EgressCIDRs:       getEnvList(EnvEgressCIDRs, ""),
+		EgressRedirects:   getEnvInt(EnvEgressRedirects, DefaultEgressRedirects),
+		IPAllowlist:       getEnvList(EnvIPAllowlist, ""),
+		IPDenylist:        getEnvList(EnvIPDenylist, ""),
+		DebugMode:         strings.ToLower(getenv(EnvLogLevel)) == "debug",
+		EnableDiagnostics: getEnvBool(EnvDiagnostics, false),
+		EnableSanitize:    getEnvBool(EnvSanitize, false),
+
+		EnableTestVerdicts: getEnvBool(EnvTestVerdicts, false),
+
+		// Unix socket listener
+		ListenSocket:     getenv(EnvListenSocket),
+		ListenSocketMode: getEnvFileMode(EnvListenSocketMode, DefaultListenSocketMode),
 
 		// HTTP timeouts
 		ReadTimeout:  time.Duration(getEnvInt(EnvReadTimeout, DefaultReadTimeoutSecs)) * time.Second,
 		WriteTimeout: time.Duration(getEnvInt(EnvWriteTimeout, DefaultWriteTimeoutSecs)) * time.Second,
 		IdleTimeout:  time.Duration(getEnvInt(EnvIdleTimeout, DefaultIdleTimeoutSecs)) * time.Second,
 
+		// HTTP protocol settings
+		EnableHTTP2:                 getEnvBool(EnvHTTP2, true),
+		EnableResponseCompression:   getEnvBool(EnvResponseCompression, true),
+		ResponseCompressionMinBytes: getEnvInt(EnvResponseCompressionMinBytes, DefaultResponseCompressionMinBytes),
+
 		// Upload and extraction limits
 		MaxUploadSize:     int64(getEnvInt(EnvMaxUploadSize, DefaultMaxUploadMB)) << 20,
+		UploadFieldNames:  getEnvList(EnvUploadFieldNames, ""),
+		MetadataMaxBytes:  getEnvInt(EnvMetadataMaxBytes, DefaultMetadataMaxBytes),
+		AllowedExtensions: getEnvList(EnvAllowedExt, ""),
+		DeniedExtensions:  getEnvList(EnvDeniedExt, ""),
+		AllowedTypes:      getEnvList(EnvAllowedTypes, ""),
+		DeniedTypes:       getEnvList(EnvDeniedTypes, ""),
 		MaxExtractedSize:  int64(getEnvInt(EnvMaxExtractedSize, DefaultMaxExtractedMB)) << 20,
 		MaxFileCount:      getEnvInt(EnvMaxFileCount, DefaultMaxFileCount),
 		MaxSingleFileSize: uint64(getEnvInt(EnvMaxSingleFile, DefaultMaxSingleFileMB)) << 20,
+		MaxEntryPath:      getEnvInt(EnvMaxEntryPath, DefaultMaxEntryPath),
+		ArchivePasswords:  parsePasswordList(getenv(EnvArchivePasswords)),
+
+		RequestMaxExtracted: int64(getEnvInt(EnvRequestExtracted, DefaultRequestExtractedMB)) << 20,
+		RequestMaxFiles:     getEnvInt(EnvRequestFiles, DefaultRequestFiles),
+		RequestMaxDirs:      getEnvInt(EnvRequestDirs, DefaultRequestDirs),
+		RequestMaxDepth:     getEnvInt(EnvRequestDepth, DefaultRequestDepth),
 
 		// Scan settings
 		ScanTimeout: time.Duration(getEnvInt(EnvScanTimeout, DefaultScanTimeoutMins)) * time.Minute,
 		MaxThreads:  getEnvInt(EnvMaxThreads, DefaultMaxThreads),
+
+		ScanTimeoutMax: time.Duration(getEnvInt(EnvScanTimeoutMax, 0)) * time.Minute,
+
+		HashAlgorithms: getEnvList(EnvHashAlgorithms, ""),
+		FuzzyHashing:   getEnvBool(EnvFuzzyHashing, false),
+		StaticAnalysis: getEnvStr(EnvStaticAnalysis, analysisThreats),
+
+		ThreatClassesFile: getenv(EnvThreatClasses),
+		ThreatTagsFile:    getenv(EnvThreatTags),
+
+		MalwareBazaarAuthKey:  getenv(EnvMalwareBazaarAuthKey),
+		MalwareBazaarURL:      getEnvStr(EnvMalwareBazaarURL, DefaultMalwareBazaarURL),
+		MalwareBazaarTimeout:  time.Duration(getEnvInt(EnvMalwareBazaarTimeout, DefaultMalwareBazaarTimeout)) * time.Millisecond,
+		MalwareBazaarCacheTTL: time.Duration(getEnvInt(EnvMalwareBazaarCacheTTL, DefaultMalwareBazaarCacheTTL)) * time.Hour,
+
+		HeuristicAlerts: getEnvList(EnvHeuristicAlerts, ""),
+
+		EmailExtraction:    getEnvBool(EnvEmailExtraction, true),
+		ImageExtraction:    getEnvBool(EnvImageExtraction, true),
+		StreamExtraction:   getEnvBool(EnvStreamExtraction, memoryBounded),
+		DedupeEntries:      getEnvBool(EnvDedupeEntries, true),
+		DocumentIndicators: getEnvBool(EnvDocIndicators, true),
+
+		ArchiveMaxRatio:            getEnvInt(EnvArchiveMaxRatio, DefaultArchiveMaxRatio),
+		ArchiveMaxNestedDuplicates: getEnvInt(EnvArchiveMaxNestedDuplicates, DefaultArchiveMaxNestedDuplicates),
+		ArchiveBombAction:          getEnvStr(EnvArchiveBombAction, bombActionReject),
+
+		ScanTmpDir:     getEnvStr(EnvScanTmpDir, ""),
+		ScanTmpMinFree: int64(getEnvInt(EnvScanTmpMinFree, DefaultScanTmpMinFreeMB)) << 20,
+
+		MemoryBounded:    memoryBounded,
+		MemoryBufferSize: int64(getEnvInt(EnvMemoryBufferSize, DefaultMemoryBufferMB)) << 20,
+		ShedRSS:          int64(getEnvInt(EnvShedRSS, 0)) << 20,
+		ShedTemp:         int64(getEnvInt(EnvShedTemp, 0)) << 20,
+
+		ShedLoadPerCPU:   getEnvFloat(EnvShedLoadPerCPU, 0),
+		ShedMinAvailable: int64(getEnvInt(EnvShedMinAvailable, 0)) << 20,
+		ShedGoroutines:   getEnvInt(EnvShedGoroutines, 0),
+		ShedQueueDepth:   getEnvInt(EnvShedQueueDepth, 0),
+
+		FaultLatency:           time.Duration(getEnvInt(EnvFaultLatency, 0)) * time.Millisecond,
+		FaultLatencyPercent:    getEnvInt(EnvFaultLatencyPercent, 100),
+		FaultClamdErrorPercent: getEnvInt(EnvFaultClamdErrorPercent, 0),
+		FaultExtractDelay:      time.Duration(getEnvInt(EnvFaultExtractDelay, 0)) * time.Millisecond,
+		FaultExtractPercent:    getEnvInt(EnvFaultExtractPercent, 100),
+
+		ImageRegistries:     getEnvList(EnvImageRegistries, ""),
+		ImageMaxLayerSize:   int64(getEnvInt(EnvImageMaxLayer, DefaultImageMaxLayerMB)) << 20,
+		ImageLayerCacheSize: getEnvInt(EnvImageLayerCache, DefaultImageLayerCache),
+
+		VerdictCacheRedisURL: getenv(EnvVerdictCacheRedisURL),
+		VerdictCacheTTL:      time.Duration(getEnvInt(EnvVerdictCacheTTL, DefaultVerdictCacheTTL)) * time.Hour,
+		VerdictCachePrefix:   getEnvStr(EnvVerdictCachePrefix, DefaultVerdictCachePrefix),
+
+		ScanPathRoots: getEnvList(EnvScanPathRoots, ""),
+
+		ObjectStorageProviders: getEnvList(EnvObjectStorageProviders, ""),
+		GCSCredentialsFile:     getEnvStr(EnvGCSCredentialsFile, ""),
+		AzureStorageAccount:    getEnvStr(EnvAzureStorageAccount, ""),
+		AzureStorageKey:        getEnvStr(EnvAzureStorageKey, ""),
+		AzureStorageSASToken:   getEnvStr(EnvAzureStorageSASToken, ""),
+
+		RemoteScanHosts:   getEnvList(EnvRemoteScanHosts, ""),
+		RemoteCredentials: getEnvMap(EnvRemoteCredentials),
+		RemoteSSHHostKeys: getEnvMap(EnvRemoteSSHHostKeys),
+		CurlPath:          getEnvStr(EnvCurlPath, DefaultCurlPath),
+
+		// clamdscan command
+		ClamdscanPath:      getEnvStr(EnvClamdscanPath, DefaultClamdscanPath),
+		ClamdConfigFile:    getEnvStr(EnvClamdConfigFile, DefaultClamdConfigFile),
+		ClamdscanFdpass:    getEnvBool(EnvClamdscanFdpass, true),
+		ClamdscanStream:    getEnvBool(EnvClamdscanStream, false),
+		ClamdscanMultiscan: getEnvBool(EnvClamdscanMultiscan, true),
+		ClamdscanArgs:      strings.Fields(getenv(EnvClamdscanArgs)),
+
+		// Native clamd client
+		ClamdAddress:       getenv(EnvClamdAddress),
+		ClamdPoolSize:      getEnvInt(EnvClamdPoolSize, runtime.NumCPU()),
+		ClamdStreamWorkers: getEnvInt(EnvClamdStreamWork, 0),
+
+		// clamd failure handling
+		ClamdRetries:          getEnvInt(EnvClamdRetries, DefaultClamdRetries),
+		ClamdBreakerThreshold: getEnvInt(EnvClamdBreakerThreshold, DefaultClamdBreakerThreshold),
+		ClamdBreakerCooldown:  time.Duration(getEnvInt(EnvClamdBreakerCooldown, DefaultClamdBreakerCooldown)) * time.Second,
+		ClamdStartupWait:      time.Duration(getEnvInt(EnvClamdStartupWait, DefaultClamdStartupWait)) * time.Second,
+		ClamdUnreachableExit:  time.Duration(getEnvInt(EnvClamdUnreachableExit, 0)) * time.Second,
+
+		// Worker pool
+		ScanWorkers:   getEnvInt(EnvScanWorkers, runtime.NumCPU()),
+		ScanQueueSize: getEnvInt(EnvScanQueueSize, DefaultScanQueueSize),
+		ScanQueueWait: time.Duration(getEnvInt(EnvScanQueueWait, DefaultScanQueueWait)) * time.Second,
+
+		// Async scan jobs
+		AsyncMaxJobs: getEnvInt(EnvAsyncMaxJobs, DefaultAsyncMaxJobs),
+		AsyncJobTTL:  time.Duration(getEnvInt(EnvAsyncJobTTL, DefaultAsyncJobTTL)) * time.Minute,
+		AsyncJobDir:  getEnvStr(EnvAsyncJobDir, ""),
+
+		// Coordinator mode
+		CoordinatorRedisURL: getenv(EnvCoordinatorRedisURL),
+		CoordinatorPrefix:   getEnvStr(EnvCoordinatorPrefix, DefaultCoordinatorPrefix),
+		CoordinatorLease:    time.Duration(getEnvInt(EnvCoordinatorLease, DefaultCoordinatorLease)) * time.Second,
+		CoordinatorJobs:     getEnvInt(EnvCoordinatorJobs, DefaultCoordinatorJobs),
+
+		// Signed async result URLs
+		ResultURLSecret: getenv(EnvResultURLSecret),
+		ResultURLTTL:    time.Duration(getEnvInt(EnvResultURLTTL, DefaultResultURLTTL)) * time.Minute,
+
+		// Scan history
+		ScanHistorySize: getEnvInt(EnvScanHistorySize, DefaultScanHistorySize),
+		ScanHistoryFile: getEnvStr(EnvScanHistoryFile, ""),
+
+		// Retention periods
+		ScanHistoryRetention: time.Duration(getEnvInt(EnvScanHistoryRetention, 0)) * 24 * time.Hour,
+		QuarantineRetention:  time.Duration(getEnvInt(EnvQuarantineRetention, 0)) * 24 * time.Hour,
+
+		// Batch scans
+		BatchMaxItems:    getEnvInt(EnvBatchMaxItems, DefaultBatchMaxItems),
+		BatchConcurrency: getEnvInt(EnvBatchConcurrency, DefaultBatchConcurrency),
+
+		// Resumable uploads
+		UploadSessionsMax: getEnvInt(EnvUploadSessionsMax, DefaultUploadSessionsMax),
+		UploadSessionTTL:  time.Duration(getEnvInt(EnvUploadSessionTTL, DefaultUploadSessionTTL)) * time.Minute,
+
+		// Watched directories
+		WatchDirs:          getEnvList(EnvWatchDirs, ""),
+		WatchInterval:      time.Duration(getEnvInt(EnvWatchInterval, DefaultWatchInterval)) * time.Second,
+		WatchQuarantineDir: getEnvStr(EnvWatchQuarantineDir, ""),
+		WatchCleanDir:      getEnvStr(EnvWatchCleanDir, ""),
+
+		// Re-scans after signature updates
+		RescanOnUpdate: getEnvBool(EnvRescanOnUpdate, false),
+		RescanDirs:     getEnvList(EnvRescanDirs, ""),
+
+		// Authentication
+		AuthMethods:         getEnvList(EnvAuthMethods, DefaultAuthMethods),
+		APIKeys:             invertMap(getEnvMap(EnvAPIKeys)),
+		BasicAuthUsers:      getEnvMap(EnvBasicAuthUsers),
+		JWTSecret:           getenv(EnvJWTSecret),
+		JWTJWKSURL:          getenv(EnvJWTJWKSURL),
+		JWTIssuer:           getenv(EnvJWTIssuer),
+		JWTAudience:         getenv(EnvJWTAudience),
+		MTLSAllowedSubjects: getEnvList(EnvMTLSAllowedSubjects, ""),
+		AuthScopes:          getEnvScopes(EnvAuthScopes),
+
+		// Scan routes
+		ScanRoutesFile: getenv(EnvScanRoutesFile),
+
+		// Metrics
+		StatsDAddress: statsDAddressFromEnv(),
+		StatsDPrefix:  getEnvStr(EnvStatsDPrefix, DefaultStatsDPrefix),
+		StatsDTags:    getEnvList(EnvStatsDTags, ""),
+		DogStatsD:     getEnvBool(EnvDogStatsD, true),
+
+		// Audit log
+		AuditLogFile:        getenv(EnvAuditLogFile),
+		AuditSyslogAddress:  getenv(EnvAuditSyslogAddress),
+		AuditSyslogFacility: getEnvStr(EnvAuditSyslogFacility, DefaultSyslogFacility),
+
+		// SIEM forwarding
+		SIEMAddress:  getenv(EnvSIEMAddress),
+		SIEMFormat:   getEnvStr(EnvSIEMFormat, DefaultSIEMFormat),
+		SIEMFacility: getEnvStr(EnvSIEMFacility, DefaultSyslogFacility),
+		SIEMCAFile:   getenv(EnvSIEMCAFile),
+		SIEMFieldMap: getEnvMap(EnvSIEMFieldMap),
+
+		// Detection notifications
+		NotifyURL:       getenv(EnvNotifyURL),
+		NotifyFormat:    getEnvStr(EnvNotifyFormat, DefaultNotifyFormat),
+		NotifyTemplate:  getenv(EnvNotifyTemplate),
+		NotifyInterval:  getEnvInt(EnvNotifyInterval, DefaultNotifyInterval),
+		NotifyRateLimit: getEnvInt(EnvNotifyRateLimit, DefaultNotifyRateLimit),
+
+		// Result indexing
+		ElasticsearchURL:       getenv(EnvElasticsearchURL),
+		ElasticsearchIndex:     getEnvStr(EnvElasticsearchIndex, DefaultElasticsearchIndex),
+		ElasticsearchUsername:  getenv(EnvElasticsearchUsername),
+		ElasticsearchPassword:  getenv(EnvElasticsearchPassword),
+		ElasticsearchAPIKey:    getenv(EnvElasticsearchAPIKey),
+		ElasticsearchBatchSize: getEnvInt(EnvElasticsearchBatchSize, DefaultElasticsearchBatchSize),
+		ElasticsearchInterval:  getEnvInt(EnvElasticsearchInterval, DefaultElasticsearchInterval),
+
+		// Signed result tokens
+		ResultTokenSecret:  getenv(EnvResultTokenSecret),
+		ResultTokenKeyFile: getenv(EnvResultTokenKeyFile),
+		ResultTokenIssuer:  getEnvStr(EnvResultTokenIssuer, DefaultResultTokenIssuer),
+
+		// Rate limiting
+		RateLimitRPS:   getEnvFloat(EnvRateLimitRPS, 0),
+		RateLimitBurst: getEnvInt(EnvRateLimitBurst, DefaultRateLimitBurst),
+
+		MaxInFlightPerIP: getEnvInt(EnvMaxInFlightPerIP, 0),
+		MaxInFlight:      getEnvInt(EnvMaxInFlight, 0),
+
+		// CORS
+		CORSAllowedOrigins:   getEnvList(EnvCORSAllowedOrigins, ""),
+		CORSAllowedMethods:   getEnvList(EnvCORSAllowedMethods, DefaultCORSAllowedMethods),
+		CORSAllowedHeaders:   getEnvList(EnvCORSAllowedHeaders, DefaultCORSAllowedHeaders),
+		CORSAllowCredentials: getEnvBool(EnvCORSAllowCredentials, false),
+		CORSMaxAge:           getEnvInt(EnvCORSMaxAge, DefaultCORSMaxAge),
+
+		// Multi-tenancy
+		TenantsFile: getenv(EnvTenantsFile),
+
+		// State and backups
+		SignatureDir: getEnvStr(EnvSignatureDir, DefaultSignatureDir),
+		BackupKey:    getenv(EnvBackupKey),
+
+		// TLS
+		TLSCertFile:     getenv(EnvTLSCertFile),
+		TLSKeyFile:      getenv(EnvTLSKeyFile),
+		TLSClientCAFile: getenv(EnvTLSClientCAFile),
 	}
+	config.invalidSettings = invalidSettings
 
 	return config
 }
 
+// Validate reports settings that can't work together or are out of range,
+// and values that could not be parsed. All problems are returned at once.
+func (c *Config) Validate() error {
+	errs := append([]error(nil), c.invalidSettings...)
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(c.Port)
+	check(err == nil && port > 0 && port <= 65535, "%s: %q is not a valid port", EnvPort, c.Port)
+
+	check(c.BindAddress == "" || net.ParseIP(c.BindAddress) != nil || !strings.ContainsAny(c.BindAddress, ":/ "),
+		"%s: %q is not an address or host name", EnvBindAddress, c.BindAddress)
+	check(!strings.ContainsAny(c.BasePath, "?# "), "%s: %q is not a URL path", EnvBasePath, c.BasePath)
+	if _, err := parseNetworks(c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", EnvTrustedProxies, err))
+	}
+	if c.OutboundProxy != "" {
+		if _, err := parseOutboundProxy(c.OutboundProxy); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", EnvOutboundProxy, err))
+		}
+	}
+	if _, err := parseNetworks(c.EgressDeniedCIDRs); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", EnvEgressDenied, err))
+	}
+	if _, err := parseNetworks(c.EgressCIDRs); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", EnvEgressCIDRs, err))
+	}
+	for _, host := range c.EgressHosts {
+		check(host == "*" || !strings.ContainsAny(strings.TrimPrefix(host, "*."), "*/: "),
+			"%s: %q is not a host name or *.domain", EnvEgressHosts, host)
+	}
+	check(c.EgressRedirects >= 0, "%s must not be negative", EnvEgressRedirects)
+	if _, err := NewIPFilter(c); err != nil {
+		errs = append(errs, err)
+	}
+	check(c.ListenSocketMode&^os.ModePerm == 0, "%s: %o is not a permission mode", EnvListenSocketMode, c.ListenSocketMode)
+
+	check(c.ReadTimeout > 0, "%s must be positive", EnvReadTimeout)
+	check(c.WriteTimeout > 0, "%s must be positive", EnvWriteTimeout)
+	check(c.IdleTimeout > 0, "%s must be positive", EnvIdleTimeout)
+	c.checkScanLimits(check)
+	check(c.ResponseCompressionMinBytes >= 0, "%s must not be negative", EnvResponseCompressionMinBytes)
+	check(c.MetadataMaxBytes > 0, "%s must be positive", EnvMetadataMaxBytes)
+	check(c.MaxEntryPath >= 0, "%s must not be negative", EnvMaxEntryPath)
+	check(c.RequestMaxExtracted >= 0, "%s must not be negative", EnvRequestExtracted)
+	check(c.RequestMaxFiles >= 0, "%s must not be negative", EnvRequestFiles)
+	check(c.RequestMaxDirs >= 0, "%s must not be negative", EnvRequestDirs)
+	check(c.RequestMaxDepth >= 0, "%s must not be negative", EnvRequestDepth)
+	check(c.MaxThreads > 0, "%s must be positive", EnvMaxThreads)
+	check(c.ImageMaxLayerSize > 0, "%s must be positive", EnvImageMaxLayer)
+	check(c.ImageLayerCacheSize >= 0, "%s must not be negative", EnvImageLayerCache)
+	if _, err := NewRedisClient(c.VerdictCacheRedisURL); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", EnvVerdictCacheRedisURL, err))
+	}
+	check(c.VerdictCacheTTL > 0, "%s must be positive", EnvVerdictCacheTTL)
+	if c.MalwareBazaarAuthKey != "" {
+		u, err := url.Parse(c.MalwareBazaarURL)
+		check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "%s must be an http(s) URL", EnvMalwareBazaarURL)
+		check(c.MalwareBazaarTimeout > 0, "%s must be positive", EnvMalwareBazaarTimeout)
+		check(c.MalwareBazaarCacheTTL > 0, "%s must be positive", EnvMalwareBazaarCacheTTL)
+	}
+	for _, provider := range c.ObjectStorageProviders {
+		check(provider == storageGCS || provider == storageAzure, "%s: unknown provider %q (gcs, azure)", EnvObjectStorageProviders, provider)
+		check(provider != storageAzure || c.AzureStorageAccount != "", "%s is required for azure", EnvAzureStorageAccount)
+	}
+	check(c.AzureStorageKey == "" || c.AzureStorageSASToken == "", "%s and %s are mutually exclusive", EnvAzureStorageKey, EnvAzureStorageSASToken)
+	check(len(c.RemoteScanHosts) == 0 || c.CurlPath != "", "%s must not be empty", EnvCurlPath)
+	for host, credentials := range c.RemoteCredentials {
+		check(strings.Contains(credentials, ":"), "%s: credentials for %s must be user:password", EnvRemoteCredentials, host)
+	}
+	for _, root := range c.ScanPathRoots {
+		check(filepath.IsAbs(root) && filepath.Clean(root) != "/", "%s: %q must be an absolute path below /", EnvScanPathRoots, root)
+	}
+	for _, name := range c.HashAlgorithms {
+		check(hashAlgorithms[name] != nil, "%s: unknown algorithm %q (md5, sha1, sha256)", EnvHashAlgorithms, name)
+	}
+	check(c.StaticAnalysis == analysisOff || c.StaticAnalysis == analysisThreats || c.StaticAnalysis == analysisAll,
+		"%s must be %s, %s or %s", EnvStaticAnalysis, analysisOff, analysisThreats, analysisAll)
+	if _, err := parseHeuristics(strings.Join(c.HeuristicAlerts, ",")); err != nil {
+		check(false, "%s: %v", EnvHeuristicAlerts, err)
+	}
+	check(c.ArchiveMaxRatio >= 0, "%s must not be negative", EnvArchiveMaxRatio)
+	check(c.ArchiveMaxNestedDuplicates >= 0, "%s must not be negative", EnvArchiveMaxNestedDuplicates)
+	check(c.ArchiveBombAction == bombActionReject || c.ArchiveBombAction == bombActionFlag,
+		"%s must be %s or %s", EnvArchiveBombAction, bombActionReject, bombActionFlag)
+	check(c.ScanTmpDir == "" || filepath.IsAbs(c.ScanTmpDir), "%s must be an absolute path", EnvScanTmpDir)
+	check(c.ScanTmpMinFree >= 0, "%s must not be negative", EnvScanTmpMinFree)
+	check(!c.MemoryBounded || c.MemoryBufferSize > 0, "%s must be positive", EnvMemoryBufferSize)
+	check(c.ShedRSS >= 0, "%s must not be negative", EnvShedRSS)
+	check(c.ShedTemp >= 0, "%s must not be negative", EnvShedTemp)
+	check(c.ShedLoadPerCPU >= 0, "%s must not be negative", EnvShedLoadPerCPU)
+	check(c.ShedMinAvailable >= 0, "%s must not be negative", EnvShedMinAvailable)
+	check(c.ShedGoroutines >= 0, "%s must not be negative", EnvShedGoroutines)
+	check(c.ShedQueueDepth >= 0, "%s must not be negative", EnvShedQueueDepth)
+	check(c.FaultLatency >= 0, "%s must not be negative", EnvFaultLatency)
+	check(c.FaultExtractDelay >= 0, "%s must not be negative", EnvFaultExtractDelay)
+	check(c.FaultLatencyPercent >= 0 && c.FaultLatencyPercent <= 100, "%s must be between 0 and 100", EnvFaultLatencyPercent)
+	check(c.FaultClamdErrorPercent >= 0 && c.FaultClamdErrorPercent <= 100, "%s must be between 0 and 100", EnvFaultClamdErrorPercent)
+	check(c.FaultExtractPercent >= 0 && c.FaultExtractPercent <= 100, "%s must be between 0 and 100", EnvFaultExtractPercent)
+
+	check(c.ClamdscanPath != "", "%s must not be empty", EnvClamdscanPath)
+	check(c.ClamdAddress == "" || c.ClamdPoolSize > 0, "%s must be positive", EnvClamdPoolSize)
+	check(c.ClamdStreamWorkers >= 0, "%s must not be negative", EnvClamdStreamWork)
+	check(c.ClamdStreamWorkers == 0 || c.ClamdAddress != "", "%s requires %s", EnvClamdStreamWork, EnvClamdAddress)
+	check(c.ClamdRetries >= 0, "%s must not be negative", EnvClamdRetries)
+	check(c.ClamdBreakerThreshold >= 0, "%s must not be negative", EnvClamdBreakerThreshold)
+	check(c.ClamdBreakerThreshold == 0 || c.ClamdBreakerCooldown > 0, "%s must be positive", EnvClamdBreakerCooldown)
+	check(c.ClamdStartupWait >= 0, "%s must not be negative", EnvClamdStartupWait)
+	check(c.ClamdUnreachableExit >= 0, "%s must not be negative", EnvClamdUnreachableExit)
+
+	check(c.ScanWorkers >= 0, "%s must not be negative", EnvScanWorkers)
+	check(c.ScanQueueSize >= 0, "%s must not be negative", EnvScanQueueSize)
+	check(c.ScanQueueWait >= 0, "%s must not be negative", EnvScanQueueWait)
+	check(c.AsyncMaxJobs >= 0, "%s must not be negative", EnvAsyncMaxJobs)
+	check(c.AsyncMaxJobs == 0 || c.AsyncJobTTL > 0, "%s must be positive", EnvAsyncJobTTL)
+	check(c.AsyncJobDir == "" || filepath.IsAbs(c.AsyncJobDir), "%s must be an absolute path", EnvAsyncJobDir)
+	if _, err := NewRedisClient(c.CoordinatorRedisURL); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", EnvCoordinatorRedisURL, err))
+	}
+	if c.CoordinatorRedisURL != "" {
+		check(c.AsyncMaxJobs > 0 && c.AsyncJobDir != "", "%s requires async jobs saved in %s", EnvCoordinatorRedisURL, EnvAsyncJobDir)
+		check(c.CoordinatorLease >= 3*time.Second, "%s must be at least 3", EnvCoordinatorLease)
+		check(c.CoordinatorJobs > 0, "%s must be positive", EnvCoordinatorJobs)
+	}
+	check(c.ResultURLSecret == "" || len(c.ResultURLSecret) >= 32, "%s must be at least 32 bytes", EnvResultURLSecret)
+	check(c.ResultURLSecret == "" || c.ResultURLTTL > 0, "%s must be positive", EnvResultURLTTL)
+	check(c.ScanHistorySize >= 0, "%s must not be negative", EnvScanHistorySize)
+	check(c.ScanHistoryRetention >= 0, "%s must not be negative", EnvScanHistoryRetention)
+	check(c.QuarantineRetention >= 0, "%s must not be negative", EnvQuarantineRetention)
+	check(c.BatchMaxItems > 0, "%s must be positive", EnvBatchMaxItems)
+	check(c.BatchConcurrency > 0, "%s must be positive", EnvBatchConcurrency)
+	check(c.UploadSessionsMax >= 0, "%s must not be negative", EnvUploadSessionsMax)
+	check(c.UploadSessionsMax == 0 || c.UploadSessionTTL > 0, "%s must be positive", EnvUploadSessionTTL)
+	check(len(c.WatchDirs) == 0 || c.WatchInterval > 0, "%s must be positive", EnvWatchInterval)
+	// Files moved into a watched directory would be picked up again
+	for _, target := range []struct{ env, dir string }{{EnvWatchQuarantineDir, c.WatchQuarantineDir}, {EnvWatchCleanDir, c.WatchCleanDir}} {
+		check(target.dir == "" || !underRoot(absPaths(c.WatchDirs), absPath(target.dir)), "%s must not be inside %s", target.env, EnvWatchDirs)
+	}
+	check(!c.RescanOnUpdate || c.WatchQuarantineDir != "" || len(c.RescanDirs) > 0,
+		"%s needs %s or %s", EnvRescanOnUpdate, EnvWatchQuarantineDir, EnvRescanDirs)
+
+	check(c.ResultTokenSecret == "" || c.ResultTokenKeyFile == "", "%s and %s are mutually exclusive", EnvResultTokenSecret, EnvResultTokenKeyFile)
+	check(c.ResultTokenSecret == "" || len(c.ResultTokenSecret) >= 32, "%s must be at least 32 bytes", EnvResultTokenSecret)
+
+	check(c.RateLimitRPS >= 0, "%s must not be negative", EnvRateLimitRPS)
+	check(c.RateLimitRPS == 0 || c.RateLimitBurst > 0, "%s must be positive", EnvRateLimitBurst)
+	check(c.MaxInFlightPerIP >= 0, "%s must not be negative", EnvMaxInFlightPerIP)
+	check(c.MaxInFlight >= 0, "%s must not be negative", EnvMaxInFlight)
+
+	for _, origin := range c.CORSAllowedOrigins {
+		check(origin == "*" || strings.Contains(origin, "://"), "%s: %q is not an origin (scheme://host[:port])", EnvCORSAllowedOrigins, origin)
+		check(origin != "*" || !c.CORSAllowCredentials, "%s: * can't be combined with %s", EnvCORSAllowedOrigins, EnvCORSAllowCredentials)
+	}
+	check(c.CORSMaxAge >= 0, "%s must not be negative", EnvCORSMaxAge)
+
+	check((c.TLSCertFile == "") == (c.TLSKeyFile == ""), "%s and %s must be set together", EnvTLSCertFile, EnvTLSKeyFile)
+	for key := range c.AuthScopes {
+		method, name, _ := strings.Cut(key, ":")
+		check(containsString(authMethods, method) && name != "", "%s: %q must name the auth method and identity, e.g. %s:%s", EnvAuthScopes, key, AuthMethodAPIKey, key)
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkScanLimits checks the limits and file policy a scan route's profile
+// may override, so routes are held to the same ranges as the global config
+func (c *Config) checkScanLimits(check func(ok bool, format string, args ...any)) {
+	check(c.ScanTimeout > 0, "%s must be positive", EnvScanTimeout)
+	check(c.ScanTimeoutMax == 0 || c.ScanTimeoutMax >= c.ScanTimeout, "%s must not be below %s", EnvScanTimeoutMax, EnvScanTimeout)
+	check(c.MaxUploadSize > 0, "%s must be positive", EnvMaxUploadSize)
+	for _, list := range []struct {
+		env        string
+		extensions []string
+	}{{EnvAllowedExt, c.AllowedExtensions}, {EnvDeniedExt, c.DeniedExtensions}} {
+		for _, ext := range list.extensions {
+			check(strings.TrimPrefix(ext, ".") != "" && !strings.ContainsAny(ext, "/\\* "), "%s: %q is not a file extension", list.env, ext)
+		}
+	}
+	for _, list := range []struct {
+		env   string
+		types []string
+	}{{EnvAllowedTypes, c.AllowedTypes}, {EnvDeniedTypes, c.DeniedTypes}} {
+		for _, mimeType := range list.types {
+			major, minor, ok := strings.Cut(mimeType, "/")
+			check(ok && major != "" && minor != "" && !strings.ContainsAny(major, "*; ") && (minor == "*" || !strings.ContainsAny(minor, "*/; ")),
+				"%s: %q is not a MIME type or type/*", list.env, mimeType)
+		}
+	}
+	check(c.MaxExtractedSize > 0, "%s must be positive", EnvMaxExtractedSize)
+	check(c.MaxFileCount > 0, "%s must be positive", EnvMaxFileCount)
+	check(c.MaxSingleFileSize > 0, "%s must be positive", EnvMaxSingleFile)
+	check(c.MaxUploadSize <= 0 || c.MaxSingleFileSize == 0 || uint64(c.MaxUploadSize) >= c.MaxSingleFileSize,
+		"%s (%d MB) is smaller than %s (%d MB)", EnvMaxUploadSize, c.MaxUploadSize>>20, EnvMaxSingleFile, c.MaxSingleFileSize>>20)
+}
+
 // LogConfig logs the current configuration (useful for debugging)
 func (c *Config) LogConfig() {
 	log.Printf("Configuration:")
 	log.Printf("  Port: %s", c.Port)
+	log.Printf("  Bind address: %s", c.BindAddress)
+	log.Printf("  Base path: %s", c.BasePath)
+	log.Printf("  Trusted proxies: %v", c.TrustedProxies)
+	if c.OutboundProxy != "" {
+		log.Printf("  Outbound proxy: %s (no proxy: %v)", redactSetting(EnvOutboundProxy, c.OutboundProxy), c.OutboundNoProxy)
+	} else {
+		log.Printf("  Outbound proxy: from HTTP_PROXY/HTTPS_PROXY/NO_PROXY")
+	}
+	log.Printf("  Egress: schemes %v, hosts %v, denied %v (except %v), max %d redirects",
+		c.EgressSchemes, c.EgressHosts, c.EgressDeniedCIDRs, c.EgressCIDRs, c.EgressRedirects)
+	log.Printf("  IP allowlist: %v (denylist: %v)", c.IPAllowlist, c.IPDenylist)
 	log.Printf("  Debug mode: %v", c.DebugMode)
+	log.Printf("  Diagnostics endpoints: %v", c.EnableDiagnostics)
+	log.Printf("  Sanitize endpoint: %v", c.EnableSanitize)
+	log.Printf("  Test verdicts: %v", c.EnableTestVerdicts)
+	log.Printf("  Listen socket: %s (mode: %04o)", c.ListenSocket, c.ListenSocketMode)
 	log.Printf("  Read timeout: %v", c.ReadTimeout)
 	log.Printf("  Write timeout: %v", c.WriteTimeout)
 	log.Printf("  Idle timeout: %v", c.IdleTimeout)
+	log.Printf("  HTTP/2: %v (h2c: %v)", c.EnableHTTP2, c.EnableHTTP2 && h2cSupported)
+	log.Printf("  Response compression: %v (min size: %d bytes)", c.EnableResponseCompression, c.ResponseCompressionMinBytes)
 	log.Printf("  Max upload size: %d MB", c.MaxUploadSize>>20)
+	if len(c.UploadFieldNames) > 0 {
+		log.Printf("  Upload field names: %s", strings.Join(c.UploadFieldNames, ","))
+	} else {
+		log.Printf("  Upload field names: any file part")
+	}
+	log.Printf("  Max metadata size: %d bytes", c.MetadataMaxBytes)
+	if filePolicyEnabled(c) {
+		log.Printf("  File policy: extensions %v (denied: %v), types %v (denied: %v)",
+			c.AllowedExtensions, c.DeniedExtensions, c.AllowedTypes, c.DeniedTypes)
+	}
 	log.Printf("  Max extracted size: %d MB", c.MaxExtractedSize>>20)
 	log.Printf("  Max file count: %d", c.MaxFileCount)
 	log.Printf("  Max single file: %d MB", c.MaxSingleFileSize>>20)
-	log.Printf("  Scan timeout: %v", c.ScanTimeout)
-	log.Printf("  Max threads: %d (multiscan: %v)", c.MaxThreads, c.MaxThreads >= 2)
+	log.Printf("  Max entry path: %d bytes (0 = unlimited)", c.MaxEntryPath)
+	if len(c.ArchivePasswords) > 0 {
+		log.Printf("  Archive passwords: %d", len(c.ArchivePasswords))
+	}
+	log.Printf("  Request budget: %d MB, %d files, %d directories, %d levels deep (0 = unlimited)",
+		c.RequestMaxExtracted>>20, c.RequestMaxFiles, c.RequestMaxDirs, c.RequestMaxDepth)
+	log.Printf("  Scan timeout: %v (max per request: %v)", c.ScanTimeout, max(c.ScanTimeoutMax, c.ScanTimeout))
+	log.Printf("  Max threads: %d (multiscan: %v)", c.MaxThreads, c.ClamdscanMultiscan && c.MaxThreads >= 2)
+	log.Printf("  Hash algorithms: %v (ssdeep: %v)", c.HashAlgorithms, c.FuzzyHashing)
+	log.Printf("  Static analysis: %s", c.StaticAnalysis)
+	log.Printf("  Threat classes file: %s", c.ThreatClassesFile)
+	log.Printf("  Threat tags file: %s", c.ThreatTagsFile)
+	log.Printf("  MalwareBazaar lookups: %v (timeout: %v, cache: %v)", c.MalwareBazaarAuthKey != "", c.MalwareBazaarTimeout, c.MalwareBazaarCacheTTL)
+	log.Printf("  Heuristic alerts: %v", c.HeuristicAlerts)
+	log.Printf("  Email extraction: %v", c.EmailExtraction)
+	log.Printf("  Disk image extraction: %v", c.ImageExtraction)
+	log.Printf("  Stream extraction: %v", c.StreamExtraction)
+	log.Printf("  Dedupe archive entries: %v", c.DedupeEntries)
+	log.Printf("  Archive bomb checks: max ratio %d, max nested duplicates %d (%s)", c.ArchiveMaxRatio, c.ArchiveMaxNestedDuplicates, c.ArchiveBombAction)
+	log.Printf("  Document indicators: %v", c.DocumentIndicators)
+	tmpDir := c.ScanTmpDir
+	if tmpDir == "" {
+		tmpDir = os.TempDir()
+	}
+	log.Printf("  Temp directory: %s (min free: %d MB)", tmpDir, c.ScanTmpMinFree>>20)
+	if c.MemoryBounded {
+		log.Printf("  Memory-bounded mode: %d MB extraction buffers", c.MemoryBufferSize>>20)
+	}
+	if c.FaultLatency > 0 || c.FaultClamdErrorPercent > 0 || c.FaultExtractDelay > 0 {
+		log.Printf("  Fault injection: latency %v (%d%%), clamd errors %d%%, extraction delay %v (%d%%)",
+			c.FaultLatency, c.FaultLatencyPercent, c.FaultClamdErrorPercent, c.FaultExtractDelay, c.FaultExtractPercent)
+	}
+	if len(c.ImageRegistries) > 0 {
+		log.Printf("  Image scanning: %s (max layer: %d MB, cache: %d layers)",
+			strings.Join(c.ImageRegistries, ","), c.ImageMaxLayerSize>>20, c.ImageLayerCacheSize)
+	}
+	if c.VerdictCacheRedisURL != "" {
+		log.Printf("  Verdict cache: Redis (prefix: %s, TTL: %v)", c.VerdictCachePrefix, c.VerdictCacheTTL)
+	}
+	if len(c.ScanPathRoots) > 0 {
+		log.Printf("  Path scanning: %s", strings.Join(c.ScanPathRoots, ","))
+	}
+	if len(c.ObjectStorageProviders) > 0 {
+		log.Printf("  Object storage scanning: %s (GCS credentials: %s, Azure account: %s)",
+			strings.Join(c.ObjectStorageProviders, ","), c.GCSCredentialsFile, c.AzureStorageAccount)
+	}
+	if len(c.RemoteScanHosts) > 0 {
+		log.Printf("  Remote scanning: %s (credentials for %d hosts, pinned host keys: %d, curl: %s)",
+			strings.Join(c.RemoteScanHosts, ","), len(c.RemoteCredentials), len(c.RemoteSSHHostKeys), c.CurlPath)
+	}
+	log.Printf("  clamdscan: %s (config: %s, fdpass: %v, stream: %v, multiscan: %v, extra args: %v)",
+		c.ClamdscanPath, c.ClamdConfigFile, c.ClamdscanFdpass, c.ClamdscanStream, c.ClamdscanMultiscan, c.ClamdscanArgs)
+	log.Printf("  clamd: %s (pool: %d, stream workers: %d)", c.ClamdAddress, c.ClamdPoolSize, c.ClamdStreamWorkers)
+	log.Printf("  clamd retries: %d (breaker threshold: %d, cooldown: %v)", c.ClamdRetries, c.ClamdBreakerThreshold, c.ClamdBreakerCooldown)
+	log.Printf("  clamd startup wait: %v (exit when unreachable for: %v)", c.ClamdStartupWait, c.ClamdUnreachableExit)
+	log.Printf("  Scan workers: %d (queue: %d, wait: %v)", c.ScanWorkers, c.ScanQueueSize, c.ScanQueueWait)
+	log.Printf("  Async jobs: %d (results kept: %v)", c.AsyncMaxJobs, c.AsyncJobTTL)
+	if c.AsyncJobDir != "" {
+		log.Printf("  Async job directory: %s", c.AsyncJobDir)
+	}
+	if c.CoordinatorRedisURL != "" {
+		log.Printf("  Coordinator: Redis (prefix: %s, lease: %v, jobs: %d)", c.CoordinatorPrefix, c.CoordinatorLease, c.CoordinatorJobs)
+	}
+	if c.ResultURLSecret != "" {
+		log.Printf("  Signed result URLs: valid for %v", c.ResultURLTTL)
+	}
+	log.Printf("  Scan history: %d scans (file: %s, retention: %v)", c.ScanHistorySize, c.ScanHistoryFile, c.ScanHistoryRetention)
+	if c.QuarantineRetention > 0 {
+		log.Printf("  Quarantine retention: %v", c.QuarantineRetention)
+	}
+	log.Printf("  Batch scans: up to %d items (concurrency: %d)", c.BatchMaxItems, c.BatchConcurrency)
+	log.Printf("  Resumable uploads: %d (idle expiry: %v)", c.UploadSessionsMax, c.UploadSessionTTL)
+	if len(c.WatchDirs) > 0 {
+		log.Printf("  Watched directories: %s (every %v, quarantine: %s, clean: %s)",
+			strings.Join(c.WatchDirs, ","), c.WatchInterval, c.WatchQuarantineDir, c.WatchCleanDir)
+	}
+	if c.RescanOnUpdate {
+		log.Printf("  Re-scan on signature update: quarantine=%s stores=%s", c.WatchQuarantineDir, strings.Join(c.RescanDirs, ","))
+	}
+	log.Printf("  Auth methods: %s", strings.Join(c.AuthMethods, ","))
+	log.Printf("  Scan routes file: %s", c.ScanRoutesFile)
+	log.Printf("  StatsD: %s", c.StatsDAddress)
+	log.Printf("  Audit log: file=%s syslog=%s", c.AuditLogFile, c.AuditSyslogAddress)
+	log.Printf("  SIEM: %s (format: %s)", c.SIEMAddress, c.SIEMFormat)
+	log.Printf("  Notifications: %v (format: %s, interval: %ds, limit: %d/min)", c.NotifyURL != "", c.NotifyFormat, c.NotifyInterval, c.NotifyRateLimit)
+	log.Printf("  Elasticsearch: %s (index: %s, batch: %d)", c.ElasticsearchURL, c.ElasticsearchIndex, c.ElasticsearchBatchSize)
+	log.Printf("  Result tokens: %s", resultTokenMode(c))
+	log.Printf("  Rate limit: %g req/s (burst %d)", c.RateLimitRPS, c.RateLimitBurst)
+	log.Printf("  In-flight limit: %d per IP, %d total", c.MaxInFlightPerIP, c.MaxInFlight)
+	log.Printf("  CORS origins: %v (methods: %v, headers: %v, credentials: %v, max age: %ds)",
+		c.CORSAllowedOrigins, c.CORSAllowedMethods, c.CORSAllowedHeaders, c.CORSAllowCredentials, c.CORSMaxAge)
+	log.Printf("  Tenants file: %s", c.TenantsFile)
+	log.Printf("  Signature dir: %s", c.SignatureDir)
+	log.Printf("  Backups: %v", c.BackupKey != "")
+	log.Printf("  TLS: %v (client CA: %v)", c.TLSCertFile != "", c.TLSClientCAFile != "")
+}
+
+// Invalid values seen by the getEnv helpers since LoadConfig started
+var invalidSettings []error
+
+// invalidSetting warns about a value that could not be parsed and records it
+// for Validate
+func invalidSetting(key, value string, defaultValue any) {
+	log.Printf("Warning: invalid value for %s, using default %v", key, defaultValue)
+	invalidSettings = append(invalidSettings, fmt.Errorf("%s: invalid value %q", key, value))
 }
 
 // getEnvStr returns environment variable value or default
 func getEnvStr(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
+	if value := getenv(key); value != "" {
 		return value
 	}
 	return defaultValue
@@ -115,11 +1263,128 @@ func getEnvStr(key, defaultValue string) string {
 
 // getEnvInt returns environment variable as int or default
 func getEnvInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
+	if value := getenv(key); value != "" {
 		if intVal, err := strconv.Atoi(value); err == nil {
 			return intVal
 		}
-		log.Printf("Warning: invalid value for %s, using default %d", key, defaultValue)
+		invalidSetting(key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+// getEnvFloat returns environment variable as float64 or default
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := getenv(key); value != "" {
+		if floatVal, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatVal
+		}
+		invalidSetting(key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+// statsDAddressFromEnv returns STATSD_ADDRESS, falling back to the
+// Datadog agent variables (DD_AGENT_HOST, DD_DOGSTATSD_PORT)
+func statsDAddressFromEnv() string {
+	if address := getenv(EnvStatsDAddress); address != "" {
+		return address
+	}
+	if host := getenv(EnvDDAgentHost); host != "" {
+		return net.JoinHostPort(host, getEnvStr(EnvDDDogStatsDPort, DefaultDogStatsDPort))
+	}
+	return ""
+}
+
+// getEnvBool returns environment variable as bool or default.
+// Accepts the values understood by strconv.ParseBool (1, true, false, ...).
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := getenv(key); value != "" {
+		if boolVal, err := strconv.ParseBool(value); err == nil {
+			return boolVal
+		}
+		invalidSetting(key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+// normalizeBasePath returns the route prefix with a leading slash and no
+// trailing slash ("" for none)
+func normalizeBasePath(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return ""
+	}
+	return "/" + path
+}
+
+// getEnvFileMode returns environment variable as an octal file mode or default
+func getEnvFileMode(key string, defaultValue os.FileMode) os.FileMode {
+	if value := getenv(key); value != "" {
+		if mode, err := strconv.ParseUint(value, 8, 32); err == nil {
+			return os.FileMode(mode)
+		}
+		invalidSetting(key, value, fmt.Sprintf("%04o", defaultValue))
 	}
 	return defaultValue
 }
+
+// getEnvList returns a comma-separated environment variable as a list.
+// Newlines also separate entries (for lists read from secret files).
+// Empty entries are dropped and surrounding whitespace is trimmed.
+func getEnvList(key, defaultValue string) []string {
+	value := getEnvStr(key, defaultValue)
+
+	var list []string
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvMap parses a comma-separated list of "name:value" pairs.
+// Entries without a separator are ignored with a warning.
+func getEnvMap(key string) map[string]string {
+	result := make(map[string]string)
+	for _, item := range getEnvList(key, "") {
+		name, value, ok := strings.Cut(item, ":")
+		if !ok || name == "" || value == "" {
+			log.Printf("Warning: ignoring malformed entry in %s", key)
+			invalidSettings = append(invalidSettings, fmt.Errorf("%s: malformed entry (want name:value)", key))
+			continue
+		}
+		result[name] = value
+	}
+	return result
+}
+
+// getEnvScopes parses "method:name:scope1|scope2" entries into a scope list
+// per identity key ("method:name"). Names may contain colons, scopes don't.
+func getEnvScopes(key string) map[string][]string {
+	result := make(map[string][]string)
+	for _, item := range getEnvList(key, "") {
+		i := strings.LastIndex(item, ":")
+		if i <= 0 || i == len(item)-1 {
+			log.Printf("Warning: ignoring malformed entry in %s", key)
+			invalidSettings = append(invalidSettings, fmt.Errorf("%s: malformed entry (want method:name:scopes)", key))
+			continue
+		}
+		name, value := item[:i], item[i+1:]
+		for _, scope := range strings.Split(value, "|") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				result[name] = append(result[name], scope)
+			}
+		}
+	}
+	return result
+}
+
+// invertMap swaps keys and values (used to index API keys by secret)
+func invertMap(m map[string]string) map[string]string {
+	result := make(map[string]string, len(m))
+	for k, v := range m {
+		result[v] = k
+	}
+	return result
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -182,4 +184,225 @@ func TestLoadConfig(t *testing.T) {
 			t.Errorf("MaxFileCount = %d, want 500", cfg.MaxFileCount)
 		}
 	})
+
+	t.Run("memory-bounded defaults", func(t *testing.T) {
+		t.Setenv(EnvMemoryBounded, "true")
+		if cfg := LoadConfig(); !cfg.StreamExtraction {
+			t.Error("StreamExtraction = false, want true with MEMORY_BOUNDED")
+		}
+		t.Setenv(EnvStreamExtraction, "false")
+		if cfg := LoadConfig(); cfg.StreamExtraction {
+			t.Error("StreamExtraction = true, want the explicit false")
+		}
+	})
+}
+
+func TestGetEnvList(t *testing.T) {
+	os.Setenv("TEST_VAR_LIST", " api-key, ,basic ")
+	defer os.Unsetenv("TEST_VAR_LIST")
+
+	got := getEnvList("TEST_VAR_LIST", "none")
+	if len(got) != 2 || got[0] != "api-key" || got[1] != "basic" {
+		t.Errorf("getEnvList() = %v, want [api-key basic]", got)
+	}
+
+	if got := getEnvList("TEST_VAR_LIST_UNSET", "none"); len(got) != 1 || got[0] != "none" {
+		t.Errorf("getEnvList() default = %v, want [none]", got)
+	}
+}
+
+func TestGetEnvMap(t *testing.T) {
+	os.Setenv("TEST_VAR_MAP", "ci:key-1,malformed,backup:key:with:colons")
+	defer os.Unsetenv("TEST_VAR_MAP")
+
+	got := getEnvMap("TEST_VAR_MAP")
+	if len(got) != 2 {
+		t.Fatalf("getEnvMap() = %v, want 2 entries", got)
+	}
+	if got["ci"] != "key-1" {
+		t.Errorf("got[ci] = %q, want key-1", got["ci"])
+	}
+	if got["backup"] != "key:with:colons" {
+		t.Errorf("got[backup] = %q, want key:with:colons", got["backup"])
+	}
+}
+
+func TestGetEnvScopes(t *testing.T) {
+	os.Setenv("TEST_VAR_SCOPES", "api-key:ci:scan|priority,jwt:urn:svc:mail:mail,malformed")
+	defer os.Unsetenv("TEST_VAR_SCOPES")
+
+	got := getEnvScopes("TEST_VAR_SCOPES")
+	want := map[string][]string{"api-key:ci": {"scan", "priority"}, "jwt:urn:svc:mail": {"mail"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getEnvScopes() = %v, want %v", got, want)
+	}
+}
+
+func TestGetEnvBool(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{value: "true", want: true},
+		{value: "1", want: true},
+		{value: "false", want: false},
+		{value: "not-a-bool", want: true}, // falls back to default
+		{value: "", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("TEST_VAR_BOOL", tt.value)
+			if got := getEnvBool("TEST_VAR_BOOL", true); got != tt.want {
+				t.Errorf("getEnvBool(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetEnvFloat(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+	}{
+		{value: "2.5", want: 2.5},
+		{value: "10", want: 10},
+		{value: "fast", want: 1}, // falls back to default
+		{value: "", want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("TEST_VAR_FLOAT", tt.value)
+			if got := getEnvFloat("TEST_VAR_FLOAT", 1); got != tt.want {
+				t.Errorf("getEnvFloat(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeBasePath(t *testing.T) {
+	for value, want := range map[string]string{"": "", "/": "", "antivirus": "/antivirus", "/antivirus/": "/antivirus", "/a/b": "/a/b"} {
+		if got := normalizeBasePath(value); got != want {
+			t.Errorf("normalizeBasePath(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr string
+	}{
+		{name: "defaults", modify: func(c *Config) {}},
+		{name: "invalid port", modify: func(c *Config) { c.Port = "http" }, wantErr: EnvPort},
+		{name: "zero timeout", modify: func(c *Config) { c.ScanTimeout = 0 }, wantErr: EnvScanTimeout},
+		{name: "max timeout below timeout", modify: func(c *Config) { c.ScanTimeoutMax = time.Minute }, wantErr: EnvScanTimeoutMax},
+		{name: "unknown heuristic alert", modify: func(c *Config) { c.HeuristicAlerts = []string{"macros", "pua"} }, wantErr: EnvHeuristicAlerts},
+		{name: "negative size", modify: func(c *Config) { c.MaxExtractedSize = -1 }, wantErr: EnvMaxExtractedSize},
+		{name: "negative request budget", modify: func(c *Config) { c.RequestMaxExtracted = -1 }, wantErr: EnvRequestExtracted},
+		{name: "negative request files", modify: func(c *Config) { c.RequestMaxFiles = -1 }, wantErr: EnvRequestFiles},
+		{name: "negative request directories", modify: func(c *Config) { c.RequestMaxDirs = -1 }, wantErr: EnvRequestDirs},
+		{name: "negative request depth", modify: func(c *Config) { c.RequestMaxDepth = -1 }, wantErr: EnvRequestDepth},
+		{name: "unlimited entry path", modify: func(c *Config) { c.MaxEntryPath = 0 }},
+		{name: "negative entry path", modify: func(c *Config) { c.MaxEntryPath = -1 }, wantErr: EnvMaxEntryPath},
+		{
+			name:   "file policy",
+			modify: func(c *Config) { c.DeniedExtensions = []string{".exe", "scr"}; c.AllowedTypes = []string{"image/*"} },
+		},
+		{name: "empty extension", modify: func(c *Config) { c.AllowedExtensions = []string{"."} }, wantErr: EnvAllowedExt},
+		{name: "extension with path", modify: func(c *Config) { c.DeniedExtensions = []string{"bin/.exe"} }, wantErr: EnvDeniedExt},
+		{name: "type without subtype", modify: func(c *Config) { c.DeniedTypes = []string{"application"} }, wantErr: EnvDeniedTypes},
+		{name: "wildcard type", modify: func(c *Config) { c.AllowedTypes = []string{"*/pdf"} }, wantErr: EnvAllowedTypes},
+		{
+			name:    "upload smaller than single file",
+			modify:  func(c *Config) { c.MaxUploadSize = 10 << 20; c.MaxSingleFileSize = 20 << 20 },
+			wantErr: "is smaller than " + EnvMaxSingleFile,
+		},
+		{name: "cert without key", modify: func(c *Config) { c.TLSCertFile = "cert.pem" }, wantErr: EnvTLSKeyFile},
+		{name: "scopes by method and name", modify: func(c *Config) { c.AuthScopes = map[string][]string{"jwt:alice": {"admin"}} }},
+		{name: "scopes without method", modify: func(c *Config) { c.AuthScopes = map[string][]string{"alice": {"admin"}} }, wantErr: EnvAuthScopes},
+		{name: "scopes with unknown method", modify: func(c *Config) { c.AuthScopes = map[string][]string{"oidc:alice": {"admin"}} }, wantErr: EnvAuthScopes},
+		{name: "ipv6 bind address", modify: func(c *Config) { c.BindAddress = "fd00::1" }},
+		{name: "bind address with port", modify: func(c *Config) { c.BindAddress = "10.0.0.1:9000" }, wantErr: EnvBindAddress},
+		{
+			name:    "cors any origin with credentials",
+			modify:  func(c *Config) { c.CORSAllowedOrigins = []string{"*"}; c.CORSAllowCredentials = true },
+			wantErr: EnvCORSAllowCredentials,
+		},
+		{
+			name:    "quarantine inside watched directory",
+			modify:  func(c *Config) { c.WatchDirs = []string{"/srv/sftp"}; c.WatchQuarantineDir = "/srv/sftp/quarantine" },
+			wantErr: EnvWatchQuarantineDir,
+		},
+		{
+			name:   "clean directory outside watched directory",
+			modify: func(c *Config) { c.WatchDirs = []string{"/srv/sftp"}; c.WatchCleanDir = "/srv/sftp-clean" },
+		},
+		{
+			name:    "azure without account",
+			modify:  func(c *Config) { c.ObjectStorageProviders = []string{storageGCS, storageAzure} },
+			wantErr: EnvAzureStorageAccount,
+		},
+		{name: "unknown storage provider", modify: func(c *Config) { c.ObjectStorageProviders = []string{"s3"} }, wantErr: EnvObjectStorageProviders},
+		{name: "unknown bomb action", modify: func(c *Config) { c.ArchiveBombAction = "quarantine" }, wantErr: EnvArchiveBombAction},
+		{name: "relative temp dir", modify: func(c *Config) { c.ScanTmpDir = "tmp/scans" }, wantErr: EnvScanTmpDir},
+		{name: "relative async job dir", modify: func(c *Config) { c.AsyncJobDir = "jobs" }, wantErr: EnvAsyncJobDir},
+		{name: "coordinator without job dir", modify: func(c *Config) { c.CoordinatorRedisURL = "redis://redis:6379" }, wantErr: EnvAsyncJobDir},
+		{name: "short coordinator lease", modify: func(c *Config) {
+			c.CoordinatorRedisURL, c.AsyncJobDir, c.CoordinatorLease = "redis://redis:6379", "/var/lib/clamav-rest/jobs", time.Second
+		}, wantErr: EnvCoordinatorLease},
+		{name: "short result URL secret", modify: func(c *Config) { c.ResultURLSecret = "short" }, wantErr: EnvResultURLSecret},
+		{name: "invalid verdict cache URL", modify: func(c *Config) { c.VerdictCacheRedisURL = "http://redis:6379" }, wantErr: EnvVerdictCacheRedisURL},
+		{name: "zero verdict cache TTL", modify: func(c *Config) { c.VerdictCacheTTL = 0 }, wantErr: EnvVerdictCacheTTL},
+		{name: "outbound proxy without scheme", modify: func(c *Config) { c.OutboundProxy = "proxy:3128" }, wantErr: EnvOutboundProxy},
+		{name: "invalid egress denied CIDR", modify: func(c *Config) { c.EgressDeniedCIDRs = []string{"169.254.0.0/33"} }, wantErr: EnvEgressDenied},
+		{name: "invalid egress allowed CIDR", modify: func(c *Config) { c.EgressCIDRs = []string{"metadata"} }, wantErr: EnvEgressCIDRs},
+		{name: "egress host with path", modify: func(c *Config) { c.EgressHosts = []string{"example.com/hooks"} }, wantErr: EnvEgressHosts},
+		{name: "negative egress redirects", modify: func(c *Config) { c.EgressRedirects = -1 }, wantErr: EnvEgressRedirects},
+		{name: "invalid MalwareBazaar URL", modify: func(c *Config) { c.MalwareBazaarAuthKey, c.MalwareBazaarURL = "key", "mb-api.abuse.ch" }, wantErr: EnvMalwareBazaarURL},
+		{name: "zero MalwareBazaar timeout", modify: func(c *Config) { c.MalwareBazaarAuthKey, c.MalwareBazaarTimeout = "key", 0 }, wantErr: EnvMalwareBazaarTimeout},
+		{name: "negative load per CPU", modify: func(c *Config) { c.ShedLoadPerCPU = -1 }, wantErr: EnvShedLoadPerCPU},
+		{name: "negative queue depth", modify: func(c *Config) { c.ShedQueueDepth = -1 }, wantErr: EnvShedQueueDepth},
+		{name: "negative fault latency", modify: func(c *Config) { c.FaultLatency = -time.Millisecond }, wantErr: EnvFaultLatency},
+		{name: "fault percent over 100", modify: func(c *Config) { c.FaultClamdErrorPercent = 101 }, wantErr: EnvFaultClamdErrorPercent},
+		{name: "negative scan history size", modify: func(c *Config) { c.ScanHistorySize = -1 }, wantErr: EnvScanHistorySize},
+		{name: "negative scan history retention", modify: func(c *Config) { c.ScanHistoryRetention = -24 * time.Hour }, wantErr: EnvScanHistoryRetention},
+		{name: "negative quarantine retention", modify: func(c *Config) { c.QuarantineRetention = -24 * time.Hour }, wantErr: EnvQuarantineRetention},
+		{name: "no memory buffer", modify: func(c *Config) { c.MemoryBounded, c.MemoryBufferSize = true, 0 }, wantErr: EnvMemoryBufferSize},
+		{name: "negative in-flight limit", modify: func(c *Config) { c.MaxInFlightPerIP = -1 }, wantErr: EnvMaxInFlightPerIP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := LoadConfig()
+			tt.modify(cfg)
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() error = %v, want mention of %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigValidateReportsAllProblems(t *testing.T) {
+	t.Setenv(EnvMaxFileCount, "lots")
+	t.Setenv(EnvReadTimeout, "0")
+
+	err := LoadConfig().Validate()
+	if err == nil {
+		t.Fatal("Validate() succeeded")
+	}
+	for _, want := range []string{EnvMaxFileCount + `: invalid value "lots"`, EnvReadTimeout + " must be positive"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() error = %v, want mention of %q", err, want)
+		}
+	}
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Settings loaded from the -config file. Environment variables override them.
+var configFileSettings map[string]string
+
+// LoadConfigFile reads a JSON config file, or a YAML one if the name ends
+// in .yaml or .yml (see parseYAMLConfig), whose keys are the environment
+// variable names (case-insensitive). Lists may be given as arrays and
+// "name:value" settings as objects, e.g.
+//
+//	{
+//	  "max_upload_size_mb": 100,
+//	  "auth_methods": ["api-key", "jwt"],
+//	  "api_keys": {"ci": "secret"},
+//	  "auth_scopes": {"api-key:ops": ["admin", "scan"]}
+//	}
+//
+// Unknown keys are rejected so typos don't silently fall back to defaults.
+func LoadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var raw map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		raw, err = parseYAMLConfig(data)
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&raw)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	known := make(map[string]bool, len(configSettings)+len(secretSettings))
+	for _, setting := range configSettings {
+		known[setting.key] = true
+	}
+	for key := range secretSettings {
+		known[key+secretFileSuffix] = true
+	}
+
+	settings := make(map[string]string, len(raw))
+	for key, value := range raw {
+		name := strings.ToUpper(key)
+		if !known[name] {
+			return fmt.Errorf("unknown setting %q in %s", key, path)
+		}
+		if value == nil {
+			continue
+		}
+		s, err := configValue(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for %q in %s: %w", key, path, err)
+		}
+		settings[name] = s
+	}
+
+	configFileSettings = settings
+	return nil
+}
+
+// configValue renders a JSON value in the environment variable syntax:
+// arrays become comma-separated lists and objects "name:value" pairs, with
+// array values joined by "|" (as in AUTH_SCOPES)
+func configValue(value any) (string, error) {
+	switch v := value.(type) {
+	case []any:
+		return joinConfigValues(v, ",")
+	case map[string]any:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		pairs := make([]string, 0, len(v))
+		for _, name := range names {
+			var s string
+			var err error
+			if list, ok := v[name].([]any); ok {
+				s, err = joinConfigValues(list, "|")
+			} else {
+				s, err = scalarConfigValue(v[name])
+			}
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, name+":"+s)
+		}
+		return strings.Join(pairs, ","), nil
+	default:
+		return scalarConfigValue(value)
+	}
+}
+
+// joinConfigValues joins an array of scalars with sep
+func joinConfigValues(values []any, sep string) (string, error) {
+	items := make([]string, 0, len(values))
+	for _, item := range values {
+		s, err := scalarConfigValue(item)
+		if err != nil {
+			return "", err
+		}
+		items = append(items, s)
+	}
+	return strings.Join(items, sep), nil
+}
+
+// scalarConfigValue renders a string, number or bool
+func scalarConfigValue(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+// getenv returns a setting from, in order of precedence, the command line,
+// the environment, the file named by <NAME>_FILE (secret settings only) and
+// the config file. Empty values count as unset.
+func getenv(key string) string {
+	if value := flagSettings[key]; value != "" {
+		return value
+	}
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	if secretSettings[key] {
+		if value := secretFromFile(key); value != "" {
+			return value
+		}
+	}
+	return configFileSettings[key]
+}
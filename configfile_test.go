@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes a JSON config file and resets the loaded settings
+// after the test
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	return writeNamedConfigFile(t, "config.json", content)
+}
+
+// writeNamedConfigFile is writeConfigFile with a file name, which picks the
+// format
+func writeNamedConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	t.Cleanup(func() { configFileSettings = nil })
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"max_upload_size_mb": 100,
+		"SCAN_TIMEOUT_MINUTES": "2",
+		"enable_diagnostics": true,
+		"auth_methods": ["api-key", "none"],
+		"api_keys": {"ci": "secret"},
+		"auth_scopes": {"api-key:ops": ["admin", "scan"]},
+		"tenants_file": null
+	}`)
+
+	if err := LoadConfigFile(path); err != nil {
+		t.Fatalf("LoadConfigFile() error = %v", err)
+	}
+	cfg := LoadConfig()
+
+	if cfg.MaxUploadSize != 100<<20 {
+		t.Errorf("MaxUploadSize = %d, want 100 MB", cfg.MaxUploadSize)
+	}
+	if cfg.ScanTimeout != 2*time.Minute {
+		t.Errorf("ScanTimeout = %v, want 2m", cfg.ScanTimeout)
+	}
+	if !cfg.EnableDiagnostics {
+		t.Error("EnableDiagnostics not set from file")
+	}
+	if want := []string{"api-key", "none"}; !reflect.DeepEqual(cfg.AuthMethods, want) {
+		t.Errorf("AuthMethods = %v, want %v", cfg.AuthMethods, want)
+	}
+	if cfg.APIKeys["secret"] != "ci" {
+		t.Errorf("APIKeys = %v", cfg.APIKeys)
+	}
+	if want := []string{"admin", "scan"}; !reflect.DeepEqual(cfg.AuthScopes["api-key:ops"], want) {
+		t.Errorf("AuthScopes = %v", cfg.AuthScopes)
+	}
+}
+
+func TestLoadConfigFileYAML(t *testing.T) {
+	path := writeNamedConfigFile(t, "config.yml", `
+max_upload_size_mb: 100
+SCAN_TIMEOUT_MINUTES: "2"
+auth_methods: [api-key, none]
+api_keys:
+  ci: secret
+auth_scopes:
+  "api-key:ops":
+    - admin
+    - scan
+tenants_file: ~
+`)
+
+	if err := LoadConfigFile(path); err != nil {
+		t.Fatalf("LoadConfigFile() error = %v", err)
+	}
+	cfg := LoadConfig()
+
+	if cfg.MaxUploadSize != 100<<20 {
+		t.Errorf("MaxUploadSize = %d, want 100 MB", cfg.MaxUploadSize)
+	}
+	if cfg.ScanTimeout != 2*time.Minute {
+		t.Errorf("ScanTimeout = %v, want 2m", cfg.ScanTimeout)
+	}
+	if want := []string{"api-key", "none"}; !reflect.DeepEqual(cfg.AuthMethods, want) {
+		t.Errorf("AuthMethods = %v, want %v", cfg.AuthMethods, want)
+	}
+	if cfg.APIKeys["secret"] != "ci" {
+		t.Errorf("APIKeys = %v", cfg.APIKeys)
+	}
+	if want := []string{"admin", "scan"}; !reflect.DeepEqual(cfg.AuthScopes["api-key:ops"], want) {
+		t.Errorf("AuthScopes = %v", cfg.AuthScopes)
+	}
+
+	// Unknown keys are rejected as in JSON
+	if err := LoadConfigFile(writeNamedConfigFile(t, "config.yaml", "max_upload_size: 100\n")); err == nil {
+		t.Error("LoadConfigFile() accepted an unknown YAML key")
+	}
+}
+
+func TestLoadConfigFileEnvOverrides(t *testing.T) {
+	path := writeConfigFile(t, `{"port": "8000", "max_file_count": 5}`)
+	t.Setenv(EnvPort, "9100")
+
+	if err := LoadConfigFile(path); err != nil {
+		t.Fatalf("LoadConfigFile() error = %v", err)
+	}
+	cfg := LoadConfig()
+
+	if cfg.Port != "9100" {
+		t.Errorf("Port = %q, want env value 9100", cfg.Port)
+	}
+	if cfg.MaxFileCount != 5 {
+		t.Errorf("MaxFileCount = %d, want file value 5", cfg.MaxFileCount)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "unknown key", content: `{"max_upload_size": 100}`},
+		{name: "nested object value", content: `{"api_keys": {"ci": {"key": "secret"}}}`},
+		{name: "not an object", content: `["port"]`},
+		{name: "invalid json", content: `{"port": }`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfigFile(t, tt.content)
+			if err := LoadConfigFile(path); err == nil {
+				t.Error("LoadConfigFile() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileMissing(t *testing.T) {
+	if err := LoadConfigFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("LoadConfigFile() succeeded for missing file")
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAMLConfig parses the subset of YAML a config file needs: a mapping
+// of settings whose values are scalars, block or flow sequences, or one
+// level of nested mappings, e.g.
+//
+//	max_upload_size_mb: 100
+//	auth_methods: [api-key, jwt]
+//	api_keys:
+//	  ci: secret
+//	auth_scopes:
+//	  "api-key:ops": [admin, scan]
+//
+// Plain scalars are kept as written ("100", "true"); null, ~ and empty
+// values are unset. Anchors, aliases, tags, block scalars (| and >) and
+// multi-document files are rejected rather than misread.
+func parseYAMLConfig(data []byte) (map[string]any, error) {
+	p := &yamlParser{}
+	for i, line := range strings.Split(string(data), "\n") {
+		text := stripYAMLComment(strings.TrimRight(line, " \t\r"))
+		content := strings.TrimLeft(text, " ")
+		if content == "" {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed in indentation", i+1)
+		}
+		if content == "---" && len(p.lines) == 0 {
+			continue
+		}
+		if content == "---" || content == "..." {
+			return nil, fmt.Errorf("line %d: only one document is supported", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{number: i + 1, indent: len(text) - len(content), text: content})
+	}
+	if len(p.lines) == 0 {
+		return map[string]any{}, nil
+	}
+
+	if first := p.lines[0]; first.indent != 0 || isYAMLSequenceItem(first.text) {
+		return nil, fmt.Errorf("line %d: expected a mapping of settings", first.number)
+	}
+	settings, err := p.mapping(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].number)
+	}
+	return settings, nil
+}
+
+// yamlLine is a non-empty line without its comment and indentation
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+// yamlParser walks the lines of a block-style document
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// mapping parses "key: value" lines at indent
+func (p *yamlParser) mapping(indent int) (map[string]any, error) {
+	result := make(map[string]any)
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.number)
+		}
+		if isYAMLSequenceItem(line.text) {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", line.number)
+		}
+
+		key, rest, err := splitYAMLKey(line.text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line.number, err)
+		}
+		if _, dup := result[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", line.number, key)
+		}
+		p.pos++
+
+		var value any
+		if rest != "" {
+			value, err = parseYAMLInline(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line.number, err)
+			}
+		} else if p.pos < len(p.lines) {
+			// A nested block: deeper indented, or a sequence at the key's
+			// own indentation
+			next := p.lines[p.pos]
+			switch {
+			case next.indent > indent && isYAMLSequenceItem(next.text):
+				value, err = p.sequence(next.indent)
+			case next.indent > indent:
+				value, err = p.mapping(next.indent)
+			case next.indent == indent && isYAMLSequenceItem(next.text):
+				value, err = p.sequence(indent)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		result[key] = value
+	}
+	return result, nil
+}
+
+// sequence parses "- item" lines at indent. Items are scalars or flow
+// collections.
+func (p *yamlParser) sequence(indent int) ([]any, error) {
+	var result []any
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent || (line.indent == indent && !isYAMLSequenceItem(line.text)) {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.number)
+		}
+		p.pos++
+
+		item := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if item == "" {
+			return nil, fmt.Errorf("line %d: empty or nested sequence items are not supported", line.number)
+		}
+		if _, _, err := splitYAMLKey(item); err == nil && !strings.HasPrefix(item, "[") && !strings.HasPrefix(item, "{") {
+			return nil, fmt.Errorf("line %d: mappings in sequences are not supported", line.number)
+		}
+		value, err := parseYAMLInline(item)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line.number, err)
+		}
+		result = append(result, value)
+	}
+	return result, nil
+}
+
+// isYAMLSequenceItem reports whether a line starts a block sequence item
+func isYAMLSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitYAMLKey splits "key: value" at the first ": " (or a trailing ":")
+// outside quotes
+func splitYAMLKey(text string) (string, string, error) {
+	var key string
+	var rest string
+	if text[0] == '"' || text[0] == '\'' {
+		quoted, n, err := parseYAMLQuoted(text)
+		if err != nil {
+			return "", "", err
+		}
+		after := text[n:]
+		if after != ":" && !strings.HasPrefix(after, ": ") {
+			return "", "", fmt.Errorf("expected \"key: value\"")
+		}
+		key, rest = quoted, after[1:]
+	} else {
+		i := strings.Index(text, ": ")
+		switch {
+		case i >= 0:
+			key, rest = text[:i], text[i+1:]
+		case strings.HasSuffix(text, ":"):
+			key = text[:len(text)-1]
+		default:
+			return "", "", fmt.Errorf("expected \"key: value\"")
+		}
+		if key == "" || strings.ContainsAny(key[:1], "[]{}&*!|>%@`,?") {
+			return "", "", fmt.Errorf("unsupported key %q", key)
+		}
+	}
+	return key, strings.TrimSpace(rest), nil
+}
+
+// parseYAMLInline parses a value written on one line: a quoted or plain
+// scalar, or a flow sequence or mapping
+func parseYAMLInline(text string) (any, error) {
+	switch text[0] {
+	case '[', '{':
+		value, n, err := parseYAMLFlow(text)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(text[n:]) != "" {
+			return nil, fmt.Errorf("unexpected %q after %s", text[n:], text[:n])
+		}
+		return value, nil
+	case '"', '\'':
+		value, n, err := parseYAMLQuoted(text)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(text[n:]) != "" {
+			return nil, fmt.Errorf("unexpected %q after %s", text[n:], text[:n])
+		}
+		return value, nil
+	case '|', '>':
+		return nil, fmt.Errorf("block scalars are not supported, quote the value instead")
+	}
+	return plainYAMLScalar(text)
+}
+
+// parseYAMLFlow parses a flow sequence ([a, b]) or mapping ({a: b}) at the
+// start of text, returning the value and the number of bytes consumed
+func parseYAMLFlow(text string) (any, int, error) {
+	open := text[0]
+	end := byte(']')
+	if open == '{' {
+		end = '}'
+	}
+	var list []any
+	object := make(map[string]any)
+
+	i := 1
+	for {
+		i += countYAMLSpaces(text[i:])
+		if i >= len(text) {
+			return nil, 0, fmt.Errorf("unterminated %c, flow collections must fit on one line", open)
+		}
+		if text[i] == end {
+			// Empty, or after a trailing comma
+			i++
+			break
+		}
+
+		var key string
+		if open == '{' {
+			k, n, err := parseYAMLFlowScalar(text[i:], true)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("invalid key in %s", text)
+			}
+			if _, dup := object[name]; dup {
+				return nil, 0, fmt.Errorf("duplicate key %q", name)
+			}
+			i += n
+			i += countYAMLSpaces(text[i:])
+			if i >= len(text) || text[i] != ':' {
+				return nil, 0, fmt.Errorf("expected \":\" after key %q", name)
+			}
+			i++
+			i += countYAMLSpaces(text[i:])
+			key = name
+		}
+
+		var value any
+		var n int
+		var err error
+		if i < len(text) && (text[i] == '[' || text[i] == '{') {
+			value, n, err = parseYAMLFlow(text[i:])
+		} else {
+			value, n, err = parseYAMLFlowScalar(text[i:], false)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		i += n
+		if open == '{' {
+			object[key] = value
+		} else {
+			list = append(list, value)
+		}
+
+		i += countYAMLSpaces(text[i:])
+		if i >= len(text) {
+			return nil, 0, fmt.Errorf("unterminated %c, flow collections must fit on one line", open)
+		}
+		if text[i] == end {
+			i++
+			break
+		}
+		if text[i] != ',' {
+			return nil, 0, fmt.Errorf("expected \",\" or %q in %s", end, text)
+		}
+		i++
+	}
+
+	if open == '{' {
+		return object, i, nil
+	}
+	if list == nil {
+		list = []any{}
+	}
+	return list, i, nil
+}
+
+// parseYAMLFlowScalar parses a scalar inside a flow collection, which ends
+// at a "," or closing bracket (or ":" for a key)
+func parseYAMLFlowScalar(text string, isKey bool) (any, int, error) {
+	if text != "" && (text[0] == '"' || text[0] == '\'') {
+		value, n, err := parseYAMLQuoted(text)
+		return value, n, err
+	}
+	n := 0
+	for n < len(text) {
+		c := text[n]
+		if c == ',' || c == ']' || c == '}' || c == '[' || c == '{' {
+			break
+		}
+		if isKey && c == ':' && (n+1 == len(text) || strings.IndexByte(" ,}", text[n+1]) >= 0) {
+			break
+		}
+		n++
+	}
+	raw := strings.TrimSpace(text[:n])
+	if raw == "" {
+		if isKey {
+			return nil, 0, fmt.Errorf("empty key")
+		}
+		return nil, n, nil
+	}
+	value, err := plainYAMLScalar(raw)
+	return value, n, err
+}
+
+// parseYAMLQuoted parses a single- or double-quoted string at the start of
+// text, returning it and the number of bytes consumed
+func parseYAMLQuoted(text string) (string, int, error) {
+	quote := text[0]
+	if quote == '\'' {
+		var b strings.Builder
+		for i := 1; i < len(text); i++ {
+			if text[i] != '\'' {
+				b.WriteByte(text[i])
+				continue
+			}
+			if i+1 < len(text) && text[i+1] == '\'' {
+				b.WriteByte('\'')
+				i++
+				continue
+			}
+			return b.String(), i + 1, nil
+		}
+		return "", 0, fmt.Errorf("unterminated quoted string")
+	}
+
+	for i := 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			s, err := strconv.Unquote(text[:i+1])
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid quoted string %s", text[:i+1])
+			}
+			return s, i + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated quoted string")
+}
+
+// plainYAMLScalar returns an unquoted scalar as written, or nil for null
+func plainYAMLScalar(text string) (any, error) {
+	switch text {
+	case "null", "Null", "NULL", "~":
+		return nil, nil
+	}
+	if strings.ContainsAny(text[:1], "&*!%@`") {
+		return nil, fmt.Errorf("anchors, aliases and tags are not supported, quote %q", text)
+	}
+	return text, nil
+}
+
+// stripYAMLComment removes a "#" comment (at the start of the line or after
+// whitespace) outside quotes
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			// Quotes only open a string at the start of a scalar
+			if i == 0 || strings.IndexByte(" [{,:-", line[i-1]) >= 0 {
+				quote = c
+			}
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return strings.TrimRight(line[:i], " \t")
+		}
+	}
+	return line
+}
+
+// countYAMLSpaces returns the number of leading spaces in text
+func countYAMLSpaces(text string) int {
+	return len(text) - len(strings.TrimLeft(text, " "))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseYAMLConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]any
+	}{
+		{
+			name:    "scalars",
+			content: "port: 8080\nenable_diagnostics: true\nlog_format: \"json\"\nclamd_address: 'tcp://clamd:3310'\n",
+			want:    map[string]any{"port": "8080", "enable_diagnostics": "true", "log_format": "json", "clamd_address": "tcp://clamd:3310"},
+		},
+		{
+			name:    "comments and document start",
+			content: "---\n# Settings\nport: 8080 # inline\nnotify_webhook_url: \"https://example.com/#anchor\"\n\n",
+			want:    map[string]any{"port": "8080", "notify_webhook_url": "https://example.com/#anchor"},
+		},
+		{
+			name:    "null values",
+			content: "tenants_file:\ntls_cert_file: null\ntls_key_file: ~\n",
+			want:    map[string]any{"tenants_file": nil, "tls_cert_file": nil, "tls_key_file": nil},
+		},
+		{
+			name:    "flow collections",
+			content: "auth_methods: [api-key, \"jwt\", ]\napi_keys: {ci: secret, 'ops team': 'it''s'}\nauth_scopes: {\"api-key:ops\": [admin, scan]}\n",
+			want: map[string]any{
+				"auth_methods": []any{"api-key", "jwt"},
+				"api_keys":     map[string]any{"ci": "secret", "ops team": "it's"},
+				"auth_scopes":  map[string]any{"api-key:ops": []any{"admin", "scan"}},
+			},
+		},
+		{
+			name:    "block collections",
+			content: "auth_methods:\n  - api-key\n  - jwt\nallowed_ips:\n- 10.0.0.0/8\napi_keys:\n  ci: secret\nauth_scopes:\n  \"jwt:ops\":\n    - admin\n    - scan\n  api-key:ci: [scan]\n",
+			want: map[string]any{
+				"auth_methods": []any{"api-key", "jwt"},
+				"allowed_ips":  []any{"10.0.0.0/8"},
+				"api_keys":     map[string]any{"ci": "secret"},
+				"auth_scopes":  map[string]any{"jwt:ops": []any{"admin", "scan"}, "api-key:ci": []any{"scan"}},
+			},
+		},
+		{
+			name:    "escapes",
+			content: "api_keys: \"ci:s\\\"e\\u00e9\"\n",
+			want:    map[string]any{"api_keys": "ci:s\"eé"},
+		},
+		{
+			name:    "empty",
+			content: "# nothing here\n",
+			want:    map[string]any{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAMLConfig([]byte(tt.content))
+			if err != nil {
+				t.Fatalf("parseYAMLConfig() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseYAMLConfig() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "top-level list", content: "- port\n"},
+		{name: "no colon", content: "port 8080\n"},
+		{name: "duplicate key", content: "port: 1\nport: 2\n"},
+		{name: "bad indentation", content: "port: 1\n  host: x\n"},
+		{name: "tab indentation", content: "api_keys:\n\tci: secret\n"},
+		{name: "anchor", content: "port: &p 8080\n"},
+		{name: "alias", content: "cors_allowed_origins: *\n"},
+		{name: "tag", content: "port: !!int 8080\n"},
+		{name: "block scalar", content: "jwt_secret: |\n  secret\n"},
+		{name: "multiline flow", content: "auth_methods: [api-key,\n  jwt]\n"},
+		{name: "unterminated string", content: "port: \"8080\n"},
+		{name: "text after string", content: "port: \"80\" 80\n"},
+		{name: "mapping in list", content: "auth_methods:\n  - name: api-key\n"},
+		{name: "second document", content: "port: 1\n---\nport: 2\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := parseYAMLConfig([]byte(tt.content)); err == nil {
+				t.Errorf("parseYAMLConfig() = %v, want error", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Coordinator mode spreads async jobs over the instances of a cluster
+// without a queue: jobs are saved in a directory every instance shares
+// (ASYNC_JOB_DIR), and each instance claims unfinished jobs while it has
+// free slots, holding a lease in Redis for as long as a job runs. When an
+// instance dies its leases expire, and other instances run its jobs again
+// from their records.
+
+// How often the shared job directory is checked for jobs to claim
+const coordinatorPollInterval = time.Second
+
+// Lua scripts renewing and releasing a lease, only while this instance
+// still holds it
+const (
+	leaseRenewScript   = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`
+	leaseReleaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+)
+
+// Coordinator claims and runs the jobs of the shared job directory
+type Coordinator struct {
+	redis   *RedisClient
+	prefix  string        // Namespace of the Redis keys
+	node    string        // This instance's ID
+	lease   time.Duration // How long a lease lasts without renewal
+	slots   int           // Jobs run at once
+	store   *JobStore
+	config  *Config
+	scanner *Scanner
+	kick    chan struct{}
+
+	mu      sync.Mutex
+	running int
+
+	seen map[string]time.Time // Modification time of each record last read (poll only)
+}
+
+// Global coordinator (nil = jobs run where they are submitted)
+var coordinator *Coordinator
+
+// clusterNode is an instance as listed by GET /admin/cluster
+type clusterNode struct {
+	ID       string    `json:"id"`
+	LastSeen time.Time `json:"last_seen"`
+	Jobs     int       `json:"jobs"` // Jobs running
+	Self     bool      `json:"self,omitempty"`
+}
+
+// clusterResponse is the response of GET /admin/cluster
+type clusterResponse struct {
+	Node    string        `json:"node"` // The instance that answered
+	Nodes   []clusterNode `json:"nodes"`
+	Pending int           `json:"pending"` // Jobs waiting for, or running on, another instance
+}
+
+// NewCoordinator creates the coordinator for store. Returns nil when
+// COORDINATOR_REDIS_URL is not set or async scans are disabled.
+func NewCoordinator(config *Config, scanner *Scanner, store *JobStore) (*Coordinator, error) {
+	client, err := NewRedisClient(config.CoordinatorRedisURL)
+	if client == nil || err != nil || store == nil {
+		return nil, err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "clamav-rest"
+	}
+	return &Coordinator{
+		redis:   client,
+		prefix:  config.CoordinatorPrefix,
+		node:    host + "-" + randomID()[:8],
+		lease:   config.CoordinatorLease,
+		slots:   config.CoordinatorJobs,
+		store:   store,
+		config:  config,
+		scanner: scanner,
+		kick:    make(chan struct{}, 1),
+		seen:    make(map[string]time.Time),
+	}, nil
+}
+
+// Start joins the cluster and claims jobs in the background
+func (c *Coordinator) Start() {
+	log.Printf("Coordinator: joined as %s (jobs: %d, lease: %v)", c.node, c.slots, c.lease)
+	go func() {
+		poll := time.NewTicker(coordinatorPollInterval)
+		defer poll.Stop()
+		beat := time.NewTicker(c.lease / 3)
+		defer beat.Stop()
+		c.heartbeat()
+		for {
+			select {
+			case <-poll.C:
+			case <-c.kick:
+			case <-beat.C:
+				c.heartbeat()
+				continue
+			}
+			c.poll()
+		}
+	}()
+}
+
+// Kick checks for jobs to claim now rather than at the next poll
+func (c *Coordinator) Kick() {
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+}
+
+// poll brings the store up to date with the shared job directory, removes
+// files left behind by interrupted writes and claims jobs for free slots
+func (c *Coordinator) poll() {
+	dir := c.store.dir
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Coordinator: failed to read %s: %v", dir, err)
+		return
+	}
+
+	present := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if id, ok := strings.CutSuffix(entry.Name(), ".json"); ok {
+			present[id] = true
+		}
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		id, ok := strings.CutSuffix(name, ".json")
+		if !ok {
+			// A temp file or upload whose job was never saved; the instance
+			// that wrote it is done with it after a lease at most
+			upload, isUpload := strings.CutSuffix(name, ".upload")
+			stale := time.Since(info.ModTime()) > c.lease
+			if stale && (strings.HasPrefix(name, ".job-") || isUpload && !present[upload]) {
+				os.Remove(filepath.Join(dir, name))
+			}
+			continue
+		}
+		if c.seen[id].Equal(info.ModTime()) {
+			continue
+		}
+		record, err := c.store.readRecord(id)
+		if err != nil {
+			continue
+		}
+		c.seen[id] = info.ModTime()
+		c.store.observe(record)
+	}
+
+	// Jobs deleted or expired on any instance
+	for id := range c.seen {
+		if !present[id] {
+			delete(c.seen, id)
+			if job := c.store.Find(id); job != nil {
+				c.store.forget(job)
+			}
+		}
+	}
+	c.claim()
+}
+
+// claim runs the oldest waiting jobs this instance gets a lease for, up to
+// its free slots
+func (c *Coordinator) claim() {
+	for _, job := range c.store.pending() {
+		if !c.acquireSlot() {
+			return
+		}
+		lease, err := c.hold(job)
+		if err != nil {
+			c.releaseSlot()
+			log.Printf("Coordinator: failed to claim async job %s: %v", job.ID, err)
+			return
+		}
+		if lease == nil {
+			c.releaseSlot()
+			continue // Running elsewhere
+		}
+
+		// The job may have finished between the poll and the lease
+		var run func()
+		if record, err := c.store.readRecord(job.ID); err == nil && record.Finished.IsZero() {
+			run = c.store.adopt(job, record, c.config, c.scanner)
+		}
+		if run == nil {
+			lease.Release()
+			c.releaseSlot()
+			continue
+		}
+		log.Printf("Coordinator: claimed async job %s", job.ID)
+		metrics.Count("coordinator.claimed", 1)
+		c.store.Go(job, func() {
+			defer c.releaseSlot()
+			defer lease.Release()
+			waitForClamd()
+			run()
+		})
+	}
+}
+
+// acquireSlot takes a free job slot, or returns false if there is none
+func (c *Coordinator) acquireSlot() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running >= c.slots {
+		return false
+	}
+	c.running++
+	metrics.Gauge("coordinator.running", float64(c.running))
+	return true
+}
+
+func (c *Coordinator) releaseSlot() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running--
+	metrics.Gauge("coordinator.running", float64(c.running))
+}
+
+// jobLease is this instance's claim on a job, renewed until released
+type jobLease struct {
+	c    *Coordinator
+	job  *ScanJob
+	key  string
+	done chan struct{}
+	once sync.Once
+}
+
+// hold takes the lease of job, or returns nil if another instance holds it
+func (c *Coordinator) hold(job *ScanJob) (*jobLease, error) {
+	key := c.prefix + "lease:" + job.ID
+	ok, err := c.redis.SetNX(context.Background(), key, []byte(c.node), c.lease)
+	if err != nil || !ok {
+		return nil, err
+	}
+	l := &jobLease{c: c, job: job, key: key, done: make(chan struct{})}
+	go l.keep()
+	return l, nil
+}
+
+// Hold takes the lease of a job submitted here, before it is saved where
+// other instances see it. Returns nil without a coordinator, or if Redis
+// fails; the job then runs here unguarded.
+func (c *Coordinator) Hold(job *ScanJob) *jobLease {
+	if c == nil {
+		return nil
+	}
+	l, err := c.hold(job)
+	if err != nil {
+		log.Printf("Coordinator: failed to lease async job %s, running it here: %v", job.ID, err)
+	}
+	return l
+}
+
+// Share leaves the job to whichever instance claims it first, and returns
+// false without a lease (the caller runs the job)
+func (l *jobLease) Share() bool {
+	if l == nil {
+		return false
+	}
+	l.c.store.share(l.job)
+	l.Release()
+	l.c.Kick()
+	return true
+}
+
+// Release stops renewing the lease and gives it up
+func (l *jobLease) Release() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		close(l.done)
+		if _, err := l.c.redis.Eval(context.Background(), leaseReleaseScript, []string{l.key}, l.c.node); err != nil {
+			log.Printf("Coordinator: failed to release async job %s, it is claimable when the lease expires: %v", l.job.ID, err)
+		}
+	})
+}
+
+// keep renews the lease until it is released. If the lease is lost, to an
+// outage longer than the lease or to another instance, the job stops here
+// and is left to whichever instance claims it.
+func (l *jobLease) keep() {
+	ticker := time.NewTicker(l.c.lease / 3)
+	defer ticker.Stop()
+	renewed := time.Now()
+	ms := strconv.FormatInt(l.c.lease.Milliseconds(), 10)
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+		reply, err := l.c.redis.Eval(context.Background(), leaseRenewScript, []string{l.key}, l.c.node, ms)
+		select {
+		case <-l.done:
+			return // Released meanwhile
+		default:
+		}
+		if err == nil && reply != int64(0) {
+			renewed = time.Now()
+			continue
+		}
+		if err != nil && time.Since(renewed) < l.c.lease {
+			log.Printf("Coordinator: failed to renew the lease of async job %s: %v", l.job.ID, err)
+			continue
+		}
+		log.Printf("Coordinator: lost the lease of async job %s, leaving it to another instance", l.job.ID)
+		metrics.Count("coordinator.leases_lost", 1)
+		l.c.store.forget(l.job)
+		return
+	}
+}
+
+// heartbeat records this instance in the cluster's node list
+func (c *Coordinator) heartbeat() {
+	c.mu.Lock()
+	running := c.running
+	c.mu.Unlock()
+	data, _ := json.Marshal(clusterNode{ID: c.node, LastSeen: time.Now().UTC(), Jobs: running})
+	if err := c.redis.HSet(context.Background(), c.prefix+"nodes", c.node, data); err != nil {
+		log.Printf("Coordinator: failed to send heartbeat: %v", err)
+	}
+}
+
+// Nodes lists the instances that sent a heartbeat lately, dropping those
+// silent for three leases
+func (c *Coordinator) Nodes(ctx context.Context) ([]clusterNode, error) {
+	fields, err := c.redis.HGetAll(ctx, c.prefix+"nodes")
+	if err != nil {
+		return nil, err
+	}
+	nodes := []clusterNode{}
+	var gone []string
+	for id, data := range fields {
+		var node clusterNode
+		if json.Unmarshal(data, &node) != nil || time.Since(node.LastSeen) > 3*c.lease {
+			gone = append(gone, id)
+			continue
+		}
+		node.ID, node.Self = id, id == c.node
+		nodes = append(nodes, node)
+	}
+	if len(gone) > 0 {
+		if err := c.redis.HDel(ctx, c.prefix+"nodes", gone...); err != nil {
+			log.Printf("Coordinator: failed to drop silent nodes: %v", err)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, nil
+}
+
+// clusterHandler lists the cluster's instances (GET /admin/cluster)
+func clusterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nodes, err := coordinator.Nodes(r.Context())
+	if err != nil {
+		log.Printf("Coordinator: failed to list nodes: %v", err)
+		sendErrorStatus(w, http.StatusServiceUnavailable, "Coordinator store unavailable")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clusterResponse{Node: coordinator.node, Nodes: nodes, Pending: len(coordinator.store.pending())})
+}
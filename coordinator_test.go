@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useCoordinator shares a new job store through dir and returns its
+// coordinator, backed by a fake Redis
+func useCoordinator(t *testing.T, cfg *Config, dir string) (*Coordinator, *fakeRedis) {
+	t.Helper()
+	server := newFakeRedis(t, "")
+	cfg.CoordinatorRedisURL = "redis://" + server.address()
+	cfg.CoordinatorPrefix = "test:"
+	cfg.CoordinatorLease = 3 * time.Second
+	cfg.CoordinatorJobs = 1
+
+	store := NewJobStore(10, time.Minute)
+	useJobStore(t, store)
+	if err := store.Share(dir); err != nil {
+		t.Fatalf("Share() error: %v", err)
+	}
+	c, err := NewCoordinator(cfg, NewScanner(cfg), store)
+	if err != nil {
+		t.Fatalf("NewCoordinator() error: %v", err)
+	}
+	coordinator = c
+	t.Cleanup(func() { coordinator = nil })
+	return c, server
+}
+
+// writeSharedJob saves an unfinished upload job as another instance would
+func writeSharedJob(t *testing.T, dir string, created time.Time, content string) string {
+	t.Helper()
+	id := randomID()
+	data, _ := json.Marshal(jobRecord{ID: id, Created: created,
+		Request: &savedRequest{Method: http.MethodPost, URL: "/scan?async=true", ClientIP: "192.0.2.1"},
+		Upload:  &jobUpload{Filename: "upload.bin", Size: int64(len(content))}})
+	if err := os.WriteFile(filepath.Join(dir, id+".json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, id+".upload"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestCoordinatorClaimsJobs(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	dir := t.TempDir()
+	c, server := useCoordinator(t, cfg, dir)
+
+	// The older job is claimed first; the other is leased by a live instance
+	created := time.Now().UTC().Add(-time.Minute)
+	first := writeSharedJob(t, dir, created, "EICAR")
+	second := writeSharedJob(t, dir, created.Add(time.Second), "EICAR")
+	server.set("test:lease:"+second, "other-node")
+
+	c.poll()
+	job := c.store.Find(first)
+	if job == nil {
+		t.Fatal("shared job not loaded")
+	}
+	if status := waitForJob(t, job); status.Result == nil || status.Result.Status != "infected" {
+		t.Errorf("claimed job = %+v, want infected result", status)
+	}
+	record, err := c.store.readRecord(first)
+	if err != nil || record.Finished.IsZero() || record.Result == nil {
+		t.Errorf("claimed job record = %+v, %v; want its result", record, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, first+".upload")); !os.IsNotExist(err) {
+		t.Error("upload of the finished job was not removed")
+	}
+	for deadline := time.Now().Add(time.Second); server.get("test:lease:"+first) != "" && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.get("test:lease:"+first) != "" {
+		t.Error("lease of the finished job was not released")
+	}
+
+	// A job leased elsewhere stays queued until its lease expires
+	c.poll()
+	if snapshot, _ := c.store.Find(second).Snapshot(); snapshot.Stage != stageQueued {
+		t.Errorf("job leased by another instance is %s, want queued", snapshot.Stage)
+	}
+	server.expire("test:lease:" + second)
+	c.poll()
+	if status := waitForJob(t, c.store.Find(second)); status.Result == nil || status.Result.Status != "infected" {
+		t.Errorf("job of a dead instance = %+v, want infected result", status)
+	}
+
+	// Jobs whose record is removed elsewhere are dropped
+	os.Remove(filepath.Join(dir, first+".json"))
+	c.poll()
+	if job := c.store.Find(first); job != nil {
+		t.Errorf("job removed from the shared directory still found: %+v", job)
+	}
+}
+
+func TestCoordinatorSharesSubmissions(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	dir := t.TempDir()
+	c, server := useCoordinator(t, cfg, dir)
+
+	body, contentType := multipartUpload(t, "test.txt", []byte("hello"))
+	req := httptest.NewRequest(http.MethodPost, "/scan?async=true", body)
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+	handleScan(recorder, req, cfg, NewScanner(cfg))
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("status %d, want 202", recorder.Code)
+	}
+	var accepted JobResponse
+	json.NewDecoder(recorder.Body).Decode(&accepted)
+
+	// Left for any instance: saved with its upload and not leased
+	job := c.store.Get(accepted.ID, "")
+	if job == nil || len(c.store.pending()) != 1 {
+		t.Fatalf("submitted job not pending: %+v", job)
+	}
+	if _, err := os.Stat(filepath.Join(dir, accepted.ID+".upload")); err != nil {
+		t.Errorf("upload not saved in the shared directory: %v", err)
+	}
+	if server.get("test:lease:"+accepted.ID) != "" {
+		t.Error("submitted job still leased")
+	}
+
+	c.poll()
+	if status := waitForJob(t, job); status.Result == nil || status.Result.Status != "clean" {
+		t.Errorf("shared job = %+v, want clean result", status)
+	}
+
+	// Archive passwords aren't saved, so such a job runs where it was sent
+	body, contentType = multipartUpload(t, "test.txt", []byte("hello"))
+	req = httptest.NewRequest(http.MethodPost, "/scan?async=true", body)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(archivePasswordHeader, "infected")
+	recorder = httptest.NewRecorder()
+	handleScan(recorder, req, cfg, NewScanner(cfg))
+	accepted = JobResponse{}
+	json.NewDecoder(recorder.Body).Decode(&accepted)
+	if len(c.store.pending()) != 0 {
+		t.Error("job with archive passwords shared with the cluster")
+	}
+	if status := waitForJob(t, c.store.Get(accepted.ID, "")); status.Result == nil || status.Result.Status != "clean" {
+		t.Errorf("local job = %+v, want clean result", status)
+	}
+	record, err := c.store.readRecord(accepted.ID)
+	if err != nil || record.Result == nil {
+		t.Errorf("local job record = %+v, %v; want its result", record, err)
+	}
+}
+
+func TestCoordinatorLeaseLost(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	c, server := useCoordinator(t, cfg, t.TempDir())
+	c.lease = 300 * time.Millisecond
+
+	job := c.store.Create("", "")
+	ctx := job.start(context.Background())
+	lease, err := c.hold(job)
+	if err != nil || lease == nil {
+		t.Fatalf("hold() = %v, %v", lease, err)
+	}
+	defer lease.Release()
+	if server.get("test:lease:"+job.ID) != c.node {
+		t.Fatalf("lease held by %q, want %q", server.get("test:lease:"+job.ID), c.node)
+	}
+	if other, err := c.hold(job); other != nil || err != nil {
+		t.Errorf("second hold() = %v, %v; want nil", other, err)
+	}
+
+	// Renewed while held, then lost to another instance
+	time.Sleep(200 * time.Millisecond)
+	if ctx.Err() != nil {
+		t.Fatal("job canceled while its lease was held")
+	}
+	server.set("test:lease:"+job.ID, "other-node")
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("job not canceled after its lease was lost")
+	}
+	if c.store.Find(job.ID) != nil {
+		t.Error("job with a lost lease still kept")
+	}
+	lease.Release()
+	if server.get("test:lease:"+job.ID) != "other-node" {
+		t.Error("Release() removed another instance's lease")
+	}
+}
+
+func TestClusterHandler(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	c, _ := useCoordinator(t, cfg, t.TempDir())
+	c.heartbeat()
+	stale, _ := json.Marshal(clusterNode{LastSeen: time.Now().Add(-time.Hour)})
+	if err := c.redis.HSet(context.Background(), "test:nodes", "dead-node", stale); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	clusterHandler(recorder, httptest.NewRequest(http.MethodGet, "/admin/cluster", nil))
+	var response clusterResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("status %d, %v", recorder.Code, err)
+	}
+	if response.Node != c.node || len(response.Nodes) != 1 || response.Nodes[0].ID != c.node || !response.Nodes[0].Self {
+		t.Errorf("response = %+v, want only this node", response)
+	}
+	if fields, _ := c.redis.HGetAll(context.Background(), "test:nodes"); len(fields) != 1 {
+		t.Errorf("silent node not dropped: %d nodes", len(fields))
+	}
+
+	recorder = httptest.NewRecorder()
+	clusterHandler(recorder, httptest.NewRequest(http.MethodPost, "/admin/cluster", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status %d, want 405", recorder.Code)
+	}
+}
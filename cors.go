@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Response headers browsers may read besides the CORS-safelisted ones
+const corsExposedHeaders = "Retry-After, traceresponse, X-Request-ID, ETag, Location, Tus-Resumable, Tus-Version, Upload-Offset, Upload-Length, Upload-Expires"
+
+// CORSPolicy decides which browser origins may call the API
+type CORSPolicy struct {
+	origins     map[string]bool // Exact origins
+	wildcards   []corsWildcard  // https://*.example.com patterns
+	anyOrigin   bool
+	methods     []string
+	headers     string
+	credentials bool
+	maxAge      int
+}
+
+// corsWildcard matches any subdomain of domain, e.g. https://*.example.com
+type corsWildcard struct {
+	scheme string // "https://"
+	domain string // ".example.com"
+}
+
+// NewCORSPolicy creates the CORS policy, or returns nil if no origins are allowed
+func NewCORSPolicy(config *Config) *CORSPolicy {
+	if len(config.CORSAllowedOrigins) == 0 {
+		return nil
+	}
+
+	policy := &CORSPolicy{
+		origins:     make(map[string]bool),
+		methods:     config.CORSAllowedMethods,
+		headers:     strings.Join(config.CORSAllowedHeaders, ", "),
+		credentials: config.CORSAllowCredentials,
+		maxAge:      config.CORSMaxAge,
+	}
+	for _, origin := range config.CORSAllowedOrigins {
+		scheme, host, wildcard := strings.Cut(origin, "://*.")
+		switch {
+		case origin == "*":
+			policy.anyOrigin = true
+		case wildcard:
+			policy.wildcards = append(policy.wildcards, corsWildcard{strings.ToLower(scheme + "://"), strings.ToLower("." + host)})
+		default:
+			policy.origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+		}
+	}
+
+	log.Printf("CORS enabled for origins %v", config.CORSAllowedOrigins)
+	return policy
+}
+
+// allowOrigin reports whether a browser at origin may call the API
+func (p *CORSPolicy) allowOrigin(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for _, pattern := range p.wildcards {
+		host, ok := strings.CutPrefix(origin, pattern.scheme)
+		if ok && strings.HasSuffix(host, pattern.domain) && len(host) > len(pattern.domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowMethod reports whether a cross-origin request may use method
+func (p *CORSPolicy) allowMethod(method string) bool {
+	for _, m := range p.methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleCORS adds CORS headers for allowed origins and answers preflight
+// requests itself, before authentication (browsers send preflights without
+// credentials). No-op if policy is nil.
+func handleCORS(policy *CORSPolicy, next http.Handler) http.Handler {
+	if policy == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowed := policy.allowOrigin(origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if !allowed {
+			if preflight {
+				log.Printf("Rejected CORS preflight from origin %s", sanitizeFilename(origin))
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			// Served without CORS headers, so the browser withholds the response
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if policy.anyOrigin && !policy.credentials {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if policy.credentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			header.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		if !policy.allowMethod(r.Header.Get("Access-Control-Request-Method")) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		header.Set("Access-Control-Allow-Methods", strings.Join(policy.methods, ", "))
+		header.Set("Access-Control-Allow-Headers", policy.headers)
+		if policy.maxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(policy.maxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
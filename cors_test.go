@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestCORSPolicy creates a CORS policy with the default methods and headers
+func newTestCORSPolicy(credentials bool, origins ...string) *CORSPolicy {
+	return NewCORSPolicy(&Config{
+		CORSAllowedOrigins:   origins,
+		CORSAllowedMethods:   []string{"GET", "POST"},
+		CORSAllowedHeaders:   []string{"Authorization", "Content-Type"},
+		CORSAllowCredentials: credentials,
+		CORSMaxAge:           600,
+	})
+}
+
+func TestCORSPolicyAllowOrigin(t *testing.T) {
+	policy := newTestCORSPolicy(false, "https://app.example.com", "https://*.internal.example.com")
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"HTTPS://APP.EXAMPLE.COM", true},
+		{"http://app.example.com", false},
+		{"https://ui.internal.example.com", true},
+		{"https://internal.example.com", false},
+		{"https://internal.example.com.evil.net", false},
+		{"https://evil.net", false},
+	}
+
+	for _, tt := range tests {
+		if got := policy.allowOrigin(tt.origin); got != tt.want {
+			t.Errorf("allowOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestHandleCORSDisabled(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	if NewCORSPolicy(&Config{}) != nil {
+		t.Fatal("NewCORSPolicy() without origins should be nil")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	recorder := httptest.NewRecorder()
+	handleCORS(nil, next).ServeHTTP(recorder, req)
+
+	if got := recorder.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Access-Control-Allow-Origin = %q with CORS disabled", got)
+	}
+}
+
+func TestHandleCORSPreflight(t *testing.T) {
+	// The scan handler must never see the preflight (it has no credentials)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("preflight reached the handler")
+	})
+	handler := handleCORS(newTestCORSPolicy(true, "https://app.example.com"), next)
+
+	tests := []struct {
+		name       string
+		origin     string
+		method     string
+		wantStatus int
+	}{
+		{"allowed", "https://app.example.com", "POST", http.StatusNoContent},
+		{"disallowed origin", "https://evil.net", "POST", http.StatusForbidden},
+		{"disallowed method", "https://app.example.com", "DELETE", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodOptions, "/scan", nil)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", tt.method)
+			req.Header.Set("Access-Control-Request-Headers", "authorization")
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusNoContent {
+				return
+			}
+			header := recorder.Header()
+			if header.Get("Access-Control-Allow-Origin") != tt.origin {
+				t.Errorf("Access-Control-Allow-Origin = %q", header.Get("Access-Control-Allow-Origin"))
+			}
+			if header.Get("Access-Control-Allow-Credentials") != "true" {
+				t.Error("Access-Control-Allow-Credentials not set")
+			}
+			if header.Get("Access-Control-Allow-Methods") != "GET, POST" {
+				t.Errorf("Access-Control-Allow-Methods = %q", header.Get("Access-Control-Allow-Methods"))
+			}
+			if header.Get("Access-Control-Allow-Headers") != "Authorization, Content-Type" {
+				t.Errorf("Access-Control-Allow-Headers = %q", header.Get("Access-Control-Allow-Headers"))
+			}
+			if header.Get("Access-Control-Max-Age") != "600" {
+				t.Errorf("Access-Control-Max-Age = %q", header.Get("Access-Control-Max-Age"))
+			}
+		})
+	}
+}
+
+func TestHandleCORSRequest(t *testing.T) {
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true })
+	handler := handleCORS(newTestCORSPolicy(false, "*"), next)
+
+	req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if !called {
+		t.Fatal("request not passed to the handler")
+	}
+	if got := recorder.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want *", got)
+	}
+	if got := recorder.Header().Get("Access-Control-Expose-Headers"); got != corsExposedHeaders {
+		t.Errorf("Access-Control-Expose-Headers = %q", got)
+	}
+}
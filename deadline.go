@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Header carrying the caller's end-to-end deadline in milliseconds
+const deadlineHeader = "X-Deadline-Ms"
+
+// deadlineKey is the context key for the request's X-Deadline-Ms
+type deadlineKey struct{}
+
+// requestDeadline returns the deadline the caller set with X-Deadline-Ms
+// (0 = none), or an error if it is not a positive number of milliseconds
+func requestDeadline(r *http.Request) (time.Duration, *requestError) {
+	value := r.Header.Get(deadlineHeader)
+	if value == "" {
+		return 0, nil
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, &requestError{status: http.StatusBadRequest, message: "Deadline must be a positive number of milliseconds"}
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// contextDeadline returns the X-Deadline-Ms of the request ctx belongs to
+// (0 = none)
+func contextDeadline(ctx context.Context) time.Duration {
+	deadline, _ := ctx.Value(deadlineKey{}).(time.Duration)
+	return deadline
+}
+
+// deadlinePassed reports whether ctx's deadline has passed. Unlike
+// ctx.Err(), it doesn't lag behind the connection deadlines set from it.
+func deadlinePassed(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+// expiredTimeout returns the timeout to report for a scan that ran out of
+// time under ctx: the caller's deadline if that is what expired, or else
+// timeout
+func expiredTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	if deadline := contextDeadline(ctx); deadline > 0 && deadlinePassed(ctx) {
+		return deadline
+	}
+	return timeout
+}
+
+// applyDeadline bounds the whole request by the caller's X-Deadline-Ms:
+// queueing, extraction and clamd stop once it passes, and the scan is
+// answered with a timeout.
+func applyDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, reqErr := requestDeadline(r)
+		if reqErr != nil {
+			sendRequestError(w, reqErr)
+			return
+		}
+		if deadline == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.WithValue(r.Context(), deadlineKey{}, deadline), deadline)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
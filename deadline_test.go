@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestDeadline(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"250", 250 * time.Millisecond, false},
+		{"0", 0, true},
+		{"-5", 0, true},
+		{"1.5", 0, true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+		if tt.header != "" {
+			req.Header.Set(deadlineHeader, tt.header)
+		}
+		got, reqErr := requestDeadline(req)
+		if got != tt.want || (reqErr != nil) != tt.wantErr {
+			t.Errorf("%q: got %v, %v; want %v, error %v", tt.header, got, reqErr, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestApplyDeadline(t *testing.T) {
+	var deadline time.Time
+	var hasDeadline bool
+	handler := applyDeadline(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, hasDeadline = r.Context().Deadline()
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/scan", nil))
+	if hasDeadline {
+		t.Error("deadline set without X-Deadline-Ms")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+	req.Header.Set(deadlineHeader, "500")
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if d := deadline.Sub(start); !hasDeadline || d < 400*time.Millisecond || d > 600*time.Millisecond {
+		t.Errorf("deadline in %v (set %v), want 500ms", d, hasDeadline)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/scan", nil)
+	req.Header.Set(deadlineHeader, "soon")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status = %d for an invalid deadline, want 400", recorder.Code)
+	}
+}
+
+func TestExpiredTimeout(t *testing.T) {
+	if got := expiredTimeout(context.Background(), time.Minute); got != time.Minute {
+		t.Errorf("without deadline: %v, want the scan timeout", got)
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), deadlineKey{}, time.Millisecond), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	if got := expiredTimeout(ctx, time.Minute); got != time.Millisecond {
+		t.Errorf("after the deadline: %v, want the deadline", got)
+	}
+}
+
+func TestScanHandlerDeadline(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	handler := applyDeadline(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleScan(w, r, cfg, NewScanner(cfg))
+	}))
+
+	for _, tt := range []struct {
+		name    string
+		content []byte
+	}{
+		{"clamd", []byte("SLOW")},
+		{"extraction", zipBytes(t, 0, [2]string{"a.txt", "SLOW"}, [2]string{"b.txt", "clean"})},
+	} {
+		body, contentType := multipartUpload(t, "upload.bin", tt.content)
+		req := httptest.NewRequest(http.MethodPost, "/scan", body)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set(deadlineHeader, "200")
+		recorder := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusGatewayTimeout {
+			t.Errorf("%s: status %d, want 504 after the 200ms deadline", tt.name, recorder.Code)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: took %v despite the 200ms deadline", tt.name, elapsed)
+		}
+		var resp ScanResponse
+		json.NewDecoder(recorder.Body).Decode(&resp)
+		if resp.Status != "timeout" || !strings.Contains(resp.Error, "200ms") {
+			t.Errorf("%s: response = %+v", tt.name, resp)
+		}
+	}
+}
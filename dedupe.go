@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// entryIndex tracks the content of extracted archive entries so identical
+// entries are scanned once. An entry whose content was already extracted is
+// removed again and recorded as a copy of the first one; expand maps the
+// verdict back onto the copies. A nil index extracts every entry.
+type entryIndex struct {
+	root   string
+	sums   map[string][sha256.Size]byte // Entry path (relative to root) → content hash
+	first  map[[sha256.Size]byte]string // Content hash → the entry kept on disk
+	copies map[string][]string          // Kept entry → identical entries removed
+}
+
+// newEntryIndex returns an index for entries extracted below root, or nil
+// with DEDUPE_ARCHIVE_ENTRIES off
+func newEntryIndex(config *Config, root string) *entryIndex {
+	if !config.DedupeEntries {
+		return nil
+	}
+	return &entryIndex{
+		root:   root,
+		sums:   make(map[string][sha256.Size]byte),
+		first:  make(map[[sha256.Size]byte]string),
+		copies: make(map[string][]string),
+	}
+}
+
+// entryFile is an extracted entry being written; its content is hashed on
+// the way so no second read is needed
+type entryFile struct {
+	file  *os.File
+	index *entryIndex
+	hash  hash.Hash
+}
+
+// unique returns the path the nth entry of an archive is extracted to: path,
+// or if an earlier entry already has that name, path with ".~n~" appended
+// (like the backups of tar and cp), so the earlier content isn't replaced
+// before it was scanned. A nil index checks the disk only.
+func (x *entryIndex) unique(path string, n int) string {
+	for x.taken(path) {
+		path = fmt.Sprintf("%s.~%d~", path, n)
+	}
+	return path
+}
+
+// taken reports whether an entry was extracted to path, or was removed
+// from it as a copy
+func (x *entryIndex) taken(path string) bool {
+	if _, err := os.Lstat(path); err == nil {
+		return true
+	}
+	if x == nil {
+		return false
+	}
+	_, ok := x.sums[x.rel(path)]
+	return ok
+}
+
+// create creates an entry file at path, which must be below the root
+func (x *entryIndex) create(path string) (*entryFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	entry := &entryFile{file: f, index: x}
+	if x != nil {
+		entry.hash = sha256.New()
+	}
+	return entry, nil
+}
+
+func (f *entryFile) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	if f.hash != nil {
+		f.hash.Write(p[:n])
+	}
+	return n, err
+}
+
+// Close closes the file without recording it; use finish for a complete entry
+func (f *entryFile) Close() error {
+	return f.file.Close()
+}
+
+// finish closes a completely written entry. If an identical entry was
+// extracted before, the file is removed and recorded as its copy.
+func (f *entryFile) finish() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	x := f.index
+	if x == nil {
+		return nil
+	}
+
+	var sum [sha256.Size]byte
+	f.hash.Sum(sum[:0])
+	path := f.file.Name()
+	rel := x.rel(path)
+	x.sums[rel] = sum
+	first, ok := x.first[sum]
+	if !ok {
+		x.first[sum] = rel
+		return nil
+	}
+	x.copies[first] = append(x.copies[first], rel)
+	return os.Remove(path)
+}
+
+func (x *entryIndex) rel(path string) string {
+	rel, _ := filepath.Rel(x.root, path)
+	return rel
+}
+
+// duplicates returns the number of entries that were not extracted
+func (x *entryIndex) duplicates() int {
+	if x == nil {
+		return 0
+	}
+	n := 0
+	for _, copies := range x.copies {
+		n += len(copies)
+	}
+	return n
+}
+
+// expand repeats the threats, file analyses and document indicators of each
+// kept entry for its copies, in place after the original, and lists the
+// copies as skipped
+func (x *entryIndex) expand(result *ScanResult) {
+	if x.duplicates() == 0 {
+		return
+	}
+
+	var duplicates []SkippedFile
+	for _, copies := range x.copies {
+		for _, copyPath := range copies {
+			duplicates = append(duplicates, SkippedFile{File: copyPath, Reason: skipDuplicate})
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool { return duplicates[i].File < duplicates[j].File })
+	result.Skipped = append(result.Skipped, duplicates...)
+
+	if result.Threats != nil {
+		threats := make([]Threat, 0, len(result.Threats))
+		for _, threat := range result.Threats {
+			threats = append(threats, threat)
+			for _, copyPath := range x.copies[threat.File] {
+				threat.File = copyPath
+				threats = append(threats, threat)
+			}
+		}
+		result.Threats = threats
+	}
+
+	if result.Files != nil {
+		files := make([]*FileAnalysis, 0, len(result.Files))
+		for _, file := range result.Files {
+			files = append(files, file)
+			for _, copyPath := range x.copies[file.File] {
+				duplicate := *file
+				duplicate.File = copyPath
+				files = append(files, &duplicate)
+			}
+		}
+		result.Files = files
+	}
+
+	if result.Indicators != nil {
+		indicators := make([]Indicator, 0, len(result.Indicators))
+		for _, indicator := range result.Indicators {
+			indicators = append(indicators, indicator)
+			for _, copyPath := range x.copies[indicator.File] {
+				indicator.File = copyPath
+				indicators = append(indicators, indicator)
+			}
+		}
+		result.Indicators = indicators
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestExtractZipDedupe(t *testing.T) {
+	zipPath := createTestZip(t, map[string]string{
+		"a/eicar.com": "EICAR",
+		"b/eicar.com": "EICAR",
+		"c/eicar.com": "EICAR",
+		"readme.txt":  "hello",
+	})
+	defer os.Remove(zipPath)
+
+	cfg := &Config{MaxFileCount: 10, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20, DedupeEntries: true}
+	targetDir := t.TempDir()
+	index := newEntryIndex(cfg, targetDir)
+	count, _, err := NewScanner(cfg).extractZipSafe(context.Background(), zipPath, targetDir, index)
+	if err != nil {
+		t.Fatalf("extractZipSafe() error: %v", err)
+	}
+	if files := readTree(t, targetDir); count != 4 || len(files) != 2 || index.duplicates() != 2 {
+		t.Errorf("extracted %d files, kept %v, %d duplicates; want 4, 2 kept, 2 duplicates", count, files, index.duplicates())
+	}
+}
+
+func TestScanFileDedupe(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.DedupeEntries = true
+	cfg.StaticAnalysis = analysisAll
+	zipPath := createTestZip(t, map[string]string{
+		"a/eicar.com": "EICAR",
+		"b/eicar.com": "EICAR",
+		"readme.txt":  "hello",
+		"copy.txt":    "hello",
+	})
+	defer os.Remove(zipPath)
+
+	result, err := NewScanner(cfg).ScanFile(context.Background(), zipPath)
+	if err != nil {
+		t.Fatalf("ScanFile() error: %v", err)
+	}
+	var threats []string
+	for _, threat := range result.Threats {
+		threats = append(threats, threat.File)
+	}
+	sort.Strings(threats)
+	if len(threats) != 2 || threats[0] != "a/eicar.com" || threats[1] != "b/eicar.com" {
+		t.Errorf("threats = %v, want both copies", threats)
+	}
+	if result.ScannedFiles != 4 || len(result.Files) != 4 {
+		t.Errorf("scanned %d files, analyzed %d; want 4", result.ScannedFiles, len(result.Files))
+	}
+}
+
+func TestEntryIndexDuplicateNames(t *testing.T) {
+	// A later "a" must not replace the first one, nor "b", which was
+	// dropped as its copy
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range []struct{ name, content string }{{"a", "EICAR"}, {"b", "EICAR"}, {"a", "hello"}} {
+		tw.WriteHeader(&tar.Header{Name: entry.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(entry.content))})
+		tw.Write([]byte(entry.content))
+	}
+	tw.Close()
+
+	cfg := &Config{MaxFileCount: 10, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20, DedupeEntries: true}
+	targetDir := t.TempDir()
+	index := newEntryIndex(cfg, targetDir)
+	if _, _, err := extractTar(&buf, targetDir, cfg, "archive", nil, index, nil); err != nil {
+		t.Fatalf("extractTar() error: %v", err)
+	}
+	files := readTree(t, targetDir)
+	if !reflect.DeepEqual(files, map[string]string{"a": "EICAR", "a.~3~": "hello"}) || !reflect.DeepEqual(index.copies, map[string][]string{"a": {"b"}}) {
+		t.Errorf("extracted %v with copies %v, want a, a.~3~ and b as a copy of a", files, index.copies)
+	}
+
+	// Without deduplication too
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	for _, content := range []string{"EICAR", "hello"} {
+		tw.WriteHeader(&tar.Header{Name: "dir/a", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	targetDir = t.TempDir()
+	if _, _, err := extractTar(&buf, targetDir, cfg, "archive", nil, nil, nil); err != nil {
+		t.Fatalf("extractTar() error: %v", err)
+	}
+	if files := readTree(t, targetDir); !reflect.DeepEqual(files, map[string]string{"dir/a": "EICAR", "dir/a.~2~": "hello"}) {
+		t.Errorf("extracted %v, want both entries", files)
+	}
+}
+
+func TestEntryIndexExpand(t *testing.T) {
+	index := newEntryIndex(&Config{DedupeEntries: true}, t.TempDir())
+	index.copies["a/x.exe"] = []string{"b/x.exe", "c/x.exe"}
+
+	result := &ScanResult{
+		Threats:    []Threat{{Name: "Eicar", File: "a/x.exe"}, {Name: "Other", File: "y.exe"}},
+		Indicators: []Indicator{{File: "a/x.exe", Type: "vba_macros"}},
+	}
+	index.expand(result)
+	var files []string
+	for _, threat := range result.Threats {
+		files = append(files, threat.Name+":"+threat.File)
+	}
+	want := []string{"Eicar:a/x.exe", "Eicar:b/x.exe", "Eicar:c/x.exe", "Other:y.exe"}
+	if len(files) != len(want) {
+		t.Fatalf("threats = %v, want %v", files, want)
+	}
+	for i := range want {
+		if files[i] != want[i] {
+			t.Errorf("threats = %v, want %v", files, want)
+			break
+		}
+	}
+	if len(result.Indicators) != 3 || result.Indicators[2].File != "c/x.exe" {
+		t.Errorf("indicators = %+v, want one per copy", result.Indicators)
+	}
+
+	// A nil index leaves the result as is
+	var none *entryIndex
+	none.expand(result)
+	if len(result.Threats) != 4 {
+		t.Errorf("nil index changed threats: %+v", result.Threats)
+	}
+}
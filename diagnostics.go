@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Prefix of temp files and directories created by scans
+const scanTempPrefix = "clamav-"
+
+// DiagnosticsResponse is the JSON response for GET /debug/diagnostics
+type DiagnosticsResponse struct {
+	Goroutines int              `json:"goroutines"`
+	Uptime     string           `json:"uptime"`
+	Memory     MemoryStats      `json:"memory"`
+	TempDir    TempDirUsage     `json:"temp_dir"`
+	Runtime    RuntimeInfo      `json:"runtime"`
+	GC         GarbageCollector `json:"gc"`
+}
+
+// MemoryStats is a subset of runtime.MemStats relevant to memory growth
+type MemoryStats struct {
+	HeapAllocBytes    uint64 `json:"heap_alloc_bytes"`    // Live heap objects
+	HeapInuseBytes    uint64 `json:"heap_inuse_bytes"`    // Heap spans in use
+	HeapIdleBytes     uint64 `json:"heap_idle_bytes"`     // Heap spans waiting to be reused
+	HeapReleasedBytes uint64 `json:"heap_released_bytes"` // Heap returned to the OS
+	HeapObjects       uint64 `json:"heap_objects"`
+	StackInuseBytes   uint64 `json:"stack_inuse_bytes"`
+	SysBytes          uint64 `json:"sys_bytes"` // Total memory obtained from the OS
+}
+
+// GarbageCollector summarizes GC activity
+type GarbageCollector struct {
+	NumGC        uint32  `json:"num_gc"`
+	PauseTotalMs float64 `json:"pause_total_ms"`
+	LastGC       string  `json:"last_gc,omitempty"`
+}
+
+// RuntimeInfo describes the Go runtime
+type RuntimeInfo struct {
+	GoVersion  string `json:"go_version"`
+	GOMAXPROCS int    `json:"gomaxprocs"`
+	NumCPU     int    `json:"num_cpu"`
+}
+
+// TempDirUsage reports leftover and in-flight scan temp data
+type TempDirUsage struct {
+	Path    string `json:"path"`
+	Entries int    `json:"entries"` // Scan temp files/dirs at the top level
+	Files   int    `json:"files"`   // Files including archive contents
+	Bytes   int64  `json:"bytes"`
+
+	FreeBytes int64  `json:"free_bytes,omitempty"` // Available on the filesystem (0 = unknown)
+	Error     string `json:"error,omitempty"`
+}
+
+// Process start time for uptime reporting
+var startTime = time.Now()
+
+// registerDiagnostics adds pprof and diagnostics endpoints to the mux.
+// wrap is applied to every handler (authentication and admin scope).
+func registerDiagnostics(mux *http.ServeMux, wrap func(http.Handler) http.Handler) {
+	mux.Handle("/debug/pprof/", wrap(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", wrap(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", wrap(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", wrap(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", wrap(http.HandlerFunc(pprof.Trace)))
+	mux.Handle("/debug/diagnostics", wrap(http.HandlerFunc(diagnosticsHandler)))
+}
+
+// diagnosticsHandler returns goroutine, memory and temp-dir statistics
+func diagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	response := DiagnosticsResponse{
+		Goroutines: runtime.NumGoroutine(),
+		Uptime:     time.Since(startTime).Round(time.Second).String(),
+		Memory: MemoryStats{
+			HeapAllocBytes:    mem.HeapAlloc,
+			HeapInuseBytes:    mem.HeapInuse,
+			HeapIdleBytes:     mem.HeapIdle,
+			HeapReleasedBytes: mem.HeapReleased,
+			HeapObjects:       mem.HeapObjects,
+			StackInuseBytes:   mem.StackInuse,
+			SysBytes:          mem.Sys,
+		},
+		GC: GarbageCollector{
+			NumGC:        mem.NumGC,
+			PauseTotalMs: float64(mem.PauseTotalNs) / float64(time.Millisecond),
+		},
+		Runtime: RuntimeInfo{
+			GoVersion:  runtime.Version(),
+			GOMAXPROCS: runtime.GOMAXPROCS(0),
+			NumCPU:     runtime.NumCPU(),
+		},
+		TempDir: measureTempDir(tempDir()),
+	}
+	if mem.LastGC > 0 {
+		response.GC.LastGC = time.Unix(0, int64(mem.LastGC)).UTC().Format(time.RFC3339)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// measureTempDir sums the size of scan temp files in dir.
+// Files that disappear mid-walk (finished scans) are ignored.
+func measureTempDir(dir string) TempDirUsage {
+	usage := TempDirUsage{Path: dir}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		usage.Error = err.Error()
+		return usage
+	}
+	if free, err := freeDiskSpace(dir); err == nil {
+		usage.FreeBytes = free
+	}
+
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), scanTempPrefix) {
+			continue
+		}
+		usage.Entries++
+		files, bytes := measureTempEntry(filepath.Join(dir, entry.Name()))
+		usage.Files += files
+		usage.Bytes += bytes
+	}
+
+	return usage
+}
+
+// measureTempEntry counts the files below a temp file or directory and
+// their total size
+func measureTempEntry(root string) (files int, bytes int64) {
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			files++
+			bytes += info.Size()
+		}
+		return nil
+	})
+	return files, bytes
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMeasureTempDir(t *testing.T) {
+	dir := t.TempDir()
+
+	scanDir := filepath.Join(dir, "clamav-extract-123")
+	os.MkdirAll(filepath.Join(scanDir, "sub"), 0755)
+	writeTestFile(t, filepath.Join(scanDir, "a.txt"), "12345")
+	writeTestFile(t, filepath.Join(scanDir, "sub", "b.txt"), "123")
+	writeTestFile(t, filepath.Join(dir, "clamav-scan-456"), "1234567890")
+	writeTestFile(t, filepath.Join(dir, "unrelated.txt"), "ignored")
+
+	usage := measureTempDir(dir)
+
+	if usage.Entries != 2 {
+		t.Errorf("Entries = %d, want 2", usage.Entries)
+	}
+	if usage.Files != 3 {
+		t.Errorf("Files = %d, want 3", usage.Files)
+	}
+	if usage.Bytes != 18 {
+		t.Errorf("Bytes = %d, want 18", usage.Bytes)
+	}
+}
+
+func TestMeasureTempDirMissing(t *testing.T) {
+	usage := measureTempDir("/nonexistent/temp/dir")
+	if usage.Error == "" {
+		t.Error("expected error for missing directory")
+	}
+}
+
+func TestDiagnosticsHandler(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/debug/diagnostics", nil)
+	recorder := httptest.NewRecorder()
+
+	diagnosticsHandler(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+
+	var response DiagnosticsResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if response.Goroutines == 0 {
+		t.Error("Goroutines = 0, want > 0")
+	}
+	if response.Memory.SysBytes == 0 {
+		t.Error("Memory.SysBytes = 0, want > 0")
+	}
+}
+
+func TestRegisterDiagnosticsRequiresAdmin(t *testing.T) {
+	auth := &APIKeyAuthenticator{keys: map[string]string{"key-123": "ci"}}
+	mux := http.NewServeMux()
+	registerDiagnostics(mux, func(h http.Handler) http.Handler {
+		return requireAuth(auth, requireScope(adminScope, h))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+	req.Header.Set(apiKeyHeader, "key-123")
+	recorder := httptest.NewRecorder()
+
+	mux.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,733 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+// Sector size of optical disc images
+const imageSectorSize = 2048
+
+// Largest directory of a disk image that is read (a directory takes about
+// 50 bytes per entry, so this holds hundreds of thousands)
+const maxImageDirSize = 16 << 20
+
+// UDF descriptor tags
+const (
+	udfTagAnchor         = 2
+	udfTagPartition      = 5
+	udfTagLogicalVolume  = 6
+	udfTagTerminating    = 8
+	udfTagFileSet        = 256
+	udfTagFileIdentifier = 257
+	udfTagFileEntry      = 261
+	udfTagExtendedEntry  = 266
+)
+
+// UDF file types (ECMA-167 4/14.6.6)
+const (
+	udfTypeDirectory = 4
+	udfTypeFile      = 5
+)
+
+// errUnsupportedImage is returned for disk image structures that aren't
+// read, such as UDF metadata partitions
+var errUnsupportedImage = errors.New("unsupported disk image structure")
+
+// imageFormat returns the file systems a disk image carries, from the
+// volume recognition sequence that starts at sector 16
+func imageFormat(r io.ReaderAt) (iso, udf bool) {
+	descriptor := make([]byte, 6)
+	for sector := int64(16); sector < 48; sector++ {
+		if _, err := r.ReadAt(descriptor, sector*imageSectorSize); err != nil {
+			break
+		}
+		switch string(descriptor[1:6]) {
+		case "CD001":
+			iso = true
+		case "NSR02", "NSR03":
+			udf = true
+		case "BEA01", "TEA01", "BOOT2", "CDW02":
+		default:
+			return iso, udf
+		}
+	}
+	return iso, udf
+}
+
+// looksLikeDiskImage reports whether a file is an ISO 9660 or UDF image
+func looksLikeDiskImage(filePath string) bool {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	iso, udf := imageFormat(f)
+	return iso || udf
+}
+
+// imageExtractor writes the files of a disk image to a directory, enforcing
+// the limits extractZipSafe does. Files are stored under their path in the
+// image, which threats report as their file.
+type imageExtractor struct {
+	ctx       context.Context
+	scanner   *Scanner
+	image     *os.File
+	targetDir string
+	index     *entryIndex
+	budget    *requestBudget
+	count     int
+	total     int64
+	skipped   []SkippedFile
+}
+
+// extractImage extracts the files of an ISO 9660 or UDF disk image. UDF is
+// read if present, since hybrid images such as Windows installers keep only
+// a placeholder in their ISO 9660 tree. Entries identical to an earlier one
+// are recorded in index (if set) and not kept. Returns the number of files
+// and directories, and the entries that were left out.
+func (s *Scanner) extractImage(ctx context.Context, imagePath, targetDir string, index *entryIndex) (int, []SkippedFile, error) {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	x := &imageExtractor{ctx: ctx, scanner: s, image: f, targetDir: targetDir, index: index, budget: requestBudgetFrom(ctx)}
+	switch iso, udf := imageFormat(f); {
+	case udf:
+		err = x.walkUDF()
+	case iso:
+		err = x.walkISO()
+	default:
+		err = errUnsupportedImage
+	}
+	if err != nil {
+		entries, _ := os.ReadDir(targetDir)
+		for _, entry := range entries {
+			os.RemoveAll(filepath.Join(targetDir, entry.Name()))
+		}
+		return 0, nil, err
+	}
+	return x.count, x.skipped, nil
+}
+
+// next counts an entry against MAX_FILE_COUNT, and stops once the request's
+// deadline passed or its client went away
+func (x *imageExtractor) next() error {
+	if err := x.ctx.Err(); err != nil {
+		return err
+	}
+	x.count++
+	if x.count > x.scanner.config.MaxFileCount {
+		return fmt.Errorf("disk image contains too many files (limit: %d)", x.scanner.config.MaxFileCount)
+	}
+	return nil
+}
+
+// target returns the path an entry is extracted to, or "" if it was
+// skipped for its name
+func (x *imageExtractor) target(name string) string {
+	if entryPathTooLong(name, x.scanner.config.MaxEntryPath) {
+		x.skip(truncateName(name, maxEntryNameLength), skipLongPath)
+		return ""
+	}
+	// Cleaning against the root keeps every path inside targetDir
+	targetPath := filepath.Join(x.targetDir, filepath.Clean("/"+name))
+	if !strings.HasPrefix(targetPath, filepath.Clean(x.targetDir)+string(os.PathSeparator)) {
+		x.skip(name, skipUnsafePath)
+		return ""
+	}
+	return targetPath
+}
+
+// dir creates a directory of the image
+func (x *imageExtractor) dir(name string) error {
+	if err := x.next(); err != nil {
+		return err
+	}
+	targetPath := x.target(name)
+	if targetPath == "" {
+		return nil
+	}
+	if err := x.budget.addDir(x.targetDir, targetPath); err != nil {
+		return err
+	}
+	return os.MkdirAll(targetPath, 0755)
+}
+
+// file extracts a file of size bytes read from r
+func (x *imageExtractor) file(name string, size int64, r io.Reader) error {
+	if err := x.next(); err != nil {
+		return err
+	}
+	config := x.scanner.config
+	if size < 0 || uint64(size) > config.MaxSingleFileSize {
+		x.skip(name, skipTooLarge)
+		return nil
+	}
+	x.total += size
+	if x.total > config.MaxExtractedSize {
+		return fmt.Errorf("disk image exceeds total size limit (%d bytes)", config.MaxExtractedSize)
+	}
+
+	targetPath := x.target(name)
+	if targetPath == "" {
+		return nil
+	}
+	targetPath = x.index.unique(targetPath, x.count)
+	if err := x.budget.addFile(x.targetDir, targetPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return err
+	}
+	return x.scanner.writeEntry(r, name, targetPath, x.index, x.budget)
+}
+
+// skip records an entry that is left out, counting it like the others
+func (x *imageExtractor) skip(name, reason string) {
+	x.skipped = append(x.skipped, SkippedFile{File: name, Reason: reason})
+}
+
+// read returns n bytes of the image at offset
+func (x *imageExtractor) read(offset int64, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := x.image.ReadAt(b, offset); err != nil {
+		return nil, fmt.Errorf("truncated disk image: %w", err)
+	}
+	return b, nil
+}
+
+// imageName joins a directory path and an entry name read from an image,
+// cleaned like archive entry names
+func imageName(dir, name string) string {
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	return path.Join(dir, normalizeEntryName(strings.ReplaceAll(name, "/", "_")))
+}
+
+// isoRecord is an ISO 9660 directory record
+type isoRecord struct {
+	name        string
+	extent      uint32 // First sector
+	size        uint32
+	dir         bool
+	multiExtent bool // Continued by the next record of the same name
+	interleaved bool
+	link        bool // Rock Ridge symbolic link
+}
+
+// walkISO extracts an ISO 9660 tree. Names are taken from Rock Ridge if
+// the image has it, then from the Joliet tree, and otherwise are the plain
+// ISO 9660 names without their version suffix.
+func (x *imageExtractor) walkISO() error {
+	var primary, joliet []byte
+	for sector := int64(16); sector < 48; sector++ {
+		descriptor, err := x.read(sector*imageSectorSize, imageSectorSize)
+		if err != nil {
+			return err
+		}
+		if string(descriptor[1:6]) != "CD001" || descriptor[0] == 255 {
+			break
+		}
+		switch escape := string(descriptor[88:91]); {
+		case descriptor[0] == 1 && primary == nil:
+			primary = descriptor[156:190]
+		case descriptor[0] == 2 && (escape == "%/@" || escape == "%/C" || escape == "%/E"):
+			joliet = descriptor[156:190]
+		}
+	}
+	if primary == nil {
+		return errUnsupportedImage
+	}
+
+	root, useJoliet := primary, false
+	if joliet != nil && !x.hasRockRidge(primary) {
+		root, useJoliet = joliet, true
+	}
+
+	type isoDir struct {
+		path   string
+		extent uint32
+		size   uint32
+	}
+	stack := []isoDir{{"", binary.LittleEndian.Uint32(root[2:]), binary.LittleEndian.Uint32(root[10:])}}
+	visited := make(map[uint32]bool)
+	for len(stack) > 0 {
+		d := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		// Directories pointing at each other would loop forever
+		if visited[d.extent] {
+			continue
+		}
+		visited[d.extent] = true
+		if d.size > maxImageDirSize {
+			return fmt.Errorf("disk image directory exceeds %d bytes", maxImageDirSize)
+		}
+		data, err := x.read(int64(d.extent)*imageSectorSize, int(d.size))
+		if err != nil {
+			return err
+		}
+
+		// Multi-extent files are read from the sections of all their records
+		var sections []io.Reader
+		var sectionSize int64
+		for _, record := range isoRecords(data, useJoliet) {
+			name := imageName(d.path, record.name)
+			switch {
+			case record.dir:
+				if err := x.dir(name); err != nil {
+					return err
+				}
+				stack = append(stack, isoDir{name, record.extent, record.size})
+			case record.link:
+				if err := x.next(); err != nil {
+					return err
+				}
+				x.skip(name, skipNotRegular)
+			case record.interleaved:
+				if err := x.next(); err != nil {
+					return err
+				}
+				x.skip(name, skipUnsupported)
+			default:
+				sections = append(sections, io.NewSectionReader(x.image, int64(record.extent)*imageSectorSize, int64(record.size)))
+				sectionSize += int64(record.size)
+				if record.multiExtent {
+					continue
+				}
+				if err := x.file(name, sectionSize, io.MultiReader(sections...)); err != nil {
+					return err
+				}
+			}
+			sections, sectionSize = nil, 0
+		}
+	}
+	return nil
+}
+
+// hasRockRidge reports whether the tree of a root directory record carries
+// Rock Ridge extensions: the SUSP "SP" entry in the system use area of its
+// first record
+func (x *imageExtractor) hasRockRidge(root []byte) bool {
+	first, err := x.read(int64(binary.LittleEndian.Uint32(root[2:]))*imageSectorSize, imageSectorSize)
+	if err != nil || first[0] < 34 {
+		return false
+	}
+	su := systemUse(first[:first[0]])
+	return len(su) >= 7 && string(su[:2]) == "SP" && su[4] == 0xBE && su[5] == 0xEF
+}
+
+// systemUse returns the system use area of a directory record
+func systemUse(record []byte) []byte {
+	start := 33 + int(record[32])
+	if record[32]%2 == 0 {
+		start++ // Padding after an even-length name
+	}
+	if start > len(record) {
+		return nil
+	}
+	return record[start:]
+}
+
+// isoRecords parses the records of an ISO 9660 directory, leaving out its
+// "." and ".." entries
+func isoRecords(data []byte, joliet bool) []isoRecord {
+	var records []isoRecord
+	for offset := 0; offset < len(data); {
+		n := int(data[offset])
+		if n == 0 {
+			// Records don't cross sectors; the rest of this one is padding
+			offset = (offset/imageSectorSize + 1) * imageSectorSize
+			continue
+		}
+		if n < 34 || offset+n > len(data) || 33+int(data[offset+32]) > n {
+			break
+		}
+		record := data[offset : offset+n]
+		offset += n
+		id := record[33 : 33+int(record[32])]
+		if len(id) == 1 && id[0] <= 1 {
+			continue
+		}
+
+		r := isoRecord{
+			extent:      binary.LittleEndian.Uint32(record[2:]),
+			size:        binary.LittleEndian.Uint32(record[10:]),
+			dir:         record[25]&0x02 != 0,
+			multiExtent: record[25]&0x80 != 0,
+			interleaved: record[26] != 0,
+		}
+		var ok bool
+		if r.name, r.link, ok = rockRidgeName(systemUse(record)); !ok {
+			r.name = isoName(id, joliet)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// isoName decodes an ISO 9660 or Joliet (UCS-2) file identifier, without
+// the ";1" version suffix and the dot of names without an extension
+func isoName(id []byte, joliet bool) string {
+	name := string(id)
+	if joliet {
+		units := make([]uint16, len(id)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(id[2*i:])
+		}
+		name = string(utf16.Decode(units))
+	}
+	if i := strings.LastIndexByte(name, ';'); i >= 0 {
+		name = name[:i]
+	}
+	return strings.TrimSuffix(name, ".")
+}
+
+// rockRidgeName returns the Rock Ridge name ("NM" entries) of a directory
+// record's system use area, and whether it is a symbolic link ("SL")
+func rockRidgeName(su []byte) (name string, link, ok bool) {
+	var b []byte
+	for len(su) >= 4 {
+		size := int(su[2])
+		if size < 4 || size > len(su) {
+			break
+		}
+		switch string(su[:2]) {
+		case "NM":
+			// Flags 2 and 4 stand for the current and parent directory
+			if size > 5 && su[4]&0x06 == 0 {
+				b = append(b, su[5:size]...)
+				ok = true
+			}
+		case "SL":
+			link = true
+		case "ST":
+			return string(b), link, ok
+		}
+		su = su[size:]
+	}
+	return string(b), link, ok
+}
+
+// udfAllocation is a UDF long allocation descriptor: an extent in a
+// partition
+type udfAllocation struct {
+	length    uint32
+	block     uint32
+	partition uint16
+}
+
+func parseLongAD(b []byte) udfAllocation {
+	return udfAllocation{
+		length:    binary.LittleEndian.Uint32(b),
+		block:     binary.LittleEndian.Uint32(b[4:]),
+		partition: binary.LittleEndian.Uint16(b[8:]),
+	}
+}
+
+// udfVolume locates the blocks of a UDF logical volume
+type udfVolume struct {
+	x      *imageExtractor
+	starts []int64 // Offset of each partition, by partition reference
+}
+
+// walkUDF extracts a UDF tree (ECMA-167 as profiled by UDF 1.02 to 2.01).
+// Volumes with virtual, sparable or metadata partitions (UDF 2.50 and
+// later, CD-R and DVD-RW images) are not read.
+func (x *imageExtractor) walkUDF() error {
+	anchor, err := x.udfDescriptor(256*imageSectorSize, udfTagAnchor)
+	if err != nil {
+		return err
+	}
+	sequenceLength := binary.LittleEndian.Uint32(anchor[16:])
+	sequenceStart := int64(binary.LittleEndian.Uint32(anchor[20:]))
+
+	partitions := make(map[uint16]int64)
+	var volume []byte
+	for i := int64(0); i < int64(sequenceLength/imageSectorSize) && i < 64; i++ {
+		descriptor, err := x.read((sequenceStart+i)*imageSectorSize, imageSectorSize)
+		if err != nil {
+			return err
+		}
+		tag := binary.LittleEndian.Uint16(descriptor)
+		if tag == udfTagTerminating {
+			break
+		}
+		switch tag {
+		case udfTagPartition:
+			partitions[binary.LittleEndian.Uint16(descriptor[22:])] = int64(binary.LittleEndian.Uint32(descriptor[188:])) * imageSectorSize
+		case udfTagLogicalVolume:
+			volume = descriptor
+		}
+	}
+	if volume == nil || binary.LittleEndian.Uint32(volume[212:]) != imageSectorSize {
+		return errUnsupportedImage
+	}
+
+	// Only type 1 maps, which name a physical partition, are supported
+	v := &udfVolume{x: x}
+	maps := volume[440:]
+	for i := uint32(0); i < binary.LittleEndian.Uint32(volume[268:]); i++ {
+		if len(maps) < 6 || maps[0] != 1 || maps[1] != 6 {
+			return errUnsupportedImage
+		}
+		start, ok := partitions[binary.LittleEndian.Uint16(maps[4:])]
+		if !ok {
+			return errUnsupportedImage
+		}
+		v.starts = append(v.starts, start)
+		maps = maps[6:]
+	}
+
+	fileSet, err := v.descriptor(parseLongAD(volume[248:]), udfTagFileSet)
+	if err != nil {
+		return err
+	}
+
+	type udfDir struct {
+		path string
+		icb  udfAllocation
+	}
+	stack := []udfDir{{"", parseLongAD(fileSet[400:])}}
+	visited := make(map[udfAllocation]bool)
+	for len(stack) > 0 {
+		d := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		// Directories pointing at each other would loop forever
+		if visited[d.icb] {
+			continue
+		}
+		visited[d.icb] = true
+
+		_, size, r, err := v.entry(d.icb)
+		if err != nil {
+			return err
+		}
+		if size > maxImageDirSize {
+			return fmt.Errorf("disk image directory exceeds %d bytes", maxImageDirSize)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		for _, child := range udfFileIdentifiers(data) {
+			name := imageName(d.path, child.name)
+			fileType, size, r, err := v.entry(child.icb)
+			switch {
+			case errors.Is(err, errUnsupportedImage):
+				if err := x.next(); err != nil {
+					return err
+				}
+				x.skip(name, skipUnsupported)
+			case err != nil:
+				return err
+			case fileType == udfTypeDirectory:
+				if err := x.dir(name); err != nil {
+					return err
+				}
+				stack = append(stack, udfDir{name, child.icb})
+			case fileType == udfTypeFile:
+				if err := x.file(name, size, r); err != nil {
+					return err
+				}
+			default:
+				if err := x.next(); err != nil {
+					return err
+				}
+				x.skip(name, skipNotRegular)
+			}
+		}
+	}
+	return nil
+}
+
+// udfDescriptor reads the descriptor at offset, checking its tag
+func (x *imageExtractor) udfDescriptor(offset int64, tag uint16) ([]byte, error) {
+	descriptor, err := x.read(offset, imageSectorSize)
+	if err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint16(descriptor) != tag || !udfTagValid(descriptor) {
+		return nil, fmt.Errorf("invalid UDF descriptor (want tag %d)", tag)
+	}
+	return descriptor, nil
+}
+
+// udfTagValid checks a descriptor tag's checksum, the sum of its other bytes
+func udfTagValid(descriptor []byte) bool {
+	var sum byte
+	for i, b := range descriptor[:16] {
+		if i != 4 {
+			sum += b
+		}
+	}
+	return sum == descriptor[4]
+}
+
+// offset returns the image offset of a block in a partition
+func (v *udfVolume) offset(partition uint16, block uint32) (int64, error) {
+	if int(partition) >= len(v.starts) {
+		return 0, errUnsupportedImage
+	}
+	return v.starts[partition] + int64(block)*imageSectorSize, nil
+}
+
+// descriptor reads the descriptor an allocation points at
+func (v *udfVolume) descriptor(ad udfAllocation, tag uint16) ([]byte, error) {
+	offset, err := v.offset(ad.partition, ad.block)
+	if err != nil {
+		return nil, err
+	}
+	return v.x.udfDescriptor(offset, tag)
+}
+
+// entry reads the (extended) file entry at icb, returning the file type,
+// the content size and a reader for the content
+func (v *udfVolume) entry(icb udfAllocation) (byte, int64, io.Reader, error) {
+	offset, err := v.offset(icb.partition, icb.block)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	descriptor, err := v.x.read(offset, imageSectorSize)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if !udfTagValid(descriptor) {
+		return 0, 0, nil, errors.New("invalid UDF file entry")
+	}
+	var base int
+	var eaLength, adLength uint32
+	switch binary.LittleEndian.Uint16(descriptor) {
+	case udfTagFileEntry:
+		base, eaLength, adLength = 176, binary.LittleEndian.Uint32(descriptor[168:]), binary.LittleEndian.Uint32(descriptor[172:])
+	case udfTagExtendedEntry:
+		base, eaLength, adLength = 216, binary.LittleEndian.Uint32(descriptor[208:]), binary.LittleEndian.Uint32(descriptor[212:])
+	default:
+		return 0, 0, nil, errors.New("invalid UDF file entry")
+	}
+	if uint64(base)+uint64(eaLength)+uint64(adLength) > imageSectorSize {
+		return 0, 0, nil, errors.New("invalid UDF file entry")
+	}
+	fileType := descriptor[27]
+	size := int64(binary.LittleEndian.Uint64(descriptor[56:]))
+	ads := descriptor[base+int(eaLength) : base+int(eaLength)+int(adLength)]
+
+	// Allocation descriptors: short (in the entry's partition), long, or
+	// the content itself embedded in the entry
+	var extents []io.Reader
+	switch binary.LittleEndian.Uint16(descriptor[34:]) & 0x7 {
+	case 0:
+		for ; len(ads) >= 8; ads = ads[8:] {
+			ad := udfAllocation{length: binary.LittleEndian.Uint32(ads), block: binary.LittleEndian.Uint32(ads[4:]), partition: icb.partition}
+			if extents, err = v.extent(extents, ad); err != nil {
+				return 0, 0, nil, err
+			}
+		}
+	case 1:
+		for ; len(ads) >= 16; ads = ads[16:] {
+			if extents, err = v.extent(extents, parseLongAD(ads)); err != nil {
+				return 0, 0, nil, err
+			}
+		}
+	case 3:
+		extents = append(extents, bytes.NewReader(ads))
+	default:
+		return 0, 0, nil, errUnsupportedImage
+	}
+	return fileType, size, io.LimitReader(io.MultiReader(extents...), max(size, 0)), nil
+}
+
+// extent appends the reader for an extent of a file; the top two bits of
+// its length give its type
+func (v *udfVolume) extent(extents []io.Reader, ad udfAllocation) ([]io.Reader, error) {
+	length := int64(ad.length & 0x3fffffff)
+	switch ad.length >> 30 {
+	case 0:
+		offset, err := v.offset(ad.partition, ad.block)
+		if err != nil {
+			return nil, err
+		}
+		return append(extents, io.NewSectionReader(v.x.image, offset, length)), nil
+	case 1, 2:
+		// Allocated or not, but not recorded: reads as zeros
+		return append(extents, io.LimitReader(zeroReader{}, length)), nil
+	}
+	// The next extent of allocation descriptors, for heavily fragmented files
+	return nil, errUnsupportedImage
+}
+
+// zeroReader reads zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// udfChild is an entry of a UDF directory
+type udfChild struct {
+	name string
+	icb  udfAllocation
+}
+
+// udfFileIdentifiers parses the file identifier descriptors of a UDF
+// directory, leaving out its parent and deleted entries
+func udfFileIdentifiers(data []byte) []udfChild {
+	var children []udfChild
+	for offset := 0; offset+38 <= len(data); {
+		fid := data[offset:]
+		if binary.LittleEndian.Uint16(fid) != udfTagFileIdentifier {
+			break
+		}
+		characteristics := fid[18]
+		idLength := int(fid[19])
+		iuLength := int(binary.LittleEndian.Uint16(fid[36:]))
+		end := 38 + iuLength + idLength
+		if end > len(fid) {
+			break
+		}
+		offset += (end + 3) &^ 3
+		// Bit 2: deleted, bit 3: parent directory
+		if characteristics&0x0C != 0 {
+			continue
+		}
+		children = append(children, udfChild{name: udfName(fid[38+iuLength : end]), icb: parseLongAD(fid[20:])})
+	}
+	return children
+}
+
+// udfName decodes an OSTA compressed Unicode file identifier: 8-bit
+// (Latin-1) or 16-bit (UTF-16BE) characters after a compression ID
+func udfName(id []byte) string {
+	if len(id) == 0 {
+		return ""
+	}
+	switch id[0] {
+	case 8:
+		runes := make([]rune, len(id)-1)
+		for i, b := range id[1:] {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	case 16:
+		units := make([]uint16, (len(id)-1)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(id[1+2*i:])
+		}
+		return string(utf16.Decode(units))
+	}
+	return ""
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// testImageTree returns the directories holding files (path to content),
+// sorted with the root ("") first, and the paths in each of them
+func testImageTree(files map[string]string) ([]string, map[string][]string) {
+	children := map[string][]string{"": nil}
+	var add func(p string)
+	add = func(p string) {
+		parent := path.Dir(p)
+		if parent == "." {
+			parent = ""
+		}
+		if _, ok := children[parent]; !ok {
+			children[parent] = nil
+			add(parent)
+		}
+		children[parent] = append(children[parent], p)
+	}
+	for p := range files {
+		add(p)
+	}
+	var dirs []string
+	for dir := range children {
+		sort.Strings(children[dir])
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs, children
+}
+
+// testISO returns an ISO 9660 image of files with upper-case identifiers,
+// carrying the real names as Rock Ridge NM entries if rockRidge is set.
+// Each directory takes one sector, starting at sector 18.
+func testISO(t *testing.T, files map[string]string, rockRidge bool) []byte {
+	t.Helper()
+	dirs, children := testImageTree(files)
+	sectors := make(map[string]int)
+	next := 18
+	for _, dir := range dirs {
+		sectors[dir] = next
+		next++
+	}
+	var paths []string
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		sectors[p] = next
+		next += max(1, (len(files[p])+imageSectorSize-1)/imageSectorSize)
+	}
+	image := make([]byte, next*imageSectorSize)
+
+	record := func(id []byte, extent, size int, dir bool, su []byte) []byte {
+		r := make([]byte, 33+len(id))
+		copy(r[33:], id)
+		if len(id)%2 == 0 {
+			r = append(r, 0)
+		}
+		r = append(r, su...)
+		if len(r)%2 != 0 {
+			r = append(r, 0)
+		}
+		r[0] = byte(len(r))
+		binary.LittleEndian.PutUint32(r[2:], uint32(extent))
+		binary.BigEndian.PutUint32(r[6:], uint32(extent))
+		binary.LittleEndian.PutUint32(r[10:], uint32(size))
+		binary.BigEndian.PutUint32(r[14:], uint32(size))
+		if dir {
+			r[25] = 0x02
+		}
+		r[32] = byte(len(id))
+		return r
+	}
+
+	pvd := image[16*imageSectorSize:]
+	copy(pvd, "\x01CD001\x01")
+	copy(pvd[156:], record([]byte{0}, sectors[""], imageSectorSize, true, nil))
+	copy(image[17*imageSectorSize:], "\xffCD001\x01")
+
+	for _, dir := range dirs {
+		var su []byte
+		if rockRidge && dir == "" {
+			su = []byte{'S', 'P', 7, 1, 0xBE, 0xEF, 0}
+		}
+		parent := path.Dir(dir)
+		if dir == "" || parent == "." {
+			parent = ""
+		}
+		data := record([]byte{0}, sectors[dir], imageSectorSize, true, su)
+		data = append(data, record([]byte{1}, sectors[parent], imageSectorSize, true, nil)...)
+		for _, p := range children[dir] {
+			content, isFile := files[p]
+			id := strings.ToUpper(path.Base(p))
+			size := imageSectorSize
+			if isFile {
+				id += ";1"
+				size = len(content)
+			}
+			su = nil
+			if rockRidge {
+				name := path.Base(p)
+				su = append([]byte{'N', 'M', byte(5 + len(name)), 1, 0}, name...)
+			}
+			data = append(data, record([]byte(id), sectors[p], size, !isFile, su)...)
+		}
+		copy(image[sectors[dir]*imageSectorSize:], data)
+	}
+	for _, p := range paths {
+		copy(image[sectors[p]*imageSectorSize:], files[p])
+	}
+	return image
+}
+
+// testUDF returns a UDF image of files: its anchor at sector 256, the
+// volume descriptors at 32 and one partition from sector 257 holding the
+// file set descriptor, a file entry per directory with its identifiers
+// embedded, and an extended file entry per file followed by its content.
+// The root also has a deleted entry.
+func testUDF(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	const partitionStart = 257
+	dirs, children := testImageTree(files)
+	blocks := make(map[string]int)
+	next := 1
+	for _, dir := range dirs {
+		blocks[dir] = next
+		next++
+	}
+	var paths []string
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		blocks[p] = next
+		next += 1 + (len(files[p])+imageSectorSize-1)/imageSectorSize
+	}
+	image := make([]byte, (partitionStart+next)*imageSectorSize)
+	sector := func(n int) []byte {
+		return image[n*imageSectorSize : (n+1)*imageSectorSize]
+	}
+	tag := func(d []byte, id uint16) {
+		binary.LittleEndian.PutUint16(d, id)
+		binary.LittleEndian.PutUint16(d[2:], 2)
+		var sum byte
+		for i, b := range d[:16] {
+			if i != 4 {
+				sum += b
+			}
+		}
+		d[4] = sum
+	}
+	fid := func(characteristics byte, name string, block int) []byte {
+		// 8-bit characters if the name fits Latin-1, else UTF-16
+		var id []byte
+		if strings.IndexFunc(name, func(r rune) bool { return r > 0xff }) >= 0 {
+			id = []byte{16}
+			for _, u := range utf16.Encode([]rune(name)) {
+				id = binary.BigEndian.AppendUint16(id, u)
+			}
+		} else if name != "" {
+			id = []byte{8}
+			for _, r := range name {
+				id = append(id, byte(r))
+			}
+		}
+		f := make([]byte, 38+len(id))
+		f[18] = characteristics
+		f[19] = byte(len(id))
+		binary.LittleEndian.PutUint32(f[20:], imageSectorSize)
+		binary.LittleEndian.PutUint32(f[24:], uint32(block))
+		copy(f[38:], id)
+		for len(f)%4 != 0 {
+			f = append(f, 0)
+		}
+		tag(f, udfTagFileIdentifier)
+		return f
+	}
+
+	copy(sector(16), "\x00BEA01\x01")
+	copy(sector(17), "\x00NSR02\x01")
+	copy(sector(18), "\x00TEA01\x01")
+
+	pd := sector(32)
+	binary.LittleEndian.PutUint32(pd[188:], partitionStart)
+	binary.LittleEndian.PutUint32(pd[192:], uint32(next))
+	tag(pd, udfTagPartition)
+	lvd := sector(33)
+	binary.LittleEndian.PutUint32(lvd[212:], imageSectorSize)
+	binary.LittleEndian.PutUint32(lvd[248:], imageSectorSize)
+	binary.LittleEndian.PutUint32(lvd[264:], 6)
+	binary.LittleEndian.PutUint32(lvd[268:], 1)
+	copy(lvd[440:], []byte{1, 6, 1, 0, 0, 0})
+	tag(lvd, udfTagLogicalVolume)
+	tag(sector(34), udfTagTerminating)
+
+	anchor := sector(256)
+	binary.LittleEndian.PutUint32(anchor[16:], 3*imageSectorSize)
+	binary.LittleEndian.PutUint32(anchor[20:], 32)
+	tag(anchor, udfTagAnchor)
+
+	fsd := sector(partitionStart)
+	binary.LittleEndian.PutUint32(fsd[400:], imageSectorSize)
+	binary.LittleEndian.PutUint32(fsd[404:], uint32(blocks[""]))
+	tag(fsd, udfTagFileSet)
+
+	for _, dir := range dirs {
+		parent := path.Dir(dir)
+		if dir == "" || parent == "." {
+			parent = ""
+		}
+		data := fid(0x0A, "", blocks[parent])
+		if dir == "" {
+			data = append(data, fid(0x04, "deleted.txt", blocks[""])...)
+		}
+		for _, p := range children[dir] {
+			var characteristics byte
+			if _, isFile := files[p]; !isFile {
+				characteristics = 0x02
+			}
+			data = append(data, fid(characteristics, path.Base(p), blocks[p])...)
+		}
+		fe := sector(partitionStart + blocks[dir])
+		fe[27] = udfTypeDirectory
+		binary.LittleEndian.PutUint64(fe[56:], uint64(len(data)))
+		fe[34] = 3
+		binary.LittleEndian.PutUint32(fe[172:], uint32(len(data)))
+		copy(fe[176:], data)
+		tag(fe, udfTagFileEntry)
+	}
+	for _, p := range paths {
+		efe := sector(partitionStart + blocks[p])
+		efe[27] = udfTypeFile
+		binary.LittleEndian.PutUint64(efe[56:], uint64(len(files[p])))
+		binary.LittleEndian.PutUint32(efe[212:], 8)
+		binary.LittleEndian.PutUint32(efe[216:], uint32(len(files[p])))
+		binary.LittleEndian.PutUint32(efe[220:], uint32(blocks[p]+1))
+		tag(efe, udfTagExtendedEntry)
+		copy(image[(partitionStart+blocks[p]+1)*imageSectorSize:], files[p])
+	}
+	return image
+}
+
+// testImageFiles are the files of the test images
+var testImageFiles = map[string]string{
+	"readme.txt":          "hello",
+	"empty.txt":           "",
+	"café.txt":            "latin-1",
+	"日本.txt":              "utf-16",
+	"docs/sub/report.pdf": "nested",
+	"docs/big.bin":        strings.Repeat("x", 3000),
+}
+
+func TestImageFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		image    []byte
+		iso, udf bool
+	}{
+		{"iso 9660", testISO(t, testImageFiles, false), true, false},
+		{"udf", testUDF(t, testImageFiles), false, true},
+		{"zip", []byte("PK\x03\x04" + strings.Repeat("\x00", 40000)), false, false},
+		{"short file", []byte("hello"), false, false},
+	}
+	for _, tt := range tests {
+		if iso, udf := imageFormat(bytes.NewReader(tt.image)); iso != tt.iso || udf != tt.udf {
+			t.Errorf("%s: imageFormat() = %v, %v, want %v, %v", tt.name, iso, udf, tt.iso, tt.udf)
+		}
+	}
+}
+
+func TestExtractImage(t *testing.T) {
+	tests := []struct {
+		name  string
+		image []byte
+		names func(string) string // Name of a file in the image
+	}{
+		{"iso 9660", testISO(t, testImageFiles, false), strings.ToUpper},
+		{"rock ridge", testISO(t, testImageFiles, true), func(s string) string { return s }},
+		{"udf", testUDF(t, testImageFiles), func(s string) string { return s }},
+	}
+	config := &Config{MaxFileCount: 100, MaxSingleFileSize: 2048, MaxExtractedSize: 1 << 20, MaxEntryPath: 1024}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imagePath := filepath.Join(t.TempDir(), "image.iso")
+			os.WriteFile(imagePath, tt.image, 0644)
+			targetDir := t.TempDir()
+			count, skipped, err := NewScanner(config).extractImage(context.Background(), imagePath, targetDir, nil)
+			if err != nil {
+				t.Fatalf("extractImage() error: %v", err)
+			}
+			// Six files and two directories
+			if count != 8 {
+				t.Errorf("count = %d, want 8", count)
+			}
+			want := make(map[string]string)
+			for name, content := range testImageFiles {
+				if name != "docs/big.bin" {
+					want[tt.names(name)] = content
+				}
+			}
+			if files := readTree(t, targetDir); !reflect.DeepEqual(files, want) {
+				t.Errorf("extracted %v, want %v", files, want)
+			}
+			wantSkipped := []SkippedFile{{File: tt.names("docs/big.bin"), Reason: skipTooLarge}}
+			if !reflect.DeepEqual(skipped, wantSkipped) {
+				t.Errorf("skipped = %+v, want %+v", skipped, wantSkipped)
+			}
+		})
+	}
+}
+
+func TestExtractImageLimits(t *testing.T) {
+	images := map[string][]byte{
+		"iso 9660": testISO(t, testImageFiles, true),
+		"udf":      testUDF(t, testImageFiles),
+	}
+	tests := []struct {
+		name   string
+		config *Config
+	}{
+		{"file count", &Config{MaxFileCount: 3, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20}},
+		{"total size", &Config{MaxFileCount: 100, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1000}},
+	}
+
+	for format, image := range images {
+		imagePath := filepath.Join(t.TempDir(), "image.iso")
+		os.WriteFile(imagePath, image, 0644)
+		for _, tt := range tests {
+			targetDir := t.TempDir()
+			if _, _, err := NewScanner(tt.config).extractImage(context.Background(), imagePath, targetDir, nil); err == nil {
+				t.Errorf("%s, %s: extractImage() should fail", format, tt.name)
+			}
+			if files := readTree(t, targetDir); len(files) != 0 {
+				t.Errorf("%s, %s: partial extraction left %v", format, tt.name, files)
+			}
+		}
+
+		// Paths over MAX_ENTRY_PATH_LENGTH are skipped, the rest extracted
+		config := &Config{MaxFileCount: 100, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20, MaxEntryPath: 12}
+		_, skipped, err := NewScanner(config).extractImage(context.Background(), imagePath, t.TempDir(), nil)
+		want := []SkippedFile{{File: "docs/sub/report.pdf", Reason: skipLongPath}}
+		if err != nil || !reflect.DeepEqual(skipped, want) {
+			t.Errorf("%s, long path: skipped %+v, %v, want %+v", format, skipped, err, want)
+		}
+	}
+}
+
+func TestExtractImageMalformed(t *testing.T) {
+	config := &Config{MaxFileCount: 100, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20}
+	extract := func(image []byte) (map[string]string, error) {
+		t.Helper()
+		imagePath := filepath.Join(t.TempDir(), "image.iso")
+		os.WriteFile(imagePath, image, 0644)
+		targetDir := t.TempDir()
+		_, _, err := NewScanner(config).extractImage(context.Background(), imagePath, targetDir, nil)
+		return readTree(t, targetDir), err
+	}
+
+	// A directory pointing back at the root is read once
+	image := testISO(t, map[string]string{"a.txt": "a", "loop/b.txt": "b"}, false)
+	root := image[18*imageSectorSize:]
+	record := bytes.Index(root, []byte("LOOP")) - 33
+	binary.LittleEndian.PutUint32(root[record+2:], 18)
+	if files, err := extract(image); err != nil || !reflect.DeepEqual(files, map[string]string{"A.TXT": "a"}) {
+		t.Errorf("directory loop: extracted %v, %v", files, err)
+	}
+
+	// Sparable and metadata partitions aren't read
+	image = testUDF(t, map[string]string{"a.txt": "a"})
+	image[33*imageSectorSize+440] = 2
+	if _, err := extract(image); !errors.Is(err, errUnsupportedImage) {
+		t.Errorf("unsupported partition map: error = %v, want errUnsupportedImage", err)
+	}
+
+	// A descriptor with a bad checksum
+	image = testUDF(t, map[string]string{"a.txt": "a"})
+	image[256*imageSectorSize+4]++
+	if _, err := extract(image); err == nil {
+		t.Error("corrupt anchor: extractImage() should fail")
+	}
+
+	image = testISO(t, map[string]string{"a.txt": "a"}, false)
+	if _, err := extract(image[:18*imageSectorSize+100]); err == nil {
+		t.Error("truncated image: extractImage() should fail")
+	}
+}
+
+func TestRockRidgeName(t *testing.T) {
+	tests := []struct {
+		su   string
+		name string
+		link bool
+		ok   bool
+	}{
+		{"NM\x09\x01\x00long", "long", false, true},
+		{"NM\x08\x01\x01lon" + "NM\x06\x01\x00g", "long", false, true},
+		{"NM\x05\x01\x02", "", false, false},
+		{"SL\x05\x01\x00NM\x06\x01\x00x", "x", true, true},
+		{"PX\x04\x01", "", false, false},
+	}
+	for _, tt := range tests {
+		name, link, ok := rockRidgeName([]byte(tt.su))
+		if name != tt.name || link != tt.link || ok != tt.ok {
+			t.Errorf("rockRidgeName(%q) = %q, %v, %v, want %q, %v, %v", tt.su, name, link, ok, tt.name, tt.link, tt.ok)
+		}
+	}
+}
+
+func TestScanFileDiskImage(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.ImageExtraction = true
+	dir := t.TempDir()
+
+	isoPath := filepath.Join(dir, "setup.iso")
+	os.WriteFile(isoPath, testISO(t, map[string]string{"readme.txt": "hello", "setup/payload.exe": "EICAR"}, true), 0644)
+	result, err := NewScanner(cfg).ScanFile(context.Background(), isoPath)
+	if err != nil {
+		t.Fatalf("ScanFile() error: %v", err)
+	}
+	if len(result.Threats) != 1 || result.Threats[0].File != "setup/payload.exe" {
+		t.Errorf("threats = %+v, want one in setup/payload.exe", result.Threats)
+	}
+	if result.ExtractedFiles != 2 {
+		t.Errorf("ExtractedFiles = %d, want 2", result.ExtractedFiles)
+	}
+
+	// Images that can't be read are scanned as a single file
+	udf := testUDF(t, map[string]string{"payload.exe": "EICAR"})
+	udf[33*imageSectorSize+440] = 2
+	udfPath := filepath.Join(dir, "setup.img")
+	os.WriteFile(udfPath, udf, 0644)
+	result, err = NewScanner(cfg).ScanFile(context.Background(), udfPath)
+	if err != nil || len(result.Threats) != 1 || result.Threats[0].File != "file" {
+		t.Errorf("ScanFile() of unsupported image = %+v, %v", result, err)
+	}
+
+	cfg.ImageExtraction = false
+	result, err = NewScanner(cfg).ScanFile(context.Background(), isoPath)
+	if err != nil || len(result.Threats) != 1 || result.Threats[0].File != "file" {
+		t.Errorf("ScanFile() without extraction = %+v, %v", result, err)
+	}
+}
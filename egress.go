@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// outboundTransport carries the requests to external services: webhooks,
+// registries, object storage, JWKS, enrichment lookups and trace export
+// (nil = http.DefaultTransport, which follows HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY)
+var outboundTransport http.RoundTripper
+
+// outboundProxy returns the proxy for a request to an external service
+// (nil = direct)
+var outboundProxy = http.ProxyFromEnvironment
+
+// parseOutboundProxy parses OUTBOUND_PROXY
+func parseOutboundProxy(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("must be a URL such as http://proxy:3128")
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return u, nil
+	}
+	return nil, errors.New("scheme must be http, https or socks5")
+}
+
+// configureEgress sets up the transport of requests to external services:
+// through OUTBOUND_PROXY, except for the hosts in OUTBOUND_NO_PROXY (without
+// it the environment's HTTP_PROXY, HTTPS_PROXY and NO_PROXY apply), and
+// restricted by the egress policy
+func configureEgress(config *Config) error {
+	if config.OutboundProxy != "" {
+		proxyURL, err := parseOutboundProxy(config.OutboundProxy)
+		if err != nil {
+			return err
+		}
+		noProxy := config.OutboundNoProxy
+		outboundProxy = func(req *http.Request) (*url.URL, error) {
+			if bypassProxy(req.URL.Host, noProxy) {
+				return nil, nil
+			}
+			return proxyURL, nil
+		}
+	}
+	policy, err := NewEgressPolicy(config)
+	if err != nil {
+		return err
+	}
+	egress = policy
+
+	// Proxies are recognized by the address before resolution, which is
+	// what they are configured by
+	direct := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	checked := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: policy.control}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = outboundProxy
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if policy.proxies[strings.ToLower(address)] {
+			return direct.DialContext(ctx, network, address)
+		}
+		return checked.DialContext(ctx, network, address)
+	}
+	outboundTransport = &egressTransport{policy: policy, proxy: outboundProxy, next: transport}
+	return nil
+}
+
+// bypassProxy reports whether host (with or without port) is reached
+// directly: loopback addresses, and hosts matching a NO_PROXY-style entry,
+// which is * (all hosts), a domain (example.com or .example.com, which
+// include subdomains), an IP address or a CIDR range
+func bypassProxy(host string, noProxy []string) bool {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+	ip := net.ParseIP(host)
+	if host == "localhost" || ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "*" {
+			return true
+		}
+		if ip != nil {
+			if network, err := parseNetwork(entry); err == nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		domain := strings.TrimPrefix(entry, ".")
+		if domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// outboundProxyFor returns the proxy for connections to host that don't
+// go through net/http, such as curl's SFTP and FTPS transfers (nil = direct)
+func outboundProxyFor(host string) *url.URL {
+	proxyURL, err := outboundProxy(&http.Request{URL: &url.URL{Scheme: "https", Host: host}})
+	if err != nil {
+		return nil
+	}
+	return proxyURL
+}
+
+// newOutboundClient returns an HTTP client for an external service
+func newOutboundClient(timeout time.Duration) *http.Client {
+	client := &http.Client{Transport: outboundTransport, Timeout: timeout}
+	if egress != nil {
+		client.CheckRedirect = egress.checkRedirect
+	}
+	return client
+}
+
+// errEgressDenied is wrapped by the errors of outbound requests the egress
+// policy doesn't allow
+var errEgressDenied = errors.New("destination not allowed by egress policy")
+
+// EgressPolicy restricts where outbound requests may go. Schemes and hosts
+// are checked for every request, redirects included; addresses when the
+// connection is made, so a hostname that resolves to an allowed address
+// when checked and to a denied one when dialled (DNS rebinding) is still
+// refused. Hosts reached through a proxy are resolved and checked before
+// the request is sent to it.
+type EgressPolicy struct {
+	schemes      []string // Empty = any
+	hosts        []string // Empty = any
+	denied       []*net.IPNet
+	allowed      []*net.IPNet // Exceptions to denied
+	maxRedirects int
+	proxies      map[string]bool // Proxy host:ports (lowercase), which are always dialled
+}
+
+// Global egress policy (nil = unrestricted)
+var egress *EgressPolicy
+
+// NewEgressPolicy creates the egress policy described by the (validated)
+// config
+func NewEgressPolicy(config *Config) (*EgressPolicy, error) {
+	p := &EgressPolicy{maxRedirects: config.EgressRedirects, proxies: make(map[string]bool)}
+	for _, scheme := range config.EgressSchemes {
+		p.schemes = append(p.schemes, strings.ToLower(scheme))
+	}
+	for _, host := range config.EgressHosts {
+		p.hosts = append(p.hosts, strings.ToLower(strings.TrimSuffix(host, ".")))
+	}
+	for _, cidr := range config.EgressDeniedCIDRs {
+		network, err := parseNetwork(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid denied CIDR %q: %w", cidr, err)
+		}
+		p.denied = append(p.denied, network)
+	}
+	for _, cidr := range config.EgressCIDRs {
+		network, err := parseNetwork(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed CIDR %q: %w", cidr, err)
+		}
+		p.allowed = append(p.allowed, network)
+	}
+
+	proxies := []string{config.OutboundProxy}
+	if config.OutboundProxy == "" {
+		proxies = []string{os.Getenv("HTTP_PROXY"), os.Getenv("http_proxy"), os.Getenv("HTTPS_PROXY"), os.Getenv("https_proxy")}
+	}
+	for _, raw := range proxies {
+		if proxyURL, err := url.Parse(raw); err == nil && proxyURL.Host != "" {
+			p.proxies[strings.ToLower(proxyAddress(proxyURL))] = true
+		}
+	}
+	return p, nil
+}
+
+// proxyAddress returns the host:port a proxy URL connects to
+func proxyAddress(proxyURL *url.URL) string {
+	port := proxyURL.Port()
+	if port == "" {
+		switch proxyURL.Scheme {
+		case "https":
+			port = "443"
+		case "socks5":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+// CheckURL reports whether the URL's scheme and host may be requested. A
+// host that is an IP address is checked like a dialled one.
+func (p *EgressPolicy) CheckURL(u *url.URL) error {
+	if p == nil {
+		return nil
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if len(p.schemes) > 0 && !containsString(p.schemes, scheme) {
+		return fmt.Errorf("%w: scheme %s", errEgressDenied, scheme)
+	}
+	if !p.hostAllowed(u.Hostname()) {
+		return fmt.Errorf("%w: host %s", errEgressDenied, u.Hostname())
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		return p.CheckIP(ip)
+	}
+	return nil
+}
+
+// CheckHost resolves host and reports whether connections to all of its
+// addresses may be made. It is for hosts reached through a proxy, which
+// resolves them itself; names that don't resolve here are refused.
+func (p *EgressPolicy) CheckHost(ctx context.Context, host string) error {
+	if p == nil || len(p.denied) == 0 {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.CheckIP(ip)
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("%w: cannot resolve %s: %v", errEgressDenied, host, err)
+	}
+	for _, ip := range ips {
+		if err := p.CheckIP(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hostAllowed reports whether host matches EGRESS_ALLOWED_HOSTS: * (all
+// hosts), the host itself, or *.example.com for its subdomains
+func (p *EgressPolicy) hostAllowed(host string) bool {
+	if len(p.hosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range p.hosts {
+		if allowed == "*" || allowed == host {
+			return true
+		}
+		if domain, ok := strings.CutPrefix(allowed, "*."); ok && strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckIP reports whether a connection to ip may be made
+func (p *EgressPolicy) CheckIP(ip net.IP) error {
+	if p == nil {
+		return nil
+	}
+	for _, network := range p.allowed {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	for _, network := range p.denied {
+		if network.Contains(ip) {
+			return fmt.Errorf("%w: address %s", errEgressDenied, ip)
+		}
+	}
+	return nil
+}
+
+// control checks the address a connection is about to be made to, after
+// name resolution
+func (p *EgressPolicy) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: unresolved address %s", errEgressDenied, address)
+	}
+	return p.CheckIP(ip)
+}
+
+// ResolveHost resolves host for a connection made outside net/http and
+// returns the first address the policy allows, so the connection can be
+// pinned to the checked address
+func (p *EgressPolicy) ResolveHost(ctx context.Context, host string) (net.IP, error) {
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	var denied error
+	for _, ip := range ips {
+		if denied = p.CheckIP(ip); denied == nil {
+			return ip, nil
+		}
+	}
+	return nil, denied
+}
+
+// egressTransport applies the egress policy to each request it carries,
+// including those of followed redirects
+type egressTransport struct {
+	policy *EgressPolicy
+	proxy  func(*http.Request) (*url.URL, error)
+	next   http.RoundTripper
+}
+
+func (t *egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	err := t.policy.CheckURL(req.URL)
+	if err == nil {
+		if proxyURL, _ := t.proxy(req); proxyURL != nil {
+			err = t.policy.CheckHost(req.Context(), req.URL.Hostname())
+		}
+	}
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// checkRedirect stops following redirects after EGRESS_MAX_REDIRECTS
+func (p *EgressPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > p.maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", p.maxRedirects)
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Email extraction limits
+const (
+	emailMaxDepth  = 10       // Nested multiparts and attached messages
+	emailSniffSize = 64 << 10 // Header bytes read to recognize a message
+)
+
+// emailRawName is the name the original message is scanned under, next to
+// its extracted parts, so ClamAV's own mail parser sees it too
+const emailRawName = "message.eml"
+
+// Headers of which a message must have From and one other to be treated as email
+var emailHeaders = []string{"Date", "Message-Id", "Mime-Version", "Received", "Subject", "To"}
+
+// looksLikeEmail reports whether the file starts with an RFC 5322 header
+// block carrying From and at least one other typical message header
+func looksLikeEmail(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	reader := textproto.NewReader(bufio.NewReader(io.LimitReader(f, emailSniffSize)))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil || header.Get("From") == "" {
+		return false
+	}
+	for _, name := range emailHeaders {
+		if header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// extractMessage extracts an uploaded .eml or Outlook .msg file into
+// targetDir, counting the parts against budget (if set). Anything partially
+// written is removed when extraction fails, so the upload can be scanned as
+// a single file instead.
+func (s *Scanner) extractMessage(filePath, targetDir string, budget *requestBudget) (int, error) {
+	var count int
+	var err error
+	if looksLikeEmail(filePath) {
+		count, err = s.extractEmail(filePath, targetDir, budget)
+	} else {
+		count, err = s.extractOutlookMessage(filePath, targetDir, budget)
+	}
+	if err != nil {
+		entries, _ := os.ReadDir(targetDir)
+		for _, entry := range entries {
+			os.RemoveAll(filepath.Join(targetDir, entry.Name()))
+		}
+		return 0, err
+	}
+	return count, nil
+}
+
+// emailExtractor writes the parts of a message to a directory, enforcing
+// the extraction limits. Parts are stored under their MIME part path, e.g.
+// "2/invoice.pdf" or "3.1/body.html", which threats report as their file.
+type emailExtractor struct {
+	config    *Config
+	targetDir string
+	budget    *requestBudget
+	count     int
+	total     int64
+}
+
+// extractEmail extracts the text bodies and attachments of an RFC 822
+// message (.eml), including attached messages, and keeps a copy of the raw
+// message. Returns the number of files written.
+func (s *Scanner) extractEmail(emailPath, targetDir string, budget *requestBudget) (int, error) {
+	f, err := os.Open(emailPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	msg, err := mail.ReadMessage(bufio.NewReader(f))
+	if err != nil {
+		return 0, fmt.Errorf("invalid message: %w", err)
+	}
+
+	x := &emailExtractor{config: s.config, targetDir: targetDir, budget: budget}
+	if err := x.walk(textproto.MIMEHeader(msg.Header), msg.Body, "", 0); err != nil {
+		return 0, err
+	}
+	if err := x.copyRaw(emailPath); err != nil {
+		return 0, err
+	}
+	return x.count, nil
+}
+
+// walk extracts one MIME entity: recursing into multiparts and attached
+// messages, and writing leaf parts decoded
+func (x *emailExtractor) walk(header textproto.MIMEHeader, body io.Reader, partPath string, depth int) error {
+	if depth > emailMaxDepth {
+		return fmt.Errorf("message nesting exceeds %d levels", emailMaxDepth)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		reader := multipart.NewReader(body, params["boundary"])
+		for i := 1; ; i++ {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				// Truncated multiparts are common in mail; keep what was read
+				return nil
+			}
+			err = x.walk(part.Header, part, joinPartPath(partPath, i), depth+1)
+			part.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if partPath == "" {
+		partPath = "1"
+	}
+	decoded := decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body)
+
+	if mediaType == "message/rfc822" {
+		msg, err := mail.ReadMessage(bufio.NewReader(decoded))
+		if err == nil {
+			return x.walk(textproto.MIMEHeader(msg.Header), msg.Body, partPath, depth+1)
+		}
+	}
+	return x.write(filepath.Join(partPath, emailPartName(header, mediaType, params)), decoded)
+}
+
+// joinPartPath numbers a multipart child like IMAP: 1, 2, 2.1, ...
+func joinPartPath(parent string, i int) string {
+	if parent == "" {
+		return strconv.Itoa(i)
+	}
+	return parent + "." + strconv.Itoa(i)
+}
+
+// decodeTransferEncoding undoes base64 or quoted-printable encoding
+func decodeTransferEncoding(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		// The decoder skips line breaks; stray whitespace is removed first
+		return base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// base64Cleaner drops characters that are not part of base64 data, as mail
+// clients do
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	for {
+		n, err := c.r.Read(p)
+		kept := 0
+		for _, b := range p[:n] {
+			if b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '+' || b == '/' || b == '=' {
+				p[kept] = b
+				kept++
+			}
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+// emailPartName returns the file name a part is extracted under: its
+// attachment name, or body.txt/body.html/part for unnamed parts
+func emailPartName(header textproto.MIMEHeader, mediaType string, params map[string]string) string {
+	name := params["name"]
+	if _, dispParams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && dispParams["filename"] != "" {
+		name = dispParams["filename"]
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+		name = decoded
+	}
+
+	name = shortenElement(cleanName(strings.NewReplacer("/", "_", "\\", "_", "\x00", "").Replace(name), '_'))
+	if name != "" && name != "." && name != ".." {
+		return name
+	}
+	switch mediaType {
+	case "text/plain":
+		return "body.txt"
+	case "text/html":
+		return "body.html"
+	}
+	return "part"
+}
+
+// write stores a part, enforcing the file count and size limits
+func (x *emailExtractor) write(name string, r io.Reader) error {
+	x.count++
+	if x.count > x.config.MaxFileCount {
+		return fmt.Errorf("message contains too many parts (limit: %d)", x.config.MaxFileCount)
+	}
+
+	targetPath := filepath.Join(x.targetDir, name)
+	if !strings.HasPrefix(targetPath, filepath.Clean(x.targetDir)+string(os.PathSeparator)) {
+		return fmt.Errorf("invalid part name %q", name)
+	}
+	if err := x.budget.addFile(x.targetDir, targetPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return err
+	}
+	dst, err := os.Create(targetPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	limit := min(int64(x.config.MaxSingleFileSize), x.config.MaxExtractedSize-x.total)
+	written, err := io.Copy(dst, x.budget.reader(io.LimitReader(r, limit+1)))
+	x.total += written
+	if written > int64(x.config.MaxSingleFileSize) {
+		return fmt.Errorf("part %s exceeds size limit (%d bytes)", name, x.config.MaxSingleFileSize)
+	}
+	if x.total > x.config.MaxExtractedSize {
+		return fmt.Errorf("message exceeds total size limit (%d bytes)", x.config.MaxExtractedSize)
+	}
+	if errors.As(err, new(*bombError)) {
+		return err // The request's budget is spent
+	}
+	// Undecodable content is kept as far as it decoded
+	return nil
+}
+
+// copyRaw adds the original message to the scan
+func (x *emailExtractor) copyRaw(emailPath string) error {
+	f, err := os.Open(emailPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return x.write(emailRawName, f)
+}
+
+// dropRawMessageThreats removes detections in the raw message copy whose
+// signature was also found in an extracted part, so an infected attachment
+// is reported once, by its part path
+func dropRawMessageThreats(threats []Threat) []Threat {
+	found := make(map[string]bool)
+	for _, threat := range threats {
+		if threat.File != emailRawName {
+			found[threat.Name] = true
+		}
+	}
+	kept := threats[:0]
+	for _, threat := range threats {
+		if threat.File != emailRawName || !found[threat.Name] {
+			kept = append(kept, threat)
+		}
+	}
+	return kept
+}
+
+// Outlook .msg property streams (MS-OXMSG)
+const (
+	msgAttachPrefix   = "__attach_version1.0_#"
+	msgBodyStream     = "__substg1.0_1000001F" // Plain text body, UTF-16
+	msgHTMLStream     = "__substg1.0_10130102" // HTML body, bytes
+	msgAttachData     = "__substg1.0_37010102"
+	msgAttachLongName = "__substg1.0_3707001F"
+	msgAttachName     = "__substg1.0_3704001F"
+)
+
+// isOutlookMessage reports whether a compound file is an Outlook message
+func isOutlookMessage(cfb *cfbFile) bool {
+	return cfb.Find("__properties_version1.0") != nil && cfb.Find("__nameid_version1.0") != nil
+}
+
+// extractOutlookMessage extracts the bodies and attachments of an Outlook
+// .msg file as body.txt, body.html and attachments/<n>/<name>, and keeps a
+// copy of the raw message. Returns the number of files written.
+func (s *Scanner) extractOutlookMessage(msgPath, targetDir string, budget *requestBudget) (int, error) {
+	f, err := os.Open(msgPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	cfb, err := openCFB(f, info.Size())
+	if err != nil {
+		return 0, err
+	}
+	if !isOutlookMessage(cfb) {
+		return 0, fmt.Errorf("not an Outlook message")
+	}
+
+	x := &emailExtractor{config: s.config, targetDir: targetDir, budget: budget}
+	read := func(path string) ([]byte, error) {
+		entry := cfb.Find(path)
+		if entry == nil {
+			return nil, nil
+		}
+		return cfb.ReadStream(entry, s.config.MaxSingleFileSize)
+	}
+
+	if body, err := read(msgBodyStream); err != nil {
+		return 0, err
+	} else if body != nil {
+		if err := x.write("body.txt", strings.NewReader(decodeUTF16(body))); err != nil {
+			return 0, err
+		}
+	}
+	if html, err := read(msgHTMLStream); err != nil {
+		return 0, err
+	} else if html != nil {
+		if err := x.write("body.html", bytes.NewReader(html)); err != nil {
+			return 0, err
+		}
+	}
+
+	n := 0
+	for _, entry := range cfb.Entries() {
+		if entry.Type != cfbTypeStorage || !strings.HasPrefix(entry.Path, msgAttachPrefix) {
+			continue
+		}
+		data, err := read(entry.Path + "/" + msgAttachData)
+		if err != nil {
+			return 0, err
+		}
+		if data == nil {
+			continue // Embedded messages and OLE objects are stored differently
+		}
+
+		var name string
+		for _, stream := range []string{msgAttachLongName, msgAttachName} {
+			if raw, err := read(entry.Path + "/" + stream); err == nil && raw != nil {
+				name = decodeUTF16(raw)
+				break
+			}
+		}
+		name = emailPartName(textproto.MIMEHeader{}, "", map[string]string{"name": name})
+
+		n++
+		if err := x.write(filepath.Join("attachments", strconv.Itoa(n), name), bytes.NewReader(data)); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := x.copyRaw(msgPath); err != nil {
+		return 0, err
+	}
+	return x.count, nil
+}
+
+// decodeUTF16 decodes little-endian UTF-16 without a trailing NUL
+func decodeUTF16(b []byte) string {
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		units = append(units, uint16(b[i])|uint16(b[i+1])<<8)
+	}
+	return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+}
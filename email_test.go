@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"mime"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// testEmail is a message with a plain and an HTML body, a base64 and a
+// quoted-printable attachment, and an attached message with its own
+// attachment
+var testEmail = "From: sender@example.com\r\n" +
+	"To: recipient@example.com\r\n" +
+	"Subject: Invoice\r\n" +
+	"Date: Mon, 2 Jan 2006 15:04:05 +0000\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Please find the invoice attached.\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>Please find the invoice attached.</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream; name=\"ignored.bin\"\r\n" +
+	"Content-Disposition: attachment; filename=\"invoice.exe\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	base64.StdEncoding.EncodeToString([]byte("MZ payload EICAR"))[:12] + "\r\n" +
+	base64.StdEncoding.EncodeToString([]byte("MZ payload EICAR"))[12:] + "\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain; name=\"=?UTF-8?Q?r=C3=A9sum=C3=A9.txt?=\"\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"caf=C3=A9 =\r\n" +
+	"au lait\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"From: other@example.com\r\n" +
+	"Subject: Fwd\r\n" +
+	"Content-Type: multipart/mixed; boundary=nested\r\n" +
+	"\r\n" +
+	"--nested\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"forwarded\r\n" +
+	"--nested\r\n" +
+	"Content-Type: application/pdf; name=\"../../evil.pdf\"\r\n" +
+	"\r\n" +
+	"%PDF-1.7\r\n" +
+	"--nested--\r\n" +
+	"--outer--\r\n"
+
+// readTree returns the files below dir by relative path
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			data, _ := os.ReadFile(path)
+			rel, _ := filepath.Rel(dir, path)
+			files[filepath.ToSlash(rel)] = string(data)
+		}
+		return nil
+	})
+	return files
+}
+
+func TestLooksLikeEmail(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		want    bool
+	}{
+		{"message", testEmail, true},
+		{"minimal", "From: a@example.com\nSubject: hi\n\nbody", true},
+		{"from only", "From: a@example.com\n\nbody", false},
+		{"no from", "Subject: hi\nDate: today\n\nbody", false},
+		{"binary", "MZ\x90\x00\x03", false},
+		{"text", "hello world", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			writeTestFile(t, path, tt.content)
+			if got := looksLikeEmail(path); got != tt.want {
+				t.Errorf("looksLikeEmail() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractEmail(t *testing.T) {
+	dir := t.TempDir()
+	emailPath := filepath.Join(dir, "upload")
+	writeTestFile(t, emailPath, testEmail)
+	targetDir := filepath.Join(dir, "out")
+	os.Mkdir(targetDir, 0755)
+
+	s := NewScanner(&Config{MaxFileCount: 100, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20})
+	count, err := s.extractEmail(emailPath, targetDir, nil)
+	if err != nil {
+		t.Fatalf("extractEmail() error: %v", err)
+	}
+
+	want := map[string]string{
+		"1.1/body.txt":       "Please find the invoice attached.",
+		"1.2/body.html":      "<p>Please find the invoice attached.</p>",
+		"2/invoice.exe":      "MZ payload EICAR",
+		"3/résumé.txt":       "café au lait",
+		"4.1/body.txt":       "forwarded",
+		"4.2/.._.._evil.pdf": "%PDF-1.7",
+		emailRawName:         testEmail,
+	}
+	files := readTree(t, targetDir)
+	if count != len(want) || len(files) != len(want) {
+		var names []string
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		t.Fatalf("extracted %d files %v, want %d", count, names, len(want))
+	}
+	for name, content := range want {
+		if got, ok := files[name]; !ok || got != content {
+			t.Errorf("%s = %q (exists: %v), want %q", name, got, ok, content)
+		}
+	}
+}
+
+func TestEmailPartName(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"invoice.pdf", "invoice.pdf"},
+		{"../../evil.pdf", ".._.._evil.pdf"},
+		{"a\r\nX-Injected: 1.txt", "a__X-Injected: 1.txt"},
+		{"invoice\u202efdp.exe", "invoice_fdp.exe"},
+		{"=?utf-8?q?r=C3=A9sum=C3=A9.txt?=", "résumé.txt"},
+		{"", "body.txt"},
+	}
+	for _, tt := range tests {
+		header := textproto.MIMEHeader{"Content-Disposition": {mime.FormatMediaType("attachment", map[string]string{"filename": tt.filename})}}
+		if tt.filename == "" {
+			header = textproto.MIMEHeader{}
+		}
+		if got := emailPartName(header, "text/plain", nil); got != tt.want {
+			t.Errorf("emailPartName(%q) = %q, want %q", tt.filename, got, tt.want)
+		}
+	}
+
+	long := emailPartName(textproto.MIMEHeader{}, "", map[string]string{"name": strings.Repeat("x", 400) + ".exe"})
+	if len(long) != maxEntryNameLength || !strings.HasSuffix(long, ".exe") {
+		t.Errorf("long name = %q (%d bytes), want %d bytes ending in .exe", long, len(long), maxEntryNameLength)
+	}
+}
+
+func TestExtractEmailLimits(t *testing.T) {
+	dir := t.TempDir()
+	emailPath := filepath.Join(dir, "upload")
+	writeTestFile(t, emailPath, testEmail)
+
+	tests := []struct {
+		name   string
+		config *Config
+	}{
+		{"file count", &Config{MaxFileCount: 3, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20}},
+		{"single file", &Config{MaxFileCount: 100, MaxSingleFileSize: 20, MaxExtractedSize: 1 << 20}},
+		{"total size", &Config{MaxFileCount: 100, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 100}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targetDir := t.TempDir()
+			if _, err := NewScanner(tt.config).extractMessage(emailPath, targetDir, nil); err == nil {
+				t.Fatal("extractMessage() should fail")
+			}
+			if files := readTree(t, targetDir); len(files) != 0 {
+				t.Errorf("partial extraction left %v", files)
+			}
+		})
+	}
+}
+
+func TestExtractEmailNesting(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("From: a@example.com\r\nSubject: deep\r\n")
+	for i := 0; i <= emailMaxDepth; i++ {
+		b.WriteString("Content-Type: multipart/mixed; boundary=b" + string(rune('a'+i)) + "\r\n\r\n--b" + string(rune('a'+i)) + "\r\n")
+	}
+	b.WriteString("\r\nbottom\r\n")
+
+	dir := t.TempDir()
+	emailPath := filepath.Join(dir, "upload")
+	writeTestFile(t, emailPath, b.String())
+
+	s := NewScanner(&Config{MaxFileCount: 100, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20})
+	if _, err := s.extractEmail(emailPath, t.TempDir(), nil); err == nil || !strings.Contains(err.Error(), "nesting") {
+		t.Errorf("extractEmail() error = %v, want nesting error", err)
+	}
+}
+
+// utf16Stream encodes a .msg string property
+func utf16Stream(s string) []byte {
+	var b []byte
+	for _, unit := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(unit), byte(unit>>8))
+	}
+	return append(b, 0, 0)
+}
+
+func TestExtractOutlookMessage(t *testing.T) {
+	dir := t.TempDir()
+	msgPath := filepath.Join(dir, "upload")
+	attachment := strings.Repeat("MZ large attachment ", 300) // Regular sectors
+	msg := buildCFB(t, map[string][]byte{
+		"__properties_version1.0":                         make([]byte, 32),
+		"__nameid_version1.0/__substg1.0_00020102":        make([]byte, 16),
+		msgBodyStream:                                     utf16Stream("Hello from Outlook"),
+		msgHTMLStream:                                     []byte("<p>Hello</p>"),
+		msgAttachPrefix + "00000000/" + msgAttachData:     []byte("EICAR"),
+		msgAttachPrefix + "00000000/" + msgAttachLongName: utf16Stream("report.docm"),
+		msgAttachPrefix + "00000001/" + msgAttachData:     []byte(attachment),
+		msgAttachPrefix + "00000001/" + msgAttachName:     utf16Stream("SETUP~1.EXE"),
+	})
+	os.WriteFile(msgPath, msg, 0644)
+
+	if looksLikeEmail(msgPath) {
+		t.Error("looksLikeEmail() should not match a .msg file")
+	}
+
+	targetDir := t.TempDir()
+	s := NewScanner(&Config{MaxFileCount: 100, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20})
+	count, err := s.extractMessage(msgPath, targetDir, nil)
+	if err != nil {
+		t.Fatalf("extractMessage() error: %v", err)
+	}
+
+	want := map[string]string{
+		"body.txt":                  "Hello from Outlook",
+		"body.html":                 "<p>Hello</p>",
+		"attachments/1/report.docm": "EICAR",
+		"attachments/2/SETUP~1.EXE": attachment,
+		emailRawName:                string(msg),
+	}
+	files := readTree(t, targetDir)
+	if count != len(want) || len(files) != len(want) {
+		t.Fatalf("extracted %d files, want %d", count, len(want))
+	}
+	for name, content := range want {
+		if got := files[name]; got != content {
+			t.Errorf("%s = %d bytes, want %d", name, len(got), len(content))
+		}
+	}
+
+	// A compound file that is not a message, e.g. a Word document
+	docPath := filepath.Join(dir, "doc")
+	os.WriteFile(docPath, buildCFB(t, map[string][]byte{"WordDocument": []byte("text")}), 0644)
+	if _, err := s.extractMessage(docPath, t.TempDir(), nil); err == nil {
+		t.Error("extractMessage() should fail for a non-message compound file")
+	}
+}
+
+func TestDropRawMessageThreats(t *testing.T) {
+	threats := []Threat{
+		{Name: "Eicar", File: "2/invoice.exe"},
+		{Name: "Eicar", File: emailRawName},
+		{Name: "Heuristics.Phishing", File: emailRawName},
+	}
+	got := dropRawMessageThreats(threats)
+	if len(got) != 2 || got[0].File != "2/invoice.exe" || got[1].Name != "Heuristics.Phishing" {
+		t.Errorf("dropRawMessageThreats() = %+v", got)
+	}
+}
+
+func TestScanFileEmail(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.EmailExtraction = true
+
+	// A plain-text attachment shows up in the raw message too, and is only
+	// reported once
+	email := "From: a@example.com\r\nSubject: hi\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nhello\r\n" +
+		"--b\r\nContent-Disposition: attachment; filename=eicar.com\r\n\r\nEICAR\r\n--b--\r\n"
+	path := filepath.Join(t.TempDir(), "upload")
+	writeTestFile(t, path, email)
+
+	result, err := NewScanner(cfg).ScanFile(context.Background(), path)
+	if err != nil {
+		t.Fatalf("ScanFile() error: %v", err)
+	}
+	if len(result.Threats) != 1 || result.Threats[0].File != "2/eicar.com" {
+		t.Errorf("threats = %+v, want one in 2/eicar.com", result.Threats)
+	}
+	if result.ScannedFiles != 3 {
+		t.Errorf("ScannedFiles = %d, want 3", result.ScannedFiles)
+	}
+
+	cfg.EmailExtraction = false
+	result, err = NewScanner(cfg).ScanFile(context.Background(), path)
+	if err != nil || len(result.Threats) != 1 || result.Threats[0].File != "file" {
+		t.Errorf("ScanFile() without extraction = %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Content-Encoding values accepted on upload bodies
+const supportedContentEncodings = "gzip, deflate, zstd"
+
+// decodeBody replaces a compressed request body with its decompressed
+// content, which is capped at limit bytes so a small compressed upload can't
+// expand without bound. Encodings are undone in reverse order of application.
+func decodeBody(w http.ResponseWriter, r *http.Request, limit int64) *requestError {
+	header := r.Header.Get("Content-Encoding")
+	if header == "" {
+		return nil
+	}
+
+	encodings := strings.Split(header, ",")
+	body := r.Body
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		var err error
+		switch encoding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			body, err = gzip.NewReader(body)
+		case "deflate":
+			body, err = zlib.NewReader(body)
+		case "zstd":
+			body, err = newZstdReader(body)
+		default:
+			log.Printf("Rejected upload: unsupported Content-Encoding %q", encoding)
+			return &requestError{status: http.StatusUnsupportedMediaType,
+				message: fmt.Sprintf("Unsupported Content-Encoding %q (supported: %s)", sanitizeFilename(encoding), supportedContentEncodings)}
+		}
+		if err != nil {
+			log.Printf("Invalid %s request body: %v", encoding, err)
+			return &requestError{status: http.StatusBadRequest, message: "Invalid compressed request body"}
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, io.NopCloser(body), limit)
+	r.ContentLength = -1
+	r.Header.Del("Content-Encoding")
+	return nil
+}
+
+// isCorruptCompression reports whether err comes from a corrupt compressed body
+func isCorruptCompression(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) ||
+		errors.Is(err, zlib.ErrChecksum) || errors.As(err, &corrupt) || errors.Is(err, errZstdCorrupt)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// gzipBytes compresses data with gzip
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzip error: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeBody(t *testing.T) {
+	content := []byte("plain text artifact")
+	body, contentType := multipartUpload(t, "notes.txt", content)
+
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	zw.Write(body.Bytes())
+	zw.Close()
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{"gzip", "gzip", gzipBytes(t, body.Bytes())},
+		{"x-gzip", "x-gzip", gzipBytes(t, body.Bytes())},
+		{"deflate", "deflate", deflated.Bytes()},
+		{"zstd", "zstd", zstdRawFrame(body.Bytes())},
+		{"identity", "identity", body.Bytes()},
+		{"stacked", "gzip, gzip", gzipBytes(t, gzipBytes(t, body.Bytes()))},
+		{"stacked zstd", "gzip, zstd", zstdRawFrame(gzipBytes(t, body.Bytes()))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/scan", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("Content-Encoding", tt.encoding)
+
+			if reqErr := decodeBody(httptest.NewRecorder(), req, 1<<20); reqErr != nil {
+				t.Fatalf("decodeBody() error = %v", reqErr.message)
+			}
+			file, _, err := req.FormFile("file")
+			if err != nil {
+				t.Fatalf("FormFile() error = %v", err)
+			}
+			got, _ := io.ReadAll(file)
+			if !bytes.Equal(got, content) {
+				t.Errorf("file = %q, want %q", got, content)
+			}
+		})
+	}
+}
+
+func TestScanHandlerContentEncoding(t *testing.T) {
+	cfg := &Config{MaxUploadSize: 4096}
+
+	t.Run("bomb", func(t *testing.T) {
+		// Compresses to well under the limit but expands far beyond it
+		body, contentType := multipartUpload(t, "bomb.txt", make([]byte, 1<<20))
+		compressed := gzipBytes(t, body.Bytes())
+		if len(compressed) > int(cfg.MaxUploadSize) {
+			t.Fatalf("compressed size %d exceeds limit", len(compressed))
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/scan", bytes.NewReader(compressed))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Content-Encoding", "gzip")
+		recorder := httptest.NewRecorder()
+
+		handleScan(recorder, req, cfg, nil)
+
+		if recorder.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("status = %d, want 413", recorder.Code)
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/scan", bytes.NewReader([]byte("not gzip")))
+		req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+		req.Header.Set("Content-Encoding", "gzip")
+		recorder := httptest.NewRecorder()
+
+		handleScan(recorder, req, cfg, nil)
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status = %d, want 400", recorder.Code)
+		}
+	})
+
+	t.Run("corrupt zstd", func(t *testing.T) {
+		// A valid frame header followed by a block of the reserved type
+		body, contentType := multipartUpload(t, "notes.txt", []byte("plain text artifact"))
+		compressed := zstdRawFrame(body.Bytes())
+		compressed[6] |= 3 << 1
+
+		req := httptest.NewRequest(http.MethodPost, "/scan", bytes.NewReader(compressed))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Content-Encoding", "zstd")
+		recorder := httptest.NewRecorder()
+
+		handleScan(recorder, req, cfg, nil)
+
+		if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "Invalid compressed request body") {
+			t.Errorf("status = %d (%s), want 400 for the compressed body", recorder.Code, recorder.Body.String())
+		}
+	})
+
+	t.Run("br", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/scan", bytes.NewReader([]byte("data")))
+		req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+		req.Header.Set("Content-Encoding", "br")
+		recorder := httptest.NewRecorder()
+
+		handleScan(recorder, req, cfg, nil)
+
+		if recorder.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("status = %d, want 415", recorder.Code)
+		}
+	})
+}
@@ -22,9 +22,49 @@ MAX_EXTRACTED_SIZE_MB=${MAX_EXTRACTED_SIZE_MB:-1024}
 MAX_SINGLE_FILE_MB=${MAX_SINGLE_FILE_MB:-256}
 MAX_RECURSION=${MAX_RECURSION:-16}
 MAX_THREADS=${MAX_THREADS:-20}
+# Heuristic alerts to turn on: macros, encrypted, broken, limits or all
+HEURISTIC_ALERTS=$(echo "${HEURISTIC_ALERTS:-}" | tr -d ' ')
 # How many times per day to check for updates (24=hourly, 12=every 2h, 1=daily)
 FRESHCLAM_CHECKS=${FRESHCLAM_CHECKS:-24}
 
+# Proxy for freshclam downloads: OUTBOUND_PROXY, else HTTPS_PROXY
+# (scheme://[user:password@]host[:port])
+FRESHCLAM_PROXY=${OUTBOUND_PROXY:-${HTTPS_PROXY:-${https_proxy:-}}}
+
+# freshclam_proxy: freshclam.conf proxy settings for FRESHCLAM_PROXY, if set
+freshclam_proxy() {
+    [ -n "${FRESHCLAM_PROXY}" ] || return 0
+    scheme=http
+    case "${FRESHCLAM_PROXY}" in
+        *://*) scheme=${FRESHCLAM_PROXY%%://*} ;;
+    esac
+    hostport=${FRESHCLAM_PROXY#*://}
+    hostport=${hostport%%/*}
+    case "${hostport}" in
+        *@*)
+            credentials=${hostport%@*}
+            hostport=${hostport##*@}
+            echo "HTTPProxyUsername ${credentials%%:*}"
+            echo "HTTPProxyPassword ${credentials#*:}"
+            ;;
+    esac
+    case "${hostport}" in
+        *:*) echo "HTTPProxyServer ${scheme}://${hostport%:*}"; echo "HTTPProxyPort ${hostport##*:}" ;;
+        *)
+            echo "HTTPProxyServer ${scheme}://${hostport}"
+            if [ "${scheme}" = https ]; then echo "HTTPProxyPort 443"; else echo "HTTPProxyPort 80"; fi
+            ;;
+    esac
+}
+
+# alert <category>: "yes" if HEURISTIC_ALERTS turns the category on
+alert() {
+    case ",${HEURISTIC_ALERTS}," in
+        *,all,*|*,$1,*) echo yes ;;
+        *) echo no ;;
+    esac
+}
+
 # Config file paths - stored in /var/run/clamav (writable by GID 0)
 CLAMD_CONF=/var/run/clamav/clamd.conf
 FRESHCLAM_CONF=/var/run/clamav/freshclam.conf
@@ -33,7 +73,9 @@ echo "Generating ClamAV configuration files..."
 echo "  MaxScanSize: ${MAX_EXTRACTED_SIZE_MB}M"
 echo "  MaxFileSize: ${MAX_SINGLE_FILE_MB}M"
 echo "  MaxRecursion: ${MAX_RECURSION}"
+echo "  HeuristicAlerts: ${HEURISTIC_ALERTS:-none}"
 echo "  FreshclamChecks: ${FRESHCLAM_CHECKS}/day"
+echo "  FreshclamProxy: $(freshclam_proxy | sed -n 's/^HTTPProxyServer //p')"
 
 # Generate clamd.conf
 # Note: No "User" directive - runs as container's assigned user
@@ -61,6 +103,13 @@ MaxScanSize ${MAX_EXTRACTED_SIZE_MB}M
 MaxFileSize ${MAX_SINGLE_FILE_MB}M
 MaxRecursion ${MAX_RECURSION}
 
+# Heuristic alerts - derived from HEURISTIC_ALERTS
+AlertOLE2Macros $(alert macros)
+AlertEncryptedDoc $(alert encrypted)
+AlertEncryptedArchive $(alert encrypted)
+AlertBrokenExecutables $(alert broken)
+AlertExceedsMax $(alert limits)
+
 # Concurrency - critical for high throughput
 MaxThreads ${MAX_THREADS}
 
@@ -89,6 +138,9 @@ Checks ${FRESHCLAM_CHECKS}
 # Notify clamd to reload after updates
 NotifyClamd ${CLAMD_CONF}
 
+# Proxy (from OUTBOUND_PROXY or HTTPS_PROXY)
+$(freshclam_proxy)
+
 # Run in foreground when started as daemon
 Foreground yes
 
@@ -134,5 +186,5 @@ echo "Starting freshclam daemon for automatic updates..."
 freshclam --config-file=${FRESHCLAM_CONF} --daemon &
 
 # Start REST server
-echo "Starting ClamAV REST server on port ${PORT:-9000}..."
-exec ./clamav-rest
+echo "Starting ClamAV REST server on ${LISTEN_SOCKET:-port ${PORT:-9000}}..."
+exec ./clamav-rest "$@"
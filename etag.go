@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Verdicts are tagged with the SHA-256 of the scanned content (when sha256
+// is in HASH_ALGORITHMS). The tag is weak: the same content gives the same
+// verdict, but scan time and result URLs differ between responses.
+
+// scanETag returns the ETag of a scan result, or "" if the content was not
+// hashed with SHA-256
+func scanETag(response *ScanResponse) string {
+	if response == nil || response.Hashes["sha256"] == "" {
+		return ""
+	}
+	return `W/"` + response.Hashes["sha256"] + `"`
+}
+
+// notModified sets etag on the response and answers 304 Not Modified if
+// the request's If-None-Match lists it. Returns true if it answered.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, by weak
+// comparison (RFC 9110 section 13.1.2)
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEtagMatches(t *testing.T) {
+	etag := `W/"abc"`
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{`W/"abc"`, true},
+		{`"abc"`, true},
+		{`"xyz", W/"abc"`, true},
+		{`*`, true},
+		{`"xyz"`, false},
+		{``, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, etag); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+
+	if etag := scanETag(&ScanResponse{Hashes: map[string]string{"md5": "44d8"}}); etag != "" {
+		t.Errorf("scanETag() without sha256 = %q", etag)
+	}
+}
+
+func TestJobStatusNotModified(t *testing.T) {
+	useJobStore(t, NewJobStore(10, time.Minute))
+	job := jobs.Create("", "")
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/scan/jobs/"+job.ID, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		recorder := httptest.NewRecorder()
+		jobStatusHandler(recorder, req)
+		return recorder
+	}
+
+	// Untagged until the result is in
+	if recorder := get(`*`); recorder.Code != http.StatusOK || recorder.Header().Get("ETag") != "" {
+		t.Errorf("queued job: status %d, ETag %q; want 200 without ETag", recorder.Code, recorder.Header().Get("ETag"))
+	}
+
+	job.finish(&ScanResponse{Status: "clean", Hashes: map[string]string{"sha256": "9f2c"}})
+	recorder := get("")
+	if recorder.Code != http.StatusOK || recorder.Header().Get("ETag") != `W/"9f2c"` {
+		t.Fatalf("finished job: status %d, ETag %q", recorder.Code, recorder.Header().Get("ETag"))
+	}
+	if recorder := get(`W/"9f2c"`); recorder.Code != http.StatusNotModified || recorder.Body.Len() != 0 {
+		t.Errorf("matching If-None-Match: status %d, %d bytes; want 304 without a body", recorder.Code, recorder.Body.Len())
+	}
+	if recorder := get(`"other"`); recorder.Code != http.StatusOK {
+		t.Errorf("other If-None-Match: status %d, want 200", recorder.Code)
+	}
+}
+
+func TestScanResponseETag(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.HashAlgorithms = []string{"sha256"}
+	body, contentType := multipartUpload(t, "test.txt", []byte("hello"))
+	req := httptest.NewRequest(http.MethodPost, "/scan", body)
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+	handleScan(recorder, req, cfg, NewScanner(cfg))
+
+	want := `W/"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"`
+	if recorder.Code != http.StatusOK || recorder.Header().Get("ETag") != want {
+		t.Errorf("status %d, ETag %q; want 200, %s", recorder.Code, recorder.Header().Get("ETag"), want)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// How often an idle event stream sends a comment to keep proxies from closing it
+const sseKeepAlive = 15 * time.Second
+
+// jobEventsHandler streams an async job's progress as Server-Sent Events
+// (GET /scan/events/{id}). Each update is a "progress" event carrying the
+// JobResponse; the stream ends with a "done" event that includes the result.
+func jobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	job := jobFromPath(w, r, "/scan/events/")
+	if job == nil {
+		return
+	}
+
+	// Scans of large archives outlast the server write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no") // Disable nginx response buffering
+	w.WriteHeader(http.StatusOK)
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		snapshot, changed := job.Snapshot()
+		event := "progress"
+		if snapshot.Stage == stageDone {
+			event = "done"
+		}
+		data, _ := json.Marshal(snapshot)
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return
+		}
+		rc.Flush()
+		if event == "done" {
+			return
+		}
+
+	wait:
+		for {
+			select {
+			case <-changed:
+				break wait
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				rc.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
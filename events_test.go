@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobEventsHandler(t *testing.T) {
+	useJobStore(t, NewJobStore(10, time.Minute))
+	job := jobs.Create("", "")
+
+	server := httptest.NewServer(http.HandlerFunc(jobEventsHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/scan/events/" + job.ID)
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	go func() {
+		job.setProgress(stageExtracting, 40)
+		time.Sleep(10 * time.Millisecond)
+		job.setProgress(stageScanning, 0)
+		time.Sleep(10 * time.Millisecond)
+		job.finish(&ScanResponse{Status: "clean", ScannedFiles: 3})
+	}()
+
+	// Updates may coalesce; the stream must end with the result
+	var events []string
+	var last JobResponse
+	reader := bufio.NewScanner(resp.Body)
+	for reader.Scan() {
+		line := reader.Text()
+		if event, ok := strings.CutPrefix(line, "event: "); ok {
+			events = append(events, event)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			last = JobResponse{}
+			json.Unmarshal([]byte(data), &last)
+		}
+	}
+
+	if len(events) < 2 || events[0] != "progress" || events[len(events)-1] != "done" {
+		t.Errorf("events = %v, want progress ... done", events)
+	}
+	if last.Stage != stageDone || last.Result == nil || last.Result.ScannedFiles != 3 {
+		t.Errorf("last event = %+v, want done with result", last)
+	}
+}
+
+func TestJobEventsHandlerNotFound(t *testing.T) {
+	useJobStore(t, NewJobStore(10, time.Minute))
+	recorder := httptest.NewRecorder()
+
+	jobEventsHandler(recorder, httptest.NewRequest(http.MethodGet, "/scan/events/missing", nil))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", recorder.Code)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// FaultInjector slows down and breaks scans on purpose, so platform teams
+// can check their client timeouts and retries against the service. Each
+// fault hits the given percentage of scans.
+type FaultInjector struct {
+	latency        time.Duration // Added before a scan request is handled
+	latencyPercent int
+	clamdPercent   int           // clamd calls failing as if clamd were unreachable
+	extractDelay   time.Duration // Added before an upload is extracted
+	extractPercent int
+
+	roll func() int // Returns 0-99; replaced in tests
+}
+
+// Global fault injector (nil = no faults)
+var faults *FaultInjector
+
+// NewFaultInjector creates the fault injector described by the config.
+// Returns nil when no fault is configured.
+func NewFaultInjector(config *Config) *FaultInjector {
+	f := &FaultInjector{
+		latency:        config.FaultLatency,
+		latencyPercent: config.FaultLatencyPercent,
+		clamdPercent:   config.FaultClamdErrorPercent,
+		extractDelay:   config.FaultExtractDelay,
+		extractPercent: config.FaultExtractPercent,
+		roll:           func() int { return rand.Intn(100) },
+	}
+	if (f.latency == 0 || f.latencyPercent == 0) && f.clamdPercent == 0 && (f.extractDelay == 0 || f.extractPercent == 0) {
+		return nil
+	}
+	return f
+}
+
+// hits reports whether a fault with the given percentage strikes, and
+// counts it
+func (f *FaultInjector) hits(percent int, fault string) bool {
+	if percent == 0 || f.roll() >= percent {
+		return false
+	}
+	metrics.Count("faults.injected", 1, "fault:"+fault)
+	return true
+}
+
+// sleep waits for d, or until ctx is done
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// Latency delays the request by FAULT_LATENCY_MS, if the fault strikes
+func (f *FaultInjector) Latency(ctx context.Context) {
+	if f == nil || f.latency == 0 || !f.hits(f.latencyPercent, "latency") {
+		return
+	}
+	sleep(ctx, f.latency)
+}
+
+// ClamdError returns an error for a clamd call to fail with, if the fault
+// strikes. It counts as clamd being unreachable, so it is retried and
+// trips the circuit breaker like the real thing.
+func (f *FaultInjector) ClamdError() error {
+	if f == nil || !f.hits(f.clamdPercent, "clamd") {
+		return nil
+	}
+	return fmt.Errorf("%w: injected fault", errClamdUnavailable)
+}
+
+// SlowExtraction delays extracting an upload by FAULT_EXTRACT_DELAY_MS, if
+// the fault strikes
+func (f *FaultInjector) SlowExtraction(ctx context.Context) {
+	if f == nil || f.extractDelay == 0 || !f.hits(f.extractPercent, "extract") {
+		return
+	}
+	sleep(ctx, f.extractDelay)
+}
+
+// injectLatency delays scan requests as configured by FAULT_LATENCY_MS
+func injectLatency(f *FaultInjector, next http.Handler) http.Handler {
+	if f == nil || f.latency == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.Latency(r.Context())
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewFaultInjector(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want bool
+	}{
+		{"off", Config{FaultLatencyPercent: 100, FaultExtractPercent: 100}, false},
+		{"latency", Config{FaultLatency: time.Second, FaultLatencyPercent: 100}, true},
+		{"latency never", Config{FaultLatency: time.Second, FaultLatencyPercent: 0}, false},
+		{"clamd errors", Config{FaultClamdErrorPercent: 10}, true},
+		{"slow extraction", Config{FaultExtractDelay: time.Second, FaultExtractPercent: 50}, true},
+	}
+	for _, tt := range tests {
+		if got := NewFaultInjector(&tt.cfg) != nil; got != tt.want {
+			t.Errorf("%s: enabled = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFaultInjectorRates(t *testing.T) {
+	f := NewFaultInjector(&Config{FaultClamdErrorPercent: 30})
+	rolls := []int{0, 29, 30, 99}
+	f.roll = func() int {
+		roll := rolls[0]
+		rolls = rolls[1:]
+		return roll
+	}
+	var failed []bool
+	for i := 0; i < 4; i++ {
+		failed = append(failed, f.ClamdError() != nil)
+	}
+	if want := []bool{true, true, false, false}; !equalBools(failed, want) {
+		t.Errorf("clamd failures = %v, want %v", failed, want)
+	}
+
+	var nilInjector *FaultInjector
+	if nilInjector.ClamdError() != nil {
+		t.Error("nil injector failed a clamd call")
+	}
+	nilInjector.Latency(context.Background())
+	nilInjector.SlowExtraction(context.Background())
+}
+
+func equalBools(a, b []bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFaultClamdErrorRetried(t *testing.T) {
+	f := NewFaultInjector(&Config{FaultClamdErrorPercent: 100})
+	calls := 0
+	err := callClamd(context.Background(), 2, func() error {
+		calls++
+		if err := f.ClamdError(); err != nil {
+			return err
+		}
+		return nil
+	})
+	if !errors.Is(err, errClamdUnavailable) || calls != 3 {
+		t.Errorf("callClamd() = %v after %d calls, want errClamdUnavailable after 3", err, calls)
+	}
+}
+
+func TestInjectLatency(t *testing.T) {
+	f := NewFaultInjector(&Config{FaultLatency: 50 * time.Millisecond, FaultLatencyPercent: 100})
+	handler := injectLatency(f, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/scan", nil))
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("request took %v, want at least 50ms", elapsed)
+	}
+
+	// A client giving up ends the delay
+	f.latency = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/scan", nil).WithContext(ctx))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled request took %v", elapsed)
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	if got := injectLatency(nil, next); got == nil {
+		t.Error("injectLatency(nil) returned nil")
+	}
+}
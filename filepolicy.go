@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// fileTypeMIME maps the formats recognized by their magic bytes (see
+// fileMagic) that http.DetectContentType doesn't know to MIME types
+var fileTypeMIME = map[string]string{
+	"pe":     "application/vnd.microsoft.portable-executable",
+	"elf":    "application/x-executable",
+	"macho":  "application/x-mach-binary",
+	"ole":    "application/x-ole-storage",
+	"script": "text/x-shellscript",
+}
+
+// detectMIMEType returns the MIME type of content starting with head,
+// without parameters
+func detectMIMEType(head []byte) string {
+	for _, m := range fileMagic {
+		if mimeType := fileTypeMIME[m.fileType]; mimeType != "" && bytes.HasPrefix(head, m.magic) {
+			return mimeType
+		}
+	}
+	mimeType, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	return mimeType
+}
+
+// filePolicyEnabled reports whether uploads are checked against extension
+// or type lists
+func filePolicyEnabled(config *Config) bool {
+	return len(config.AllowedExtensions) > 0 || len(config.DeniedExtensions) > 0 ||
+		len(config.AllowedTypes) > 0 || len(config.DeniedTypes) > 0
+}
+
+// checkFilePolicy checks an upload's file name and leading bytes against
+// the extension and MIME type lists. Denied lists win over allowed ones;
+// with an allowed list, anything not on it is refused, including uploads
+// without a name. Returns the check that refused it ("" = allowed) and the
+// client message.
+func checkFilePolicy(config *Config, filename string, head []byte) (check, message string) {
+	// Windows ignores trailing dots and spaces, so "payload.exe." is an .exe
+	name := strings.ToLower(strings.TrimRight(path.Base(strings.ReplaceAll(filename, "\\", "/")), ". "))
+	if ext := listedExtension(config.DeniedExtensions, name); ext != "" {
+		return "extension", "File extension " + ext + " not allowed"
+	}
+	if len(config.AllowedExtensions) > 0 && listedExtension(config.AllowedExtensions, name) == "" {
+		return "extension", "File extension not allowed"
+	}
+
+	if len(config.DeniedTypes) == 0 && len(config.AllowedTypes) == 0 {
+		return "", ""
+	}
+	mimeType := detectMIMEType(head)
+	if listedType(config.DeniedTypes, mimeType) || len(config.AllowedTypes) > 0 && !listedType(config.AllowedTypes, mimeType) {
+		return "type", "File type " + mimeType + " not allowed"
+	}
+	return "", ""
+}
+
+// listedExtension returns the entry of extensions that name ends with
+// (.tar.gz as well as .gz), or "" if none
+func listedExtension(extensions []string, name string) string {
+	for _, ext := range extensions {
+		ext = "." + strings.TrimPrefix(strings.ToLower(ext), ".")
+		if strings.HasSuffix(name, ext) && len(name) > len(ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// listedType reports whether mimeType matches an entry of types: the type
+// itself, or type/* for all its subtypes
+func listedType(types []string, mimeType string) bool {
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if t == mimeType {
+			return true
+		}
+		if major, ok := strings.CutSuffix(t, "/*"); ok && strings.HasPrefix(mimeType, major+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// refuseByPolicy checks an upload against the file policy and returns the
+// 415 for one it refuses
+func refuseByPolicy(config *Config, filename, safeFilename string, head []byte) *requestError {
+	check, message := checkFilePolicy(config, filename, head)
+	if check == "" {
+		return nil
+	}
+	log.Printf("Refused %s by file policy: %s", safeFilename, message)
+	metrics.Count("policy.refused", 1, "check:"+check)
+	return &requestError{status: http.StatusUnsupportedMediaType, message: message}
+}
+
+// readHead returns the first 512 bytes of a file, as much as
+// http.DetectContentType looks at
+func readHead(path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	return head[:n]
+}
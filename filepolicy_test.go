@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDetectMIMEType(t *testing.T) {
+	tests := []struct {
+		head []byte
+		want string
+	}{
+		{[]byte("MZ\x90\x00\x03"), "application/vnd.microsoft.portable-executable"},
+		{[]byte("\x7fELF\x02\x01"), "application/x-executable"},
+		{[]byte("#!/bin/sh\necho hi\n"), "text/x-shellscript"},
+		{[]byte("%PDF-1.7\n"), "application/pdf"},
+		{[]byte("PK\x03\x04"), "application/zip"},
+		{[]byte("hello world"), "text/plain"},
+	}
+	for _, tt := range tests {
+		if got := detectMIMEType(tt.head); got != tt.want {
+			t.Errorf("detectMIMEType(%q) = %q, want %q", tt.head, got, tt.want)
+		}
+	}
+}
+
+func TestCheckFilePolicy(t *testing.T) {
+	pdf := []byte("%PDF-1.7\n")
+	exe := []byte("MZ\x90\x00")
+	tests := []struct {
+		name     string
+		config   Config
+		filename string
+		head     []byte
+		want     string
+	}{
+		{name: "no lists", filename: "setup.exe", head: exe},
+		{name: "denied extension", config: Config{DeniedExtensions: []string{".exe"}}, filename: "setup.exe", head: exe, want: "extension"},
+		{name: "denied extension without dot", config: Config{DeniedExtensions: []string{"EXE"}}, filename: "Setup.EXE", head: exe, want: "extension"},
+		{name: "trailing dot", config: Config{DeniedExtensions: []string{".exe"}}, filename: "setup.exe. ", head: exe, want: "extension"},
+		{name: "windows path", config: Config{DeniedExtensions: []string{".exe"}}, filename: `C:\Users\a\setup.exe`, head: exe, want: "extension"},
+		{name: "compound extension", config: Config{AllowedExtensions: []string{".tar.gz"}}, filename: "logs.tar.gz", head: pdf},
+		{name: "extension not allowed", config: Config{AllowedExtensions: []string{".pdf"}}, filename: "report.docx", head: pdf, want: "extension"},
+		{name: "no name with allowed list", config: Config{AllowedExtensions: []string{".pdf"}}, filename: "", head: pdf, want: "extension"},
+		{name: "extension alone is no name", config: Config{AllowedExtensions: []string{".pdf"}}, filename: ".pdf", head: pdf, want: "extension"},
+		{name: "denied type under another name", config: Config{DeniedTypes: []string{"application/vnd.microsoft.portable-executable"}}, filename: "invoice.pdf", head: exe, want: "type"},
+		{name: "allowed type", config: Config{AllowedTypes: []string{"application/pdf"}}, filename: "invoice.pdf", head: pdf},
+		{name: "type not allowed", config: Config{AllowedTypes: []string{"application/pdf", "image/*"}}, filename: "invoice.pdf", head: exe, want: "type"},
+		{name: "wildcard type", config: Config{AllowedTypes: []string{"image/*"}}, filename: "logo.png", head: []byte("\x89PNG\r\n\x1a\n")},
+		{name: "deny wins", config: Config{AllowedTypes: []string{"application/*"}, DeniedTypes: []string{"application/pdf"}}, filename: "a.pdf", head: pdf, want: "type"},
+	}
+	for _, tt := range tests {
+		if check, _ := checkFilePolicy(&tt.config, tt.filename, tt.head); check != tt.want {
+			t.Errorf("%s: check = %q, want %q", tt.name, check, tt.want)
+		}
+	}
+}
+
+func TestScanHandlerFilePolicy(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.DeniedExtensions = []string{".exe"}
+	cfg.DeniedTypes = []string{"application/vnd.microsoft.portable-executable"}
+
+	scan := func(filename string, content []byte) (*httptest.ResponseRecorder, ScanResponse) {
+		body, contentType := multipartUpload(t, filename, content)
+		req := httptest.NewRequest(http.MethodPost, "/scan", body)
+		req.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+		handleScan(recorder, req, cfg, NewScanner(cfg))
+		var response ScanResponse
+		json.NewDecoder(recorder.Body).Decode(&response)
+		return recorder, response
+	}
+
+	if recorder, response := scan("setup.exe", []byte("hello")); recorder.Code != http.StatusUnsupportedMediaType || response.Error != "File extension .exe not allowed" {
+		t.Errorf("denied extension: status %d, response %+v", recorder.Code, response)
+	}
+	if recorder, response := scan("invoice.pdf", []byte("MZ\x90\x00 renamed executable")); recorder.Code != http.StatusUnsupportedMediaType || response.Status != "error" {
+		t.Errorf("denied type: status %d, response %+v", recorder.Code, response)
+	}
+	if recorder, response := scan("notes.txt", []byte("hello")); recorder.Code != http.StatusOK || response.Status != "clean" {
+		t.Errorf("allowed file: status %d, response %+v", recorder.Code, response)
+	}
+
+	// Streamed tars are refused before they are extracted
+	cfg.StreamExtraction = true
+	if recorder, _ := scan("bundle.exe", testLayer(t, map[string]string{"a.txt": "hello"})); recorder.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("streamed tar: status %d, want 415", recorder.Code)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// configSetting describes one setting for the config file and command line
+type configSetting struct {
+	key   string // Environment variable name
+	def   string // Default shown in -help ("" = none or computed)
+	usage string
+}
+
+// configSettings lists every server setting
+var configSettings = []configSetting{
+	{EnvPort, DefaultPort, "HTTP server port"},
+	{EnvBindAddress, "", "Address to listen on, IPv4 or IPv6 (default all interfaces)"},
+	{EnvBasePath, "", "Prefix for all routes, e.g. /antivirus"},
+	{EnvTrustedProxies, "", "Proxy IPs/CIDRs whose X-Forwarded-For and X-Real-IP are honored"},
+	{EnvOutboundProxy, "", "Proxy for requests to external services, e.g. http://proxy:3128 (default HTTP_PROXY/HTTPS_PROXY)"},
+	{EnvOutboundNoProxy, "", "Hosts, domains and CIDRs reached without OUTBOUND_PROXY"},
+	{EnvEgressSchemes, DefaultEgressSchemes, "URL schemes outbound requests may use"},
+	{EnvEgressHosts, "", "Hosts outbound requests may reach, *.domain for subdomains (empty = any)"},
+	{EnvEgressDenied, DefaultEgressDenied, "IPs/CIDRs outbound connections must not reach"},
+	{EnvEgressCIDRs, "", "IPs/CIDRs allowed despite EGRESS_DENIED_CIDRS"},
+	{EnvEgressRedirects, "5", "Redirects followed by outbound requests"},
+	{EnvIPAllowlist, "", "Client IPs/CIDRs allowed to connect (default all)"},
+	{EnvIPDenylist, "", "Client IPs/CIDRs rejected with 403"},
+	{EnvLogLevel, "info", "Log level (info or debug)"},
+	{EnvDiagnostics, "false", "Expose /debug/pprof/ and /debug/diagnostics (requires the admin scope)"},
+	{EnvSanitize, "false", "Expose POST /sanitize, which returns clean PDF and OOXML documents without macros and JavaScript"},
+	{EnvTestVerdicts, "false", "Let callers force an infected or error verdict with X-Test-Verdict, for integration tests"},
+	{EnvListenSocket, "", "Unix domain socket to listen on instead of the TCP port"},
+	{EnvListenSocketMode, fmt.Sprintf("%04o", DefaultListenSocketMode), "Octal permissions of the listen socket"},
+
+	{EnvReadTimeout, fmt.Sprint(DefaultReadTimeoutSecs), "Max seconds to read an entire request"},
+	{EnvWriteTimeout, fmt.Sprint(DefaultWriteTimeoutSecs), "Max seconds to write a response"},
+	{EnvIdleTimeout, fmt.Sprint(DefaultIdleTimeoutSecs), "Max idle seconds for keep-alive connections"},
+	{EnvHTTP2, "true", "Serve HTTP/2 over TLS and cleartext HTTP/2 (h2c)"},
+	{EnvResponseCompression, "true", "gzip responses for clients that send Accept-Encoding: gzip"},
+	{EnvResponseCompressionMinBytes, fmt.Sprint(DefaultResponseCompressionMinBytes), "Smallest response to compress"},
+
+	{EnvMaxUploadSize, fmt.Sprint(DefaultMaxUploadMB), "Max upload size in MB"},
+	{EnvUploadFieldNames, "", "Multipart fields that carry the file, e.g. file,attachment (default: any file part)"},
+	{EnvMetadataMaxBytes, fmt.Sprint(DefaultMetadataMaxBytes), "Largest caller metadata (JSON object) accepted with a scan"},
+	{EnvAllowedExt, "", "File extensions uploads may have, e.g. .pdf,.docx (empty = any)"},
+	{EnvDeniedExt, "", "File extensions refused before scanning, e.g. .exe,.scr"},
+	{EnvAllowedTypes, "", "MIME types, detected from the content, uploads may have; type/* for all subtypes (empty = any)"},
+	{EnvDeniedTypes, "", "MIME types, detected from the content, refused before scanning"},
+	{EnvMaxExtractedSize, fmt.Sprint(DefaultMaxExtractedMB), "Max total extracted size in MB"},
+	{EnvMaxFileCount, fmt.Sprint(DefaultMaxFileCount), "Max files in an archive"},
+	{EnvMaxSingleFile, fmt.Sprint(DefaultMaxSingleFileMB), "Max single file size in MB"},
+	{EnvMaxEntryPath, fmt.Sprint(DefaultMaxEntryPath), "Max archive entry path length in bytes"},
+	{EnvArchivePasswords, "", "Passwords tried on encrypted ZIP entries, one per line"},
+	{EnvRequestExtracted, fmt.Sprint(DefaultRequestExtractedMB), "Max MB extracted by one request, over all its archives (0 = unlimited)"},
+	{EnvRequestFiles, fmt.Sprint(DefaultRequestFiles), "Max files extracted by one request (0 = unlimited)"},
+	{EnvRequestDirs, fmt.Sprint(DefaultRequestDirs), "Max directories created by one request (0 = unlimited)"},
+	{EnvRequestDepth, fmt.Sprint(DefaultRequestDepth), "Max directory levels of extracted files (0 = unlimited)"},
+	{EnvScanTimeout, fmt.Sprint(DefaultScanTimeoutMins), "Max minutes for a ClamAV scan"},
+	{EnvScanTimeoutMax, "", "Longest scan timeout in minutes a request or tenant may set (default: SCAN_TIMEOUT_MINUTES)"},
+	{EnvMaxThreads, fmt.Sprint(DefaultMaxThreads), "clamd MaxThreads (multiscan needs at least 2)"},
+	{EnvHashAlgorithms, "", "Digests reported for uploads and threats, e.g. md5,sha1,sha256"},
+	{EnvFuzzyHashing, "false", "Compute ssdeep fuzzy hashes of infected files"},
+	{EnvStaticAnalysis, analysisThreats, "Entropy, type and header triage for: off, threats or all files"},
+	{EnvThreatClasses, "", "JSON file overriding the platform, category and family parsed from signature names"},
+	{EnvThreatTags, "", "JSON or CSV database of threat tags (ATT&CK techniques, family aliases), reread when it changes"},
+	{EnvMalwareBazaarAuthKey, "", "abuse.ch Auth-Key for MalwareBazaar lookups of infected files (disabled if empty)"},
+	{EnvMalwareBazaarURL, DefaultMalwareBazaarURL, "MalwareBazaar API endpoint"},
+	{EnvMalwareBazaarTimeout, fmt.Sprint(DefaultMalwareBazaarTimeout), "Milliseconds the MalwareBazaar lookups of one scan may take"},
+	{EnvMalwareBazaarCacheTTL, fmt.Sprint(DefaultMalwareBazaarCacheTTL), "Hours MalwareBazaar answers are cached"},
+	{EnvHeuristicAlerts, "", "ClamAV heuristic alerts turned on in clamd.conf: macros, encrypted, broken, limits or all"},
+	{EnvEmailExtraction, "true", "Scan attachments of .eml and Outlook .msg uploads as separate parts"},
+	{EnvImageExtraction, "true", "Scan the files of ISO 9660 and UDF disk images separately"},
+	{EnvStreamExtraction, "false", "Extract tar and tar.gz uploads while they are received instead of saving them first (default true with MEMORY_BOUNDED)"},
+	{EnvDedupeEntries, "true", "Scan identical archive entries once and report the verdict for every copy"},
+	{EnvArchiveMaxRatio, fmt.Sprint(DefaultArchiveMaxRatio), "Largest uncompressed/compressed size ratio of an archive (0 = unchecked)"},
+	{EnvArchiveMaxNestedDuplicates, fmt.Sprint(DefaultArchiveMaxNestedDuplicates), "Most identical nested archives in a ZIP (0 = unchecked)"},
+	{EnvArchiveBombAction, bombActionReject, "What to do with likely decompression bombs: reject or flag"},
+	{EnvScanTmpDir, "", "Directory for uploads and extracted archives, ideally a tmpfs (empty = TMPDIR or /tmp)"},
+	{EnvScanTmpMinFree, fmt.Sprint(DefaultScanTmpMinFreeMB), "Free space in MB uploads and archive extraction must leave in the temp directory"},
+	{EnvMemoryBounded, "false", "Run within a small memory limit: cap extraction buffers, stream tar uploads and shed load with 429"},
+	{EnvMemoryBufferSize, fmt.Sprint(DefaultMemoryBufferMB), "MB of document objects held in memory at once (with MEMORY_BOUNDED)"},
+	{EnvShedRSS, "0", "Reject scans with 429 while RSS exceeds this many MB (with MEMORY_BOUNDED; 0 = 80% of the container limit)"},
+	{EnvShedTemp, "0", "Reject scans with 429 while scan temp data exceeds this many MB (with MEMORY_BOUNDED; 0 = unchecked)"},
+	{EnvShedLoadPerCPU, "0", "Reject scans with 503 while the 1-minute load average per CPU exceeds this (0 = unchecked)"},
+	{EnvShedMinAvailable, "0", "Reject scans with 503 while less than this many MB of system memory are available (0 = unchecked)"},
+	{EnvShedGoroutines, "0", "Reject scans with 503 while more goroutines than this are running (0 = unchecked)"},
+	{EnvShedQueueDepth, "0", "Reject scans with 503 while more scans than this wait for a worker (0 = unchecked)"},
+	{EnvFaultLatency, "0", "Delay scan requests by this many ms, for resilience tests (0 = off)"},
+	{EnvFaultLatencyPercent, "100", "Percentage of scan requests FAULT_LATENCY_MS delays"},
+	{EnvFaultClamdErrorPercent, "0", "Percentage of clamd calls failing as if clamd were unreachable, for resilience tests"},
+	{EnvFaultExtractDelay, "0", "Delay extracting uploads by this many ms, for resilience tests (0 = off)"},
+	{EnvFaultExtractPercent, "100", "Percentage of uploads FAULT_EXTRACT_DELAY_MS delays"},
+	{EnvDocIndicators, "true", "Report and scan VBA macros and embedded objects in Office documents"},
+	{EnvImageRegistries, "", "Registries POST /scan/image may pull from, e.g. docker.io,ghcr.io (* = any; empty = disabled)"},
+	{EnvImageMaxLayer, fmt.Sprint(DefaultImageMaxLayerMB), "Largest compressed image layer downloaded, in MB"},
+	{EnvImageLayerCache, fmt.Sprint(DefaultImageLayerCache), "Image layer verdicts cached by digest (0 = no cache)"},
+	{EnvVerdictCacheRedisURL, "", "Redis URL verdicts are shared between replicas in (redis:// or rediss://; empty = memory only)"},
+	{EnvVerdictCacheTTL, fmt.Sprint(DefaultVerdictCacheTTL), "Hours verdicts are kept in Redis"},
+	{EnvVerdictCachePrefix, DefaultVerdictCachePrefix, "Prefix of the Redis keys, to share a Redis between deployments"},
+	{EnvScanPathRoots, "", "Mounted directories POST /scan/path may scan below (empty = disabled)"},
+	{EnvObjectStorageProviders, "", "Providers POST /scan/object may read from: gcs, azure (empty = disabled)"},
+	{EnvGCSCredentialsFile, "", "Google Cloud service account JSON key (empty = anonymous)"},
+	{EnvAzureStorageAccount, "", "Azure storage account blobs are read from"},
+	{EnvAzureStorageKey, "", "Azure storage account shared key"},
+	{EnvAzureStorageSASToken, "", "Azure shared access signature, instead of the key"},
+	{EnvRemoteScanHosts, "", "SFTP/FTPS hosts POST /scan/remote may fetch from (* = any; empty = disabled)"},
+	{EnvRemoteCredentials, "", "Remote credentials as host:user:password, comma-separated"},
+	{EnvRemoteSSHHostKeys, "", "Pinned SFTP host keys as host:sha256-fingerprint, comma-separated"},
+	{EnvCurlPath, DefaultCurlPath, "curl binary used for SFTP/FTPS transfers"},
+
+	{EnvClamdscanPath, DefaultClamdscanPath, "clamdscan binary"},
+	{EnvClamdConfigFile, DefaultClamdConfigFile, "clamd config passed to clamdscan"},
+	{EnvClamdscanFdpass, "true", "Pass file descriptors to clamd (--fdpass)"},
+	{EnvClamdscanStream, "false", "Stream file contents to clamd (--stream) instead of fdpass"},
+	{EnvClamdscanMultiscan, "true", "Scan archive contents in parallel (--multiscan)"},
+	{EnvClamdscanArgs, "", "Extra space-separated clamdscan arguments"},
+	{EnvClamdAddress, "", "clamd socket (tcp://host:port or unix:///path) to use instead of clamdscan"},
+	{EnvClamdPoolSize, "", "Persistent clamd connections (default CPU count)"},
+	{EnvClamdStreamWork, "0", "Connections one scan streams files over in parallel with INSTREAM (0 = SCAN by path)"},
+	{EnvClamdRetries, fmt.Sprint(DefaultClamdRetries), "Retries when clamd is unreachable or drops the connection"},
+	{EnvClamdBreakerThreshold, fmt.Sprint(DefaultClamdBreakerThreshold), "Consecutive clamd failures that open the circuit breaker (0 = disabled)"},
+	{EnvClamdBreakerCooldown, fmt.Sprint(DefaultClamdBreakerCooldown), "Seconds the circuit stays open before a probe"},
+	{EnvClamdStartupWait, fmt.Sprint(DefaultClamdStartupWait), "Max seconds to wait for clamd on startup (0 = don't wait)"},
+	{EnvClamdUnreachableExit, "0", "Exit when clamd has been unreachable this many seconds (0 = never)"},
+
+	{EnvScanWorkers, "", "Concurrent scans, 0 = unlimited (default CPU count)"},
+	{EnvScanQueueSize, fmt.Sprint(DefaultScanQueueSize), "Scans that may wait for a worker"},
+	{EnvScanQueueWait, fmt.Sprint(DefaultScanQueueWait), "Seconds to wait for a queue slot before 503"},
+	{EnvAsyncMaxJobs, fmt.Sprint(DefaultAsyncMaxJobs), "Async scan jobs kept at once (0 = async scans disabled)"},
+	{EnvAsyncJobTTL, fmt.Sprint(DefaultAsyncJobTTL), "Minutes finished async results are kept"},
+	{EnvAsyncJobDir, "", "Directory async jobs are saved in to survive restarts (empty = memory only)"},
+	{EnvCoordinatorRedisURL, "", "Redis URL instances sharing ASYNC_JOB_DIR claim its jobs through (redis:// or rediss://; empty = disabled)"},
+	{EnvCoordinatorPrefix, DefaultCoordinatorPrefix, "Prefix of the coordinator's Redis keys"},
+	{EnvCoordinatorLease, fmt.Sprint(DefaultCoordinatorLease), "Seconds before the jobs of an instance that stopped renewing its leases are run elsewhere"},
+	{EnvCoordinatorJobs, fmt.Sprint(DefaultCoordinatorJobs), "Shared async jobs this instance runs at once"},
+	{EnvResultURLSecret, "", "HMAC secret for signed async result URLs (at least 32 bytes, empty = disabled)"},
+	{EnvResultURLTTL, fmt.Sprint(DefaultResultURLTTL), "Minutes a signed async result URL stays valid"},
+	{EnvScanHistorySize, fmt.Sprint(DefaultScanHistorySize), "Most recent scans kept for GET /stats (0 = disabled)"},
+	{EnvScanHistoryFile, "", "JSON lines file the scan history is kept in across restarts (empty = memory only)"},
+	{EnvScanHistoryRetention, "0", "Days scan history records are kept (0 = no time limit)"},
+	{EnvQuarantineRetention, "0", "Days quarantined files are kept (0 = forever)"},
+	{EnvBatchMaxItems, fmt.Sprint(DefaultBatchMaxItems), "Items accepted per POST /scan/batch request"},
+	{EnvBatchConcurrency, fmt.Sprint(DefaultBatchConcurrency), "Items of one batch fetched and scanned at once"},
+	{EnvUploadSessionsMax, fmt.Sprint(DefaultUploadSessionsMax), "Unfinished resumable uploads kept at once (0 = disabled)"},
+	{EnvUploadSessionTTL, fmt.Sprint(DefaultUploadSessionTTL), "Idle minutes before an unfinished resumable upload is discarded"},
+	{EnvWatchDirs, "", "Drop folders scanned as files appear, comma-separated (empty = disabled)"},
+	{EnvWatchInterval, fmt.Sprint(DefaultWatchInterval), "Seconds between checks of the watched directories"},
+	{EnvWatchQuarantineDir, "", "Directory infected files are moved to (empty = renamed to *.infected in place)"},
+	{EnvWatchCleanDir, "", "Directory clean files are moved to (empty = left in place)"},
+	{EnvRescanOnUpdate, "false", "Re-scan the quarantine and RESCAN_DIRS after each signature update"},
+	{EnvRescanDirs, "", "Stores of previously clean files to re-scan after signature updates"},
+
+	{EnvAuthMethods, DefaultAuthMethods, "Authentication chain: none, api-key, basic, jwt, mtls"},
+	{EnvAPIKeys, "", "name:key pairs, comma-separated"},
+	{EnvBasicAuthUsers, "", "user:password pairs, comma-separated"},
+	{EnvJWTSecret, "", "HMAC secret for HS256 bearer tokens"},
+	{EnvJWTJWKSURL, "", "JWKS endpoint for RS256 bearer tokens"},
+	{EnvJWTIssuer, "", "Required iss claim (JWKS discovered via OIDC if no JWKS URL)"},
+	{EnvJWTAudience, "", "Required aud claim"},
+	{EnvMTLSAllowedSubjects, "", "Allowed client certificate CNs (empty = any verified certificate)"},
+	{EnvAuthScopes, "", "method:name:scope1|scope2 entries, comma-separated"},
+	{EnvScanRoutesFile, "", "Scan routes JSON file"},
+
+	{EnvStatsDAddress, "", "StatsD agent host:port (disabled if empty)"},
+	{EnvStatsDPrefix, DefaultStatsDPrefix, "Prefix for metric names"},
+	{EnvStatsDTags, "", "Tags added to every metric"},
+	{EnvDogStatsD, "true", "Send tags in DogStatsD format"},
+	{EnvDDAgentHost, "", "Datadog agent host (if no StatsD address)"},
+	{EnvDDDogStatsDPort, DefaultDogStatsDPort, "Datadog agent DogStatsD port"},
+
+	{EnvAuditLogFile, "", "Audit log JSON lines file"},
+	{EnvAuditSyslogAddress, "", "Audit syslog server (udp://, tcp:// or unix://)"},
+	{EnvAuditSyslogFacility, DefaultSyslogFacility, "Audit syslog facility"},
+
+	{EnvSIEMAddress, "", "SIEM syslog server (udp://, tcp:// or tls://)"},
+	{EnvSIEMFormat, DefaultSIEMFormat, "SIEM event format (cef or leef)"},
+	{EnvSIEMFacility, DefaultSyslogFacility, "SIEM syslog facility"},
+	{EnvSIEMCAFile, "", "CA bundle for the tls:// SIEM server"},
+	{EnvSIEMFieldMap, "", "SIEM field name overrides (field:name, - omits)"},
+
+	{EnvNotifyURL, "", "Detection notification webhook URL (disabled if empty)"},
+	{EnvNotifyFormat, DefaultNotifyFormat, "Notification format (slack, teams or webhook)"},
+	{EnvNotifyTemplate, "", "Go text/template for the notification text"},
+	{EnvNotifyInterval, fmt.Sprint(DefaultNotifyInterval), "Notification batching interval in seconds"},
+	{EnvNotifyRateLimit, fmt.Sprint(DefaultNotifyRateLimit), "Max notifications per minute"},
+
+	{EnvElasticsearchURL, "", "Elasticsearch/OpenSearch URL for result indexing (disabled if empty)"},
+	{EnvElasticsearchIndex, DefaultElasticsearchIndex, "Index name ({layout} expands to the scan date)"},
+	{EnvElasticsearchUsername, "", "Elasticsearch basic auth username"},
+	{EnvElasticsearchPassword, "", "Elasticsearch basic auth password"},
+	{EnvElasticsearchAPIKey, "", "Elasticsearch API key"},
+	{EnvElasticsearchBatchSize, fmt.Sprint(DefaultElasticsearchBatchSize), "Documents per bulk request"},
+	{EnvElasticsearchInterval, fmt.Sprint(DefaultElasticsearchInterval), "Max seconds between bulk requests"},
+
+	{EnvResultTokenSecret, "", "HMAC secret for HS256 result tokens (at least 32 bytes)"},
+	{EnvResultTokenKeyFile, "", "PEM Ed25519 private key for EdDSA result tokens"},
+	{EnvResultTokenIssuer, DefaultResultTokenIssuer, "Issuer (iss) of result tokens"},
+
+	{EnvRateLimitRPS, "0", "Requests per second per client (0 = disabled)"},
+	{EnvRateLimitBurst, fmt.Sprint(DefaultRateLimitBurst), "Requests a client may make at once"},
+	{EnvMaxInFlightPerIP, "0", "Scan requests one client IP may have in flight at once (0 = unlimited)"},
+	{EnvMaxInFlight, "0", "Scan requests in flight at once across all clients (0 = unlimited)"},
+	{EnvCORSAllowedOrigins, "", "Origins allowed to call the API from browsers (*, https://app.example.com, https://*.example.com)"},
+	{EnvCORSAllowedMethods, DefaultCORSAllowedMethods, "Methods allowed for cross-origin requests"},
+	{EnvCORSAllowedHeaders, DefaultCORSAllowedHeaders, "Request headers allowed for cross-origin requests"},
+	{EnvCORSAllowCredentials, "false", "Allow cross-origin requests with cookies or browser credentials"},
+	{EnvCORSMaxAge, fmt.Sprint(DefaultCORSMaxAge), "Seconds browsers may cache a preflight response"},
+	{EnvTenantsFile, "", "Tenants JSON file (disabled if empty)"},
+	{EnvSignatureDir, DefaultSignatureDir, "ClamAV database directory"},
+	{EnvBackupKey, "", "Backup key, 64 hex characters"},
+
+	{EnvTLSCertFile, "", "Server certificate (enables HTTPS)"},
+	{EnvTLSKeyFile, "", "Server private key"},
+	{EnvTLSClientCAFile, "", "CA bundle for verifying client certificates"},
+
+	{EnvOTelSDKDisabled, "false", "Disable tracing"},
+	{EnvOTelTracesExporter, "otlp", "Traces exporter (only otlp)"},
+	{EnvOTelEndpoint, "", "OTLP collector base URL"},
+	{EnvOTelTracesEndpoint, "", "OTLP traces URL"},
+	{EnvOTelHeaders, "", "key=value headers sent with each export"},
+	{EnvOTelProtocol, "http/json", "OTLP protocol (only http/json)"},
+	{EnvOTelServiceName, "clamav-rest", "Service name resource attribute"},
+	{EnvOTelTracesSampler, "parentbased_always_on", "Trace sampler"},
+	{EnvOTelTracesSamplerArg, "", "Sampler argument (ratio for traceidratio)"},
+}
+
+// Settings given on the command line. They override the environment.
+var flagSettings = map[string]string{}
+
+// settingFlag is a flag.Value that records a setting given on the command
+// line. Its String is the default shown by -help.
+type settingFlag struct {
+	key string
+	def string
+}
+
+func (f *settingFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.def
+}
+
+func (f *settingFlag) Set(value string) error {
+	flagSettings[f.key] = value
+	return nil
+}
+
+// IsBoolFlag lets boolean settings be given without a value (-enable-diagnostics)
+func (f *settingFlag) IsBoolFlag() bool {
+	return f.def == "true" || f.def == "false"
+}
+
+// settingFlagName returns the flag for an environment variable,
+// e.g. MAX_UPLOAD_SIZE_MB -> max-upload-size-mb
+func settingFlagName(key string) string {
+	return strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+}
+
+// registerSettingFlags adds a flag for every setting, and for the secret
+// file variant of every secret setting
+func registerSettingFlags(flags *flag.FlagSet) {
+	for _, s := range configSettings {
+		flags.Var(&settingFlag{key: s.key, def: s.def}, settingFlagName(s.key), s.usage+" (env "+s.key+")")
+		if secretSettings[s.key] {
+			fileKey := s.key + secretFileSuffix
+			flags.Var(&settingFlag{key: fileKey}, settingFlagName(fileKey), "File containing "+settingFlagName(s.key)+" (env "+fileKey+")")
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+// parseSettingFlags parses args into flagSettings, resetting them after the test
+func parseSettingFlags(t *testing.T, args ...string) {
+	t.Helper()
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	registerSettingFlags(flags)
+	t.Cleanup(func() { flagSettings = map[string]string{} })
+
+	if err := flags.Parse(args); err != nil {
+		t.Fatalf("Parse(%v) error = %v", args, err)
+	}
+}
+
+func TestSettingFlagName(t *testing.T) {
+	if got := settingFlagName(EnvMaxUploadSize); got != "max-upload-size-mb" {
+		t.Errorf("settingFlagName() = %q", got)
+	}
+}
+
+func TestSettingFlagsPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `{"port": "7000", "max_file_count": 5, "scan_queue_size": 7}`)
+	if err := LoadConfigFile(path); err != nil {
+		t.Fatalf("LoadConfigFile() error = %v", err)
+	}
+	t.Setenv(EnvPort, "8000")
+	t.Setenv(EnvMaxFileCount, "6")
+
+	parseSettingFlags(t, "-port", "9100", "-enable-diagnostics")
+	cfg := LoadConfig()
+
+	if cfg.Port != "9100" {
+		t.Errorf("Port = %q, want flag value", cfg.Port)
+	}
+	if cfg.MaxFileCount != 6 {
+		t.Errorf("MaxFileCount = %d, want env value", cfg.MaxFileCount)
+	}
+	if cfg.ScanQueueSize != 7 {
+		t.Errorf("ScanQueueSize = %d, want config file value", cfg.ScanQueueSize)
+	}
+	if cfg.ScanTimeout.Minutes() != DefaultScanTimeoutMins {
+		t.Errorf("ScanTimeout = %v, want default", cfg.ScanTimeout)
+	}
+	if !cfg.EnableDiagnostics {
+		t.Error("boolean flag without value not applied")
+	}
+}
+
+func TestSettingFlagsSecretFile(t *testing.T) {
+	parseSettingFlags(t, "-jwt-secret-file", writeSecretFile(t, "s3cret\n"))
+
+	if got := LoadConfig().JWTSecret; got != "s3cret" {
+		t.Errorf("JWTSecret = %q, want secret file contents", got)
+	}
+}
+
+func TestSettingFlagsUnknown(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	registerSettingFlags(flags)
+
+	if err := flags.Parse([]string{"-max-upload-size", "10"}); err == nil {
+		t.Error("Parse() accepted unknown flag")
+	}
+}
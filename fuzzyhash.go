@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ssdeep (context triggered piecewise hashing) parameters, as in the
+// reference implementation so digests can be compared with ssdeep -m
+const (
+	ssdeepRollingWindow = 7
+	ssdeepMinBlockSize  = 3
+	ssdeepHashPrime     = 0x01000193
+	ssdeepHashInit      = 0x28021967
+	ssdeepLength        = 64 // Maximum characters in the first digest part
+)
+
+const ssdeepBase64 = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// ssdeepRoll is the rolling hash over the last seven bytes that decides
+// where the input is cut into pieces
+type ssdeepRoll struct {
+	window     [ssdeepRollingWindow]byte
+	h1, h2, h3 uint32
+	n          int
+}
+
+func (r *ssdeepRoll) update(c byte) {
+	r.h2 -= r.h1
+	r.h2 += ssdeepRollingWindow * uint32(c)
+	r.h1 += uint32(c)
+	r.h1 -= uint32(r.window[r.n])
+	r.window[r.n] = c
+	r.n = (r.n + 1) % ssdeepRollingWindow
+	r.h3 = r.h3<<5 ^ uint32(c)
+}
+
+func (r *ssdeepRoll) sum() uint32 {
+	return r.h1 + r.h2 + r.h3
+}
+
+// ssdeepDigest is one part of an ssdeep signature: a piece hash character
+// for every cut point, with the last character absorbing the rest once
+// the digest is full
+type ssdeepDigest struct {
+	chars [ssdeepLength]byte
+	n     int    // Characters completed
+	max   int    // Capacity (64, or 32 for the second part)
+	full  bool   // The last character was written
+	h     uint32 // FNV-style hash of the current piece
+}
+
+func (d *ssdeepDigest) cut() {
+	d.chars[d.n] = ssdeepBase64[d.h%64]
+	if d.n < d.max-1 {
+		d.n++
+		d.h = ssdeepHashInit
+	} else {
+		d.full = true
+	}
+}
+
+// finish returns the digest, closing the last piece if the input did not
+// end on a cut point
+func (d *ssdeepDigest) finish(rollSum uint32) string {
+	s := string(d.chars[:d.n])
+	if rollSum != 0 {
+		s += string(ssdeepBase64[d.h%64])
+	} else if d.full {
+		s += string(d.chars[d.n])
+	}
+	return s
+}
+
+// computeSSDeep computes the ssdeep fuzzy hash of a file. The block size
+// guessed from the file size is halved, rereading the file, until the
+// first part is at least half full.
+func computeSSDeep(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	blockSize := uint32(ssdeepMinBlockSize)
+	for int64(blockSize)*ssdeepLength < info.Size() {
+		blockSize *= 2
+	}
+
+	for {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		first, second, err := ssdeepPass(bufio.NewReader(f), blockSize)
+		if err != nil {
+			return "", err
+		}
+		if blockSize > ssdeepMinBlockSize && len(first) < ssdeepLength/2 {
+			blockSize /= 2
+			continue
+		}
+		return fmt.Sprintf("%d:%s:%s", blockSize, first, second), nil
+	}
+}
+
+// ssdeepPass hashes the input with one block size, returning the digests
+// for blockSize and twice blockSize
+func ssdeepPass(r io.ByteReader, blockSize uint32) (string, string, error) {
+	var roll ssdeepRoll
+	first := ssdeepDigest{max: ssdeepLength, h: ssdeepHashInit}
+	second := ssdeepDigest{max: ssdeepLength / 2, h: ssdeepHashInit}
+
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", "", err
+		}
+
+		roll.update(c)
+		first.h = first.h*ssdeepHashPrime ^ uint32(c)
+		second.h = second.h*ssdeepHashPrime ^ uint32(c)
+
+		sum := roll.sum()
+		if sum%blockSize == blockSize-1 {
+			first.cut()
+		}
+		if sum%(2*blockSize) == 2*blockSize-1 {
+			second.cut()
+		}
+	}
+
+	sum := roll.sum()
+	return first.finish(sum), second.finish(sum), nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestComputeSSDeep(t *testing.T) {
+	dir := t.TempDir()
+	random := make([]byte, 20000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"empty", nil, "3::"},
+		{"short", []byte("hello world"), "3:iKFSMPn:rJPn"},
+		{"block size from file size", random, "384:meE86dAfwMl/10Aul7ViZi8eL8loZKfpKhyQrCRT1ZBMANlIZSuK/u:meE7mlHmRZnCRFRwSuK/u"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, tt.content, 0644); err != nil {
+				t.Fatalf("failed to write file: %v", err)
+			}
+			got, err := computeSSDeep(path)
+			if err != nil {
+				t.Fatalf("computeSSDeep() error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("computeSSDeep() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComputeSSDeepSimilarFiles(t *testing.T) {
+	dir := t.TempDir()
+	random := make([]byte, 20000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	// Cutting 100 bytes out of the middle only changes the pieces around the cut
+	edited := append(append([]byte{}, random[:10000]...), random[10100:]...)
+	original, edit := filepath.Join(dir, "original"), filepath.Join(dir, "edited")
+	os.WriteFile(original, random, 0644)
+	os.WriteFile(edit, edited, 0644)
+
+	a, _ := computeSSDeep(original)
+	b, _ := computeSSDeep(edit)
+	if a == b {
+		t.Fatal("different files should not have the same hash")
+	}
+	prefixA, prefixB := strings.SplitN(a, ":", 3)[1], strings.SplitN(b, ":", 3)[1]
+	if prefixA[:16] != prefixB[:16] || prefixA[len(prefixA)-16:] != prefixB[len(prefixB)-16:] {
+		t.Errorf("hashes %q and %q do not share the unchanged pieces", a, b)
+	}
+}
+
+func TestComputeSSDeepNotFound(t *testing.T) {
+	if _, err := computeSSDeep(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("computeSSDeep() should fail for a missing file")
+	}
+}
+
+func TestScanHandlerFuzzyHashing(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.FuzzyHashing = true
+
+	body, contentType := multipartUpload(t, "eicar.com", []byte("EICAR"))
+	req := httptest.NewRequest(http.MethodPost, "/scan", body)
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+
+	handleScan(recorder, req, cfg, NewScanner(cfg))
+
+	var response ScanResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if len(response.Threats) != 1 || !strings.HasPrefix(response.Threats[0].SSDeep, "3:") {
+		t.Errorf("threats = %+v, want an ssdeep hash", response.Threats)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Google Cloud Storage API
+const (
+	gcsEndpoint  = "https://storage.googleapis.com"
+	gcsReadScope = "https://www.googleapis.com/auth/devstorage.read_only"
+)
+
+// gcsBucketPattern matches valid bucket names (dotted names may be longer)
+var gcsBucketPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{1,220}[a-z0-9]$`)
+
+// gcsStore reads objects through the Cloud Storage JSON API, authenticated
+// with a service account key or anonymously for public objects
+type gcsStore struct {
+	client   *http.Client
+	endpoint string             // API base URL (overridden in tests)
+	account  *gcsServiceAccount // nil = anonymous
+
+	mu     sync.Mutex
+	token  string // Cached access token
+	expiry time.Time
+}
+
+// gcsServiceAccount holds the fields of a service account JSON key
+type gcsServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+}
+
+// newGCSStore creates the GCS store, loading the service account key if
+// one is configured
+func newGCSStore(config *Config) (*gcsStore, error) {
+	s := &gcsStore{client: newOutboundClient(0), endpoint: gcsEndpoint}
+	if config.GCSCredentialsFile == "" {
+		return s, nil
+	}
+	account, err := loadGCSServiceAccount(config.GCSCredentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", EnvGCSCredentialsFile, err)
+	}
+	s.account = account
+	return s, nil
+}
+
+// loadGCSServiceAccount reads a service account JSON key file
+func loadGCSServiceAccount(path string) (*gcsServiceAccount, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var account gcsServiceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("invalid service account key: %w", err)
+	}
+	if account.ClientEmail == "" || account.TokenURI == "" {
+		return nil, errors.New("service account key lacks client_email or token_uri")
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("service account key has no PEM private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		account.key = key
+		return &account, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	account.key = rsaKey
+	return &account, nil
+}
+
+// Locate checks the bucket and object names
+func (s *gcsStore) Locate(bucket, object string) (string, error) {
+	if !gcsBucketPattern.MatchString(bucket) {
+		return "", errors.New("invalid bucket name")
+	}
+	if object == "" || len(object) > 1024 || strings.ContainsAny(object, "\r\n") {
+		return "", errors.New("invalid object name")
+	}
+	return "gs://" + bucket + "/" + object, nil
+}
+
+// Open downloads the object's contents (alt=media)
+func (s *gcsStore) Open(ctx context.Context, bucket, object string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		s.endpoint+"/storage/v1/b/"+url.PathEscape(bucket)+"/o/"+url.PathEscape(object)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.account != nil {
+		token, err := s.accessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStorageResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// accessToken returns a read-only OAuth access token for the service
+// account, exchanging a signed JWT assertion (RFC 7523) when the cached
+// token is about to expire
+func (s *gcsStore) accessToken(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Until(s.expiry) > time.Minute {
+		return s.token, nil
+	}
+
+	assertion, err := s.account.assertion(time.Now())
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkStorageResponse(resp); err != nil {
+		return "", err
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil || token.AccessToken == "" {
+		return "", errors.New("invalid token response")
+	}
+	s.token = token.AccessToken
+	s.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// assertion builds the RS256-signed JWT exchanged for an access token
+func (a *gcsServiceAccount) assertion(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   a.ClientEmail,
+		"scope": gcsReadScope,
+		"aud":   a.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(nil, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
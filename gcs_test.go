@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeGCS serves a token endpoint and one private object
+type fakeGCS struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	tokens atomic.Int32
+}
+
+func newFakeGCS(t *testing.T) *fakeGCS {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	f := &fakeGCS{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", f.token)
+	mux.HandleFunc("/storage/v1/b/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.EscapedPath() != "/storage/v1/b/scans/o/in%2Freport.txt" || r.URL.Query().Get("alt") != "media" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "object contents")
+	})
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// token checks the JWT assertion's signature and claims
+func (f *fakeGCS) token(w http.ResponseWriter, r *http.Request) {
+	f.tokens.Add(1)
+	r.ParseForm()
+	parts := strings.Split(r.PostForm.Get("assertion"), ".")
+	if r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(parts) != 3 {
+		http.Error(w, "invalid grant", http.StatusBadRequest)
+		return
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if err := rsa.VerifyPKCS1v15(&f.key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		http.Error(w, "invalid signature", http.StatusBadRequest)
+		return
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims map[string]any
+	json.Unmarshal(payload, &claims)
+	if claims["iss"] != "scanner@project.iam.gserviceaccount.com" || claims["scope"] != gcsReadScope || claims["aud"] != f.server.URL+"/token" {
+		http.Error(w, "invalid claims", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"access_token": "test-token", "expires_in": 3600})
+}
+
+// writeCredentials writes a service account key file for the fake server
+func (f *fakeGCS) writeCredentials(t *testing.T) string {
+	t.Helper()
+	der, _ := x509.MarshalPKCS8PrivateKey(f.key)
+	data, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "scanner@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    f.server.URL + "/token",
+	})
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write credentials: %v", err)
+	}
+	return path
+}
+
+func TestGCSStoreOpen(t *testing.T) {
+	fake := newFakeGCS(t)
+	s, err := newGCSStore(&Config{GCSCredentialsFile: fake.writeCredentials(t)})
+	if err != nil {
+		t.Fatalf("newGCSStore() error: %v", err)
+	}
+	s.endpoint = fake.server.URL
+
+	for i := 0; i < 2; i++ {
+		body, err := s.Open(context.Background(), "scans", "in/report.txt")
+		if err != nil {
+			t.Fatalf("Open() error: %v", err)
+		}
+		data, _ := io.ReadAll(body)
+		body.Close()
+		if string(data) != "object contents" {
+			t.Errorf("Open() = %q", data)
+		}
+	}
+	if got := fake.tokens.Load(); got != 1 {
+		t.Errorf("token requests = %d, want 1 (cached)", got)
+	}
+
+	_, err = s.Open(context.Background(), "scans", "missing")
+	if got := storageRequestError(err); got.status != http.StatusNotFound {
+		t.Errorf("Open(missing) error = %v, want 404", err)
+	}
+}
+
+func TestGCSStoreAnonymous(t *testing.T) {
+	fake := newFakeGCS(t)
+	s, err := newGCSStore(&Config{})
+	if err != nil {
+		t.Fatalf("newGCSStore() error: %v", err)
+	}
+	s.endpoint = fake.server.URL
+
+	_, err = s.Open(context.Background(), "scans", "in/report.txt")
+	if got := storageRequestError(err); got.status != http.StatusForbidden {
+		t.Errorf("Open() error = %v, want 403 for a private object", err)
+	}
+}
+
+func TestGCSStoreLocate(t *testing.T) {
+	s := &gcsStore{}
+	tests := []struct {
+		bucket, object string
+		want           string
+		wantErr        bool
+	}{
+		{bucket: "scans", object: "in/report.txt", want: "gs://scans/in/report.txt"},
+		{bucket: "my.bucket-1", object: "a b", want: "gs://my.bucket-1/a b"},
+		{bucket: "Scans", object: "x", wantErr: true},
+		{bucket: "ab", object: "x", wantErr: true},
+		{bucket: "scans", object: "", wantErr: true},
+		{bucket: "scans", object: "a\nb", wantErr: true},
+		{bucket: "scans", object: strings.Repeat("x", 1025), wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := s.Locate(tt.bucket, tt.object)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("Locate(%q, %q) = %q, %v", tt.bucket, tt.object, got, err)
+		}
+	}
+}
+
+func TestNewGCSStoreInvalidCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	os.WriteFile(path, []byte(`{"client_email": "a@b", "token_uri": "https://oauth2.googleapis.com/token", "private_key": "none"}`), 0600)
+	if _, err := newGCSStore(&Config{GCSCredentialsFile: path}); err == nil {
+		t.Error("newGCSStore() accepted a key without a private key")
+	}
+	if _, err := newGCSStore(&Config{GCSCredentialsFile: path + ".missing"}); err == nil {
+		t.Error("newGCSStore() accepted a missing credentials file")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// hashAlgorithms are the digests HASH_ALGORITHMS can select. MD5 and SHA-1
+// are only reported for lookups in threat intelligence systems that key on
+// them; they are never used to decide a verdict.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// computeFileHashes computes the named digests of a file in one pass.
+// Returns nil if no algorithms are given.
+func computeFileHashes(filePath string, algorithms []string) (map[string]string, error) {
+	if len(algorithms) == 0 {
+		return nil, nil
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hashes, _, err := hashReader(f, algorithms)
+	return hashes, err
+}
+
+// hashReader computes the named digests of everything read from r in one
+// pass, and returns them with the number of bytes read
+func hashReader(r io.Reader, algorithms []string) (map[string]string, int64, error) {
+	hashers := make(map[string]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, 0, len(algorithms))
+	for _, name := range algorithms {
+		h := hashAlgorithms[name]()
+		hashers[name] = h
+		writers = append(writers, h)
+	}
+	size, err := io.Copy(io.MultiWriter(writers...), r)
+	if err != nil {
+		return nil, size, err
+	}
+
+	hashes := make(map[string]string, len(hashers))
+	for name, h := range hashers {
+		hashes[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return hashes, size, nil
+}
+
+// HashResponse is the JSON response of POST /hash
+type HashResponse struct {
+	Hashes     map[string]string `json:"hashes"`             // Digests by algorithm
+	Size       int64             `json:"size"`               // Bytes hashed
+	HashTimeMs int64             `json:"hash_time_ms"`       // Request duration in milliseconds
+	Metadata   json.RawMessage   `json:"metadata,omitempty"` // Caller metadata, echoed back
+}
+
+// hashHandler handles POST /hash (and PUT with the file as the body): the
+// upload is hashed with SHA-256 and every HASH_ALGORITHMS digest as it is
+// received, without being scanned or written to disk
+func hashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	startTime := time.Now()
+	if reqErr := checkContentLength(r, config); reqErr != nil {
+		sendRequestError(w, reqErr)
+		return
+	}
+	body, filename, metadata, _, reqErr := openUploadBody(w, r, config)
+	if reqErr != nil {
+		sendRequestError(w, reqErr)
+		return
+	}
+	defer body.Close()
+
+	algorithms := []string{"sha256"}
+	for _, name := range config.HashAlgorithms {
+		if !containsString(algorithms, name) {
+			algorithms = append(algorithms, name)
+		}
+	}
+	hashes, size, err := hashReader(body, algorithms)
+	if err != nil {
+		log.Printf("Failed to hash upload: %v", err)
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			sendRequestError(w, uploadTooLarge(tooLarge.Limit))
+		case isCorruptCompression(err):
+			sendErrorStatus(w, http.StatusBadRequest, "Invalid compressed request body")
+		default:
+			sendErrorStatus(w, http.StatusBadRequest, "Failed to read upload")
+		}
+		return
+	}
+	metrics.Count("hash.bytes", size)
+	log.Printf("Hashed file: %s (%d bytes)", sanitizeFilename(filename), size)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&HashResponse{
+		Hashes:     hashes,
+		Size:       size,
+		HashTimeMs: time.Since(startTime).Milliseconds(),
+		Metadata:   metadata,
+	})
+}
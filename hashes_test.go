@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestComputeFileHashes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	writeTestFile(t, path, "hello world")
+
+	hashes, err := computeFileHashes(path, []string{"md5", "sha1", "sha256"})
+	if err != nil {
+		t.Fatalf("computeFileHashes() error: %v", err)
+	}
+	want := map[string]string{
+		"md5":    "5eb63bbbe01eeed093cb22bb8f5acdc3",
+		"sha1":   "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed",
+		"sha256": "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+	}
+	for name, digest := range want {
+		if hashes[name] != digest {
+			t.Errorf("%s = %q, want %q", name, hashes[name], digest)
+		}
+	}
+	if len(hashes) != len(want) {
+		t.Errorf("got %d hashes, want %d", len(hashes), len(want))
+	}
+}
+
+func TestComputeFileHashesNone(t *testing.T) {
+	// Disabled: the file is not even opened
+	hashes, err := computeFileHashes(filepath.Join(t.TempDir(), "missing"), nil)
+	if hashes != nil || err != nil {
+		t.Errorf("computeFileHashes() = %v, %v, want nil, nil", hashes, err)
+	}
+}
+
+func TestValidateHashAlgorithms(t *testing.T) {
+	cfg := &Config{HashAlgorithms: []string{"sha1", "crc32"}}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), `unknown algorithm "crc32"`) {
+		t.Errorf("Validate() = %v, want unknown algorithm error", err)
+	}
+}
+
+func TestScanHandlerHashes(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.HashAlgorithms = []string{"md5", "sha1"}
+
+	body, contentType := multipartUpload(t, "eicar.com", []byte("EICAR"))
+	req := httptest.NewRequest(http.MethodPost, "/scan", body)
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+
+	handleScan(recorder, req, cfg, NewScanner(cfg))
+
+	var response ScanResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if response.Hashes["md5"] != "998a38ee3e5d17dd1081fcd96ee81342" || response.Hashes["sha1"] == "" || response.Hashes["sha256"] != "" {
+		t.Errorf("upload hashes = %v", response.Hashes)
+	}
+	if len(response.Threats) != 1 || response.Threats[0].Hashes["md5"] != response.Hashes["md5"] {
+		t.Errorf("threats = %+v", response.Threats)
+	}
+}
+
+func TestHashHandler(t *testing.T) {
+	oldConfig := config
+	config = &Config{MaxUploadSize: 1024, MetadataMaxBytes: 256, HashAlgorithms: []string{"md5"}}
+	t.Cleanup(func() { config = oldConfig })
+
+	body, contentType := multipartUpload(t, "test.txt", []byte("hello world"))
+	req := httptest.NewRequest(http.MethodPost, "/hash", body)
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+	hashHandler(recorder, req)
+
+	var response HashResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("status %d, decode error %v", recorder.Code, err)
+	}
+	want := map[string]string{
+		"md5":    "5eb63bbbe01eeed093cb22bb8f5acdc3",
+		"sha256": "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+	}
+	if response.Size != 11 || len(response.Hashes) != 2 || response.Hashes["md5"] != want["md5"] || response.Hashes["sha256"] != want["sha256"] {
+		t.Errorf("response = %+v, want 11 bytes with %v", response, want)
+	}
+
+	// PUT sends the file as the body; the size limit applies while reading
+	req = httptest.NewRequest(http.MethodPut, "/hash", strings.NewReader(strings.Repeat("x", 1025)))
+	req.ContentLength = -1
+	recorder = httptest.NewRecorder()
+	hashHandler(recorder, req)
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversize PUT: status %d, want 413", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	hashHandler(recorder, httptest.NewRequest(http.MethodGet, "/hash", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want 405", recorder.Code)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ClamAV heuristic alert categories (HEURISTIC_ALERTS, ?heuristics=). The
+// entrypoint turns each enabled one on in clamd.conf.
+const (
+	heuristicMacros    = "macros"    // AlertOLE2Macros: Office documents with VBA macros
+	heuristicEncrypted = "encrypted" // AlertEncryptedDoc, AlertEncryptedArchive: encrypted documents and archives
+	heuristicBroken    = "broken"    // AlertBrokenExecutables: malformed PE and ELF files
+	heuristicLimits    = "limits"    // AlertExceedsMax: files not fully scanned for MaxScanSize, MaxRecursion, ...
+)
+
+// Header and query parameter selecting the heuristic alerts a caller wants
+const (
+	heuristicsHeader = "X-Heuristic-Alerts"
+	heuristicsParam  = "heuristics"
+)
+
+// heuristicCategories are the known categories, in the order they are listed
+var heuristicCategories = []string{heuristicMacros, heuristicEncrypted, heuristicBroken, heuristicLimits}
+
+// heuristicPrefixes maps the detection names clamd reports for each
+// category. Other heuristics (e.g. phishing) are always reported.
+var heuristicPrefixes = []struct {
+	prefix   string
+	category string
+}{
+	{"Heuristics.OLE2.ContainsMacros", heuristicMacros},
+	{"Heuristics.Encrypted.", heuristicEncrypted},
+	{"Heuristics.Broken.", heuristicBroken},
+	{"Heuristics.Limits.Exceeded.", heuristicLimits},
+}
+
+// heuristicCategory returns the category of a detection name, or "" if it
+// isn't one of the optional heuristic alerts
+func heuristicCategory(name string) string {
+	for _, p := range heuristicPrefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			return p.category
+		}
+	}
+	return ""
+}
+
+// parseHeuristics parses a comma-separated list of categories. "all" stands
+// for every category and "none" for none.
+func parseHeuristics(value string) ([]string, error) {
+	categories := []string{}
+	for _, name := range strings.Split(value, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "", "none":
+		case "all":
+			categories = append(categories, heuristicCategories...)
+		case heuristicMacros, heuristicEncrypted, heuristicBroken, heuristicLimits:
+			categories = append(categories, name)
+		default:
+			return nil, fmt.Errorf("unknown heuristic alert %q (%s, all or none)", name, strings.Join(heuristicCategories, ", "))
+		}
+	}
+	return categories, nil
+}
+
+// heuristicsKey is the context key for the categories a request reports
+type heuristicsKey struct{}
+
+// withHeuristics returns ctx with the heuristic alert categories its scans
+// report
+func withHeuristics(ctx context.Context, categories []string) context.Context {
+	return context.WithValue(ctx, heuristicsKey{}, categories)
+}
+
+// requestHeuristics returns the categories the caller asked for with
+// ?heuristics= or X-Heuristic-Alerts (nil = not set), or an error if one is
+// unknown or not turned on with HEURISTIC_ALERTS
+func requestHeuristics(r *http.Request, config *Config) ([]string, *requestError) {
+	value := r.URL.Query().Get(heuristicsParam)
+	if value == "" {
+		value = r.Header.Get(heuristicsHeader)
+	}
+	if value == "" {
+		return nil, nil
+	}
+	categories, err := parseHeuristics(value)
+	if err != nil {
+		return nil, &requestError{status: http.StatusBadRequest, message: "Invalid heuristics: " + err.Error()}
+	}
+	enabled, _ := parseHeuristics(strings.Join(config.HeuristicAlerts, ","))
+	for _, category := range categories {
+		if !containsString(enabled, category) {
+			return nil, &requestError{status: http.StatusBadRequest, message: fmt.Sprintf("Heuristic alert %q is not enabled on this server", category)}
+		}
+	}
+	return categories, nil
+}
+
+// selectHeuristics applies the heuristic alerts asked for by the request.
+// Scans of requests without a selection report every alert clamd raises.
+func selectHeuristics(config *Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		categories, reqErr := requestHeuristics(r, config)
+		if reqErr != nil {
+			sendRequestError(w, reqErr)
+			return
+		}
+		if categories == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withHeuristics(r.Context(), categories)))
+	})
+}
+
+// filterHeuristics drops the heuristic alerts of categories the scan's
+// request did not ask for
+func filterHeuristics(ctx context.Context, threats []Threat) []Threat {
+	categories, ok := ctx.Value(heuristicsKey{}).([]string)
+	if !ok {
+		return threats
+	}
+	kept := threats[:0]
+	for _, threat := range threats {
+		if category := heuristicCategory(threat.Name); category == "" || containsString(categories, category) {
+			kept = append(kept, threat)
+		}
+	}
+	return kept
+}
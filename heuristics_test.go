@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseHeuristics(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{"", []string{}, false},
+		{"none", []string{}, false},
+		{"macros, encrypted", []string{heuristicMacros, heuristicEncrypted}, false},
+		{"all", heuristicCategories, false},
+		{"macros,pua", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseHeuristics(tt.value)
+		if !reflect.DeepEqual(got, tt.want) || (err != nil) != tt.wantErr {
+			t.Errorf("parseHeuristics(%q) = %v, %v; want %v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestRequestHeuristics(t *testing.T) {
+	cfg := &Config{HeuristicAlerts: []string{heuristicMacros, heuristicEncrypted}}
+	tests := []struct {
+		target  string
+		header  string
+		want    []string
+		wantErr bool
+	}{
+		{"/scan", "", nil, false},
+		{"/scan?heuristics=macros", "", []string{heuristicMacros}, false},
+		{"/scan", "encrypted", []string{heuristicEncrypted}, false},
+		{"/scan?heuristics=none", "macros", []string{}, false},
+		{"/scan?heuristics=broken", "", nil, true},
+		{"/scan?heuristics=all", "", nil, true},
+		{"/scan?heuristics=pua", "", nil, true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.target, nil)
+		if tt.header != "" {
+			req.Header.Set(heuristicsHeader, tt.header)
+		}
+		got, reqErr := requestHeuristics(req, cfg)
+		if !reflect.DeepEqual(got, tt.want) || (reqErr != nil) != tt.wantErr {
+			t.Errorf("%s %q: got %v, %v; want %v, error %v", tt.target, tt.header, got, reqErr, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSelectHeuristics(t *testing.T) {
+	cfg := &Config{HeuristicAlerts: []string{"all"}}
+	threats := []Threat{
+		{Name: "Eicar-Signature", File: "eicar.com"},
+		{Name: "Heuristics.OLE2.ContainsMacros", File: "report.doc"},
+		{Name: "Heuristics.Encrypted.Zip", File: "secret.zip"},
+		{Name: "Heuristics.Limits.Exceeded.MaxScanSize", File: "huge.iso"},
+		{Name: "Heuristics.Phishing.Email.SpoofedDomain", File: "mail.eml"},
+	}
+	var kept []string
+	handler := selectHeuristics(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kept = nil
+		for _, threat := range filterHeuristics(r.Context(), append([]Threat(nil), threats...)) {
+			kept = append(kept, threat.File)
+		}
+	}))
+
+	tests := []struct {
+		target string
+		want   []string
+	}{
+		{"/scan", []string{"eicar.com", "report.doc", "secret.zip", "huge.iso", "mail.eml"}},
+		{"/scan?heuristics=none", []string{"eicar.com", "mail.eml"}},
+		{"/scan?heuristics=encrypted,limits", []string{"eicar.com", "secret.zip", "huge.iso", "mail.eml"}},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, tt.target, nil))
+		if recorder.Code != http.StatusOK || !reflect.DeepEqual(kept, tt.want) {
+			t.Errorf("%s: status %d, threats %v; want %v", tt.target, recorder.Code, kept, tt.want)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	handler = selectHeuristics(&Config{}, handler)
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/scan?heuristics=macros", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("alert not turned on: status %d, want 400", recorder.Code)
+	}
+
+	if got := filterHeuristics(context.Background(), threats); len(got) != len(threats) {
+		t.Errorf("filterHeuristics() without a selection kept %d of %d threats", len(got), len(threats))
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Scan history defaults for GET /stats
+const (
+	defaultStatsWindow = 24 * time.Hour
+	defaultStatsTop    = 10
+	maxStatsTop        = 100
+)
+
+// HistoryRecord is one scan kept in the scan history
+type HistoryRecord struct {
+	Time       time.Time         `json:"time"`
+	Route      string            `json:"route"`
+	Tenant     string            `json:"tenant,omitempty"`
+	Identity   string            `json:"identity,omitempty"`
+	Filename   string            `json:"filename,omitempty"`
+	FileSize   int64             `json:"file_size"`
+	Status     string            `json:"status"`
+	Threats    []Threat          `json:"threats,omitempty"`
+	Hashes     map[string]string `json:"hashes,omitempty"` // Upload digests (HASH_ALGORITHMS)
+	DurationMs int64             `json:"duration_ms"`
+
+	Metadata json.RawMessage `json:"metadata,omitempty"` // Caller metadata sent with the scan
+}
+
+// ScanHistory keeps the most recent scan records in memory, oldest first,
+// and optionally in a JSON lines file that is reloaded on startup
+type ScanHistory struct {
+	mu      sync.Mutex
+	records []*HistoryRecord
+	max     int
+	path    string   // JSON lines copy ("" = memory only)
+	file    *os.File // path, open for appending
+	lines   int      // Records in the file, compacted at twice max
+	now     func() time.Time
+}
+
+// Global scan history (nil = disabled)
+var history *ScanHistory
+
+// NewScanHistory creates the scan history described by the config, loading
+// the records saved in SCAN_HISTORY_FILE. Returns nil when SCAN_HISTORY_SIZE
+// is not positive (disabled).
+func NewScanHistory(config *Config) (*ScanHistory, error) {
+	if config.ScanHistorySize <= 0 {
+		return nil, nil
+	}
+	h := &ScanHistory{max: config.ScanHistorySize, path: config.ScanHistoryFile, now: time.Now}
+	if h.path == "" {
+		return h, nil
+	}
+
+	if err := h.load(); err != nil {
+		return nil, fmt.Errorf("failed to load scan history: %w", err)
+	}
+	// Readable by the service user only; records name files and identities
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scan history: %w", err)
+	}
+	h.file = f
+	return h, nil
+}
+
+// load reads the records saved in the history file, keeping the newest max.
+// Unreadable lines (such as one cut off by a crash) are skipped.
+func (h *ScanHistory) load() error {
+	f, err := os.Open(h.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		h.lines++
+		var record HistoryRecord
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			continue
+		}
+		h.records = append(h.records, &record)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(h.records) > h.max {
+		h.records = h.records[len(h.records)-h.max:]
+	}
+	return nil
+}
+
+// Add records a scan, dropping the oldest record once max are kept.
+// Failures to save it are logged but never fail the scan request.
+func (h *ScanHistory) Add(record *HistoryRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.records = append(h.records, record)
+	if len(h.records) > h.max {
+		h.records[0] = nil
+		h.records = h.records[1:]
+	}
+	if h.file == nil {
+		return
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Warning: failed to encode scan history record: %v", err)
+		return
+	}
+	if _, err := h.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Warning: failed to write scan history: %v", err)
+		return
+	}
+	if h.lines++; h.lines >= 2*h.max {
+		if err := h.compact(); err != nil {
+			log.Printf("Warning: failed to compact scan history: %v", err)
+		}
+	}
+}
+
+// compact rewrites the history file with the records kept in memory.
+// Callers hold h.mu.
+func (h *ScanHistory) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(h.path), ".history-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, record := range h.records {
+		if err := encoder.Encode(record); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), h.path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	h.file.Close()
+	h.file, h.lines = f, len(h.records)
+	return nil
+}
+
+// Expire drops the records of scans before a time and returns how many
+func (h *ScanHistory) Expire(before time.Time) (int, error) {
+	return h.Remove(func(record *HistoryRecord) bool { return record.Time.Before(before) })
+}
+
+// Remove drops the records that match and returns how many. An error means
+// the history file could not be rewritten and still holds them.
+func (h *ScanHistory) Remove(match func(*HistoryRecord) bool) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	kept := make([]*HistoryRecord, 0, len(h.records))
+	for _, record := range h.records {
+		if !match(record) {
+			kept = append(kept, record)
+		}
+	}
+	removed := len(h.records) - len(kept)
+	if removed == 0 {
+		return 0, nil
+	}
+	h.records = kept
+	if h.file == nil {
+		return removed, nil
+	}
+	return removed, h.compact()
+}
+
+// Between returns the records of scans from since up to until, oldest
+// first, and the time of the oldest record kept (zero when empty)
+func (h *ScanHistory) Between(since, until time.Time) (records []*HistoryRecord, oldest time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.records) == 0 {
+		return nil, time.Time{}
+	}
+	start := sort.Search(len(h.records), func(i int) bool { return !h.records[i].Time.Before(since) })
+	end := sort.Search(len(h.records), func(i int) bool { return h.records[i].Time.After(until) })
+	if start < end {
+		records = append(records, h.records[start:end]...)
+	}
+	return records, h.records[0].Time
+}
+
+// recordHistory adds a scan response to the history, if enabled
+func recordHistory(doc *ScanDocument) {
+	if history == nil {
+		return
+	}
+	history.Add(&HistoryRecord{
+		Time:       doc.Timestamp,
+		Route:      doc.Route,
+		Tenant:     doc.Tenant,
+		Identity:   doc.Identity,
+		Filename:   doc.Filename,
+		FileSize:   doc.FileSize,
+		Status:     doc.Status,
+		Threats:    doc.Threats,
+		Hashes:     doc.Hashes,
+		DurationMs: doc.ScanTimeMs,
+		Metadata:   doc.Metadata,
+	})
+}
+
+// ScanStats aggregates the scans of a time window (GET /stats)
+type ScanStats struct {
+	Since         time.Time      `json:"since"`
+	Until         time.Time      `json:"until"`
+	HistoryStart  *time.Time     `json:"history_start,omitempty"` // Oldest scan kept; earlier scans are not counted
+	Scans         int            `json:"scans"`
+	Statuses      map[string]int `json:"statuses"` // Scans by status (clean, infected, error, ...)
+	Infected      int            `json:"infected"`
+	BytesScanned  int64          `json:"bytes_scanned"`
+	AvgDurationMs float64        `json:"avg_duration_ms"`
+	TopSignatures []StatsCount   `json:"top_signatures"` // By detections
+	TopTenants    []StatsCount   `json:"top_tenants"`    // By scans
+}
+
+// StatsCount is a name and how often it was seen
+type StatsCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// aggregateStats computes the statistics of records, listing the top most
+// frequent signatures and tenants
+func aggregateStats(records []*HistoryRecord, top int) *ScanStats {
+	stats := &ScanStats{Statuses: make(map[string]int)}
+	signatures := make(map[string]int)
+	byTenant := make(map[string]int)
+	var totalMs int64
+	for _, record := range records {
+		stats.Scans++
+		stats.Statuses[record.Status]++
+		stats.BytesScanned += record.FileSize
+		totalMs += record.DurationMs
+		for _, threat := range record.Threats {
+			signatures[threat.Name]++
+		}
+		if record.Tenant != "" {
+			byTenant[record.Tenant]++
+		}
+	}
+	stats.Infected = stats.Statuses["infected"]
+	if stats.Scans > 0 {
+		stats.AvgDurationMs = float64(totalMs) / float64(stats.Scans)
+	}
+	stats.TopSignatures = topCounts(signatures, top)
+	stats.TopTenants = topCounts(byTenant, top)
+	return stats
+}
+
+// topCounts returns the n most frequent names, most frequent first (ties by
+// name)
+func topCounts(counts map[string]int, n int) []StatsCount {
+	list := make([]StatsCount, 0, len(counts))
+	for name, count := range counts {
+		list = append(list, StatsCount{name, count})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list[:min(n, len(list))]
+}
+
+// scanStatsHandler serves GET /stats: aggregate counters of the scans in
+// the history over a time window. ?window= (Go duration, default 24h) sets
+// the window ending now, or ?since= and ?until= (RFC 3339) set it
+// explicitly. ?top= limits the top signature and tenant lists.
+func scanStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	since, until, reqErr := historyWindow(r, history.now())
+	if reqErr != nil {
+		sendRequestError(w, reqErr)
+		return
+	}
+	top := defaultStatsTop
+	if value := r.URL.Query().Get("top"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > maxStatsTop {
+			sendErrorStatus(w, http.StatusBadRequest, fmt.Sprintf("top must be between 0 and %d", maxStatsTop))
+			return
+		}
+		top = n
+	}
+
+	records, oldest := history.Between(since, until)
+	stats := aggregateStats(records, top)
+	stats.Since, stats.Until = since.UTC(), until.UTC()
+	if !oldest.IsZero() {
+		oldest = oldest.UTC()
+		stats.HistoryStart = &oldest
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// historyWindow parses a history query's ?since= and ?until= (RFC 3339),
+// or ?window= (Go duration, default 24h) ending at until
+func historyWindow(r *http.Request, now time.Time) (since, until time.Time, reqErr *requestError) {
+	query := r.URL.Query()
+	until = now
+	if value := query.Get("until"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return since, until, &requestError{status: http.StatusBadRequest, message: "until must be an RFC 3339 time"}
+		}
+		until = t
+	}
+	if value := query.Get("since"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return since, until, &requestError{status: http.StatusBadRequest, message: "since must be an RFC 3339 time"}
+		}
+		return t, until, nil
+	}
+	window := defaultStatsWindow
+	if value := query.Get("window"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return since, until, &requestError{status: http.StatusBadRequest, message: "window must be a positive duration such as 24h"}
+		}
+		window = d
+	}
+	return until.Add(-window), until, nil
+}
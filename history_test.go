@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScanHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	h, err := NewScanHistory(&Config{ScanHistorySize: 3, ScanHistoryFile: path})
+	if err != nil {
+		t.Fatalf("NewScanHistory() error: %v", err)
+	}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		h.Add(&HistoryRecord{Time: start.Add(time.Duration(i) * time.Hour), Status: "clean", FileSize: int64(i)})
+	}
+
+	// Only the newest three are kept, and the file was compacted at six lines
+	records, oldest := h.Between(start, start.Add(24*time.Hour))
+	if len(records) != 3 || records[0].FileSize != 2 || !oldest.Equal(start.Add(2*time.Hour)) {
+		t.Fatalf("Between() = %d records from %v", len(records), oldest)
+	}
+	if records, _ := h.Between(start.Add(3*time.Hour), start.Add(3*time.Hour)); len(records) != 1 || records[0].FileSize != 3 {
+		t.Errorf("Between() of one hour = %+v", records)
+	}
+	h.Add(&HistoryRecord{Time: start.Add(5 * time.Hour), Status: "infected"})
+	if data, _ := os.ReadFile(path); strings.Count(string(data), "\n") != 3 {
+		t.Errorf("history file not compacted:\n%s", data)
+	}
+
+	// A restart reloads the newest records, skipping a torn last line
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"time":`)
+	f.Close()
+	reloaded, err := NewScanHistory(&Config{ScanHistorySize: 3, ScanHistoryFile: path})
+	if err != nil {
+		t.Fatalf("NewScanHistory() reload error: %v", err)
+	}
+	if records, _ := reloaded.Between(start, start.Add(24*time.Hour)); len(records) != 3 || records[2].Status != "infected" {
+		t.Errorf("reloaded %+v", records)
+	}
+
+	if h, _ := NewScanHistory(&Config{}); h != nil {
+		t.Error("history with SCAN_HISTORY_SIZE 0 should be nil")
+	}
+}
+
+func TestAggregateStats(t *testing.T) {
+	eicar := Threat{Name: "Eicar-Signature"}
+	stats := aggregateStats([]*HistoryRecord{
+		{Status: "clean", Tenant: "acme", FileSize: 100, DurationMs: 10},
+		{Status: "infected", Tenant: "acme", FileSize: 50, DurationMs: 30, Threats: []Threat{eicar, eicar, {Name: "Win.Trojan.Agent"}}},
+		{Status: "infected", Tenant: "globex", DurationMs: 20, Threats: []Threat{{Name: "Win.Trojan.Agent"}}},
+	}, 1)
+
+	if stats.Scans != 3 || stats.Infected != 2 || stats.Statuses["clean"] != 1 || stats.BytesScanned != 150 || stats.AvgDurationMs != 20 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if len(stats.TopSignatures) != 1 || stats.TopSignatures[0] != (StatsCount{"Eicar-Signature", 2}) {
+		t.Errorf("top signatures = %+v", stats.TopSignatures)
+	}
+	if len(stats.TopTenants) != 1 || stats.TopTenants[0] != (StatsCount{"acme", 2}) {
+		t.Errorf("top tenants = %+v", stats.TopTenants)
+	}
+}
+
+func TestScanStatsHandler(t *testing.T) {
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	history, _ = NewScanHistory(&Config{ScanHistorySize: 10})
+	history.now = func() time.Time { return now }
+	t.Cleanup(func() { history = nil })
+	history.Add(&HistoryRecord{Time: now.Add(-48 * time.Hour), Status: "clean"})
+	history.Add(&HistoryRecord{Time: now.Add(-time.Hour), Status: "infected"})
+
+	get := func(query string) (*httptest.ResponseRecorder, ScanStats) {
+		recorder := httptest.NewRecorder()
+		scanStatsHandler(recorder, httptest.NewRequest(http.MethodGet, "/stats"+query, nil))
+		var stats ScanStats
+		json.NewDecoder(recorder.Body).Decode(&stats)
+		return recorder, stats
+	}
+
+	if _, stats := get(""); stats.Scans != 1 || stats.Infected != 1 || !stats.Since.Equal(now.Add(-24*time.Hour)) {
+		t.Errorf("default window: %+v", stats)
+	}
+	if _, stats := get("?window=72h"); stats.Scans != 2 || stats.HistoryStart == nil {
+		t.Errorf("72h window: %+v", stats)
+	}
+	if _, stats := get("?since=2023-12-31T00:00:00Z&until=2024-01-01T00:00:00Z"); stats.Scans != 1 || stats.Statuses["clean"] != 1 {
+		t.Errorf("explicit window: %+v", stats)
+	}
+	for _, query := range []string{"?window=-1h", "?window=day", "?since=yesterday", "?top=1000"} {
+		if recorder, _ := get(query); recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build go1.24
+
+package main
+
+import "net/http"
+
+// Cleartext HTTP/2 needs Go 1.24 (http.Protocols)
+const h2cSupported = true
+
+// configureHTTP2 serves HTTP/2 over TLS (negotiated with ALPN) and cleartext
+// HTTP/2 with prior knowledge (h2c) next to HTTP/1.1, or HTTP/1.1 only
+func configureHTTP2(server *http.Server, enabled bool) {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(enabled)
+	protocols.SetUnencryptedHTTP2(enabled)
+	server.Protocols = protocols
+}
@@ -0,0 +1,19 @@
+//go:build !go1.24
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// Cleartext HTTP/2 needs Go 1.24 (http.Protocols)
+const h2cSupported = false
+
+// configureHTTP2 leaves HTTP/2 over TLS enabled (the net/http default), or
+// disables it. Cleartext HTTP/2 isn't available in this build.
+func configureHTTP2(server *http.Server, enabled bool) {
+	if !enabled {
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+}
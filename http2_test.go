@@ -0,0 +1,38 @@
+//go:build go1.24
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConfigureHTTP2Cleartext(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}))
+		configureHTTP2(server.Config, enabled)
+		server.Start()
+
+		protocols := new(http.Protocols)
+		protocols.SetUnencryptedHTTP2(true)
+		client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+		resp, err := client.Get(server.URL)
+		if enabled {
+			if err != nil {
+				t.Fatalf("h2c request error = %v", err)
+			}
+			if resp.ProtoMajor != 2 {
+				t.Errorf("protocol = %s, want HTTP/2", resp.Proto)
+			}
+			resp.Body.Close()
+		} else if err == nil {
+			resp.Body.Close()
+			t.Errorf("h2c request succeeded with HTTP/2 disabled (%s)", resp.Proto)
+		}
+		server.Close()
+	}
+}
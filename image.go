@@ -0,0 +1,793 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registry API limits
+const (
+	registryTimeout      = 30 * time.Second // Manifest and token requests
+	registryManifestSize = 4 << 20          // Largest manifest or index accepted
+	defaultImagePlatform = "linux/amd64"
+	dockerHubRegistry    = "docker.io"
+	dockerHubAPIHost     = "registry-1.docker.io"
+)
+
+// Manifest media types, most specific first in the Accept header
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// ImageScanRequest is the body of POST /scan/image
+type ImageScanRequest struct {
+	Image    string `json:"image"`              // e.g. "alpine:3.19" or "ghcr.io/org/app@sha256:..."
+	Username string `json:"username,omitempty"` // Registry credentials (optional)
+	Password string `json:"password,omitempty"` // Password or access token
+	Platform string `json:"platform,omitempty"` // os/arch[/variant] for multi-platform images
+}
+
+// ImageScanResponse is the result of an image scan. The image is infected
+// if any layer is, or a layer that timed out had threats; a layer that could
+// not be scanned, or timed out clean, makes it "error", and one with skipped
+// files "clean_with_skips".
+type ImageScanResponse struct {
+	Status       string         `json:"status"` // "clean", "clean_with_skips", "infected", "error"
+	Image        string         `json:"image"`  // Normalized reference
+	Digest       string         `json:"digest"` // Manifest digest
+	Platform     string         `json:"platform"`
+	Layers       []*LayerResult `json:"layers"`
+	ScannedFiles int            `json:"scanned_files"`
+	ScanTimeMs   int64          `json:"scan_time_ms"`
+	EngineInfo                  // Engine and signatures of this scan (cached layers match their version)
+}
+
+// LayerResult is the verdict for one image layer
+type LayerResult struct {
+	Digest       string        `json:"digest"`
+	Size         int64         `json:"size"`
+	Status       string        `json:"status"`  // "clean", "clean_with_skips", "infected", "timeout" (partial), "error"
+	Threats      []Threat      `json:"threats"` // Files are paths within the layer
+	ScannedFiles int           `json:"scanned_files"`
+	SkippedFiles []SkippedFile `json:"skipped_files,omitempty"` // Files not scanned themselves, with the reason
+	Cached       bool          `json:"cached"`                  // Verdict reused from an earlier scan
+	Error        string        `json:"error,omitempty"`
+}
+
+// imageRef is a parsed image reference
+type imageRef struct {
+	registry   string // e.g. docker.io, ghcr.io, localhost:5000
+	repository string // e.g. library/alpine
+	reference  string // Tag or digest
+}
+
+var (
+	repositoryPattern = regexp.MustCompile(`^[a-z0-9]+(?:[._-]+[a-z0-9]+)*(?:/[a-z0-9]+(?:[._-]+[a-z0-9]+)*)*$`)
+	tagPattern        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	digestPattern     = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+	challengePattern  = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// parseImageRef parses a reference the way docker does: the first path
+// component is a registry if it looks like a host, Docker Hub otherwise,
+// and the tag defaults to latest
+func parseImageRef(s string) (*imageRef, error) {
+	ref := &imageRef{registry: dockerHubRegistry}
+	name := s
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.reference = name[:i], name[i+1:]
+		if !digestPattern.MatchString(ref.reference) {
+			return nil, fmt.Errorf("invalid digest %q (only sha256 is supported)", ref.reference)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		tag := name[i+1:]
+		name = name[:i]
+		if !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		if ref.reference == "" {
+			ref.reference = tag // A digest wins over the tag
+		}
+	}
+	if ref.reference == "" {
+		ref.reference = "latest"
+	}
+
+	if i := strings.Index(name, "/"); i >= 0 {
+		first := name[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			ref.registry, name = first, name[i+1:]
+		}
+	}
+	if ref.registry == dockerHubRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if !repositoryPattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid repository %q", name)
+	}
+	ref.repository = name
+	return ref, nil
+}
+
+// String returns the normalized reference
+func (ref *imageRef) String() string {
+	if strings.HasPrefix(ref.reference, "sha256:") {
+		return ref.registry + "/" + ref.repository + "@" + ref.reference
+	}
+	return ref.registry + "/" + ref.repository + ":" + ref.reference
+}
+
+// apiHost returns the host serving the registry API
+func (ref *imageRef) apiHost() string {
+	if ref.registry == dockerHubRegistry {
+		return dockerHubAPIHost
+	}
+	return ref.registry
+}
+
+// ImageScanner pulls images from allowed registries and scans them layer
+// by layer, caching verdicts per layer digest
+type ImageScanner struct {
+	config  *Config
+	scanner *Scanner
+	client  *http.Client
+	cache   *layerCache
+	scheme  string // https; tests use plain HTTP registries
+}
+
+// Global image scanner (nil = POST /scan/image disabled)
+var imageScanner *ImageScanner
+
+// NewImageScanner creates the image scanner. Returns nil if no registries
+// are allowed.
+func NewImageScanner(config *Config, scanner *Scanner) (*ImageScanner, error) {
+	if len(config.ImageRegistries) == 0 {
+		return nil, nil
+	}
+	for _, registry := range config.ImageRegistries {
+		if registry != "*" && strings.ContainsAny(registry, "/@ ") {
+			return nil, fmt.Errorf("invalid registry %q in %s (expected a host, e.g. ghcr.io)", registry, EnvImageRegistries)
+		}
+	}
+	cache, err := newLayerCache(config)
+	if err != nil {
+		return nil, err
+	}
+	return &ImageScanner{
+		config:  config,
+		scanner: scanner,
+		client:  newOutboundClient(0),
+		cache:   cache,
+		scheme:  "https",
+	}, nil
+}
+
+// allowed reports whether images may be pulled from the registry
+func (s *ImageScanner) allowed(registry string) bool {
+	for _, allowed := range s.config.ImageRegistries {
+		if allowed == "*" || strings.EqualFold(allowed, registry) {
+			return true
+		}
+	}
+	return false
+}
+
+// registryError is a failed registry request; status is the registry's
+type registryError struct {
+	status  int
+	message string
+}
+
+func (e *registryError) Error() string {
+	return fmt.Sprintf("registry returned %d: %s", e.status, e.message)
+}
+
+// registrySession talks to one repository, holding the credentials and
+// the token obtained from the registry's auth challenge
+type registrySession struct {
+	s             *ImageScanner
+	ref           *imageRef
+	username      string
+	password      string
+	authorization string
+}
+
+// get requests a registry API path, answering an auth challenge once
+func (rs *registrySession) get(ctx context.Context, path string, accept []string) (*http.Response, error) {
+	u := rs.s.scheme + "://" + rs.ref.apiHost() + "/v2/" + rs.ref.repository + path
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+		if rs.authorization != "" {
+			req.Header.Set("Authorization", rs.authorization)
+		}
+		resp, err := rs.s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+
+		challenge := resp.Header.Get("WWW-Authenticate")
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 || challenge == "" {
+			return nil, &registryError{status: resp.StatusCode, message: strings.TrimSpace(string(body))}
+		}
+		if err := rs.authenticate(ctx, challenge); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// authenticate answers a Basic or Bearer challenge (docker token auth)
+func (rs *registrySession) authenticate(ctx context.Context, challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if rs.username == "" {
+			return &registryError{status: http.StatusUnauthorized, message: "registry requires credentials"}
+		}
+		rs.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(rs.username+":"+rs.password))
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("unsupported registry auth scheme %q", scheme)
+	}
+
+	values := make(map[string]string)
+	for _, match := range challengePattern.FindAllStringSubmatch(params, -1) {
+		values[strings.ToLower(match[1])] = match[2]
+	}
+	realm, err := url.Parse(values["realm"])
+	if err != nil || (realm.Scheme != "https" && realm.Scheme != rs.s.scheme) || realm.Host == "" {
+		return fmt.Errorf("invalid token realm %q", values["realm"])
+	}
+	query := realm.Query()
+	if values["service"] != "" {
+		query.Set("service", values["service"])
+	}
+	query.Set("scope", "repository:"+rs.ref.repository+":pull")
+	realm.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, registryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if rs.username != "" {
+		req.SetBasicAuth(rs.username, rs.password)
+	}
+	resp, err := rs.s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &registryError{status: resp.StatusCode, message: "token request rejected"}
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return fmt.Errorf("invalid token response: %w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return fmt.Errorf("registry returned no token")
+	}
+	rs.authorization = "Bearer " + token.Token
+	return nil
+}
+
+// descriptor references a manifest or blob
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+		Variant      string `json:"variant"`
+	} `json:"platform,omitempty"`
+}
+
+// manifest is an image manifest or, with Manifests set, an index of them
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []descriptor `json:"manifests"`
+	Layers    []descriptor `json:"layers"`
+}
+
+// fetchManifest gets a manifest by tag or digest and verifies its digest.
+// Returns the manifest and its digest.
+func (rs *registrySession) fetchManifest(ctx context.Context, reference string) (*manifest, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, registryTimeout)
+	defer cancel()
+	resp, err := rs.get(ctx, "/manifests/"+reference, manifestMediaTypes)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, registryManifestSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(body) > registryManifestSize {
+		return nil, "", fmt.Errorf("manifest exceeds %d bytes", registryManifestSize)
+	}
+	sum := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if strings.HasPrefix(reference, "sha256:") && reference != digest {
+		return nil, "", fmt.Errorf("manifest digest mismatch: got %s", digest)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, "", fmt.Errorf("invalid manifest: %w", err)
+	}
+	return &m, digest, nil
+}
+
+// resolve returns the manifest digest and layers of the image, picking
+// the platform from a multi-platform index
+func (rs *registrySession) resolve(ctx context.Context, platform string) (string, []descriptor, error) {
+	m, digest, err := rs.fetchManifest(ctx, rs.ref.reference)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(m.Manifests) > 0 {
+		var chosen string
+		for _, candidate := range m.Manifests {
+			p := candidate.Platform
+			if p == nil {
+				continue
+			}
+			name := p.OS + "/" + p.Architecture
+			if name == platform || p.Variant != "" && name+"/"+p.Variant == platform {
+				chosen = candidate.Digest
+				break
+			}
+		}
+		if chosen == "" || !digestPattern.MatchString(chosen) {
+			return "", nil, &registryError{status: http.StatusNotFound, message: "no manifest for platform " + platform}
+		}
+		if m, digest, err = rs.fetchManifest(ctx, chosen); err != nil {
+			return "", nil, err
+		}
+	}
+	for _, layer := range m.Layers {
+		if !digestPattern.MatchString(layer.Digest) {
+			return "", nil, fmt.Errorf("unsupported layer digest %q", layer.Digest)
+		}
+	}
+	return digest, m.Layers, nil
+}
+
+// downloadLayer streams a layer blob to a temp file, verifying its size
+// and digest. The caller removes the file.
+func (rs *registrySession) downloadLayer(ctx context.Context, layer descriptor) (string, error) {
+	resp, err := rs.get(ctx, "/blobs/"+layer.Digest, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	f, err := os.CreateTemp(scanTmpDir, "clamav-layer-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	limit := rs.s.config.ImageMaxLayerSize
+	written, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(resp.Body, limit+1))
+	switch {
+	case err != nil:
+		err = fmt.Errorf("layer download failed: %w", err)
+	case written > limit:
+		err = fmt.Errorf("layer exceeds size limit (%d bytes)", limit)
+	case "sha256:"+hex.EncodeToString(h.Sum(nil)) != layer.Digest:
+		err = fmt.Errorf("layer digest mismatch")
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// extractLayer unpacks a (gzip-compressed) tar layer into targetDir,
+// enforcing the extraction limits. Only regular files are extracted;
+// links, devices and whiteouts are skipped. The files count against budget
+// (if set), which the image's layers share.
+func (s *Scanner) extractLayer(layerPath, targetDir string, index *entryIndex, budget *requestBudget) (int, []SkippedFile, error) {
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	buffered := bufio.NewReader(f)
+	var r io.Reader = buffered
+	if magic, _ := buffered.Peek(4); bytes.HasPrefix(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer gz.Close()
+		r = gz
+	} else if bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		return 0, nil, fmt.Errorf("zstd-compressed layers are not supported")
+	}
+
+	return extractTar(r, targetDir, s.config, "layer", isWhiteout, index, budget)
+}
+
+// isWhiteout reports whether a layer entry marks a deleted file
+func isWhiteout(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), ".wh.")
+}
+
+// scanLayer downloads, unpacks and scans one layer, or returns the cached
+// verdict for its digest
+func (s *ImageScanner) scanLayer(ctx context.Context, rs *registrySession, layer descriptor, dbVersion string) (*LayerResult, error) {
+	result := &LayerResult{Digest: layer.Digest, Size: layer.Size}
+	cacheKey := layer.Digest + "/" + dbVersion
+	if dbVersion != "" {
+		if cached := s.cache.Get(ctx, cacheKey); cached != nil {
+			result.Status, result.Threats, result.ScannedFiles, result.SkippedFiles, result.Cached = cached.Status, cached.Threats, cached.ScannedFiles, cached.SkippedFiles, true
+			return result, nil
+		}
+	}
+	if layer.Size > s.config.ImageMaxLayerSize {
+		result.Status, result.Error = "error", fmt.Sprintf("layer exceeds size limit (%d bytes)", s.config.ImageMaxLayerSize)
+		return result, nil
+	}
+
+	layerPath, err := rs.downloadLayer(ctx, layer)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(layerPath)
+
+	scanResult, err := runPooled(ctx, func(ctx context.Context) (*ScanResult, error) {
+		tempDir, err := os.MkdirTemp(scanTmpDir, "clamav-extract-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temp dir: %w", err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		index := newEntryIndex(s.config, tempDir)
+		fileCount, skipped, err := s.scanner.extractLayer(layerPath, tempDir, index, requestBudgetFrom(ctx))
+		if err != nil {
+			return nil, &layerError{err}
+		}
+		makeReadable(tempDir)
+		result, err := s.scanner.ScanDirectory(ctx, tempDir, fileCount)
+		if err != nil {
+			return nil, err
+		}
+		result.Skipped = skipped
+		index.expand(result)
+		return result, nil
+	})
+	var layerErr *layerError
+	if errors.As(err, &layerErr) {
+		// The layer can't be unpacked within the limits; report it unscanned
+		result.Status, result.Error = "error", layerErr.Error()
+		return result, nil
+	}
+	var timeout *scanTimeoutError
+	if errors.As(err, &timeout) {
+		// Not cached: a later scan may finish
+		result.Status, result.Error = "timeout", timeout.Error()
+		result.Threats, result.ScannedFiles = timeout.threats, timeout.scanned
+		if result.Threats == nil {
+			result.Threats = []Threat{}
+		}
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.Status = cleanStatus(scanResult.Skipped)
+	if len(scanResult.Threats) > 0 {
+		result.Status = "infected"
+	}
+	result.Threats, result.ScannedFiles, result.SkippedFiles = scanResult.Threats, scanResult.ScannedFiles, scanResult.Skipped
+	if result.Threats == nil {
+		result.Threats = []Threat{}
+	}
+	if dbVersion != "" {
+		s.cache.Put(ctx, cacheKey, result)
+	}
+	return result, nil
+}
+
+// layerError is a layer that could not be unpacked for scanning
+type layerError struct {
+	err error
+}
+
+func (e *layerError) Error() string { return e.err.Error() }
+
+// imageScanHandler handles POST /scan/image
+func imageScanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	startTime := time.Now()
+	if rejectWhileStarting(w, r, startTime) {
+		return
+	}
+
+	var request ImageScanRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		sendErrorStatus(w, http.StatusBadRequest, "Invalid image scan request")
+		return
+	}
+	ref, err := parseImageRef(request.Image)
+	if err != nil {
+		sendErrorStatus(w, http.StatusBadRequest, "Invalid image reference: "+err.Error())
+		return
+	}
+	if !imageScanner.allowed(ref.registry) {
+		sendErrorStatus(w, http.StatusForbidden, "Registry not allowed: "+ref.registry)
+		return
+	}
+	if request.Platform == "" {
+		request.Platform = defaultImagePlatform
+	}
+
+	response, reqErr := imageScanner.Scan(r.Context(), r, ref, &request, startTime)
+	if reqErr != nil {
+		recordScan(scanTags(r), "error", time.Since(startTime), 0, nil)
+		sendRequestError(w, reqErr)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Scan pulls and scans an image, layer by layer, and reports detections
+func (s *ImageScanner) Scan(ctx context.Context, r *http.Request, ref *imageRef, request *ImageScanRequest, startTime time.Time) (*ImageScanResponse, *requestError) {
+	image := sanitizeFilename(ref.String())
+	rs := &registrySession{s: s, ref: ref, username: request.Username, password: request.Password}
+	digest, layers, err := rs.resolve(ctx, request.Platform)
+	if err != nil {
+		log.Printf("Image scan failed for %s: %v", image, err)
+		return nil, registryRequestError(err)
+	}
+
+	// Cached verdicts are only valid for the signatures they were made with
+	_, dbVersion, err := s.scanner.GetVersion()
+	if err != nil {
+		dbVersion = ""
+	}
+
+	response := &ImageScanResponse{Status: "clean", Image: ref.String(), Digest: digest, Platform: request.Platform, Layers: []*LayerResult{}}
+	response.EngineInfo = s.scanner.Engine()
+	var threats []Threat
+	var downloaded int64
+	for _, layer := range layers {
+		result, err := s.scanLayer(ctx, rs, layer, dbVersion)
+		switch {
+		case errors.Is(err, errQueueFull):
+			return nil, &requestError{status: http.StatusServiceUnavailable, message: "Scanner busy, try again later", retryAfter: s.config.ScanQueueWait}
+		case errors.Is(err, errCircuitOpen):
+			return nil, &requestError{status: http.StatusServiceUnavailable, message: "Scanner unavailable, try again later", retryAfter: s.config.ClamdBreakerCooldown}
+		case err != nil:
+			log.Printf("Image scan failed for %s, layer %s: %v", image, layer.Digest, err)
+			return nil, registryRequestError(err)
+		}
+		if !result.Cached {
+			downloaded += layer.Size
+		}
+
+		response.Layers = append(response.Layers, result)
+		response.ScannedFiles += result.ScannedFiles
+		for _, threat := range result.Threats {
+			threat.File = layer.Digest + "/" + threat.File
+			threats = append(threats, threat)
+		}
+		switch {
+		case result.Status == "infected" || result.Status == "timeout" && len(result.Threats) > 0:
+			response.Status = "infected"
+		case (result.Status == "error" || result.Status == "timeout") && (response.Status == "clean" || response.Status == "clean_with_skips"):
+			response.Status = "error"
+		case result.Status == "clean_with_skips" && response.Status == "clean":
+			response.Status = "clean_with_skips"
+		}
+	}
+	response.ScanTimeMs = time.Since(startTime).Milliseconds()
+
+	log.Printf("Image scan completed: %s - %s (%d layers, %d threats, %d files, %dms)",
+		image, response.Status, len(response.Layers), len(threats), response.ScannedFiles, response.ScanTimeMs)
+	recordScan(scanTags(r), response.Status, time.Since(startTime), downloaded, nil)
+	if len(threats) > 0 {
+		reportDetection(r, &uploadedFile{filename: ref.String(), safeFilename: image}, threats)
+	}
+	return response, nil
+}
+
+// registryRequestError maps a registry failure to the client response
+func registryRequestError(err error) *requestError {
+	var regErr *registryError
+	if errors.As(err, &regErr) {
+		switch regErr.status {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return &requestError{status: http.StatusForbidden, message: "Registry denied access to the image"}
+		case http.StatusNotFound:
+			return &requestError{status: http.StatusNotFound, message: "Image not found"}
+		}
+	}
+	if errors.Is(err, errEgressDenied) {
+		return &requestError{status: http.StatusForbidden, message: "Registry address not allowed"}
+	}
+	if errors.Is(err, context.Canceled) {
+		return &requestError{status: http.StatusRequestTimeout, message: "Request cancelled"}
+	}
+	return &requestError{status: http.StatusBadGateway, message: "Failed to pull image"}
+}
+
+// layerCache is an LRU cache of layer verdicts keyed by digest and
+// signature version, optionally backed by Redis so that replicas share
+// their verdicts
+type layerCache struct {
+	mu      sync.Mutex
+	size    int        // Verdicts kept in memory (0 = Redis only)
+	order   *list.List // Front = most recently used
+	entries map[string]*list.Element
+
+	shared *RedisClient // nil = memory only
+	prefix string       // Namespace of the Redis keys
+	ttl    time.Duration
+}
+
+type layerCacheEntry struct {
+	key    string
+	result *LayerResult
+}
+
+// newLayerCache returns the cache described by the config, or nil if
+// neither IMAGE_LAYER_CACHE_SIZE nor VERDICT_CACHE_REDIS_URL is set (no
+// caching)
+func newLayerCache(config *Config) (*layerCache, error) {
+	shared, err := NewRedisClient(config.VerdictCacheRedisURL)
+	if err != nil {
+		return nil, err
+	}
+	if config.ImageLayerCacheSize <= 0 && shared == nil {
+		return nil, nil
+	}
+	return &layerCache{
+		size:    max(config.ImageLayerCacheSize, 0),
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		shared:  shared,
+		prefix:  config.VerdictCachePrefix + "layer:",
+		ttl:     config.VerdictCacheTTL,
+	}, nil
+}
+
+// Get returns a cached verdict, or nil. Redis failures count as misses.
+func (c *layerCache) Get(ctx context.Context, key string) *LayerResult {
+	if c == nil {
+		return nil
+	}
+	if result := c.getLocal(key); result != nil {
+		return result
+	}
+	if c.shared == nil {
+		return nil
+	}
+
+	data, ok, err := c.shared.Get(ctx, c.prefix+key)
+	if err != nil {
+		log.Printf("Warning: verdict cache lookup failed: %v", err)
+		metrics.Count("verdict_cache.errors", 1)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	var result LayerResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil
+	}
+	c.putLocal(key, &result)
+	return &result
+}
+
+// Put stores a verdict
+func (c *layerCache) Put(ctx context.Context, key string, result *LayerResult) {
+	if c == nil {
+		return
+	}
+	c.putLocal(key, result)
+	if c.shared == nil {
+		return
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	if err := c.shared.SetEX(ctx, c.prefix+key, data, c.ttl); err != nil {
+		log.Printf("Warning: verdict cache update failed: %v", err)
+		metrics.Count("verdict_cache.errors", 1)
+	}
+}
+
+// getLocal returns a verdict cached in memory, or nil
+func (c *layerCache) getLocal(key string) *LayerResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*layerCacheEntry).result
+}
+
+// putLocal keeps a verdict in memory, evicting the least recently used one
+// when full
+func (c *layerCache) putLocal(key string, result *LayerResult) {
+	if c.size == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*layerCacheEntry).result = result
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&layerCacheEntry{key: key, result: result})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*layerCacheEntry).key)
+	}
+}
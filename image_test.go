@@ -0,0 +1,390 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testLayer builds a gzip-compressed tar layer
+func testLayer(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// fakeRegistry serves one multi-platform image, "team/app:1.0", behind
+// docker token auth for user/secret
+type fakeRegistry struct {
+	server      *httptest.Server
+	blobs       map[string][]byte
+	manifests   map[string][]byte
+	blobFetches atomic.Int32
+}
+
+func newFakeRegistry(t *testing.T, layers ...[]byte) *fakeRegistry {
+	t.Helper()
+	reg := &fakeRegistry{blobs: make(map[string][]byte), manifests: make(map[string][]byte)}
+
+	type desc struct {
+		MediaType string            `json:"mediaType"`
+		Digest    string            `json:"digest"`
+		Size      int               `json:"size"`
+		Platform  map[string]string `json:"platform,omitempty"`
+	}
+	var layerDescs []desc
+	for _, layer := range layers {
+		reg.blobs[sha256Digest(layer)] = layer
+		layerDescs = append(layerDescs, desc{"application/vnd.oci.image.layer.v1.tar+gzip", sha256Digest(layer), len(layer), nil})
+	}
+	image, _ := json.Marshal(map[string]any{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "layers": layerDescs})
+	other, _ := json.Marshal(map[string]any{"schemaVersion": 2, "layers": []desc{}})
+	reg.manifests[sha256Digest(image)] = image
+	reg.manifests[sha256Digest(other)] = other
+	index, _ := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.index.v1+json",
+		"manifests": []desc{
+			{"application/vnd.oci.image.manifest.v1+json", sha256Digest(other), len(other), map[string]string{"os": "linux", "architecture": "arm64", "variant": "v8"}},
+			{"application/vnd.oci.image.manifest.v1+json", sha256Digest(image), len(image), map[string]string{"os": "linux", "architecture": "amd64"}},
+		},
+	})
+	reg.manifests["1.0"] = index
+
+	reg.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if user, pass, _ := r.BasicAuth(); user != "user" || pass != "secret" || r.URL.Query().Get("scope") != "repository:team/app:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"token": "pull-token"})
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer pull-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake"`, reg.server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		name, ok := strings.CutPrefix(r.URL.Path, "/v2/team/app/manifests/")
+		if ok && reg.manifests[name] != nil {
+			w.Write(reg.manifests[name])
+			return
+		}
+		name, ok = strings.CutPrefix(r.URL.Path, "/v2/team/app/blobs/")
+		if ok && reg.blobs[name] != nil {
+			reg.blobFetches.Add(1)
+			w.Write(reg.blobs[name])
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(reg.server.Close)
+	return reg
+}
+
+// host returns the registry host for image references
+func (reg *fakeRegistry) host() string {
+	return strings.TrimPrefix(reg.server.URL, "http://")
+}
+
+// useImageScanner installs an image scanner for the registry with the fake
+// clamd
+func useImageScanner(t *testing.T, reg *fakeRegistry) *Config {
+	t.Helper()
+	cfg := useFakeClamdScanner(t)
+	cfg.ImageRegistries = []string{reg.host()}
+	cfg.ImageMaxLayerSize = 1 << 20
+	cfg.ImageLayerCacheSize = 10
+
+	s, err := NewImageScanner(cfg, NewScanner(cfg))
+	if err != nil {
+		t.Fatalf("NewImageScanner() error: %v", err)
+	}
+	s.scheme = "http"
+	imageScanner = s
+	t.Cleanup(func() { imageScanner = nil })
+	return cfg
+}
+
+func postImageScan(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/scan/image", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	imageScanHandler(recorder, req)
+	return recorder
+}
+
+func TestParseImageRef(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		ref     string
+		want    string
+		wantErr bool
+	}{
+		{"alpine", "docker.io/library/alpine:latest", false},
+		{"alpine:3.19", "docker.io/library/alpine:3.19", false},
+		{"bitnami/redis:7", "docker.io/bitnami/redis:7", false},
+		{"ghcr.io/org/app:v1.2", "ghcr.io/org/app:v1.2", false},
+		{"localhost:5000/app", "localhost:5000/app:latest", false},
+		{"registry.example.com:8443/team/app:1.0", "registry.example.com:8443/team/app:1.0", false},
+		{"ghcr.io/org/app@" + digest, "ghcr.io/org/app@" + digest, false},
+		{"ghcr.io/org/app:v1@" + digest, "ghcr.io/org/app@" + digest, false},
+		{"", "", true},
+		{"Alpine", "", true},
+		{"alpine:bad tag", "", true},
+		{"alpine@md5:abc", "", true},
+		{"ghcr.io/../etc", "", true},
+	}
+
+	for _, tt := range tests {
+		ref, err := parseImageRef(tt.ref)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseImageRef(%q) error = %v, wantErr %v", tt.ref, err, tt.wantErr)
+			continue
+		}
+		if err == nil && ref.String() != tt.want {
+			t.Errorf("parseImageRef(%q) = %s, want %s", tt.ref, ref, tt.want)
+		}
+	}
+
+	if ref, _ := parseImageRef("alpine"); ref.apiHost() != dockerHubAPIHost {
+		t.Errorf("Docker Hub API host = %s", ref.apiHost())
+	}
+}
+
+func TestExtractLayer(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, header := range []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Size: 4},
+		{Name: "../../escape", Typeflag: tar.TypeReg, Size: 4},
+		{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "/etc/shadow"},
+		{Name: "etc/.wh.removed", Typeflag: tar.TypeReg},
+	} {
+		tw.WriteHeader(header)
+		if header.Size > 0 {
+			tw.Write([]byte("data"))
+		}
+	}
+	tw.Close()
+	gz.Close()
+
+	dir := t.TempDir()
+	layerPath := filepath.Join(dir, "layer")
+	os.WriteFile(layerPath, buf.Bytes(), 0644)
+	targetDir := filepath.Join(dir, "out")
+	os.Mkdir(targetDir, 0755)
+
+	s := NewScanner(&Config{MaxFileCount: 10, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20})
+	count, _, err := s.extractLayer(layerPath, targetDir, nil, nil)
+	if err != nil {
+		t.Fatalf("extractLayer() error: %v", err)
+	}
+	files := readTree(t, targetDir)
+	if count != 2 || len(files) != 2 || files["etc/passwd"] != "data" || files["escape"] != "data" {
+		t.Errorf("extracted %d files: %v", count, files)
+	}
+
+	limited := NewScanner(&Config{MaxFileCount: 1, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20})
+	if _, _, err := limited.extractLayer(layerPath, t.TempDir(), nil, nil); err == nil {
+		t.Error("extractLayer() should enforce the file count limit")
+	}
+
+	small := NewScanner(&Config{MaxFileCount: 10, MaxSingleFileSize: 3, MaxExtractedSize: 1 << 20})
+	if _, skipped, err := small.extractLayer(layerPath, t.TempDir(), nil, nil); err != nil || len(skipped) != 3 || skipped[0].Reason != skipTooLarge {
+		t.Errorf("extractLayer() with oversize files = %+v, %v; want them skipped as too_large", skipped, err)
+	}
+
+	zstd := filepath.Join(dir, "zstd")
+	os.WriteFile(zstd, []byte{0x28, 0xb5, 0x2f, 0xfd, 0, 0}, 0644)
+	if _, _, err := s.extractLayer(zstd, t.TempDir(), nil, nil); err == nil || !strings.Contains(err.Error(), "zstd") {
+		t.Errorf("extractLayer() error = %v, want zstd unsupported", err)
+	}
+}
+
+func TestImageScanHandler(t *testing.T) {
+	clean := testLayer(t, map[string]string{"bin/sh": "shell", "etc/os-release": "ID=test"})
+	infected := testLayer(t, map[string]string{"usr/local/bin/miner": "EICAR"})
+	reg := newFakeRegistry(t, clean, infected)
+	useImageScanner(t, reg)
+
+	body := fmt.Sprintf(`{"image": "%s/team/app:1.0", "username": "user", "password": "secret"}`, reg.host())
+	recorder := postImageScan(t, body)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", recorder.Code, recorder.Body)
+	}
+
+	var response ImageScanResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if response.Status != "infected" || response.Platform != defaultImagePlatform || response.ScannedFiles != 3 {
+		t.Errorf("response = %+v", response)
+	}
+	if len(response.Layers) != 2 {
+		t.Fatalf("layers = %+v", response.Layers)
+	}
+	if layer := response.Layers[0]; layer.Digest != sha256Digest(clean) || layer.Status != "clean" || layer.Cached {
+		t.Errorf("layer 0 = %+v", layer)
+	}
+	if layer := response.Layers[1]; layer.Status != "infected" || len(layer.Threats) != 1 || layer.Threats[0].File != "usr/local/bin/miner" {
+		t.Errorf("layer 1 = %+v", layer)
+	}
+	if !strings.HasPrefix(response.Digest, "sha256:") {
+		t.Errorf("digest = %q", response.Digest)
+	}
+
+	// The verdicts are cached by layer digest
+	recorder = postImageScan(t, body)
+	response = ImageScanResponse{}
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if response.Status != "infected" || !response.Layers[0].Cached || !response.Layers[1].Cached {
+		t.Errorf("second scan = %+v", response)
+	}
+	if fetches := reg.blobFetches.Load(); fetches != 2 {
+		t.Errorf("blob fetches = %d, want 2", fetches)
+	}
+
+	// Another platform of the same index
+	recorder = postImageScan(t, fmt.Sprintf(`{"image": "%s/team/app:1.0", "username": "user", "password": "secret", "platform": "linux/arm64/v8"}`, reg.host()))
+	response = ImageScanResponse{}
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if recorder.Code != http.StatusOK || response.Status != "clean" || len(response.Layers) != 0 {
+		t.Errorf("arm64 scan = %d %+v", recorder.Code, response)
+	}
+}
+
+func TestImageScanHandlerErrors(t *testing.T) {
+	reg := newFakeRegistry(t, testLayer(t, map[string]string{"a": "b"}))
+	cfg := useImageScanner(t, reg)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"invalid json", `{"image":`, http.StatusBadRequest},
+		{"unknown field", `{"image": "alpine", "tag": "x"}`, http.StatusBadRequest},
+		{"invalid reference", `{"image": "UPPER/case"}`, http.StatusBadRequest},
+		{"registry not allowed", `{"image": "ghcr.io/org/app"}`, http.StatusForbidden},
+		{"wrong credentials", fmt.Sprintf(`{"image": "%s/team/app:1.0", "username": "user", "password": "wrong"}`, reg.host()), http.StatusForbidden},
+		{"no credentials", fmt.Sprintf(`{"image": "%s/team/app:1.0"}`, reg.host()), http.StatusForbidden},
+		{"unknown tag", fmt.Sprintf(`{"image": "%s/team/app:2.0", "username": "user", "password": "secret"}`, reg.host()), http.StatusNotFound},
+		{"unknown platform", fmt.Sprintf(`{"image": "%s/team/app:1.0", "username": "user", "password": "secret", "platform": "windows/amd64"}`, reg.host()), http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if recorder := postImageScan(t, tt.body); recorder.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", recorder.Code, tt.want, recorder.Body)
+			}
+		})
+	}
+
+	// Layers over the size limit are reported unscanned
+	cfg.ImageMaxLayerSize = 10
+	recorder := postImageScan(t, fmt.Sprintf(`{"image": "%s/team/app:1.0", "username": "user", "password": "secret"}`, reg.host()))
+	var response ImageScanResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if response.Status != "error" || len(response.Layers) != 1 || response.Layers[0].Error == "" {
+		t.Errorf("oversized layer = %+v", response)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/scan/image", nil)
+	recorder = httptest.NewRecorder()
+	imageScanHandler(recorder, req)
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d", recorder.Code)
+	}
+}
+
+func TestNewImageScanner(t *testing.T) {
+	if s, err := NewImageScanner(&Config{}, nil); s != nil || err != nil {
+		t.Errorf("NewImageScanner() without registries = %v, %v", s, err)
+	}
+	if _, err := NewImageScanner(&Config{ImageRegistries: []string{"https://ghcr.io"}}, nil); err == nil {
+		t.Error("NewImageScanner() should reject URLs as registries")
+	}
+	s, err := NewImageScanner(&Config{ImageRegistries: []string{"GHCR.io"}}, nil)
+	if err != nil || !s.allowed("ghcr.io") || s.allowed("docker.io") {
+		t.Errorf("NewImageScanner() = %v, %v", s, err)
+	}
+}
+
+func TestLayerCache(t *testing.T) {
+	ctx := context.Background()
+	cache, _ := newLayerCache(&Config{ImageLayerCacheSize: 2})
+	cache.Put(ctx, "a", &LayerResult{Digest: "a"})
+	cache.Put(ctx, "b", &LayerResult{Digest: "b"})
+	cache.Get(ctx, "a") // b is now the least recently used
+	cache.Put(ctx, "c", &LayerResult{Digest: "c"})
+
+	if cache.Get(ctx, "a") == nil || cache.Get(ctx, "b") != nil || cache.Get(ctx, "c") == nil {
+		t.Error("cache should have evicted the least recently used entry")
+	}
+
+	disabled, _ := newLayerCache(&Config{})
+	disabled.Put(ctx, "a", &LayerResult{})
+	if disabled.Get(ctx, "a") != nil {
+		t.Error("a disabled cache should not store entries")
+	}
+}
+
+func TestLayerCacheShared(t *testing.T) {
+	ctx := context.Background()
+	redis := newFakeRedis(t, "")
+	config := &Config{VerdictCacheRedisURL: "redis://" + redis.address(), VerdictCacheTTL: time.Hour, VerdictCachePrefix: "test:"}
+
+	// A verdict stored by one replica is a hit for another
+	first, err := newLayerCache(config)
+	if err != nil {
+		t.Fatalf("newLayerCache() error: %v", err)
+	}
+	first.Put(ctx, "sha256:abc/27000", &LayerResult{Digest: "sha256:abc", Status: "infected", Threats: []Threat{{Name: "Eicar-Signature"}}, ScannedFiles: 3})
+	if ttl := redis.ttl("test:layer:sha256:abc/27000"); ttl != "3600000" {
+		t.Errorf("verdict stored with PX %q, want 3600000", ttl)
+	}
+
+	second, _ := newLayerCache(config)
+	cached := second.Get(ctx, "sha256:abc/27000")
+	if cached == nil || cached.Status != "infected" || len(cached.Threats) != 1 || cached.ScannedFiles != 3 {
+		t.Errorf("shared Get() = %+v", cached)
+	}
+	if second.Get(ctx, "sha256:def/27000") != nil {
+		t.Error("Get() of an unknown digest returned a verdict")
+	}
+
+	// An unreachable Redis is a miss, not a failure
+	redis.close()
+	if third, _ := newLayerCache(config); third.Get(ctx, "sha256:abc/27000") != nil {
+		t.Error("Get() without Redis returned a verdict")
+	}
+}
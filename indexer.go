@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Number of documents buffered before new ones are dropped
+const indexerQueueSize = 10000
+
+// Timeout for one bulk request
+const indexerTimeout = 30 * time.Second
+
+// ScanDocument is the document indexed for every scan response
+type ScanDocument struct {
+	Timestamp  time.Time `json:"@timestamp"`
+	ClientIP   string    `json:"client_ip"`
+	Identity   string    `json:"identity,omitempty"`
+	AuthMethod string    `json:"auth_method,omitempty"`
+	Route      string    `json:"route"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Filename   string    `json:"filename,omitempty"`
+	FileSize   int64     `json:"file_size"`
+	ScanResponse
+}
+
+// Indexer ships scan documents to Elasticsearch or OpenSearch using the
+// bulk API. Documents are queued and sent in batches in the background.
+type Indexer struct {
+	url       string // Cluster base URL
+	index     string // Index name pattern
+	username  string
+	password  string
+	apiKey    string
+	batchSize int
+	interval  time.Duration
+	client    *http.Client
+	queue     chan *ScanDocument
+}
+
+// Global indexer (nil when disabled)
+var indexer *Indexer
+
+// NewIndexer creates the indexer described by the config and starts its
+// flush loop. Returns nil when no cluster URL is configured.
+func NewIndexer(config *Config) (*Indexer, error) {
+	if config.ElasticsearchURL == "" {
+		return nil, nil
+	}
+
+	x, err := newIndexer(config)
+	if err != nil {
+		return nil, err
+	}
+	go x.flushLoop()
+	return x, nil
+}
+
+// newIndexer validates the config without starting the flush loop
+func newIndexer(config *Config) (*Indexer, error) {
+	if config.ElasticsearchIndex == "" {
+		return nil, fmt.Errorf("%s must not be empty", EnvElasticsearchIndex)
+	}
+	if strings.Count(config.ElasticsearchIndex, "{") != strings.Count(config.ElasticsearchIndex, "}") {
+		return nil, fmt.Errorf("unbalanced braces in %s", EnvElasticsearchIndex)
+	}
+	if config.ElasticsearchBatchSize <= 0 {
+		return nil, fmt.Errorf("%s must be positive", EnvElasticsearchBatchSize)
+	}
+	if config.ElasticsearchInterval <= 0 {
+		return nil, fmt.Errorf("%s must be positive", EnvElasticsearchInterval)
+	}
+
+	return &Indexer{
+		url:       strings.TrimSuffix(config.ElasticsearchURL, "/"),
+		index:     config.ElasticsearchIndex,
+		username:  config.ElasticsearchUsername,
+		password:  config.ElasticsearchPassword,
+		apiKey:    config.ElasticsearchAPIKey,
+		batchSize: config.ElasticsearchBatchSize,
+		interval:  time.Duration(config.ElasticsearchInterval) * time.Second,
+		client:    newOutboundClient(indexerTimeout),
+		queue:     make(chan *ScanDocument, indexerQueueSize),
+	}, nil
+}
+
+// Index queues a document, dropping it if the queue is full
+func (x *Indexer) Index(doc *ScanDocument) {
+	select {
+	case x.queue <- doc:
+	default:
+		log.Printf("Warning: index queue full, dropping scan document")
+	}
+}
+
+// flushLoop sends a bulk request when a batch is full or the interval elapses
+func (x *Indexer) flushLoop() {
+	ticker := time.NewTicker(x.interval)
+	defer ticker.Stop()
+
+	var batch []*ScanDocument
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := x.bulk(batch); err != nil {
+			log.Printf("Warning: failed to index %d scan documents: %v", len(batch), err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case doc := <-x.queue:
+			batch = append(batch, doc)
+			if len(batch) >= x.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// bulk sends documents in one _bulk request
+func (x *Indexer) bulk(docs []*ScanDocument) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, doc := range docs {
+		action := map[string]map[string]string{"index": {"_index": indexName(x.index, doc.Timestamp)}}
+		if err := encoder.Encode(action); err != nil {
+			return err
+		}
+		if err := encoder.Encode(doc); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, x.url+"/_bulk", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if x.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+x.apiKey)
+	} else if x.username != "" {
+		req.SetBasicAuth(x.username, x.password)
+	}
+
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("bulk request returned %s", resp.Status)
+	}
+
+	// The bulk API reports per-document failures in a 200 response
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("invalid bulk response: %w", err)
+	}
+	if result.Errors {
+		failed := 0
+		for _, item := range result.Items {
+			for _, op := range item {
+				if op.Status > 299 {
+					failed++
+				}
+			}
+		}
+		return fmt.Errorf("%d of %d documents rejected", failed, len(docs))
+	}
+	return nil
+}
+
+// indexName expands {layout} placeholders in the pattern with the document
+// time formatted by the Go time layout, e.g. "scans-{2006.01.02}"
+func indexName(pattern string, t time.Time) string {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(pattern, '{')
+		end := strings.IndexByte(pattern, '}')
+		if start < 0 || end < start {
+			b.WriteString(pattern)
+			return b.String()
+		}
+		b.WriteString(pattern[:start])
+		b.WriteString(t.UTC().Format(pattern[start+1 : end]))
+		pattern = pattern[end+1:]
+	}
+}
+
+// indexScan queues the response and request metadata for indexing and
+// adds them to the scan history. upload is nil when the request was
+// rejected before the file was read.
+func indexScan(r *http.Request, upload *uploadedFile, response *ScanResponse) {
+	if indexer == nil && history == nil {
+		return
+	}
+
+	doc := &ScanDocument{
+		Timestamp:    time.Now().UTC(),
+		ClientIP:     clientIP(r),
+		Route:        r.URL.Path,
+		ScanResponse: *response,
+	}
+	if identity := identityFromContext(r.Context()); identity != nil {
+		doc.Identity = identity.Name
+		doc.AuthMethod = identity.Method
+	}
+	if tenant := tenantFromContext(r.Context()); tenant != nil {
+		doc.Tenant = tenant.Name
+	}
+	if upload != nil {
+		doc.Filename = upload.filename
+		doc.FileSize = upload.size
+		doc.Metadata = upload.metadata
+	}
+
+	recordHistory(doc)
+	if indexer != nil {
+		indexer.Index(doc)
+	}
+}
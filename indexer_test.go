@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testIndexerConfig(url string) *Config {
+	return &Config{
+		ElasticsearchURL:       url,
+		ElasticsearchIndex:     DefaultElasticsearchIndex,
+		ElasticsearchBatchSize: DefaultElasticsearchBatchSize,
+		ElasticsearchInterval:  DefaultElasticsearchInterval,
+	}
+}
+
+func TestNewIndexer(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(c *Config)
+		wantErr bool
+	}{
+		{name: "defaults", mutate: func(c *Config) {}},
+		{name: "empty index", mutate: func(c *Config) { c.ElasticsearchIndex = "" }, wantErr: true},
+		{name: "unbalanced braces", mutate: func(c *Config) { c.ElasticsearchIndex = "scans-{2006" }, wantErr: true},
+		{name: "zero batch", mutate: func(c *Config) { c.ElasticsearchBatchSize = 0 }, wantErr: true},
+		{name: "zero interval", mutate: func(c *Config) { c.ElasticsearchInterval = 0 }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testIndexerConfig("http://localhost:9200")
+			tt.mutate(config)
+			_, err := newIndexer(config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newIndexer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIndexName(t *testing.T) {
+	ts := time.Date(2024, 3, 7, 23, 0, 0, 0, time.UTC)
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"clamav-scans", "clamav-scans"},
+		{"clamav-scans-{2006.01.02}", "clamav-scans-2024.03.07"},
+		{"scans-{2006}-w-{01}", "scans-2024-w-03"},
+	}
+
+	for _, tt := range tests {
+		if got := indexName(tt.pattern, ts); got != tt.want {
+			t.Errorf("indexName(%q) = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestIndexerBulk(t *testing.T) {
+	var lines []map[string]json.RawMessage
+	var authHeader, contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" {
+			t.Errorf("path = %q, want /_bulk", r.URL.Path)
+		}
+		authHeader = r.Header.Get("Authorization")
+		contentType = r.Header.Get("Content-Type")
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var line map[string]json.RawMessage
+			json.Unmarshal(scanner.Bytes(), &line)
+			lines = append(lines, line)
+		}
+		w.Write([]byte(`{"errors":false,"items":[]}`))
+	}))
+	defer server.Close()
+
+	config := testIndexerConfig(server.URL + "/")
+	config.ElasticsearchAPIKey = "secret"
+	x, err := newIndexer(config)
+	if err != nil {
+		t.Fatalf("newIndexer() error: %v", err)
+	}
+
+	doc := &ScanDocument{
+		Timestamp:    time.Date(2024, 3, 7, 12, 0, 0, 0, time.UTC),
+		ClientIP:     "192.0.2.10",
+		Route:        "/scan",
+		Filename:     "report.pdf",
+		ScanResponse: ScanResponse{Status: "clean", ScannedFiles: 1},
+	}
+	if err := x.bulk([]*ScanDocument{doc}); err != nil {
+		t.Fatalf("bulk() error: %v", err)
+	}
+
+	if authHeader != "ApiKey secret" {
+		t.Errorf("Authorization = %q, want ApiKey", authHeader)
+	}
+	if contentType != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", contentType)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("got %d NDJSON lines, want 2", len(lines))
+	}
+	if string(lines[0]["index"]) != `{"_index":"clamav-scans-2024.03.07"}` {
+		t.Errorf("action = %s", lines[0]["index"])
+	}
+	if string(lines[1]["status"]) != `"clean"` || string(lines[1]["client_ip"]) != `"192.0.2.10"` {
+		t.Errorf("document = %v", lines[1])
+	}
+}
+
+func TestIndexerBulkItemErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"errors":true,"items":[{"index":{"status":201}},{"index":{"status":400}}]}`))
+	}))
+	defer server.Close()
+
+	config := testIndexerConfig(server.URL)
+	config.ElasticsearchUsername = "elastic"
+	x, err := newIndexer(config)
+	if err != nil {
+		t.Fatalf("newIndexer() error: %v", err)
+	}
+
+	docs := []*ScanDocument{{Timestamp: time.Now()}, {Timestamp: time.Now()}}
+	err = x.bulk(docs)
+	if err == nil || err.Error() != "1 of 2 documents rejected" {
+		t.Errorf("bulk() error = %v, want 1 of 2 rejected", err)
+	}
+}
+
+func TestIndexScan(t *testing.T) {
+	x, err := newIndexer(testIndexerConfig("http://localhost:9200"))
+	if err != nil {
+		t.Fatalf("newIndexer() error: %v", err)
+	}
+	indexer = x
+	t.Cleanup(func() { indexer = nil })
+
+	req := httptest.NewRequest("POST", "/scan", nil)
+	req.RemoteAddr = "192.0.2.10:1234"
+	indexScan(req, &uploadedFile{filename: "a.zip", size: 10}, &ScanResponse{Status: "infected"})
+	indexScan(req, nil, &ScanResponse{Status: "error", Error: "No file provided in request"})
+
+	first, second := <-x.queue, <-x.queue
+	if first.Filename != "a.zip" || first.FileSize != 10 || first.Status != "infected" {
+		t.Errorf("first document = %+v", first)
+	}
+	if second.Filename != "" || second.Error == "" {
+		t.Errorf("rejected document = %+v", second)
+	}
+}
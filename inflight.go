@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Retry-After sent when a request is rejected for too many in flight
+const inFlightRetryAfter = time.Second
+
+// InFlightLimiter caps the requests handled at once, per client IP and in
+// total, so a single uploader can't tie up every worker and temp directory
+// slot with slow uploads
+type InFlightLimiter struct {
+	perIP  int // 0 = unlimited
+	global int // 0 = unlimited
+
+	mu    sync.Mutex
+	total int
+	byIP  map[string]int
+}
+
+// NewInFlightLimiter creates a limiter for perIP requests per client and
+// global requests in total. Returns nil when neither is positive (disabled).
+func NewInFlightLimiter(perIP, global int) *InFlightLimiter {
+	if perIP <= 0 && global <= 0 {
+		return nil
+	}
+	return &InFlightLimiter{
+		perIP:  max(perIP, 0),
+		global: max(global, 0),
+		byIP:   make(map[string]int),
+	}
+}
+
+// Acquire takes a slot for a request from ip. If a limit is reached it
+// returns a nil release and which limit: "ip" or "global".
+func (l *InFlightLimiter) Acquire(ip string) (release func(), scope string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.global > 0 && l.total >= l.global {
+		return nil, "global"
+	}
+	if l.perIP > 0 && l.byIP[ip] >= l.perIP {
+		return nil, "ip"
+	}
+	l.total++
+	l.byIP[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if l.byIP[ip]--; l.byIP[ip] == 0 {
+				delete(l.byIP, ip)
+			}
+		})
+	}, ""
+}
+
+// limitInFlight rejects requests beyond the in-flight limits with 429 Too
+// Many Requests and a Retry-After header. A nil limiter disables it.
+func limitInFlight(l *InFlightLimiter, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, scope := l.Acquire(clientIP(r))
+		if release == nil {
+			metrics.Count("inflight_rejected", 1, "route:"+r.URL.Path, "scope:"+scope)
+			w.Header().Set("Retry-After", strconv.Itoa(int(inFlightRetryAfter.Seconds())))
+			if scope == "ip" {
+				sendErrorStatus(w, http.StatusTooManyRequests, "Too many concurrent requests from this client")
+			} else {
+				sendErrorStatus(w, http.StatusTooManyRequests, "Too many concurrent requests")
+			}
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
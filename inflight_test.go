@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInFlightLimiter(t *testing.T) {
+	l := NewInFlightLimiter(2, 3)
+
+	a1, _ := l.Acquire("10.0.0.1")
+	a2, _ := l.Acquire("10.0.0.1")
+	if release, scope := l.Acquire("10.0.0.1"); release != nil || scope != "ip" {
+		t.Fatalf("third request from one IP: scope %q, want ip", scope)
+	}
+	b1, _ := l.Acquire("10.0.0.2")
+	if release, scope := l.Acquire("10.0.0.3"); release != nil || scope != "global" {
+		t.Fatalf("fourth request in total: scope %q, want global", scope)
+	}
+
+	// Releasing twice frees one slot only
+	a1()
+	a1()
+	if l.total != 2 || l.byIP["10.0.0.1"] != 1 {
+		t.Errorf("after release: total %d, 10.0.0.1 %d; want 2, 1", l.total, l.byIP["10.0.0.1"])
+	}
+	a2()
+	b1()
+	if l.total != 0 || len(l.byIP) != 0 {
+		t.Errorf("after all releases: total %d, %d IPs tracked", l.total, len(l.byIP))
+	}
+
+	if NewInFlightLimiter(0, 0) != nil {
+		t.Error("limiter without limits should be nil")
+	}
+}
+
+func TestLimitInFlight(t *testing.T) {
+	l := NewInFlightLimiter(1, 0)
+	entered, proceed := make(chan struct{}), make(chan struct{})
+	handler := limitInFlight(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-proceed
+	}))
+
+	// Hold one request from the client open
+	done := make(chan int)
+	go func() {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/scan", nil))
+		done <- recorder.Code
+	}()
+	<-entered
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/scan", nil))
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "1" {
+		t.Errorf("concurrent request: status %d, Retry-After %q; want 429, 1", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+
+	// Another client is not affected
+	other := httptest.NewRequest(http.MethodPost, "/scan", nil)
+	other.RemoteAddr = "192.0.2.99:1234"
+	go func() {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, other)
+		done <- recorder.Code
+	}()
+	<-entered
+
+	close(proceed)
+	for i := 0; i < 2; i++ {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("admitted request: status %d, want 200", code)
+		}
+	}
+
+	if h := limitInFlight(nil, handler); h == nil {
+		t.Error("nil limiter should return the next handler")
+	}
+}
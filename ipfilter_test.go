@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPFilterAllowed(t *testing.T) {
+	filter, err := NewIPFilter(&Config{
+		IPAllowlist: []string{"10.0.0.0/8", "2001:db8::/32"},
+		IPDenylist:  []string{"10.6.6.0/24"},
+	})
+	if err != nil {
+		t.Fatalf("NewIPFilter() error = %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"10.6.6.6", false},
+		{"192.0.2.1", false},
+		{"2001:db8::1", true},
+		{"@", true}, // unix socket peer
+	}
+
+	for _, tt := range tests {
+		if got := filter.Allowed(tt.ip); got != tt.want {
+			t.Errorf("Allowed(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestIPFilterDenyOnly(t *testing.T) {
+	filter, _ := NewIPFilter(&Config{IPDenylist: []string{"192.0.2.1"}})
+
+	if filter.Allowed("192.0.2.1") {
+		t.Error("denied address allowed")
+	}
+	if !filter.Allowed("192.0.2.2") {
+		t.Error("other address denied without an allowlist")
+	}
+}
+
+func TestNewIPFilter(t *testing.T) {
+	if filter, err := NewIPFilter(&Config{}); filter != nil || err != nil {
+		t.Errorf("NewIPFilter() = %v, %v, want nil when disabled", filter, err)
+	}
+	if _, err := NewIPFilter(&Config{IPDenylist: []string{"10.0.0.0/99"}}); err == nil {
+		t.Error("NewIPFilter() accepted invalid CIDR")
+	}
+}
+
+func TestFilterIPs(t *testing.T) {
+	useTrustedProxies(t, "10.0.0.1")
+	filter, _ := NewIPFilter(&Config{IPAllowlist: []string{"198.51.100.0/24"}})
+	handler := filterIPs(filter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("body read for a rejected client")
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.5")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403 for the forwarded client", recorder.Code)
+	}
+}
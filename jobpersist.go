@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How often expired jobs are removed without waiting for the next request
+const jobCleanupInterval = time.Minute
+
+// jobRecord is an async job as saved in ASYNC_JOB_DIR as <id>.json. The
+// upload of an unfinished scan is kept beside it as <id>.upload.
+type jobRecord struct {
+	ID       string             `json:"id"`
+	Owner    string             `json:"owner,omitempty"`
+	Key      string             `json:"key,omitempty"`
+	Created  time.Time          `json:"created"`
+	BasePath string             `json:"base_path,omitempty"`
+	Finished time.Time          `json:"finished"`
+	Result   *ScanResponse      `json:"result,omitempty"`
+	Batch    *BatchScanResponse `json:"batch,omitempty"`
+
+	// What an unfinished job needs to run again after a restart
+	Request *savedRequest `json:"request,omitempty"`
+	Upload  *jobUpload    `json:"upload,omitempty"`
+	Items   []BatchItem   `json:"items,omitempty"`
+}
+
+// savedRequest is the part of the submitting request a re-run job reports
+// with: route, client and identity
+type savedRequest struct {
+	Method     string   `json:"method"`
+	URL        string   `json:"url"`
+	ClientIP   string   `json:"client_ip"`
+	Identity   string   `json:"identity,omitempty"`
+	AuthMethod string   `json:"auth_method,omitempty"`
+	Scopes     []string `json:"scopes,omitempty"`
+
+	ScanTimeout time.Duration `json:"scan_timeout,omitempty"` // Set by the caller or its tenant
+	Heuristics  []string      `json:"heuristics,omitempty"`   // Heuristic alerts the caller asked for
+	TestVerdict string        `json:"test_verdict,omitempty"` // X-Test-Verdict
+}
+
+// jobUpload describes the saved upload of an unfinished scan
+type jobUpload struct {
+	Filename string          `json:"filename"`
+	Size     int64           `json:"size"`
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+
+	// Archive passwords were sent with the upload. They are never saved,
+	// so the job can't run again without them.
+	Passwords bool `json:"passwords,omitempty"`
+}
+
+// newSavedRequest records the request a job was submitted with
+func newSavedRequest(r *http.Request) *savedRequest {
+	q := &savedRequest{Method: r.Method, URL: r.URL.RequestURI(), ClientIP: clientIP(r)}
+	if identity := identityFromContext(r.Context()); identity != nil {
+		q.Identity, q.AuthMethod, q.Scopes = identity.Name, identity.Method, identity.Scopes
+	}
+	if timeout, ok := r.Context().Value(scanTimeoutKey{}).(time.Duration); ok {
+		q.ScanTimeout = timeout
+	}
+	if categories, ok := r.Context().Value(heuristicsKey{}).([]string); ok {
+		q.Heuristics = categories
+	}
+	q.TestVerdict = r.Header.Get(testVerdictHeader)
+	return q
+}
+
+// build returns a request carrying the recorded route, client, identity,
+// tenant, scan timeout, heuristic alerts and test verdict, for scans re-run
+// after a restart
+func (q *savedRequest) build() (*http.Request, error) {
+	r, err := http.NewRequest(q.Method, q.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.RemoteAddr = net.JoinHostPort(q.ClientIP, "0")
+	ctx := context.Background()
+	if q.AuthMethod != "" {
+		identity := &Identity{Name: q.Identity, Method: q.AuthMethod, Scopes: q.Scopes}
+		ctx = context.WithValue(ctx, identityKey{}, identity)
+		if tenants != nil {
+			if tenant := tenants.Lookup(identity); tenant != nil {
+				ctx = context.WithValue(ctx, tenantKey{}, tenant)
+			}
+		}
+	}
+	if q.ScanTimeout > 0 {
+		ctx = withScanTimeout(ctx, q.ScanTimeout)
+	}
+	if q.Heuristics != nil {
+		ctx = withHeuristics(ctx, q.Heuristics)
+	}
+	if q.TestVerdict != "" {
+		r.Header.Set(testVerdictHeader, q.TestVerdict)
+	}
+	return r.WithContext(ctx), nil
+}
+
+// persistScan saves a new scan job and moves its upload into the job
+// directory, so the scan can run again if the process restarts before it
+// finishes. Streamed tar uploads (already extracted) are not kept; such a
+// job fails after a restart instead.
+func (s *JobStore) persistScan(job *ScanJob, r *http.Request, upload *uploadedFile) error {
+	if s.dir == "" {
+		return nil
+	}
+	record := job.record()
+	record.Request = newSavedRequest(r)
+	if upload.dir == "" {
+		path, err := moveFile(upload.path, filepath.Join(s.dir, job.ID+".upload"))
+		if err != nil {
+			return err
+		}
+		upload.path = path
+		record.Upload = &jobUpload{Filename: upload.filename, Size: upload.size, Metadata: upload.metadata, Passwords: len(upload.passwords) > 0}
+	}
+	return s.writeRecord(record)
+}
+
+// persistBatch saves a new batch job with its items, including any
+// credentials, until it finishes
+func (s *JobStore) persistBatch(job *ScanJob, r *http.Request, items []BatchItem) error {
+	if s.dir == "" {
+		return nil
+	}
+	record := job.record()
+	record.Request = newSavedRequest(r)
+	record.Items = items
+	return s.writeRecord(record)
+}
+
+// persistFinished saves a finished job's result in place of what was
+// needed to run it
+func (s *JobStore) persistFinished(job *ScanJob) {
+	if s.dir == "" {
+		return
+	}
+	// Not if the job was deleted meanwhile, here or on another instance
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.jobs[job.ID] != job {
+		return
+	}
+	path := filepath.Join(s.dir, job.ID+".json")
+	if _, err := os.Stat(path); s.shared && errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err := s.writeRecord(job.record()); err != nil {
+		log.Printf("Failed to save async job %s: %v", job.ID, err)
+		return
+	}
+	if s.shared {
+		// Kept until now for another instance to run the job again
+		os.Remove(filepath.Join(s.dir, job.ID+".upload"))
+	}
+}
+
+// record returns the job's saved form, without what's needed to re-run it
+func (j *ScanJob) record() *jobRecord {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return &jobRecord{
+		ID:       j.ID,
+		Owner:    j.owner,
+		Key:      j.key,
+		Created:  j.created,
+		BasePath: j.basePath,
+		Finished: j.finished,
+		Result:   j.result,
+		Batch:    j.batch,
+	}
+}
+
+// writeRecord writes a job record atomically, readable by the service only
+func (s *JobStore) writeRecord(record *jobRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".job-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, record.ID+".json"))
+}
+
+// removeRecord deletes a job's files from the job directory
+func (s *JobStore) removeRecord(id string) {
+	if s.dir == "" {
+		return
+	}
+	os.Remove(filepath.Join(s.dir, id+".json"))
+	os.Remove(filepath.Join(s.dir, id+".upload"))
+}
+
+// Recover keeps jobs in dir from now on and loads the jobs saved there
+// before a restart: finished results are served until they expire,
+// unfinished scans are queued again (once clamd is up) and jobs that can't
+// run again finish with an error.
+func (s *JobStore) Recover(dir string, config *Config, scanner *Scanner) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.dir = dir
+	var requeued, restored, failed int
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".job-") {
+			os.Remove(filepath.Join(dir, name)) // Interrupted write
+			continue
+		}
+		id, ok := strings.CutSuffix(name, ".json")
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		var record jobRecord
+		if err == nil {
+			err = json.Unmarshal(data, &record)
+		}
+		if err != nil || record.ID != id {
+			log.Printf("Discarding unreadable async job %s: %v", name, err)
+			s.removeRecord(id)
+			continue
+		}
+
+		job := s.add(&record)
+		if !record.Finished.IsZero() {
+			os.Remove(filepath.Join(dir, id+".upload"))
+			restored++
+			continue
+		}
+		if run := s.resume(job, &record, config, scanner); run != nil {
+			s.Go(job, func() {
+				waitForClamd()
+				run()
+			})
+			requeued++
+			continue
+		}
+		s.interrupt(job)
+		failed++
+	}
+	for _, entry := range entries {
+		// Uploads whose job was never saved
+		if id, ok := strings.CutSuffix(entry.Name(), ".upload"); ok && s.jobs[id] == nil {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+	s.expire()
+	metrics.Gauge("jobs.stored", float64(len(s.jobs)))
+	s.mu.Unlock()
+
+	if requeued+restored+failed > 0 {
+		log.Printf("Recovered async jobs from %s: %d re-queued, %d finished, %d interrupted", dir, requeued, restored, failed)
+	}
+	return nil
+}
+
+// add adds a job from its record, finished if the record has a result.
+// Callers hold s.mu.
+func (s *JobStore) add(record *jobRecord) *ScanJob {
+	job := &ScanJob{
+		ID:       record.ID,
+		owner:    record.Owner,
+		key:      record.Key,
+		created:  record.Created,
+		basePath: record.BasePath,
+		stage:    stageQueued,
+		changed:  make(chan struct{}),
+	}
+	if !record.Finished.IsZero() {
+		job.stage, job.result, job.batch, job.finished = stageDone, record.Result, record.Batch, record.Finished
+	}
+	s.jobs[job.ID] = job
+	if job.key != "" {
+		s.keys[jobKey(job.owner, job.key)] = job
+	}
+	return job
+}
+
+// Share keeps jobs in dir, shared with the other instances of a cluster,
+// from now on. Unlike Recover it runs nothing: the coordinator claims the
+// unfinished jobs one at a time.
+func (s *JobStore) Share(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.dir, s.shared = dir, true
+	s.mu.Unlock()
+	return nil
+}
+
+// readRecord reads a job's record from the job directory
+func (s *JobStore) readRecord(id string) (*jobRecord, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var record jobRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	if record.ID != id {
+		return nil, fmt.Errorf("record of job %q", record.ID)
+	}
+	return &record, nil
+}
+
+// load adds a job another instance saved in the shared directory since the
+// coordinator last looked, or returns nil. Callers hold s.mu.
+func (s *JobStore) load(id string) *ScanJob {
+	if !s.shared || !validJobID(id) {
+		return nil
+	}
+	record, err := s.readRecord(id)
+	if err != nil {
+		return nil
+	}
+	job := s.add(record)
+	job.remote = true
+	metrics.Gauge("jobs.stored", float64(len(s.jobs)))
+	return job
+}
+
+// validJobID reports whether id has the form of a job ID, and so names no
+// other file
+func validJobID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 32
+}
+
+// observe updates the store from a record in the shared directory: new
+// jobs are added as remote, and remote jobs finish once their record has a
+// result. Returns the job.
+func (s *JobStore) observe(record *jobRecord) *ScanJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := s.jobs[record.ID]
+	if job == nil {
+		job = s.add(record)
+		job.remote = true
+		metrics.Gauge("jobs.stored", float64(len(s.jobs)))
+		return job
+	}
+	if job.remote && !record.Finished.IsZero() {
+		job.mu.Lock()
+		if job.finished.IsZero() {
+			job.stage, job.percent, job.result, job.batch, job.finished = stageDone, 0, record.Result, record.Batch, record.Finished
+			job.settle()
+		}
+		job.mu.Unlock()
+	}
+	return job
+}
+
+// share hands a job submitted here to the cluster: any instance, this one
+// included, may claim it
+func (s *JobStore) share(job *ScanJob) {
+	s.mu.Lock()
+	job.remote = true
+	s.mu.Unlock()
+}
+
+// pending returns the unfinished remote jobs, oldest first
+func (s *JobStore) pending() []*ScanJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pending []*ScanJob
+	for _, job := range s.jobs {
+		job.mu.Lock()
+		waiting := job.remote && job.finished.IsZero()
+		job.mu.Unlock()
+		if waiting {
+			pending = append(pending, job)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].created.Before(pending[j].created) })
+	return pending
+}
+
+// adopt takes over a remote job whose lease this instance claimed and
+// returns the function that runs it, or nil if the job is gone or can't run
+// again (it then finishes with an error)
+func (s *JobStore) adopt(job *ScanJob, record *jobRecord, config *Config, scanner *Scanner) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.jobs[job.ID] != job || !job.remote {
+		return nil
+	}
+	job.remote = false
+	run := s.resume(job, record, config, scanner)
+	if run == nil {
+		s.interrupt(job)
+	}
+	return run
+}
+
+// forget drops a job whose record another instance removed, or whose lease
+// this instance lost, without touching its files
+func (s *JobStore) forget(job *ScanJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.jobs[job.ID] == job {
+		s.drop(job)
+		metrics.Gauge("jobs.stored", float64(len(s.jobs)))
+	}
+}
+
+// resume prepares an unfinished job to run again from its record and
+// returns the function that runs it, or nil if it can't run again
+func (s *JobStore) resume(job *ScanJob, record *jobRecord, config *Config, scanner *Scanner) func() {
+	if record.Request == nil {
+		return nil
+	}
+	r, err := record.Request.build()
+	if err != nil {
+		return nil
+	}
+
+	switch {
+	case record.Upload != nil:
+		if record.Upload.Passwords {
+			return nil
+		}
+		path := filepath.Join(s.dir, job.ID+".upload")
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		upload := &uploadedFile{
+			path:         path,
+			filename:     record.Upload.Filename,
+			safeFilename: sanitizeFilename(record.Upload.Filename),
+			size:         record.Upload.Size,
+			metadata:     record.Upload.Metadata,
+			kept:         s.shared,
+		}
+		ctx := withProgress(job.start(r.Context()), job.setProgress)
+		return func() {
+			runScanJob(ctx, job, r.WithContext(ctx), config, scanner, upload, time.Now())
+		}
+
+	case len(record.Items) > 0:
+		ctx := job.start(r.Context())
+		return func() {
+			runBatchJob(ctx, job, r, record.Items, time.Now())
+		}
+	}
+	return nil
+}
+
+// interrupt finishes a job that can't run again with an error
+func (s *JobStore) interrupt(job *ScanJob) {
+	job.mu.Lock()
+	job.stage, job.finished = stageDone, s.now()
+	job.result = &ScanResponse{Status: "error", Error: "Scan interrupted by a restart, submit it again"}
+	job.settle()
+	job.mu.Unlock()
+	os.Remove(filepath.Join(s.dir, job.ID+".upload"))
+	if err := s.writeRecord(job.record()); err != nil {
+		log.Printf("Failed to save async job %s: %v", job.ID, err)
+	}
+}
+
+// waitForClamd blocks while the service waits for clamd after startup
+func waitForClamd() {
+	for clamdStarting.Load() {
+		time.Sleep(time.Second)
+	}
+}
+
+// StartCleanup removes expired jobs in the background, so finished results
+// (and their files) don't outlive the TTL when no requests arrive
+func (s *JobStore) StartCleanup() {
+	go func() {
+		ticker := time.NewTicker(jobCleanupInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.mu.Lock()
+			s.expire()
+			s.mu.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitForJob polls until the job is done and returns its state
+func waitForJob(t *testing.T, job *ScanJob) JobResponse {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if snapshot, _ := job.Snapshot(); snapshot.Stage == stageDone {
+			return snapshot
+		}
+	}
+	t.Fatalf("job %s did not finish", job.ID)
+	return JobResponse{}
+}
+
+func TestJobStoreRecover(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	dir := t.TempDir()
+	write := func(name string, data []byte) {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeRecord := func(record jobRecord) {
+		data, _ := json.Marshal(record)
+		write(record.ID+".json", data)
+	}
+	created := time.Now().UTC().Add(-time.Minute)
+
+	// A finished job, a queued upload, a job that can't run again and
+	// leftovers from writes interrupted by the restart
+	writeRecord(jobRecord{ID: "finished", Owner: "api-key:ci", Key: "order-1", Created: created,
+		Finished: time.Now(), Result: &ScanResponse{Status: "clean"}})
+	writeRecord(jobRecord{ID: "queued", Owner: "api-key:ci", Created: created,
+		Request: &savedRequest{Method: http.MethodPost, URL: "/scan?async=true", ClientIP: "192.0.2.1", Identity: "ci", AuthMethod: "api-key"},
+		Upload:  &jobUpload{Filename: "eicar.com", Size: 5}})
+	write("queued.upload", []byte("EICAR"))
+	writeRecord(jobRecord{ID: "streamed", Created: created,
+		Request: &savedRequest{Method: http.MethodPost, URL: "/scan/tar?async=true", ClientIP: "192.0.2.1"}})
+	writeRecord(jobRecord{ID: "protected", Created: created,
+		Request: &savedRequest{Method: http.MethodPost, URL: "/scan?async=true", ClientIP: "192.0.2.1"},
+		Upload:  &jobUpload{Filename: "protected.zip", Size: 5, Passwords: true}})
+	write("protected.upload", []byte("EICAR"))
+	write("corrupt.json", []byte("{"))
+	write("orphan.upload", []byte("data"))
+	write(".job-123", []byte("{"))
+
+	store := NewJobStore(10, time.Minute)
+	useJobStore(t, store)
+	if err := store.Recover(dir, cfg, NewScanner(cfg)); err != nil {
+		t.Fatalf("Recover() error: %v", err)
+	}
+
+	if job := store.Lookup("api-key:ci", "order-1"); job == nil || job.result == nil || job.result.Status != "clean" {
+		t.Errorf("finished job not restored with its key: %+v", job)
+	}
+	queued := store.Get("queued", "api-key:ci")
+	if queued == nil {
+		t.Fatal("queued job not restored")
+	}
+	if status := waitForJob(t, queued); status.Result == nil || status.Result.Status != "infected" {
+		t.Errorf("re-queued job = %+v, want infected result", status)
+	}
+	if status := waitForJob(t, store.Get("streamed", "")); status.Result == nil || status.Result.Status != "error" {
+		t.Errorf("job that can't run again = %+v, want error result", status)
+	}
+	// Its archive passwords weren't saved
+	if status := waitForJob(t, store.Get("protected", "")); status.Result == nil || status.Result.Status != "error" {
+		t.Errorf("job with archive passwords = %+v, want error result", status)
+	}
+
+	for _, name := range []string{"queued.upload", "protected.upload", "corrupt.json", "orphan.upload", ".job-123"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+	var record jobRecord
+	data, _ := os.ReadFile(filepath.Join(dir, "queued.json"))
+	if json.Unmarshal(data, &record); record.Finished.IsZero() || record.Upload != nil || record.Request != nil {
+		t.Errorf("saved record of the re-queued job = %+v, want only its result", record)
+	}
+}
+
+func TestAsyncScanPersisted(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	dir := t.TempDir()
+	store := NewJobStore(10, time.Minute)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	useJobStore(t, store)
+	if err := store.Recover(dir, cfg, NewScanner(cfg)); err != nil {
+		t.Fatalf("Recover() error: %v", err)
+	}
+
+	body, contentType := multipartUpload(t, "test.txt", []byte("hello"))
+	req := httptest.NewRequest(http.MethodPost, "/scan?async=true", body)
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+	handleScan(recorder, req, cfg, NewScanner(cfg))
+	var accepted JobResponse
+	json.NewDecoder(recorder.Body).Decode(&accepted)
+	waitForJob(t, store.Get(accepted.ID, ""))
+
+	// A restarted store serves the saved result
+	restarted := NewJobStore(10, time.Minute)
+	if err := restarted.Recover(dir, cfg, NewScanner(cfg)); err != nil {
+		t.Fatalf("Recover() error: %v", err)
+	}
+	if job := restarted.Get(accepted.ID, ""); job == nil || job.result == nil || job.result.Status != "clean" {
+		t.Errorf("restarted store job = %+v, want the clean result", job)
+	}
+
+	// Expired jobs are removed from the directory
+	now = now.Add(2 * time.Minute)
+	store.mu.Lock()
+	store.expire()
+	store.mu.Unlock()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d files left after the job expired", len(entries))
+	}
+}
+
+func TestSavedRequestScanTimeout(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/scan?async=true", nil)
+	req = req.WithContext(withScanTimeout(req.Context(), 15*time.Second))
+	rebuilt, err := newSavedRequest(req).build()
+	if err != nil {
+		t.Fatalf("build() error: %v", err)
+	}
+	if timeout := scanTimeout(rebuilt.Context(), time.Minute); timeout != 15*time.Second {
+		t.Errorf("scan timeout after a restart = %v, want 15s", timeout)
+	}
+}
+
+func TestSavedRequestHeuristics(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/scan?async=true&heuristics=macros", nil)
+	req = req.WithContext(withHeuristics(req.Context(), []string{heuristicMacros}))
+	rebuilt, err := newSavedRequest(req).build()
+	if err != nil {
+		t.Fatalf("build() error: %v", err)
+	}
+	threats := []Threat{{Name: "Heuristics.OLE2.ContainsMacros"}, {Name: "Heuristics.Encrypted.Zip"}}
+	if kept := filterHeuristics(rebuilt.Context(), threats); len(kept) != 1 || kept[0].Name != "Heuristics.OLE2.ContainsMacros" {
+		t.Errorf("threats after a restart = %v, want only the macro alert", kept)
+	}
+}
+
+func TestSavedRequestTestVerdict(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/scan?async=true", nil)
+	req.Header.Set(testVerdictHeader, testVerdictInfected)
+	rebuilt, err := newSavedRequest(req).build()
+	if err != nil {
+		t.Fatalf("build() error: %v", err)
+	}
+	if verdict, _ := requestTestVerdict(rebuilt, &Config{EnableTestVerdicts: true}); verdict != testVerdictInfected {
+		t.Errorf("test verdict after a restart = %q, want infected", verdict)
+	}
+}
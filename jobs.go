@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Async scan job stages, in order
+const (
+	stageQueued     = "queued"
+	stageExtracting = "extracting"
+	stageScanning   = "scanning"
+	stageHashing    = "hashing"
+	stageDone       = "done"
+)
+
+// Longest Idempotency-Key accepted on async submissions
+const maxIdempotencyKeyLength = 255
+
+// JobResponse describes an async scan job
+type JobResponse struct {
+	ID        string             `json:"id"`
+	Stage     string             `json:"stage"`             // queued, extracting, scanning, hashing, done
+	Percent   int                `json:"percent,omitempty"` // Estimate for the current stage (extraction, batch items)
+	Result    *ScanResponse      `json:"result,omitempty"`  // Set once done
+	Batch     *BatchScanResponse `json:"batch,omitempty"`   // Set once a batch job is done
+	CreatedAt time.Time          `json:"created_at"`
+	StatusURL string             `json:"status_url"`
+	EventsURL string             `json:"events_url"`
+	ResultURL string             `json:"result_url,omitempty"` // Signed URL readable without credentials (RESULT_URL_SECRET)
+}
+
+// ScanJob is an async scan and its progress
+type ScanJob struct {
+	ID       string
+	owner    string // Identity that submitted the job ("" = anonymous)
+	key      string // Idempotency-Key it was submitted with ("" = none)
+	created  time.Time
+	basePath string
+
+	mu       sync.Mutex
+	stage    string
+	percent  int
+	result   *ScanResponse
+	batch    *BatchScanResponse
+	finished time.Time
+	changed  chan struct{}      // Closed and replaced on every update
+	cancel   context.CancelFunc // Stops the running scan (nil = not started)
+
+	// Set while the job runs on another instance, or waits for one to claim
+	// it; its state then comes from its record (coordinator mode). Guarded
+	// by the store's mu.
+	remote bool
+}
+
+// start returns the context the job's scan runs with: ctx, without its
+// cancellation, but canceled when the job is deleted
+func (j *ScanJob) start(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	j.mu.Lock()
+	j.cancel = cancel
+	j.mu.Unlock()
+	return ctx
+}
+
+// setProgress records the job's stage and percent and wakes watchers
+func (j *ScanJob) setProgress(stage string, percent int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stage == stage && j.percent == percent {
+		return
+	}
+	j.stage, j.percent = stage, percent
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// finish records the job's result
+func (j *ScanJob) finish(result *ScanResponse) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.stage, j.percent, j.result = stageDone, 0, result
+	j.finished = time.Now()
+	j.settle()
+}
+
+// finishBatch records a batch job's results
+func (j *ScanJob) finishBatch(batch *BatchScanResponse) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.stage, j.percent, j.batch = stageDone, 0, batch
+	j.finished = time.Now()
+	j.settle()
+}
+
+// settle wakes watchers of a finished job and frees its context. Callers
+// hold j.mu.
+func (j *ScanJob) settle() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+	if j.cancel != nil {
+		j.cancel()
+	}
+}
+
+// Snapshot returns the job's current state and a channel closed on the next change
+func (j *ScanJob) Snapshot() (JobResponse, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return JobResponse{
+		ID:        j.ID,
+		Stage:     j.stage,
+		Percent:   j.percent,
+		Result:    j.result,
+		Batch:     j.batch,
+		CreatedAt: j.created,
+		StatusURL: j.basePath + "/scan/jobs/" + j.ID,
+		EventsURL: j.basePath + "/scan/events/" + j.ID,
+	}, j.changed
+}
+
+// JobStore keeps async scan jobs in memory, and in a directory if one is
+// set (see Recover), until their results expire
+type JobStore struct {
+	mu      sync.Mutex
+	jobs    map[string]*ScanJob
+	keys    map[string]*ScanJob // By owner and Idempotency-Key
+	maxJobs int
+	ttl     time.Duration // How long finished jobs are kept
+	dir     string        // Where jobs are saved ("" = memory only)
+	shared  bool          // dir is shared with other instances (see Share)
+	now     func() time.Time
+	running sync.WaitGroup // Job goroutines started by Go
+}
+
+// Global async job store (nil = async scans disabled)
+var jobs *JobStore
+
+// NewJobStore creates the async job store. Returns nil when maxJobs is not
+// positive (async scans disabled).
+func NewJobStore(maxJobs int, ttl time.Duration) *JobStore {
+	if maxJobs <= 0 {
+		return nil
+	}
+	return &JobStore{
+		jobs:    make(map[string]*ScanJob),
+		keys:    make(map[string]*ScanJob),
+		maxJobs: maxJobs,
+		ttl:     ttl,
+		now:     time.Now,
+	}
+}
+
+// Go runs a job in the background, tracked by Wait. A panic fails the job
+// instead of crashing the service.
+func (s *JobStore) Go(job *ScanJob, run func()) {
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		defer func() {
+			if v := recover(); v != nil {
+				log.Printf("Panic in async job %s: %v\n%s", job.ID, v, debug.Stack())
+				metrics.Count("http.panics", 1)
+				s.fail(job)
+			}
+		}()
+		run()
+	}()
+}
+
+// fail records an internal error for a job that didn't finish
+func (s *JobStore) fail(job *ScanJob) {
+	job.mu.Lock()
+	finished := !job.finished.IsZero()
+	job.mu.Unlock()
+	if finished {
+		return
+	}
+	job.finish(&ScanResponse{Status: "error", Error: "Internal server error"})
+	s.persistFinished(job)
+}
+
+// Wait blocks until the jobs started by Go have returned, including saving
+// their results
+func (s *JobStore) Wait() {
+	s.running.Wait()
+}
+
+// Create adds a queued job for owner, or returns nil if the store is full
+func (s *JobStore) Create(owner, basePath string) *ScanJob {
+	job, _ := s.CreateOnce(owner, basePath, "")
+	return job
+}
+
+// CreateOnce is Create for a submission with an Idempotency-Key: if owner
+// already has a job for key, that job is returned with existing set
+// instead. An empty key always creates a job.
+func (s *JobStore) CreateOnce(owner, basePath, key string) (job *ScanJob, existing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	if job := s.keys[jobKey(owner, key)]; job != nil && key != "" {
+		return job, true
+	}
+	if len(s.jobs) >= s.maxJobs {
+		return nil, false
+	}
+
+	job = &ScanJob{
+		ID:       randomID(),
+		owner:    owner,
+		key:      key,
+		created:  s.now().UTC(),
+		basePath: basePath,
+		stage:    stageQueued,
+		changed:  make(chan struct{}),
+	}
+	s.jobs[job.ID] = job
+	if key != "" {
+		s.keys[jobKey(owner, key)] = job
+	}
+	metrics.Gauge("jobs.stored", float64(len(s.jobs)))
+	return job, false
+}
+
+// Lookup returns owner's job submitted with the Idempotency-Key, if any
+func (s *JobStore) Lookup(owner, key string) *ScanJob {
+	if key == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	return s.keys[jobKey(owner, key)]
+}
+
+// Delete removes owner's job, cancelling its scan if it is still queued or
+// running. Returns false if there is no such job.
+func (s *JobStore) Delete(id, owner string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := s.jobs[id]
+	if job == nil {
+		job = s.load(id)
+	}
+	if job == nil || job.owner != owner {
+		return false
+	}
+	s.remove(job)
+	metrics.Gauge("jobs.stored", float64(len(s.jobs)))
+	return true
+}
+
+// Purge deletes the finished jobs with a result (or batch item result)
+// that matches, whoever owns them, and returns how many
+func (s *JobStore) Purge(match func(*ScanResponse) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for _, job := range s.jobs {
+		job.mu.Lock()
+		matched := job.result != nil && match(job.result)
+		if job.batch != nil {
+			for _, item := range job.batch.Results {
+				matched = matched || item.ScanResponse != nil && match(item.ScanResponse)
+			}
+		}
+		job.mu.Unlock()
+		if matched {
+			s.remove(job)
+			purged++
+		}
+	}
+	if purged > 0 {
+		metrics.Gauge("jobs.stored", float64(len(s.jobs)))
+	}
+	return purged
+}
+
+// remove drops a job and its saved files, cancelling its scan if it is
+// still queued or running. Callers hold s.mu.
+func (s *JobStore) remove(job *ScanJob) {
+	s.removeRecord(job.ID)
+	s.drop(job)
+}
+
+// drop forgets a job, cancelling its scan if it is still queued or running.
+// Callers hold s.mu.
+func (s *JobStore) drop(job *ScanJob) {
+	delete(s.jobs, job.ID)
+	if job.key != "" {
+		delete(s.keys, jobKey(job.owner, job.key))
+	}
+
+	job.mu.Lock()
+	if job.finished.IsZero() && job.cancel != nil {
+		job.cancel()
+	}
+	job.mu.Unlock()
+}
+
+// jobKey is the keys map key of an Idempotency-Key; keys are scoped to the
+// identity that sent them
+func jobKey(owner, key string) string {
+	return owner + "\x00" + key
+}
+
+// randomID returns an unguessable 128-bit hex identifier
+func randomID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Get returns the job if it exists and belongs to owner
+func (s *JobStore) Get(id, owner string) *ScanJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	job := s.jobs[id]
+	if job == nil {
+		job = s.load(id)
+	}
+	if job == nil || job.owner != owner {
+		return nil
+	}
+	return job
+}
+
+// Find returns the job regardless of its owner, for signed result URLs
+func (s *JobStore) Find(id string) *ScanJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	if job := s.jobs[id]; job != nil {
+		return job
+	}
+	return s.load(id)
+}
+
+// expire drops finished jobs older than the TTL. Callers hold s.mu.
+func (s *JobStore) expire() {
+	now := s.now()
+	expired := 0
+	for id, job := range s.jobs {
+		job.mu.Lock()
+		done := !job.finished.IsZero() && now.Sub(job.finished) > s.ttl
+		job.mu.Unlock()
+		if done {
+			delete(s.jobs, id)
+			s.removeRecord(id)
+			if job.key != "" {
+				delete(s.keys, jobKey(job.owner, job.key))
+			}
+			expired++
+		}
+	}
+	if expired > 0 {
+		metrics.Gauge("jobs.stored", float64(len(s.jobs)))
+	}
+}
+
+// progressKey is the context key for a scan's progress callback
+type progressKey struct{}
+
+// withProgress returns a context whose scans report progress to report
+func withProgress(ctx context.Context, report func(stage string, percent int)) context.Context {
+	return context.WithValue(ctx, progressKey{}, report)
+}
+
+// reportProgress reports a scan's stage and percent, if anyone is listening
+func reportProgress(ctx context.Context, stage string, percent int) {
+	if report, ok := ctx.Value(progressKey{}).(func(string, int)); ok {
+		report(stage, percent)
+	}
+}
+
+// jobOwner identifies the caller that may see a job
+func jobOwner(r *http.Request) string {
+	if identity := identityFromContext(r.Context()); identity != nil {
+		return identity.Key()
+	}
+	return ""
+}
+
+// wantsAsync reports whether the client asked for an async scan, with
+// ?async=true or Prefer: respond-async
+func wantsAsync(r *http.Request) bool {
+	if async := r.URL.Query().Get("async"); async == "true" || async == "1" {
+		return true
+	}
+	return headerHasToken(r.Header, "Prefer", "respond-async")
+}
+
+// idempotencyKey returns the request's Idempotency-Key header ("" = none),
+// or an error if it is too long
+func idempotencyKey(r *http.Request) (string, *requestError) {
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > maxIdempotencyKeyLength {
+		return "", &requestError{status: http.StatusBadRequest, message: fmt.Sprintf("Idempotency-Key exceeds %d characters", maxIdempotencyKeyLength)}
+	}
+	return key, nil
+}
+
+// replayAsyncSubmission answers an async submission whose Idempotency-Key
+// matches an earlier job with that job, before the body is read. Returns
+// true if the request was answered.
+func replayAsyncSubmission(w http.ResponseWriter, r *http.Request) bool {
+	if !wantsAsync(r) || jobs == nil {
+		return false
+	}
+	key, reqErr := idempotencyKey(r)
+	if reqErr != nil {
+		sendRequestError(w, reqErr)
+		return true
+	}
+	job := jobs.Lookup(jobOwner(r), key)
+	if job == nil {
+		return false
+	}
+	log.Printf("Replaying async job %s for a repeated Idempotency-Key", job.ID)
+	acceptJob(w, job, true)
+	return true
+}
+
+// acceptJob responds with 202 Accepted, the job's state and its status URL
+// in Location. replayed marks a job returned for a repeated
+// Idempotency-Key.
+func acceptJob(w http.ResponseWriter, job *ScanJob, replayed bool) {
+	snapshot, _ := job.Snapshot()
+	snapshot.ResultURL = resultURLSigner.URL(job)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", snapshot.StatusURL)
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// submitScanJob starts an async scan of a received upload and responds with
+// 202 Accepted and the job's status and events URLs. An upload repeating an
+// earlier Idempotency-Key is dropped and the earlier job returned.
+func submitScanJob(w http.ResponseWriter, r *http.Request, config *Config, scanner *Scanner, upload *uploadedFile, startTime time.Time) {
+	key, reqErr := idempotencyKey(r)
+	if reqErr != nil {
+		upload.remove()
+		sendRequestError(w, reqErr)
+		return
+	}
+	job, existing := jobs.CreateOnce(jobOwner(r), config.BasePath, key)
+	if existing {
+		upload.remove()
+		log.Printf("Replaying async job %s for a repeated Idempotency-Key", job.ID)
+		acceptJob(w, job, true)
+		return
+	}
+	if job == nil {
+		upload.remove()
+		log.Printf("Async job limit reached, rejecting %s", upload.safeFilename)
+		recordScan(scanTags(r), "rejected", time.Since(startTime), upload.size, nil)
+		sendRequestError(w, &requestError{status: http.StatusServiceUnavailable, message: "Too many scan jobs, try again later", retryAfter: config.ScanQueueWait})
+		return
+	}
+
+	// The scan outlives the request; keep its values (identity, tenant,
+	// trace) but not its cancellation
+	// In coordinator mode a saved job runs on whichever instance claims it;
+	// the lease keeps others off it until then. Jobs with archive passwords
+	// stay here, since the passwords aren't saved.
+	lease := coordinator.Hold(job)
+	err := jobs.persistScan(job, r, upload)
+	if err != nil {
+		log.Printf("Failed to save async job %s, it won't survive a restart: %v", job.ID, err)
+	}
+	if err == nil && upload.dir == "" && len(upload.passwords) == 0 && lease.Share() {
+		log.Printf("Accepted async scan job %s for %s, shared with the cluster", job.ID, upload.safeFilename)
+		acceptJob(w, job, false)
+		return
+	}
+
+	ctx := withProgress(job.start(r.Context()), job.setProgress)
+	jobRequest := r.Clone(ctx)
+	release := detachTenantSlot(r.Context())
+	jobs.Go(job, func() {
+		if release != nil {
+			defer release()
+		}
+		defer lease.Release()
+		runScanJob(ctx, job, jobRequest, config, scanner, upload, startTime)
+	})
+
+	log.Printf("Accepted async scan job %s for %s", job.ID, upload.safeFilename)
+	acceptJob(w, job, false)
+}
+
+// runScanJob scans an async job's upload, records the result and removes
+// the upload
+func runScanJob(ctx context.Context, job *ScanJob, r *http.Request, config *Config, scanner *Scanner, upload *uploadedFile, startTime time.Time) {
+	defer upload.remove()
+	response, reqErr := executeScan(ctx, r, config, scanner, upload, startTime)
+	if reqErr != nil {
+		response = &ScanResponse{Status: "error", Error: reqErr.message, ScanTimeMs: time.Since(startTime).Milliseconds()}
+	}
+	job.finish(response)
+	jobs.persistFinished(job)
+}
+
+// jobFromPath looks up the job named by the last path element for the caller
+func jobFromPath(w http.ResponseWriter, r *http.Request, prefix string) *ScanJob {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	id := strings.TrimPrefix(r.URL.Path, prefix)
+	if jobs == nil || id == "" {
+		sendErrorStatus(w, http.StatusNotFound, "Job not found")
+		return nil
+	}
+	job := jobs.Get(id, jobOwner(r))
+	if job == nil {
+		sendErrorStatus(w, http.StatusNotFound, "Job not found")
+		return nil
+	}
+	return job
+}
+
+// jobStatusHandler returns an async job's state (GET /scan/jobs/{id}) or
+// deletes it (DELETE /scan/jobs/{id})
+func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		deleteJob(w, r)
+		return
+	}
+	job := jobFromPath(w, r, "/scan/jobs/")
+	if job == nil {
+		return
+	}
+	snapshot, _ := job.Snapshot()
+	if notModified(w, r, scanETag(snapshot.Result)) {
+		return
+	}
+	snapshot.ResultURL = resultURLSigner.URL(job)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// deleteJob cancels a queued or running job, or drops a finished job's
+// result before it expires, and responds with 204 No Content
+func deleteJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/scan/jobs/")
+	if jobs == nil || id == "" || !jobs.Delete(id, jobOwner(r)) {
+		sendErrorStatus(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	log.Printf("Deleted async job %s", id)
+	metrics.Count("jobs.deleted", 1)
+	w.WriteHeader(http.StatusNoContent)
+}
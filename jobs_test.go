@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useJobStore sets the async job store for a test, and waits for its jobs
+// at the end so none outlive the test's fakes
+func useJobStore(t *testing.T, store *JobStore) {
+	t.Helper()
+	jobs = store
+	t.Cleanup(func() {
+		store.Wait()
+		jobs = nil
+	})
+}
+
+// useFakeClamdScanner points scans at a fake clamd and returns a config for them
+func useFakeClamdScanner(t *testing.T) *Config {
+	t.Helper()
+	pool, err := NewClamdPool(newFakeClamd(t).address(), 1)
+	if err != nil {
+		t.Fatalf("NewClamdPool() error: %v", err)
+	}
+	clamdPool = pool
+	t.Cleanup(func() { clamdPool = nil })
+
+	return &Config{
+		MaxUploadSize:     1 << 20,
+		MaxExtractedSize:  1 << 20,
+		MaxFileCount:      10,
+		MaxSingleFileSize: 1 << 20,
+		ScanTimeout:       time.Minute,
+	}
+}
+
+func TestWantsAsync(t *testing.T) {
+	tests := []struct {
+		target string
+		prefer string
+		want   bool
+	}{
+		{"/scan", "", false},
+		{"/scan?async=true", "", true},
+		{"/scan?async=false", "", false},
+		{"/scan", "respond-async, wait=10", true},
+		{"/scan", "return=minimal", false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.target, nil)
+		if tt.prefer != "" {
+			req.Header.Set("Prefer", tt.prefer)
+		}
+		if got := wantsAsync(req); got != tt.want {
+			t.Errorf("wantsAsync(%q, Prefer %q) = %v, want %v", tt.target, tt.prefer, got, tt.want)
+		}
+	}
+}
+
+func TestJobStore(t *testing.T) {
+	store := NewJobStore(2, time.Minute)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	first := store.Create("api-key:ci", "")
+	second := store.Create("", "")
+	if first == nil || second == nil {
+		t.Fatal("Create() returned nil below the limit")
+	}
+	if store.Create("", "") != nil {
+		t.Error("Create() succeeded over the limit")
+	}
+
+	if store.Get(first.ID, "api-key:ci") != first {
+		t.Error("Get() did not return the owner's job")
+	}
+	if store.Get(first.ID, "api-key:other") != nil {
+		t.Error("Get() returned another identity's job")
+	}
+
+	// Finished jobs expire after the TTL and free their slot
+	first.finish(&ScanResponse{Status: "clean"})
+	now = now.Add(2 * time.Minute)
+	if store.Get(first.ID, "api-key:ci") != nil {
+		t.Error("expired job still returned")
+	}
+	if store.Create("", "") == nil {
+		t.Error("Create() failed after a job expired")
+	}
+	if store.Get(second.ID, "") == nil {
+		t.Error("unfinished job expired")
+	}
+}
+
+func TestJobStoreIdempotencyKey(t *testing.T) {
+	store := NewJobStore(10, time.Minute)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	first, existing := store.CreateOnce("api-key:ci", "", "upload-1")
+	if first == nil || existing {
+		t.Fatalf("CreateOnce() = %v, %v; want a new job", first, existing)
+	}
+	if again, existing := store.CreateOnce("api-key:ci", "", "upload-1"); again != first || !existing {
+		t.Error("CreateOnce() with a repeated key did not return the existing job")
+	}
+	if other, existing := store.CreateOnce("api-key:other", "", "upload-1"); other == first || existing {
+		t.Error("CreateOnce() shared a key between identities")
+	}
+	if store.Lookup("api-key:ci", "upload-1") != first || store.Lookup("api-key:ci", "") != nil {
+		t.Error("Lookup() did not find the job by key")
+	}
+
+	// The key is released with the job
+	first.finish(&ScanResponse{Status: "clean"})
+	now = now.Add(2 * time.Minute)
+	if store.Lookup("api-key:ci", "upload-1") != nil {
+		t.Error("key of an expired job still found")
+	}
+	if job, existing := store.CreateOnce("api-key:ci", "", "upload-1"); job == first || existing {
+		t.Error("CreateOnce() returned an expired job")
+	}
+}
+
+func TestAsyncScanIdempotencyKey(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	useJobStore(t, NewJobStore(10, time.Minute))
+
+	submit := func(key string) (*httptest.ResponseRecorder, JobResponse) {
+		body, contentType := multipartUpload(t, "test.txt", []byte("hello"))
+		req := httptest.NewRequest(http.MethodPost, "/scan?async=true", body)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Idempotency-Key", key)
+		recorder := httptest.NewRecorder()
+		handleScan(recorder, req, cfg, NewScanner(cfg))
+		var job JobResponse
+		json.NewDecoder(bytes.NewReader(recorder.Body.Bytes())).Decode(&job)
+		return recorder, job
+	}
+
+	first, job := submit("order-42")
+	if first.Code != http.StatusAccepted || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first submission: status %d, headers %v", first.Code, first.Header())
+	}
+	second, replayed := submit("order-42")
+	if second.Code != http.StatusAccepted || second.Header().Get("Idempotent-Replayed") != "true" || replayed.ID != job.ID {
+		t.Errorf("repeated submission: status %d, job %s; want 202 replaying %s", second.Code, replayed.ID, job.ID)
+	}
+	_, other := submit("order-43")
+	if other.ID == job.ID {
+		t.Error("a different key returned the same job")
+	}
+	if tooLong, _ := submit(strings.Repeat("k", maxIdempotencyKeyLength+1)); tooLong.Code != http.StatusBadRequest {
+		t.Errorf("oversized key: status %d, want 400", tooLong.Code)
+	}
+
+	// Both scans run to the end before the fake clamd goes away
+	for _, id := range []string{job.ID, other.ID} {
+		if result := waitForJob(t, jobs.Find(id)).Result; result == nil || result.Status != "clean" {
+			t.Errorf("job %s result = %+v, want clean", id, result)
+		}
+	}
+}
+
+func TestNewJobStoreDisabled(t *testing.T) {
+	if NewJobStore(0, time.Minute) != nil {
+		t.Error("NewJobStore(0) should be nil")
+	}
+}
+
+func TestAsyncScan(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.BasePath = "/antivirus"
+	useJobStore(t, NewJobStore(10, time.Minute))
+
+	body, contentType := multipartUpload(t, "eicar.com", []byte("EICAR"))
+	req := httptest.NewRequest(http.MethodPost, "/scan?async=true", body)
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+
+	handleScan(recorder, req, cfg, NewScanner(cfg))
+
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", recorder.Code, recorder.Body)
+	}
+	var accepted JobResponse
+	json.NewDecoder(recorder.Body).Decode(&accepted)
+	if accepted.Stage != stageQueued || accepted.StatusURL != "/antivirus/scan/jobs/"+accepted.ID {
+		t.Errorf("accepted = %+v", accepted)
+	}
+	if recorder.Header().Get("Location") != accepted.StatusURL {
+		t.Errorf("Location = %q, want %q", recorder.Header().Get("Location"), accepted.StatusURL)
+	}
+
+	var status JobResponse
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		recorder := httptest.NewRecorder()
+		jobStatusHandler(recorder, httptest.NewRequest(http.MethodGet, "/scan/jobs/"+accepted.ID, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("job status = %d", recorder.Code)
+		}
+		status = JobResponse{}
+		json.NewDecoder(recorder.Body).Decode(&status)
+		if status.Stage == stageDone {
+			break
+		}
+	}
+
+	if status.Result == nil || status.Result.Status != "infected" {
+		t.Errorf("job = %+v, want infected result", status)
+	}
+}
+
+func TestAsyncScanPanic(t *testing.T) {
+	store := NewJobStore(10, time.Minute)
+	useJobStore(t, store)
+
+	job := store.Create("", "")
+	store.Go(job, func() {
+		job.setProgress(stageScanning, 0)
+		panic("boom")
+	})
+	store.Wait()
+
+	status := waitForJob(t, job)
+	if status.Result == nil || status.Result.Status != "error" {
+		t.Errorf("job = %+v, want an error result", status)
+	}
+}
+
+func TestJobStatusNotFound(t *testing.T) {
+	useJobStore(t, NewJobStore(10, time.Minute))
+	job := jobs.Create("api-key:ci", "")
+
+	for _, target := range []string{"/scan/jobs/unknown", "/scan/jobs/" + job.ID} {
+		recorder := httptest.NewRecorder()
+		jobStatusHandler(recorder, httptest.NewRequest(http.MethodGet, target, bytes.NewReader(nil)))
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want 404", target, recorder.Code)
+		}
+	}
+}
+
+func TestDeleteJob(t *testing.T) {
+	useJobStore(t, NewJobStore(10, time.Minute))
+	running := jobs.Create("", "")
+	ctx := running.start(context.Background())
+	finished, _ := jobs.CreateOnce("", "", "order-1")
+	finished.finish(&ScanResponse{Status: "clean"})
+	other := jobs.Create("api-key:ci", "")
+
+	remove := func(id string) int {
+		recorder := httptest.NewRecorder()
+		jobStatusHandler(recorder, httptest.NewRequest(http.MethodDelete, "/scan/jobs/"+id, nil))
+		return recorder.Code
+	}
+
+	if code := remove(running.ID); code != http.StatusNoContent {
+		t.Errorf("deleting a running job: status %d, want 204", code)
+	}
+	if ctx.Err() == nil {
+		t.Error("deleting a running job did not cancel its scan")
+	}
+	if code := remove(finished.ID); code != http.StatusNoContent {
+		t.Errorf("deleting a finished job: status %d, want 204", code)
+	}
+	if jobs.Get(finished.ID, "") != nil || jobs.Lookup("", "order-1") != nil {
+		t.Error("deleted job still found")
+	}
+	for _, id := range []string{running.ID, other.ID, "unknown"} {
+		if code := remove(id); code != http.StatusNotFound {
+			t.Errorf("deleting %s: status %d, want 404", id, code)
+		}
+	}
+}
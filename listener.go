@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// First file descriptor passed by systemd socket activation (SD_LISTEN_FDS_START)
+var systemdListenFdsStart = 3
+
+// listen opens the server listener: the socket passed by systemd if the
+// service was socket activated, the unix socket if LISTEN_SOCKET is set,
+// otherwise TCP on BIND_ADDRESS and PORT
+func listen(config *Config) (net.Listener, error) {
+	listener, err := systemdListener()
+	if listener != nil || err != nil {
+		return listener, err
+	}
+	if config.ListenSocket != "" {
+		return listenUnix(config.ListenSocket, config.ListenSocketMode)
+	}
+	return net.Listen("tcp", net.JoinHostPort(config.BindAddress, config.Port))
+}
+
+// listenUnix listens on a unix domain socket with the given permissions.
+// A socket left behind by an unclean shutdown is replaced; any other file at
+// the path is an error.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	return listener, nil
+}
+
+// systemdListener returns the listener passed by systemd socket activation
+// (LISTEN_PID/LISTEN_FDS), or nil if the process wasn't socket activated.
+// The variables are cleared so child processes (clamdscan) don't see them.
+func systemdListener() (net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	names := os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	if count > 1 {
+		log.Printf("Warning: systemd passed %d sockets, using the first", count)
+	}
+
+	name, _, _ := strings.Cut(names, ":")
+	if name == "" {
+		name = "systemd"
+	}
+	file := os.NewFile(uintptr(systemdListenFdsStart), name)
+	defer file.Close()
+
+	// FileListener duplicates the descriptor
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("socket from systemd (%s): %w", name, err)
+	}
+	log.Printf("Using socket %s from systemd socket activation", name)
+	return listener, nil
+}
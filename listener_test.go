@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clamav-rest.sock")
+	cfg := &Config{ListenSocket: path, ListenSocketMode: 0600}
+
+	listener, err := listen(cfg)
+	if err != nil {
+		t.Fatalf("listen() error = %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("socket not created: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %04o, want 0600", info.Mode().Perm())
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Fatalf("request over socket error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestListenUnixStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clamav-rest.sock")
+
+	// A listener that doesn't remove its socket on close, as after a crash
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnix(path, DefaultListenSocketMode)
+	if err != nil {
+		t.Fatalf("listenUnix() error = %v, want stale socket replaced", err)
+	}
+	listener.Close()
+}
+
+func TestListenUnixNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	os.WriteFile(path, []byte("keep me"), 0600)
+
+	if _, err := listenUnix(path, DefaultListenSocketMode); err == nil {
+		t.Fatal("listenUnix() replaced a regular file")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "keep me" {
+		t.Error("regular file was modified")
+	}
+}
+
+func TestSystemdListener(t *testing.T) {
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer socket.Close()
+	file, err := socket.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File() error = %v", err)
+	}
+	defer file.Close()
+
+	// systemdListener closes the descriptor it is given; pass a duplicate
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		t.Fatalf("Dup() error = %v", err)
+	}
+	start := systemdListenFdsStart
+	systemdListenFdsStart = fd
+	t.Cleanup(func() { systemdListenFdsStart = start })
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "clamav-rest.socket")
+
+	listener, err := listen(&Config{Port: "0"})
+	if err != nil {
+		t.Fatalf("listen() error = %v", err)
+	}
+	defer listener.Close()
+
+	if listener.Addr().String() != socket.Addr().String() {
+		t.Errorf("Addr() = %s, want the systemd socket %s", listener.Addr(), socket.Addr())
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS not cleared")
+	}
+}
+
+func TestSystemdListenerOtherProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+
+	listener, err := systemdListener()
+	if listener != nil || err != nil {
+		t.Errorf("systemdListener() = %v, %v, want nil for another process's sockets", listener, err)
+	}
+}
+
+func TestListenBindAddress(t *testing.T) {
+	for _, address := range []string{"127.0.0.1", "[::1]"} {
+		t.Run(address, func(t *testing.T) {
+			t.Setenv(EnvBindAddress, address)
+			t.Setenv(EnvPort, "0")
+
+			listener, err := listen(LoadConfig())
+			if err != nil {
+				t.Skipf("cannot listen on %s: %v", address, err)
+			}
+			defer listener.Close()
+
+			host, _, _ := net.SplitHostPort(listener.Addr().String())
+			if want := strings.Trim(address, "[]"); host != want {
+				t.Errorf("listening on %s, want %s", host, want)
+			}
+		})
+	}
+}
@@ -1,21 +1,58 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // ScanResponse is the JSON response for scan requests
 type ScanResponse struct {
-	Status       string   `json:"status"`        // "clean", "infected", "error"
+	Status       string   `json:"status"`        // "clean", "clean_with_skips", "infected", "suspicious", "rejected", "timeout", "error"
 	Threats      []Threat `json:"threats"`       // List of detected threats
 	ScannedFiles int      `json:"scanned_files"` // Number of files scanned
 	ScanTimeMs   int64    `json:"scan_time_ms"`  // Scan duration in milliseconds
 	Error        string   `json:"error,omitempty"`
+	Token        string   `json:"token,omitempty"` // Signed result token, if enabled
+
+	Hashes   map[string]string `json:"hashes,omitempty"`   // Upload digests (HASH_ALGORITHMS)
+	Files    []*FileAnalysis   `json:"files,omitempty"`    // Every scanned file (STATIC_ANALYSIS=all)
+	Metadata json.RawMessage   `json:"metadata,omitempty"` // Caller metadata, echoed back
+
+	Indicators []Indicator `json:"indicators,omitempty"` // Macros and embedded objects (DOCUMENT_INDICATORS)
+
+	RejectedReason *RejectedReason `json:"rejected_reason,omitempty"` // Why an archive was rejected or flagged as a decompression bomb
+
+	// Scan conditions behind the verdict
+	ScannedBytes   int64         `json:"scanned_bytes"`           // Bytes handed to ClamAV
+	ExtractedFiles int           `json:"extracted_files"`         // Files unpacked from the upload (0 if scanned as is)
+	SkippedFiles   []SkippedFile `json:"skipped_files,omitempty"` // Entries not scanned themselves, with the reason
+	EngineInfo                   // ClamAV engine and signatures the verdict was produced with
+
+	Debug *ScanDebug `json:"debug,omitempty"` // Raw ClamAV exchange (debug mode or ?debug=true for admins)
+
+	Supported *UploadFormats `json:"supported,omitempty"` // How to upload, with 400 and 415 for unusable uploads
+}
+
+// setSummary copies the scan conditions of a result to the response
+func (r *ScanResponse) setSummary(result *ScanResult) {
+	r.ScannedBytes = result.ScannedBytes
+	r.ExtractedFiles = result.ExtractedFiles
+	r.SkippedFiles = result.Skipped
+	r.EngineInfo = result.Engine
 }
 
 // Threat represents a detected virus/malware
@@ -24,6 +61,19 @@ type Threat struct {
 	File     string `json:"file"`                // File path within archive
 	FileHash string `json:"file_hash,omitempty"` // SHA256 hash of infected file
 	Severity string `json:"severity"`            // Always "critical" for malware
+
+	Platform string `json:"platform,omitempty"` // From the signature name, e.g. Win
+	Category string `json:"category,omitempty"` // e.g. Trojan, PUA or Heuristics
+	Family   string `json:"family,omitempty"`   // e.g. Emotet
+
+	Tags []string `json:"tags,omitempty"` // ATT&CK techniques, family aliases etc. from THREAT_TAGS_FILE
+
+	MalwareBazaar *BazaarInfo `json:"malwarebazaar,omitempty"` // The sample on MalwareBazaar, if known (MALWAREBAZAAR_AUTH_KEY)
+
+	Hashes map[string]string `json:"hashes,omitempty"` // Digests of the infected file (HASH_ALGORITHMS)
+	SSDeep string            `json:"ssdeep,omitempty"` // Fuzzy hash of the infected file (FUZZY_HASHING)
+
+	Analysis *FileAnalysis `json:"analysis,omitempty"` // Static triage context (STATIC_ANALYSIS)
 }
 
 // HealthResponse for health check endpoint
@@ -33,43 +83,577 @@ type HealthResponse struct {
 	DBVersion     string `json:"db_version,omitempty"`
 }
 
+// ReadyResponse for the readiness endpoint
+type ReadyResponse struct {
+	Status  string `json:"status"`
+	Circuit string `json:"circuit,omitempty"` // clamd circuit breaker state
+}
+
+// StartupResponse for the startup probe endpoint
+type StartupResponse struct {
+	Status         string `json:"status"`                    // "starting" or "started"
+	ElapsedSeconds int    `json:"elapsed_seconds"`           // Time waited for clamd so far, or until it answered
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty"` // CLAMD_STARTUP_WAIT_SECONDS
+	Attempts       int    `json:"attempts,omitempty"`        // clamd pings tried
+	LastError      string `json:"last_error,omitempty"`      // Why the last ping failed
+}
+
 // Global scanner instance
 var scanner *Scanner
 
 // Global config instance
 var config *Config
 
+// Scope required for /admin endpoints
+const adminScope = "admin"
+
+// Scope required for GET /threats/feed
+const threatsScope = "threats"
+
+// Scope of callers whose scans are not shed under system pressure
+const priorityScope = "priority"
+
 func main() {
-	// Load configuration from environment variables
+	// Subcommands (backup, restore, ...) run instead of the server
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
+	configFile := flag.String("config", "", "JSON or YAML config file (environment variables override its settings)")
+	validateOnly := flag.Bool("validate-config", false, "Validate the configuration and exit (non-zero if invalid)")
+	registerSettingFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n       %s <command> [args]\n\n", os.Args[0], os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Every setting can also be given as an environment variable or in the -config file.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Precedence: flags, environment, config file, defaults.\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *configFile != "" {
+		if err := LoadConfigFile(*configFile); err != nil {
+			log.Fatalf("Invalid config file: %v", err)
+		}
+	}
+
+	// Load configuration from environment variables and the config file
 	config = LoadConfig()
 
+	if *validateOnly {
+		if err := checkConfig(config); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+			os.Exit(exitError)
+		}
+		fmt.Println("Configuration is valid")
+		os.Exit(exitOK)
+	}
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if err := configureEgress(config); err != nil {
+		log.Fatalf("Invalid egress configuration: %v", err)
+	}
+
 	// Log configuration on startup
-	log.Printf("ClamAV REST server starting...")
+	log.Printf("ClamAV REST server %s starting...", buildVersion)
 	config.LogConfig()
 
 	// Initialize scanner with configuration
 	scanner = NewScanner(config)
 
+	var err error
+	metrics, err = NewMetrics(config)
+	if err != nil {
+		log.Fatalf("Invalid metrics config: %v", err)
+	}
+
+	// Remove scan temp data left behind by a crashed or killed process
+	scanTmpDir = config.ScanTmpDir
+	if scanTmpDir != "" {
+		if err := os.MkdirAll(scanTmpDir, 0755); err != nil {
+			log.Fatalf("Invalid temp directory: %v", err)
+		}
+	}
+	if removed, bytes := cleanOrphanedTemp(tempDir()); removed > 0 {
+		log.Printf("Removed %d orphaned scan temp entries (%d bytes) from %s", removed, bytes, tempDir())
+	}
+	if _, off := metrics.(noopMetrics); !off {
+		startTempDirMetrics()
+	}
+
+	// Small containers cap in-memory extraction and shed scans under pressure
+	extractBudget = newBufferBudget(config)
+	faults = NewFaultInjector(config)
+	shedder := NewLoadShedder(config)
+	if shedder != nil {
+		shedder.Start()
+	}
+
+	auditLog, err = NewAuditLogger(config)
+	if err != nil {
+		log.Fatalf("Invalid audit log config: %v", err)
+	}
+
+	history, err = NewScanHistory(config)
+	if err != nil {
+		log.Fatalf("Invalid scan history config: %v", err)
+	}
+
+	siem, err = NewSIEMForwarder(config)
+	if err != nil {
+		log.Fatalf("Invalid SIEM config: %v", err)
+	}
+
+	notifier, err = NewNotifier(config)
+	if err != nil {
+		log.Fatalf("Invalid notification config: %v", err)
+	}
+
+	indexer, err = NewIndexer(config)
+	if err != nil {
+		log.Fatalf("Invalid Elasticsearch config: %v", err)
+	}
+
+	malwareBazaar = NewMalwareBazaar(config)
+
+	resultSigner, err = NewResultSigner(config)
+	if err != nil {
+		log.Fatalf("Invalid result token config: %v", err)
+	}
+	resultURLSigner = NewResultURLSigner(config)
+
+	imageScanner, err = NewImageScanner(config, scanner)
+	if err != nil {
+		log.Fatalf("Invalid image scanning config: %v", err)
+	}
+
+	objectScanner, err = NewObjectScanner(config)
+	if err != nil {
+		log.Fatalf("Invalid object storage config: %v", err)
+	}
+
+	remoteScanner, err = NewRemoteScanner(config)
+	if err != nil {
+		log.Fatalf("Invalid remote scanning config: %v", err)
+	}
+
+	if config.ClamdAddress != "" {
+		clamdPool, err = NewClamdPool(config.ClamdAddress, config.ClamdPoolSize)
+		if err != nil {
+			log.Fatalf("Invalid clamd config: %v", err)
+		}
+	}
+
+	clamdBreaker = NewCircuitBreaker(config.ClamdBreakerThreshold, config.ClamdBreakerCooldown)
+
+	// Hold off scan traffic until clamd has loaded its signatures
+	watchdog := NewClamdWatchdog(config, func() error {
+		_, _, err := scanner.GetVersion()
+		return err
+	})
+	if watchdog != nil {
+		watchdog.Start()
+	}
+
+	scanPool = NewWorkerPool(config.ScanWorkers, config.ScanQueueSize, config.ScanQueueWait)
+	jobs = NewJobStore(config.AsyncMaxJobs, config.AsyncJobTTL)
+	uploads = NewUploadStore(config.UploadSessionsMax, config.UploadSessionTTL)
+
+	// Drop folders are scanned alongside HTTP traffic, sharing the workers
+	dirWatcher, err := NewDirWatcher(config, scanner)
+	if err != nil {
+		log.Fatalf("Invalid watched directory config: %v", err)
+	}
+	if dirWatcher != nil {
+		dirWatcher.Start()
+	}
+	if rescanner := NewRescanner(config, scanner); rescanner != nil {
+		rescanner.Start()
+	}
+	if purger := NewRetentionPurger(config); purger != nil {
+		purger.Start()
+	}
+
+	// Client IPs behind these proxies come from X-Forwarded-For / X-Real-IP
+	trustedProxies, err = parseNetworks(config.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err)
+	}
+	ipFilter, err := NewIPFilter(config)
+	if err != nil {
+		log.Fatalf("Invalid IP filter: %v", err)
+	}
+
+	// Tracing is enabled by the standard OTEL_EXPORTER_OTLP_* variables
+	if tracingConfig := LoadTracingConfig(); tracingConfig != nil {
+		tracer = NewTracer(tracingConfig)
+		log.Printf("  Tracing: exporting to %s", tracingConfig.Endpoint)
+	}
+
+	auth, err := NewAuthenticator(config)
+	if err != nil {
+		log.Fatalf("Invalid authentication config: %v", err)
+	}
+
 	// Set up routes
+	// Health stays unauthenticated so liveness/readiness probes keep working
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", healthHandler)
-	mux.HandleFunc("/scan", scanHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/livez", livezHandler)
+	mux.HandleFunc("/startupz", startupzHandler)
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("/.well-known/jwks.json", resultKeysHandler)
+
+	var routes []*ScanRoute
+	if config.ScanRoutesFile != "" {
+		routes, err = LoadScanRoutes(config.ScanRoutesFile, config)
+		if err != nil {
+			log.Fatalf("Invalid scan routes: %v", err)
+		}
+	}
+
+	if config.TenantsFile != "" {
+		tenants, err = LoadTenants(config.TenantsFile)
+		if err != nil {
+			log.Fatalf("Invalid tenants config: %v", err)
+		}
+	}
+
+	if config.ThreatClassesFile != "" {
+		threatClasses, err = LoadThreatClasses(config.ThreatClassesFile)
+		if err != nil {
+			log.Fatalf("Invalid threat classes: %v", err)
+		}
+	}
+	if config.ThreatTagsFile != "" {
+		threatTags, err = LoadThreatTags(config.ThreatTagsFile)
+		if err != nil {
+			log.Fatalf("Invalid threat tags: %v", err)
+		}
+	}
+
+	// Async jobs saved before a restart run again now that identities and
+	// tenants are known
+	coordinator, err = NewCoordinator(config, scanner, jobs)
+	if err != nil {
+		log.Fatalf("Invalid coordinator config: %v", err)
+	}
+	if jobs != nil {
+		switch {
+		case coordinator != nil:
+			// Shared with other instances, which may be running its jobs
+			if err := jobs.Share(config.AsyncJobDir); err != nil {
+				log.Fatalf("Invalid async job directory: %v", err)
+			}
+			coordinator.Start()
+		case config.AsyncJobDir != "":
+			if err := jobs.Recover(config.AsyncJobDir, config, scanner); err != nil {
+				log.Fatalf("Invalid async job directory: %v", err)
+			}
+		}
+		jobs.StartCleanup()
+	}
+
+	// Scan endpoints are capped in flight per client IP and in total before
+	// authentication, then rate limited per API key / client IP, shed under
+	// memory pressure and subject to the caller's tenant limits, scan
+	// timeout and decompression budget
+	inFlight := NewInFlightLimiter(config.MaxInFlightPerIP, config.MaxInFlight)
+	limiter := NewRateLimiter(config.RateLimitRPS, config.RateLimitBurst)
+	// Failed authentication attempts on any route are rate limited per client
+	// IP, which rejections by requireAuth would otherwise skip
+	auth = limitAuthFailures(limiter, auth)
+	// Scan routes apply their own profile's timeout and extraction limits
+	protectRoute := func(routeConfig *Config, h http.Handler) http.Handler {
+		return limitInFlight(inFlight, requireAuth(auth, applyDeadline(limitRate(limiter, shedLoad(shedder, enforceTenant(tenants, limitScanTimeout(routeConfig, limitExtraction(routeConfig, selectHeuristics(routeConfig, injectLatency(faults, h))))))))))
+	}
+	protectScan := func(h http.Handler) http.Handler {
+		return protectRoute(config, h)
+	}
+
+	// Declared routes may redefine /scan; otherwise it uses the global limits.
+	// Each route also takes PUT {path}/{filename} with the file as the body
+	defaultRoute := true
+	for _, route := range routes {
+		route.LogRoute()
+		mux.Handle(route.Path, protectRoute(route.config, route.Handler()))
+		if !strings.HasSuffix(route.Path, "/") {
+			mux.Handle(route.Path+"/", scanByName(route.Path, protectRoute(route.config, route.Handler())))
+		}
+		if route.Path == "/scan" {
+			defaultRoute = false
+		}
+	}
+	if defaultRoute {
+		mux.Handle("/scan", protectScan(http.HandlerFunc(scanHandler)))
+		mux.Handle("/scan/", scanByName("/scan", protectScan(http.HandlerFunc(scanHandler))))
+	}
+
+	// Browsers can stream uploads over a WebSocket, which CORS doesn't cover
+	corsPolicy := NewCORSPolicy(config)
+	mux.Handle("/scan/ws", protectScan(scanSocketHandler(corsPolicy)))
+
+	// Images are pulled from allowed registries only
+	if imageScanner != nil {
+		mux.Handle("/scan/image", protectScan(http.HandlerFunc(imageScanHandler)))
+	}
+
+	// Mounted directories are scanned in place, below the allowed roots only
+	if len(config.ScanPathRoots) > 0 {
+		mux.Handle("/scan/path", protectScan(http.HandlerFunc(pathScanHandler)))
+	}
+
+	// Objects are read with the service's storage credentials only
+	if objectScanner != nil {
+		mux.Handle("/scan/object", protectScan(http.HandlerFunc(objectScanHandler)))
+	}
+
+	// SFTP and FTPS files are fetched from allowed hosts only
+	if remoteScanner != nil {
+		mux.Handle("/scan/remote", protectScan(http.HandlerFunc(remoteScanHandler)))
+	}
+
+	// Hashing reads the upload but never reaches clamd, so only the request
+	// limits apply
+	mux.Handle("/hash", limitInFlight(inFlight, requireAuth(auth, limitRate(limiter, http.HandlerFunc(hashHandler)))))
+
+	// Clean documents are returned disarmed
+	if config.EnableSanitize {
+		mux.Handle("/sanitize", protectScan(http.HandlerFunc(sanitizeHandler)))
+	}
+
+	// Batches combine remote files and objects, so need one of them enabled
+	if remoteScanner != nil || objectScanner != nil {
+		mux.Handle("/scan/batch", protectScan(http.HandlerFunc(batchScanHandler)))
+	}
+
+	// Resumable uploads are scanned once complete. Chunks are rate limited;
+	// only the scan counts against tenant limits.
+	if uploads != nil {
+		protectUpload := func(h http.Handler) http.Handler {
+			return requireAuth(auth, limitRate(limiter, h))
+		}
+		uploadHandler := uploadRoutes(protectUpload(http.HandlerFunc(uploadsHandler)), protectScan(http.HandlerFunc(uploadScanHandler)))
+		mux.Handle("/uploads", uploadHandler)
+		mux.Handle("/uploads/", uploadHandler)
+	}
+
+	// Async jobs are visible only to the identity that submitted them
+	mux.Handle("/scan/jobs/", requireAuth(auth, http.HandlerFunc(jobStatusHandler)))
+	mux.Handle("/scan/events/", requireAuth(auth, http.HandlerFunc(jobEventsHandler)))
+	// Signed result URLs stand in for credentials, but are still rate limited
+	mux.Handle("/scan/results/", limitRate(limiter, http.HandlerFunc(resultHandler)))
+
+	// Admin endpoints require the admin scope
+	mux.Handle("/admin/backup", requireAuth(auth, requireScope(adminScope, http.HandlerFunc(backupHandler))))
+	mux.Handle("/admin/restore", requireAuth(auth, requireScope(adminScope, http.HandlerFunc(restoreHandler))))
+	mux.Handle("/admin/tenants", requireAuth(auth, requireScope(adminScope, http.HandlerFunc(tenantsHandler))))
+	mux.Handle("/admin/tenants/", requireAuth(auth, requireScope(adminScope, http.HandlerFunc(tenantsHandler))))
+	mux.Handle("/admin/stats", requireAuth(auth, requireScope(adminScope, http.HandlerFunc(statsHandler))))
+	mux.Handle("/admin/reload-db", requireAuth(auth, requireScope(adminScope, http.HandlerFunc(reloadHandler))))
+	mux.Handle("/admin/config", requireAuth(auth, requireScope(adminScope, http.HandlerFunc(configDumpHandler))))
+	if history != nil {
+		mux.Handle("/stats", requireAuth(auth, requireScope(adminScope, http.HandlerFunc(scanStatsHandler))))
+		mux.Handle("/threats/feed", requireAuth(auth, requireScope(threatsScope, http.HandlerFunc(threatFeedHandler))))
+	}
+	mux.Handle("/admin/records", requireAuth(auth, requireScope(adminScope, http.HandlerFunc(purgeRecordsHandler))))
+	if coordinator != nil {
+		mux.Handle("/admin/cluster", requireAuth(auth, requireScope(adminScope, http.HandlerFunc(clusterHandler))))
+	}
+
+	if config.EnableDiagnostics {
+		registerDiagnostics(mux, func(h http.Handler) http.Handler {
+			return requireAuth(auth, requireScope(adminScope, h))
+		})
+	}
 
 	// Configure server with timeouts to prevent slow-loris attacks
 	// and connection exhaustion
+	var handler http.Handler = mux
+	if config.BasePath != "" {
+		handler = withBasePath(config.BasePath, handler)
+	}
+	// Preflight requests carry no credentials, so CORS runs before auth
+	handler = handleCORS(corsPolicy, handler)
+	// Disallowed clients are turned away before anything else runs
+	handler = filterIPs(ipFilter, handler)
+	if config.EnableResponseCompression {
+		handler = compressResponses(config.ResponseCompressionMinBytes, handler)
+	}
+	// Panics anywhere below become a 500 the trace span still records
+	handler = recoverPanics(handler)
 	server := &http.Server{
-		Addr:         ":" + config.Port,
-		Handler:      mux,
+		Handler:      traceRequests(handler),
 		ReadTimeout:  config.ReadTimeout,
 		WriteTimeout: config.WriteTimeout,
 		IdleTimeout:  config.IdleTimeout,
 	}
+	configureHTTP2(server, config.EnableHTTP2)
+
+	listener, err := listen(config)
+	if err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
 
-	log.Printf("Listening on port %s", config.Port)
+	if config.TLSCertFile != "" {
+		tlsConfig, err := buildTLSConfig(config)
+		if err != nil {
+			log.Fatalf("Invalid TLS config: %v", err)
+		}
+		server.TLSConfig = tlsConfig
 
-	if err := server.ListenAndServe(); err != nil {
+		log.Printf("Listening on %s (TLS)", listener.Addr())
+		err = server.ServeTLS(listener, config.TLSCertFile, config.TLSKeyFile)
 		log.Fatalf("Server failed to start: %v", err)
 	}
+
+	log.Printf("Listening on %s", listener.Addr())
+
+	if err := server.Serve(listener); err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+}
+
+// withBasePath serves h under the route prefix (removed from the request
+// path) and answers 404 for paths outside it
+func withBasePath(base string, h http.Handler) http.Handler {
+	strip := http.StripPrefix(base, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, base+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		strip.ServeHTTP(w, r)
+	})
+}
+
+// putFilenameKey is the context key for the file name of a PUT upload
+type putFilenameKey struct{}
+
+// scanByName serves PUT {route}/{filename} uploads: the raw body is the file
+// and its name comes from the path. The request is passed on with the
+// route's own path so metrics and logs aren't keyed by file name.
+func scanByName(routePath string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, routePath+"/")
+		if r.Method != http.MethodPut {
+			w.Header().Set("Allow", http.MethodPut)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if name == "" {
+			sendErrorStatus(w, http.StatusBadRequest, "No filename in path")
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), putFilenameKey{}, name))
+		u := *r.URL
+		u.Path, u.RawPath = routePath, ""
+		r.URL = &u
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkConfig validates the config and the files and subsystem settings it
+// refers to, without starting anything (for -validate-config)
+func checkConfig(config *Config) error {
+	errs := []error{config.Validate()}
+
+	if _, err := NewAuthenticator(config); err != nil {
+		errs = append(errs, err)
+	}
+	if config.ScanRoutesFile != "" {
+		if _, err := LoadScanRoutes(config.ScanRoutesFile, config); err != nil {
+			errs = append(errs, fmt.Errorf("scan routes: %w", err))
+		}
+	}
+	if config.TenantsFile != "" {
+		if _, err := LoadTenants(config.TenantsFile); err != nil {
+			errs = append(errs, fmt.Errorf("tenants: %w", err))
+		}
+	}
+	if config.ThreatClassesFile != "" {
+		if _, err := LoadThreatClasses(config.ThreatClassesFile); err != nil {
+			errs = append(errs, fmt.Errorf("threat classes: %w", err))
+		}
+	}
+	if config.ThreatTagsFile != "" {
+		if _, err := LoadThreatTags(config.ThreatTagsFile); err != nil {
+			errs = append(errs, fmt.Errorf("threat tags: %w", err))
+		}
+	}
+	if config.ClamdAddress != "" {
+		if _, err := NewClamdPool(config.ClamdAddress, config.ClamdPoolSize); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if config.NotifyURL != "" {
+		if _, err := newNotifier(config); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if config.ElasticsearchURL != "" {
+		if _, err := newIndexer(config); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, err := NewResultSigner(config); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := NewImageScanner(config, nil); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := NewObjectScanner(config); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := NewRemoteScanner(config); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := NewDirWatcher(config, nil); err != nil {
+		errs = append(errs, err)
+	}
+	if config.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("TLS certificate: %w", err))
+		}
+		if _, err := buildTLSConfig(config); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// buildTLSConfig creates the server TLS config.
+// When a client CA is configured, client certificates are verified if presented
+// (not required, so mTLS can be chained with other auth methods).
+func buildTLSConfig(config *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.TLSClientCAFile != "" {
+		pool, err := loadCertPool(config.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// loadCertPool reads PEM-encoded CA certificates from a file
+func loadCertPool(path string) (*x509.CertPool, error) {
+	caPEM, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
 }
 
 // healthHandler returns service health status.
@@ -97,104 +681,603 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// scanHandler handles file upload and scanning
+// readyzHandler reports whether the service should receive scan traffic.
+// Returns 503 while waiting for clamd on startup, during a signature reload
+// started with /admin/reload-db, or while the clamd circuit breaker is open.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if clamdStarting.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ReadyResponse{Status: "starting"})
+		return
+	}
+
+	if clamdReload.active() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ReadyResponse{Status: "reloading"})
+		return
+	}
+
+	if clamdBreaker == nil {
+		json.NewEncoder(w).Encode(ReadyResponse{Status: "ready"})
+		return
+	}
+
+	state := clamdBreaker.State()
+	if state == circuitOpen {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ReadyResponse{Status: "unavailable", Circuit: state})
+		return
+	}
+	json.NewEncoder(w).Encode(ReadyResponse{Status: "ready", Circuit: state})
+}
+
+// startupzHandler is the startup probe. Returns 503 with the wait's progress
+// until clamd has loaded its signatures and answered after startup, then 200
+// for good, so the orchestrator holds off the other probes meanwhile.
+func startupzHandler(w http.ResponseWriter, r *http.Request) {
+	starting := clamdStarting.Load()
+	w.Header().Set("Content-Type", "application/json")
+	if starting {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(clamdStartup.snapshot(starting))
+}
+
+// livezHandler is the liveness probe. It only shows that the server is
+// serving: clamd being down or reloading is left to /readyz, and the
+// watchdog restarts the process if clamd stays down.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ReadyResponse{Status: "alive"})
+}
+
+// scanHandler handles file upload and scanning on the default /scan route
 func scanHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+	handleScan(w, r, config, scanner)
+}
+
+// handleScan handles file upload and scanning using the given limits and scanner
+func handleScan(w http.ResponseWriter, r *http.Request, config *Config, scanner *Scanner) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	startTime := time.Now()
+	if rejectWhileStarting(w, r, startTime) {
+		return
+	}
 
-	// Parse multipart form with configured size limit
-	if err := r.ParseMultipartForm(config.MaxUploadSize); err != nil {
-		// Log full error internally, return generic message to client
-		log.Printf("Failed to parse multipart form: %v", err)
-		sendError(w, "Invalid request format")
+	// A repeated async submission gets its job back without another upload
+	if replayAsyncSubmission(w, r) {
 		return
 	}
 
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		log.Printf("No file in request: %v", err)
-		sendError(w, "No file provided in request")
+	upload, reqErr := receiveUpload(r.Context(), w, r, config)
+	if reqErr != nil {
+		recordScan(scanTags(r), "rejected", time.Since(startTime), 0, nil)
+		indexScan(r, nil, &ScanResponse{Status: "error", Error: reqErr.message, ScanTimeMs: time.Since(startTime).Milliseconds()})
+		sendRequestError(w, reqErr)
 		return
 	}
-	defer file.Close()
 
-	// Sanitize filename for logging (remove control characters, limit length)
-	safeFilename := sanitizeFilename(header.Filename)
-	log.Printf("Received file: %s (%d bytes)", safeFilename, header.Size)
+	respondScan(w, r, config, scanner, upload, startTime)
+}
 
-	tempFile, err := os.CreateTemp("", "clamav-scan-*")
-	if err != nil {
-		log.Printf("Failed to create temp file: %v", err)
-		sendError(w, "Server error during file processing")
+// rejectWhileStarting rejects a scan with 503 until clamd has answered after
+// startup. Returns true if the request was rejected.
+func rejectWhileStarting(w http.ResponseWriter, r *http.Request, startTime time.Time) bool {
+	if !clamdStarting.Load() {
+		return false
+	}
+	recordScan(scanTags(r), "rejected", time.Since(startTime), 0, nil)
+	indexScan(r, nil, &ScanResponse{Status: "error", Error: "Scanner starting", ScanTimeMs: time.Since(startTime).Milliseconds()})
+	sendRequestError(w, &requestError{status: http.StatusServiceUnavailable, message: "Scanner starting, try again later", retryAfter: clamdWatchInterval})
+	return true
+}
+
+// respondScan scans a received upload and sends the result, or starts an
+// async job if the client asked for one. The upload's temp file is removed
+// once scanned.
+func respondScan(w http.ResponseWriter, r *http.Request, config *Config, scanner *Scanner, upload *uploadedFile, startTime time.Time) {
+	if wantsAsync(r) && jobs != nil {
+		submitScanJob(w, r, config, scanner, upload, startTime)
 		return
 	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
+	defer upload.remove()
 
-	if _, err := io.Copy(tempFile, file); err != nil {
-		log.Printf("Failed to write temp file: %v", err)
-		sendError(w, "Server error during file processing")
+	response, reqErr := executeScan(r.Context(), r, config, scanner, upload, startTime)
+	if reqErr != nil {
+		sendRequestError(w, reqErr)
 		return
 	}
-	tempFile.Close()
+	writeScanResponse(w, response)
+}
 
-	result, err := scanner.ScanFile(tempFile.Name())
+// writeScanResponse sends a scan response, with 422 for rejected uploads
+// and 504 for timed out scans
+func writeScanResponse(w http.ResponseWriter, response *ScanResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	if etag := scanETag(response); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	switch response.Status {
+	case "rejected":
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	case "timeout":
+		w.WriteHeader(http.StatusGatewayTimeout)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// executeScan scans a received upload and records the outcome (metrics,
+// detection reports, result index). Rejections and failures are returned as
+// a requestError for the client.
+func executeScan(ctx context.Context, r *http.Request, config *Config, scanner *Scanner, upload *uploadedFile, startTime time.Time) (*ScanResponse, *requestError) {
+	safeFilename := upload.safeFilename
+	// Stream-extracted tars were checked before extraction
+	if filePolicyEnabled(config) && upload.dir == "" {
+		if reqErr := refuseByPolicy(config, upload.filename, safeFilename, readHead(upload.path)); reqErr != nil {
+			recordScan(scanTags(r), "rejected", time.Since(startTime), upload.size, nil)
+			indexScan(r, upload, &ScanResponse{Status: "error", Error: reqErr.message, ScanTimeMs: time.Since(startTime).Milliseconds()})
+			return nil, reqErr
+		}
+	}
+	if verdict, reqErr := requestTestVerdict(r, config); verdict != "" || reqErr != nil {
+		if reqErr != nil {
+			return nil, reqErr
+		}
+		return testVerdictResponse(config, scanner, upload, verdict, startTime)
+	}
+	if upload.rejected != nil && config.ArchiveBombAction != bombActionFlag {
+		return rejectBomb(r, upload, upload.rejected, startTime), nil
+	}
+	var debug *ScanDebug
+	if wantsDebug(r, config) {
+		ctx, debug = withScanDebug(ctx)
+	}
+	ctx = withArchivePasswords(ctx, upload.passwords)
+	result, err := scanUpload(ctx, scanner, upload)
+	var bomb *bombError
+	if errors.As(err, &bomb) {
+		return rejectBomb(r, upload, bomb.reason, startTime), nil
+	}
+	if errors.Is(err, errQueueFull) {
+		log.Printf("Scan queue full, rejecting %s", safeFilename)
+		recordScan(scanTags(r), "rejected", time.Since(startTime), upload.size, nil)
+		indexScan(r, upload, &ScanResponse{Status: "error", Error: "Scanner busy", ScanTimeMs: time.Since(startTime).Milliseconds()})
+		return nil, &requestError{status: http.StatusServiceUnavailable, message: "Scanner busy, try again later", retryAfter: config.ScanQueueWait}
+	}
+	if errors.Is(err, errInsufficientSpace) {
+		log.Printf("Scan failed for %s: %v", safeFilename, err)
+		recordScan(scanTags(r), "error", time.Since(startTime), upload.size, nil)
+		indexScan(r, upload, &ScanResponse{Status: "error", Error: "Insufficient storage", ScanTimeMs: time.Since(startTime).Milliseconds()})
+		return nil, insufficientStorage()
+	}
+	if deadline := contextDeadline(ctx); deadline > 0 && deadlinePassed(ctx) && !errors.As(err, new(*scanTimeoutError)) {
+		// The caller's X-Deadline-Ms passed while queued or extracting
+		err = &scanTimeoutError{timeout: deadline, engine: scanner.cachedEngine()}
+	}
+	var timeout *scanTimeoutError
+	if errors.As(err, &timeout) {
+		response := timedOut(r, upload, timeout, startTime)
+		response.Debug = debug.recorded()
+		return response, nil
+	}
+	if errors.Is(err, errCircuitOpen) {
+		log.Printf("clamd circuit open, rejecting %s", safeFilename)
+		recordScan(scanTags(r), "rejected", time.Since(startTime), upload.size, nil)
+		indexScan(r, upload, &ScanResponse{Status: "error", Error: "Scanner unavailable", ScanTimeMs: time.Since(startTime).Milliseconds()})
+		return nil, &requestError{status: http.StatusServiceUnavailable, message: "Scanner unavailable, try again later", retryAfter: config.ClamdBreakerCooldown}
+	}
 	if err != nil {
 		log.Printf("Scan failed for %s: %v", safeFilename, err)
-		sendError(w, "Scan operation failed")
-		return
+		recordScan(scanTags(r), "error", time.Since(startTime), upload.size, nil)
+		indexScan(r, upload, &ScanResponse{Status: "error", Error: "Scan operation failed", ScanTimeMs: time.Since(startTime).Milliseconds()})
+		return nil, &requestError{status: http.StatusInternalServerError, message: "Scan operation failed"}
 	}
 
-	status := "clean"
-	if len(result.Threats) > 0 {
+	if upload.rejected != nil {
+		result.Rejected = upload.rejected
+	}
+	status := cleanStatus(result.Skipped)
+	switch {
+	case len(result.Threats) > 0:
 		status = "infected"
+	case result.Rejected != nil:
+		status = "suspicious"
 	}
 
-	response := ScanResponse{
+	response := &ScanResponse{
 		Status:       status,
 		Threats:      result.Threats,
 		ScannedFiles: result.ScannedFiles,
 		ScanTimeMs:   time.Since(startTime).Milliseconds(),
+		Files:        result.Files,
+		Metadata:     upload.metadata,
+		Indicators:   result.Indicators,
+
+		RejectedReason: result.Rejected,
+	}
+	response.setSummary(result)
+	if hashes, err := upload.fileHashes(config.HashAlgorithms); err != nil {
+		log.Printf("Failed to hash %s: %v", safeFilename, err)
+	} else {
+		response.Hashes = hashes
+	}
+	if resultSigner != nil {
+		response.Token = resultSigner.ResultToken(upload, response)
 	}
 
 	log.Printf("Scan completed: %s - %s (%d threats, %d files, %dms)",
 		safeFilename, status, len(result.Threats), result.ScannedFiles, response.ScanTimeMs)
+	recordScan(scanTags(r), status, time.Since(startTime), upload.size, result)
+	if status == "infected" {
+		reportDetection(r, upload, result.Threats)
+	}
+	indexScan(r, upload, response)
+	response.Debug = debug.recorded()
+	return response, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+// rejectBomb records an archive rejected as a likely decompression bomb and
+// returns its "rejected" response, sent with 422
+func rejectBomb(r *http.Request, upload *uploadedFile, reason *RejectedReason, startTime time.Time) *ScanResponse {
+	log.Printf("Rejected %s as a possible decompression bomb: %s", upload.safeFilename, reason.Detail)
+	recordScan(scanTags(r), "rejected", time.Since(startTime), upload.size, nil)
+	response := &ScanResponse{
+		Status:         "rejected",
+		ScanTimeMs:     time.Since(startTime).Milliseconds(),
+		Error:          "Archive rejected as a possible decompression bomb",
+		Metadata:       upload.metadata,
+		RejectedReason: reason,
+	}
+	indexScan(r, upload, response)
+	return response
+}
+
+// timedOut records a scan stopped by SCAN_TIMEOUT and returns its "timeout"
+// response, sent with 504, with the threats found and files scanned before
+// the timeout
+func timedOut(r *http.Request, upload *uploadedFile, timeout *scanTimeoutError, startTime time.Time) *ScanResponse {
+	log.Printf("Scan timed out for %s after %v (%d threats, %d files scanned so far)",
+		upload.safeFilename, timeout.timeout, len(timeout.threats), timeout.scanned)
+	partial := &ScanResult{Threats: timeout.threats, ScannedFiles: timeout.scanned}
+	recordScan(scanTags(r), "timeout", time.Since(startTime), upload.size, partial)
+	if len(timeout.threats) > 0 {
+		reportDetection(r, upload, timeout.threats)
+	}
+	response := &ScanResponse{
+		Status:       "timeout",
+		Threats:      timeout.threats,
+		ScannedFiles: timeout.scanned,
+		ScanTimeMs:   time.Since(startTime).Milliseconds(),
+		Error:        fmt.Sprintf("Scan timed out after %v; threats and scanned_files cover only the part scanned", timeout.timeout),
+		Metadata:     upload.metadata,
+		EngineInfo:   timeout.engine,
+	}
+	if response.Threats == nil {
+		response.Threats = []Threat{}
+	}
+	indexScan(r, upload, response)
+	return response
+}
+
+// requestError is a request failure reported to the client
+type requestError struct {
+	status     int            // HTTP status code
+	message    string         // Generic, sanitized message for the client
+	retryAfter time.Duration  // Sent as Retry-After if set
+	formats    *UploadFormats // Uploads the endpoint accepts, for errors about unusable ones
+}
+
+// uploadedFile is an upload saved to a temp file for scanning, or with
+// STREAM_EXTRACTION, a tar upload extracted to a temp directory
+type uploadedFile struct {
+	path         string // Temp file path (caller removes it)
+	filename     string // Client filename as sent
+	safeFilename string // Client filename, sanitized for logging
+	size         int64
+	metadata     json.RawMessage // Caller metadata (nil = none)
+	passwords    []string        // Archive passwords sent with the upload (never logged)
+
+	dir       string            // Extracted entries instead of path (caller removes it)
+	fileCount int               // Number of files in dir, including duplicates
+	skipped   []SkippedFile     // Entries left out of dir
+	entries   *entryIndex       // Duplicate entries left out of dir (nil = none)
+	rejected  *RejectedReason   // Set if dir came from a likely decompression bomb
+	digests   map[string]string // Hashes of the upload computed while receiving it
+
+	kept bool // path is a shared async job's upload, removed with the job instead
+}
+
+// remove deletes the upload's temp file or directory
+func (u *uploadedFile) remove() {
+	if u.kept {
+		return
+	}
+	if u.dir != "" {
+		os.RemoveAll(u.dir)
+		return
+	}
+	os.Remove(u.path)
+}
+
+// fileHash returns the SHA256 of the upload
+func (u *uploadedFile) fileHash() (string, error) {
+	if u.dir != "" {
+		return u.digests["sha256"], nil
+	}
+	return computeFileHash(u.path)
+}
+
+// fileHashes returns the upload's digests for algorithms
+func (u *uploadedFile) fileHashes(algorithms []string) (map[string]string, error) {
+	if u.dir == "" || len(algorithms) == 0 {
+		return computeFileHashes(u.path, algorithms)
+	}
+	hashes := make(map[string]string, len(algorithms))
+	for _, name := range algorithms {
+		hashes[name] = u.digests[name]
+	}
+	return hashes, nil
+}
+
+// receiveUpload reads the uploaded file from a multipart request into a temp file.
+// Failures are logged here; the returned requestError is safe to send to the client.
+func receiveUpload(ctx context.Context, w http.ResponseWriter, r *http.Request, config *Config) (upload *uploadedFile, reqErr *requestError) {
+	_, span := StartSpan(ctx, "upload")
+	defer func() {
+		if reqErr != nil {
+			span.RecordError(errors.New(reqErr.message))
+		}
+		span.End()
+	}()
+
+	// Reject declared oversize bodies before reading anything
+	if reqErr := checkContentLength(r, config); reqErr != nil {
+		return nil, reqErr
+	}
+
+	// Fail fast when the upload (if its size is declared) won't fit on disk
+	if err := checkDiskSpace(tempDir(), max(r.ContentLength, 0), config.ScanTmpMinFree); err != nil {
+		log.Printf("Rejected upload: %v", err)
+		return nil, insufficientStorage()
+	}
+
+	checksums, reqErr := requestChecksums(r)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+
+	body, filename, metadata, formPasswords, reqErr := openUploadBody(w, r, config)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	defer body.Close()
+	var file io.Reader = body
+	passwords, reqErr := requestPasswords(r, formPasswords)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+
+	// Sanitize filename for logging (remove control characters, limit length)
+	safeFilename := sanitizeFilename(filename)
+
+	// The file is checked against the caller's checksums once received
+	if checksums != nil {
+		file = io.TeeReader(body, checksums)
+	}
+
+	// Tar archives are extracted as they arrive instead of being saved first
+	if config.StreamExtraction {
+		buffered := bufio.NewReaderSize(file, tarSniffSize)
+		if gzipped, isTar := sniffTar(buffered); isTar {
+			if filePolicyEnabled(config) {
+				head, _ := buffered.Peek(512)
+				if reqErr := refuseByPolicy(config, filename, safeFilename, head); reqErr != nil {
+					return nil, reqErr
+				}
+			}
+			upload, reqErr := receiveTarUpload(buffered, gzipped, config, requestBudgetFrom(ctx))
+			if reqErr != nil {
+				return nil, reqErr
+			}
+			if reqErr := checksums.verify(safeFilename); reqErr != nil {
+				upload.remove()
+				return nil, reqErr
+			}
+			upload.filename, upload.safeFilename, upload.metadata = filename, safeFilename, metadata
+			log.Printf("Received tar archive: %s (%d bytes, %d files)", safeFilename, upload.size, upload.fileCount)
+			span.SetAttribute("file.size", upload.size)
+			span.SetAttribute("file.count", upload.fileCount)
+			return upload, nil
+		}
+		file = buffered
+	}
+
+	tempFile, err := os.CreateTemp(scanTmpDir, "clamav-scan-*")
+	if err != nil {
+		log.Printf("Failed to create temp file: %v", err)
+		return nil, &requestError{status: http.StatusInternalServerError, message: "Server error during file processing"}
+	}
+	defer tempFile.Close()
+
+	size, err := io.Copy(tempFile, file)
+	if err != nil {
+		os.Remove(tempFile.Name())
+		log.Printf("Failed to write temp file: %v", err)
+		// A PUT body hits the size limit or a corrupt encoding while copying
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, uploadTooLarge(tooLarge.Limit)
+		}
+		if isCorruptCompression(err) {
+			return nil, &requestError{status: http.StatusBadRequest, message: "Invalid compressed request body"}
+		}
+		return nil, &requestError{status: http.StatusInternalServerError, message: "Server error during file processing"}
+	}
+	if reqErr := checksums.verify(safeFilename); reqErr != nil {
+		os.Remove(tempFile.Name())
+		return nil, reqErr
+	}
+	log.Printf("Received file: %s (%d bytes)", safeFilename, size)
+
+	span.SetAttribute("file.size", size)
+	return &uploadedFile{
+		path:         tempFile.Name(),
+		filename:     filename,
+		safeFilename: safeFilename,
+		size:         size,
+		metadata:     metadata,
+		passwords:    passwords,
+	}, nil
+}
+
+// checkContentLength rejects a request whose declared body is larger than
+// MAX_UPLOAD_SIZE_MB
+func checkContentLength(r *http.Request, config *Config) *requestError {
+	if r.ContentLength > config.MaxUploadSize {
+		log.Printf("Rejected upload: Content-Length %d exceeds limit %d", r.ContentLength, config.MaxUploadSize)
+		return uploadTooLarge(config.MaxUploadSize)
+	}
+	return nil
+}
+
+// openUploadBody returns the uploaded file of a request, unread and limited
+// to MAX_UPLOAD_SIZE_MB, with its client filename, caller metadata and the
+// archive passwords of the form. PUT sends the file as the body; POST as a
+// multipart form. The caller closes the file.
+func openUploadBody(w http.ResponseWriter, r *http.Request, config *Config) (io.ReadCloser, string, json.RawMessage, []string, *requestError) {
+	// The multipart reader doesn't bound the request size; stop reading at the limit
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxUploadSize)
+	if reqErr := decodeBody(w, r, config.MaxUploadSize); reqErr != nil {
+		return nil, "", nil, nil, reqErr
+	}
+
+	metadata, reqErr := requestMetadata(r, config)
+	if reqErr != nil {
+		return nil, "", nil, nil, reqErr
+	}
+
+	if r.Method == http.MethodPut {
+		filename, _ := r.Context().Value(putFilenameKey{}).(string)
+		return io.NopCloser(r.Body), filename, metadata, nil, nil
+	}
+	part, formMetadata, passwords, reqErr := nextUploadPart(r, config)
+	if reqErr != nil {
+		return nil, "", nil, nil, reqErr
+	}
+	if formMetadata != nil {
+		metadata = formMetadata
+	}
+	return part, part.FileName(), metadata, passwords, nil
+}
+
+// nextUploadPart streams a multipart request up to the part carrying the
+// file: the first part in one of UPLOAD_FIELD_NAMES, or with no names
+// configured, the first part with a file name or in the "file" field. Of the
+// earlier parts only the metadata and password fields are read; later ones
+// are never read.
+func nextUploadPart(r *http.Request, config *Config) (part *multipart.Part, metadata json.RawMessage, passwords []string, reqErr *requestError) {
+	fieldNames := config.UploadFieldNames
+	if reqErr := checkUploadRequest(r, config); reqErr != nil {
+		log.Printf("Rejected upload: %s", reqErr.message)
+		return nil, nil, nil, reqErr
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		log.Printf("Invalid multipart request: %v", err)
+		return nil, nil, nil, &requestError{status: http.StatusBadRequest, message: "Invalid request format (expected multipart/form-data)", formats: uploadFormats(r, config)}
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			log.Printf("No file in request")
+			if len(fieldNames) > 0 {
+				return nil, nil, nil, &requestError{status: http.StatusBadRequest, message: "No file provided in request (expected field: " + strings.Join(fieldNames, ", ") + ")", formats: uploadFormats(r, config)}
+			}
+			return nil, nil, nil, &requestError{status: http.StatusBadRequest, message: "No file provided in request", formats: uploadFormats(r, config)}
+		}
+		if err != nil {
+			// Log full error internally, return generic message to client
+			log.Printf("Failed to parse multipart form: %v", err)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return nil, nil, nil, uploadTooLarge(tooLarge.Limit)
+			}
+			if isCorruptCompression(err) {
+				return nil, nil, nil, &requestError{status: http.StatusBadRequest, message: "Invalid compressed request body"}
+			}
+			return nil, nil, nil, &requestError{status: http.StatusBadRequest, message: "Invalid multipart/form-data body", formats: uploadFormats(r, config)}
+		}
+
+		if len(fieldNames) > 0 && containsString(fieldNames, part.FormName()) ||
+			len(fieldNames) == 0 && (part.FileName() != "" || part.FormName() == "file") {
+			return part, metadata, passwords, nil
+		}
+		if part.FormName() == metadataField && part.FileName() == "" {
+			raw, _ := io.ReadAll(io.LimitReader(part, int64(config.MetadataMaxBytes)+1))
+			if metadata, reqErr = parseScanMetadata(raw, config.MetadataMaxBytes); reqErr != nil {
+				return nil, nil, nil, reqErr
+			}
+		}
+		if part.FormName() == archivePasswordField && part.FileName() == "" && len(passwords) <= maxRequestPasswords {
+			raw, _ := io.ReadAll(io.LimitReader(part, maxPasswordLength+1))
+			passwords = append(passwords, string(raw))
+		}
+		part.Close()
+	}
+}
+
+// uploadTooLarge is the 413 error for a request body over limit bytes
+func uploadTooLarge(limit int64) *requestError {
+	return &requestError{status: http.StatusRequestEntityTooLarge, message: fmt.Sprintf("Upload exceeds size limit of %d bytes", limit)}
+}
+
+// insufficientStorage is the error for uploads and archives that don't fit
+// in the temp directory
+func insufficientStorage() *requestError {
+	return &requestError{status: http.StatusInsufficientStorage, message: "Not enough disk space to process the upload"}
+}
+
+// sendRequestError sends a requestError to the client
+func sendRequestError(w http.ResponseWriter, reqErr *requestError) {
+	if reqErr.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(reqErr.retryAfter.Seconds()))))
+	}
+	if reqErr.formats != nil {
+		w.Header().Set("Accept-Post", strings.Join(reqErr.formats.ContentTypes, ", "))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(reqErr.status)
+		json.NewEncoder(w).Encode(ScanResponse{Status: "error", Error: reqErr.message, Supported: reqErr.formats})
+		return
+	}
+	sendErrorStatus(w, reqErr.status, reqErr.message)
 }
 
 // sendError sends an error response to the client.
 // Note: message should be a generic, sanitized string - do not include internal errors.
 func sendError(w http.ResponseWriter, message string) {
+	sendErrorStatus(w, http.StatusInternalServerError, message)
+}
+
+// sendErrorStatus sends an error response with a specific HTTP status code.
+// Note: message should be a generic, sanitized string - do not include internal errors.
+func sendErrorStatus(w http.ResponseWriter, statusCode int, message string) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusInternalServerError)
+	w.WriteHeader(statusCode)
 	json.NewEncoder(w).Encode(ScanResponse{
 		Status: "error",
 		Error:  message,
 	})
 }
 
-// sanitizeFilename removes control characters and limits length for safe logging.
+// sanitizeFilename replaces control and format characters and limits length for safe logging.
 func sanitizeFilename(filename string) string {
 	// Limit length to prevent log flooding
-	const maxLen = 100
-	if len(filename) > maxLen {
-		filename = filename[:maxLen] + "..."
-	}
-
-	var result []rune
-	for _, r := range filename {
-		if r < 32 || r == 127 {
-			result = append(result, '_')
-		} else {
-			result = append(result, r)
-		}
-	}
-
-	return string(result)
+	return truncateName(cleanName(filename, '_'), 100)
 }
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
 	"encoding/json"
+	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSanitizeFilename(t *testing.T) {
@@ -63,6 +70,21 @@ func TestSanitizeFilename(t *testing.T) {
 			input:    "文档.pdf",
 			expected: "文档.pdf",
 		},
+		{
+			name:     "bidi override replaced",
+			input:    "invoice\u202efdp.exe",
+			expected: "invoice_fdp.exe",
+		},
+		{
+			name:     "line separator and invalid UTF-8 replaced",
+			input:    "a\u2028b\xffc",
+			expected: "a_b_c",
+		},
+		{
+			name:     "truncated between characters",
+			input:    strings.Repeat("a", 99) + "文档.pdf",
+			expected: strings.Repeat("a", 99) + "...",
+		},
 		{
 			name:     "empty string",
 			input:    "",
@@ -108,7 +130,7 @@ func TestSendError(t *testing.T) {
 }
 
 func TestScanHandlerMethodNotAllowed(t *testing.T) {
-	methods := []string{http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodPatch}
+	methods := []string{http.MethodGet, http.MethodDelete, http.MethodPatch}
 
 	for _, method := range methods {
 		t.Run(method, func(t *testing.T) {
@@ -136,8 +158,8 @@ func TestScanHandlerNoFile(t *testing.T) {
 
 	scanHandler(recorder, req)
 
-	if recorder.Code != http.StatusInternalServerError {
-		t.Errorf("status = %d, want %d", recorder.Code, http.StatusInternalServerError)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusBadRequest)
 	}
 }
 
@@ -161,3 +183,255 @@ func TestHealthHandlerRequiresScanner(t *testing.T) {
 		t.Errorf("Content-Type = %q, want application/json", contentType)
 	}
 }
+
+func TestCheckConfig(t *testing.T) {
+	cfg := LoadConfig()
+	if err := checkConfig(cfg); err != nil {
+		t.Fatalf("checkConfig() error = %v for defaults", err)
+	}
+
+	cfg.AuthMethods = []string{"api-key"}
+	cfg.ScanRoutesFile = filepath.Join(t.TempDir(), "missing.json")
+	err := checkConfig(cfg)
+	if err == nil {
+		t.Fatal("checkConfig() succeeded")
+	}
+	for _, want := range []string{EnvAPIKeys, "scan routes"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("checkConfig() error = %v, want mention of %q", err, want)
+		}
+	}
+}
+
+// multipartUpload builds a multipart body with content in the "file" field
+func multipartUpload(t *testing.T, filename string, content []byte) (*bytes.Buffer, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatalf("failed to create form file: %v", err)
+	}
+	part.Write(content)
+	writer.Close()
+	return body, writer.FormDataContentType()
+}
+
+func TestNextUploadPart(t *testing.T) {
+	// A form with a plain field, a file in "attachment" and one in "FILES"
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("comment", "quarterly report")
+	attachment, _ := writer.CreateFormFile("attachment", "report.pdf")
+	attachment.Write([]byte("attachment"))
+	files, _ := writer.CreateFormFile("FILES", "other.pdf")
+	files.Write([]byte("files"))
+	writer.Close()
+
+	tests := []struct {
+		name       string
+		fieldNames []string
+		wantField  string
+		wantStatus int
+	}{
+		{"any file part", nil, "attachment", 0},
+		{"configured order is form order", []string{"FILES", "attachment"}, "attachment", 0},
+		{"configured field", []string{"FILES"}, "FILES", 0},
+		{"case sensitive", []string{"files"}, "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/scan", bytes.NewReader(body.Bytes()))
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+
+			part, _, _, reqErr := nextUploadPart(req, &Config{UploadFieldNames: tt.fieldNames, MetadataMaxBytes: DefaultMetadataMaxBytes})
+			if tt.wantStatus != 0 {
+				if reqErr == nil || reqErr.status != tt.wantStatus {
+					t.Fatalf("error = %+v, want status %d", reqErr, tt.wantStatus)
+				}
+				if !strings.Contains(reqErr.message, "files") {
+					t.Errorf("message %q does not name the expected field", reqErr.message)
+				}
+				return
+			}
+			if reqErr != nil {
+				t.Fatalf("nextUploadPart() error: %s", reqErr.message)
+			}
+			if part.FormName() != tt.wantField {
+				t.Errorf("part = %q, want %q", part.FormName(), tt.wantField)
+			}
+		})
+	}
+}
+
+func TestNextUploadPartFileFieldWithoutName(t *testing.T) {
+	// curl -F "file=<data.txt" sends the "file" field without a file name
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("file", "contents")
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/scan", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if part, _, _, reqErr := nextUploadPart(req, &Config{MetadataMaxBytes: DefaultMetadataMaxBytes}); reqErr != nil || part.FormName() != "file" {
+		t.Errorf("nextUploadPart() = %v, %+v, want the file field", part, reqErr)
+	}
+}
+
+func TestScanHandlerUploadTooLarge(t *testing.T) {
+	cfg := &Config{MaxUploadSize: 1024}
+	body, contentType := multipartUpload(t, "big.bin", bytes.Repeat([]byte("x"), 4096))
+
+	t.Run("declared length", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/scan", bytes.NewReader(body.Bytes()))
+		req.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+
+		handleScan(recorder, req, cfg, nil)
+
+		if recorder.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("status = %d, want 413", recorder.Code)
+		}
+	})
+
+	t.Run("chunked", func(t *testing.T) {
+		// No Content-Length: the limit is enforced while reading
+		req := httptest.NewRequest(http.MethodPost, "/scan", io.MultiReader(bytes.NewReader(body.Bytes())))
+		req.ContentLength = -1
+		req.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+
+		handleScan(recorder, req, cfg, nil)
+
+		if recorder.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("status = %d, want 413", recorder.Code)
+		}
+		var response ScanResponse
+		json.NewDecoder(recorder.Body).Decode(&response)
+		if !strings.Contains(response.Error, "1024 bytes") {
+			t.Errorf("error = %q, want the limit", response.Error)
+		}
+	})
+}
+
+func TestScanByName(t *testing.T) {
+	var seenPath, seenName string
+	handler := scanByName("/scan", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenPath = r.URL.Path
+		seenName, _ = r.Context().Value(putFilenameKey{}).(string)
+	}))
+
+	tests := []struct {
+		method     string
+		path       string
+		wantStatus int
+		wantName   string
+	}{
+		{http.MethodPut, "/scan/report.pdf", http.StatusOK, "report.pdf"},
+		{http.MethodPut, "/scan/2024/q1%20report.pdf", http.StatusOK, "2024/q1 report.pdf"},
+		{http.MethodPut, "/scan/", http.StatusBadRequest, ""},
+		{http.MethodGet, "/scan/report.pdf", http.StatusMethodNotAllowed, ""},
+	}
+
+	for _, tt := range tests {
+		seenPath, seenName = "", ""
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.path, nil))
+
+		if recorder.Code != tt.wantStatus {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.path, recorder.Code, tt.wantStatus)
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+		// Metrics and logs see the route, not the file name
+		if seenPath != "/scan" || seenName != tt.wantName {
+			t.Errorf("%s: handler saw path %q, name %q", tt.path, seenPath, seenName)
+		}
+	}
+}
+
+func TestScanHandlerPut(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	handler := scanByName("/scan", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleScan(w, r, cfg, NewScanner(cfg))
+	}))
+
+	req := httptest.NewRequest(http.MethodPut, "/scan/eicar.com", strings.NewReader("EICAR"))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", recorder.Code, recorder.Body)
+	}
+	var response ScanResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if response.Status != "infected" {
+		t.Errorf("response = %+v, want infected", response)
+	}
+
+	// Chunked bodies are cut off at the limit
+	cfg.MaxUploadSize = 16
+	req = httptest.NewRequest(http.MethodPut, "/scan/big.bin", io.MultiReader(strings.NewReader(strings.Repeat("x", 32))))
+	req.ContentLength = -1
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversize status = %d, want 413", recorder.Code)
+	}
+}
+
+func TestWithBasePath(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/tenants/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	handler := withBasePath("/antivirus", mux)
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantPath   string
+	}{
+		{"/antivirus/admin/tenants/acme", http.StatusOK, "/admin/tenants/acme"},
+		{"/admin/tenants/acme", http.StatusNotFound, ""},
+		{"/antivirusx/admin/tenants/acme", http.StatusNotFound, ""},
+		{"/antivirus", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+		if recorder.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.path, recorder.Code, tt.wantStatus)
+		}
+		if tt.wantPath != "" && recorder.Body.String() != tt.wantPath {
+			t.Errorf("%s: handler saw %q, want %q", tt.path, recorder.Body.String(), tt.wantPath)
+		}
+	}
+}
+
+func TestScanHandlerTimeout(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.ScanTimeout = 300 * time.Millisecond
+	archive := zipBytes(t, zip.Deflate, [2]string{"a.com", "EICAR"}, [2]string{"b.bin", "SLOW"})
+	body, contentType := multipartUpload(t, "partial.zip", archive)
+	req := httptest.NewRequest(http.MethodPost, "/scan", body)
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+	handleScan(recorder, req, cfg, NewScanner(cfg))
+
+	// The threat found before the timeout is not lost
+	var response ScanResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if recorder.Code != http.StatusGatewayTimeout || response.Status != "timeout" || response.ScannedFiles != 1 ||
+		len(response.Threats) != 1 || response.Threats[0].Name != "Eicar-Test-Signature" || response.Error == "" {
+		t.Errorf("status %d, response %+v; want 504 timeout with the EICAR threat", recorder.Code, response)
+	}
+	if response.DBVersion != "27000" {
+		t.Errorf("db_version = %q, want the signatures of the partial scan", response.DBVersion)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MalwareBazaar lookups: the abuse.ch API, the hashes kept in memory with
+// their answers, and the most of an answer that is read
+const (
+	DefaultMalwareBazaarURL = "https://mb-api.abuse.ch/api/v1/"
+	bazaarCacheSize         = 10000
+	bazaarMaxResponse       = 1 << 20
+)
+
+// BazaarInfo is what MalwareBazaar knows about an infected file
+type BazaarInfo struct {
+	FirstSeen string   `json:"first_seen,omitempty"` // RFC 3339, when the sample was first submitted
+	FileType  string   `json:"file_type,omitempty"`  // e.g. exe, docm
+	Signature string   `json:"signature,omitempty"`  // Malware family as abuse.ch names it
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// bazaarResponse is a MalwareBazaar get_info answer
+type bazaarResponse struct {
+	QueryStatus string `json:"query_status"`
+	Data        []struct {
+		FirstSeen string   `json:"first_seen"` // "2006-01-02 15:04:05" UTC
+		FileType  string   `json:"file_type"`
+		Signature string   `json:"signature"`
+		Tags      []string `json:"tags"`
+	} `json:"data"`
+}
+
+// MalwareBazaar looks up the SHA-256 of infected files on abuse.ch's
+// MalwareBazaar, so responders see at once whether a sample is known. Only
+// hashes of detected threats are sent. Answers, including unknown hashes,
+// are cached; failed lookups are not, and never fail the scan.
+type MalwareBazaar struct {
+	url     string
+	authKey string
+	timeout time.Duration // For all lookups of one scan
+	ttl     time.Duration
+	client  *http.Client
+	now     func() time.Time
+
+	mu      sync.Mutex
+	order   *list.List // Front = most recently used
+	entries map[string]*list.Element
+}
+
+type bazaarCacheEntry struct {
+	sha256  string
+	info    *BazaarInfo // nil = unknown to MalwareBazaar
+	expires time.Time
+}
+
+// Global MalwareBazaar client (nil when disabled)
+var malwareBazaar *MalwareBazaar
+
+// NewMalwareBazaar creates the MalwareBazaar client described by the
+// (validated) config. Returns nil when no auth key is configured.
+func NewMalwareBazaar(config *Config) *MalwareBazaar {
+	if config.MalwareBazaarAuthKey == "" {
+		return nil
+	}
+	return &MalwareBazaar{
+		url:     config.MalwareBazaarURL,
+		authKey: config.MalwareBazaarAuthKey,
+		timeout: config.MalwareBazaarTimeout,
+		ttl:     config.MalwareBazaarCacheTTL,
+		client:  newOutboundClient(0),
+		now:     time.Now,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Enrich adds MalwareBazaar's information to the threats with a file hash.
+// Lookups share one timeout, so a slow API delays a scan by at most that;
+// threats not looked up in time are left as they are.
+func (b *MalwareBazaar) Enrich(ctx context.Context, threats []Threat) {
+	if b == nil || len(threats) == 0 {
+		return
+	}
+	ctx, span := StartSpan(ctx, "malwarebazaar")
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+
+	for i := range threats {
+		if threats[i].FileHash == "" {
+			continue
+		}
+		info, err := b.Lookup(ctx, threats[i].FileHash)
+		if err != nil {
+			log.Printf("Warning: MalwareBazaar lookup of %s failed: %v", threats[i].FileHash, err)
+			span.RecordError(err)
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		threats[i].MalwareBazaar = info
+	}
+}
+
+// Lookup returns what MalwareBazaar knows about a SHA-256 (nil = unknown),
+// from the cache if it was looked up within the cache TTL
+func (b *MalwareBazaar) Lookup(ctx context.Context, sha256 string) (*BazaarInfo, error) {
+	sha256 = strings.ToLower(sha256)
+	if info, ok := b.cached(sha256); ok {
+		metrics.Count("malwarebazaar.lookups", 1, "result:cached")
+		return info, nil
+	}
+
+	info, err := b.query(ctx, sha256)
+	if err != nil {
+		metrics.Count("malwarebazaar.lookups", 1, "result:error")
+		return nil, err
+	}
+	if info == nil {
+		metrics.Count("malwarebazaar.lookups", 1, "result:unknown")
+	} else {
+		metrics.Count("malwarebazaar.lookups", 1, "result:found")
+	}
+	b.store(sha256, info)
+	return info, nil
+}
+
+// query asks the MalwareBazaar API about a SHA-256
+func (b *MalwareBazaar) query(ctx context.Context, sha256 string) (*BazaarInfo, error) {
+	form := url.Values{"query": {"get_info"}, "hash": {sha256}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Auth-Key", b.authKey)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var answer bazaarResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, bazaarMaxResponse)).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	switch answer.QueryStatus {
+	case "ok":
+	case "hash_not_found", "no_results":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("query status %q", answer.QueryStatus)
+	}
+	if len(answer.Data) == 0 {
+		return nil, nil
+	}
+
+	sample := answer.Data[0]
+	info := &BazaarInfo{
+		FirstSeen: sample.FirstSeen,
+		FileType:  sample.FileType,
+		Signature: sample.Signature,
+		Tags:      sample.Tags,
+	}
+	if t, err := time.Parse(time.DateTime, sample.FirstSeen); err == nil {
+		info.FirstSeen = t.UTC().Format(time.RFC3339)
+	}
+	return info, nil
+}
+
+// cached returns a cached answer that hasn't expired
+func (b *MalwareBazaar) cached(sha256 string) (*BazaarInfo, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	element, ok := b.entries[sha256]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*bazaarCacheEntry)
+	if b.now().After(entry.expires) {
+		b.order.Remove(element)
+		delete(b.entries, sha256)
+		return nil, false
+	}
+	b.order.MoveToFront(element)
+	return entry.info, true
+}
+
+// store caches an answer, evicting the least recently used beyond
+// bazaarCacheSize
+func (b *MalwareBazaar) store(sha256 string, info *BazaarInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry := &bazaarCacheEntry{sha256: sha256, info: info, expires: b.now().Add(b.ttl)}
+	if element, ok := b.entries[sha256]; ok {
+		element.Value = entry
+		b.order.MoveToFront(element)
+		return
+	}
+	b.entries[sha256] = b.order.PushFront(entry)
+	for b.order.Len() > bazaarCacheSize {
+		oldest := b.order.Back()
+		b.order.Remove(oldest)
+		delete(b.entries, oldest.Value.(*bazaarCacheEntry).sha256)
+	}
+}
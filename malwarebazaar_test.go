@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const bazaarKnownSHA256 = "094fd325049b8a9cf6d3e5ef2a6d4cc6a567d7d49c35f8bb8dd9e3c6acf3d78d"
+
+// fakeMalwareBazaar serves get_info queries, knowing bazaarKnownSHA256.
+// Returns the client and the number of queries received.
+func fakeMalwareBazaar(t *testing.T) (*MalwareBazaar, *atomic.Int32) {
+	t.Helper()
+	var queries atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		if r.Header.Get("Auth-Key") != "test-key" {
+			json.NewEncoder(w).Encode(map[string]string{"query_status": "unknown_auth_key"})
+			return
+		}
+		if r.FormValue("query") != "get_info" {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		switch hash := r.FormValue("hash"); {
+		case hash == bazaarKnownSHA256:
+			w.Write([]byte(`{"query_status": "ok", "data": [{
+				"sha256_hash": "` + hash + `",
+				"first_seen": "2021-01-25 14:32:07",
+				"file_type": "docm",
+				"signature": "Emotet",
+				"tags": ["doc", "emotet", "epoch3"]
+			}]}`))
+		case strings.HasPrefix(hash, "5"):
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case strings.HasPrefix(hash, "f"):
+			time.Sleep(200 * time.Millisecond)
+			fallthrough
+		default:
+			w.Write([]byte(`{"query_status": "hash_not_found"}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return NewMalwareBazaar(&Config{
+		MalwareBazaarAuthKey:  "test-key",
+		MalwareBazaarURL:      server.URL,
+		MalwareBazaarTimeout:  time.Second,
+		MalwareBazaarCacheTTL: time.Hour,
+	}), &queries
+}
+
+func TestMalwareBazaarLookup(t *testing.T) {
+	bazaar, queries := fakeMalwareBazaar(t)
+
+	info, err := bazaar.Lookup(context.Background(), strings.ToUpper(bazaarKnownSHA256))
+	if err != nil {
+		t.Fatalf("Lookup() error: %v", err)
+	}
+	if info == nil || info.FirstSeen != "2021-01-25T14:32:07Z" || info.FileType != "docm" || info.Signature != "Emotet" || len(info.Tags) != 3 {
+		t.Errorf("info = %+v", info)
+	}
+
+	info, err = bazaar.Lookup(context.Background(), strings.Repeat("0", 64))
+	if err != nil || info != nil {
+		t.Errorf("unknown hash: info = %+v, error %v; want nil, nil", info, err)
+	}
+
+	if _, err := bazaar.Lookup(context.Background(), strings.Repeat("5", 64)); err == nil {
+		t.Error("server error: expected error")
+	}
+
+	bazaar.authKey = "wrong"
+	if _, err := bazaar.Lookup(context.Background(), strings.Repeat("1", 64)); err == nil {
+		t.Error("rejected auth key: expected error")
+	}
+	if got := queries.Load(); got != 4 {
+		t.Errorf("queries = %d, want 4", got)
+	}
+}
+
+func TestMalwareBazaarCache(t *testing.T) {
+	bazaar, queries := fakeMalwareBazaar(t)
+	now := time.Now()
+	bazaar.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		bazaar.Lookup(context.Background(), bazaarKnownSHA256)
+		bazaar.Lookup(context.Background(), strings.Repeat("0", 64)) // Unknown hashes are cached too
+		bazaar.Lookup(context.Background(), strings.Repeat("5", 64)) // Failures are not
+	}
+	if got := queries.Load(); got != 5 {
+		t.Errorf("queries = %d, want 5", got)
+	}
+
+	now = now.Add(time.Hour + time.Second)
+	if info, _ := bazaar.Lookup(context.Background(), bazaarKnownSHA256); info == nil {
+		t.Error("expired entry: info = nil")
+	}
+	if got := queries.Load(); got != 6 {
+		t.Errorf("after expiry: queries = %d, want 6", got)
+	}
+}
+
+func TestMalwareBazaarEnrichTimeout(t *testing.T) {
+	bazaar, queries := fakeMalwareBazaar(t)
+	bazaar.timeout = 100 * time.Millisecond
+
+	threats := []Threat{
+		{Name: "Doc.Downloader.Emotet-1", FileHash: bazaarKnownSHA256},
+		{Name: "Win.Trojan.Agent-1", FileHash: strings.Repeat("f", 64)}, // Slower than the timeout
+		{Name: "Win.Trojan.Agent-2", FileHash: strings.Repeat("0", 64)},
+		{Name: "Win.Trojan.Agent-3"}, // No hash
+	}
+	start := time.Now()
+	bazaar.Enrich(context.Background(), threats)
+
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Enrich() took %v, want about the 100ms timeout", elapsed)
+	}
+	if threats[0].MalwareBazaar == nil || threats[0].MalwareBazaar.Signature != "Emotet" {
+		t.Errorf("known threat = %+v", threats[0].MalwareBazaar)
+	}
+	if threats[1].MalwareBazaar != nil || threats[2].MalwareBazaar != nil {
+		t.Errorf("threats after the timeout = %+v, %+v; want nil", threats[1].MalwareBazaar, threats[2].MalwareBazaar)
+	}
+	if got := queries.Load(); got != 2 {
+		t.Errorf("queries = %d, want 2 (none after the timeout)", got)
+	}
+}
+
+func TestScanHandlerMalwareBazaar(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	bazaar, _ := fakeMalwareBazaar(t)
+	malwareBazaar = bazaar
+	t.Cleanup(func() { malwareBazaar = nil })
+
+	body, contentType := multipartUpload(t, "eicar.com", []byte("EICAR"))
+	req := httptest.NewRequest(http.MethodPost, "/scan", body)
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+
+	handleScan(recorder, req, cfg, NewScanner(cfg))
+
+	var response ScanResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if len(response.Threats) != 1 || response.Threats[0].FileHash == "" {
+		t.Fatalf("threats = %+v", response.Threats)
+	}
+	// The fake API doesn't know the upload: looked up, but nothing to add
+	if response.Threats[0].MalwareBazaar != nil {
+		t.Errorf("malwarebazaar = %+v, want nil for an unknown sample", response.Threats[0].MalwareBazaar)
+	}
+	if info, ok := bazaar.cached(response.Threats[0].FileHash); !ok || info != nil {
+		t.Errorf("cached = %+v, %v; want the unknown hash cached", info, ok)
+	}
+}
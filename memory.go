@@ -0,0 +1,222 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Memory-bounded mode (MEMORY_BOUNDED) keeps the service within a small
+// container memory limit: document objects read into memory share a fixed
+// budget, and scans are shed with 429 while RSS or temp usage is too high.
+
+const (
+	memorySampleInterval = 2 * time.Second // How often RSS and temp usage are measured
+	shedRetryAfter       = 5 * time.Second // Retry-After sent with shed requests
+
+	shedRSSFraction = 0.8 // Default SHED_RSS_MB, of the container memory limit
+	gcLimitFraction = 0.7 // Go soft memory limit, of the container memory limit
+)
+
+// Files read for the container memory limit (cgroup v2, then v1)
+var memoryLimitFiles = []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"}
+
+// bufferBudget caps the bytes held in memory at once by extraction steps
+// that can't stream, such as objects read out of Office documents
+type bufferBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+}
+
+// Global extraction buffer budget (nil = unlimited)
+var extractBudget *bufferBudget
+
+// newBufferBudget creates the budget for MEMORY_BUFFER_MB. Returns nil
+// unless MEMORY_BOUNDED is set.
+func newBufferBudget(config *Config) *bufferBudget {
+	if !config.MemoryBounded {
+		return nil
+	}
+	b := &bufferBudget{limit: config.MemoryBufferSize}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire reserves n bytes, waiting while other extractions hold the
+// budget. A request larger than the budget reserves all of it. Returns the
+// bytes reserved, to be passed to release. A goroutine must release before
+// acquiring again.
+func (b *bufferBudget) acquire(n int64) int64 {
+	if b == nil {
+		return 0
+	}
+	n = min(n, b.limit)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.used+n > b.limit {
+		b.cond.Wait()
+	}
+	b.used += n
+	return n
+}
+
+// release returns bytes reserved by acquire
+func (b *bufferBudget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// LoadShedder rejects scans while the process RSS or the scan temp data
+// exceed their thresholds (429), or while the system is under pressure (503)
+type LoadShedder struct {
+	maxRSS      int64 // bytes (0 = unchecked)
+	maxTemp     int64 // bytes (0 = unchecked)
+	memoryLimit int64 // Container memory limit (0 = unknown)
+	pressure    pressureLimits
+
+	rss       atomic.Int64
+	temp      atomic.Int64
+	pressured atomic.Value // string: system pressure reason (unset or "" = none)
+}
+
+// NewLoadShedder creates the shedder described by the config. The RSS and
+// temp thresholds apply only with MEMORY_BOUNDED. Returns nil when no
+// threshold is set and the container memory limit is unknown.
+func NewLoadShedder(config *Config) *LoadShedder {
+	s := &LoadShedder{pressure: newPressureLimits(config)}
+	if config.MemoryBounded {
+		s.maxRSS, s.maxTemp, s.memoryLimit = config.ShedRSS, config.ShedTemp, readMemoryLimit(memoryLimitFiles...)
+		if s.maxRSS == 0 && s.memoryLimit > 0 {
+			s.maxRSS = int64(float64(s.memoryLimit) * shedRSSFraction)
+		}
+	}
+	if s.maxRSS == 0 && s.maxTemp == 0 && !s.pressure.enabled() {
+		return nil
+	}
+	return s
+}
+
+// Start sets the Go soft memory limit below the container limit (unless
+// GOMEMLIMIT is set) and measures usage in the background
+func (s *LoadShedder) Start() {
+	if s.memoryLimit > 0 && os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(int64(float64(s.memoryLimit) * gcLimitFraction))
+	}
+	if s.maxRSS > 0 || s.maxTemp > 0 {
+		log.Printf("  Load shedding: RSS above %d MB, temp data above %d MB (container limit: %d MB)",
+			s.maxRSS>>20, s.maxTemp>>20, s.memoryLimit>>20)
+	}
+	if s.pressure.enabled() {
+		log.Printf("  Pressure shedding: load above %.2f per CPU, available memory below %d MB, goroutines above %d, queue above %d",
+			s.pressure.loadPerCPU, s.pressure.minAvailable>>20, s.pressure.goroutines, s.pressure.queueDepth)
+	}
+
+	s.sample()
+	go func() {
+		ticker := time.NewTicker(memorySampleInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.sample()
+		}
+	}()
+}
+
+// sample measures the current RSS and temp usage
+func (s *LoadShedder) sample() {
+	if s.maxRSS > 0 {
+		if rss, err := readRSS(); err == nil {
+			s.rss.Store(rss)
+		}
+	}
+	if s.maxTemp > 0 {
+		if usage := measureTempDir(tempDir()); usage.Error == "" {
+			s.temp.Store(usage.Bytes)
+		}
+	}
+	if s.pressure.enabled() {
+		s.setPressure(s.pressure.check())
+	}
+}
+
+// overloaded returns which threshold is exceeded: "rss", "temp" or ""
+func (s *LoadShedder) overloaded() string {
+	switch {
+	case s.maxRSS > 0 && s.rss.Load() > s.maxRSS:
+		return "rss"
+	case s.maxTemp > 0 && s.temp.Load() > s.maxTemp:
+		return "temp"
+	}
+	return ""
+}
+
+// shedLoad wraps a handler to answer 429 while the shedder reports memory
+// pressure, and 503 while it reports system pressure unless the caller has
+// the priority scope. A nil shedder disables it.
+func shedLoad(shedder *LoadShedder, next http.Handler) http.Handler {
+	if shedder == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reason := shedder.overloaded(); reason != "" {
+			metrics.Count("load_shed", 1, "route:"+r.URL.Path, "reason:"+reason)
+			sendRequestError(w, &requestError{status: http.StatusTooManyRequests, message: "Server under memory pressure, try again later", retryAfter: shedRetryAfter})
+			return
+		}
+		if reason := shedder.underPressure(); reason != "" {
+			if id := identityFromContext(r.Context()); id == nil || !id.HasScope(priorityScope) {
+				metrics.Count("load_shed", 1, "route:"+r.URL.Path, "reason:"+reason)
+				sendRequestError(w, &requestError{status: http.StatusServiceUnavailable, message: "Server overloaded, try again later", retryAfter: shedRetryAfter})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readRSS returns the resident set size of the process (Linux only)
+func readRSS() (int64, error) {
+	data, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, strconv.ErrSyntax
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * int64(os.Getpagesize()), nil
+}
+
+// readMemoryLimit returns the container memory limit from the first
+// readable cgroup file, or 0 if there is none
+func readMemoryLimit(files ...string) int64 {
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		limit, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		// cgroup v2 writes "max" and v1 a page-aligned maximum when unlimited
+		if err != nil || limit <= 0 || limit >= 1<<60 {
+			return 0
+		}
+		return limit
+	}
+	return 0
+}
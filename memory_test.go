@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBufferBudget(t *testing.T) {
+	b := newBufferBudget(&Config{MemoryBounded: true, MemoryBufferSize: 100})
+
+	first := b.acquire(60)
+	if huge := b.acquire(0); huge != 0 {
+		t.Fatalf("acquire(0) = %d", huge)
+	}
+
+	// A second reservation waits for the first to be released
+	acquired := make(chan int64)
+	go func() { acquired <- b.acquire(500) }()
+	select {
+	case <-acquired:
+		t.Fatal("acquire() beyond the budget did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.release(first)
+	if held := <-acquired; held != 100 {
+		t.Errorf("oversized acquire() reserved %d, want the whole budget", held)
+	}
+
+	// No budget when the mode is off
+	none := newBufferBudget(&Config{})
+	if none != nil || none.acquire(1<<40) != 0 {
+		t.Error("budget without MEMORY_BOUNDED should be nil and never block")
+	}
+	none.release(0)
+}
+
+func TestReadMemoryLimit(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0644)
+		return path
+	}
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		name  string
+		files []string
+		want  int64
+	}{
+		{name: "cgroup v2", files: []string{write("v2", "268435456\n")}, want: 256 << 20},
+		{name: "cgroup v2 unlimited", files: []string{write("v2max", "max\n")}, want: 0},
+		{name: "cgroup v1", files: []string{missing, write("v1", "536870912\n")}, want: 512 << 20},
+		{name: "cgroup v1 unlimited", files: []string{missing, write("v1max", "9223372036854771712\n")}, want: 0},
+		{name: "none", files: []string{missing}, want: 0},
+	}
+	for _, tt := range tests {
+		if got := readMemoryLimit(tt.files...); got != tt.want {
+			t.Errorf("%s: readMemoryLimit() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadRSS(t *testing.T) {
+	if _, err := os.Stat("/proc/self/statm"); err != nil {
+		t.Skip("no /proc on this platform")
+	}
+	if rss, err := readRSS(); err != nil || rss <= 0 {
+		t.Errorf("readRSS() = %d, %v", rss, err)
+	}
+}
+
+func TestShedLoad(t *testing.T) {
+	shedder := &LoadShedder{maxRSS: 100 << 20, maxTemp: 10 << 20}
+	handler := shedLoad(shedder, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/scan", nil))
+		return recorder
+	}
+
+	shedder.rss.Store(50 << 20)
+	if recorder := serve(); recorder.Code != http.StatusOK {
+		t.Errorf("below thresholds: status %d, want 200", recorder.Code)
+	}
+
+	shedder.rss.Store(200 << 20)
+	recorder := serve()
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "5" {
+		t.Errorf("above RSS threshold: status %d, Retry-After %q; want 429, 5", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+
+	shedder.rss.Store(0)
+	shedder.temp.Store(20 << 20)
+	if reason := shedder.overloaded(); reason != "temp" {
+		t.Errorf("overloaded() = %q, want temp", reason)
+	}
+
+	// Without thresholds or a known container limit there is nothing to shed
+	if NewLoadShedder(&Config{}) != nil {
+		t.Error("NewLoadShedder() without MEMORY_BOUNDED should be nil")
+	}
+	if s := NewLoadShedder(&Config{MemoryBounded: true, ShedTemp: 1 << 30}); s == nil || s.maxTemp != 1<<30 {
+		t.Errorf("NewLoadShedder() = %+v, want temp threshold", s)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Header and form field carrying caller metadata for a scan
+const (
+	metadataHeader = "X-Scan-Metadata"
+	metadataField  = "metadata"
+)
+
+// parseScanMetadata validates caller-supplied metadata: a JSON object of at
+// most maxBytes. It is returned compacted; empty input and null mean none.
+func parseScanMetadata(raw []byte, maxBytes int) (json.RawMessage, *requestError) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	if len(raw) > maxBytes {
+		return nil, &requestError{status: http.StatusBadRequest, message: fmt.Sprintf("Metadata exceeds %d bytes", maxBytes)}
+	}
+
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &object); err != nil || object == nil {
+		return nil, &requestError{status: http.StatusBadRequest, message: "Metadata must be a JSON object"}
+	}
+
+	var compact bytes.Buffer
+	json.Compact(&compact, raw)
+	return compact.Bytes(), nil
+}
+
+// requestMetadata returns the metadata sent in the X-Scan-Metadata header
+func requestMetadata(r *http.Request, config *Config) (json.RawMessage, *requestError) {
+	return parseScanMetadata([]byte(r.Header.Get(metadataHeader)), config.MetadataMaxBytes)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseScanMetadata(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        string
+		want       string
+		wantStatus int
+	}{
+		{"empty", "", "", 0},
+		{"null", " null ", "", 0},
+		{"object", `{ "ticket": "T-1", "tags": ["a", "b"] }`, `{"ticket":"T-1","tags":["a","b"]}`, 0},
+		{"array", `["T-1"]`, "", http.StatusBadRequest},
+		{"string", `"T-1"`, "", http.StatusBadRequest},
+		{"invalid", `{"ticket":`, "", http.StatusBadRequest},
+		{"too large", `{"note":"` + strings.Repeat("x", 64) + `"}`, "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reqErr := parseScanMetadata([]byte(tt.raw), 64)
+			if tt.wantStatus != 0 {
+				if reqErr == nil || reqErr.status != tt.wantStatus {
+					t.Fatalf("error = %+v, want status %d", reqErr, tt.wantStatus)
+				}
+				return
+			}
+			if reqErr != nil {
+				t.Fatalf("parseScanMetadata() error: %s", reqErr.message)
+			}
+			if string(got) != tt.want {
+				t.Errorf("parseScanMetadata() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// metadataUpload builds a multipart form with a metadata field before the file
+func metadataUpload(t *testing.T, metadata string, content []byte) (*bytes.Buffer, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField(metadataField, metadata)
+	part, err := writer.CreateFormFile("file", "report.pdf")
+	if err != nil {
+		t.Fatalf("failed to create form file: %v", err)
+	}
+	part.Write(content)
+	writer.Close()
+	return body, writer.FormDataContentType()
+}
+
+func TestScanHandlerEchoesMetadata(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.MetadataMaxBytes = DefaultMetadataMaxBytes
+
+	t.Run("header", func(t *testing.T) {
+		body, contentType := multipartUpload(t, "report.pdf", []byte("clean"))
+		req := httptest.NewRequest(http.MethodPost, "/scan", body)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set(metadataHeader, `{"ticket": "T-1"}`)
+		recorder := httptest.NewRecorder()
+
+		handleScan(recorder, req, cfg, NewScanner(cfg))
+
+		var response ScanResponse
+		json.NewDecoder(recorder.Body).Decode(&response)
+		if recorder.Code != http.StatusOK || string(response.Metadata) != `{"ticket":"T-1"}` {
+			t.Errorf("status = %d, metadata = %s", recorder.Code, response.Metadata)
+		}
+	})
+
+	t.Run("form field overrides header", func(t *testing.T) {
+		body, contentType := metadataUpload(t, `{"ticket":"T-2"}`, []byte("EICAR"))
+		req := httptest.NewRequest(http.MethodPost, "/scan", body)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set(metadataHeader, `{"ticket":"T-1"}`)
+		recorder := httptest.NewRecorder()
+
+		handleScan(recorder, req, cfg, NewScanner(cfg))
+
+		var response ScanResponse
+		json.NewDecoder(recorder.Body).Decode(&response)
+		if response.Status != "infected" || string(response.Metadata) != `{"ticket":"T-2"}` {
+			t.Errorf("status = %q, metadata = %s", response.Status, response.Metadata)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		body, contentType := metadataUpload(t, `["T-3"]`, []byte("clean"))
+		req := httptest.NewRequest(http.MethodPost, "/scan", body)
+		req.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+
+		handleScan(recorder, req, cfg, NewScanner(cfg))
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("status = %d, want 400", recorder.Code)
+		}
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics receives service metrics.
+// Implementations must be safe for concurrent use and must never block the
+// caller. Tags are "key:value" strings.
+type Metrics interface {
+	Count(name string, value int64, tags ...string)
+	Gauge(name string, value float64, tags ...string)
+	Timing(name string, d time.Duration, tags ...string)
+}
+
+// Global metrics sink (no-op unless a backend is configured)
+var metrics Metrics = noopMetrics{}
+
+// noopMetrics discards all metrics
+type noopMetrics struct{}
+
+func (noopMetrics) Count(name string, value int64, tags ...string)      {}
+func (noopMetrics) Gauge(name string, value float64, tags ...string)    {}
+func (noopMetrics) Timing(name string, d time.Duration, tags ...string) {}
+
+// Maximum UDP payload; stays below typical MTU to avoid fragmentation
+const statsdMaxPacketSize = 1432
+
+// How often buffered metrics are flushed
+const statsdFlushInterval = time.Second
+
+// Number of metric lines buffered before new ones are dropped
+const statsdQueueSize = 4096
+
+// StatsDMetrics pushes metrics to a StatsD or DogStatsD agent over UDP.
+// Lines are packed into packets and flushed in the background.
+type StatsDMetrics struct {
+	conn       net.Conn
+	prefix     string
+	globalTags []string
+	dogStatsD  bool // Append tags in DogStatsD "|#tag" format
+	queue      chan string
+}
+
+// NewStatsDMetrics connects to the agent and starts the flush loop.
+// UDP is connectionless, so this only fails for unresolvable addresses.
+func NewStatsDMetrics(address, prefix string, globalTags []string, dogStatsD bool) (*StatsDMetrics, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up StatsD client: %w", err)
+	}
+
+	m := &StatsDMetrics{
+		conn:       conn,
+		prefix:     prefix,
+		globalTags: globalTags,
+		dogStatsD:  dogStatsD,
+		queue:      make(chan string, statsdQueueSize),
+	}
+	go m.flushLoop()
+	return m, nil
+}
+
+// Count implements Metrics
+func (m *StatsDMetrics) Count(name string, value int64, tags ...string) {
+	m.send(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+// Gauge implements Metrics
+func (m *StatsDMetrics) Gauge(name string, value float64, tags ...string) {
+	m.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", tags)
+}
+
+// Timing implements Metrics
+func (m *StatsDMetrics) Timing(name string, d time.Duration, tags ...string) {
+	m.send(name, strconv.FormatInt(d.Milliseconds(), 10), "ms", tags)
+}
+
+// send formats a metric line and queues it, dropping it if the queue is full
+func (m *StatsDMetrics) send(name, value, metricType string, tags []string) {
+	select {
+	case m.queue <- m.format(name, value, metricType, tags):
+	default:
+	}
+}
+
+// format builds a StatsD line: prefix.name:value|type[|#tags]
+func (m *StatsDMetrics) format(name, value, metricType string, tags []string) string {
+	var b strings.Builder
+	b.WriteString(m.prefix)
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(metricType)
+
+	if m.dogStatsD && len(m.globalTags)+len(tags) > 0 {
+		b.WriteString("|#")
+		b.WriteString(strings.Join(append(append([]string{}, m.globalTags...), tags...), ","))
+	}
+	return b.String()
+}
+
+// flushLoop packs queued lines into packets
+func (m *StatsDMetrics) flushLoop() {
+	ticker := time.NewTicker(statsdFlushInterval)
+	defer ticker.Stop()
+
+	var packet []byte
+	flush := func() {
+		if len(packet) == 0 {
+			return
+		}
+		if _, err := m.conn.Write(packet); err != nil {
+			log.Printf("Warning: failed to send metrics: %v", err)
+		}
+		packet = packet[:0]
+	}
+
+	for {
+		select {
+		case line := <-m.queue:
+			if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacketSize {
+				flush()
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			packet = append(packet, line...)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// NewMetrics creates the metrics sink described by the config
+func NewMetrics(config *Config) (Metrics, error) {
+	if config.StatsDAddress == "" {
+		return noopMetrics{}, nil
+	}
+	return NewStatsDMetrics(config.StatsDAddress, config.StatsDPrefix, config.StatsDTags, config.DogStatsD)
+}
+
+// scanTags returns the base tags for a scan request: the route, plus the
+// tenant name and labels when the caller belongs to a tenant
+func scanTags(r *http.Request) []string {
+	tags := []string{"route:" + r.URL.Path}
+	if tenant := tenantFromContext(r.Context()); tenant != nil {
+		tags = append(tags, "tenant:"+tenant.Name)
+		labels := make([]string, 0, len(tenant.Labels))
+		for key, value := range tenant.Labels {
+			labels = append(labels, key+":"+value)
+		}
+		sort.Strings(labels)
+		tags = append(tags, labels...)
+	}
+	return tags
+}
+
+// recordScan emits the metrics for a completed scan request
+func recordScan(requestTags []string, status string, duration time.Duration, uploadBytes int64, result *ScanResult) {
+	tags := append(append([]string{}, requestTags...), "status:"+status)
+
+	metrics.Count("scans", 1, tags...)
+	metrics.Timing("scan.duration", duration, tags...)
+	if uploadBytes > 0 {
+		metrics.Count("upload.bytes", uploadBytes, tags...)
+	}
+	if result != nil {
+		metrics.Count("scanned_files", int64(result.ScannedFiles), tags...)
+		for _, threat := range result.Threats {
+			metrics.Count("threats", 1, append(append([]string{}, requestTags...), "signature:"+threat.Name)...)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics captures metrics for assertions
+type recordingMetrics struct {
+	mu     sync.Mutex
+	counts map[string]int64
+	gauges map[string]float64
+}
+
+func newRecordingMetrics(t *testing.T) *recordingMetrics {
+	t.Helper()
+
+	m := &recordingMetrics{counts: make(map[string]int64), gauges: make(map[string]float64)}
+	metrics = m
+	t.Cleanup(func() { metrics = noopMetrics{} })
+	return m
+}
+
+func (m *recordingMetrics) Count(name string, value int64, tags ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[name] += value
+}
+
+func (m *recordingMetrics) Gauge(name string, value float64, tags ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[name] = value
+}
+
+func (m *recordingMetrics) Timing(name string, d time.Duration, tags ...string) {}
+
+func (m *recordingMetrics) count(name string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[name]
+}
+
+func TestStatsDFormat(t *testing.T) {
+	tests := []struct {
+		name      string
+		dogStatsD bool
+		want      string
+	}{
+		{name: "dogstatsd tags", dogStatsD: true, want: "clamav_rest.scans:1|c|#env:prod,status:clean"},
+		{name: "plain statsd", dogStatsD: false, want: "clamav_rest.scans:1|c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &StatsDMetrics{prefix: "clamav_rest.", globalTags: []string{"env:prod"}, dogStatsD: tt.dogStatsD}
+			if got := m.format("scans", "1", "c", []string{"status:clean"}); got != tt.want {
+				t.Errorf("format() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatsDMetricsSendsUDP(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	m, err := NewStatsDMetrics(listener.LocalAddr().String(), "test.", nil, true)
+	if err != nil {
+		t.Fatalf("NewStatsDMetrics() error: %v", err)
+	}
+
+	m.Count("scans", 1, "status:clean")
+	m.Timing("scan.duration", 150*time.Millisecond)
+	m.Gauge("queue.depth", 3)
+
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var received []string
+	buf := make([]byte, statsdMaxPacketSize)
+	for len(received) < 3 {
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("failed to read packet: %v (got %v)", err, received)
+		}
+		received = append(received, strings.Split(string(buf[:n]), "\n")...)
+	}
+
+	want := []string{"test.scans:1|c|#status:clean", "test.scan.duration:150|ms", "test.queue.depth:3|g"}
+	for i, line := range want {
+		if received[i] != line {
+			t.Errorf("line %d = %q, want %q", i, received[i], line)
+		}
+	}
+}
+
+func TestStatsDAddressFromEnv(t *testing.T) {
+	t.Run("explicit address", func(t *testing.T) {
+		t.Setenv(EnvStatsDAddress, "statsd:9125")
+		t.Setenv(EnvDDAgentHost, "datadog")
+		if got := statsDAddressFromEnv(); got != "statsd:9125" {
+			t.Errorf("address = %q, want statsd:9125", got)
+		}
+	})
+
+	t.Run("datadog agent host", func(t *testing.T) {
+		t.Setenv(EnvStatsDAddress, "")
+		t.Setenv(EnvDDAgentHost, "10.0.0.5")
+		if got := statsDAddressFromEnv(); got != "10.0.0.5:8125" {
+			t.Errorf("address = %q, want 10.0.0.5:8125", got)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv(EnvStatsDAddress, "")
+		t.Setenv(EnvDDAgentHost, "")
+		if got := statsDAddressFromEnv(); got != "" {
+			t.Errorf("address = %q, want empty", got)
+		}
+	})
+}
+
+func TestRecordScan(t *testing.T) {
+	m := newRecordingMetrics(t)
+
+	recordScan([]string{"route:/scan"}, "infected", time.Second, 1024, &ScanResult{
+		Threats:      []Threat{{Name: "Virus.A"}, {Name: "Virus.B"}},
+		ScannedFiles: 10,
+	})
+
+	if got := m.count("scans"); got != 1 {
+		t.Errorf("scans = %d, want 1", got)
+	}
+	if got := m.count("threats"); got != 2 {
+		t.Errorf("threats = %d, want 2", got)
+	}
+	if got := m.count("scanned_files"); got != 10 {
+		t.Errorf("scanned_files = %d, want 10", got)
+	}
+	if got := m.count("upload.bytes"); got != 1024 {
+		t.Errorf("upload.bytes = %d, want 1024", got)
+	}
+}
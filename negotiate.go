@@ -0,0 +1,60 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+)
+
+// Media type of multipart scan uploads
+const multipartFormData = "multipart/form-data"
+
+// UploadFormats tells a client whose upload couldn't be used how to send
+// one, with 400 and 415 responses
+type UploadFormats struct {
+	ContentTypes []string `json:"content_types"` // Request Content-Types accepted by POST
+	FileFields   []string `json:"file_fields"`   // Multipart fields that carry the file
+	Endpoints    []string `json:"endpoints"`     // Ways to upload a file, relative to BASE_PATH
+}
+
+// uploadFormats describes the uploads the request's route accepts
+func uploadFormats(r *http.Request, config *Config) *UploadFormats {
+	fields := config.UploadFieldNames
+	if len(fields) == 0 {
+		fields = []string{"file", "(any part with a filename)"}
+	}
+	formats := &UploadFormats{
+		ContentTypes: []string{multipartFormData},
+		FileFields:   fields,
+		Endpoints: []string{
+			"POST " + r.URL.Path + " (" + multipartFormData + ")",
+			"PUT " + r.URL.Path + "/{filename} (file as the raw body, any Content-Type)",
+			"GET /scan/ws (WebSocket stream)",
+		},
+	}
+	if uploads != nil {
+		formats.Endpoints = append(formats.Endpoints, "POST /uploads (resumable tus upload)")
+	}
+	return formats
+}
+
+// checkUploadRequest rejects a POST that can't carry a multipart upload
+// before its body is read: an empty body with 400, another Content-Type
+// with 415
+func checkUploadRequest(r *http.Request, config *Config) *requestError {
+	if r.ContentLength == 0 {
+		return &requestError{status: http.StatusBadRequest, message: "Empty request body (expected a file upload)", formats: uploadFormats(r, config)}
+	}
+	contentType := r.Header.Get("Content-Type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	switch {
+	case contentType == "":
+		return &requestError{status: http.StatusUnsupportedMediaType, message: "Missing Content-Type (expected " + multipartFormData + ")", formats: uploadFormats(r, config)}
+	case err != nil:
+		return &requestError{status: http.StatusBadRequest, message: "Invalid Content-Type (expected " + multipartFormData + ")", formats: uploadFormats(r, config)}
+	case mediaType != multipartFormData && mediaType != "multipart/mixed":
+		return &requestError{status: http.StatusUnsupportedMediaType, message: "Unsupported Content-Type " + mediaType + " (expected " + multipartFormData + ", or PUT the raw file)", formats: uploadFormats(r, config)}
+	case params["boundary"] == "":
+		return &requestError{status: http.StatusBadRequest, message: "Invalid " + multipartFormData + " request (missing boundary)", formats: uploadFormats(r, config)}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckUploadRequest(t *testing.T) {
+	cfg := &Config{UploadFieldNames: []string{"file"}}
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int // 0 = accepted
+	}{
+		{"multipart", "multipart/form-data; boundary=xyz", "--xyz--", 0},
+		{"multipart mixed", "multipart/mixed; boundary=xyz", "--xyz--", 0},
+		{"empty body", "multipart/form-data; boundary=xyz", "", http.StatusBadRequest},
+		{"json", "application/json", `{"file":"..."}`, http.StatusUnsupportedMediaType},
+		{"raw file", "application/octet-stream", "data", http.StatusUnsupportedMediaType},
+		{"no content type", "", "data", http.StatusUnsupportedMediaType},
+		{"missing boundary", "multipart/form-data", "data", http.StatusBadRequest},
+		{"invalid content type", "multipart/form-data; boundary", "data", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/scan", strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		reqErr := checkUploadRequest(req, cfg)
+		switch {
+		case tt.wantStatus == 0 && reqErr != nil:
+			t.Errorf("%s: rejected with %d %q", tt.name, reqErr.status, reqErr.message)
+		case tt.wantStatus != 0 && reqErr == nil:
+			t.Errorf("%s: accepted, want %d", tt.name, tt.wantStatus)
+		case tt.wantStatus != 0 && (reqErr.status != tt.wantStatus || reqErr.formats == nil):
+			t.Errorf("%s: status = %d (formats %v), want %d with formats", tt.name, reqErr.status, reqErr.formats, tt.wantStatus)
+		}
+	}
+}
+
+func TestScanHandlerUnsupportedContentType(t *testing.T) {
+	cfg := &Config{MaxUploadSize: 10 << 20, UploadFieldNames: []string{"file"}}
+	req := httptest.NewRequest(http.MethodPost, "/scan", strings.NewReader(`{"file":"eicar"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+
+	handleScan(rec, req, cfg, NewScanner(cfg))
+
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusUnsupportedMediaType, rec.Body.String())
+	}
+	if got := rec.Header().Get("Accept-Post"); got != multipartFormData {
+		t.Errorf("Accept-Post = %q, want %q", got, multipartFormData)
+	}
+	var resp ScanResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.Status != "error" || resp.Supported == nil {
+		t.Fatalf("response = %+v, want an error with supported formats", resp)
+	}
+	if len(resp.Supported.FileFields) != 1 || resp.Supported.FileFields[0] != "file" {
+		t.Errorf("file_fields = %v, want [file]", resp.Supported.FileFields)
+	}
+	if len(resp.Supported.Endpoints) == 0 || !strings.HasPrefix(resp.Supported.Endpoints[0], "POST /scan ") {
+		t.Errorf("endpoints = %v, want POST /scan first", resp.Supported.Endpoints)
+	}
+}
+
+func TestScanHandlerEmptyBody(t *testing.T) {
+	cfg := &Config{MaxUploadSize: 10 << 20}
+	req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=xyz")
+	rec := httptest.NewRecorder()
+
+	handleScan(rec, req, cfg, NewScanner(cfg))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if !strings.Contains(rec.Body.String(), `"supported"`) {
+		t.Errorf("body = %s, want the supported upload formats", rec.Body.String())
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Notification payload formats
+const (
+	notifyFormatSlack   = "slack"
+	notifyFormatTeams   = "teams"
+	notifyFormatWebhook = "webhook"
+)
+
+// Maximum detections kept per notification; further ones are only counted
+const notifyMaxBatch = 50
+
+// Timeout for posting a notification
+const notifyTimeout = 10 * time.Second
+
+// defaultNotifyTemplate renders the message text for a batch
+const defaultNotifyTemplate = `{{.Total}} infected upload(s) detected on {{.Hostname}}
+{{- range .Detections}}
+• {{.Filename}}{{if .ClientIP}} from {{.ClientIP}}{{end}}{{if .Identity}} ({{.Identity}}){{end}}{{if eq .Event "retrospective_detection"}} (stored file, after signature update){{end}}: {{range $i, $t := .Threats}}{{if $i}}, {{end}}{{$t.Name}}{{end}}
+{{- end}}
+{{- if .Omitted}}
+…and {{.Omitted}} more{{end}}`
+
+// NotificationBatch is the data passed to the message template
+type NotificationBatch struct {
+	Hostname   string         `json:"hostname"`
+	Total      int            `json:"total"`
+	Omitted    int            `json:"omitted"` // Detections not included in Detections
+	Detections []*AuditRecord `json:"detections"`
+}
+
+// Notifier posts detection alerts to Slack, Microsoft Teams or a generic
+// webhook. Detections are batched per interval, and at most rateLimit
+// messages are sent per minute; detections arriving while rate limited are
+// folded into the next message.
+type Notifier struct {
+	url       string
+	format    string
+	template  *template.Template
+	interval  time.Duration
+	rateLimit int
+	hostname  string
+	client    *http.Client
+
+	mu      sync.Mutex
+	pending []*AuditRecord
+	omitted int
+	sent    []time.Time // Send times within the last minute
+}
+
+// Global notifier (nil when disabled)
+var notifier *Notifier
+
+// NewNotifier creates the notifier described by the config and starts its
+// flush loop. Returns nil when no webhook URL is configured.
+func NewNotifier(config *Config) (*Notifier, error) {
+	if config.NotifyURL == "" {
+		return nil, nil
+	}
+
+	n, err := newNotifier(config)
+	if err != nil {
+		return nil, err
+	}
+	go n.flushLoop()
+	return n, nil
+}
+
+// newNotifier validates the config without starting the flush loop
+func newNotifier(config *Config) (*Notifier, error) {
+	format := strings.ToLower(config.NotifyFormat)
+	switch format {
+	case notifyFormatSlack, notifyFormatTeams, notifyFormatWebhook:
+	default:
+		return nil, fmt.Errorf("unsupported notification format %q (use slack, teams or webhook)", config.NotifyFormat)
+	}
+
+	text := config.NotifyTemplate
+	if text == "" {
+		text = defaultNotifyTemplate
+	}
+	tmpl, err := template.New("notification").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid notification template: %w", err)
+	}
+
+	if config.NotifyInterval <= 0 {
+		return nil, fmt.Errorf("%s must be positive", EnvNotifyInterval)
+	}
+	if config.NotifyRateLimit <= 0 {
+		return nil, fmt.Errorf("%s must be positive", EnvNotifyRateLimit)
+	}
+
+	hostname, _ := os.Hostname()
+
+	return &Notifier{
+		url:       config.NotifyURL,
+		format:    format,
+		template:  tmpl,
+		interval:  time.Duration(config.NotifyInterval) * time.Second,
+		rateLimit: config.NotifyRateLimit,
+		hostname:  hostname,
+		client:    newOutboundClient(notifyTimeout),
+	}, nil
+}
+
+// Notify queues a detection for the next batch. Never blocks on the network.
+func (n *Notifier) Notify(record *AuditRecord) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.pending) < notifyMaxBatch {
+		n.pending = append(n.pending, record)
+	} else {
+		n.omitted++
+	}
+}
+
+// flushLoop sends pending detections once per interval
+func (n *Notifier) flushLoop() {
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n.flush(time.Now())
+	}
+}
+
+// flush sends the pending batch unless it is empty or the rate limit is hit
+func (n *Notifier) flush(now time.Time) {
+	n.mu.Lock()
+	if len(n.pending) == 0 || !n.allow(now) {
+		n.mu.Unlock()
+		return
+	}
+	batch := &NotificationBatch{
+		Hostname:   n.hostname,
+		Total:      len(n.pending) + n.omitted,
+		Omitted:    n.omitted,
+		Detections: n.pending,
+	}
+	n.pending, n.omitted = nil, 0
+	n.mu.Unlock()
+
+	if err := n.send(batch); err != nil {
+		log.Printf("Warning: failed to send detection notification: %v", err)
+	}
+}
+
+// allow reports whether another message fits in the per-minute limit and
+// records the send. Caller holds n.mu.
+func (n *Notifier) allow(now time.Time) bool {
+	cutoff := now.Add(-time.Minute)
+	recent := n.sent[:0]
+	for _, t := range n.sent {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	n.sent = recent
+
+	if len(n.sent) >= n.rateLimit {
+		return false
+	}
+	n.sent = append(n.sent, now)
+	return true
+}
+
+// send renders and posts one notification
+func (n *Notifier) send(batch *NotificationBatch) error {
+	body, err := n.payload(batch)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// payload builds the request body for the configured format
+func (n *Notifier) payload(batch *NotificationBatch) ([]byte, error) {
+	var text bytes.Buffer
+	if err := n.template.Execute(&text, escapeNotification(batch, n.format)); err != nil {
+		return nil, fmt.Errorf("failed to render notification: %w", err)
+	}
+
+	switch n.format {
+	case notifyFormatSlack:
+		return json.Marshal(map[string]string{"text": text.String()})
+	case notifyFormatTeams:
+		// Legacy connector card, accepted by Teams incoming webhooks
+		return json.Marshal(map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  "Malware detected",
+			"title":    "Malware detected",
+			"text":     text.String(),
+		})
+	default:
+		return json.Marshal(struct {
+			Event string `json:"event"`
+			Text  string `json:"text"`
+			*NotificationBatch
+		}{auditEventDetection, text.String(), batch})
+	}
+}
+
+// Characters Slack reads as markup (mentions, links), as entities
+var slackMarkup = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// Markdown characters Teams would otherwise render, backslash-escaped
+var teamsMarkdown = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`",
+	"[", `\[`, "]", `\]`, "#", `\#`, "~", `\~`, "|", `\|`)
+
+// escapeNotification returns a copy of batch for rendering the message
+// text: client-supplied names are cleaned (see reportedName), and escaped
+// for the format's markup, so a crafted file name can't add lines, links,
+// mentions or formatting to the message
+func escapeNotification(batch *NotificationBatch, format string) *NotificationBatch {
+	escape := reportedName
+	switch format {
+	case notifyFormatSlack:
+		escape = func(s string) string { return slackMarkup.Replace(reportedName(s)) }
+	case notifyFormatTeams:
+		escape = func(s string) string { return html.EscapeString(teamsMarkdown.Replace(reportedName(s))) }
+	}
+
+	escaped := *batch
+	escaped.Detections = make([]*AuditRecord, len(batch.Detections))
+	for i, record := range batch.Detections {
+		r := *record
+		r.Filename = escape(r.Filename)
+		r.Threats = make([]Threat, len(record.Threats))
+		for j, threat := range record.Threats {
+			threat.File = escape(threat.File)
+			r.Threats[j] = threat
+		}
+		escaped.Detections[i] = &r
+	}
+	return &escaped
+}
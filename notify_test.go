@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testNotifyConfig(url, format string) *Config {
+	return &Config{
+		NotifyURL:       url,
+		NotifyFormat:    format,
+		NotifyInterval:  DefaultNotifyInterval,
+		NotifyRateLimit: DefaultNotifyRateLimit,
+	}
+}
+
+func TestNewNotifier(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(c *Config)
+		wantErr bool
+	}{
+		{name: "slack", mutate: func(c *Config) { c.NotifyFormat = "Slack" }},
+		{name: "teams", mutate: func(c *Config) { c.NotifyFormat = "teams" }},
+		{name: "unknown format", mutate: func(c *Config) { c.NotifyFormat = "pager" }, wantErr: true},
+		{name: "bad template", mutate: func(c *Config) { c.NotifyTemplate = "{{.Total" }, wantErr: true},
+		{name: "zero interval", mutate: func(c *Config) { c.NotifyInterval = 0 }, wantErr: true},
+		{name: "zero rate limit", mutate: func(c *Config) { c.NotifyRateLimit = 0 }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testNotifyConfig("http://localhost/hook", "webhook")
+			tt.mutate(config)
+			_, err := newNotifier(config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newNotifier() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewNotifierDisabled(t *testing.T) {
+	n, err := NewNotifier(&Config{})
+	if err != nil || n != nil {
+		t.Errorf("NewNotifier() = %v, %v; want nil, nil", n, err)
+	}
+}
+
+func TestNotifierBatchesDetections(t *testing.T) {
+	var bodies []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+	}))
+	defer server.Close()
+
+	n, err := newNotifier(testNotifyConfig(server.URL, "slack"))
+	if err != nil {
+		t.Fatalf("newNotifier() error: %v", err)
+	}
+
+	n.Notify(testDetectionRecord())
+	n.Notify(testDetectionRecord())
+	n.flush(time.Now())
+
+	// Nothing pending: no message
+	n.flush(time.Now())
+
+	if len(bodies) != 1 {
+		t.Fatalf("got %d messages, want 1", len(bodies))
+	}
+	text, _ := bodies[0]["text"].(string)
+	if !strings.HasPrefix(text, "2 infected upload(s)") {
+		t.Errorf("text = %q, want count of 2", text)
+	}
+	if !strings.Contains(text, "Eicar-Test-Signature, Win.Test|Pipe") {
+		t.Errorf("text = %q, want signature list", text)
+	}
+}
+
+func TestNotifierRateLimit(t *testing.T) {
+	var messages int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		messages++
+	}))
+	defer server.Close()
+
+	config := testNotifyConfig(server.URL, "webhook")
+	config.NotifyRateLimit = 1
+	n, err := newNotifier(config)
+	if err != nil {
+		t.Fatalf("newNotifier() error: %v", err)
+	}
+
+	now := time.Now()
+	n.Notify(testDetectionRecord())
+	n.flush(now)
+
+	// Second batch is held back until the minute has passed
+	n.Notify(testDetectionRecord())
+	n.flush(now.Add(30 * time.Second))
+	if messages != 1 {
+		t.Fatalf("got %d messages while rate limited, want 1", messages)
+	}
+
+	n.flush(now.Add(61 * time.Second))
+	if messages != 2 {
+		t.Errorf("got %d messages after limit reset, want 2", messages)
+	}
+}
+
+func TestNotifierOmitsBeyondMaxBatch(t *testing.T) {
+	n, err := newNotifier(testNotifyConfig("http://localhost/hook", "webhook"))
+	if err != nil {
+		t.Fatalf("newNotifier() error: %v", err)
+	}
+
+	for i := 0; i < notifyMaxBatch+3; i++ {
+		n.Notify(testDetectionRecord())
+	}
+
+	body, err := n.payload(&NotificationBatch{Total: notifyMaxBatch + 3, Omitted: n.omitted, Detections: n.pending})
+	if err != nil {
+		t.Fatalf("payload() error: %v", err)
+	}
+
+	var decoded struct {
+		Event      string        `json:"event"`
+		Text       string        `json:"text"`
+		Total      int           `json:"total"`
+		Omitted    int           `json:"omitted"`
+		Detections []AuditRecord `json:"detections"`
+	}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		t.Fatalf("invalid payload: %v", err)
+	}
+	if decoded.Event != auditEventDetection || decoded.Omitted != 3 || len(decoded.Detections) != notifyMaxBatch {
+		t.Errorf("payload = event %q, omitted %d, %d detections", decoded.Event, decoded.Omitted, len(decoded.Detections))
+	}
+	if !strings.Contains(decoded.Text, "…and 3 more") {
+		t.Errorf("text = %q, want omitted count", decoded.Text)
+	}
+}
+
+func TestNotifierTeamsPayload(t *testing.T) {
+	config := testNotifyConfig("http://localhost/hook", "teams")
+	config.NotifyTemplate = "{{.Total}} detections"
+	n, err := newNotifier(config)
+	if err != nil {
+		t.Fatalf("newNotifier() error: %v", err)
+	}
+
+	body, err := n.payload(&NotificationBatch{Total: 4})
+	if err != nil {
+		t.Fatalf("payload() error: %v", err)
+	}
+
+	var card map[string]string
+	json.Unmarshal(body, &card)
+	if card["@type"] != "MessageCard" || card["text"] != "4 detections" {
+		t.Errorf("card = %v", card)
+	}
+}
+
+func TestNotifierEscapesNames(t *testing.T) {
+	record := testDetectionRecord()
+	record.Filename = "<!channel> *urgent* <https://evil.example|invoice>.pdf\n• fake line"
+	record.Threats = []Threat{{Name: "Eicar-Test-Signature", File: "[click](https://evil.example)"}}
+	batch := &NotificationBatch{Total: 1, Detections: []*AuditRecord{record}}
+
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{notifyFormatSlack, []string{"&lt;!channel&gt; *urgent* &lt;https://evil.example|invoice&gt;.pdf"}},
+		{notifyFormatTeams, []string{`&lt;!channel&gt; \*urgent\*`, `\[click\](https://evil.example)`}},
+		{notifyFormatWebhook, []string{"<!channel> *urgent*", ".pdf\uFFFD• fake line"}},
+	}
+	for _, tt := range tests {
+		config := testNotifyConfig("http://localhost/hook", tt.format)
+		config.NotifyTemplate = "{{range .Detections}}{{.Filename}} {{range .Threats}}{{.File}}{{end}}{{end}}"
+		n, err := newNotifier(config)
+		if err != nil {
+			t.Fatalf("newNotifier() error: %v", err)
+		}
+		body, err := n.payload(batch)
+		if err != nil {
+			t.Fatalf("payload() error: %v", err)
+		}
+		var payload map[string]interface{}
+		json.Unmarshal(body, &payload)
+		text, _ := payload["text"].(string)
+		for _, want := range tt.want {
+			if !strings.Contains(text, want) {
+				t.Errorf("%s: text = %q, want %q", tt.format, text, want)
+			}
+		}
+	}
+	if !strings.HasSuffix(record.Filename, ".pdf\n• fake line") {
+		t.Errorf("record modified: %q", record.Filename)
+	}
+}
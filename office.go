@@ -0,0 +1,404 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Document indicator types
+const (
+	indicatorMacros    = "vba_macros" // VBA project; detail lists the modules
+	indicatorOLEObject = "ole_object" // Embedded OLE object or package
+	indicatorActiveX   = "activex"    // ActiveX control (OOXML)
+)
+
+// Indicator flags risky active content in a document, whether or not
+// ClamAV has a signature for it, so clients can apply their own policy
+// (e.g. reject macro-enabled documents)
+type Indicator struct {
+	File   string `json:"file"`             // Document path within the upload
+	Type   string `json:"type"`             // vba_macros, ole_object or activex
+	Detail string `json:"detail,omitempty"` // Storage, part or module names
+}
+
+// Suffixes of the extraction directories added next to a document
+const (
+	macrosDirSuffix  = ".macros"  // Decompressed VBA module source
+	objectsDirSuffix = ".objects" // Embedded objects and OOXML parts
+)
+
+// errVBACorrupt is returned for VBA streams that do not decompress
+var errVBACorrupt = errors.New("corrupt VBA compressed stream")
+
+// documentInspector finds indicators in the files of a scan directory and
+// extracts macro source and embedded objects next to each document, so
+// ClamAV scans them as well. Extraction stops at the configured limits;
+// indicators are reported regardless.
+type documentInspector struct {
+	config     *Config
+	dir        string
+	budget     *requestBudget
+	indicators []Indicator
+	extracted  int
+	total      int64
+}
+
+// inspectDocuments inspects every OLE compound file and OOXML document
+// below dir, extracting within budget (if set) as well as the limits.
+// Returns the indicators and the number of files extracted.
+func (s *Scanner) inspectDocuments(dir string, budget *requestBudget) ([]Indicator, int) {
+	x := &documentInspector{config: s.config, dir: dir, budget: budget}
+
+	var files []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	for _, file := range files {
+		rel := x.rel(file)
+		// Parts of a document uploaded directly, unpacked as an archive
+		if indicator := ooxmlPartIndicator(rel); indicator != "" && indicator != indicatorMacros {
+			x.indicators = append(x.indicators, Indicator{File: rel, Type: indicator})
+		}
+		x.inspect(file, rel, 0)
+	}
+	return x.indicators, x.extracted
+}
+
+// ooxmlPartIndicator returns the indicator type for an OOXML part name,
+// e.g. word/vbaProject.bin or xl/embeddings/oleObject1.bin
+func ooxmlPartIndicator(name string) string {
+	parts := strings.Split(name, "/")
+	if len(parts) == 2 && strings.EqualFold(parts[1], "vbaProject.bin") {
+		return indicatorMacros
+	}
+	if len(parts) != 3 {
+		return ""
+	}
+	switch {
+	case parts[1] == "embeddings":
+		return indicatorOLEObject
+	case parts[1] == "activeX" && strings.HasSuffix(parts[2], ".bin"):
+		return indicatorActiveX
+	}
+	return ""
+}
+
+// inspect dispatches on the file's magic bytes. Indicators are reported
+// for owner, the outermost document the file was extracted from.
+func (x *documentInspector) inspect(file, owner string, depth int) {
+	if depth > 2 {
+		return // An object inside an object inside a document is enough
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return
+	}
+
+	switch {
+	case bytes.Equal(head, cfbMagic):
+		if cfb, err := openCFB(f, info.Size()); err == nil {
+			x.inspectCFB(file, owner, cfb, depth)
+		}
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		if reader, err := zip.NewReader(f, info.Size()); err == nil {
+			x.inspectOOXML(file, owner, reader, depth)
+		}
+	}
+}
+
+// inspectCFB reports VBA projects and embedded objects of an Office 97-2003
+// document, Outlook message or vbaProject.bin
+func (x *documentInspector) inspectCFB(file, owner string, cfb *cfbFile, depth int) {
+	for _, entry := range cfb.Entries() {
+		name := path.Base(entry.Path)
+		switch {
+		case entry.Type == cfbTypeStorage && name == "VBA" && cfb.Find(entry.Path+"/dir") != nil:
+			modules, err := x.extractVBA(file, cfb, entry.Path)
+			if err != nil && x.config.DebugMode {
+				log.Printf("Warning: could not extract VBA project %s in %s: %v", entry.Path, owner, err)
+			}
+			x.indicators = append(x.indicators, Indicator{File: owner, Type: indicatorMacros, Detail: strings.Join(modules, ",")})
+
+		case entry.Type == cfbTypeStorage && (strings.HasPrefix(entry.Path, "ObjectPool/") && !strings.Contains(entry.Path[len("ObjectPool/"):], "/") ||
+			strings.HasPrefix(name, "MBD") && !strings.Contains(entry.Path, "/")):
+			// Word keeps embedded objects in ObjectPool, Excel in MBD storages
+			x.indicators = append(x.indicators, Indicator{File: owner, Type: indicatorOLEObject, Detail: entry.Path})
+
+		case entry.Type == cfbTypeStream && (name == "\x01Ole10Native" || name == "Package" || name == "CONTENTS"):
+			// Object payloads: packaged files, OOXML and PDF objects. The
+			// buffer is released before the written object is inspected.
+			held := extractBudget.acquire(int64(min(entry.Size, x.config.MaxSingleFileSize)))
+			var target string
+			if data, err := cfb.ReadStream(entry, x.config.MaxSingleFileSize); err == nil {
+				target = x.write(file, objectsDirSuffix, strings.ReplaceAll(entry.Path, "\x01", ""), data)
+			}
+			extractBudget.release(held)
+			if target != "" {
+				x.inspect(target, owner, depth+1)
+			}
+		}
+	}
+}
+
+// inspectOOXML reports macros, embedded objects and ActiveX controls of an
+// Office Open XML document nested in the upload, and extracts those parts.
+// A document uploaded directly has already been unpacked as an archive, so
+// its parts are found as files instead.
+func (x *documentInspector) inspectOOXML(file, owner string, reader *zip.Reader, depth int) {
+	isOffice := false
+	for _, f := range reader.File {
+		if f.Name == "[Content_Types].xml" {
+			isOffice = true
+			break
+		}
+	}
+	if !isOffice {
+		return
+	}
+
+	for _, f := range reader.File {
+		indicator := ooxmlPartIndicator(f.Name)
+		if indicator == "" {
+			continue
+		}
+		if indicator != indicatorMacros {
+			x.indicators = append(x.indicators, Indicator{File: owner, Type: indicator, Detail: f.Name})
+		}
+
+		if f.UncompressedSize64 > x.config.MaxSingleFileSize {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			continue
+		}
+		held := extractBudget.acquire(int64(f.UncompressedSize64))
+		data, err := io.ReadAll(io.LimitReader(rc, int64(x.config.MaxSingleFileSize)))
+		rc.Close()
+		var target string
+		if err == nil {
+			target = x.write(file, objectsDirSuffix, f.Name, data)
+		}
+		extractBudget.release(held)
+		if err != nil {
+			continue
+		}
+		if target != "" {
+			// vbaProject.bin reports its macros itself, with the module names
+			x.inspect(target, owner, depth+1)
+		} else if indicator == indicatorMacros {
+			x.indicators = append(x.indicators, Indicator{File: owner, Type: indicatorMacros, Detail: f.Name})
+		}
+	}
+}
+
+// extractVBA decompresses the source of each module of a VBA project
+// storage to <document>.macros/<module>.vba. Returns the module names.
+func (x *documentInspector) extractVBA(file string, cfb *cfbFile, storage string) ([]string, error) {
+	read := func(name string) ([]byte, error) {
+		entry := cfb.Find(storage + "/" + name)
+		if entry == nil {
+			return nil, fmt.Errorf("missing stream %s", name)
+		}
+		return cfb.ReadStream(entry, x.config.MaxSingleFileSize)
+	}
+
+	compressed, err := read("dir")
+	if err != nil {
+		return nil, err
+	}
+	dir, err := decompressVBA(compressed, x.config.MaxSingleFileSize)
+	if err != nil {
+		return nil, err
+	}
+	modules, err := parseVBADir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, module := range modules {
+		names = append(names, module.name)
+		stream, err := read(module.stream)
+		if err != nil || int(module.offset) > len(stream) {
+			continue
+		}
+		source, err := decompressVBA(stream[module.offset:], x.config.MaxSingleFileSize)
+		if err != nil {
+			continue
+		}
+		x.write(file, macrosDirSuffix, module.name+".vba", source)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// write stores extracted content at <document><suffix>/<name>, within the
+// extraction limits. Returns the path written, or "" if skipped.
+func (x *documentInspector) write(document, suffix, name string, data []byte) string {
+	if x.extracted >= x.config.MaxFileCount || x.total+int64(len(data)) > x.config.MaxExtractedSize {
+		return ""
+	}
+	base := document + suffix
+	target := filepath.Join(base, filepath.FromSlash(strings.NewReplacer("\\", "_", "\x00", "").Replace(name)))
+	if !strings.HasPrefix(target, base+string(os.PathSeparator)) {
+		return ""
+	}
+	if x.budget.addFile(x.dir, target) != nil || x.budget.take(int64(len(data))) != nil {
+		return ""
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return ""
+	}
+	if err := os.WriteFile(target, data, 0644); err != nil {
+		return ""
+	}
+	x.extracted++
+	x.total += int64(len(data))
+	return target
+}
+
+// rel returns a path relative to the scan directory, as in threat entries
+func (x *documentInspector) rel(file string) string {
+	rel, err := filepath.Rel(x.dir, file)
+	if err != nil {
+		return file
+	}
+	return filepath.ToSlash(rel)
+}
+
+// decompressVBA implements the MS-OVBA 2.4.1 decompression used for VBA
+// source and the dir stream, up to maxSize bytes of output
+func decompressVBA(data []byte, maxSize uint64) ([]byte, error) {
+	if len(data) == 0 || data[0] != 1 {
+		return nil, errVBACorrupt
+	}
+	var out []byte
+	for pos := 1; pos+2 <= len(data); {
+		header := binary.LittleEndian.Uint16(data[pos:])
+		end := min(pos+int(header&0x0fff)+3, len(data))
+		pos += 2
+
+		if header&0x8000 == 0 {
+			// Uncompressed chunk: always 4096 raw bytes
+			end = min(pos+4096, len(data))
+			out = append(out, data[pos:end]...)
+			pos = end
+		} else {
+			chunkStart := len(out)
+			for pos < end {
+				flags := data[pos]
+				pos++
+				for bit := 0; bit < 8 && pos < end; bit++ {
+					if flags&(1<<bit) == 0 {
+						out = append(out, data[pos])
+						pos++
+						continue
+					}
+					if pos+2 > end {
+						return nil, errVBACorrupt
+					}
+					token := binary.LittleEndian.Uint16(data[pos:])
+					pos += 2
+
+					bitCount := 4
+					for 1<<bitCount < len(out)-chunkStart {
+						bitCount++
+					}
+					lengthMask := uint16(0xffff) >> bitCount
+					length := int(token&lengthMask) + 3
+					offset := int(token>>(16-bitCount)) + 1
+					if offset > len(out)-chunkStart {
+						return nil, errVBACorrupt
+					}
+					for i := 0; i < length; i++ {
+						out = append(out, out[len(out)-offset])
+					}
+				}
+			}
+		}
+		if uint64(len(out)) > maxSize {
+			return nil, fmt.Errorf("VBA stream exceeds size limit (%d bytes)", maxSize)
+		}
+	}
+	return out, nil
+}
+
+// vbaModule locates a module's compressed source within its stream
+type vbaModule struct {
+	name   string
+	stream string
+	offset uint32
+}
+
+// VBA dir stream record IDs (MS-OVBA 2.3.4.2)
+const (
+	vbaRecordProjectVersion   = 0x0009
+	vbaRecordModuleName       = 0x0019
+	vbaRecordModuleStreamName = 0x001a
+	vbaRecordModuleOffset     = 0x0031
+	vbaRecordModuleTerminator = 0x002b
+	vbaRecordDirTerminator    = 0x0010
+)
+
+// parseVBADir lists the modules of a decompressed dir stream. Records are
+// an ID, a size and data; only the ones locating module source are used.
+func parseVBADir(dir []byte) ([]vbaModule, error) {
+	le := binary.LittleEndian
+	var modules []vbaModule
+	var current vbaModule
+	for pos := 0; pos+6 <= len(dir); {
+		id := le.Uint16(dir[pos:])
+		size := int(le.Uint32(dir[pos+2:]))
+		if id == vbaRecordProjectVersion {
+			size = 6 // The size field says 4, but the record holds 6 bytes
+		}
+		pos += 6
+		if size < 0 || pos+size > len(dir) {
+			return nil, errVBACorrupt
+		}
+		data := dir[pos : pos+size]
+		pos += size
+
+		switch id {
+		case vbaRecordModuleName:
+			current = vbaModule{name: string(data)}
+		case vbaRecordModuleStreamName:
+			current.stream = string(data)
+		case vbaRecordModuleOffset:
+			if len(data) == 4 {
+				current.offset = le.Uint32(data)
+			}
+		case vbaRecordModuleTerminator:
+			if current.name != "" && current.stream != "" {
+				modules = append(modules, current)
+			}
+			current = vbaModule{}
+		case vbaRecordDirTerminator:
+			return modules, nil
+		}
+	}
+	return modules, nil
+}
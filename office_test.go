@@ -0,0 +1,241 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// compressVBALiteral encodes data in the MS-OVBA compressed format without
+// back-references: full chunks are stored raw, the last one as literals
+func compressVBALiteral(data []byte) []byte {
+	out := []byte{1}
+	for len(data) > 0 {
+		chunk := data[:min(len(data), 4096)]
+		data = data[len(chunk):]
+		if len(chunk) == 4096 {
+			out = binary.LittleEndian.AppendUint16(out, 0x3fff)
+			out = append(out, chunk...)
+			continue
+		}
+		var body []byte
+		for i := 0; i < len(chunk); i += 8 {
+			body = append(body, 0)
+			body = append(body, chunk[i:min(i+8, len(chunk))]...)
+		}
+		out = binary.LittleEndian.AppendUint16(out, uint16(len(body)+2-3)|0xb000)
+		out = append(out, body...)
+	}
+	return out
+}
+
+// vbaRecord encodes one dir stream record
+func vbaRecord(id uint16, data []byte) []byte {
+	record := binary.LittleEndian.AppendUint16(nil, id)
+	record = binary.LittleEndian.AppendUint32(record, uint32(len(data)))
+	return append(record, data...)
+}
+
+// vbaProjectStreams returns the streams of a VBA project storage with one
+// module, whose source follows 4 bytes of (fake) p-code
+func vbaProjectStreams(storage, module, source string) map[string][]byte {
+	var dir []byte
+	dir = append(dir, vbaRecord(0x0001, []byte{1, 0, 0, 0})...) // PROJECTSYSKIND
+	// PROJECTVERSION declares 4 bytes but holds 6
+	dir = append(dir, binary.LittleEndian.AppendUint16(nil, vbaRecordProjectVersion)...)
+	dir = append(dir, 4, 0, 0, 0, 1, 2, 3, 4, 5, 6)
+	dir = append(dir, vbaRecord(vbaRecordModuleName, []byte(module))...)
+	dir = append(dir, vbaRecord(vbaRecordModuleStreamName, []byte(module))...)
+	dir = append(dir, vbaRecord(0x0032, []byte{'M', 0})...)
+	dir = append(dir, vbaRecord(vbaRecordModuleOffset, []byte{4, 0, 0, 0})...)
+	dir = append(dir, vbaRecord(vbaRecordModuleTerminator, nil)...)
+	dir = append(dir, vbaRecord(vbaRecordDirTerminator, nil)...)
+
+	return map[string][]byte{
+		storage + "/dir":          compressVBALiteral(dir),
+		storage + "/" + module:    append([]byte("CODE"), compressVBALiteral([]byte(source))...),
+		storage + "/_VBA_PROJECT": {0xcc, 0x61},
+	}
+}
+
+// testDocument builds an Office 97-2003 style document with a macro
+// module and an embedded package object
+func testDocument(t *testing.T, source string) []byte {
+	t.Helper()
+	streams := vbaProjectStreams("Macros/VBA", "Module1", source)
+	streams["WordDocument"] = []byte("document text")
+	streams["ObjectPool/_1234/\x01Ole10Native"] = []byte("packaged payload")
+	return buildCFB(t, streams)
+}
+
+func TestDecompressVBA(t *testing.T) {
+	// Example from MS-OVBA 3.2
+	compressed := []byte{
+		0x01, 0x2f, 0xb0, 0x00, 0x23, 0x61, 0x61, 0x61, 0x62, 0x63, 0x64, 0x65, 0x82, 0x66, 0x00, 0x70,
+		0x61, 0x67, 0x68, 0x69, 0x6a, 0x01, 0x38, 0x08, 0x61, 0x6b, 0x6c, 0x00, 0x30, 0x6d, 0x6e, 0x6f,
+		0x70, 0x06, 0x71, 0x02, 0x70, 0x04, 0x10, 0x72, 0x73, 0x74, 0x75, 0x76, 0x10, 0x77, 0x78, 0x79,
+		0x7a, 0x00, 0x3c,
+	}
+	got, err := decompressVBA(compressed, 1<<20)
+	if want := "#aaabcdefaaaaghijaaaaaklaaamnopqaaaaaaaaaaaarstuvwxyzaaa"; err != nil || string(got) != want {
+		t.Errorf("decompressVBA() = %q, %v; want %q", got, err, want)
+	}
+
+	long := bytes.Repeat([]byte("Sub AutoOpen()\r\n"), 600) // Several chunks
+	if got, err := decompressVBA(compressVBALiteral(long), 1<<20); err != nil || !bytes.Equal(got, long) {
+		t.Errorf("decompressVBA() of literal chunks = %d bytes, %v", len(got), err)
+	}
+	if _, err := decompressVBA(compressVBALiteral(long), 1000); err == nil {
+		t.Error("decompressVBA() should enforce the size limit")
+	}
+
+	for _, invalid := range [][]byte{nil, {0x02, 0x00}, {0x01, 0x02, 0xb0, 0x01, 0x05, 0x00}} {
+		if _, err := decompressVBA(invalid, 1<<20); err == nil {
+			t.Errorf("decompressVBA(%x) should fail", invalid)
+		}
+	}
+}
+
+func TestInspectDocumentsOLE(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "report.doc"), testDocument(t, "Sub AutoOpen()\r\nShell \"calc\"\r\nEnd Sub\r\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "plain.doc"), buildCFB(t, map[string][]byte{"WordDocument": []byte("text")}), 0644)
+	writeTestFile(t, filepath.Join(dir, "notes.txt"), "no documents here")
+
+	s := NewScanner(&Config{MaxFileCount: 100, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20})
+	indicators, extracted := s.inspectDocuments(dir, nil)
+
+	want := []Indicator{
+		{File: "report.doc", Type: indicatorMacros, Detail: "Module1"},
+		{File: "report.doc", Type: indicatorOLEObject, Detail: "ObjectPool/_1234"},
+	}
+	if len(indicators) != len(want) {
+		t.Fatalf("indicators = %+v, want %+v", indicators, want)
+	}
+	for _, w := range want {
+		found := false
+		for _, got := range indicators {
+			found = found || got == w
+		}
+		if !found {
+			t.Errorf("indicators = %+v, missing %+v", indicators, w)
+		}
+	}
+
+	if extracted != 2 {
+		t.Errorf("extracted = %d, want 2", extracted)
+	}
+	files := readTree(t, dir)
+	if got := files["report.doc.macros/Module1.vba"]; got != "Sub AutoOpen()\r\nShell \"calc\"\r\nEnd Sub\r\n" {
+		t.Errorf("macro source = %q", got)
+	}
+	if got := files["report.doc.objects/ObjectPool/_1234/Ole10Native"]; got != "packaged payload" {
+		t.Errorf("object = %q", got)
+	}
+}
+
+func TestInspectDocumentsOOXML(t *testing.T) {
+	vbaProject := buildCFB(t, vbaProjectStreams("VBA", "ThisDocument", "Sub Document_Open()\r\nEnd Sub\r\n"))
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string][]byte{
+		"[Content_Types].xml":             []byte("<Types/>"),
+		"word/document.xml":               []byte("<w:document/>"),
+		"word/vbaProject.bin":             vbaProject,
+		"word/embeddings/oleObject1.bin":  []byte("object"),
+		"word/activeX/activeX1.bin":       []byte("control"),
+		"word/activeX/activeX1.xml":       []byte("<ax/>"),
+		"word/media/embeddings/image.png": nil,
+	} {
+		w, _ := zw.Create(name)
+		w.Write(content)
+	}
+	zw.Close()
+
+	// A document inside an archive is still packed when inspected
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "docs"), 0755)
+	os.WriteFile(filepath.Join(dir, "docs", "invoice.docm"), buf.Bytes(), 0644)
+
+	s := NewScanner(&Config{MaxFileCount: 100, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20})
+	indicators, _ := s.inspectDocuments(dir, nil)
+
+	got := make(map[string]string)
+	for _, indicator := range indicators {
+		if indicator.File != "docs/invoice.docm" {
+			t.Errorf("indicator %+v not attributed to the document", indicator)
+		}
+		got[indicator.Type] += indicator.Detail
+	}
+	want := map[string]string{
+		indicatorMacros:    "ThisDocument",
+		indicatorOLEObject: "word/embeddings/oleObject1.bin",
+		indicatorActiveX:   "word/activeX/activeX1.bin",
+	}
+	if len(got) != len(want) {
+		t.Errorf("indicators = %+v", indicators)
+	}
+	for typ, detail := range want {
+		if got[typ] != detail {
+			t.Errorf("%s detail = %q, want %q", typ, got[typ], detail)
+		}
+	}
+
+	files := readTree(t, dir)
+	if files["docs/invoice.docm.objects/word/vbaProject.bin.macros/ThisDocument.vba"] != "Sub Document_Open()\r\nEnd Sub\r\n" {
+		t.Errorf("files = %v, want the extracted macro source", len(files))
+	}
+}
+
+func TestInspectDocumentsLimits(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "report.doc"), testDocument(t, "Sub AutoOpen()\r\nEnd Sub\r\n"), 0644)
+
+	// Nothing may be extracted, but the indicators are still reported
+	s := NewScanner(&Config{MaxFileCount: 100, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 10})
+	indicators, extracted := s.inspectDocuments(dir, nil)
+	if len(indicators) != 2 || extracted != 0 {
+		t.Errorf("indicators = %+v, extracted = %d", indicators, extracted)
+	}
+	if files := readTree(t, dir); len(files) != 1 {
+		t.Errorf("files = %d, want only the document", len(files))
+	}
+}
+
+func TestScanHandlerDocumentIndicators(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.DocumentIndicators = true
+
+	// The signature is split by a flag byte in the compressed stream, so it
+	// is only found in the extracted source
+	document := testDocument(t, "Sub X(EICAR)\r\nEnd Sub\r\n")
+	if bytes.Contains(document, []byte("EICAR")) {
+		t.Fatal("test document should not contain the signature verbatim")
+	}
+
+	body, contentType := multipartUpload(t, "report.doc", document)
+	req := httptest.NewRequest(http.MethodPost, "/scan", body)
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+
+	handleScan(recorder, req, cfg, NewScanner(cfg))
+
+	var response ScanResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if len(response.Indicators) != 2 || response.Indicators[0].File != "file" {
+		t.Errorf("indicators = %+v", response.Indicators)
+	}
+	if len(response.Threats) != 1 || response.Threats[0].File != "file.macros/Module1.vba" {
+		t.Errorf("threats = %+v, want one in the macro source", response.Threats)
+	}
+	if response.ScannedFiles != 3 {
+		t.Errorf("scanned files = %d, want 3", response.ScannedFiles)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PathScanRequest is the body of POST /scan/path
+type PathScanRequest struct {
+	Path string `json:"path"` // Directory below one of SCAN_PATH_ROOTS
+}
+
+// errTooManyFiles is returned when a directory holds more files than
+// MAX_FILE_COUNT
+var errTooManyFiles = errors.New("too many files")
+
+// pathScanHandler handles POST /scan/path. The directory is scanned in
+// place: unlike uploads, nothing is copied, and clamd must be able to read
+// the files.
+func pathScanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	startTime := time.Now()
+	if rejectWhileStarting(w, r, startTime) {
+		return
+	}
+
+	var request PathScanRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		sendErrorStatus(w, http.StatusBadRequest, "Invalid path scan request")
+		return
+	}
+
+	response, reqErr := scanPath(r.Context(), r, config, scanner, request.Path, startTime)
+	if reqErr != nil {
+		sendRequestError(w, reqErr)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if response.Status == "timeout" {
+		w.WriteHeader(http.StatusGatewayTimeout)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// scanPath scans a directory below the allowed roots and records the
+// outcome like an upload scan. Threat files are relative to the directory.
+func scanPath(ctx context.Context, r *http.Request, config *Config, scanner *Scanner, path string, startTime time.Time) (*ScanResponse, *requestError) {
+	dir, reqErr := resolveScanPath(config.ScanPathRoots, path)
+	var fileCount int
+	if reqErr == nil {
+		fileCount, reqErr = checkScanDir(dir, config.MaxFileCount)
+	}
+	if reqErr != nil {
+		recordScan(scanTags(r), "rejected", time.Since(startTime), 0, nil)
+		return nil, reqErr
+	}
+
+	target := &uploadedFile{path: dir, filename: dir, safeFilename: sanitizeFilename(dir)}
+	result, err := runPooled(ctx, func(ctx context.Context) (*ScanResult, error) {
+		return scanner.ScanDirectory(ctx, dir, fileCount)
+	})
+	var timeout *scanTimeoutError
+	switch {
+	case errors.As(err, &timeout):
+		return timedOut(r, target, timeout, startTime), nil
+	case errors.Is(err, errQueueFull):
+		log.Printf("Scan queue full, rejecting %s", target.safeFilename)
+		recordScan(scanTags(r), "rejected", time.Since(startTime), 0, nil)
+		return nil, &requestError{status: http.StatusServiceUnavailable, message: "Scanner busy, try again later", retryAfter: config.ScanQueueWait}
+	case errors.Is(err, errCircuitOpen):
+		log.Printf("clamd circuit open, rejecting %s", target.safeFilename)
+		recordScan(scanTags(r), "rejected", time.Since(startTime), 0, nil)
+		return nil, &requestError{status: http.StatusServiceUnavailable, message: "Scanner unavailable, try again later", retryAfter: config.ClamdBreakerCooldown}
+	case err != nil:
+		log.Printf("Path scan failed for %s: %v", target.safeFilename, err)
+		recordScan(scanTags(r), "error", time.Since(startTime), 0, nil)
+		indexScan(r, target, &ScanResponse{Status: "error", Error: "Scan operation failed", ScanTimeMs: time.Since(startTime).Milliseconds()})
+		return nil, &requestError{status: http.StatusInternalServerError, message: "Scan operation failed"}
+	}
+
+	status := cleanStatus(result.Skipped)
+	if len(result.Threats) > 0 {
+		status = "infected"
+	}
+	response := &ScanResponse{
+		Status:       status,
+		Threats:      result.Threats,
+		ScannedFiles: result.ScannedFiles,
+		ScanTimeMs:   time.Since(startTime).Milliseconds(),
+		Files:        result.Files,
+	}
+	response.setSummary(result)
+
+	log.Printf("Path scan completed: %s - %s (%d threats, %d files, %dms)",
+		target.safeFilename, status, len(result.Threats), result.ScannedFiles, response.ScanTimeMs)
+	recordScan(scanTags(r), status, time.Since(startTime), 0, result)
+	if status == "infected" {
+		reportDetection(r, target, result.Threats)
+	}
+	indexScan(r, target, response)
+	return response, nil
+}
+
+// resolveScanPath resolves a requested directory, following symlinks, and
+// checks that it lies below one of the roots both as given and as resolved,
+// so a symlink in the volume cannot point the scan elsewhere. Paths outside
+// the roots are rejected before they are looked up.
+func resolveScanPath(roots []string, path string) (string, *requestError) {
+	if !filepath.IsAbs(path) {
+		return "", &requestError{status: http.StatusBadRequest, message: "Path must be absolute"}
+	}
+	path = filepath.Clean(path)
+	if !underRoot(roots, path) {
+		return "", &requestError{status: http.StatusForbidden, message: "Path not allowed"}
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", &requestError{status: http.StatusNotFound, message: "Path not found"}
+	}
+	if err != nil {
+		log.Printf("Failed to resolve %s: %v", sanitizeFilename(path), err)
+		return "", &requestError{status: http.StatusForbidden, message: "Path not readable"}
+	}
+
+	var resolvedRoots []string
+	for _, root := range roots {
+		if root, err := filepath.EvalSymlinks(root); err == nil {
+			resolvedRoots = append(resolvedRoots, root)
+		}
+	}
+	if !underRoot(resolvedRoots, resolved) {
+		return "", &requestError{status: http.StatusForbidden, message: "Path not allowed"}
+	}
+	return resolved, nil
+}
+
+// underRoot reports whether path is one of the roots or lies below one
+func underRoot(roots []string, path string) bool {
+	for _, root := range roots {
+		rel, err := filepath.Rel(filepath.Clean(root), path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkScanDir checks that dir is a readable directory within the file
+// count limit, so a request is rejected before it waits for a worker.
+// Returns the number of files to scan.
+func checkScanDir(dir string, maxFiles int) (int, *requestError) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return 0, &requestError{status: http.StatusForbidden, message: "Path not readable"}
+	}
+	if !info.IsDir() {
+		return 0, &requestError{status: http.StatusBadRequest, message: "Path is not a directory"}
+	}
+
+	count, err := countFiles(dir, maxFiles)
+	switch {
+	case errors.Is(err, errTooManyFiles):
+		return 0, &requestError{status: http.StatusRequestEntityTooLarge, message: fmt.Sprintf("Directory exceeds %d files", maxFiles)}
+	case err != nil:
+		log.Printf("Failed to list %s: %v", sanitizeFilename(dir), err)
+		return 0, &requestError{status: http.StatusForbidden, message: "Path not readable"}
+	}
+	return count, nil
+}
+
+// countFiles counts the regular files below dir, the ones clamd scans.
+// Symlinks are not followed.
+func countFiles(dir string, maxFiles int) (int, error) {
+	count := 0
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			if count++; count > maxFiles {
+				return errTooManyFiles
+			}
+		}
+		return nil
+	})
+	return count, err
+}
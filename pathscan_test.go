@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// usePathScanner sets the global config and scanner for /scan/path with
+// the fake clamd, allowing scans below root
+func usePathScanner(t *testing.T, root string) *Config {
+	t.Helper()
+	cfg := useFakeClamdScanner(t)
+	cfg.ScanPathRoots = []string{root}
+
+	oldConfig, oldScanner := config, scanner
+	config, scanner = cfg, NewScanner(cfg)
+	t.Cleanup(func() { config, scanner = oldConfig, oldScanner })
+	return cfg
+}
+
+func postPathScan(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/scan/path", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	pathScanHandler(recorder, req)
+	return recorder
+}
+
+func TestPathScanHandler(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "batch")
+	os.MkdirAll(filepath.Join(dir, "in"), 0755)
+	writeTestFile(t, filepath.Join(dir, "report.txt"), "quarterly report")
+	writeTestFile(t, filepath.Join(dir, "in", "payload.bin"), "EICAR test")
+	os.Chmod(filepath.Join(dir, "in", "payload.bin"), 0600)
+	usePathScanner(t, root)
+
+	recorder := postPathScan(t, `{"path": "`+dir+`"}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+	var response ScanResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if response.Status != "infected" || response.ScannedFiles != 2 {
+		t.Errorf("response = %+v", response)
+	}
+	if len(response.Threats) != 1 || response.Threats[0].File != filepath.Join("in", "payload.bin") {
+		t.Errorf("threats = %+v, want one relative to the directory", response.Threats)
+	}
+
+	// Files in the volume are scanned in place, not made world-readable
+	if info, _ := os.Stat(filepath.Join(dir, "in", "payload.bin")); info.Mode().Perm() != 0600 {
+		t.Errorf("file mode = %04o, want 0600", info.Mode().Perm())
+	}
+
+	// The root itself may be scanned
+	if recorder := postPathScan(t, `{"path": "`+root+`"}`); recorder.Code != http.StatusOK {
+		t.Errorf("root scan status = %d", recorder.Code)
+	}
+}
+
+func TestPathScanHandlerErrors(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "volume")
+	os.Mkdir(root, 0755)
+	os.Mkdir(filepath.Join(base, "secret"), 0755)
+	writeTestFile(t, filepath.Join(root, "file.txt"), "text")
+	writeTestFile(t, filepath.Join(base, "secret", "key"), "outside the root")
+	os.Symlink(filepath.Join(base, "secret"), filepath.Join(root, "escape"))
+	cfg := usePathScanner(t, root)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"invalid body", `{"path": 1}`, http.StatusBadRequest},
+		{"unknown field", `{"path": "` + root + `", "recursive": false}`, http.StatusBadRequest},
+		{"relative", `{"path": "volume"}`, http.StatusBadRequest},
+		{"outside", `{"path": "` + filepath.Join(base, "secret") + `"}`, http.StatusForbidden},
+		{"dot-dot", `{"path": "` + root + `/../secret"}`, http.StatusForbidden},
+		{"sibling prefix", `{"path": "` + root + `2"}`, http.StatusForbidden},
+		{"symlink escape", `{"path": "` + filepath.Join(root, "escape") + `"}`, http.StatusForbidden},
+		{"missing", `{"path": "` + filepath.Join(root, "missing") + `"}`, http.StatusNotFound},
+		{"file", `{"path": "` + filepath.Join(root, "file.txt") + `"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if recorder := postPathScan(t, tt.body); recorder.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d (%s)", tt.name, recorder.Code, tt.want, recorder.Body)
+		}
+	}
+
+	cfg.MaxFileCount = 1
+	writeTestFile(t, filepath.Join(root, "more.txt"), "text")
+	if recorder := postPathScan(t, `{"path": "`+root+`"}`); recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("file count limit: status = %d", recorder.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/scan/path", nil)
+	recorder := httptest.NewRecorder()
+	pathScanHandler(recorder, req)
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d", recorder.Code)
+	}
+}
+
+func TestCountFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	writeTestFile(t, filepath.Join(dir, "a"), "a")
+	writeTestFile(t, filepath.Join(dir, "sub", "b"), "b")
+	os.Symlink(filepath.Join(dir, "a"), filepath.Join(dir, "link"))
+
+	if count, err := countFiles(dir, 10); err != nil || count != 2 {
+		t.Errorf("countFiles() = %d, %v; want 2 (symlinks skipped)", count, err)
+	}
+	if _, err := countFiles(dir, 1); err != errTooManyFiles {
+		t.Errorf("countFiles() error = %v, want errTooManyFiles", err)
+	}
+}
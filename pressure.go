@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Shedding under system pressure turns scans away with 503 before the node
+// is overwhelmed, while there is still headroom to answer health checks and
+// finish the scans already running. Callers with the priority scope are
+// still served.
+
+// pressureLimits are the system pressure thresholds (0 = unchecked)
+type pressureLimits struct {
+	loadPerCPU   float64 // 1-minute load average per CPU
+	minAvailable int64   // Available system memory (bytes)
+	goroutines   int
+	queueDepth   int // Scans waiting for a worker
+
+	// Sources, replaced in tests
+	loadAverage  func() (float64, error)
+	memAvailable func() (int64, error)
+	numCPU       func() int
+	numGoroutine func() int
+	queued       func() int
+}
+
+// newPressureLimits reads the SHED_* pressure thresholds from the config
+func newPressureLimits(config *Config) pressureLimits {
+	return pressureLimits{
+		loadPerCPU:   config.ShedLoadPerCPU,
+		minAvailable: config.ShedMinAvailable,
+		goroutines:   config.ShedGoroutines,
+		queueDepth:   config.ShedQueueDepth,
+		loadAverage:  readLoadAverage,
+		memAvailable: readMemAvailable,
+		numCPU:       runtime.NumCPU,
+		numGoroutine: runtime.NumGoroutine,
+		queued:       queueDepth,
+	}
+}
+
+// queueDepth returns the scans waiting for a worker (0 without workers)
+func queueDepth() int {
+	if scanPool == nil {
+		return 0
+	}
+	return scanPool.QueueDepth()
+}
+
+// enabled reports whether any threshold is set
+func (l *pressureLimits) enabled() bool {
+	return l.loadPerCPU > 0 || l.minAvailable > 0 || l.goroutines > 0 || l.queueDepth > 0
+}
+
+// check returns the first threshold exceeded: "load", "memory",
+// "goroutines", "queue" or "". Readings that fail (e.g. outside Linux) are
+// ignored.
+func (l *pressureLimits) check() string {
+	if l.loadPerCPU > 0 {
+		if load, err := l.loadAverage(); err == nil && load/float64(l.numCPU()) > l.loadPerCPU {
+			return "load"
+		}
+	}
+	if l.minAvailable > 0 {
+		if available, err := l.memAvailable(); err == nil && available < l.minAvailable {
+			return "memory"
+		}
+	}
+	if l.goroutines > 0 && l.numGoroutine() > l.goroutines {
+		return "goroutines"
+	}
+	if l.queueDepth > 0 && l.queued() > l.queueDepth {
+		return "queue"
+	}
+	return ""
+}
+
+// setPressure records the pressure reason from the latest sample, logging
+// when shedding starts and stops
+func (s *LoadShedder) setPressure(reason string) {
+	previous, _ := s.pressured.Swap(reason).(string)
+	if reason == previous {
+		return
+	}
+	switch {
+	case previous == "":
+		log.Printf("Shedding scans under system pressure (%s)", reason)
+		metrics.Gauge("load_shed.active", 1)
+	case reason == "":
+		log.Printf("System pressure relieved, no longer shedding scans")
+		metrics.Gauge("load_shed.active", 0)
+	default:
+		log.Printf("Shedding scans under system pressure (%s)", reason)
+	}
+}
+
+// underPressure returns the system pressure reason, or "" if there is none
+func (s *LoadShedder) underPressure() string {
+	reason, _ := s.pressured.Load().(string)
+	return reason
+}
+
+// readLoadAverage returns the 1-minute load average (Linux only)
+func readLoadAverage() (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// readMemAvailable returns the memory available to new work without
+// swapping, system-wide (Linux only)
+func readMemAvailable() (int64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || name != "MemAvailable" {
+			continue
+		}
+		kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb << 10, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, strconv.ErrSyntax
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestPressureLimitsCheck(t *testing.T) {
+	limits := pressureLimits{
+		loadPerCPU:   2,
+		minAvailable: 100 << 20,
+		goroutines:   1000,
+		queueDepth:   10,
+		numCPU:       func() int { return 4 },
+	}
+	load, available, goroutines, queued := 1.0, int64(1<<30), 10, 0
+	limits.loadAverage = func() (float64, error) { return load, nil }
+	limits.memAvailable = func() (int64, error) { return available, nil }
+	limits.numGoroutine = func() int { return goroutines }
+	limits.queued = func() int { return queued }
+
+	if reason := limits.check(); reason != "" {
+		t.Errorf("check() below thresholds = %q", reason)
+	}
+	load = 9
+	if reason := limits.check(); reason != "load" {
+		t.Errorf("check() with load 9 on 4 CPUs = %q, want load", reason)
+	}
+	load, available = 1, 50<<20
+	if reason := limits.check(); reason != "memory" {
+		t.Errorf("check() with 50 MB available = %q, want memory", reason)
+	}
+	available, goroutines = 1<<30, 5000
+	if reason := limits.check(); reason != "goroutines" {
+		t.Errorf("check() with 5000 goroutines = %q, want goroutines", reason)
+	}
+	goroutines, queued = 10, 11
+	if reason := limits.check(); reason != "queue" {
+		t.Errorf("check() with 11 queued = %q, want queue", reason)
+	}
+
+	// Failed readings don't count as pressure
+	queued = 0
+	limits.loadAverage = func() (float64, error) { return 0, errors.New("no /proc") }
+	limits.memAvailable = func() (int64, error) { return 0, errors.New("no /proc") }
+	if reason := limits.check(); reason != "" {
+		t.Errorf("check() with failed readings = %q", reason)
+	}
+}
+
+func TestShedLoadUnderPressure(t *testing.T) {
+	shedder := &LoadShedder{}
+	handler := shedLoad(shedder, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(identity *Identity) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+		if identity != nil {
+			req = req.WithContext(context.WithValue(req.Context(), identityKey{}, identity))
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	if recorder := serve(nil); recorder.Code != http.StatusOK {
+		t.Errorf("without pressure: status %d, want 200", recorder.Code)
+	}
+
+	shedder.setPressure("queue")
+	recorder := serve(&Identity{Name: "batch"})
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") != "5" {
+		t.Errorf("under pressure: status %d, Retry-After %q; want 503, 5", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	if recorder := serve(&Identity{Name: "ci", Scopes: []string{priorityScope}}); recorder.Code != http.StatusOK {
+		t.Errorf("priority caller under pressure: status %d, want 200", recorder.Code)
+	}
+
+	shedder.setPressure("")
+	if recorder := serve(nil); recorder.Code != http.StatusOK {
+		t.Errorf("after pressure relieved: status %d, want 200", recorder.Code)
+	}
+
+	if s := NewLoadShedder(&Config{ShedGoroutines: 5000}); s == nil || s.maxRSS != 0 || s.pressure.goroutines != 5000 {
+		t.Errorf("NewLoadShedder() = %+v, want goroutine threshold only", s)
+	}
+}
+
+func TestReadLoadAverage(t *testing.T) {
+	if _, err := os.Stat("/proc/loadavg"); err != nil {
+		t.Skip("no /proc on this platform")
+	}
+	if load, err := readLoadAverage(); err != nil || load < 0 {
+		t.Errorf("readLoadAverage() = %v, %v", load, err)
+	}
+	if available, err := readMemAvailable(); err != nil || available <= 0 {
+		t.Errorf("readMemAvailable() = %d, %v", available, err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Reverse proxies whose X-Forwarded-For / X-Real-IP headers are trusted (nil = none)
+var trustedProxies []*net.IPNet
+
+// parseNetworks parses a list of IP addresses and CIDR ranges
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		network, err := parseNetwork(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// parseNetwork parses a CIDR range or a single IP address
+func parseNetwork(entry string) (*net.IPNet, error) {
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", entry)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// inNetworks reports whether ip is in any of the networks
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client. Requests from trusted
+// proxies are attributed to the address they forwarded for: the last
+// X-Forwarded-For entry that isn't itself a trusted proxy, or X-Real-IP.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	if trustedProxies == nil || !inNetworks(net.ParseIP(host), trustedProxies) {
+		return host
+	}
+
+	// Each proxy appends the address it received from; walk back from the
+	// nearest one. Entries left of an untrusted or malformed hop can't be
+	// trusted.
+	if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		forwarded := strings.Split(strings.Join(values, ","), ",")
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+			if ip == nil {
+				break
+			}
+			host = ip.String()
+			if !inNetworks(ip, trustedProxies) {
+				break
+			}
+		}
+		return host
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return host
+}
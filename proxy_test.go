@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// useTrustedProxies sets the trusted proxies for a test
+func useTrustedProxies(t *testing.T, entries ...string) {
+	t.Helper()
+	networks, err := parseNetworks(entries)
+	if err != nil {
+		t.Fatalf("parseNetworks() error = %v", err)
+	}
+	trustedProxies = networks
+	t.Cleanup(func() { trustedProxies = nil })
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := parseNetworks([]string{"10.0.0.0/8", "192.0.2.7", "fd00::1"})
+	if err != nil {
+		t.Fatalf("parseNetworks() error = %v", err)
+	}
+	if len(networks) != 3 || networks[1].String() != "192.0.2.7/32" || networks[2].String() != "fd00::1/128" {
+		t.Errorf("networks = %v", networks)
+	}
+
+	for _, entry := range []string{"10.0.0.0/33", "proxy.internal"} {
+		if _, err := parseNetworks([]string{entry}); err == nil {
+			t.Errorf("parseNetworks(%q) succeeded", entry)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"192.0.2.1:1234", "192.0.2.1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"@", "@"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		req.Header.Set("X-Forwarded-For", "198.51.100.9")
+		if got := clientIP(req); got != tt.want {
+			t.Errorf("clientIP(%q) = %q, want %q (no trusted proxies)", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
+
+func TestClientIPTrustedProxies(t *testing.T) {
+	useTrustedProxies(t, "10.0.0.0/8")
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		realIP       string
+		want         string
+	}{
+		{"untrusted peer", "192.0.2.1:1234", []string{"198.51.100.9"}, "", "192.0.2.1"},
+		{"single proxy", "10.0.0.5:1234", []string{"198.51.100.9"}, "", "198.51.100.9"},
+		{"proxy chain", "10.0.0.5:1234", []string{"198.51.100.9, 10.1.1.1"}, "", "198.51.100.9"},
+		{"multiple headers", "10.0.0.5:1234", []string{"198.51.100.9", "10.1.1.1"}, "", "198.51.100.9"},
+		{"spoofed entry", "10.0.0.5:1234", []string{"203.0.113.66, 198.51.100.9"}, "", "198.51.100.9"},
+		{"malformed entry", "10.0.0.5:1234", []string{"unknown, 10.1.1.1"}, "", "10.1.1.1"},
+		{"real ip", "10.0.0.5:1234", nil, "198.51.100.9", "198.51.100.9"},
+		{"no headers", "10.0.0.5:1234", nil, "", "10.0.0.5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := clientIP(req); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
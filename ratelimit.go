@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often idle buckets are removed
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket holds the tokens available to one client
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a token-bucket limiter keyed by client.
+// Each client gets burst tokens that refill at rate per second.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates a limiter allowing rate requests per second with
+// the given burst. Returns nil when rate is not positive (disabled).
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token for the key. If none is available it returns false
+// and the time until the next token.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.bucket(key)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, l.wait(b)
+}
+
+// Wait returns the time until the key has a token, without taking one
+// (0 = one is available)
+func (l *RateLimiter) Wait(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b := l.bucket(key); b.tokens < 1 {
+		return l.wait(b)
+	}
+	return 0
+}
+
+// bucket returns the key's bucket, refilled up to now. Caller holds l.mu.
+func (l *RateLimiter) bucket(key string) *tokenBucket {
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+// wait returns the time until b has a token
+func (l *RateLimiter) wait(b *tokenBucket) time.Duration {
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep drops buckets that have refilled completely, since they are
+// indistinguishable from new ones. Caller holds l.mu.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitKey identifies the client: the authenticated identity, or the
+// client IP for anonymous requests
+func rateLimitKey(r *http.Request) string {
+	if identity := identityFromContext(r.Context()); identity != nil && identity.Method != AuthMethodNone {
+		return identity.Key()
+	}
+	return "ip:" + clientIP(r)
+}
+
+// limitRate rejects requests over the client's rate with 429 Too Many
+// Requests and a Retry-After header. Must run after requireAuth, whose
+// failures are limited by limitAuthFailures. A nil limiter disables rate
+// limiting.
+func limitRate(limiter *RateLimiter, next http.Handler) http.Handler {
+	if limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, wait := limiter.Allow(rateLimitKey(r))
+		if !allowed {
+			sendRateLimited(w, r, wait, "Rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sendRateLimited responds 429 Too Many Requests, with a Retry-After header
+// for wait
+func sendRateLimited(w http.ResponseWriter, r *http.Request, wait time.Duration, message string) {
+	metrics.Count("rate_limited", 1, "route:"+r.URL.Path)
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	sendErrorStatus(w, http.StatusTooManyRequests, message)
+}
+
+// authRateLimitedError is returned for a client IP whose failed
+// authentication attempts used up its rate limit
+type authRateLimitedError struct {
+	wait time.Duration
+}
+
+func (e *authRateLimitedError) Error() string {
+	return fmt.Sprintf("too many failed attempts, retry in %s", e.wait.Round(time.Second))
+}
+
+// authFailureLimiter counts failed authentication attempts against a
+// per-IP bucket of their own, and refuses to authenticate the IP while it is
+// used up, so credentials can't be guessed faster than the rate allows. The
+// bucket is separate from the one anonymous requests use, so an IP busy with
+// anonymous traffic (polling results, say) can still sign in.
+type authFailureLimiter struct {
+	next    Authenticator
+	limiter *RateLimiter
+}
+
+// limitAuthFailures applies limiter to the failed attempts of auth. A nil
+// limiter disables it.
+func limitAuthFailures(limiter *RateLimiter, auth Authenticator) Authenticator {
+	if limiter == nil {
+		return auth
+	}
+	return &authFailureLimiter{next: auth, limiter: limiter}
+}
+
+func (a *authFailureLimiter) Authenticate(r *http.Request) (*Identity, error) {
+	key := "authfail:" + clientIP(r)
+	if wait := a.limiter.Wait(key); wait > 0 {
+		return nil, &authRateLimitedError{wait: wait}
+	}
+	identity, err := a.next.Authenticate(r)
+	if err != nil {
+		a.limiter.Allow(key)
+	}
+	return identity, err
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestRateLimiter returns a limiter driven by a manual clock
+func newTestRateLimiter(rate float64, burst int) (*RateLimiter, *time.Time) {
+	l := NewRateLimiter(rate, burst)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestNewRateLimiterDisabled(t *testing.T) {
+	if l := NewRateLimiter(0, 10); l != nil {
+		t.Error("expected nil limiter for zero rate")
+	}
+}
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	l, now := newTestRateLimiter(2, 3)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d within burst was limited", i+1)
+		}
+	}
+
+	ok, wait := l.Allow("a")
+	if ok {
+		t.Fatal("request beyond burst should be limited")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wait = %v, want 500ms at 2 req/s", wait)
+	}
+
+	// Other clients have their own bucket
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("separate key should not be limited")
+	}
+
+	*now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("request after refill should be allowed")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	l, now := newTestRateLimiter(1, 2)
+
+	l.Allow("idle")
+	*now = now.Add(2 * rateLimitSweepInterval)
+	l.Allow("active")
+
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("refilled idle bucket should be swept")
+	}
+	if _, ok := l.buckets["active"]; !ok {
+		t.Error("active bucket should remain")
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	req := httptest.NewRequest("POST", "/scan", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	withIdentity := func(identity *Identity) *http.Request {
+		return req.WithContext(context.WithValue(req.Context(), identityKey{}, identity))
+	}
+
+	if got := rateLimitKey(req); got != "ip:192.0.2.1" {
+		t.Errorf("no identity: key = %q", got)
+	}
+	if got := rateLimitKey(withIdentity(&Identity{Name: "anonymous", Method: AuthMethodNone})); got != "ip:192.0.2.1" {
+		t.Errorf("anonymous: key = %q", got)
+	}
+	if got := rateLimitKey(withIdentity(&Identity{Name: "ci", Method: AuthMethodAPIKey})); got != AuthMethodAPIKey+":ci" {
+		t.Errorf("API key: key = %q", got)
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+	l, _ := newTestRateLimiter(0.5, 1)
+	handler := limitRate(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest("POST", "/scan", nil)
+
+	first := httptest.NewRecorder()
+	handler.ServeHTTP(first, req)
+	if first.Code != http.StatusOK {
+		t.Fatalf("first request status = %d, want 200", first.Code)
+	}
+
+	second := httptest.NewRecorder()
+	handler.ServeHTTP(second, req)
+	if second.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request status = %d, want 429", second.Code)
+	}
+	if got := second.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+}
+
+func TestLimitRateDisabled(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	if h := limitRate(nil, next); h == nil {
+		t.Error("nil limiter should return the next handler")
+	}
+}
+
+func TestLimitAuthFailures(t *testing.T) {
+	l, clock := newTestRateLimiter(0.5, 2)
+	auth := limitAuthFailures(l, &APIKeyAuthenticator{keys: map[string]string{"key-123": "ci"}})
+	handler := requireAuth(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/scan", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		if key != "" {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// Successful attempts don't count
+	for i := 0; i < 3; i++ {
+		if code := request("key-123").Code; code != http.StatusOK {
+			t.Fatalf("valid request %d status = %d, want 200", i, code)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if code := request("wrong").Code; code != http.StatusUnauthorized {
+			t.Fatalf("failed attempt %d status = %d, want 401", i, code)
+		}
+	}
+
+	// The IP is limited, valid key or not
+	for _, key := range []string{"wrong", "key-123"} {
+		recorder := request(key)
+		if recorder.Code != http.StatusTooManyRequests {
+			t.Errorf("key %q after failures: status = %d, want 429", key, recorder.Code)
+		}
+		if got := recorder.Header().Get("Retry-After"); got != "2" {
+			t.Errorf("Retry-After = %q, want 2", got)
+		}
+	}
+
+	*clock = clock.Add(2 * time.Second)
+	if code := request("key-123").Code; code != http.StatusOK {
+		t.Errorf("after refill: status = %d, want 200", code)
+	}
+
+	// Anonymous requests from the IP use their own bucket, so exhausting it
+	// doesn't lock out a valid credential
+	polling := limitRate(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; ; i++ {
+		req := httptest.NewRequest("GET", "/scan/results/abc", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		recorder := httptest.NewRecorder()
+		polling.ServeHTTP(recorder, req)
+		if recorder.Code == http.StatusTooManyRequests {
+			break
+		}
+		if i > 10 {
+			t.Fatal("anonymous requests never rate limited")
+		}
+	}
+	if code := request("key-123").Code; code != http.StatusOK {
+		t.Errorf("valid key after anonymous requests: status = %d, want 200", code)
+	}
+
+	if limitAuthFailures(nil, auth) != auth {
+		t.Error("nil limiter should return the authenticator")
+	}
+}
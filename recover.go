@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+)
+
+// requestIDHeader carries the request ID in both directions
+const requestIDHeader = "X-Request-ID"
+
+// Incoming request IDs are kept if they are short and safe to log
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// panicResponse is the 500 error sent for a handler panic
+type panicResponse struct {
+	ScanResponse
+	RequestID string `json:"request_id"`
+}
+
+// responseTracker notes whether anything was sent to the client yet
+type responseTracker struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (t *responseTracker) WriteHeader(code int) {
+	// Informational responses (100 Continue, 103 Early Hints) don't commit
+	// the final status
+	if code >= 200 {
+		t.wrote = true
+	}
+	t.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter
+func (t *responseTracker) Write(p []byte) (int, error) {
+	t.wrote = true
+	return t.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (t *responseTracker) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// recoverPanics answers a handler panic with a 500 JSON error naming the
+// request ID and logs the stack, instead of dropping the connection. Every
+// response carries the request ID in X-Request-ID: the client's own, if it
+// sent a usable one, or a random one. A panic after the response started
+// can't be reported; the connection is aborted so the client doesn't take
+// the truncated response for a complete one.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = randomID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		tracker := &responseTracker{ResponseWriter: w}
+
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			log.Printf("Panic serving %s %s (request %s): %v\n%s", r.Method, sanitizeFilename(r.URL.Path), id, v, debug.Stack())
+			metrics.Count("http.panics", 1)
+			if tracker.wrote {
+				panic(http.ErrAbortHandler)
+			}
+
+			// Drop headers meant for the response that was not sent
+			header := w.Header()
+			for _, name := range []string{"Content-Length", "Content-Encoding", "Content-Disposition", "ETag", "Last-Modified"} {
+				header.Del(name)
+			}
+			header.Set("Content-Type", "application/json")
+			header.Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(panicResponse{
+				ScanResponse: ScanResponse{Status: "error", Error: "Internal server error"},
+				RequestID:    id,
+			})
+		}()
+		next.ServeHTTP(tracker, r)
+	})
+}
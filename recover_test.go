@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	handler := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", "attachment")
+		panic("boom")
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusInternalServerError)
+	}
+	if recorder.Header().Get("Content-Disposition") != "" {
+		t.Error("header of the unsent response kept")
+	}
+	var resp panicResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response is not JSON: %v", err)
+	}
+	id := recorder.Header().Get(requestIDHeader)
+	if resp.Status != "error" || resp.Error == "" || id == "" || resp.RequestID != id {
+		t.Errorf("response = %+v with %s %q", resp, requestIDHeader, id)
+	}
+}
+
+func TestRecoverPanicsAfterWrite(t *testing.T) {
+	handler := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		panic("boom")
+	}))
+
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", v)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+}
+
+func TestRequestID(t *testing.T) {
+	handler := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		sent string
+		kept bool
+	}{
+		{"", false},
+		{"abc-123_DEF.4", true},
+		{"has space", false},
+		{"line\nbreak", false},
+		{string(make([]byte, 65)), false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		if tt.sent != "" {
+			req.Header.Set(requestIDHeader, tt.sent)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		got := recorder.Header().Get(requestIDHeader)
+		if tt.kept && got != tt.sent || !tt.kept && (got == tt.sent || !requestIDPattern.MatchString(got)) {
+			t.Errorf("request ID for %q = %q", tt.sent, got)
+		}
+	}
+}
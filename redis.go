@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timeout for Redis commands when the context has no earlier deadline. A
+// slow cache must not hold up scans much.
+const redisTimeout = 2 * time.Second
+
+// Idle Redis connections kept for reuse
+const redisMaxIdle = 8
+
+// Largest bulk reply read; cached verdicts are far smaller
+const redisMaxBulk = 16 << 20
+
+// errRedisProtocol reports a reply that is not valid RESP
+var errRedisProtocol = errors.New("unexpected Redis reply")
+
+// redisError is an error reply from the server (-ERR ...)
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// RedisClient speaks just enough of the Redis protocol (RESP) to share
+// cached verdicts and job leases between replicas
+type RedisClient struct {
+	address  string
+	tls      *tls.Config // rediss:// (nil = plain TCP)
+	username string      // ACL user (empty = default user)
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+// redisConn is one Redis connection
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedisClient creates a client for a redis:// or rediss:// (TLS) URL,
+// e.g. redis://:password@cache:6379/2. Returns nil for an empty URL.
+// Connections are opened lazily.
+func NewRedisClient(rawURL string) (*RedisClient, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// The URL may hold a password; don't repeat it
+		return nil, errors.New("invalid Redis URL")
+	}
+
+	c := &RedisClient{address: u.Host, idle: make(chan *redisConn, redisMaxIdle)}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	default:
+		return nil, fmt.Errorf("unsupported Redis scheme %q (use redis or rediss)", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("invalid Redis URL: missing host")
+	}
+	if u.Port() == "" {
+		c.address = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil || c.db < 0 {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// Get returns the value of a key; ok is false if it does not exist
+func (c *RedisClient) Get(ctx context.Context, key string) (value []byte, ok bool, err error) {
+	reply, err := c.do(ctx, "GET", key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	value, ok = reply.([]byte)
+	if !ok {
+		return nil, false, errRedisProtocol
+	}
+	return value, true, nil
+}
+
+// SetEX stores a value that expires after ttl
+func (c *RedisClient) SetEX(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := c.do(ctx, "SET", key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+// SetNX stores a value that expires after ttl unless the key exists, and
+// reports whether it was stored
+func (c *RedisClient) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	reply, err := c.do(ctx, "SET", key, string(value), "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return reply != nil, err
+}
+
+// Eval runs a Lua script with keys and arguments and returns its reply
+func (c *RedisClient) Eval(ctx context.Context, script string, keys []string, args ...string) (any, error) {
+	command := append([]string{"EVAL", script, strconv.Itoa(len(keys))}, keys...)
+	return c.do(ctx, append(command, args...)...)
+}
+
+// HSet sets a field of a hash
+func (c *RedisClient) HSet(ctx context.Context, key, field string, value []byte) error {
+	_, err := c.do(ctx, "HSET", key, field, string(value))
+	return err
+}
+
+// HGetAll returns the fields of a hash
+func (c *RedisClient) HGetAll(ctx context.Context, key string) (map[string][]byte, error) {
+	reply, err := c.do(ctx, "HGETALL", key)
+	if err != nil {
+		return nil, err
+	}
+	items, _ := reply.([]any)
+	fields := make(map[string][]byte, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		field, ok1 := items[i].([]byte)
+		value, ok2 := items[i+1].([]byte)
+		if !ok1 || !ok2 {
+			return nil, errRedisProtocol
+		}
+		fields[string(field)] = value
+	}
+	return fields, nil
+}
+
+// HDel removes fields of a hash
+func (c *RedisClient) HDel(ctx context.Context, key string, fields ...string) error {
+	_, err := c.do(ctx, append([]string{"HDEL", key}, fields...)...)
+	return err
+}
+
+// do sends a command on a pooled connection and returns its reply: nil,
+// a string, an int64, []byte or []any. A command that fails on an idle
+// connection (closed by the server's timeout) is sent once more on a new one.
+func (c *RedisClient) do(ctx context.Context, args ...string) (any, error) {
+	select {
+	case conn := <-c.idle:
+		reply, err := conn.do(ctx, args...)
+		if c.put(conn, err) {
+			return reply, err
+		}
+	default:
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(ctx, args...)
+	c.put(conn, err)
+	return reply, err
+}
+
+// dial opens a connection, authenticating and selecting the database
+func (c *RedisClient) dial(ctx context.Context) (*redisConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	dialer := &net.Dialer{}
+	raw, err := dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, err
+	}
+	if c.tls != nil {
+		tlsConn := tls.Client(raw, c.tls)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			raw.Close()
+			return nil, err
+		}
+		raw = tlsConn
+	}
+
+	conn := &redisConn{conn: raw, reader: bufio.NewReader(raw)}
+	if c.password != "" {
+		args := []string{"AUTH", c.password}
+		if c.username != "" {
+			args = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := conn.do(ctx, args...); err != nil {
+			raw.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.do(ctx, "SELECT", strconv.Itoa(c.db)); err != nil {
+			raw.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// put returns a connection to the pool and reports whether it is still
+// usable. Connections that failed other than with an error reply, and
+// those over redisMaxIdle, are closed.
+func (c *RedisClient) put(conn *redisConn, err error) bool {
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		conn.conn.Close()
+		return false
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+	return true
+}
+
+// do writes a command and reads its reply
+func (c *redisConn) do(ctx context.Context, args ...string) (any, error) {
+	deadline := time.Now().Add(redisTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.reader)
+}
+
+// readRedisReply reads one RESP reply
+func readRedisReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errRedisProtocol
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 || n > redisMaxBulk {
+			return nil, errRedisProtocol
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 || n > redisMaxBulk {
+			return nil, errRedisProtocol
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, errRedisProtocol
+}
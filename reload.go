@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reload polling: how often clamd is asked whether the reload is over, and
+// how long it must keep answering with unchanged signatures before the
+// reload counts as done (clamd picks up RELOAD within about a second)
+const (
+	reloadPollInterval = 500 * time.Millisecond
+	reloadSettle       = 5 * time.Second
+)
+
+// clamdReload holds scans while a signature reload started with
+// POST /admin/reload-db runs
+var clamdReload reloadGate
+
+// reloadGate marks a clamd signature reload in progress. Scans wait for it
+// before reaching clamd, and /readyz reports not ready meanwhile.
+type reloadGate struct {
+	mu   sync.Mutex
+	done chan struct{} // Closed when the reload ends (nil = none running)
+}
+
+// begin marks a reload as started. Returns false if one already runs.
+func (g *reloadGate) begin() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.done != nil {
+		return false
+	}
+	g.done = make(chan struct{})
+	return true
+}
+
+// end marks the reload as over and releases the waiting scans
+func (g *reloadGate) end() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	close(g.done)
+	g.done = nil
+}
+
+// active reports whether a reload is running
+func (g *reloadGate) active() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.done != nil
+}
+
+// wait blocks while a reload is running, or until ctx is done
+func (g *reloadGate) wait(ctx context.Context) {
+	g.mu.Lock()
+	done := g.done
+	g.mu.Unlock()
+	if done == nil {
+		return
+	}
+	start := time.Now()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	metrics.Timing("clamd.reload_wait", time.Since(start))
+}
+
+// ReloadResponse for POST /admin/reload-db
+type ReloadResponse struct {
+	Status            string `json:"status"`               // "reloaded" or "timeout"
+	DBVersionBefore   string `json:"db_version_before"`    // Signature version before the reload
+	DBVersion         string `json:"db_version,omitempty"` // Signature version after it
+	DBDate            string `json:"db_date,omitempty"`    // Build time of the loaded signatures
+	DurationMs        int64  `json:"duration_ms"`          // Time until clamd was done
+	SignaturesChanged bool   `json:"signatures_changed"`   // clamd loaded a different database
+	Error             string `json:"error,omitempty"`      // Why the reload was not confirmed
+}
+
+// parseVersionReply splits a VERSION reply ("ClamAV 1.0.0/26789/Mon Jan
+// 1 12:00:00 2024") into the signature version and date
+func parseVersionReply(reply string) (dbVersion, dbDate string) {
+	parts := strings.Split(reply, "/")
+	if len(parts) >= 2 {
+		dbVersion = parts[1]
+	}
+	if len(parts) >= 3 {
+		dbDate = strings.Join(strings.Fields(parts[2]), " ")
+	}
+	return dbVersion, dbDate
+}
+
+// reloadClamd sends RELOAD to clamd and waits until it is done: until it
+// reports a new signature version, or has answered with the old one for
+// reloadSettle. clamd blocks new commands while it reloads without
+// ConcurrentDatabaseReload, so an answer also means the reload is over.
+func reloadClamd(ctx context.Context, network, address string) (*ReloadResponse, error) {
+	before, err := clamdCommand(ctx, network, address, "VERSION")
+	if err != nil {
+		return nil, err
+	}
+	resp := &ReloadResponse{}
+	resp.DBVersionBefore, _ = parseVersionReply(before)
+
+	start := time.Now()
+	reply, err := clamdCommand(ctx, network, address, "RELOAD")
+	if err != nil {
+		return nil, err
+	}
+	if reply != "RELOADING" {
+		return nil, errors.New("unexpected RELOAD reply: " + reply)
+	}
+
+	var answeredSince time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			resp.Status, resp.Error = "timeout", "clamd did not finish reloading in time"
+			resp.DurationMs = time.Since(start).Milliseconds()
+			return resp, nil
+		case <-time.After(reloadPollInterval):
+		}
+
+		current, err := clamdCommand(ctx, network, address, "VERSION")
+		if err != nil {
+			answeredSince = time.Time{}
+			continue
+		}
+		if answeredSince.IsZero() {
+			answeredSince = time.Now()
+		}
+		if current != before || time.Since(answeredSince) >= reloadSettle {
+			resp.Status = "reloaded"
+			resp.DBVersion, resp.DBDate = parseVersionReply(current)
+			resp.SignaturesChanged = current != before
+			resp.DurationMs = time.Since(start).Milliseconds()
+			return resp, nil
+		}
+	}
+}
+
+// reloadHandler serves POST /admin/reload-db: it has clamd reload its
+// signatures while scans wait, instead of failing against a reloading clamd.
+// The instance reports not ready until clamd is done, or for at most
+// CLAMD_STARTUP_WAIT_SECONDS.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	network, address, err := clamdStatsTarget(config)
+	if err != nil {
+		log.Printf("Cannot locate clamd socket: %v", err)
+		sendErrorStatus(w, http.StatusServiceUnavailable, "clamd socket not configured")
+		return
+	}
+	if !clamdReload.begin() {
+		sendErrorStatus(w, http.StatusConflict, "A signature reload is already running")
+		return
+	}
+	defer clamdReload.end()
+
+	wait := config.ClamdStartupWait
+	if wait <= 0 {
+		wait = time.Duration(DefaultClamdStartupWait) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	log.Printf("Reloading clamd signatures, holding scans")
+	resp, err := reloadClamd(ctx, network, address)
+	if err != nil {
+		log.Printf("clamd reload failed: %v", err)
+		metrics.Count("clamd.reloads", 1, "status:error")
+		sendErrorStatus(w, http.StatusServiceUnavailable, "clamd unavailable")
+		return
+	}
+	metrics.Count("clamd.reloads", 1, "status:"+resp.Status)
+	log.Printf("clamd reload %s after %dms (signatures %s -> %s)", resp.Status, resp.DurationMs, resp.DBVersionBefore, resp.DBVersion)
+
+	// Verdicts are stamped with the new signature version right away
+	if scanner != nil && resp.Status == "reloaded" {
+		scanner.queryEngine()
+	}
+
+	status := http.StatusOK
+	if resp.Status != "reloaded" {
+		status = http.StatusGatewayTimeout
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReloadHandler(t *testing.T) {
+	fake := newFakeClamd(t)
+	pool, err := NewClamdPool(fake.address(), 1)
+	if err != nil {
+		t.Fatalf("NewClamdPool() error = %v", err)
+	}
+	clamdPool = pool
+	oldConfig := config
+	config = &Config{ClamdStartupWait: 10 * time.Second}
+	t.Cleanup(func() { clamdPool, config = nil, oldConfig })
+
+	recorder := httptest.NewRecorder()
+	reloadHandler(recorder, httptest.NewRequest(http.MethodPost, "/admin/reload-db", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", recorder.Code, recorder.Body)
+	}
+	var resp ReloadResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if resp.Status != "reloaded" || resp.DBVersionBefore != "27000" || resp.DBVersion != "27001" || !resp.SignaturesChanged {
+		t.Errorf("response = %+v", resp)
+	}
+	if clamdReload.active() {
+		t.Error("reload still marked as running")
+	}
+}
+
+func TestReloadHandlerClamdDown(t *testing.T) {
+	pool, _ := NewClamdPool("tcp://127.0.0.1:1", 1)
+	clamdPool = pool
+	oldConfig := config
+	config = &Config{ClamdStartupWait: time.Second}
+	t.Cleanup(func() { clamdPool, config = nil, oldConfig })
+
+	recorder := httptest.NewRecorder()
+	reloadHandler(recorder, httptest.NewRequest(http.MethodPost, "/admin/reload-db", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", recorder.Code)
+	}
+}
+
+func TestReloadHoldsScans(t *testing.T) {
+	if !clamdReload.begin() {
+		t.Fatal("begin() refused the first reload")
+	}
+	if clamdReload.begin() {
+		t.Error("begin() allowed a second reload")
+	}
+
+	recorder := httptest.NewRecorder()
+	readyzHandler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz status = %d during reload, want 503", recorder.Code)
+	}
+
+	released := make(chan struct{})
+	go func() {
+		clamdReload.wait(context.Background())
+		close(released)
+	}()
+	select {
+	case <-released:
+		t.Fatal("scan not held during reload")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clamdReload.end()
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("scan not released after reload")
+	}
+
+	// A scan whose context ends stops waiting
+	clamdReload.begin()
+	defer clamdReload.end()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	clamdReload.wait(ctx)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// curl exit codes mapped to client errors (see curl(1), EXIT CODES)
+const (
+	curlAccessDenied   = 9
+	curlFileTooLarge   = 63
+	curlLoginDenied    = 67
+	curlRemoteNotFound = 78
+)
+
+// How long curl may take to connect and log in, in seconds
+const remoteConnectTimeout = 30
+
+// RemoteScanRequest is the body of POST /scan/remote
+type RemoteScanRequest struct {
+	URL      string `json:"url"`                // sftp://host[:port]/path or ftps://host[:port]/path
+	Username string `json:"username,omitempty"` // Overrides the host's configured credentials
+	Password string `json:"password,omitempty"`
+}
+
+// RemoteScanner fetches files from SFTP and FTPS servers with curl, which
+// handles the SSH and FTP protocols the standard library lacks. The
+// transfer is streamed to a temp file and scanned like an upload.
+type RemoteScanner struct {
+	config *Config
+}
+
+// Global remote scanner (nil = POST /scan/remote disabled)
+var remoteScanner *RemoteScanner
+
+// NewRemoteScanner creates the remote scanner. Returns nil if no hosts are
+// allowed.
+func NewRemoteScanner(config *Config) (*RemoteScanner, error) {
+	if len(config.RemoteScanHosts) == 0 {
+		return nil, nil
+	}
+	for _, host := range config.RemoteScanHosts {
+		if host != "*" && strings.ContainsAny(host, "/@: ") {
+			return nil, fmt.Errorf("invalid host %q in %s (expected a host name, e.g. sftp.example.com)", host, EnvRemoteScanHosts)
+		}
+	}
+	for host, credentials := range config.RemoteCredentials {
+		if user, _, ok := strings.Cut(credentials, ":"); !ok || user == "" || strings.ContainsAny(credentials, "\r\n") {
+			return nil, fmt.Errorf("invalid credentials for %s in %s (expected host:user:password)", host, EnvRemoteCredentials)
+		}
+	}
+	return &RemoteScanner{config: config}, nil
+}
+
+// allowed reports whether files may be fetched from the host
+func (s *RemoteScanner) allowed(host string) bool {
+	for _, allowed := range s.config.RemoteScanHosts {
+		if allowed == "*" || strings.EqualFold(allowed, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRemoteURL checks a remote file URL. Credentials must be sent in the
+// request fields, so the URL can be logged.
+func parseRemoteURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.New("malformed URL")
+	}
+	switch {
+	case u.Scheme != "sftp" && u.Scheme != "ftps":
+		return nil, errors.New("scheme must be sftp or ftps")
+	case u.User != nil:
+		return nil, errors.New("credentials must be sent as username and password, not in the URL")
+	case u.Hostname() == "":
+		return nil, errors.New("missing host")
+	case u.Path == "" || strings.HasSuffix(u.Path, "/"):
+		return nil, errors.New("URL must name a file")
+	case u.RawQuery != "" || u.Fragment != "":
+		return nil, errors.New("query and fragment are not supported")
+	}
+	return u, nil
+}
+
+// remoteScanHandler handles POST /scan/remote. The response (and async
+// mode) are the same as for /scan.
+func remoteScanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	startTime := time.Now()
+	if rejectWhileStarting(w, r, startTime) {
+		return
+	}
+
+	var request RemoteScanRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		sendErrorStatus(w, http.StatusBadRequest, "Invalid remote scan request")
+		return
+	}
+	u, reqErr := remoteScanner.Resolve(&request)
+	if reqErr != nil {
+		sendRequestError(w, reqErr)
+		return
+	}
+
+	upload, reqErr := remoteScanner.Fetch(r.Context(), u, &request, config.MaxUploadSize)
+	if reqErr != nil {
+		recordScan(scanTags(r), "error", time.Since(startTime), 0, nil)
+		sendRequestError(w, reqErr)
+		return
+	}
+	respondScan(w, r, config, scanner, upload, startTime)
+}
+
+// Resolve checks a request's URL and credentials and whether the host is
+// allowed
+func (s *RemoteScanner) Resolve(request *RemoteScanRequest) (*url.URL, *requestError) {
+	u, err := parseRemoteURL(request.URL)
+	if err != nil {
+		return nil, &requestError{status: http.StatusBadRequest, message: "Invalid remote URL: " + err.Error()}
+	}
+	if strings.ContainsAny(request.Username, ":\r\n") || strings.ContainsAny(request.Password, "\r\n") {
+		return nil, &requestError{status: http.StatusBadRequest, message: "Invalid remote credentials"}
+	}
+	if !s.allowed(u.Hostname()) || egress.CheckURL(u) != nil {
+		return nil, &requestError{status: http.StatusForbidden, message: "Host not allowed: " + sanitizeFilename(u.Hostname())}
+	}
+	return u, nil
+}
+
+// Fetch downloads a remote file to a temp file, up to limit bytes.
+// Failures are logged here; the returned requestError is safe to send to
+// the client.
+func (s *RemoteScanner) Fetch(ctx context.Context, u *url.URL, request *RemoteScanRequest, limit int64) (*uploadedFile, *requestError) {
+	safeURL := sanitizeFilename(u.String())
+	config := s.curlConfig(u, request)
+
+	// curl resolves the host itself: pin it to the address checked here, so
+	// that the name can't resolve to a denied address by the time curl
+	// connects. Through a proxy, the proxy resolves it, after it was
+	// checked here.
+	if egress != nil && outboundProxyFor(u.Host) != nil {
+		if err := egress.CheckHost(ctx, u.Hostname()); err != nil {
+			log.Printf("Failed to fetch %s: %v", safeURL, err)
+			return nil, &requestError{status: http.StatusForbidden, message: "Host not allowed: " + sanitizeFilename(u.Hostname())}
+		}
+	} else if egress != nil {
+		ip, err := egress.ResolveHost(ctx, u.Hostname())
+		if err != nil {
+			log.Printf("Failed to fetch %s: %v", safeURL, err)
+			if errors.Is(err, errEgressDenied) {
+				return nil, &requestError{status: http.StatusForbidden, message: "Host not allowed: " + sanitizeFilename(u.Hostname())}
+			}
+			return nil, &requestError{status: http.StatusBadGateway, message: "Failed to fetch remote file"}
+		}
+		address := ip.String()
+		if ip.To4() == nil {
+			address = "[" + address + "]"
+		}
+		config += "resolve = " + curlQuote(u.Hostname()+":"+remotePort(u)+":"+address) + "\n"
+	}
+
+	// Credentials are passed on stdin rather than the command line, where
+	// other processes could see them. -q skips any ~/.curlrc.
+	args := []string{"-q", "--silent", "--show-error", "--proto", "=sftp,ftps",
+		"--connect-timeout", strconv.Itoa(remoteConnectTimeout), "--max-filesize", strconv.FormatInt(limit, 10)}
+	if key := s.config.RemoteSSHHostKeys[u.Hostname()]; key != "" && u.Scheme == "sftp" {
+		args = append(args, "--hostpubsha256", key)
+	}
+	args = append(args, "--config", "-")
+	cmd := exec.CommandContext(ctx, s.config.CurlPath, args...)
+	cmd.Stdin = strings.NewReader(config)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Printf("Failed to start curl: %v", err)
+		return nil, &requestError{status: http.StatusInternalServerError, message: "Server error during file processing"}
+	}
+
+	tempFile, err := os.CreateTemp(scanTmpDir, "clamav-scan-*")
+	if err != nil {
+		log.Printf("Failed to create temp file: %v", err)
+		return nil, &requestError{status: http.StatusInternalServerError, message: "Server error during file processing"}
+	}
+	defer tempFile.Close()
+	if err := cmd.Start(); err != nil {
+		os.Remove(tempFile.Name())
+		log.Printf("Failed to start curl: %v", err)
+		return nil, &requestError{status: http.StatusInternalServerError, message: "Server error during file processing"}
+	}
+
+	// curl only enforces --max-filesize when the server announces the size
+	size, copyErr := io.Copy(tempFile, io.LimitReader(stdout, limit+1))
+	if size > limit {
+		cmd.Process.Kill()
+	}
+	waitErr := cmd.Wait()
+
+	code := -1
+	var exitErr *exec.ExitError
+	if errors.As(waitErr, &exitErr) {
+		code = exitErr.ExitCode()
+	}
+	switch {
+	case size > limit || code == curlFileTooLarge:
+		os.Remove(tempFile.Name())
+		log.Printf("Rejected %s: exceeds limit %d", safeURL, limit)
+		return nil, uploadTooLarge(limit)
+	case ctx.Err() != nil:
+		os.Remove(tempFile.Name())
+		return nil, &requestError{status: http.StatusRequestTimeout, message: "Request cancelled"}
+	case waitErr != nil || copyErr != nil:
+		os.Remove(tempFile.Name())
+		if waitErr == nil {
+			waitErr = copyErr
+		}
+		log.Printf("Failed to fetch %s: %v: %s", safeURL, waitErr, sanitizeFilename(strings.TrimSpace(stderr.String())))
+		return nil, curlRequestError(code)
+	}
+	log.Printf("Fetched remote file: %s (%d bytes)", safeURL, size)
+
+	name := path.Base(u.Path)
+	return &uploadedFile{path: tempFile.Name(), filename: name, safeFilename: sanitizeFilename(name), size: size}, nil
+}
+
+// curlConfig returns the curl config (read from stdin) holding the URL and
+// the credentials: those of the request, or else the host's configured ones
+func (s *RemoteScanner) curlConfig(u *url.URL, request *RemoteScanRequest) string {
+	config := "url = " + curlQuote(u.String()) + "\n"
+	credentials := s.config.RemoteCredentials[u.Hostname()]
+	if request.Username != "" {
+		credentials = request.Username + ":" + request.Password
+	}
+	if credentials != "" {
+		config += "user = " + curlQuote(credentials) + "\n"
+	}
+	// SFTP and FTPS are tunneled through HTTP proxies with CONNECT
+	if proxyURL := outboundProxyFor(u.Host); proxyURL != nil {
+		config += "proxy = " + curlQuote(proxyURL.String()) + "\n"
+		if proxyURL.Scheme != "socks5" {
+			config += "proxytunnel\n"
+		}
+	}
+	return config
+}
+
+// remotePort returns the port of a remote URL, or its scheme's default
+func remotePort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if u.Scheme == "ftps" {
+		return "990"
+	}
+	return "22"
+}
+
+// curlQuote quotes a curl config value
+func curlQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// curlRequestError maps a curl exit code to the client response
+func curlRequestError(code int) *requestError {
+	switch code {
+	case curlLoginDenied, curlAccessDenied:
+		return &requestError{status: http.StatusForbidden, message: "Remote server denied access to the file"}
+	case curlRemoteNotFound:
+		return &requestError{status: http.StatusNotFound, message: "Remote file not found"}
+	}
+	return &requestError{status: http.StatusBadGateway, message: "Failed to fetch remote file"}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// requestBudget is the decompression budget of one request: the bytes,
+// files and directories extracted, summed over every archive, message,
+// document and image layer unpacked for it (and over all items of a
+// batch), and how deep extracted files are nested. MAX_EXTRACTED_SIZE_MB
+// and MAX_FILE_COUNT still limit each archive on its own.
+type requestBudget struct {
+	maxBytes int64 // 0 = unlimited, as for the other limits
+	maxFiles int
+	maxDirs  int
+	maxDepth int
+
+	mu    sync.Mutex
+	bytes int64
+	files int
+	dirs  map[string]bool // Directories created, by path
+}
+
+// requestBudgetKey is the context key for the request's budget
+type requestBudgetKey struct{}
+
+// newRequestBudget returns a budget with the configured limits, or nil if
+// none is set
+func newRequestBudget(config *Config) *requestBudget {
+	if config.RequestMaxExtracted == 0 && config.RequestMaxFiles == 0 && config.RequestMaxDirs == 0 && config.RequestMaxDepth == 0 {
+		return nil
+	}
+	return &requestBudget{
+		maxBytes: config.RequestMaxExtracted,
+		maxFiles: config.RequestMaxFiles,
+		maxDirs:  config.RequestMaxDirs,
+		maxDepth: config.RequestMaxDepth,
+		dirs:     make(map[string]bool),
+	}
+}
+
+// requestBudgetFrom returns the budget of the request ctx belongs to (nil =
+// unlimited)
+func requestBudgetFrom(ctx context.Context) *requestBudget {
+	budget, _ := ctx.Value(requestBudgetKey{}).(*requestBudget)
+	return budget
+}
+
+// limitExtraction gives each scan request a decompression budget and a
+// limit on the keys derived for encrypted entries, which async jobs started
+// by the request keep using
+func limitExtraction(config *Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := withZipKeys(r.Context())
+		if budget := newRequestBudget(config); budget != nil {
+			ctx = context.WithValue(ctx, requestBudgetKey{}, budget)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// take counts n extracted bytes
+func (b *requestBudget) take(n int64) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bytes += n
+	if b.maxBytes > 0 && b.bytes > b.maxBytes {
+		return b.exceeded("bytes", b.bytes, b.maxBytes)
+	}
+	return nil
+}
+
+// reader counts the bytes read from r, failing the read that exceeds the
+// budget
+func (b *requestBudget) reader(r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &budgetReader{budget: b, r: r}
+}
+
+// addFile counts a file extracted to path below root, and the directories
+// that were created for it
+func (b *requestBudget) addFile(root, path string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.files++
+	if b.maxFiles > 0 && b.files > b.maxFiles {
+		return b.exceeded("files", int64(b.files), int64(b.maxFiles))
+	}
+	return b.addDirLocked(root, filepath.Dir(path))
+}
+
+// addDir counts a directory created below root, and its parents
+func (b *requestBudget) addDir(root, dir string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.addDirLocked(root, dir)
+}
+
+func (b *requestBudget) addDirLocked(root, dir string) error {
+	root, dir = filepath.Clean(root), filepath.Clean(dir)
+	prefix := root + string(os.PathSeparator)
+	if !strings.HasPrefix(dir, prefix) {
+		return nil // root itself
+	}
+	depth := strings.Count(dir[len(prefix):], string(os.PathSeparator)) + 1
+	if b.maxDepth > 0 && depth > b.maxDepth {
+		metrics.Count("extraction.budget_exceeded", 1, "limit:depth")
+		return &bombError{&RejectedReason{
+			Check:  bombRequestBudget,
+			Detail: fmt.Sprintf("files nested %d directories deep (limit %d)", depth, b.maxDepth),
+			Value:  float64(depth),
+			Limit:  float64(b.maxDepth),
+		}}
+	}
+	if b.maxDirs == 0 {
+		return nil
+	}
+	for ; strings.HasPrefix(dir, prefix) && !b.dirs[dir]; dir = filepath.Dir(dir) {
+		b.dirs[dir] = true
+	}
+	if len(b.dirs) > b.maxDirs {
+		return b.exceeded("directories", int64(len(b.dirs)), int64(b.maxDirs))
+	}
+	return nil
+}
+
+// exceeded returns the error for a spent budget
+func (b *requestBudget) exceeded(what string, value, limit int64) error {
+	metrics.Count("extraction.budget_exceeded", 1, "limit:"+what)
+	return &bombError{&RejectedReason{
+		Check:  bombRequestBudget,
+		Detail: fmt.Sprintf("request extracts more than %d %s", limit, what),
+		Value:  float64(value),
+		Limit:  float64(limit),
+	}}
+}
+
+// budgetReader counts the bytes read through it against a request budget
+type budgetReader struct {
+	budget *requestBudget
+	r      io.Reader
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if budgetErr := r.budget.take(int64(n)); budgetErr != nil {
+		return n, budgetErr
+	}
+	return n, err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// budgetCheck returns the check of a spent budget's error ("" = none)
+func budgetCheck(err error) string {
+	var bomb *bombError
+	if !errors.As(err, &bomb) {
+		return ""
+	}
+	return bomb.reason.Check
+}
+
+func TestRequestBudget(t *testing.T) {
+	if newRequestBudget(&Config{}) != nil {
+		t.Error("newRequestBudget() without limits should be nil")
+	}
+	var unlimited *requestBudget
+	if unlimited.take(1<<40) != nil || unlimited.addFile("/x", "/x/a/b") != nil {
+		t.Error("nil budget should allow everything")
+	}
+
+	root := t.TempDir()
+	budget := newRequestBudget(&Config{RequestMaxExtracted: 10, RequestMaxFiles: 3, RequestMaxDirs: 3, RequestMaxDepth: 2})
+
+	if err := budget.take(10); err != nil {
+		t.Errorf("take(10) = %v, want within budget", err)
+	}
+	if err := budget.take(1); budgetCheck(err) != bombRequestBudget {
+		t.Errorf("take(1) past the budget = %v, want request_budget", err)
+	}
+
+	// a and a/b are new directories; a again is not
+	if err := budget.addFile(root, filepath.Join(root, "a", "b", "one.txt")); err != nil {
+		t.Errorf("addFile() = %v", err)
+	}
+	if err := budget.addFile(root, filepath.Join(root, "a", "two.txt")); err != nil {
+		t.Errorf("addFile() = %v", err)
+	}
+	if err := budget.addFile(root, filepath.Join(root, "a", "b", "c", "deep.txt")); budgetCheck(err) != bombRequestBudget {
+		t.Errorf("addFile() 3 levels deep = %v, want request_budget", err)
+	}
+	if err := budget.addDir(root, filepath.Join(root, "d")); err != nil {
+		t.Errorf("addDir() third directory = %v", err)
+	}
+	if err := budget.addDir(root, filepath.Join(root, "e")); budgetCheck(err) != bombRequestBudget {
+		t.Errorf("addDir() fourth directory = %v, want request_budget", err)
+	}
+	if err := budget.addFile(root, filepath.Join(root, "four.txt")); budgetCheck(err) != bombRequestBudget {
+		t.Errorf("addFile() fourth file = %v, want request_budget", err)
+	}
+}
+
+func TestRequestBudgetAcrossArchives(t *testing.T) {
+	cfg := &Config{MaxFileCount: 100, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20}
+	s := NewScanner(cfg)
+	ctx := context.WithValue(context.Background(), requestBudgetKey{}, newRequestBudget(&Config{RequestMaxFiles: 5}))
+
+	var entries [][2]string
+	for i := 0; i < 3; i++ {
+		entries = append(entries, [2]string{fmt.Sprintf("file%d.txt", i), "hello"})
+	}
+	zipPath := filepath.Join(t.TempDir(), "three.zip")
+	os.WriteFile(zipPath, zipBytes(t, zip.Deflate, entries...), 0644)
+
+	// Each archive is within MAX_FILE_COUNT; the second exceeds the
+	// request's budget
+	if _, _, err := s.extractZipSafe(ctx, zipPath, t.TempDir(), nil); err != nil {
+		t.Fatalf("first extractZipSafe() error: %v", err)
+	}
+	if _, _, err := s.extractZipSafe(ctx, zipPath, t.TempDir(), nil); budgetCheck(err) != bombRequestBudget {
+		t.Errorf("second extractZipSafe() error = %v, want request_budget", err)
+	}
+
+	// Tar archives share it too, as the layers of an image do
+	budget := newRequestBudget(&Config{RequestMaxExtracted: 8})
+	layer := testLayer(t, map[string]string{"etc/motd": "hello"})
+	if _, _, _, err := extractUploadTar(bytes.NewReader(layer), true, t.TempDir(), cfg, nil, budget); err != nil {
+		t.Fatalf("first tar error: %v", err)
+	}
+	if _, _, _, err := extractUploadTar(bytes.NewReader(layer), true, t.TempDir(), cfg, nil, budget); budgetCheck(err) != bombRequestBudget {
+		t.Errorf("second tar error = %v, want request_budget", err)
+	}
+}
+
+func TestScanHandlerRequestBudget(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.RequestMaxDepth = 3
+	archive := zipBytes(t, zip.Deflate, [2]string{"a/b/c/d/deep.txt", "hello"})
+
+	scan := func() (*httptest.ResponseRecorder, ScanResponse) {
+		body, contentType := multipartUpload(t, "deep.zip", archive)
+		req := httptest.NewRequest(http.MethodPost, "/scan", body)
+		req.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+		limitExtraction(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handleScan(w, r, cfg, NewScanner(cfg))
+		})).ServeHTTP(recorder, req)
+		var response ScanResponse
+		json.NewDecoder(recorder.Body).Decode(&response)
+		return recorder, response
+	}
+
+	cfg.ArchiveBombAction = bombActionReject
+	recorder, response := scan()
+	if recorder.Code != http.StatusUnprocessableEntity || response.RejectedReason == nil ||
+		response.RejectedReason.Check != bombRequestBudget || !strings.Contains(response.RejectedReason.Detail, "4 directories deep") {
+		t.Errorf("reject: status %d, response %+v", recorder.Code, response)
+	}
+
+	cfg.ArchiveBombAction = bombActionFlag
+	recorder, response = scan()
+	if recorder.Code != http.StatusOK || response.Status != "suspicious" {
+		t.Errorf("flag: status %d, response %+v", recorder.Code, response)
+	}
+
+	cfg.RequestMaxDepth = 0
+	if recorder, response = scan(); recorder.Code != http.StatusOK || response.Status != "clean" {
+		t.Errorf("unlimited: status %d, response %+v", recorder.Code, response)
+	}
+}
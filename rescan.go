@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How often the signature version is checked for updates
+const rescanCheckInterval = time.Minute
+
+// Rescanner re-scans stored files whenever clamd loads new signatures, for
+// retrospective detection: a file that was clean when it arrived may match
+// a signature published later. Files in the retention stores were clean
+// when stored, so a detection there is reported like a new one. The
+// quarantine is re-scanned to keep its verdicts current; files that are no
+// longer detected (e.g. after a false positive was fixed) are logged.
+type Rescanner struct {
+	scanner    *Scanner
+	quarantine string               // Watched-directory quarantine (empty = none)
+	stores     []string             // Directories of previously clean files
+	dbVersion  string               // Signature version the files were last scanned with
+	detected   map[string]time.Time // Stored files already reported, by path (value: modification time)
+}
+
+// NewRescanner creates the re-scanner described by the config. Returns nil
+// when re-scans are disabled.
+func NewRescanner(config *Config, scanner *Scanner) *Rescanner {
+	if !config.RescanOnUpdate {
+		return nil
+	}
+	return &Rescanner{
+		scanner:    scanner,
+		quarantine: config.WatchQuarantineDir,
+		stores:     config.RescanDirs,
+		detected:   make(map[string]time.Time),
+	}
+}
+
+// Start checks the signature version in the background and re-scans after
+// each change. Files are not re-scanned on startup: the first version seen
+// is the one they are assumed to have been scanned with.
+func (s *Rescanner) Start() {
+	go func() {
+		ticker := time.NewTicker(rescanCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.CheckUpdate(context.Background())
+		}
+	}()
+}
+
+// CheckUpdate re-scans the stored files if the signature version changed
+// since the last check. Returns true if they were re-scanned.
+func (s *Rescanner) CheckUpdate(ctx context.Context) bool {
+	_, dbVersion, err := s.scanner.GetVersion()
+	if err != nil || dbVersion == s.dbVersion {
+		return false
+	}
+	previous := s.dbVersion
+	s.dbVersion = dbVersion
+	if previous == "" {
+		return false
+	}
+
+	log.Printf("Signatures updated (%s -> %s), re-scanning stored files", previous, dbVersion)
+	s.Rescan(ctx)
+	return true
+}
+
+// Rescan scans every stored file with the current signatures
+func (s *Rescanner) Rescan(ctx context.Context) {
+	startTime := time.Now()
+	scanned, detections := 0, 0
+	if s.quarantine != "" {
+		s.walk(ctx, s.quarantine, func(path string, _ fs.FileInfo, result *ScanResult, _ time.Duration) {
+			scanned++
+			if len(result.Threats) == 0 {
+				log.Printf("Quarantined file %s is no longer detected", sanitizeFilename(path))
+			}
+		})
+	}
+
+	seen := make(map[string]bool)
+	for _, store := range s.stores {
+		s.walk(ctx, store, func(path string, info fs.FileInfo, result *ScanResult, elapsed time.Duration) {
+			scanned++
+			seen[path] = true
+			if len(result.Threats) == 0 {
+				delete(s.detected, path)
+				return
+			}
+			if reported, ok := s.detected[path]; ok && reported.Equal(info.ModTime()) {
+				return
+			}
+			s.detected[path] = info.ModTime()
+			detections++
+			s.report(ctx, store, path, info.Size(), result, elapsed)
+		})
+	}
+	for path := range s.detected {
+		if !seen[path] {
+			delete(s.detected, path)
+		}
+	}
+
+	metrics.Count("rescan.files", int64(scanned))
+	metrics.Count("rescan.detections", int64(detections))
+	log.Printf("Re-scan completed: %d files, %d new detections (%dms)", scanned, detections, time.Since(startTime).Milliseconds())
+}
+
+// walk scans the regular files below dir, calling found with each result.
+// Files that fail to scan are logged and skipped.
+func (s *Rescanner) walk(ctx context.Context, dir string, found func(path string, info fs.FileInfo, result *ScanResult, elapsed time.Duration)) {
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				log.Printf("Failed to read %s for re-scan: %v", dir, err)
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+
+		// Re-scans wait for a worker rather than failing when HTTP traffic
+		// fills the queue
+		startTime := time.Now()
+		result, err := runScan(ctx, s.scanner, path)
+		for errors.Is(err, errQueueFull) && ctx.Err() == nil {
+			time.Sleep(time.Second)
+			result, err = runScan(ctx, s.scanner, path)
+		}
+		if err != nil {
+			log.Printf("Re-scan failed for %s: %v", sanitizeFilename(path), err)
+			return nil
+		}
+		found(path, info, result, time.Since(startTime))
+		return nil
+	})
+}
+
+// report sends a retrospective detection to the configured sinks
+func (s *Rescanner) report(ctx context.Context, store, path string, size int64, result *ScanResult, elapsed time.Duration) {
+	log.Printf("Re-scan detected %s in stored file %s", result.Threats[0].Name, sanitizeFilename(path))
+	r := backgroundRequest(ctx, store)
+	file := &uploadedFile{path: path, filename: path, safeFilename: sanitizeFilename(path), size: size}
+	reportEvent(r, auditEventRetroDetection, file, result.Threats)
+	response := &ScanResponse{
+		Status:       "infected",
+		Threats:      result.Threats,
+		ScannedFiles: result.ScannedFiles,
+		ScanTimeMs:   elapsed.Milliseconds(),
+		Indicators:   result.Indicators,
+	}
+	response.setSummary(result)
+	indexScan(r, file, response)
+}
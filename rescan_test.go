@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRescannerAfterUpdate(t *testing.T) {
+	server := newFakeClamd(t)
+	pool, err := NewClamdPool(server.address(), 1)
+	if err != nil {
+		t.Fatalf("NewClamdPool() error: %v", err)
+	}
+	clamdPool = pool
+	t.Cleanup(func() { clamdPool = nil })
+
+	base := t.TempDir()
+	quarantine := filepath.Join(base, "quarantine")
+	store := filepath.Join(base, "clean")
+	os.Mkdir(quarantine, 0755)
+	os.MkdirAll(filepath.Join(store, "2024"), 0755)
+	writeTestFile(t, filepath.Join(quarantine, "dropper.exe"), "EICAR")
+	writeTestFile(t, filepath.Join(quarantine, "false-positive.doc"), "harmless")
+	writeTestFile(t, filepath.Join(store, "2024", "invoice.pdf"), "NEWSIG payload")
+	writeTestFile(t, filepath.Join(store, "report.txt"), "report")
+
+	logPath := filepath.Join(base, "audit.log")
+	a, err := NewAuditLogger(&Config{AuditLogFile: logPath})
+	if err != nil {
+		t.Fatalf("NewAuditLogger() error: %v", err)
+	}
+	auditLog = a
+	t.Cleanup(func() { auditLog = nil })
+
+	cfg := &Config{
+		MaxExtractedSize:   1 << 20,
+		MaxFileCount:       10,
+		MaxSingleFileSize:  1 << 20,
+		ScanTimeout:        time.Minute,
+		RescanOnUpdate:     true,
+		WatchQuarantineDir: quarantine,
+		RescanDirs:         []string{store},
+	}
+	s := NewRescanner(cfg, NewScanner(cfg))
+
+	// The first version seen is the baseline; unchanged versions are skipped
+	if s.CheckUpdate(context.Background()) || s.CheckUpdate(context.Background()) {
+		t.Fatal("CheckUpdate() re-scanned without a signature update")
+	}
+
+	server.updated.Store(true)
+	if !s.CheckUpdate(context.Background()) {
+		t.Fatal("CheckUpdate() did not re-scan after the signature update")
+	}
+	records := readAuditRecords(t, logPath)
+	if len(records) != 1 {
+		t.Fatalf("records = %+v, want one retrospective detection", records)
+	}
+	record := records[0]
+	if record.Event != auditEventRetroDetection || record.Route != store || record.Filename != filepath.Join(store, "2024", "invoice.pdf") {
+		t.Errorf("record = %+v", record)
+	}
+	if len(record.Threats) != 1 || record.Threats[0].Name != "New-Test-Signature" || record.FileSize != 14 {
+		t.Errorf("record = %+v", record)
+	}
+
+	// A detection is reported once, unless the file changes
+	s.Rescan(context.Background())
+	if records := readAuditRecords(t, logPath); len(records) != 1 {
+		t.Errorf("got %d records after a second re-scan, want 1", len(records))
+	}
+	time.Sleep(10 * time.Millisecond)
+	writeTestFile(t, filepath.Join(store, "2024", "invoice.pdf"), "NEWSIG changed")
+	s.Rescan(context.Background())
+	if records := readAuditRecords(t, logPath); len(records) != 2 {
+		t.Errorf("got %d records after the file changed, want 2", len(records))
+	}
+}
+
+func TestNewRescanner(t *testing.T) {
+	if s := NewRescanner(&Config{RescanDirs: []string{"/srv/clean"}}, nil); s != nil {
+		t.Error("NewRescanner() should be disabled without RESCAN_ON_DB_UPDATE")
+	}
+	if s := NewRescanner(&Config{RescanOnUpdate: true, RescanDirs: []string{"/srv/clean"}}, nil); s == nil {
+		t.Error("NewRescanner() = nil, want a re-scanner")
+	}
+}
+
+// readAuditRecords reads the records of a JSON lines audit log
+func readAuditRecords(t *testing.T, path string) []AuditRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+	defer f.Close()
+
+	var records []AuditRecord
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(lines.Bytes(), &record); err != nil {
+			t.Fatalf("invalid audit line %q: %v", lines.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
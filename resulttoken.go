@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Result token signing algorithms (JWS "alg")
+const (
+	resultTokenHS256 = "HS256"
+	resultTokenEdDSA = "EdDSA"
+)
+
+// ResultClaims are the claims of a signed result token
+type ResultClaims struct {
+	Issuer   string   `json:"iss"`
+	IssuedAt int64    `json:"iat"`
+	SHA256   string   `json:"sha256"`            // Hash of the uploaded file
+	Size     int64    `json:"size"`              // Size of the uploaded file
+	Verdict  string   `json:"verdict"`           // clean or infected
+	Threats  []string `json:"threats,omitempty"` // Detected signature names
+}
+
+// ResultSigner signs scan verdicts as compact JWS tokens, so services
+// downstream of the caller can check that a verdict came from this scanner
+// without calling back. Tokens are signed with a shared HMAC secret (HS256)
+// or an Ed25519 key (EdDSA), whose public key is served as a JWKS.
+type ResultSigner struct {
+	alg    string
+	secret []byte             // HS256 secret
+	key    ed25519.PrivateKey // EdDSA signing key
+	keyID  string             // JWK thumbprint of the Ed25519 public key
+	issuer string
+	now    func() time.Time
+}
+
+// Global result signer (nil = result tokens disabled)
+var resultSigner *ResultSigner
+
+// NewResultSigner creates the signer described by the config. Returns nil
+// when neither a secret nor a key file is configured.
+func NewResultSigner(config *Config) (*ResultSigner, error) {
+	signer := &ResultSigner{issuer: config.ResultTokenIssuer, now: time.Now}
+	switch {
+	case config.ResultTokenSecret != "":
+		signer.alg = resultTokenHS256
+		signer.secret = []byte(config.ResultTokenSecret)
+	case config.ResultTokenKeyFile != "":
+		key, err := loadEd25519Key(config.ResultTokenKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", EnvResultTokenKeyFile, err)
+		}
+		signer.alg = resultTokenEdDSA
+		signer.key = key
+		signer.keyID = jwkThumbprint(key.Public().(ed25519.PublicKey))
+	default:
+		return nil, nil
+	}
+	return signer, nil
+}
+
+// resultTokenMode describes how result tokens are signed, for the startup log
+func resultTokenMode(config *Config) string {
+	switch {
+	case config.ResultTokenSecret != "":
+		return resultTokenHS256 + " (issuer: " + config.ResultTokenIssuer + ")"
+	case config.ResultTokenKeyFile != "":
+		return resultTokenEdDSA + " (issuer: " + config.ResultTokenIssuer + ")"
+	}
+	return "disabled"
+}
+
+// loadEd25519Key reads a PEM-encoded PKCS #8 Ed25519 private key, as written
+// by "openssl genpkey -algorithm ed25519"
+func loadEd25519Key(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an Ed25519 private key")
+	}
+	return key, nil
+}
+
+// jwkThumbprint computes the RFC 7638 thumbprint of an Ed25519 public key,
+// used as its key ID
+func jwkThumbprint(public ed25519.PublicKey) string {
+	canonical := `{"crv":"Ed25519","kty":"OKP","x":"` + base64.RawURLEncoding.EncodeToString(public) + `"}`
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Sign encodes and signs the claims as a compact JWS
+func (s *ResultSigner) Sign(claims *ResultClaims) (string, error) {
+	header, err := json.Marshal(struct {
+		Alg string `json:"alg"`
+		Typ string `json:"typ"`
+		Kid string `json:"kid,omitempty"`
+	}{s.alg, "JWT", s.keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	if s.alg == resultTokenEdDSA {
+		signature = ed25519.Sign(s.key, []byte(signingInput))
+	} else {
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// ResultToken signs the verdict in response for the upload. Returns "" if
+// the upload can't be hashed; the response is sent without a token.
+func (s *ResultSigner) ResultToken(upload *uploadedFile, response *ScanResponse) string {
+	hash, err := upload.fileHash()
+	if err != nil {
+		log.Printf("Failed to hash %s for the result token: %v", upload.safeFilename, err)
+		return ""
+	}
+
+	claims := &ResultClaims{
+		Issuer:   s.issuer,
+		IssuedAt: s.now().Unix(),
+		SHA256:   hash,
+		Size:     upload.size,
+		Verdict:  response.Status,
+	}
+	for _, threat := range response.Threats {
+		claims.Threats = append(claims.Threats, threat.Name)
+	}
+
+	token, err := s.Sign(claims)
+	if err != nil {
+		log.Printf("Failed to sign the result token: %v", err)
+		return ""
+	}
+	return token
+}
+
+// resultKeysHandler serves the Ed25519 verification key as a JWKS (GET
+// /.well-known/jwks.json). HS256 secrets are never published.
+func resultKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if resultSigner == nil || resultSigner.alg != resultTokenEdDSA {
+		sendErrorStatus(w, http.StatusNotFound, "No public result token keys")
+		return
+	}
+
+	public := resultSigner.key.Public().(ed25519.PublicKey)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=3600")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   base64.RawURLEncoding.EncodeToString(public),
+			"kid": resultSigner.keyID,
+			"alg": resultTokenEdDSA,
+			"use": "sig",
+		}},
+	})
+}
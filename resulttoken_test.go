@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testResultTokenSecret = "0123456789abcdef0123456789abcdef"
+
+// writeEd25519Key writes a new PKCS #8 Ed25519 key and returns its path and public key
+func writeEd25519Key(t *testing.T) (string, ed25519.PublicKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey() error: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "result-token.pem")
+	writeTestFile(t, path, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+	return path, public
+}
+
+// splitResultToken decodes the header and claims of a token and returns the
+// signing input and signature
+func splitResultToken(t *testing.T, token string) (header map[string]string, claims ResultClaims, signingInput string, signature []byte) {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token %q has %d parts, want 3", token, len(parts))
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		t.Fatalf("invalid header: %v", err)
+	}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		t.Fatalf("invalid claims: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatalf("invalid signature: %v", err)
+	}
+	return header, claims, parts[0] + "." + parts[1], signature
+}
+
+func TestNewResultSignerDisabled(t *testing.T) {
+	signer, err := NewResultSigner(&Config{})
+	if signer != nil || err != nil {
+		t.Errorf("NewResultSigner() = %v, %v, want nil, nil", signer, err)
+	}
+}
+
+func TestNewResultSignerInvalidKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	writeTestFile(t, path, "not a key")
+	if _, err := NewResultSigner(&Config{ResultTokenKeyFile: path}); err == nil {
+		t.Error("NewResultSigner() should reject a file without a PEM key")
+	}
+}
+
+func TestResultSignerHS256(t *testing.T) {
+	signer, err := NewResultSigner(&Config{ResultTokenSecret: testResultTokenSecret, ResultTokenIssuer: "scanner-1"})
+	if err != nil {
+		t.Fatalf("NewResultSigner() error: %v", err)
+	}
+	signer.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	token, err := signer.Sign(&ResultClaims{Issuer: signer.issuer, IssuedAt: signer.now().Unix(), SHA256: "abc", Verdict: "clean"})
+	if err != nil {
+		t.Fatalf("Sign() error: %v", err)
+	}
+
+	header, claims, signingInput, signature := splitResultToken(t, token)
+	if header["alg"] != "HS256" || header["kid"] != "" {
+		t.Errorf("header = %v", header)
+	}
+	mac := hmac.New(sha256.New, []byte(testResultTokenSecret))
+	mac.Write([]byte(signingInput))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		t.Error("signature does not verify with the secret")
+	}
+	if claims.Issuer != "scanner-1" || claims.IssuedAt != 1700000000 || claims.Verdict != "clean" {
+		t.Errorf("claims = %+v", claims)
+	}
+}
+
+func TestResultSignerEdDSA(t *testing.T) {
+	path, public := writeEd25519Key(t)
+	signer, err := NewResultSigner(&Config{ResultTokenKeyFile: path, ResultTokenIssuer: DefaultResultTokenIssuer})
+	if err != nil {
+		t.Fatalf("NewResultSigner() error: %v", err)
+	}
+
+	uploadPath := filepath.Join(t.TempDir(), "upload")
+	writeTestFile(t, uploadPath, "EICAR")
+	upload := &uploadedFile{path: uploadPath, safeFilename: "eicar.com", size: 5}
+	response := &ScanResponse{Status: "infected", Threats: []Threat{{Name: "Eicar-Test-Signature"}}}
+
+	token := signer.ResultToken(upload, response)
+	header, claims, signingInput, signature := splitResultToken(t, token)
+	if header["alg"] != "EdDSA" || header["kid"] != jwkThumbprint(public) {
+		t.Errorf("header = %v", header)
+	}
+	if !ed25519.Verify(public, []byte(signingInput), signature) {
+		t.Error("signature does not verify with the public key")
+	}
+
+	sum := sha256.Sum256([]byte("EICAR"))
+	if claims.SHA256 != hex.EncodeToString(sum[:]) || claims.Size != 5 || claims.Verdict != "infected" {
+		t.Errorf("claims = %+v", claims)
+	}
+	if len(claims.Threats) != 1 || claims.Threats[0] != "Eicar-Test-Signature" {
+		t.Errorf("threats = %v", claims.Threats)
+	}
+}
+
+func TestResultSignerMissingUpload(t *testing.T) {
+	signer, _ := NewResultSigner(&Config{ResultTokenSecret: testResultTokenSecret})
+	upload := &uploadedFile{path: filepath.Join(t.TempDir(), "missing")}
+	if token := signer.ResultToken(upload, &ScanResponse{Status: "clean"}); token != "" {
+		t.Errorf("ResultToken() = %q, want no token", token)
+	}
+}
+
+func TestResultKeysHandler(t *testing.T) {
+	t.Cleanup(func() { resultSigner = nil })
+
+	t.Run("HS256 is not published", func(t *testing.T) {
+		resultSigner, _ = NewResultSigner(&Config{ResultTokenSecret: testResultTokenSecret})
+		recorder := httptest.NewRecorder()
+		resultKeysHandler(recorder, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("status = %d, want 404", recorder.Code)
+		}
+	})
+
+	t.Run("EdDSA", func(t *testing.T) {
+		path, public := writeEd25519Key(t)
+		resultSigner, _ = NewResultSigner(&Config{ResultTokenKeyFile: path})
+		recorder := httptest.NewRecorder()
+		resultKeysHandler(recorder, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+
+		var jwks struct {
+			Keys []map[string]string `json:"keys"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&jwks); err != nil || len(jwks.Keys) != 1 {
+			t.Fatalf("JWKS = %+v, %v", jwks, err)
+		}
+		key := jwks.Keys[0]
+		x, _ := base64.RawURLEncoding.DecodeString(key["x"])
+		if key["kty"] != "OKP" || key["crv"] != "Ed25519" || !bytes.Equal(x, public) || key["kid"] != jwkThumbprint(public) {
+			t.Errorf("key = %v", key)
+		}
+	})
+}
+
+func TestScanHandlerResultToken(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	resultSigner, _ = NewResultSigner(&Config{ResultTokenSecret: testResultTokenSecret})
+	t.Cleanup(func() { resultSigner = nil })
+
+	body, contentType := multipartUpload(t, "report.pdf", []byte("clean"))
+	req := httptest.NewRequest(http.MethodPost, "/scan", body)
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+
+	handleScan(recorder, req, cfg, NewScanner(cfg))
+
+	var response ScanResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if response.Token == "" {
+		t.Fatalf("response has no token: %+v", response)
+	}
+	_, claims, _, _ := splitResultToken(t, response.Token)
+	sum := sha256.Sum256([]byte("clean"))
+	if claims.Verdict != "clean" || claims.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("claims = %+v", claims)
+	}
+}
+
+func TestValidateResultTokenSettings(t *testing.T) {
+	path, _ := writeEd25519Key(t)
+	cfg := &Config{ResultTokenSecret: "short", ResultTokenKeyFile: path}
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "mutually exclusive") || !strings.Contains(err.Error(), "at least 32 bytes") {
+		t.Errorf("Validate() = %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResultURLSigner signs async job result URLs with an expiry, so a browser
+// can poll GET /scan/results/{id} without holding the API credentials
+type ResultURLSigner struct {
+	secret []byte
+	ttl    time.Duration // How long a signed URL stays valid
+	now    func() time.Time
+}
+
+// Global result URL signer (nil = signed result URLs disabled)
+var resultURLSigner *ResultURLSigner
+
+// NewResultURLSigner creates the signer described by the config. Returns
+// nil when no secret is configured.
+func NewResultURLSigner(config *Config) *ResultURLSigner {
+	if config.ResultURLSecret == "" {
+		return nil
+	}
+	return &ResultURLSigner{secret: []byte(config.ResultURLSecret), ttl: config.ResultURLTTL, now: time.Now}
+}
+
+// signature is the hex HMAC-SHA256 of a job ID and expiry time
+func (s *ResultURLSigner) signature(id string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(id + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// URL returns the job's signed result URL, valid for the signer's TTL.
+// Returns "" on a nil signer.
+func (s *ResultURLSigner) URL(job *ScanJob) string {
+	if s == nil {
+		return ""
+	}
+	expires := s.now().Add(s.ttl).Unix()
+	return job.basePath + "/scan/results/" + job.ID +
+		"?expires=" + strconv.FormatInt(expires, 10) + "&signature=" + s.signature(job.ID, expires)
+}
+
+// Verify reports whether signature and expires are a valid, unexpired
+// signature of the job ID
+func (s *ResultURLSigner) Verify(id, expires, signature string) bool {
+	at, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || s.now().Unix() > at {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(s.signature(id, at)))
+}
+
+// resultHandler returns an async job's state to holders of a signed result
+// URL, without authentication (GET /scan/results/{id}?expires=&signature=)
+func resultHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/scan/results/")
+	query := r.URL.Query()
+	if resultURLSigner == nil || jobs == nil || !resultURLSigner.Verify(id, query.Get("expires"), query.Get("signature")) {
+		// Unsigned, expired and unknown jobs look the same
+		sendErrorStatus(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	job := jobs.Find(id)
+	if job == nil {
+		sendErrorStatus(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	snapshot, _ := job.Snapshot()
+	w.Header().Set("Cache-Control", "no-store")
+	if notModified(w, r, scanETag(snapshot.Result)) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
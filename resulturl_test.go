@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResultURLSigner(t *testing.T) {
+	signer := NewResultURLSigner(&Config{ResultURLSecret: strings.Repeat("s", 32), ResultURLTTL: time.Minute})
+	now := time.Now()
+	signer.now = func() time.Time { return now }
+
+	signed, err := url.Parse(signer.URL(&ScanJob{ID: "job1", basePath: "/antivirus"}))
+	if err != nil || signed.Path != "/antivirus/scan/results/job1" {
+		t.Fatalf("URL() = %v, %v", signed, err)
+	}
+	expires, signature := signed.Query().Get("expires"), signed.Query().Get("signature")
+	if !signer.Verify("job1", expires, signature) {
+		t.Error("Verify() rejected a fresh URL")
+	}
+	if signer.Verify("job2", expires, signature) {
+		t.Error("Verify() accepted the signature for another job")
+	}
+	if signer.Verify("job1", expires+"0", signature) {
+		t.Error("Verify() accepted an extended expiry")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if signer.Verify("job1", expires, signature) {
+		t.Error("Verify() accepted an expired URL")
+	}
+
+	if NewResultURLSigner(&Config{}) != nil || (*ResultURLSigner)(nil).URL(&ScanJob{}) != "" {
+		t.Error("signer without a secret should be nil and sign nothing")
+	}
+}
+
+func TestResultHandler(t *testing.T) {
+	useJobStore(t, NewJobStore(10, time.Minute))
+	resultURLSigner = NewResultURLSigner(&Config{ResultURLSecret: strings.Repeat("s", 32), ResultURLTTL: time.Minute})
+	t.Cleanup(func() { resultURLSigner = nil })
+
+	job := jobs.Create(AuthMethodAPIKey+":ci", "")
+	job.finish(&ScanResponse{Status: "clean"})
+
+	// The status response carries a signed URL readable without credentials
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/scan/jobs/"+job.ID, nil)
+	jobStatusHandler(recorder, req.WithContext(context.WithValue(req.Context(), identityKey{}, &Identity{Name: "ci", Method: AuthMethodAPIKey})))
+	var status JobResponse
+	json.NewDecoder(recorder.Body).Decode(&status)
+	if status.ResultURL == "" {
+		t.Fatalf("status = %+v, want a result_url", status)
+	}
+
+	recorder = httptest.NewRecorder()
+	resultHandler(recorder, httptest.NewRequest(http.MethodGet, status.ResultURL, nil))
+	var result JobResponse
+	json.NewDecoder(recorder.Body).Decode(&result)
+	if recorder.Code != http.StatusOK || result.Result == nil || result.Result.Status != "clean" || result.ResultURL != "" {
+		t.Errorf("signed URL: status %d, job %+v", recorder.Code, result)
+	}
+
+	for _, target := range []string{"/scan/results/" + job.ID, strings.Replace(status.ResultURL, job.ID, "unknown", 1)} {
+		recorder := httptest.NewRecorder()
+		resultHandler(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", target, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// How often records past their retention period are purged
+const retentionInterval = time.Hour
+
+// RetentionPurger removes scan history records and quarantined files once
+// they are older than their retention period. Async results expire on their
+// own after ASYNC_JOB_TTL_MINUTES.
+type RetentionPurger struct {
+	historyAge    time.Duration // 0 = kept until SCAN_HISTORY_SIZE drops them
+	quarantineAge time.Duration // 0 = kept forever
+	quarantine    string
+	now           func() time.Time
+}
+
+// NewRetentionPurger creates the purger described by the config. Returns
+// nil when no retention period applies.
+func NewRetentionPurger(config *Config) *RetentionPurger {
+	p := &RetentionPurger{quarantine: config.WatchQuarantineDir, now: time.Now}
+	if config.ScanHistorySize > 0 {
+		p.historyAge = config.ScanHistoryRetention
+	}
+	if config.WatchQuarantineDir != "" {
+		p.quarantineAge = config.QuarantineRetention
+	}
+	if p.historyAge == 0 && p.quarantineAge == 0 {
+		return nil
+	}
+	return p
+}
+
+// Start purges now and then every retentionInterval in the background
+func (p *RetentionPurger) Start() {
+	go func() {
+		p.Purge()
+		ticker := time.NewTicker(retentionInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			p.Purge()
+		}
+	}()
+}
+
+// Purge removes what is past its retention period
+func (p *RetentionPurger) Purge() {
+	now := p.now()
+	if p.historyAge > 0 && history != nil {
+		removed, err := history.Expire(now.Add(-p.historyAge))
+		if err != nil {
+			log.Printf("Warning: failed to rewrite scan history: %v", err)
+		}
+		if removed > 0 {
+			log.Printf("Retention: removed %d scan history records", removed)
+			metrics.Count("retention.purged", int64(removed), "store:history")
+		}
+	}
+	if p.quarantineAge > 0 {
+		cutoff := now.Add(-p.quarantineAge)
+		removed := purgeFiles(p.quarantine, func(path string, info fs.FileInfo) bool {
+			return info.ModTime().Before(cutoff)
+		})
+		if removed > 0 {
+			log.Printf("Retention: removed %d quarantined files", removed)
+			metrics.Count("retention.purged", int64(removed), "store:quarantine")
+		}
+	}
+}
+
+// purgeFiles removes the regular files below dir that match and returns
+// how many
+func purgeFiles(dir string, match func(path string, info fs.FileInfo) bool) int {
+	removed := 0
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || !match(path, info) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Warning: failed to remove %s: %v", sanitizeFilename(path), err)
+			return nil
+		}
+		removed++
+		return nil
+	})
+	return removed
+}
+
+// recordFilter selects the records of a purge request: by SHA-256 of the
+// upload or an infected file, or by a caller metadata value
+type recordFilter struct {
+	sha256 string
+	key    string // Metadata key
+	value  string // Metadata value: a string's contents, or other JSON as written
+}
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// parseRecordFilter reads ?sha256=<hex> or ?metadata=<key>=<value>; exactly
+// one must be given
+func parseRecordFilter(r *http.Request) (*recordFilter, *requestError) {
+	query := r.URL.Query()
+	hash, metadata := strings.ToLower(query.Get("sha256")), query.Get("metadata")
+	switch {
+	case (hash == "") == (metadata == ""):
+		return nil, &requestError{status: http.StatusBadRequest, message: "Give either sha256 or metadata"}
+	case hash != "":
+		if !sha256Pattern.MatchString(hash) {
+			return nil, &requestError{status: http.StatusBadRequest, message: "sha256 must be 64 hex digits"}
+		}
+		return &recordFilter{sha256: hash}, nil
+	}
+	key, value, ok := strings.Cut(metadata, "=")
+	if !ok || key == "" {
+		return nil, &requestError{status: http.StatusBadRequest, message: "metadata must be key=value"}
+	}
+	return &recordFilter{key: key, value: value}, nil
+}
+
+// matches reports whether a scan's upload hashes, threats or metadata
+// match the filter
+func (f *recordFilter) matches(hashes map[string]string, threats []Threat, metadata json.RawMessage) bool {
+	if f.sha256 != "" {
+		if strings.EqualFold(hashes["sha256"], f.sha256) {
+			return true
+		}
+		for _, threat := range threats {
+			if strings.EqualFold(threat.FileHash, f.sha256) || strings.EqualFold(threat.Hashes["sha256"], f.sha256) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var object map[string]json.RawMessage
+	if json.Unmarshal(metadata, &object) != nil {
+		return false
+	}
+	raw, ok := object[f.key]
+	if !ok {
+		return false
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s == f.value
+	}
+	return string(raw) == f.value
+}
+
+// PurgeResult counts the records removed by a purge request
+type PurgeResult struct {
+	History    int `json:"history"`
+	Jobs       int `json:"jobs"`
+	Quarantine int `json:"quarantine"`
+}
+
+// purgeRecordsHandler serves DELETE /admin/records: removes every scan
+// history record, async result and (for sha256) quarantined file matching
+// ?sha256= or ?metadata=, for erasure requests
+func purgeRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filter, reqErr := parseRecordFilter(r)
+	if reqErr != nil {
+		sendRequestError(w, reqErr)
+		return
+	}
+
+	var result PurgeResult
+	if history != nil {
+		removed, err := history.Remove(func(record *HistoryRecord) bool {
+			return filter.matches(record.Hashes, record.Threats, record.Metadata)
+		})
+		if err != nil {
+			log.Printf("Failed to rewrite scan history: %v", err)
+			sendErrorStatus(w, http.StatusInternalServerError, "Failed to purge scan history")
+			return
+		}
+		result.History = removed
+	}
+	if jobs != nil {
+		result.Jobs = jobs.Purge(func(response *ScanResponse) bool {
+			return filter.matches(response.Hashes, response.Threats, response.Metadata)
+		})
+	}
+	// Quarantined files carry no metadata
+	if filter.sha256 != "" && config.WatchQuarantineDir != "" {
+		result.Quarantine = purgeFiles(config.WatchQuarantineDir, func(path string, _ fs.FileInfo) bool {
+			hash, err := computeFileHash(path)
+			return err == nil && hash == filter.sha256
+		})
+	}
+
+	identity := "anonymous"
+	if id := identityFromContext(r.Context()); id != nil {
+		identity = id.Name
+	}
+	log.Printf("Purged records for %s: %d history, %d jobs, %d quarantined files", identity, result.History, result.Jobs, result.Quarantine)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
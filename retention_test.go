@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testSHA256 = "275a021bbfb6489e54d471899f7db9d1663fc695ec2fe2a2c4538aabf651fd0f"
+
+func TestParseRecordFilter(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    recordFilter
+		wantErr bool
+	}{
+		{"sha256=" + testSHA256, recordFilter{sha256: testSHA256}, false},
+		{"sha256=275A021BBFB6489E54D471899F7DB9D1663FC695EC2FE2A2C4538AABF651FD0F", recordFilter{sha256: testSHA256}, false},
+		{"metadata=customer=4711", recordFilter{key: "customer", value: "4711"}, false},
+		{"metadata=note=", recordFilter{key: "note"}, false},
+		{"", recordFilter{}, true},
+		{"sha256=abc", recordFilter{}, true},
+		{"metadata=customer", recordFilter{}, true},
+		{"metadata==4711", recordFilter{}, true},
+		{"sha256=" + testSHA256 + "&metadata=customer=4711", recordFilter{}, true},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodDelete, "/admin/records?"+tt.query, nil)
+		filter, reqErr := parseRecordFilter(req)
+		if tt.wantErr {
+			if reqErr == nil {
+				t.Errorf("parseRecordFilter(%q) succeeded, want error", tt.query)
+			}
+			continue
+		}
+		if reqErr != nil {
+			t.Errorf("parseRecordFilter(%q) error: %s", tt.query, reqErr.message)
+			continue
+		}
+		if *filter != tt.want {
+			t.Errorf("parseRecordFilter(%q) = %+v, want %+v", tt.query, *filter, tt.want)
+		}
+	}
+}
+
+func TestRecordFilterMatches(t *testing.T) {
+	byHash := &recordFilter{sha256: testSHA256}
+	if !byHash.matches(map[string]string{"sha256": testSHA256}, nil, nil) {
+		t.Error("upload hash not matched")
+	}
+	if !byHash.matches(nil, []Threat{{Name: "Eicar-Signature", FileHash: testSHA256}}, nil) {
+		t.Error("infected file hash not matched")
+	}
+	if byHash.matches(map[string]string{"md5": testSHA256[:32]}, []Threat{{Name: "Eicar-Signature"}}, nil) {
+		t.Error("unhashed scan matched")
+	}
+
+	metadata := json.RawMessage(`{"customer":"4711","order":42,"tags":["a"]}`)
+	tests := []struct {
+		filter recordFilter
+		want   bool
+	}{
+		{recordFilter{key: "customer", value: "4711"}, true},
+		{recordFilter{key: "customer", value: "4712"}, false},
+		{recordFilter{key: "order", value: "42"}, true},
+		{recordFilter{key: "tags", value: `["a"]`}, true},
+		{recordFilter{key: "missing", value: ""}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.matches(nil, nil, metadata); got != tt.want {
+			t.Errorf("matches(%s=%s) = %v, want %v", tt.filter.key, tt.filter.value, got, tt.want)
+		}
+	}
+	if (&recordFilter{key: "customer", value: "4711"}).matches(nil, nil, nil) {
+		t.Error("scan without metadata matched")
+	}
+}
+
+func TestRetentionPurge(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	history, _ = NewScanHistory(&Config{ScanHistorySize: 10})
+	t.Cleanup(func() { history = nil })
+	history.Add(&HistoryRecord{Time: now.Add(-72 * time.Hour), Status: "clean"})
+	history.Add(&HistoryRecord{Time: now.Add(-time.Hour), Status: "infected"})
+
+	quarantine := t.TempDir()
+	old, recent := filepath.Join(quarantine, "old.exe"), filepath.Join(quarantine, "sub", "recent.exe")
+	os.MkdirAll(filepath.Dir(recent), 0700)
+	os.WriteFile(old, []byte("old"), 0600)
+	os.WriteFile(recent, []byte("recent"), 0600)
+	os.Chtimes(old, now.Add(-10*24*time.Hour), now.Add(-10*24*time.Hour))
+	os.Chtimes(recent, now.Add(-time.Hour), now.Add(-time.Hour))
+
+	purger := NewRetentionPurger(&Config{
+		ScanHistorySize:      10,
+		ScanHistoryRetention: 48 * time.Hour,
+		WatchQuarantineDir:   quarantine,
+		QuarantineRetention:  7 * 24 * time.Hour,
+	})
+	purger.now = func() time.Time { return now }
+	purger.Purge()
+
+	if records, _ := history.Between(time.Time{}, now); len(records) != 1 || records[0].Status != "infected" {
+		t.Errorf("history after purge = %+v", records)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("quarantined file past retention not removed")
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf("recent quarantined file removed: %v", err)
+	}
+
+	if NewRetentionPurger(&Config{ScanHistorySize: 10, QuarantineRetention: time.Hour}) != nil {
+		t.Error("purger without a retention period that applies should be nil")
+	}
+}
+
+func TestPurgeRecordsHandler(t *testing.T) {
+	history, _ = NewScanHistory(&Config{ScanHistorySize: 10})
+	t.Cleanup(func() { history = nil })
+	history.Add(&HistoryRecord{Time: time.Now(), Status: "clean", Metadata: json.RawMessage(`{"customer":"4711"}`)})
+	history.Add(&HistoryRecord{Time: time.Now(), Status: "clean", Metadata: json.RawMessage(`{"customer":"4712"}`)})
+	history.Add(&HistoryRecord{Time: time.Now(), Status: "infected", Hashes: map[string]string{"sha256": testSHA256}})
+
+	useJobStore(t, NewJobStore(10, time.Minute))
+	matched, other := jobs.Create("", ""), jobs.Create("", "")
+	matched.finish(&ScanResponse{Status: "clean", Metadata: json.RawMessage(`{"customer":"4711"}`)})
+	other.finish(&ScanResponse{Status: "clean"})
+
+	quarantine := t.TempDir()
+	os.WriteFile(filepath.Join(quarantine, "eicar.com"), []byte("EICAR"), 0600)
+	config = &Config{WatchQuarantineDir: quarantine}
+
+	purge := func(query string) (int, PurgeResult) {
+		req := httptest.NewRequest(http.MethodDelete, "/admin/records?"+query, nil)
+		recorder := httptest.NewRecorder()
+		purgeRecordsHandler(recorder, req)
+		var result PurgeResult
+		json.Unmarshal(recorder.Body.Bytes(), &result)
+		return recorder.Code, result
+	}
+
+	if code, result := purge("metadata=customer=4711"); code != http.StatusOK || result != (PurgeResult{History: 1, Jobs: 1}) {
+		t.Errorf("purge by metadata = %d %+v", code, result)
+	}
+	if jobs.Get(matched.ID, "") != nil || jobs.Get(other.ID, "") == nil {
+		t.Error("purge removed the wrong jobs")
+	}
+
+	hash, _ := computeFileHash(filepath.Join(quarantine, "eicar.com"))
+	if code, result := purge("sha256=" + hash); code != http.StatusOK || result != (PurgeResult{Quarantine: 1}) {
+		t.Errorf("purge of quarantined file = %d %+v", code, result)
+	}
+	if code, result := purge("sha256=" + testSHA256); code != http.StatusOK || result != (PurgeResult{History: 1}) {
+		t.Errorf("purge by upload hash = %d %+v", code, result)
+	}
+	if records, _ := history.Between(time.Time{}, time.Now()); len(records) != 1 {
+		t.Errorf("%d history records left, want 1", len(records))
+	}
+
+	if code, _ := purge(""); code != http.StatusBadRequest {
+		t.Errorf("purge without a filter = %d, want %d", code, http.StatusBadRequest)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/admin/records?sha256="+testSHA256, nil)
+	recorder := httptest.NewRecorder()
+	purgeRecordsHandler(recorder, req)
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want %d", recorder.Code, http.StatusMethodNotAllowed)
+	}
+}
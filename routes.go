@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ScanRoutesConfig is the structure of the SCAN_ROUTES_FILE JSON document.
+//
+// Example:
+//
+//	{
+//	  "profiles": {
+//	    "mail": {"max_upload_size_mb": 50, "scan_timeout_seconds": 30, "denied_extensions": [".exe", ".scr"]},
+//	    "ci":   {"max_upload_size_mb": 2048, "max_file_count": 500000}
+//	  },
+//	  "routes": [
+//	    {"path": "/scan/mail", "profile": "mail", "scope": "mail"},
+//	    {"path": "/scan/ci", "profile": "ci", "scope": "ci"}
+//	  ]
+//	}
+type ScanRoutesConfig struct {
+	Profiles map[string]PolicyProfile `json:"profiles"`
+	Routes   []ScanRouteConfig        `json:"routes"`
+}
+
+// PolicyProfile overrides scan limits and the file policy for the routes
+// bound to it. Unset fields inherit the global configuration; an empty
+// list clears the global one.
+type PolicyProfile struct {
+	MaxUploadSizeMB    *int `json:"max_upload_size_mb"`
+	MaxExtractedSizeMB *int `json:"max_extracted_size_mb"`
+	MaxFileCount       *int `json:"max_file_count"`
+	MaxSingleFileMB    *int `json:"max_single_file_mb"`
+	ScanTimeoutSeconds *int `json:"scan_timeout_seconds"`
+
+	AllowedExtensions []string `json:"allowed_extensions"`
+	DeniedExtensions  []string `json:"denied_extensions"`
+	AllowedTypes      []string `json:"allowed_types"`
+	DeniedTypes       []string `json:"denied_types"`
+}
+
+// ScanRouteConfig declares one scan endpoint
+type ScanRouteConfig struct {
+	Path    string `json:"path"`    // URL path, e.g. "/scan/mail"
+	Profile string `json:"profile"` // Policy profile name (empty = global limits)
+	Scope   string `json:"scope"`   // Required auth scope (empty = any authenticated caller)
+}
+
+// ScanRoute is a resolved scan endpoint with its own config and scanner
+type ScanRoute struct {
+	Path    string
+	Profile string
+	Scope   string
+
+	config  *Config
+	scanner *Scanner
+}
+
+// reservedPaths cannot be claimed by scan routes, nor can paths below them
+var reservedPaths = []string{"/health", "/readyz", "/livez", "/startupz", "/version", "/.well-known", "/admin", "/scan/ws", "/scan/image", "/scan/path", "/scan/object", "/scan/remote", "/scan/batch", "/uploads", "/scan/jobs", "/scan/events", "/scan/results", "/sanitize", "/hash", "/stats", "/threats"}
+
+// isReservedPath reports whether path is or lies below a reserved path.
+// "/" is reserved too: it would catch every unmatched request.
+func isReservedPath(path string) bool {
+	if path == "/" {
+		return true
+	}
+	for _, reserved := range reservedPaths {
+		if path == reserved || strings.HasPrefix(path, reserved+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadScanRoutes reads and resolves the scan routes file.
+// Unknown fields, unknown profiles, duplicate paths and profile limits
+// outside the ranges the global config allows are rejected.
+func LoadScanRoutes(path string, base *Config) ([]*ScanRoute, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scan routes file: %w", err)
+	}
+	defer f.Close()
+
+	var routesConfig ScanRoutesConfig
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&routesConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse scan routes file: %w", err)
+	}
+
+	return resolveScanRoutes(&routesConfig, base)
+}
+
+// resolveScanRoutes validates route declarations and builds per-route configs
+func resolveScanRoutes(routesConfig *ScanRoutesConfig, base *Config) ([]*ScanRoute, error) {
+	seen := make(map[string]bool)
+	var routes []*ScanRoute
+
+	for _, rc := range routesConfig.Routes {
+		if !strings.HasPrefix(rc.Path, "/") {
+			return nil, fmt.Errorf("route path %q must start with /", rc.Path)
+		}
+		if isReservedPath(rc.Path) {
+			return nil, fmt.Errorf("route path %q is reserved", rc.Path)
+		}
+		// A route also serves PUT {path}/{filename}, so /x and /x/ collide
+		key := strings.TrimSuffix(rc.Path, "/")
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate route path %q", rc.Path)
+		}
+		seen[key] = true
+
+		routeConfig := *base
+		if rc.Profile != "" {
+			profile, ok := routesConfig.Profiles[rc.Profile]
+			if !ok {
+				return nil, fmt.Errorf("route %q references unknown profile %q", rc.Path, rc.Profile)
+			}
+			profile.apply(&routeConfig)
+
+			var errs []error
+			routeConfig.checkScanLimits(func(ok bool, format string, args ...any) {
+				if !ok {
+					errs = append(errs, fmt.Errorf(format, args...))
+				}
+			})
+			if len(errs) > 0 {
+				return nil, fmt.Errorf("route %q: profile %q: %w", rc.Path, rc.Profile, errors.Join(errs...))
+			}
+		}
+
+		routes = append(routes, &ScanRoute{
+			Path:    rc.Path,
+			Profile: rc.Profile,
+			Scope:   rc.Scope,
+			config:  &routeConfig,
+			scanner: NewScanner(&routeConfig),
+		})
+	}
+
+	return routes, nil
+}
+
+// apply overrides the config fields set in the profile
+func (p PolicyProfile) apply(c *Config) {
+	if p.MaxUploadSizeMB != nil {
+		c.MaxUploadSize = int64(*p.MaxUploadSizeMB) << 20
+	}
+	if p.MaxExtractedSizeMB != nil {
+		c.MaxExtractedSize = int64(*p.MaxExtractedSizeMB) << 20
+	}
+	if p.MaxFileCount != nil {
+		c.MaxFileCount = *p.MaxFileCount
+	}
+	if p.MaxSingleFileMB != nil {
+		// A negative size becomes 0 rather than wrapping, so the range check
+		// rejects it
+		c.MaxSingleFileSize = uint64(max(*p.MaxSingleFileMB, 0)) << 20
+	} else if p.MaxUploadSizeMB != nil && c.MaxUploadSize > 0 && uint64(c.MaxUploadSize) < c.MaxSingleFileSize {
+		// An inherited single-file limit above the profile's upload limit
+		// is lowered to it, rather than rejected like an explicit one
+		c.MaxSingleFileSize = uint64(c.MaxUploadSize)
+	}
+	if p.ScanTimeoutSeconds != nil {
+		c.ScanTimeout = time.Duration(*p.ScanTimeoutSeconds) * time.Second
+	}
+	if p.AllowedExtensions != nil {
+		c.AllowedExtensions = p.AllowedExtensions
+	}
+	if p.DeniedExtensions != nil {
+		c.DeniedExtensions = p.DeniedExtensions
+	}
+	if p.AllowedTypes != nil {
+		c.AllowedTypes = p.AllowedTypes
+	}
+	if p.DeniedTypes != nil {
+		c.DeniedTypes = p.DeniedTypes
+	}
+}
+
+// Handler returns the HTTP handler for the route, including the scope check
+func (route *ScanRoute) Handler() http.Handler {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleScan(w, r, route.config, route.scanner)
+	})
+	return requireScope(route.Scope, handler)
+}
+
+// LogRoute logs the effective limits of the route
+func (route *ScanRoute) LogRoute() {
+	scope := route.Scope
+	if scope == "" {
+		scope = "(any)"
+	}
+	log.Printf("  Route %s: profile=%q scope=%s upload=%dMB extracted=%dMB files=%d single=%dMB timeout=%v",
+		route.Path, route.Profile, scope,
+		route.config.MaxUploadSize>>20, route.config.MaxExtractedSize>>20,
+		route.config.MaxFileCount, route.config.MaxSingleFileSize>>20, route.config.ScanTimeout)
+}
+
+// requireScope wraps a handler so it only runs when the caller holds the scope.
+// Must be used behind requireAuth. An empty scope allows any caller.
+func requireScope(scope string, next http.Handler) http.Handler {
+	if scope == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := identityFromContext(r.Context())
+		if identity == nil || !identity.HasScope(scope) {
+			name := "unknown"
+			if identity != nil {
+				name = identity.Name
+			}
+			log.Printf("Access denied to %s for %s: missing scope %q", r.URL.Path, name, scope)
+			sendErrorStatus(w, http.StatusForbidden, "Access denied")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
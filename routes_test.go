@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadScanRoutes(t *testing.T) {
+	base := &Config{
+		MaxUploadSize:     512 << 20,
+		MaxExtractedSize:  1024 << 20,
+		MaxFileCount:      100000,
+		MaxSingleFileSize: 256 << 20,
+		ScanTimeout:       5 * time.Minute,
+		DeniedTypes:       []string{"application/x-executable"},
+	}
+
+	t.Run("applies profile overrides", func(t *testing.T) {
+		path := writeRoutesFile(t, `{
+			"profiles": {"mail": {"max_upload_size_mb": 50, "scan_timeout_seconds": 30, "denied_extensions": [".exe"], "denied_types": []}},
+			"routes": [
+				{"path": "/scan/mail", "profile": "mail", "scope": "mail"},
+				{"path": "/scan/uploads"}
+			]
+		}`)
+
+		routes, err := LoadScanRoutes(path, base)
+		if err != nil {
+			t.Fatalf("LoadScanRoutes() error: %v", err)
+		}
+		if len(routes) != 2 {
+			t.Fatalf("got %d routes, want 2", len(routes))
+		}
+
+		mail := routes[0]
+		if mail.config.MaxUploadSize != 50<<20 {
+			t.Errorf("MaxUploadSize = %d, want %d", mail.config.MaxUploadSize, 50<<20)
+		}
+		if mail.config.ScanTimeout != 30*time.Second {
+			t.Errorf("ScanTimeout = %v, want 30s", mail.config.ScanTimeout)
+		}
+		if mail.config.MaxSingleFileSize != 50<<20 {
+			t.Errorf("MaxSingleFileSize = %d, want it lowered to the upload limit", mail.config.MaxSingleFileSize)
+		}
+		if mail.config.MaxFileCount != base.MaxFileCount {
+			t.Errorf("MaxFileCount = %d, want inherited %d", mail.config.MaxFileCount, base.MaxFileCount)
+		}
+		if len(mail.config.DeniedExtensions) != 1 || len(mail.config.DeniedTypes) != 0 {
+			t.Errorf("file policy = %v, %v; want [.exe] and the global types cleared", mail.config.DeniedExtensions, mail.config.DeniedTypes)
+		}
+		if mail.Scope != "mail" {
+			t.Errorf("Scope = %q, want mail", mail.Scope)
+		}
+
+		if routes[1].config.MaxUploadSize != base.MaxUploadSize {
+			t.Errorf("route without profile changed MaxUploadSize")
+		}
+		if base.MaxUploadSize != 512<<20 {
+			t.Errorf("base config was modified")
+		}
+	})
+
+	errorCases := []struct {
+		name    string
+		content string
+	}{
+		{name: "unknown profile", content: `{"routes": [{"path": "/scan/x", "profile": "missing"}]}`},
+		{name: "duplicate path", content: `{"routes": [{"path": "/scan/x"}, {"path": "/scan/x"}]}`},
+		{name: "reserved path", content: `{"routes": [{"path": "/health"}]}`},
+		{name: "below reserved path", content: `{"routes": [{"path": "/scan/jobs/x"}]}`},
+		{name: "duplicate path with slash", content: `{"routes": [{"path": "/scan/x"}, {"path": "/scan/x/"}]}`},
+		{name: "relative path", content: `{"routes": [{"path": "scan/x"}]}`},
+		{name: "root path", content: `{"routes": [{"path": "/"}]}`},
+		{name: "zero file count", content: `{"profiles": {"p": {"max_file_count": 0}}, "routes": [{"path": "/scan/x", "profile": "p"}]}`},
+		{name: "negative upload size", content: `{"profiles": {"p": {"max_upload_size_mb": -1}}, "routes": [{"path": "/scan/x", "profile": "p"}]}`},
+		{name: "negative single file size", content: `{"profiles": {"p": {"max_single_file_mb": -1}}, "routes": [{"path": "/scan/x", "profile": "p"}]}`},
+		{name: "single file above upload size", content: `{"profiles": {"p": {"max_upload_size_mb": 10, "max_single_file_mb": 20}}, "routes": [{"path": "/scan/x", "profile": "p"}]}`},
+		{name: "zero extracted size", content: `{"profiles": {"p": {"max_extracted_size_mb": 0}}, "routes": [{"path": "/scan/x", "profile": "p"}]}`},
+		{name: "zero timeout", content: `{"profiles": {"p": {"scan_timeout_seconds": 0}}, "routes": [{"path": "/scan/x", "profile": "p"}]}`},
+		{name: "invalid extension", content: `{"profiles": {"p": {"denied_extensions": ["*"]}}, "routes": [{"path": "/scan/x", "profile": "p"}]}`},
+		{name: "unknown field", content: `{"routes": [{"path": "/scan/x", "max_upload": 1}]}`},
+		{name: "invalid json", content: `{"routes": [`},
+	}
+
+	for _, tt := range errorCases {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeRoutesFile(t, tt.content)
+			if _, err := LoadScanRoutes(path, base); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		if _, err := LoadScanRoutes("/nonexistent/routes.json", base); err == nil {
+			t.Error("expected error for missing file")
+		}
+	})
+}
+
+func TestScanRouteTimeoutLimit(t *testing.T) {
+	base := &Config{MaxUploadSize: 512 << 20, MaxExtractedSize: 1024 << 20, MaxFileCount: 100000, MaxSingleFileSize: 256 << 20, ScanTimeout: 5 * time.Minute}
+	routes, err := LoadScanRoutes(writeRoutesFile(t, `{
+		"profiles": {"mail": {"scan_timeout_seconds": 30}},
+		"routes": [{"path": "/scan/mail", "profile": "mail"}]
+	}`), base)
+	if err != nil {
+		t.Fatalf("LoadScanRoutes() error: %v", err)
+	}
+
+	// Requested timeouts are clamped to the route's own limit, not the
+	// global one
+	var got time.Duration
+	handler := limitScanTimeout(routes[0].config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = scanTimeout(r.Context(), 0)
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/scan/mail", nil)
+	req.Header.Set(scanTimeoutHeader, "120")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got != 30*time.Second {
+		t.Errorf("scan timeout = %v, want the route's 30s", got)
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	handler := requireScope("mail", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name     string
+		identity *Identity
+		want     int
+	}{
+		{name: "has scope", identity: &Identity{Name: "gw", Scopes: []string{"mail"}}, want: http.StatusOK},
+		{name: "missing scope", identity: &Identity{Name: "ci", Scopes: []string{"ci"}}, want: http.StatusForbidden},
+		{name: "no identity", identity: nil, want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/scan/mail", nil)
+			if tt.identity != nil {
+				req = req.WithContext(context.WithValue(req.Context(), identityKey{}, tt.identity))
+			}
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.want {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanRouteHandlerMethodNotAllowed(t *testing.T) {
+	routes, err := resolveScanRoutes(&ScanRoutesConfig{
+		Routes: []ScanRouteConfig{{Path: "/scan/ci"}},
+	}, &Config{MaxUploadSize: 10 << 20})
+	if err != nil {
+		t.Fatalf("resolveScanRoutes() error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/scan/ci", nil)
+	recorder := httptest.NewRecorder()
+
+	routes[0].Handler().ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+// Helper function to write a scan routes file
+func writeRoutesFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write routes file: %v", err)
+	}
+	return path
+}
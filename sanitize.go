@@ -0,0 +1,498 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Document formats POST /sanitize can disarm
+const (
+	formatPDF   = "pdf"
+	formatOOXML = "ooxml"
+)
+
+// Active content removed by the sanitizer, as listed in X-Sanitized
+const (
+	removedMacros     = indicatorMacros // VBA project of an OOXML document
+	removedJavaScript = "javascript"    // PDF JavaScript actions and name tree
+	removedLaunch     = "launch"        // PDF actions that start programs
+)
+
+// errNotDisarmable is returned for PDFs with active content the sanitizer
+// can't rewrite in place, such as inside a compressed object stream
+var errNotDisarmable = errors.New("active content can't be removed")
+
+// sanitizeHandler handles POST /sanitize: the upload is scanned like with
+// POST /scan and, if clean, returned with its macros or JavaScript removed.
+// Verdicts other than clean are answered with the JSON scan response
+// instead of the document.
+func sanitizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	startTime := time.Now()
+	if rejectWhileStarting(w, r, startTime) {
+		return
+	}
+
+	upload, reqErr := receiveUpload(r.Context(), w, r, config)
+	if reqErr != nil {
+		recordScan(scanTags(r), "rejected", time.Since(startTime), 0, nil)
+		sendRequestError(w, reqErr)
+		return
+	}
+	defer upload.remove()
+
+	format := documentFormat(upload.path)
+	if format == "" {
+		sendErrorStatus(w, http.StatusUnsupportedMediaType, "Only PDF and Office Open XML documents can be sanitized")
+		return
+	}
+	if format == formatPDF && uint64(upload.size) > config.MaxSingleFileSize {
+		sendErrorStatus(w, http.StatusRequestEntityTooLarge, "PDF too large to sanitize")
+		return
+	}
+	response, reqErr := executeScan(r.Context(), r, config, scanner, upload, startTime)
+	if reqErr != nil {
+		sendRequestError(w, reqErr)
+		return
+	}
+	if response.Status != "clean" {
+		writeScanResponse(w, response)
+		return
+	}
+
+	out, err := os.CreateTemp(scanTmpDir, "clamav-scan-*")
+	if err != nil {
+		log.Printf("Failed to create sanitized file for %s: %v", upload.safeFilename, err)
+		sendErrorStatus(w, http.StatusInternalServerError, "Sanitization failed")
+		return
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	var removed []string
+	if format == formatPDF {
+		removed, err = disarmPDF(upload.path, out, config.MaxSingleFileSize)
+	} else {
+		removed, err = disarmOOXML(upload.path, out)
+	}
+	if errors.Is(err, errNotDisarmable) {
+		log.Printf("Cannot sanitize %s: %v", upload.safeFilename, err)
+		sendErrorStatus(w, http.StatusUnprocessableEntity, "Document has active content that can't be removed")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to sanitize %s: %v", upload.safeFilename, err)
+		sendErrorStatus(w, http.StatusInternalServerError, "Sanitization failed")
+		return
+	}
+	if len(removed) > 0 {
+		metrics.Count("sanitize.disarmed", 1)
+	}
+	log.Printf("Sanitized %s: removed %v", upload.safeFilename, removed)
+
+	size, err := out.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = out.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		sendErrorStatus(w, http.StatusInternalServerError, "Sanitization failed")
+		return
+	}
+	sendDisarmed(w, out, size, upload.filename, format, removed)
+}
+
+// sendDisarmed sends the disarmed document as an attachment, with the
+// verdict and what was removed in the X-Scan-Status and X-Sanitized headers
+func sendDisarmed(w http.ResponseWriter, body io.Reader, size int64, filename, format string, removed []string) {
+	name := filepath.Base(strings.ReplaceAll(filename, "\\", "/"))
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if format == formatPDF {
+		contentType = "application/pdf"
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	sanitized := "none"
+	if len(removed) > 0 {
+		sanitized = strings.Join(removed, ",")
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", fmt.Sprint(size))
+	if disposition := mime.FormatMediaType("attachment", map[string]string{"filename": name}); name != "." && disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	w.Header().Set("X-Scan-Status", "clean")
+	w.Header().Set("X-Sanitized", sanitized)
+	io.Copy(w, body)
+}
+
+// documentFormat returns the format of a saved upload by its content, or
+// "" if it can't be sanitized
+func documentFormat(filePath string) string {
+	if filePath == "" {
+		return ""
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	head := make([]byte, 1024)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	// Readers accept the header anywhere in the first kilobyte
+	if bytes.Contains(head, []byte("%PDF-")) {
+		return formatPDF
+	}
+	if !bytes.HasPrefix(head, []byte("PK\x03\x04")) {
+		return ""
+	}
+	reader, err := zip.OpenReader(filePath)
+	if err != nil {
+		return ""
+	}
+	defer reader.Close()
+	for _, file := range reader.File {
+		if file.Name == "[Content_Types].xml" {
+			return formatOOXML
+		}
+	}
+	return ""
+}
+
+// vbaParts are the OOXML part names of a VBA project, next to the main
+// document part (e.g. word/vbaProject.bin)
+var vbaParts = map[string]bool{
+	"vbaproject.bin":               true,
+	"vbadata.xml":                  true,
+	"vbaprojectsignature.bin":      true,
+	"vbaprojectsignatureagile.bin": true,
+	"vbaprojectsignaturev3.bin":    true,
+}
+
+// isVBAPart reports whether an OOXML part belongs to a VBA project
+func isVBAPart(name string) bool {
+	parts := strings.Split(name, "/")
+	return len(parts) == 2 && vbaParts[strings.ToLower(parts[1])]
+}
+
+// Relationship and content type override elements, and their attributes
+var (
+	relationshipElement = regexp.MustCompile(`<Relationship\s[^>]*>`)
+	overrideElement     = regexp.MustCompile(`<Override\s[^>]*>`)
+	targetAttribute     = regexp.MustCompile(`\sTarget="([^"]*)"`)
+	partNameAttribute   = regexp.MustCompile(`\sPartName="([^"]*)"`)
+	externalAttribute   = regexp.MustCompile(`\sTargetMode="External"`)
+)
+
+// disarmOOXML writes the document at filePath to out without its VBA
+// project, the relationships to it and its content type overrides. Other
+// parts are copied unchanged. The document keeps its macro-enabled content
+// type, so it still opens under its .docm, .xlsm or .pptm name.
+func disarmOOXML(filePath string, out io.Writer) ([]string, error) {
+	reader, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	dropped := make(map[string]bool)
+	for _, file := range reader.File {
+		if isVBAPart(file.Name) {
+			dropped[file.Name] = true
+			// The project's own relationships, e.g. to vbaData.xml
+			dir, name := path.Split(file.Name)
+			dropped[dir+"_rels/"+name+".rels"] = true
+		}
+	}
+
+	writer := zip.NewWriter(out)
+	for _, file := range reader.File {
+		if dropped[file.Name] {
+			continue
+		}
+		var edit func([]byte) []byte
+		switch {
+		case len(dropped) > 0 && file.Name == "[Content_Types].xml":
+			edit = func(data []byte) []byte {
+				return removeElements(overrideElement, data, func(element []byte) bool {
+					name := partNameAttribute.FindSubmatch(element)
+					return name != nil && dropped[strings.TrimPrefix(string(name[1]), "/")]
+				})
+			}
+		case len(dropped) > 0 && strings.HasSuffix(file.Name, ".rels"):
+			base := relationshipBase(file.Name)
+			edit = func(data []byte) []byte {
+				return removeElements(relationshipElement, data, func(element []byte) bool {
+					target := targetAttribute.FindSubmatch(element)
+					return target != nil && !externalAttribute.Match(element) && dropped[resolvePart(base, string(target[1]))]
+				})
+			}
+		}
+		if edit == nil {
+			if err := writer.Copy(file); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := rewriteEntry(writer, file, edit); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if len(dropped) == 0 {
+		return nil, nil
+	}
+	return []string{removedMacros}, nil
+}
+
+// rewriteEntry writes a zip entry with its content changed by edit
+func rewriteEntry(writer *zip.Writer, file *zip.File, edit func([]byte) []byte) error {
+	rc, err := file.Open()
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	header := file.FileHeader
+	w, err := writer.CreateHeader(&zip.FileHeader{Name: header.Name, Method: header.Method, Modified: header.Modified})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(edit(data))
+	return err
+}
+
+// removeElements removes the matches of element from data for which drop
+// returns true
+func removeElements(element *regexp.Regexp, data []byte, drop func([]byte) bool) []byte {
+	return element.ReplaceAllFunc(data, func(match []byte) []byte {
+		if drop(match) {
+			return nil
+		}
+		return match
+	})
+}
+
+// relationshipBase returns the directory relationship targets in a .rels
+// part are relative to, e.g. "word" for word/_rels/document.xml.rels
+func relationshipBase(relsName string) string {
+	return path.Dir(path.Dir(relsName))
+}
+
+// resolvePart resolves a relationship target to a part name
+func resolvePart(base, target string) string {
+	if strings.HasPrefix(target, "/") {
+		return strings.TrimPrefix(path.Clean(target), "/")
+	}
+	return strings.TrimPrefix(path.Clean(path.Join("/", base, target)), "/")
+}
+
+// pdfActiveNames maps the PDF names that run code to what they are
+// reported as: JavaScript actions and the document's JavaScript name tree,
+// and launch actions
+var pdfActiveNames = map[string]string{
+	"JavaScript": removedJavaScript,
+	"JS":         removedJavaScript,
+	"Launch":     removedLaunch,
+}
+
+// disarmPDF writes the PDF at filePath to out with every JavaScript, JS
+// and Launch name overwritten by X's of the same length. Readers ignore the
+// unknown action types and keys, and since no byte moves, the
+// cross-reference table stays valid. Object streams are only checked: if
+// one holds such a name, errNotDisarmable is returned. The PDF is read into
+// memory, so must not be larger than maxSize.
+func disarmPDF(filePath string, out io.Writer, maxSize uint64) ([]string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(info.Size()) > maxSize {
+		return nil, fmt.Errorf("PDF larger than %d bytes", maxSize)
+	}
+	held := extractBudget.acquire(info.Size())
+	defer extractBudget.release(held)
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]bool)
+	for i := 0; i < len(data); {
+		switch {
+		case data[i] == '/':
+			i = disarmPDFName(data, i, found)
+		case isPDFKeyword(data, i, "stream"):
+			end, err := checkPDFStream(data, i, maxSize)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+		default:
+			i++
+		}
+	}
+	if _, err := out.Write(data); err != nil {
+		return nil, err
+	}
+
+	removed := make([]string, 0, len(found))
+	for kind := range found {
+		removed = append(removed, kind)
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// disarmPDFName overwrites the name starting at data[start] ('/') if it is
+// one of pdfActiveNames, and returns the offset after it
+func disarmPDFName(data []byte, start int, found map[string]bool) int {
+	end := start + 1
+	for end < len(data) && !isPDFDelimiter(data[end]) {
+		end++
+	}
+	if kind, ok := pdfActiveNames[decodePDFName(data[start+1:end])]; ok {
+		found[kind] = true
+		for i := start + 1; i < end; i++ {
+			data[i] = 'X'
+		}
+	}
+	return end
+}
+
+// pdfActiveNameIn reports whether data holds one of pdfActiveNames
+func pdfActiveNameIn(data []byte) bool {
+	for i := 0; i < len(data); i++ {
+		if data[i] != '/' {
+			continue
+		}
+		end := i + 1
+		for end < len(data) && !isPDFDelimiter(data[end]) {
+			end++
+		}
+		if _, ok := pdfActiveNames[decodePDFName(data[i+1:end])]; ok {
+			return true
+		}
+		i = end - 1
+	}
+	return false
+}
+
+// checkPDFStream skips the stream whose keyword starts at data[start] and
+// returns the offset after its endstream. Compressed object streams are
+// inflated (up to maxSize) and checked for active names.
+func checkPDFStream(data []byte, start int, maxSize uint64) (int, error) {
+	body := start + len("stream")
+	if body < len(data) && data[body] == '\r' {
+		body++
+	}
+	if body < len(data) && data[body] == '\n' {
+		body++
+	}
+	end := bytes.Index(data[body:], []byte("endstream"))
+	if end < 0 {
+		return len(data), nil
+	}
+	end += body
+
+	dict := data[:start]
+	if obj := bytes.LastIndex(dict, []byte("obj")); obj >= 0 {
+		dict = dict[obj:]
+	}
+	if !bytes.Contains(dict, []byte("/ObjStm")) {
+		return end + len("endstream"), nil
+	}
+	if !bytes.Contains(dict, []byte("/FlateDecode")) || bytes.Contains(dict, []byte("/DecodeParms")) {
+		return 0, fmt.Errorf("%w: object stream filter not supported", errNotDisarmable)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data[body:end]))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errNotDisarmable, err)
+	}
+	inflated, err := io.ReadAll(io.LimitReader(zr, int64(maxSize)))
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, fmt.Errorf("%w: %v", errNotDisarmable, err)
+	}
+	if pdfActiveNameIn(inflated) {
+		return 0, fmt.Errorf("%w: in a compressed object stream", errNotDisarmable)
+	}
+	return end + len("endstream"), nil
+}
+
+// isPDFKeyword reports whether the keyword starts at data[i] as a token of
+// its own
+func isPDFKeyword(data []byte, i int, keyword string) bool {
+	if !bytes.HasPrefix(data[i:], []byte(keyword)) {
+		return false
+	}
+	if i > 0 && !isPDFDelimiter(data[i-1]) {
+		return false
+	}
+	next := i + len(keyword)
+	return next == len(data) || isPDFDelimiter(data[next])
+}
+
+// isPDFDelimiter reports whether c ends a PDF name or keyword
+func isPDFDelimiter(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ', '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+// decodePDFName decodes the #xx escapes of a PDF name (without its slash)
+func decodePDFName(raw []byte) string {
+	if !bytes.Contains(raw, []byte("#")) {
+		return string(raw)
+	}
+	var name strings.Builder
+	for i := 0; i < len(raw); i++ {
+		if raw[i] == '#' && i+2 < len(raw) && isHex(raw[i+1]) && isHex(raw[i+2]) {
+			name.WriteByte(unhex(raw[i+1])<<4 | unhex(raw[i+2]))
+			i += 2
+			continue
+		}
+		name.WriteByte(raw[i])
+	}
+	return name.String()
+}
+
+// isHex reports whether c is a hexadecimal digit
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// unhex returns the value of a hexadecimal digit
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c >= 'a':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testPDF has a JavaScript open action (one name hex-escaped) and a
+// binary stream that happens to contain "/JS"
+const testPDF = "%PDF-1.7\n" +
+	"1 0 obj\n<< /Type /Catalog /Pages 2 0 R /OpenAction << /S /JavaScript /J#53 (app.alert(1)) >> >>\nendobj\n" +
+	"2 0 obj\n<< /Type /Pages /Kids [] /Count 0 >>\nendobj\n" +
+	"3 0 obj\n<< /Length 8 >>\nstream\n\x00\x01/JS \x02\x03\nendstream\nendobj\n" +
+	"trailer\n<< /Root 1 0 R >>\n%%EOF\n"
+
+func writeTestPDF(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "doc.pdf")
+	writeTestFile(t, path, content)
+	return path
+}
+
+func TestDisarmPDF(t *testing.T) {
+	var out bytes.Buffer
+	removed, err := disarmPDF(writeTestPDF(t, testPDF), &out, 1<<20)
+	if err != nil {
+		t.Fatalf("disarmPDF() error: %v", err)
+	}
+	if !reflect.DeepEqual(removed, []string{removedJavaScript}) {
+		t.Errorf("removed = %v, want [javascript]", removed)
+	}
+	got := out.String()
+	if len(got) != len(testPDF) {
+		t.Errorf("disarmed PDF has %d bytes, want %d", len(got), len(testPDF))
+	}
+	if !strings.Contains(got, "/S /XXXXXXXXXX /XXXX (app.alert(1))") {
+		t.Errorf("JavaScript action not disarmed:\n%s", got)
+	}
+	if !strings.Contains(got, "\x00\x01/JS \x02\x03") {
+		t.Error("stream data was changed")
+	}
+}
+
+func TestDisarmPDFObjectStream(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write([]byte("1 0 << /S /Launch /F (calc.exe) >>"))
+	zw.Close()
+	content := "%PDF-1.7\n4 0 obj\n<< /Type /ObjStm /N 1 /First 4 /Filter /FlateDecode >>\nstream\n" +
+		compressed.String() + "\nendstream\nendobj\n%%EOF\n"
+
+	_, err := disarmPDF(writeTestPDF(t, content), io.Discard, 1<<20)
+	if !errors.Is(err, errNotDisarmable) {
+		t.Errorf("disarmPDF() error = %v, want errNotDisarmable", err)
+	}
+}
+
+func TestDisarmOOXML(t *testing.T) {
+	doc := zipBytes(t, zip.Deflate,
+		[2]string{"[Content_Types].xml", `<Types><Default Extension="bin" ContentType="application/vnd.ms-office.vbaProject"/>` +
+			`<Override PartName="/word/document.xml" ContentType="application/vnd.ms-word.document.macroEnabled.main+xml"/>` +
+			`<Override PartName="/word/vbaData.xml" ContentType="application/vnd.ms-word.vbaData+xml"/></Types>`},
+		[2]string{"word/document.xml", "<w:document/>"},
+		[2]string{"word/_rels/document.xml.rels", `<Relationships>` +
+			`<Relationship Id="rId1" Type="http://schemas.microsoft.com/office/2006/relationships/vbaProject" Target="vbaProject.bin"/>` +
+			`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+			`<Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/hyperlink" Target="vbaProject.bin" TargetMode="External"/>` +
+			`</Relationships>`},
+		[2]string{"word/styles.xml", "<w:styles/>"},
+		[2]string{"word/vbaProject.bin", "VBA"},
+		[2]string{"word/_rels/vbaProject.bin.rels", `<Relationships><Relationship Id="rId1" Target="vbaData.xml"/></Relationships>`},
+		[2]string{"word/vbaData.xml", "<wne:vbaSuppData/>"},
+	)
+	path := filepath.Join(t.TempDir(), "doc.docm")
+	writeTestFile(t, path, string(doc))
+
+	var out bytes.Buffer
+	removed, err := disarmOOXML(path, &out)
+	if err != nil {
+		t.Fatalf("disarmOOXML() error: %v", err)
+	}
+	if !reflect.DeepEqual(removed, []string{removedMacros}) {
+		t.Errorf("removed = %v, want [vba_macros]", removed)
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("disarmed document is not a zip: %v", err)
+	}
+	parts := make(map[string]string)
+	var names []string
+	for _, f := range reader.File {
+		rc, _ := f.Open()
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		parts[f.Name] = string(data)
+		names = append(names, f.Name)
+	}
+	want := []string{"[Content_Types].xml", "word/document.xml", "word/_rels/document.xml.rels", "word/styles.xml"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("parts = %v, want %v", names, want)
+	}
+	if rels := parts["word/_rels/document.xml.rels"]; strings.Contains(rels, `"rId1"`) || !strings.Contains(rels, `"rId2"`) || !strings.Contains(rels, `"rId3"`) {
+		t.Errorf("relationships = %s, want only the VBA project's removed", rels)
+	}
+	if types := parts["[Content_Types].xml"]; strings.Contains(types, "vbaData") || !strings.Contains(types, "/word/document.xml") {
+		t.Errorf("content types = %s, want only the vbaData override removed", types)
+	}
+}
+
+func TestDocumentFormat(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"doc.pdf":  testPDF,
+		"doc.docx": string(zipBytes(t, zip.Store, [2]string{"[Content_Types].xml", "<Types/>"})),
+		"data.zip": string(zipBytes(t, zip.Store, [2]string{"a.txt", "a"})),
+		"note.txt": "hello",
+	}
+	want := map[string]string{"doc.pdf": formatPDF, "doc.docx": formatOOXML, "data.zip": "", "note.txt": ""}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		writeTestFile(t, path, content)
+		if got := documentFormat(path); got != want[name] {
+			t.Errorf("documentFormat(%s) = %q, want %q", name, got, want[name])
+		}
+	}
+}
+
+func TestSanitizeHandler(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	oldConfig, oldScanner := config, scanner
+	config, scanner = cfg, NewScanner(cfg)
+	t.Cleanup(func() { config, scanner = oldConfig, oldScanner })
+
+	post := func(filename, content string) *httptest.ResponseRecorder {
+		body, contentType := multipartUpload(t, filename, []byte(content))
+		req := httptest.NewRequest(http.MethodPost, "/sanitize", body)
+		req.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+		sanitizeHandler(recorder, req)
+		return recorder
+	}
+
+	recorder := post("invoice.pdf", testPDF)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/pdf" {
+		t.Fatalf("clean PDF: status %d, Content-Type %q; body %s", recorder.Code, recorder.Header().Get("Content-Type"), recorder.Body)
+	}
+	if recorder.Header().Get("X-Scan-Status") != "clean" || recorder.Header().Get("X-Sanitized") != "javascript" {
+		t.Errorf("headers = %v, want clean and javascript", recorder.Header())
+	}
+	if disposition := recorder.Header().Get("Content-Disposition"); disposition != `attachment; filename=invoice.pdf` {
+		t.Errorf("Content-Disposition = %q", disposition)
+	}
+	if strings.Contains(recorder.Body.String(), "/JavaScript") {
+		t.Error("returned PDF still has JavaScript")
+	}
+
+	recorder = post("infected.pdf", "%PDF-1.7\nEICAR\n%%EOF\n")
+	var response ScanResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if recorder.Code != http.StatusOK || response.Status != "infected" || recorder.Header().Get("X-Sanitized") != "" {
+		t.Errorf("infected PDF: status %d, verdict %q; want the JSON infected response", recorder.Code, response.Status)
+	}
+
+	if recorder := post("note.txt", "hello"); recorder.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("text file: status %d, want 415", recorder.Code)
+	}
+}
+
+func TestResolvePart(t *testing.T) {
+	tests := []struct{ base, target, want string }{
+		{"word", "vbaProject.bin", "word/vbaProject.bin"},
+		{"word", "../customXml/item1.xml", "customXml/item1.xml"},
+		{".", "word/document.xml", "word/document.xml"},
+		{"xl", "/xl/vbaProject.bin", "xl/vbaProject.bin"},
+	}
+	for _, tt := range tests {
+		if got := resolvePart(tt.base, tt.target); got != tt.want {
+			t.Errorf("resolvePart(%q, %q) = %q, want %q", tt.base, tt.target, got, tt.want)
+		}
+	}
+	if base := relationshipBase("_rels/.rels"); base != "." {
+		t.Errorf("relationshipBase(_rels/.rels) = %q, want .", base)
+	}
+}
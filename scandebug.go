@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// Longest raw scanner output returned in a debug block
+const debugOutputLimit = 64 << 10
+
+// ScanDebug is the raw exchange with ClamAV behind a verdict, returned with
+// LOG_LEVEL=debug or, for admin callers, ?debug=true
+type ScanDebug struct {
+	Scanner   string   `json:"scanner"`             // "clamdscan" or "clamd"
+	Command   []string `json:"command"`             // clamdscan path and arguments, or the clamd command
+	Output    string   `json:"output"`              // Raw output: clamdscan's, or clamd's reply per file
+	Truncated bool     `json:"truncated,omitempty"` // Output was cut at 64 KiB
+}
+
+// scanDebugKey is the context key for the ScanDebug a scan records into
+type scanDebugKey struct{}
+
+// withScanDebug returns a context whose scan records its ClamAV exchange
+// into the returned ScanDebug. Retries overwrite earlier attempts.
+func withScanDebug(ctx context.Context) (context.Context, *ScanDebug) {
+	debug := &ScanDebug{}
+	return context.WithValue(ctx, scanDebugKey{}, debug), debug
+}
+
+// recordScanDebug records a ClamAV run, if the scan is being debugged
+func recordScanDebug(ctx context.Context, scanner string, command []string, output string) {
+	debug, ok := ctx.Value(scanDebugKey{}).(*ScanDebug)
+	if !ok {
+		return
+	}
+	debug.Scanner, debug.Command, debug.Output, debug.Truncated = scanner, command, output, false
+	if len(output) > debugOutputLimit {
+		debug.Output, debug.Truncated = output[:debugOutputLimit], true
+	}
+}
+
+// wantsDebug reports whether the response should carry the scan's debug
+// block: always in debug mode, otherwise when an admin asks with ?debug=true
+func wantsDebug(r *http.Request, config *Config) bool {
+	if config.DebugMode {
+		return true
+	}
+	if debug := r.URL.Query().Get("debug"); debug != "true" && debug != "1" {
+		return false
+	}
+	identity := identityFromContext(r.Context())
+	return identity != nil && identity.HasScope(adminScope)
+}
+
+// recorded returns the debug block for a response, or nil if the scan was
+// not debugged or never reached ClamAV
+func (d *ScanDebug) recorded() *ScanDebug {
+	if d == nil || d.Scanner == "" {
+		return nil
+	}
+	return d
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWantsDebug(t *testing.T) {
+	admin := &Identity{Name: "ops", Scopes: []string{adminScope}}
+	tests := []struct {
+		name     string
+		target   string
+		identity *Identity
+		debug    bool
+		want     bool
+	}{
+		{"off", "/scan", admin, false, false},
+		{"admin", "/scan?debug=true", admin, false, true},
+		{"not admin", "/scan?debug=true", &Identity{Name: "ci"}, false, false},
+		{"anonymous", "/scan?debug=1", nil, false, false},
+		{"debug mode", "/scan", nil, true, true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.target, nil)
+		if tt.identity != nil {
+			req = req.WithContext(context.WithValue(req.Context(), identityKey{}, tt.identity))
+		}
+		if got := wantsDebug(req, &Config{DebugMode: tt.debug}); got != tt.want {
+			t.Errorf("%s: wantsDebug() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRecordScanDebugTruncates(t *testing.T) {
+	recordScanDebug(context.Background(), "clamd", []string{"SCAN"}, "ignored")
+
+	ctx, debug := withScanDebug(context.Background())
+	recordScanDebug(ctx, "clamd", []string{"SCAN"}, strings.Repeat("x", debugOutputLimit+1))
+	if len(debug.Output) != debugOutputLimit || !debug.Truncated {
+		t.Errorf("output of %d bytes, truncated %v; want %d bytes, truncated", len(debug.Output), debug.Truncated, debugOutputLimit)
+	}
+	if (*ScanDebug)(nil).recorded() != nil || (&ScanDebug{}).recorded() != nil {
+		t.Error("recorded() of a scan that never reached ClamAV is not nil")
+	}
+}
+
+func TestScanResponseDebug(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	scan := func(target string) ScanResponse {
+		body, contentType := multipartUpload(t, "eicar.com", []byte("EICAR"))
+		req := httptest.NewRequest(http.MethodPost, target, body)
+		req.Header.Set("Content-Type", contentType)
+		req = req.WithContext(context.WithValue(req.Context(), identityKey{}, &Identity{Name: "ops", Scopes: []string{adminScope}}))
+		recorder := httptest.NewRecorder()
+		handleScan(recorder, req, cfg, NewScanner(cfg))
+		var response ScanResponse
+		json.NewDecoder(recorder.Body).Decode(&response)
+		return response
+	}
+
+	if response := scan("/scan"); response.Debug != nil {
+		t.Errorf("debug block without ?debug=true: %+v", response.Debug)
+	}
+	response := scan("/scan?debug=true")
+	if response.Debug == nil || response.Debug.Scanner != "clamd" || !strings.Contains(response.Debug.Output, "Eicar-Test-Signature FOUND") {
+		t.Errorf("debug = %+v, want clamd's reply", response.Debug)
+	}
+}
@@ -6,22 +6,22 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
-const clamdscanBinary = "/usr/bin/clamdscan"
-
-// Config file path - generated by entrypoint.sh in /var/run/clamav
-// to avoid mounting over /etc/clamav which contains required certificates
-const clamdConfigFile = "/var/run/clamav/clamd.conf"
-
 // Regex to parse ClamAV output - compiled once at startup
 // Matches lines like: /path/to/file: VirusName FOUND
 var infectedRegex = regexp.MustCompile(`^(.+):\s+(.+)\s+FOUND$`)
@@ -29,14 +29,85 @@ var infectedRegex = regexp.MustCompile(`^(.+):\s+(.+)\s+FOUND$`)
 // Scanner handles ClamAV scanning operations
 type Scanner struct {
 	config *Config
+
+	versionMu sync.Mutex
+	engine    EngineInfo // As of versionAt
+	versionAt time.Time
+}
+
+// EngineInfo identifies the ClamAV engine and signature database a verdict
+// was produced with
+type EngineInfo struct {
+	Engine    string `json:"engine,omitempty"`     // ClamAV version
+	DBVersion string `json:"db_version,omitempty"` // Signature database version
+	DBDate    string `json:"db_date,omitempty"`    // Signature database build time, as clamd reports it
 }
 
 // ScanResult holds the complete scan results
 type ScanResult struct {
 	Threats      []Threat
 	ScannedFiles int
+	Files        []*FileAnalysis // Every scanned file, with STATIC_ANALYSIS=all
+	Indicators   []Indicator     // Macros and embedded objects in documents
+	Rejected     *RejectedReason // Why the archive was flagged as a likely decompression bomb
+
+	ScannedBytes   int64         // Bytes handed to ClamAV
+	ExtractedFiles int           // Files unpacked from the upload (0 if scanned as is)
+	Skipped        []SkippedFile // Entries not scanned themselves
+	Engine         EngineInfo
+}
+
+// SkippedFile is an archive entry that was not scanned itself
+type SkippedFile struct {
+	File   string `json:"file"`   // Entry path within the archive
+	Reason string `json:"reason"` // One of the skip* reasons
 }
 
+// Reasons entries are skipped
+const (
+	skipDuplicate   = "duplicate"        // Identical to another entry, whose verdict it shares
+	skipUnsafePath  = "unsafe_path"      // Name escapes the archive (zip slip)
+	skipNotRegular  = "not_regular_file" // Link, device or FIFO in a tar archive or disk image
+	skipEncrypted   = "encrypted"        // Password-protected ZIP entry none of the passwords opens
+	skipTooLarge    = "too_large"        // Larger than MAX_SINGLE_FILE_MB
+	skipUnsupported = "unsupported"      // Compressed with a method other than store or deflate, or an image file stored in a way that isn't read
+	skipLongPath    = "path_too_long"    // Longer than MAX_ENTRY_PATH_LENGTH, or an element over 255 bytes
+)
+
+// cleanStatus returns the status of a scan without threats: "clean", or
+// "clean_with_skips" if entries whose content went unscanned were skipped,
+// so the verdict doesn't cover the whole archive
+func cleanStatus(skipped []SkippedFile) string {
+	if hasUnscannedSkips(skipped) {
+		return "clean_with_skips"
+	}
+	return "clean"
+}
+
+// hasUnscannedSkips reports whether any of the skipped entries has content
+// no verdict covers
+func hasUnscannedSkips(skipped []SkippedFile) bool {
+	for _, file := range skipped {
+		if unscannedSkip(file.Reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// unscannedSkip reports whether entries skipped for reason have content no
+// verdict covers (duplicates share another entry's, links have none)
+func unscannedSkip(reason string) bool {
+	switch reason {
+	case skipEncrypted, skipTooLarge, skipUnsupported, skipUnsafePath, skipLongPath:
+		return true
+	}
+	return false
+}
+
+// How long the engine and signature versions stamped on results are reused
+const engineVersionTTL = 10 * time.Second
+
 // NewScanner creates a new ClamAV scanner
 func NewScanner(config *Config) *Scanner {
 	return &Scanner{
@@ -47,73 +118,359 @@ func NewScanner(config *Config) *Scanner {
 // GetVersion returns ClamAV and database versions.
 // Returns an error if clamd is unavailable.
 func (s *Scanner) GetVersion() (string, string, error) {
-	cmd := exec.Command(clamdscanBinary, "--config-file="+clamdConfigFile, "--version")
-	output, err := cmd.Output()
+	info, err := s.queryEngine()
 	if err != nil {
-		return "", "", fmt.Errorf("clamd unavailable: %w", err)
+		return "", "", err
+	}
+	return info.Engine, info.DBVersion, nil
+}
+
+// queryEngine asks clamd for its engine and signature versions, and
+// refreshes the ones stamped on results
+func (s *Scanner) queryEngine() (EngineInfo, error) {
+	var versionStr string
+	if clamdPool != nil {
+		reply, err := clamdPool.Command(context.Background(), "VERSION")
+		if err != nil {
+			return EngineInfo{}, fmt.Errorf("clamd unavailable: %w", err)
+		}
+		versionStr = reply
+	} else {
+		cmd := exec.Command(s.config.ClamdscanPath, "--config-file="+s.config.ClamdConfigFile, "--version")
+		output, err := cmd.Output()
+		if err != nil {
+			return EngineInfo{}, fmt.Errorf("clamd unavailable: %w", err)
+		}
+		versionStr = strings.TrimSpace(string(output))
 	}
 
 	// Parse version string like "ClamAV 1.0.0/26789/Mon Jan 1 12:00:00 2024"
-	versionStr := strings.TrimSpace(string(output))
 	parts := strings.Split(versionStr, "/")
 
-	clamVersion := "unknown"
-	dbVersion := "unknown"
+	info := EngineInfo{Engine: "unknown", DBVersion: "unknown"}
 
 	if len(parts) >= 1 {
-		clamVersion = strings.TrimPrefix(parts[0], "ClamAV ")
+		info.Engine = strings.TrimPrefix(parts[0], "ClamAV ")
 	}
 	if len(parts) >= 2 {
-		dbVersion = parts[1]
+		info.DBVersion = parts[1]
 	}
+	if len(parts) >= 3 {
+		// Days are space-padded ("Jan  1")
+		info.DBDate = strings.Join(strings.Fields(parts[2]), " ")
+	}
+
+	s.versionMu.Lock()
+	s.engine, s.versionAt = info, time.Now()
+	s.versionMu.Unlock()
+	return info, nil
+}
+
+// Engine returns the engine and signature versions to stamp results with.
+// They are asked from clamd again once older than engineVersionTTL (or
+// sooner by a health check); while clamd can't tell, the last known ones
+// are kept.
+func (s *Scanner) Engine() EngineInfo {
+	s.versionMu.Lock()
+	info, stale := s.engine, time.Since(s.versionAt) >= engineVersionTTL
+	s.versionMu.Unlock()
+	if !stale {
+		return info
+	}
+	if fresh, err := s.queryEngine(); err == nil {
+		return fresh
+	}
+	s.versionMu.Lock()
+	s.versionAt = time.Now()
+	s.versionMu.Unlock()
+	return info
+}
 
-	return clamVersion, dbVersion, nil
+// cachedEngine returns the last known engine and signature versions
+// without asking clamd
+func (s *Scanner) cachedEngine() EngineInfo {
+	s.versionMu.Lock()
+	defer s.versionMu.Unlock()
+	return s.engine
 }
 
 // ScanFile scans a file with ClamAV.
-// If the file is a ZIP archive, it extracts and scans the contents.
-// If not a ZIP, it scans the file directly.
-func (s *Scanner) ScanFile(filePath string) (*ScanResult, error) {
+// If the file is a ZIP archive or disk image, it extracts and scans the contents.
+// Otherwise, it scans the file directly.
+func (s *Scanner) ScanFile(ctx context.Context, filePath string) (*ScanResult, error) {
 	if s.config.DebugMode {
 		log.Printf("ScanFile: starting scan of %s", filePath)
 	}
 
 	// Create temp directory for scanning
-	tempDir, err := os.MkdirTemp("", "clamav-extract-")
+	tempDir, err := os.MkdirTemp(scanTmpDir, "clamav-extract-")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create temp dir: %w", err)
 	}
 	defer os.RemoveAll(tempDir)
 
 	// Try to extract as ZIP archive first
-	fileCount, err := s.extractZipSafe(filePath, tempDir)
+	reportProgress(ctx, stageExtracting, 0)
+	faults.SlowExtraction(ctx)
+	_, extractSpan := StartSpan(ctx, "extract")
+	index := newEntryIndex(s.config, tempDir)
+	fileCount, skipped, err := s.extractZipSafe(ctx, filePath, tempDir, index)
+	extractSpan.SetAttribute("archive", err == nil)
+	if err != nil {
+		index = nil
+	} else if n := index.duplicates(); n > 0 {
+		extractSpan.SetAttribute("duplicate.count", n)
+	}
+	if errors.Is(err, errInsufficientSpace) || (err != nil && ctx.Err() != nil) {
+		extractSpan.RecordError(err)
+		extractSpan.End()
+		return nil, err
+	}
+	var bomb *bombError
+	if errors.As(err, &bomb) {
+		extractSpan.SetAttribute("bomb", bomb.reason.Check)
+		if s.config.ArchiveBombAction != bombActionFlag {
+			extractSpan.End()
+			return nil, err
+		}
+		// Flagged: scanned as a single file below
+		log.Printf("ScanFile: %v", err)
+	}
+	message := false
+	unpacked := err == nil
+	if err != nil && s.config.ImageExtraction && looksLikeDiskImage(filePath) {
+		// Not a ZIP - extract the files of an ISO 9660 or UDF image
+		index = newEntryIndex(s.config, tempDir)
+		if fileCount, skipped, err = s.extractImage(ctx, filePath, tempDir, index); err == nil {
+			unpacked = true
+			extractSpan.SetAttribute("image", true)
+			if s.config.DebugMode {
+				log.Printf("ScanFile: extracted %d entries from disk image", fileCount)
+			}
+		} else {
+			index = nil
+			if errors.Is(err, errInsufficientSpace) || ctx.Err() != nil {
+				extractSpan.RecordError(err)
+				extractSpan.End()
+				return nil, err
+			}
+			if errors.As(err, &bomb) {
+				extractSpan.SetAttribute("bomb", bomb.reason.Check)
+				if s.config.ArchiveBombAction != bombActionFlag {
+					extractSpan.End()
+					return nil, err
+				}
+			}
+			// Images that can't be read, or exceed the limits, are
+			// scanned as a single file, which clamd unpacks itself
+			log.Printf("ScanFile: %v", err)
+		}
+	}
+	if err != nil && s.config.EmailExtraction {
+		// Not a valid ZIP - try splitting an email into its parts
+		if fileCount, err = s.extractMessage(filePath, tempDir, requestBudgetFrom(ctx)); err == nil {
+			message, unpacked = true, true
+			extractSpan.SetAttribute("email", true)
+			if s.config.DebugMode {
+				log.Printf("ScanFile: extracted %d parts from email", fileCount)
+			}
+		} else if errors.As(err, &bomb) {
+			// The request's budget ran out while splitting the message
+			extractSpan.SetAttribute("bomb", bomb.reason.Check)
+			if s.config.ArchiveBombAction != bombActionFlag {
+				extractSpan.End()
+				return nil, err
+			}
+			log.Printf("ScanFile: %v", err)
+		}
+	}
 	if err != nil {
-		// Not a valid ZIP - scan as single file instead
+		// Neither - scan as single file instead
 		if s.config.DebugMode {
-			log.Printf("ScanFile: not a ZIP archive, scanning as single file")
+			log.Printf("ScanFile: not a ZIP archive, disk image or email, scanning as single file")
 		}
 
 		fileCount, err = s.copySingleFile(filePath, tempDir)
 		if err != nil {
+			extractSpan.RecordError(err)
+			extractSpan.End()
 			return nil, fmt.Errorf("failed to prepare file for scanning: %w", err)
 		}
-	} else if s.config.DebugMode {
+	} else if s.config.DebugMode && !message {
 		log.Printf("ScanFile: extracted %d files from archive", fileCount)
 	}
 
-	// Run ClamAV on extracted directory with timeout
-	threats, err := s.runClamAV(tempDir)
+	// Report macros and embedded objects, and add their content to the scan
+	var indicators []Indicator
+	if s.config.DocumentIndicators {
+		var extracted int
+		indicators, extracted = s.inspectDocuments(tempDir, requestBudgetFrom(ctx))
+		fileCount += extracted
+		extractSpan.SetAttribute("indicator.count", len(indicators))
+	}
+
+	// Entries whose content was left out are still in the upload, which
+	// clamd then scans as well and unpacks as far as it can
+	var original string
+	if unpacked && hasUnscannedSkips(skipped) {
+		if original, err = s.copyOriginal(filePath, tempDir); err != nil {
+			extractSpan.RecordError(err)
+			extractSpan.End()
+			if errors.Is(err, errInsufficientSpace) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("failed to prepare file for scanning: %w", err)
+		}
+		fileCount++
+		extractSpan.SetAttribute("original", true)
+	}
+	extractSpan.SetAttribute("file.count", fileCount)
+	extractSpan.End()
+
+	makeReadable(tempDir)
+	result, err := s.ScanDirectory(ctx, tempDir, fileCount)
+	if err != nil {
+		return nil, err
+	}
+	if message {
+		result.Threats = dropRawMessageThreats(result.Threats)
+	}
+	if original != "" {
+		renameOriginal(result, original)
+	}
+	result.Indicators = indicators
+	if bomb != nil {
+		result.Rejected = bomb.reason
+	}
+	if unpacked {
+		result.ExtractedFiles = countExtracted(tempDir) + index.duplicates()
+		if original != "" {
+			result.ExtractedFiles-- // Besides the copy of the upload
+		}
+	} else if len(indicators) > 0 {
+		result.ExtractedFiles = countExtracted(tempDir) - 1 // Besides the file itself
+	}
+	result.Skipped = skipped
+	index.expand(result)
+	return result, nil
+}
+
+// ScanExtracted scans an archive already extracted to dir, inspecting
+// documents like ScanFile. Files found in documents are added to dir.
+// index (if set) holds the duplicate entries left out of dir; skipped are
+// the entries left out while extracting.
+func (s *Scanner) ScanExtracted(ctx context.Context, dir string, fileCount int, index *entryIndex, skipped []SkippedFile) (*ScanResult, error) {
+	var indicators []Indicator
+	if s.config.DocumentIndicators {
+		var extracted int
+		indicators, extracted = s.inspectDocuments(dir, requestBudgetFrom(ctx))
+		fileCount += extracted
+	}
+
+	makeReadable(dir)
+	result, err := s.ScanDirectory(ctx, dir, fileCount)
+	if err != nil {
+		return nil, err
+	}
+	result.Indicators = indicators
+	result.ExtractedFiles = countExtracted(dir) + index.duplicates()
+	result.Skipped = skipped
+	index.expand(result)
+	return result, nil
+}
+
+// ScanDirectory scans the files below dir with ClamAV, then hashes and
+// analyzes the infected ones. Threat files are relative to dir; fileCount
+// is reported as the number of scanned files. The files are not modified,
+// so clamd must already be able to read them (see makeReadable).
+func (s *Scanner) ScanDirectory(ctx context.Context, dir string, fileCount int) (*ScanResult, error) {
+	// Run ClamAV on extracted directory with timeout, retrying while clamd
+	// is briefly unreachable (e.g. reloading signatures)
+	reportProgress(ctx, stageScanning, 0)
+	clamdCtx, clamdSpan := StartSpan(ctx, "clamd")
+	var threats []Threat
+	err := callClamd(clamdCtx, s.config.ClamdRetries, func() error {
+		// Held while POST /admin/reload-db has clamd reload its signatures
+		clamdReload.wait(clamdCtx)
+		if err := faults.ClamdError(); err != nil {
+			return err
+		}
+		var err error
+		threats, err = s.runClamAV(clamdCtx, dir)
+		return err
+	})
+	clamdSpan.RecordError(err)
+	clamdSpan.SetAttribute("threat.count", len(threats))
+	clamdSpan.End()
+	var timeout *scanTimeoutError
+	if errors.As(err, &timeout) {
+		// What was found before the timeout is still reported
+		timeout.threats = filterHeuristics(ctx, timeout.threats)
+		s.describeThreats(dir, timeout.threats)
+		timeout.engine = s.Engine()
+		return nil, err
+	}
 	if err != nil {
 		return nil, fmt.Errorf("ClamAV scan failed: %w", err)
 	}
 
+	threats = filterHeuristics(ctx, threats)
 	if s.config.DebugMode {
 		log.Printf("ScanFile: ClamAV found %d threats", len(threats))
 	}
 
 	// Compute file hashes for detected threats
+	reportProgress(ctx, stageHashing, 0)
+	_, hashSpan := StartSpan(ctx, "hash")
+	defer hashSpan.End()
+	s.describeThreats(dir, threats)
+	malwareBazaar.Enrich(ctx, threats)
+
+	var files []*FileAnalysis
+	if s.config.StaticAnalysis == analysisAll {
+		files = analyzeFiles(dir)
+	}
+
+	// Names on disk needn't be UTF-8 (e.g. mounted volumes); reported ones are
+	for _, file := range files {
+		file.File = strings.ToValidUTF8(file.File, string(utf8.RuneError))
+	}
+
+	result := &ScanResult{
+		Threats:      threats,
+		ScannedFiles: fileCount,
+		Files:        files,
+		ScannedBytes: dirSize(dir),
+	}
+	result.Engine = s.Engine()
+	return result, nil
+}
+
+// dirSize returns the total size of the regular files below dir
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// countExtracted returns the number of files unpacked to dir
+func countExtracted(dir string) int {
+	count, _ := countFiles(dir, math.MaxInt)
+	return count
+}
+
+// describeThreats adds the hashes and analysis of the infected files below
+// dir to threats
+func (s *Scanner) describeThreats(dir string, threats []Threat) {
 	for i := range threats {
-		fullPath := filepath.Join(tempDir, threats[i].File)
+		fullPath := filepath.Join(dir, threats[i].File)
 		hash, err := computeFileHash(fullPath)
 		if err != nil {
 			if s.config.DebugMode {
@@ -122,12 +479,34 @@ func (s *Scanner) ScanFile(filePath string) (*ScanResult, error) {
 		} else {
 			threats[i].FileHash = hash
 		}
+		if hashes, err := computeFileHashes(fullPath, s.config.HashAlgorithms); err == nil {
+			threats[i].Hashes = hashes
+		}
+		if s.config.FuzzyHashing {
+			if ssdeep, err := computeSSDeep(fullPath); err == nil {
+				threats[i].SSDeep = ssdeep
+			}
+		}
+		if s.config.StaticAnalysis == analysisThreats || s.config.StaticAnalysis == analysisAll {
+			if analysis, err := analyzeFile(fullPath); err == nil {
+				threats[i].Analysis = analysis
+			}
+		}
+		threats[i].File = strings.ToValidUTF8(threats[i].File, string(utf8.RuneError))
 	}
+}
 
-	return &ScanResult{
-		Threats:      threats,
-		ScannedFiles: fileCount,
-	}, nil
+// scanTimeoutError is a scan stopped by SCAN_TIMEOUT, with what clamd
+// reported before it
+type scanTimeoutError struct {
+	timeout time.Duration
+	threats []Threat // Found before the timeout
+	scanned int      // Files scanned before the timeout (0 with clamdscan, which only reports threats)
+	engine  EngineInfo
+}
+
+func (e *scanTimeoutError) Error() string {
+	return fmt.Sprintf("scan timed out after %v", e.timeout)
 }
 
 // computeFileHash computes the SHA256 hash of a file
@@ -146,12 +525,11 @@ func computeFileHash(filePath string) (string, error) {
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-// runClamAV executes ClamAV on a directory and parses output
-func (s *Scanner) runClamAV(targetDir string) ([]Threat, error) {
-	// Ensure temp directory is readable by clamav user (for clamdscan)
-	// clamdscan runs through the clamd daemon which runs as 'clamav' user
-	os.Chmod(targetDir, 0755)
-	filepath.Walk(targetDir, func(path string, info os.FileInfo, err error) error {
+// makeReadable ensures a temp directory is readable by the clamav user.
+// clamdscan runs through the clamd daemon which runs as 'clamav' user.
+func makeReadable(dir string) {
+	os.Chmod(dir, 0755)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err == nil {
 			if info.IsDir() {
 				os.Chmod(path, 0755)
@@ -161,44 +539,34 @@ func (s *Scanner) runClamAV(targetDir string) ([]Threat, error) {
 		}
 		return nil
 	})
+}
 
-	// Build scan command for clamdscan
-	// clamdscan connects to clamd daemon (faster - signatures already loaded)
-	// --config-file: use config from /var/run/clamav (not /etc/clamav)
-	// --no-summary: skip summary at end (cleaner parsing)
-	// --infected: only show infected files
-	// --fdpass: pass file descriptor to daemon (faster for local files)
-	// --multiscan: scan in parallel (requires MaxThreads >= 2)
-	// Note: clamdscan scans directories recursively by default
-	args := []string{
-		"--config-file=" + clamdConfigFile,
-		"--no-summary",
-		"--infected",
-		"--fdpass",
-	}
-
-	// Only use multiscan if we have enough threads (requires >= 2)
-	if s.config.MaxThreads >= 2 {
-		args = append(args, "--multiscan")
+// runClamAV executes ClamAV on a directory and parses output
+func (s *Scanner) runClamAV(ctx context.Context, targetDir string) ([]Threat, error) {
+	if clamdPool != nil {
+		return s.runClamd(ctx, targetDir)
 	}
 
-	args = append(args, targetDir)
+	args := s.clamdscanArgs(targetDir)
 
 	if s.config.DebugMode {
-		log.Printf("Running: %s %v", clamdscanBinary, args)
+		log.Printf("Running: %s %v", s.config.ClamdscanPath, args)
 	}
 
-	// Create context with timeout for the scan
-	ctx, cancel := context.WithTimeout(context.Background(), s.config.ScanTimeout)
+	// Create context with timeout for the scan (the caller's, if it set one)
+	timeout := scanTimeout(ctx, s.config.ScanTimeout)
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, clamdscanBinary, args...)
+	cmd := exec.CommandContext(ctx, s.config.ClamdscanPath, args...)
 	output, err := cmd.CombinedOutput()
 	outputStr := string(output)
+	recordScanDebug(ctx, "clamdscan", cmd.Args, outputStr)
 
-	// Check for timeout
+	// Check for timeout; clamdscan prints infected files as it finds them
 	if ctx.Err() == context.DeadlineExceeded {
-		return nil, fmt.Errorf("scan timed out after %v", s.config.ScanTimeout)
+		return nil, &scanTimeoutError{timeout: expiredTimeout(parent, timeout), threats: parseClamAVOutput(outputStr, targetDir)}
 	}
 
 	if s.config.DebugMode {
@@ -218,7 +586,7 @@ func (s *Scanner) runClamAV(targetDir string) ([]Threat, error) {
 	if strings.Contains(outputStr, "Could not connect") ||
 		strings.Contains(outputStr, "Connection refused") ||
 		strings.Contains(outputStr, "Can't connect to clamd") {
-		return nil, fmt.Errorf("ClamAV unavailable: %s", outputStr)
+		return nil, fmt.Errorf("%w: %s", errClamdUnavailable, outputStr)
 	}
 
 	// Parse the output for threats
@@ -254,6 +622,93 @@ func (s *Scanner) runClamAV(targetDir string) ([]Threat, error) {
 	return threats, nil
 }
 
+// clamdscanArgs builds the clamdscan command line for a directory.
+// clamdscan connects to clamd (faster - signatures already loaded):
+// --config-file: use config from /var/run/clamav (not /etc/clamav)
+// --no-summary: skip summary at end (cleaner parsing)
+// --infected: only show infected files
+// --stream: send file contents, for clamd that can't read our files
+// --fdpass: pass file descriptor to daemon (faster for local files)
+// --multiscan: scan in parallel (requires MaxThreads >= 2)
+// Note: clamdscan scans directories recursively by default
+func (s *Scanner) clamdscanArgs(targetDir string) []string {
+	args := []string{
+		"--config-file=" + s.config.ClamdConfigFile,
+		"--no-summary",
+		"--infected",
+	}
+
+	// --stream and --fdpass are alternative ways to hand clamd the data
+	if s.config.ClamdscanStream {
+		args = append(args, "--stream")
+	} else if s.config.ClamdscanFdpass {
+		args = append(args, "--fdpass")
+	}
+
+	// Only use multiscan if we have enough threads (requires >= 2)
+	if s.config.ClamdscanMultiscan && s.config.MaxThreads >= 2 {
+		args = append(args, "--multiscan")
+	}
+
+	args = append(args, s.config.ClamdscanArgs...)
+	return append(args, targetDir)
+}
+
+// runClamd scans every file in the directory over a pooled clamd session,
+// or streams them over several sessions in parallel (CLAMD_STREAM_WORKERS)
+func (s *Scanner) runClamd(ctx context.Context, targetDir string) ([]Threat, error) {
+	timeout := scanTimeout(ctx, s.config.ScanTimeout)
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var paths []string
+	err := filepath.Walk(targetDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	var output string
+	if s.config.ClamdStreamWorkers > 0 {
+		output, err = clamdPool.StreamPaths(ctx, paths, s.config.ClamdStreamWorkers)
+		recordScanDebug(ctx, "clamd", []string{"INSTREAM"}, output)
+	} else {
+		output, err = clamdPool.ScanPaths(ctx, paths)
+		recordScanDebug(ctx, "clamd", []string{"SCAN"}, output)
+	}
+	if ctx.Err() == context.DeadlineExceeded || (err != nil && deadlinePassed(ctx)) {
+		return nil, &scanTimeoutError{
+			timeout: expiredTimeout(parent, timeout),
+			threats: parseClamAVOutput(output, targetDir),
+			scanned: strings.Count(output, "\n"),
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("clamd error: %w", err)
+	}
+
+	if s.config.DebugMode {
+		log.Printf("clamd scanned %d files, output=%d bytes", len(paths), len(output))
+	}
+
+	// Per-file errors look like "path: reason ERROR"; don't trust the result
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasSuffix(line, " ERROR") {
+			return nil, fmt.Errorf("ClamAV error: %s", line)
+		}
+	}
+
+	return parseClamAVOutput(output, targetDir), nil
+}
+
 // parseClamAVOutput parses ClamAV text output into Threat structs
 //
 // ClamAV output format:
@@ -297,6 +752,7 @@ func parseClamAVOutput(output string, baseDir string) []Threat {
 				File:     relPath,
 				Severity: "critical", // All malware is critical
 			}
+			enrichThreat(&threat)
 
 			threats = append(threats, threat)
 			log.Printf("Found threat: %s in %s", virusName, relPath)
@@ -351,80 +807,215 @@ func (s *Scanner) copySingleFile(filePath, targetDir string) (int, error) {
 	return 1, nil
 }
 
+// originalName is the name threats and files in the copy of an upload
+// scanned next to its extracted entries are reported under
+const originalName = "(archive)"
+
+// copyOriginal copies the upload next to its extracted entries in
+// targetDir, under a name none of them has, and returns that name
+func (s *Scanner) copyOriginal(filePath, targetDir string) (string, error) {
+	src, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+	if err := checkDiskSpace(targetDir, info.Size(), s.config.ScanTmpMinFree); err != nil {
+		return "", err
+	}
+
+	dst, err := os.CreateTemp(targetDir, ".original-*")
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		return "", err
+	}
+	return filepath.Base(dst.Name()), nil
+}
+
+// renameOriginal reports the threats and files found in the copy of the
+// upload named name under originalName. A detection the copy shares with an
+// extracted entry is reported once, by the entry's path.
+func renameOriginal(result *ScanResult, name string) {
+	found := make(map[string]bool)
+	for _, threat := range result.Threats {
+		if threat.File != name {
+			found[threat.Name] = true
+		}
+	}
+	kept := result.Threats[:0]
+	for _, threat := range result.Threats {
+		if threat.File == name {
+			if found[threat.Name] {
+				continue
+			}
+			threat.File = originalName
+		}
+		kept = append(kept, threat)
+	}
+	result.Threats = kept
+	for _, file := range result.Files {
+		if file.File == name {
+			file.File = originalName
+		}
+	}
+}
+
 // extractZipSafe extracts a ZIP file with zip bomb protection.
-// Returns the number of files extracted.
+// Returns the number of files extracted and the entries skipped.
 //
 // Security measures:
 // - Limits total extracted size to prevent disk exhaustion
 // - Limits number of files to prevent inode exhaustion
 // - Limits individual file size
 // - Prevents zip slip attacks (path traversal)
-func (s *Scanner) extractZipSafe(zipPath, targetDir string) (int, error) {
+//
+// Progress is reported as the share of uncompressed bytes extracted.
+func (s *Scanner) extractZipSafe(ctx context.Context, zipPath, targetDir string, index *entryIndex) (int, []SkippedFile, error) {
 	reader, err := zip.OpenReader(zipPath)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 	defer reader.Close()
 
+	// Refuse likely decompression bombs before writing anything
+	if info, err := os.Stat(zipPath); err == nil {
+		if reason := checkZipBomb(s.config, &reader.Reader, info.Size()); reason != nil {
+			return 0, nil, &bombError{reason}
+		}
+	}
+
+	var declaredSize uint64
+	for _, file := range reader.File {
+		declaredSize += file.UncompressedSize64
+	}
+
+	// Fail fast if the contents won't fit; larger archives fail the size limit below
+	if declaredSize <= uint64(s.config.MaxExtractedSize) {
+		if err := checkDiskSpace(targetDir, int64(declaredSize), s.config.ScanTmpMinFree); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	var skipped []SkippedFile
 	fileCount := 0
 	totalSize := int64(0)
+	budget := requestBudgetFrom(ctx)
+	passwords := archivePasswords(ctx, s.config)
+	if len(passwords) > 0 && zipKeysFrom(ctx) == nil {
+		ctx = withZipKeys(ctx)
+	}
 
 	for _, file := range reader.File {
+		// Stop once the request's deadline passed or its client went away
+		if err := ctx.Err(); err != nil {
+			return fileCount, nil, err
+		}
+		if declaredSize > 0 {
+			reportProgress(ctx, stageExtracting, int(uint64(totalSize)*100/declaredSize))
+		}
+
 		// Check file count limit
 		fileCount++
 		if fileCount > s.config.MaxFileCount {
-			return 0, fmt.Errorf("archive contains too many files (limit: %d)", s.config.MaxFileCount)
+			return 0, nil, fmt.Errorf("archive contains too many files (limit: %d)", s.config.MaxFileCount)
+		}
+
+		// Entries that can't be read are reported instead of failing the
+		// archive, which is then scanned as a whole as well
+		if file.Flags&0x1 != 0 && len(passwords) == 0 {
+			skipped = append(skipped, SkippedFile{File: zipEntryName(file), Reason: skipEncrypted})
+			continue
 		}
 
-		// Check individual file size limit (from header)
+		// Check individual file size limit (from header); the archive is
+		// then scanned as a single file
 		if file.UncompressedSize64 > s.config.MaxSingleFileSize {
-			return 0, fmt.Errorf("file %s exceeds size limit (%d > %d bytes)",
-				file.Name, file.UncompressedSize64, s.config.MaxSingleFileSize)
+			return 0, nil, fmt.Errorf("file %s exceeds size limit (%d > %d bytes)",
+				zipEntryName(file), file.UncompressedSize64, s.config.MaxSingleFileSize)
 		}
 
 		// Check total extracted size (using header info)
 		totalSize += int64(file.UncompressedSize64)
 		if totalSize > s.config.MaxExtractedSize {
-			return 0, fmt.Errorf("archive exceeds total size limit (%d bytes)", s.config.MaxExtractedSize)
+			return 0, nil, fmt.Errorf("archive exceeds total size limit (%d bytes)", s.config.MaxExtractedSize)
 		}
 
-		// Build target path
-		targetPath := filepath.Join(targetDir, file.Name)
+		// Build target path from the name decoded to UTF-8, so clamd and
+		// the report see the name the archiver showed
+		name := zipEntryName(file)
+		if entryPathTooLong(name, s.config.MaxEntryPath) {
+			if !file.FileInfo().IsDir() {
+				skipped = append(skipped, SkippedFile{File: truncateName(name, maxEntryNameLength), Reason: skipLongPath})
+			}
+			continue
+		}
+		targetPath := filepath.Join(targetDir, name)
 
 		// Security check: prevent zip slip attack
 		if !strings.HasPrefix(targetPath, filepath.Clean(targetDir)+string(os.PathSeparator)) {
-			continue // Skip files that would escape target directory
+			// Skip files that would escape target directory
+			skipped = append(skipped, SkippedFile{File: name, Reason: skipUnsafePath})
+			continue
 		}
 
 		if file.FileInfo().IsDir() {
+			if err := budget.addDir(targetDir, targetPath); err != nil {
+				return fileCount, nil, err
+			}
 			os.MkdirAll(targetPath, 0755)
 			continue
 		}
 
-		// Create parent directories
+		// Count against the request's budget, then create parent directories
+		targetPath = index.unique(targetPath, fileCount)
+		if err := budget.addFile(targetDir, targetPath); err != nil {
+			return fileCount, nil, err
+		}
 		if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-			return fileCount, err
+			return fileCount, nil, err
 		}
 
 		// Extract file with size limit enforcement
-		if err := s.extractFileSafe(file, targetPath); err != nil {
-			return fileCount, err
+		if err := s.extractFileSafe(ctx, file, targetPath, index, budget, passwords); errors.Is(err, zip.ErrAlgorithm) {
+			skipped = append(skipped, SkippedFile{File: name, Reason: skipUnsupported})
+		} else if errors.Is(err, errWrongPassword) {
+			skipped = append(skipped, SkippedFile{File: name, Reason: skipEncrypted})
+		} else if err != nil {
+			return fileCount, nil, err
 		}
 	}
 
-	return fileCount, nil
+	return fileCount, skipped, nil
 }
 
 // extractFileSafe extracts a single file from the ZIP with size limit enforcement.
 // This provides runtime protection against deceptive header sizes.
-func (s *Scanner) extractFileSafe(file *zip.File, targetPath string) error {
+// Entries identical to an earlier one are recorded in index (if set) and
+// not kept. The bytes written count against budget (if set). Encrypted
+// entries are decrypted with the first of passwords that fits, until ctx
+// is done.
+func (s *Scanner) extractFileSafe(ctx context.Context, file *zip.File, targetPath string, index *entryIndex, budget *requestBudget, passwords []string) error {
+	if file.Flags&0x1 != 0 {
+		return s.extractEncrypted(ctx, file, targetPath, index, budget, passwords)
+	}
 	src, err := file.Open()
 	if err != nil {
 		return err
 	}
 	defer src.Close()
+	return s.writeEntry(src, file.Name, targetPath, index, budget)
+}
 
-	dst, err := os.Create(targetPath)
+// writeEntry writes an entry's content to targetPath, failing if it is
+// larger than MAX_SINGLE_FILE_MB
+func (s *Scanner) writeEntry(src io.Reader, name, targetPath string, index *entryIndex, budget *requestBudget) error {
+	dst, err := index.create(targetPath)
 	if err != nil {
 		return err
 	}
@@ -434,7 +1025,7 @@ func (s *Scanner) extractFileSafe(file *zip.File, targetPath string) error {
 	// This protects against archives with false header sizes
 	limitedReader := io.LimitReader(src, int64(s.config.MaxSingleFileSize)+1)
 
-	written, err := io.Copy(dst, limitedReader)
+	written, err := io.Copy(dst, budget.reader(limitedReader))
 	if err != nil {
 		return err
 	}
@@ -442,8 +1033,8 @@ func (s *Scanner) extractFileSafe(file *zip.File, targetPath string) error {
 	// Check if we hit the limit (file was larger than allowed)
 	if written > int64(s.config.MaxSingleFileSize) {
 		os.Remove(targetPath) // Clean up partial file
-		return fmt.Errorf("file %s exceeded size limit during extraction", file.Name)
+		return fmt.Errorf("file %s exceeded size limit during extraction", name)
 	}
 
-	return nil
+	return dst.finish()
 }
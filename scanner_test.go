@@ -2,8 +2,15 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -166,7 +173,7 @@ func TestExtractZipSafe(t *testing.T) {
 		}
 		defer os.RemoveAll(targetDir)
 
-		count, err := s.extractZipSafe(zipPath, targetDir)
+		count, _, err := s.extractZipSafe(context.Background(), zipPath, targetDir, nil)
 		if err != nil {
 			t.Fatalf("extractZipSafe() error: %v", err)
 		}
@@ -192,7 +199,7 @@ func TestExtractZipSafe(t *testing.T) {
 		targetDir, _ := os.MkdirTemp("", "extract-test-*")
 		defer os.RemoveAll(targetDir)
 
-		count, err := s.extractZipSafe(zipPath, targetDir)
+		count, _, err := s.extractZipSafe(context.Background(), zipPath, targetDir, nil)
 		if err != nil {
 			t.Fatalf("extractZipSafe() error: %v", err)
 		}
@@ -220,7 +227,7 @@ func TestExtractZipSafe(t *testing.T) {
 		targetDir, _ := os.MkdirTemp("", "extract-test-*")
 		defer os.RemoveAll(targetDir)
 
-		_, err := s.extractZipSafe(zipPath, targetDir)
+		_, _, err := s.extractZipSafe(context.Background(), zipPath, targetDir, nil)
 		if err == nil {
 			t.Error("expected error for too many files")
 		}
@@ -242,12 +249,55 @@ func TestExtractZipSafe(t *testing.T) {
 		targetDir, _ := os.MkdirTemp("", "extract-test-*")
 		defer os.RemoveAll(targetDir)
 
-		_, err := s.extractZipSafe(zipPath, targetDir)
+		_, _, err := s.extractZipSafe(context.Background(), zipPath, targetDir, nil)
 		if err == nil {
 			t.Error("expected error for file exceeding size limit")
 		}
 	})
 
+	t.Run("skips encrypted and unsupported entries", func(t *testing.T) {
+		s := NewScanner(&Config{MaxExtractedSize: 10 << 20, MaxFileCount: 100, MaxSingleFileSize: 5 << 20})
+
+		var buf bytes.Buffer
+		w := zip.NewWriter(&buf)
+		f, _ := w.CreateHeader(&zip.FileHeader{Name: "secret.txt", Method: zip.Store, Flags: 0x1})
+		f.Write([]byte("ciphertext"))
+		f, _ = w.CreateRaw(&zip.FileHeader{Name: "lzma.bin", Method: 14, CompressedSize64: 4, UncompressedSize64: 4})
+		f.Write([]byte("data"))
+		f, _ = w.Create("plain.txt")
+		f.Write([]byte("hello"))
+		w.Close()
+		zipPath := filepath.Join(t.TempDir(), "mixed.zip")
+		os.WriteFile(zipPath, buf.Bytes(), 0644)
+
+		targetDir := t.TempDir()
+		_, skipped, err := s.extractZipSafe(context.Background(), zipPath, targetDir, nil)
+		if err != nil {
+			t.Fatalf("extractZipSafe() error: %v", err)
+		}
+		want := []SkippedFile{{File: "secret.txt", Reason: skipEncrypted}, {File: "lzma.bin", Reason: skipUnsupported}}
+		if !reflect.DeepEqual(skipped, want) {
+			t.Errorf("skipped = %+v, want %+v", skipped, want)
+		}
+		if content, _ := os.ReadFile(filepath.Join(targetDir, "plain.txt")); string(content) != "hello" {
+			t.Errorf("plain.txt = %q, want hello", content)
+		}
+	})
+
+	t.Run("keeps entries with the same name", func(t *testing.T) {
+		s := NewScanner(&Config{MaxExtractedSize: 10 << 20, MaxFileCount: 100, MaxSingleFileSize: 5 << 20})
+		zipPath := filepath.Join(t.TempDir(), "twice.zip")
+		os.WriteFile(zipPath, zipBytes(t, zip.Deflate, [2]string{"a.txt", "EICAR"}, [2]string{"a.txt", "hello"}), 0644)
+
+		targetDir := t.TempDir()
+		if _, _, err := s.extractZipSafe(context.Background(), zipPath, targetDir, nil); err != nil {
+			t.Fatalf("extractZipSafe() error: %v", err)
+		}
+		if files := readTree(t, targetDir); !reflect.DeepEqual(files, map[string]string{"a.txt": "EICAR", "a.txt.~2~": "hello"}) {
+			t.Errorf("extracted %v, want both entries", files)
+		}
+	})
+
 	t.Run("rejects archive exceeding total size limit", func(t *testing.T) {
 		cfg := &Config{
 			MaxExtractedSize:  20, // 20 bytes total
@@ -265,7 +315,7 @@ func TestExtractZipSafe(t *testing.T) {
 		targetDir, _ := os.MkdirTemp("", "extract-test-*")
 		defer os.RemoveAll(targetDir)
 
-		_, err := s.extractZipSafe(zipPath, targetDir)
+		_, _, err := s.extractZipSafe(context.Background(), zipPath, targetDir, nil)
 		if err == nil {
 			t.Error("expected error for archive exceeding total size limit")
 		}
@@ -280,7 +330,7 @@ func TestExtractZipSafe(t *testing.T) {
 		targetDir, _ := os.MkdirTemp("", "extract-test-*")
 		defer os.RemoveAll(targetDir)
 
-		_, err := s.extractZipSafe(tmpFile.Name(), targetDir)
+		_, _, err := s.extractZipSafe(context.Background(), tmpFile.Name(), targetDir, nil)
 		if err == nil {
 			t.Error("expected error for non-zip file")
 		}
@@ -361,6 +411,44 @@ func TestNewScanner(t *testing.T) {
 	}
 }
 
+func TestClamdscanArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   string
+	}{
+		{
+			name:   "defaults",
+			config: Config{ClamdConfigFile: "/c.conf", ClamdscanFdpass: true, ClamdscanMultiscan: true, MaxThreads: 10},
+			want:   "--config-file=/c.conf --no-summary --infected --fdpass --multiscan /dir",
+		},
+		{
+			name:   "stream replaces fdpass",
+			config: Config{ClamdConfigFile: "/c.conf", ClamdscanFdpass: true, ClamdscanStream: true},
+			want:   "--config-file=/c.conf --no-summary --infected --stream /dir",
+		},
+		{
+			name:   "multiscan needs threads",
+			config: Config{ClamdConfigFile: "/c.conf", ClamdscanMultiscan: true, MaxThreads: 1},
+			want:   "--config-file=/c.conf --no-summary --infected /dir",
+		},
+		{
+			name:   "extra args",
+			config: Config{ClamdConfigFile: "/c.conf", ClamdscanArgs: []string{"--allmatch", "--verbose"}},
+			want:   "--config-file=/c.conf --no-summary --infected --allmatch --verbose /dir",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewScanner(&tt.config)
+			if got := strings.Join(s.clamdscanArgs("/dir"), " "); got != tt.want {
+				t.Errorf("clamdscanArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 // Helper function to create a test zip file
 func createTestZip(t *testing.T, files map[string]string) string {
 	t.Helper()
@@ -441,7 +529,7 @@ func TestExtractFileSafe(t *testing.T) {
 		defer os.RemoveAll(targetDir)
 
 		targetPath := filepath.Join(targetDir, "test.txt")
-		err := s.extractFileSafe(reader.File[0], targetPath)
+		err := s.extractFileSafe(context.Background(), reader.File[0], targetPath, nil, nil, nil)
 		if err != nil {
 			t.Errorf("extractFileSafe() error: %v", err)
 		}
@@ -453,3 +541,109 @@ func TestExtractFileSafe(t *testing.T) {
 		}
 	})
 }
+
+func TestScanSummary(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.DedupeEntries = true
+	archive := zipBytes(t, zip.Store,
+		[2]string{"a.txt", "hello"}, [2]string{"copy/a.txt", "hello"},
+		[2]string{"b.txt", "world!"}, [2]string{"../evil.txt", "evil"})
+	body, contentType := multipartUpload(t, "summary.zip", archive)
+	req := httptest.NewRequest(http.MethodPost, "/scan", body)
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+	handleScan(recorder, req, cfg, NewScanner(cfg))
+
+	var response ScanResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	want := []SkippedFile{{File: "../evil.txt", Reason: skipUnsafePath}, {File: "copy/a.txt", Reason: skipDuplicate}}
+	if response.Status != "clean_with_skips" {
+		t.Errorf("status = %q, want clean_with_skips", response.Status)
+	}
+	// The archive is scanned as well, for the entry left out
+	if response.ScannedBytes != int64(11+len(archive)) || response.ExtractedFiles != 3 || !reflect.DeepEqual(response.SkippedFiles, want) {
+		t.Errorf("scanned %d bytes, extracted %d files, skipped %+v; want %d, 3, %+v",
+			response.ScannedBytes, response.ExtractedFiles, response.SkippedFiles, 11+len(archive), want)
+	}
+	if response.Engine != "1.2.0" || response.DBVersion != "27000" {
+		t.Errorf("engine %q, db_version %q; want the fake clamd's", response.Engine, response.DBVersion)
+	}
+
+	// A plain file is scanned as is
+	body, contentType = multipartUpload(t, "plain.txt", []byte("hello"))
+	req = httptest.NewRequest(http.MethodPost, "/scan", body)
+	req.Header.Set("Content-Type", contentType)
+	recorder = httptest.NewRecorder()
+	handleScan(recorder, req, cfg, NewScanner(cfg))
+	response = ScanResponse{}
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if response.ScannedBytes != 5 || response.ExtractedFiles != 0 || response.SkippedFiles != nil {
+		t.Errorf("plain file: scanned %d bytes, extracted %d files, skipped %+v", response.ScannedBytes, response.ExtractedFiles, response.SkippedFiles)
+	}
+}
+
+func TestScanStatusWithSkips(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.DedupeEntries = true
+	cfg.MaxSingleFileSize = 10
+
+	scan := func(entries ...[2]string) ScanResponse {
+		body, contentType := multipartUpload(t, "skips.zip", zipBytes(t, zip.Deflate, entries...))
+		req := httptest.NewRequest(http.MethodPost, "/scan", body)
+		req.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+		handleScan(recorder, req, cfg, NewScanner(cfg))
+		var response ScanResponse
+		json.NewDecoder(recorder.Body).Decode(&response)
+		return response
+	}
+
+	// Duplicates share another entry's verdict
+	if response := scan([2]string{"a.txt", "hello"}, [2]string{"b.txt", "hello"}); response.Status != "clean" {
+		t.Errorf("duplicates: status %q, want clean", response.Status)
+	}
+
+	response := scan([2]string{"a.txt", "hello"}, [2]string{"../b.txt", "world"})
+	want := []SkippedFile{{File: "../b.txt", Reason: skipUnsafePath}}
+	if response.Status != "clean_with_skips" || !reflect.DeepEqual(response.SkippedFiles, want) {
+		t.Errorf("unsafe entry: status %q, skipped %+v; want clean_with_skips, %+v", response.Status, response.SkippedFiles, want)
+	}
+
+	// Threats outrank skips
+	if response := scan([2]string{"eicar.com", "EICAR"}, [2]string{"../b.txt", "world"}); response.Status != "infected" {
+		t.Errorf("infected with skips: status %q, want infected", response.Status)
+	}
+
+	// Skipped entries are still scanned within the archive
+	response = scan([2]string{"a.txt", "hello"}, [2]string{"../evil.com", "EICAR"})
+	if response.Status != "infected" || len(response.Threats) != 1 || response.Threats[0].File != originalName {
+		t.Errorf("infected skipped entry: status %q, threats %+v; want infected in %s", response.Status, response.Threats, originalName)
+	}
+	var encrypted bytes.Buffer
+	w := zip.NewWriter(&encrypted)
+	f, _ := w.CreateHeader(&zip.FileHeader{Name: "secret.com", Method: zip.Store, Flags: 0x1})
+	f.Write([]byte("EICAR"))
+	w.Close()
+	body, contentType := multipartUpload(t, "secret.zip", encrypted.Bytes())
+	req := httptest.NewRequest(http.MethodPost, "/scan", body)
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+	handleScan(recorder, req, cfg, NewScanner(cfg))
+	response = ScanResponse{}
+	json.NewDecoder(recorder.Body).Decode(&response)
+	want = []SkippedFile{{File: "secret.com", Reason: skipEncrypted}}
+	if response.Status != "infected" || !reflect.DeepEqual(response.SkippedFiles, want) {
+		t.Errorf("encrypted entry: status %q, skipped %+v; want infected, %+v", response.Status, response.SkippedFiles, want)
+	}
+	// A detection in an extracted entry is reported once, by its path
+	response = scan([2]string{"eicar.com", "EICAR"}, [2]string{"../b.txt", "world"})
+	if len(response.Threats) != 1 || response.Threats[0].File != "eicar.com" {
+		t.Errorf("threats = %+v, want eicar.com only", response.Threats)
+	}
+
+	// An entry over MAX_SINGLE_FILE_MB has the archive scanned as a
+	// single file, which fails here since it is over the limit too
+	if response := scan([2]string{"a.txt", "hello"}, [2]string{"big.bin", "more than ten bytes"}); response.Status != "error" {
+		t.Errorf("oversize entry: status %q, want error", response.Status)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Streaming scan socket limits
+const (
+	socketMaxChunk         = 8 << 20 // Largest message (file chunk) a client may send
+	socketProgressInterval = time.Second
+	socketPingInterval     = 30 * time.Second
+)
+
+// stageReceiving is reported while a socket upload is in progress
+const stageReceiving = "receiving"
+
+// SocketMessage is a message on the scan socket (GET /scan/ws), in either
+// direction. The client sends:
+//
+//	{"type":"start","filename":"big.zip","size":1073741824,"metadata":{"ticket":"T-1"}}
+//	<binary messages with the file contents, in order>
+//	{"type":"end"}
+//
+// and the server answers with "ready", "progress" updates (receiving,
+// extracting, scanning, hashing) and finally "result" or "error".
+type SocketMessage struct {
+	Type     string          `json:"type"`
+	Filename string          `json:"filename,omitempty"` // start
+	Size     int64           `json:"size,omitempty"`     // start: total bytes, if known
+	Metadata json.RawMessage `json:"metadata,omitempty"` // start: caller metadata to echo
+	Stage    string          `json:"stage,omitempty"`    // progress
+	Received int64           `json:"received,omitempty"` // progress: bytes received so far
+	Percent  int             `json:"percent,omitempty"`  // progress
+	Result   *ScanResponse   `json:"result,omitempty"`   // result
+	Status   int             `json:"status,omitempty"`   // error: the equivalent HTTP status
+	Error    string          `json:"error,omitempty"`    // error
+}
+
+// scanSocketHandler serves the streaming scan socket with the global limits.
+// Browsers must come from an origin allowed by the CORS policy or the
+// service's own origin.
+func scanSocketHandler(cors *CORSPolicy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleScanSocket(w, r, cors, config, scanner)
+	})
+}
+
+// allowSocketOrigin reports whether the request's Origin may open a scan
+// socket. WebSockets are exempt from CORS, so without this check any site
+// could scan with a visitor's cached credentials. Non-browser clients send
+// no Origin.
+func allowSocketOrigin(r *http.Request, cors *CORSPolicy) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if cors != nil && cors.allowOrigin(origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// handleScanSocket receives a file over a WebSocket, reporting progress
+// while it is received and scanned, and sends the verdict on the same
+// connection
+func handleScanSocket(w http.ResponseWriter, r *http.Request, cors *CORSPolicy, config *Config, scanner *Scanner) {
+	if !allowSocketOrigin(r, cors) {
+		sendErrorStatus(w, http.StatusForbidden, "Origin not allowed")
+		return
+	}
+
+	startTime := time.Now()
+	if rejectWhileStarting(w, r, startTime) {
+		return
+	}
+
+	ws := upgradeWebSocket(w, r, socketMaxChunk)
+	if ws == nil {
+		return
+	}
+
+	upload, reqErr := receiveSocketUpload(r.Context(), ws, config)
+	if reqErr != nil {
+		recordScan(scanTags(r), "rejected", time.Since(startTime), 0, nil)
+		indexScan(r, nil, &ScanResponse{Status: "error", Error: reqErr.message, ScanTimeMs: time.Since(startTime).Milliseconds()})
+		closeSocketWithError(ws, reqErr)
+		return
+	}
+	defer upload.remove()
+
+	ctx := withProgress(r.Context(), func(stage string, percent int) {
+		ws.WriteJSON(SocketMessage{Type: "progress", Stage: stage, Percent: percent})
+	})
+	stopPings := ws.KeepAlive(socketPingInterval)
+	response, reqErr := executeScan(ctx, r, config, scanner, upload, startTime)
+	stopPings()
+	if reqErr != nil {
+		closeSocketWithError(ws, reqErr)
+		return
+	}
+
+	ws.WriteJSON(SocketMessage{Type: "result", Result: response})
+	ws.Close(wsCloseNormal, "")
+}
+
+// receiveSocketUpload reads a file sent over the scan socket into a temp file.
+// Failures are logged here; the returned requestError is safe to send to the client.
+func receiveSocketUpload(ctx context.Context, ws *WebSocketConn, config *Config) (upload *uploadedFile, reqErr *requestError) {
+	_, span := StartSpan(ctx, "upload")
+	defer func() {
+		if reqErr != nil {
+			span.RecordError(errors.New(reqErr.message))
+		}
+		span.End()
+	}()
+
+	var start SocketMessage
+	if opcode, data, err := ws.ReadMessage(); err != nil {
+		return nil, socketReadError(err)
+	} else if opcode != wsText || json.Unmarshal(data, &start) != nil || start.Type != "start" {
+		return nil, &requestError{status: http.StatusBadRequest, message: "Expected a start message"}
+	}
+	if start.Size > config.MaxUploadSize {
+		log.Printf("Rejected socket upload: size %d exceeds limit %d", start.Size, config.MaxUploadSize)
+		return nil, uploadTooLarge(config.MaxUploadSize)
+	}
+	metadata, reqErr := parseScanMetadata(start.Metadata, config.MetadataMaxBytes)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+
+	safeFilename := sanitizeFilename(start.Filename)
+
+	tempFile, err := os.CreateTemp(scanTmpDir, "clamav-scan-*")
+	if err != nil {
+		log.Printf("Failed to create temp file: %v", err)
+		return nil, &requestError{status: http.StatusInternalServerError, message: "Server error during file processing"}
+	}
+	defer tempFile.Close()
+	fail := func(reqErr *requestError) (*uploadedFile, *requestError) {
+		os.Remove(tempFile.Name())
+		return nil, reqErr
+	}
+
+	if err := ws.WriteJSON(SocketMessage{Type: "ready"}); err != nil {
+		return fail(socketReadError(err))
+	}
+
+	var size int64
+	lastProgress := time.Now()
+	for {
+		opcode, data, err := ws.ReadMessage()
+		if err != nil {
+			log.Printf("Socket upload of %s interrupted after %d bytes: %v", safeFilename, size, err)
+			return fail(socketReadError(err))
+		}
+
+		if opcode == wsText {
+			var msg SocketMessage
+			if json.Unmarshal(data, &msg) != nil || msg.Type != "end" {
+				return fail(&requestError{status: http.StatusBadRequest, message: "Expected file data or an end message"})
+			}
+			break
+		}
+
+		if size+int64(len(data)) > config.MaxUploadSize {
+			log.Printf("Rejected socket upload: %s exceeds limit %d", safeFilename, config.MaxUploadSize)
+			return fail(uploadTooLarge(config.MaxUploadSize))
+		}
+		if _, err := tempFile.Write(data); err != nil {
+			log.Printf("Failed to write temp file: %v", err)
+			return fail(&requestError{status: http.StatusInternalServerError, message: "Server error during file processing"})
+		}
+		size += int64(len(data))
+
+		if time.Since(lastProgress) >= socketProgressInterval {
+			lastProgress = time.Now()
+			progress := SocketMessage{Type: "progress", Stage: stageReceiving, Received: size}
+			if start.Size > 0 {
+				progress.Percent = int(size * 100 / start.Size)
+			}
+			ws.WriteJSON(progress)
+		}
+	}
+
+	if start.Size > 0 && size != start.Size {
+		log.Printf("Socket upload of %s incomplete: %d of %d bytes", safeFilename, size, start.Size)
+		return fail(&requestError{status: http.StatusBadRequest, message: "Upload incomplete"})
+	}
+
+	log.Printf("Received file: %s (%d bytes)", safeFilename, size)
+	span.SetAttribute("file.size", size)
+	return &uploadedFile{
+		path:         tempFile.Name(),
+		filename:     start.Filename,
+		safeFilename: safeFilename,
+		size:         size,
+		metadata:     metadata,
+	}, nil
+}
+
+// socketReadError maps a failed socket read to the error reported to the client
+func socketReadError(err error) *requestError {
+	var wsErr *WebSocketError
+	if errors.As(err, &wsErr) && wsErr.Code == wsCloseTooBig {
+		return &requestError{status: http.StatusRequestEntityTooLarge, message: "Message exceeds size limit"}
+	}
+	return &requestError{status: http.StatusBadRequest, message: "Upload interrupted"}
+}
+
+// closeSocketWithError sends the error to the client and closes the socket
+// with the matching close code
+func closeSocketWithError(ws *WebSocketConn, reqErr *requestError) {
+	code := wsClosePolicyViolation
+	switch {
+	case reqErr.status == http.StatusRequestEntityTooLarge:
+		code = wsCloseTooBig
+	case reqErr.status == http.StatusServiceUnavailable:
+		code = wsCloseTryAgainLater
+	case reqErr.status >= 500:
+		code = wsCloseInternalError
+	}
+	ws.WriteJSON(SocketMessage{Type: "error", Status: reqErr.status, Error: reqErr.message})
+	ws.Close(code, "")
+}
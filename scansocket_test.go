@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newScanSocketServer serves the scan socket against a fake clamd
+func newScanSocketServer(t *testing.T, cfg *Config) *httptest.Server {
+	t.Helper()
+	scanner := NewScanner(cfg)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleScanSocket(w, r, nil, cfg, scanner)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestScanSocket(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	server := newScanSocketServer(t, cfg)
+
+	client, resp := dialTestWebSocket(t, server.URL, "/scan/ws", nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status = %d, want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept = %q", got)
+	}
+
+	content := []byte("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*")
+	client.sendJSON(SocketMessage{Type: "start", Filename: "eicar.com", Size: int64(len(content))})
+	if msg, _ := client.readMessage(t); msg.Type != "ready" {
+		t.Fatalf("first message = %+v, want ready", msg)
+	}
+	client.send(true, wsBinary, content[:20])
+	client.send(true, wsBinary, content[20:])
+	client.sendJSON(SocketMessage{Type: "end"})
+
+	var result *ScanResponse
+	for {
+		msg, ok := client.readMessage(t)
+		if !ok {
+			break
+		}
+		switch msg.Type {
+		case "progress":
+		case "result":
+			result = msg.Result
+		default:
+			t.Fatalf("unexpected message %+v", msg)
+		}
+	}
+
+	if result == nil || result.Status != "infected" || len(result.Threats) != 1 {
+		t.Errorf("result = %+v, want one threat", result)
+	}
+}
+
+func TestScanSocketErrors(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.MaxUploadSize = 16
+	server := newScanSocketServer(t, cfg)
+
+	tests := []struct {
+		name       string
+		messages   func(*testWebSocketClient)
+		wantStatus int
+	}{
+		{
+			name:       "declared size over limit",
+			messages:   func(c *testWebSocketClient) { c.sendJSON(SocketMessage{Type: "start", Size: 17}) },
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "data over limit",
+			messages: func(c *testWebSocketClient) {
+				c.sendJSON(SocketMessage{Type: "start"})
+				c.send(true, wsBinary, bytes.Repeat([]byte("a"), 17))
+			},
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "no start message",
+			messages:   func(c *testWebSocketClient) { c.send(true, wsBinary, []byte("data")) },
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "incomplete",
+			messages: func(c *testWebSocketClient) {
+				c.sendJSON(SocketMessage{Type: "start", Size: 10})
+				c.send(true, wsBinary, []byte("short"))
+				c.sendJSON(SocketMessage{Type: "end"})
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := dialTestWebSocket(t, server.URL, "/scan/ws", nil)
+			tt.messages(client)
+
+			for {
+				msg, ok := client.readMessage(t)
+				if !ok {
+					t.Fatal("socket closed without an error message")
+				}
+				if msg.Type == "error" {
+					if msg.Status != tt.wantStatus {
+						t.Errorf("error = %+v, want status %d", msg, tt.wantStatus)
+					}
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestScanSocketHandshakeRejected(t *testing.T) {
+	server := newScanSocketServer(t, &Config{})
+
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantStatus int
+	}{
+		{"foreign origin", http.Header{"Origin": {"https://evil.example.com"}}, http.StatusForbidden},
+		{"old version", http.Header{"Sec-WebSocket-Version": {"8"}}, http.StatusUpgradeRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, server.URL+"/scan/ws", nil)
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			for name, values := range tt.header {
+				req.Header[name] = values
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request error: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAllowSocketOrigin(t *testing.T) {
+	cors := newTestCORSPolicy(false, "https://app.example.com")
+
+	tests := []struct {
+		origin string
+		cors   *CORSPolicy
+		want   bool
+	}{
+		{"", nil, true},
+		{"http://scanner.internal:9000", nil, true},
+		{"https://app.example.com", nil, false},
+		{"https://app.example.com", cors, true},
+		{"https://evil.example.com", cors, false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://scanner.internal:9000/scan/ws", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if got := allowSocketOrigin(req, tt.cors); got != tt.want {
+			t.Errorf("allowSocketOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
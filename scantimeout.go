@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Header and query parameter carrying a caller's scan timeout in seconds
+const (
+	scanTimeoutHeader = "X-Scan-Timeout"
+	scanTimeoutParam  = "timeout"
+)
+
+// scanTimeoutKey is the context key for the request's scan timeout
+type scanTimeoutKey struct{}
+
+// withScanTimeout returns ctx with the scan timeout to use for its scans
+func withScanTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, scanTimeoutKey{}, timeout)
+}
+
+// scanTimeout returns the scan timeout stored in ctx, or fallback (the
+// route's SCAN_TIMEOUT) if the caller and its tenant set none
+func scanTimeout(ctx context.Context, fallback time.Duration) time.Duration {
+	if timeout, ok := ctx.Value(scanTimeoutKey{}).(time.Duration); ok {
+		return timeout
+	}
+	return fallback
+}
+
+// requestScanTimeout returns the timeout the caller asked for with
+// ?timeout= or X-Scan-Timeout (0 = none), or an error if it is not a
+// positive number of seconds
+func requestScanTimeout(r *http.Request) (time.Duration, *requestError) {
+	value := r.URL.Query().Get(scanTimeoutParam)
+	if value == "" {
+		value = r.Header.Get(scanTimeoutHeader)
+	}
+	if value == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return 0, &requestError{status: http.StatusBadRequest, message: "Scan timeout must be a positive number of seconds"}
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// limitScanTimeout applies the scan timeout asked for by the request, or
+// else set for its tenant, clamped to SCAN_TIMEOUT_MAX_MINUTES. Must run
+// after enforceTenant. Scans of requests without either use the route's
+// SCAN_TIMEOUT.
+func limitScanTimeout(config *Config, next http.Handler) http.Handler {
+	maximum := config.ScanTimeoutMax
+	if maximum == 0 {
+		maximum = config.ScanTimeout
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout, reqErr := requestScanTimeout(r)
+		if reqErr != nil {
+			sendRequestError(w, reqErr)
+			return
+		}
+		if tenant := tenantFromContext(r.Context()); timeout == 0 && tenant != nil {
+			timeout = time.Duration(tenant.ScanTimeoutSeconds) * time.Second
+		}
+		if timeout == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if timeout > maximum {
+			timeout = maximum
+		}
+		next.ServeHTTP(w, r.WithContext(withScanTimeout(r.Context(), timeout)))
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestScanTimeout(t *testing.T) {
+	tests := []struct {
+		target  string
+		header  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"/scan", "", 0, false},
+		{"/scan?timeout=15", "", 15 * time.Second, false},
+		{"/scan", "90", 90 * time.Second, false},
+		{"/scan?timeout=15", "90", 15 * time.Second, false},
+		{"/scan?timeout=0", "", 0, true},
+		{"/scan", "15s", 0, true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.target, nil)
+		if tt.header != "" {
+			req.Header.Set(scanTimeoutHeader, tt.header)
+		}
+		got, reqErr := requestScanTimeout(req)
+		if got != tt.want || (reqErr != nil) != tt.wantErr {
+			t.Errorf("%s %q: got %v, %v; want %v, error %v", tt.target, tt.header, got, reqErr, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLimitScanTimeout(t *testing.T) {
+	cfg := &Config{ScanTimeout: 5 * time.Minute, ScanTimeoutMax: 10 * time.Minute}
+	var seen time.Duration
+	record := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = scanTimeout(r.Context(), cfg.ScanTimeout)
+	})
+	handler := limitScanTimeout(cfg, record)
+	interactive := &Tenant{Name: "web", ScanTimeoutSeconds: 15}
+
+	tests := []struct {
+		name   string
+		target string
+		tenant *Tenant
+		want   time.Duration
+	}{
+		{"default", "/scan", nil, 5 * time.Minute},
+		{"request", "/scan?timeout=30", nil, 30 * time.Second},
+		{"clamped", "/scan?timeout=3600", nil, 10 * time.Minute},
+		{"tenant", "/scan", interactive, 15 * time.Second},
+		{"request over tenant", "/scan?timeout=120", interactive, 2 * time.Minute},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.target, nil)
+		if tt.tenant != nil {
+			req = req.WithContext(context.WithValue(req.Context(), tenantKey{}, tt.tenant))
+		}
+		seen = 0
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusOK || seen != tt.want {
+			t.Errorf("%s: status %d, timeout %v; want %v", tt.name, recorder.Code, seen, tt.want)
+		}
+	}
+
+	// Without SCAN_TIMEOUT_MAX_MINUTES, requests can only shorten the timeout
+	handler = limitScanTimeout(&Config{ScanTimeout: 5 * time.Minute}, record)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/scan?timeout=3600", nil))
+	if seen != 5*time.Minute {
+		t.Errorf("timeout without a maximum = %v, want 5m", seen)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/scan?timeout=soon", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("invalid timeout: status %d, want 400", recorder.Code)
+	}
+}
+
+func TestScanHandlerRequestTimeout(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	handler := limitScanTimeout(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleScan(w, r, cfg, NewScanner(cfg))
+	}))
+	body, contentType := multipartUpload(t, "slow.bin", []byte("SLOW"))
+	req := httptest.NewRequest(http.MethodPost, "/scan", body)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(scanTimeoutHeader, "1")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("status %d, want 504 after the request's 1s timeout", recorder.Code)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Suffix of the variables naming a file that holds a secret setting
+const secretFileSuffix = "_FILE"
+
+// secretSettings are the sensitive settings that may instead be read from a
+// mounted secret file named by <NAME>_FILE (Docker/Kubernetes secrets)
+var secretSettings = map[string]bool{
+	EnvAPIKeys:               true,
+	EnvBasicAuthUsers:        true,
+	EnvJWTSecret:             true,
+	EnvNotifyURL:             true, // Slack/Teams webhook URLs embed a token
+	EnvElasticsearchPassword: true,
+	EnvElasticsearchAPIKey:   true,
+	EnvBackupKey:             true,
+	EnvResultTokenSecret:     true,
+	EnvResultURLSecret:       true,
+	EnvOTelHeaders:           true, // Usually carries collector credentials
+	EnvAzureStorageKey:       true,
+	EnvAzureStorageSASToken:  true,
+	EnvRemoteCredentials:     true,
+	EnvVerdictCacheRedisURL:  true, // May embed a password
+	EnvCoordinatorRedisURL:   true,
+	EnvMalwareBazaarAuthKey:  true,
+	EnvOutboundProxy:         true, // May embed proxy credentials
+	EnvArchivePasswords:      true,
+}
+
+// secretFromFile returns the contents of the file named by key_FILE, without
+// the trailing newline. Returns "" if no file is configured; read errors are
+// recorded for Validate.
+func secretFromFile(key string) string {
+	fileKey := key + secretFileSuffix
+	path := getenv(fileKey)
+	if path == "" {
+		return ""
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		invalidSettings = append(invalidSettings, fmt.Errorf("%s: %w", fileKey, err))
+		return ""
+	}
+	return strings.TrimRight(string(data), "\r\n")
+}
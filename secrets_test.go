@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSecretFile writes a secret file and returns its path
+func writeSecretFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write secret: %v", err)
+	}
+	return path
+}
+
+func TestSecretFromFile(t *testing.T) {
+	t.Setenv(EnvJWTSecret+secretFileSuffix, writeSecretFile(t, "s3cret\n"))
+	t.Setenv(EnvAPIKeys+secretFileSuffix, writeSecretFile(t, "ci:key1\ndeploy:key2\n"))
+
+	cfg := LoadConfig()
+	if cfg.JWTSecret != "s3cret" {
+		t.Errorf("JWTSecret = %q, want trailing newline stripped", cfg.JWTSecret)
+	}
+	if cfg.APIKeys["key1"] != "ci" || cfg.APIKeys["key2"] != "deploy" {
+		t.Errorf("APIKeys = %v, want one entry per line", cfg.APIKeys)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+func TestSecretEnvTakesPrecedence(t *testing.T) {
+	t.Setenv(EnvJWTSecret, "from-env")
+	t.Setenv(EnvJWTSecret+secretFileSuffix, writeSecretFile(t, "from-file"))
+
+	if got := LoadConfig().JWTSecret; got != "from-env" {
+		t.Errorf("JWTSecret = %q, want from-env", got)
+	}
+}
+
+func TestSecretFileOnlyForSecrets(t *testing.T) {
+	t.Setenv(EnvPort+secretFileSuffix, writeSecretFile(t, "1234"))
+
+	if got := LoadConfig().Port; got != DefaultPort {
+		t.Errorf("Port = %q, want default (PORT_FILE is not supported)", got)
+	}
+}
+
+func TestSecretFileMissing(t *testing.T) {
+	t.Setenv(EnvBackupKey+secretFileSuffix, filepath.Join(t.TempDir(), "missing"))
+
+	err := LoadConfig().Validate()
+	if err == nil || !strings.Contains(err.Error(), EnvBackupKey+secretFileSuffix) {
+		t.Errorf("Validate() error = %v, want unreadable secret file reported", err)
+	}
+}
+
+func TestSecretFileInConfigFile(t *testing.T) {
+	secret := writeSecretFile(t, "hunter2")
+	path := writeConfigFile(t, `{"elasticsearch_password_file": "`+secret+`"}`)
+
+	if err := LoadConfigFile(path); err != nil {
+		t.Fatalf("LoadConfigFile() error = %v", err)
+	}
+	if got := LoadConfig().ElasticsearchPassword; got != "hunter2" {
+		t.Errorf("ElasticsearchPassword = %q, want hunter2", got)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SIEM event formats
+const (
+	siemFormatCEF  = "cef"
+	siemFormatLEEF = "leef"
+)
+
+// Device identification in CEF/LEEF headers
+const (
+	siemVendor  = "ClamAV"
+	siemProduct = "clamav-rest"
+)
+
+// CEF severity for detections (0-10 scale, 7-8 = high)
+const siemSeverity = 8
+
+// siemFields lists the event fields in output order
+var siemFields = []string{
+	"time", "client_ip", "identity", "auth_method", "route",
+	"filename", "file_size", "file_sha256", "signature", "file", "file_hash",
+	"threat_category", "threat_family", "threat_tags",
+}
+
+// Default field names per format. CEF uses dictionary keys where one exists
+// and custom string labels otherwise; LEEF uses its predefined attributes.
+var siemDefaultFieldMaps = map[string]map[string]string{
+	siemFormatCEF: {
+		"time":        "rt",
+		"client_ip":   "src",
+		"identity":    "suser",
+		"auth_method": "cs2",
+		"route":       "request",
+		"filename":    "fname",
+		"file_size":   "fsize",
+		"file_sha256": "fileHash",
+		"signature":   "cs1",
+		"file":        "filePath",
+		"file_hash":   "cs3",
+
+		"threat_category": "cs4",
+		"threat_family":   "cs5",
+		"threat_tags":     "cs6",
+	},
+	siemFormatLEEF: {
+		"time":        "devTime",
+		"client_ip":   "src",
+		"identity":    "usrName",
+		"auth_method": "authMethod",
+		"route":       "url",
+		"filename":    "fileName",
+		"file_size":   "fileSize",
+		"file_sha256": "fileHash",
+		"signature":   "signature",
+		"file":        "filePath",
+		"file_hash":   "memberHash",
+
+		"threat_category": "threatCategory",
+		"threat_family":   "threatFamily",
+		"threat_tags":     "threatTags",
+	},
+}
+
+// Labels for CEF custom string fields
+var cefCustomLabels = map[string]string{
+	"cs1": "signature",
+	"cs2": "authMethod",
+	"cs3": "memberSHA256",
+	"cs4": "threatCategory",
+	"cs5": "threatFamily",
+	"cs6": "threatTags",
+}
+
+// SIEMForwarder sends detection events to a SIEM as CEF or LEEF over syslog.
+// Each detected signature becomes one event so SIEM rules can match on it.
+type SIEMForwarder struct {
+	syslog   *SyslogWriter
+	format   string
+	fieldMap map[string]string
+}
+
+// Global SIEM forwarder (nil when disabled)
+var siem *SIEMForwarder
+
+// NewSIEMForwarder creates the forwarder described by the config.
+// Returns nil when no SIEM address is configured.
+func NewSIEMForwarder(config *Config) (*SIEMForwarder, error) {
+	if config.SIEMAddress == "" {
+		return nil, nil
+	}
+
+	format := strings.ToLower(config.SIEMFormat)
+	defaults, ok := siemDefaultFieldMaps[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported SIEM format %q (use cef or leef)", config.SIEMFormat)
+	}
+
+	fieldMap := make(map[string]string, len(defaults))
+	for field, key := range defaults {
+		fieldMap[field] = key
+	}
+	for field, key := range config.SIEMFieldMap {
+		if _, known := defaults[field]; !known {
+			return nil, fmt.Errorf("unknown SIEM field %q in %s", field, EnvSIEMFieldMap)
+		}
+		fieldMap[field] = key
+	}
+
+	var tlsConfig *tls.Config
+	if strings.HasPrefix(config.SIEMAddress, "tls://") {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if config.SIEMCAFile != "" {
+			pool, err := loadCertPool(config.SIEMCAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = pool
+		}
+	}
+
+	w, err := NewSyslogWriter(config.SIEMAddress, config.SIEMFacility, siemProduct, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SIEMForwarder{syslog: w, format: format, fieldMap: fieldMap}, nil
+}
+
+// Forward sends one event per threat in the detection record.
+// Failures are logged but never fail the scan request.
+func (f *SIEMForwarder) Forward(record *AuditRecord) {
+	for _, threat := range record.Threats {
+		var message string
+		if f.format == siemFormatLEEF {
+			message = f.formatLEEF(record, threat)
+		} else {
+			message = f.formatCEF(record, threat)
+		}
+		if err := f.syslog.Write(syslogSeverityWarning, record.Event, message); err != nil {
+			log.Printf("Warning: failed to forward detection to SIEM: %v", err)
+			return
+		}
+	}
+}
+
+// eventFields returns the mapped key/value pairs for a threat, in field
+// order. Empty values and fields mapped to "-" are omitted.
+func (f *SIEMForwarder) eventFields(record *AuditRecord, threat Threat) [][2]string {
+	values := map[string]string{
+		"time":        strconv.FormatInt(record.Time.UnixMilli(), 10),
+		"client_ip":   record.ClientIP,
+		"identity":    record.Identity,
+		"auth_method": record.AuthMethod,
+		"route":       record.Route,
+		"filename":    record.Filename,
+		"file_size":   strconv.FormatInt(record.FileSize, 10),
+		"file_sha256": record.FileSHA256,
+		"signature":   threat.Name,
+		"file":        threat.File,
+		"file_hash":   threat.FileHash,
+
+		"threat_category": threat.Category,
+		"threat_family":   threat.Family,
+		"threat_tags":     strings.Join(threat.Tags, ","),
+	}
+
+	var fields [][2]string
+	for _, field := range siemFields {
+		key, value := f.fieldMap[field], values[field]
+		if key == "-" || value == "" {
+			continue
+		}
+		fields = append(fields, [2]string{key, value})
+	}
+	return fields
+}
+
+// formatCEF builds an ArcSight Common Event Format message:
+// CEF:0|Vendor|Product|Version|SignatureID|Name|Severity|Extension
+func (f *SIEMForwarder) formatCEF(record *AuditRecord, threat Threat) string {
+	fields := f.eventFields(record, threat)
+
+	var ext []string
+	for _, kv := range fields {
+		ext = append(ext, kv[0]+"="+cefEscapeExtension(kv[1]))
+	}
+	// Label custom string fields that are in use
+	var labels []string
+	for _, kv := range fields {
+		if label, ok := cefCustomLabels[kv[0]]; ok {
+			labels = append(labels, kv[0]+"Label="+label)
+		}
+	}
+	sort.Strings(labels)
+	ext = append(ext, labels...)
+
+	name := "Malware detected"
+	if record.Event == auditEventRetroDetection {
+		name = "Malware detected on re-scan"
+	}
+	return fmt.Sprintf("CEF:0|%s|%s||%s|%s|%d|%s",
+		cefEscapeHeader(siemVendor),
+		cefEscapeHeader(siemProduct),
+		cefEscapeHeader(threat.Name),
+		name,
+		siemSeverity,
+		strings.Join(ext, " "))
+}
+
+// formatLEEF builds an IBM QRadar LEEF 2.0 message with tab-delimited
+// attributes: LEEF:2.0|Vendor|Product|Version|EventID|Delimiter|Attributes
+func (f *SIEMForwarder) formatLEEF(record *AuditRecord, threat Threat) string {
+	fields := f.eventFields(record, threat)
+
+	attrs := []string{"cat=Malware", "sev=" + strconv.Itoa(siemSeverity)}
+	for _, kv := range fields {
+		attrs = append(attrs, kv[0]+"="+leefEscape(kv[1]))
+		if kv[0] == "devTime" {
+			attrs = append(attrs, "devTimeFormat=epoch")
+		}
+	}
+
+	return fmt.Sprintf("LEEF:2.0|%s|%s||%s|x09|%s",
+		leefEscapeHeader(siemVendor),
+		leefEscapeHeader(siemProduct),
+		leefEscapeHeader(record.Event),
+		strings.Join(attrs, "\t"))
+}
+
+// cefEscapeHeader escapes backslashes and pipes in CEF header fields
+func cefEscapeHeader(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ").Replace(s)
+}
+
+// cefEscapeExtension escapes backslashes, equals signs and newlines in
+// CEF extension values
+func cefEscapeExtension(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`).Replace(s)
+}
+
+// leefEscapeHeader escapes pipes in LEEF header fields
+func leefEscapeHeader(s string) string {
+	return strings.NewReplacer(`|`, `\|`, "\r", " ", "\n", " ").Replace(s)
+}
+
+// leefEscape replaces characters that would break tab-delimited attributes
+func leefEscape(s string) string {
+	return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(s)
+}
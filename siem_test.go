@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDetectionRecord() *AuditRecord {
+	return &AuditRecord{
+		Time:       time.UnixMilli(1700000000000).UTC(),
+		Event:      auditEventDetection,
+		ClientIP:   "192.0.2.10",
+		Identity:   "ci",
+		AuthMethod: "apikey",
+		Route:      "/scan",
+		Filename:   "a=b|c.zip",
+		FileSize:   42,
+		FileSHA256: "deadbeef",
+		Threats: []Threat{
+			{Name: "Eicar-Test-Signature", File: "eicar.com", FileHash: "abc"},
+			{Name: "Win.Test|Pipe", File: "dir\\x.exe"},
+		},
+	}
+}
+
+func TestNewSIEMForwarder(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *Config
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "disabled", config: &Config{}, wantNil: true},
+		{name: "cef", config: &Config{SIEMAddress: "udp://localhost:514", SIEMFormat: "CEF", SIEMFacility: "local4"}},
+		{name: "leef over tls", config: &Config{SIEMAddress: "tls://localhost:6514", SIEMFormat: "leef", SIEMFacility: "auth"}},
+		{name: "unknown format", config: &Config{SIEMAddress: "udp://localhost:514", SIEMFormat: "json", SIEMFacility: "auth"}, wantErr: true},
+		{name: "unknown field", config: &Config{
+			SIEMAddress: "udp://localhost:514", SIEMFormat: "cef", SIEMFacility: "auth",
+			SIEMFieldMap: map[string]string{"nope": "x"},
+		}, wantErr: true},
+		{name: "missing CA file", config: &Config{
+			SIEMAddress: "tls://localhost:6514", SIEMFormat: "cef", SIEMFacility: "auth",
+			SIEMCAFile: "/nonexistent/ca.pem",
+		}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewSIEMForwarder(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewSIEMForwarder() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (f == nil) != tt.wantNil {
+				t.Errorf("NewSIEMForwarder() = %v, wantNil %v", f, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestFormatCEF(t *testing.T) {
+	f, err := NewSIEMForwarder(&Config{SIEMAddress: "udp://localhost:514", SIEMFormat: "cef", SIEMFacility: "auth"})
+	if err != nil {
+		t.Fatalf("NewSIEMForwarder() error: %v", err)
+	}
+	record := testDetectionRecord()
+
+	msg := f.formatCEF(record, record.Threats[1])
+
+	wantPrefix := `CEF:0|ClamAV|clamav-rest||Win.Test\|Pipe|Malware detected|8|`
+	if !strings.HasPrefix(msg, wantPrefix) {
+		t.Errorf("message = %q, want prefix %q", msg, wantPrefix)
+	}
+	for _, want := range []string{
+		"rt=1700000000000", "src=192.0.2.10", "suser=ci", `fname=a\=b|c.zip`,
+		"fsize=42", "fileHash=deadbeef", `cs1=Win.Test|Pipe`, `filePath=dir\\x.exe`,
+		"cs1Label=signature", "cs2Label=authMethod",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message missing %q: %s", want, msg)
+		}
+	}
+	// Empty member hash must be omitted along with its label
+	if strings.Contains(msg, "cs3") {
+		t.Errorf("message should not contain cs3: %s", msg)
+	}
+}
+
+func TestFormatLEEF(t *testing.T) {
+	f, err := NewSIEMForwarder(&Config{
+		SIEMAddress:  "udp://localhost:514",
+		SIEMFormat:   "leef",
+		SIEMFacility: "auth",
+		SIEMFieldMap: map[string]string{"identity": "accountName", "route": "-"},
+	})
+	if err != nil {
+		t.Fatalf("NewSIEMForwarder() error: %v", err)
+	}
+	record := testDetectionRecord()
+	record.Filename = "tab\there.zip"
+
+	msg := f.formatLEEF(record, record.Threats[0])
+
+	if !strings.HasPrefix(msg, "LEEF:2.0|ClamAV|clamav-rest||detection|x09|") {
+		t.Errorf("message = %q, wrong header", msg)
+	}
+	attrs := strings.Split(msg[strings.LastIndex(msg, "|")+1:], "\t")
+	got := make(map[string]string)
+	for _, attr := range attrs {
+		key, value, _ := strings.Cut(attr, "=")
+		got[key] = value
+	}
+
+	if got["accountName"] != "ci" {
+		t.Errorf("accountName = %q, want mapped identity", got["accountName"])
+	}
+	if _, ok := got["url"]; ok {
+		t.Error("route mapped to - should be omitted")
+	}
+	if got["fileName"] != "tab here.zip" {
+		t.Errorf("fileName = %q, tab should be replaced", got["fileName"])
+	}
+	if got["devTimeFormat"] != "epoch" || got["signature"] != "Eicar-Test-Signature" {
+		t.Errorf("attributes = %v", got)
+	}
+}
+
+func TestSIEMForwardOneEventPerThreat(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	f, err := NewSIEMForwarder(&Config{SIEMAddress: "udp://" + conn.LocalAddr().String(), SIEMFormat: "cef", SIEMFacility: "auth"})
+	if err != nil {
+		t.Fatalf("NewSIEMForwarder() error: %v", err)
+	}
+
+	f.Forward(testDetectionRecord())
+
+	buf := make([]byte, 4096)
+	for _, want := range []string{"Eicar-Test-Signature", `Win.Test\|Pipe`} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom() error: %v", err)
+		}
+		if msg := string(buf[:n]); !strings.Contains(msg, "CEF:0|") || !strings.Contains(msg, want) {
+			t.Errorf("message = %q, want CEF event for %s", msg, want)
+		}
+	}
+}
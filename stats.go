@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timeout for the clamd commands behind /admin/stats
+const clamdStatsTimeout = 10 * time.Second
+
+// ClamdStats is the parsed output of clamd STATS and VERSIONCOMMANDS
+type ClamdStats struct {
+	Version  string             `json:"version"`
+	Commands []string           `json:"commands,omitempty"`
+	Pools    int                `json:"pools"`
+	State    string             `json:"state"`
+	Threads  ClamdThreadStats   `json:"threads"`
+	Queue    ClamdQueueStats    `json:"queue"`
+	MemoryMB map[string]float64 `json:"memory_mb,omitempty"` // MEMSTATS values (not reported on every platform)
+}
+
+// ClamdThreadStats describes the clamd thread pool
+type ClamdThreadStats struct {
+	Live        int `json:"live"`
+	Idle        int `json:"idle"`
+	Max         int `json:"max"`
+	IdleTimeout int `json:"idle_timeout"`
+}
+
+// ClamdQueueStats describes commands waiting for a clamd thread
+type ClamdQueueStats struct {
+	Items   int                  `json:"items"`
+	Entries []ClamdQueuedCommand `json:"entries,omitempty"`
+}
+
+// ClamdQueuedCommand is a queued or running command and how long it has waited
+type ClamdQueuedCommand struct {
+	Command string  `json:"command"`
+	Seconds float64 `json:"seconds"`
+}
+
+// clamdStatsTarget returns the clamd socket to query: the pool's address,
+// or the socket declared in the clamd config used by clamdscan
+func clamdStatsTarget(config *Config) (string, string, error) {
+	if clamdPool != nil {
+		return clamdPool.network, clamdPool.address, nil
+	}
+	return clamdConfSocket(config.ClamdConfigFile)
+}
+
+// clamdConfSocket reads LocalSocket or TCPSocket/TCPAddr from a clamd.conf
+func clamdConfSocket(path string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	var localSocket, tcpPort string
+	tcpAddr := "127.0.0.1"
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch fields[0] {
+		case "LocalSocket":
+			localSocket = fields[1]
+		case "TCPSocket":
+			tcpPort = fields[1]
+		case "TCPAddr":
+			tcpAddr = fields[1]
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return "", "", err
+	}
+
+	switch {
+	case localSocket != "":
+		return "unix", localSocket, nil
+	case tcpPort != "":
+		return "tcp", net.JoinHostPort(tcpAddr, tcpPort), nil
+	}
+	return "", "", fmt.Errorf("no LocalSocket or TCPSocket in %s", path)
+}
+
+// parseClamdStats parses a STATS reply:
+//
+//	POOLS: 1
+//
+//	STATE: VALID PRIMARY
+//	THREADS: live 1  idle 0 max 12 idle-timeout 30
+//	QUEUE: 0 items
+//		STATS 0.000394
+//
+//	MEMSTATS: heap 9.082M mmap 0.000M used 6.902M free 2.184M releasable 0.129M pools 1 pools_used 565.979M pools_total 565.999M
+//	END
+func parseClamdStats(reply string, stats *ClamdStats) {
+	for _, line := range strings.Split(reply, "\n") {
+		if strings.HasPrefix(line, "\t") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				seconds, _ := strconv.ParseFloat(fields[1], 64)
+				stats.Queue.Entries = append(stats.Queue.Entries, ClamdQueuedCommand{Command: fields[0], Seconds: seconds})
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		switch key {
+		case "POOLS":
+			stats.Pools, _ = strconv.Atoi(strings.TrimSpace(value))
+		case "STATE":
+			stats.State = strings.TrimSpace(value)
+		case "THREADS":
+			for i := 0; i+1 < len(fields); i += 2 {
+				n, _ := strconv.Atoi(fields[i+1])
+				switch fields[i] {
+				case "live":
+					stats.Threads.Live = n
+				case "idle":
+					stats.Threads.Idle = n
+				case "max":
+					stats.Threads.Max = n
+				case "idle-timeout":
+					stats.Threads.IdleTimeout = n
+				}
+			}
+		case "QUEUE":
+			if len(fields) > 0 {
+				stats.Queue.Items, _ = strconv.Atoi(fields[0])
+			}
+		case "MEMSTATS":
+			for i := 0; i+1 < len(fields); i += 2 {
+				// "pools" is a count; the other values are megabytes
+				if fields[i] == "pools" {
+					continue
+				}
+				n, err := strconv.ParseFloat(strings.TrimSuffix(fields[i+1], "M"), 64)
+				if err != nil {
+					continue // N/A
+				}
+				if stats.MemoryMB == nil {
+					stats.MemoryMB = make(map[string]float64)
+				}
+				stats.MemoryMB[fields[i]] = n
+			}
+		}
+	}
+}
+
+// parseVersionCommands parses a VERSIONCOMMANDS reply:
+//
+//	ClamAV 1.0.0/26789/Mon Jan 1 12:00:00 2024| COMMANDS: SCAN QUIT RELOAD PING ...
+func parseVersionCommands(reply string, stats *ClamdStats) {
+	version, commands, _ := strings.Cut(reply, "|")
+	stats.Version = strings.TrimSpace(version)
+	stats.Commands = strings.Fields(strings.TrimPrefix(strings.TrimSpace(commands), "COMMANDS:"))
+}
+
+// statsHandler serves GET /admin/stats with clamd's thread, queue and
+// memory statistics
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	network, address, err := clamdStatsTarget(config)
+	if err != nil {
+		log.Printf("Cannot locate clamd socket: %v", err)
+		sendErrorStatus(w, http.StatusServiceUnavailable, "clamd socket not configured")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), clamdStatsTimeout)
+	defer cancel()
+
+	var stats ClamdStats
+	reply, err := clamdCommand(ctx, network, address, "STATS")
+	if err == nil {
+		parseClamdStats(reply, &stats)
+		reply, err = clamdCommand(ctx, network, address, "VERSIONCOMMANDS")
+	}
+	if err != nil {
+		log.Printf("clamd stats failed: %v", err)
+		sendErrorStatus(w, http.StatusServiceUnavailable, "clamd unavailable")
+		return
+	}
+	parseVersionCommands(reply, &stats)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
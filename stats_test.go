@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Sample STATS reply served by fakeClamd
+const testClamdStats = "POOLS: 1\n\nSTATE: VALID PRIMARY\nTHREADS: live 2  idle 1 max 12 idle-timeout 30\nQUEUE: 1 items\n\tSTATS 0.000394\n\nMEMSTATS: heap 9.082M mmap 0.000M used 6.902M free 2.184M releasable 0.129M pools 1 pools_used 565.979M pools_total 565.999M\nEND"
+
+func TestParseClamdStats(t *testing.T) {
+	var stats ClamdStats
+	parseClamdStats(testClamdStats, &stats)
+
+	if stats.Pools != 1 || stats.State != "VALID PRIMARY" {
+		t.Errorf("pools/state = %d/%q", stats.Pools, stats.State)
+	}
+	if want := (ClamdThreadStats{Live: 2, Idle: 1, Max: 12, IdleTimeout: 30}); stats.Threads != want {
+		t.Errorf("threads = %+v, want %+v", stats.Threads, want)
+	}
+	if stats.Queue.Items != 1 || len(stats.Queue.Entries) != 1 || stats.Queue.Entries[0].Command != "STATS" {
+		t.Errorf("queue = %+v", stats.Queue)
+	}
+	if stats.MemoryMB["heap"] != 9.082 || stats.MemoryMB["pools_total"] != 565.999 {
+		t.Errorf("memory = %v", stats.MemoryMB)
+	}
+	if _, ok := stats.MemoryMB["pools"]; ok {
+		t.Error("pool count reported as memory")
+	}
+}
+
+func TestParseClamdStatsMemoryUnavailable(t *testing.T) {
+	var stats ClamdStats
+	parseClamdStats("MEMSTATS: heap N/A mmap N/A used N/A free N/A releasable N/A pools 1 pools_used 1.000M pools_total 2.000M", &stats)
+
+	if want := map[string]float64{"pools_used": 1, "pools_total": 2}; !reflect.DeepEqual(stats.MemoryMB, want) {
+		t.Errorf("memory = %v, want %v", stats.MemoryMB, want)
+	}
+}
+
+func TestParseVersionCommands(t *testing.T) {
+	var stats ClamdStats
+	parseVersionCommands("ClamAV 1.2.0/27000/Mon Jan 1 12:00:00 2024| COMMANDS: SCAN PING STATS", &stats)
+
+	if stats.Version != "ClamAV 1.2.0/27000/Mon Jan 1 12:00:00 2024" {
+		t.Errorf("version = %q", stats.Version)
+	}
+	if want := []string{"SCAN", "PING", "STATS"}; !reflect.DeepEqual(stats.Commands, want) {
+		t.Errorf("commands = %v, want %v", stats.Commands, want)
+	}
+}
+
+func TestClamdConfSocket(t *testing.T) {
+	tests := []struct {
+		name        string
+		conf        string
+		wantNetwork string
+		wantAddress string
+		wantErr     bool
+	}{
+		{name: "tcp", conf: "TCPSocket 3310\nTCPAddr 10.0.0.1\n", wantNetwork: "tcp", wantAddress: "10.0.0.1:3310"},
+		{name: "tcp default address", conf: "# TCPAddr 10.0.0.1\nTCPSocket 3310\n", wantNetwork: "tcp", wantAddress: "127.0.0.1:3310"},
+		{name: "unix preferred", conf: "TCPSocket 3310\nLocalSocket /run/clamd.sock\n", wantNetwork: "unix", wantAddress: "/run/clamd.sock"},
+		{name: "no socket", conf: "Foreground yes\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "clamd.conf")
+			os.WriteFile(path, []byte(tt.conf), 0644)
+
+			network, address, err := clamdConfSocket(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("clamdConfSocket() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if network != tt.wantNetwork || address != tt.wantAddress {
+				t.Errorf("clamdConfSocket() = %s %s, want %s %s", network, address, tt.wantNetwork, tt.wantAddress)
+			}
+		})
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	fake := newFakeClamd(t)
+	pool, err := NewClamdPool(fake.address(), 1)
+	if err != nil {
+		t.Fatalf("NewClamdPool() error = %v", err)
+	}
+	clamdPool = pool
+	t.Cleanup(func() { clamdPool = nil })
+
+	recorder := httptest.NewRecorder()
+	statsHandler(recorder, httptest.NewRequest(http.MethodGet, "/admin/stats", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", recorder.Code, recorder.Body)
+	}
+
+	var stats ClamdStats
+	if err := json.NewDecoder(recorder.Body).Decode(&stats); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if stats.Threads.Max != 12 || len(stats.Commands) == 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestStatsHandlerClamdDown(t *testing.T) {
+	pool, _ := NewClamdPool("tcp://127.0.0.1:1", 1)
+	clamdPool = pool
+	t.Cleanup(func() { clamdPool = nil })
+
+	recorder := httptest.NewRecorder()
+	statsHandler(recorder, httptest.NewRequest(http.MethodGet, "/admin/stats", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", recorder.Code)
+	}
+}
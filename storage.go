@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Object storage providers
+const (
+	storageGCS   = "gcs"
+	storageAzure = "azure"
+)
+
+// storageTimeout bounds token and metadata requests; downloads are bounded
+// by the client's request instead
+const storageTimeout = 30 * time.Second
+
+// ObjectStore is a cloud storage service objects can be scanned from.
+// Credentials come from the service config, never from the request.
+type ObjectStore interface {
+	// Locate checks an object reference and returns its URL for logs and
+	// reports, e.g. gs://bucket/name
+	Locate(bucket, object string) (string, error)
+	// Open starts downloading an object. Failed requests return a
+	// *storageError with the service's status.
+	Open(ctx context.Context, bucket, object string) (io.ReadCloser, error)
+}
+
+// ObjectScanRequest is the body of POST /scan/object
+type ObjectScanRequest struct {
+	Provider string `json:"provider"` // "gcs" or "azure"
+	Bucket   string `json:"bucket"`   // GCS bucket or Azure container
+	Object   string `json:"object"`   // Object or blob name
+}
+
+// ObjectScanner downloads objects from the enabled providers for scanning
+type ObjectScanner struct {
+	stores map[string]ObjectStore
+}
+
+// Global object scanner (nil when object storage scanning is disabled)
+var objectScanner *ObjectScanner
+
+// NewObjectScanner creates the stores for the configured providers.
+// Returns nil when no provider is enabled.
+func NewObjectScanner(config *Config) (*ObjectScanner, error) {
+	if len(config.ObjectStorageProviders) == 0 {
+		return nil, nil
+	}
+	s := &ObjectScanner{stores: make(map[string]ObjectStore)}
+	for _, provider := range config.ObjectStorageProviders {
+		var store ObjectStore
+		var err error
+		switch provider {
+		case storageGCS:
+			store, err = newGCSStore(config)
+		case storageAzure:
+			store, err = newAzureStore(config)
+		default:
+			err = fmt.Errorf("unknown provider %q in %s", provider, EnvObjectStorageProviders)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.stores[provider] = store
+	}
+	return s, nil
+}
+
+// storageError is a failed storage request; status is the service's
+type storageError struct {
+	status  int
+	message string
+}
+
+func (e *storageError) Error() string {
+	return fmt.Sprintf("storage returned %d: %s", e.status, e.message)
+}
+
+// checkStorageResponse returns a storageError for a failed response,
+// reading a little of the body for the log
+func checkStorageResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &storageError{status: resp.StatusCode, message: sanitizeFilename(string(body))}
+}
+
+// objectScanHandler handles POST /scan/object. The object is downloaded to
+// a temp file and scanned like an upload, so the response (and async mode)
+// are the same as for /scan.
+func objectScanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	startTime := time.Now()
+	if rejectWhileStarting(w, r, startTime) {
+		return
+	}
+
+	var request ObjectScanRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		sendErrorStatus(w, http.StatusBadRequest, "Invalid object scan request")
+		return
+	}
+	upload, reqErr := objectScanner.Fetch(r.Context(), &request, config.MaxUploadSize)
+	if reqErr != nil {
+		recordScan(scanTags(r), "error", time.Since(startTime), 0, nil)
+		sendRequestError(w, reqErr)
+		return
+	}
+	respondScan(w, r, config, scanner, upload, startTime)
+}
+
+// Fetch checks an object reference and downloads the object to a temp
+// file, up to limit bytes
+func (s *ObjectScanner) Fetch(ctx context.Context, request *ObjectScanRequest, limit int64) (*uploadedFile, *requestError) {
+	store := s.stores[request.Provider]
+	if store == nil {
+		return nil, &requestError{status: http.StatusBadRequest, message: "Unknown or disabled provider: " + sanitizeFilename(request.Provider)}
+	}
+	name, err := store.Locate(request.Bucket, request.Object)
+	if err != nil {
+		return nil, &requestError{status: http.StatusBadRequest, message: "Invalid object reference: " + err.Error()}
+	}
+	return downloadObject(ctx, store, request, name, limit)
+}
+
+// downloadObject downloads an object to a temp file, up to limit bytes.
+// Failures are logged here; the returned requestError is safe to send to
+// the client.
+func downloadObject(ctx context.Context, store ObjectStore, request *ObjectScanRequest, name string, limit int64) (*uploadedFile, *requestError) {
+	safeName := sanitizeFilename(name)
+	body, err := store.Open(ctx, request.Bucket, request.Object)
+	if err != nil {
+		log.Printf("Failed to download %s: %v", safeName, err)
+		return nil, storageRequestError(err)
+	}
+	defer body.Close()
+
+	tempFile, err := os.CreateTemp(scanTmpDir, "clamav-scan-*")
+	if err != nil {
+		log.Printf("Failed to create temp file: %v", err)
+		return nil, &requestError{status: http.StatusInternalServerError, message: "Server error during file processing"}
+	}
+	defer tempFile.Close()
+
+	size, err := io.Copy(tempFile, io.LimitReader(body, limit+1))
+	if err == nil && size > limit {
+		os.Remove(tempFile.Name())
+		log.Printf("Rejected %s: exceeds limit %d", safeName, limit)
+		return nil, uploadTooLarge(limit)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		log.Printf("Failed to download %s: %v", safeName, err)
+		return nil, storageRequestError(err)
+	}
+	log.Printf("Downloaded object: %s (%d bytes)", safeName, size)
+
+	return &uploadedFile{path: tempFile.Name(), filename: name, safeFilename: safeName, size: size}, nil
+}
+
+// storageRequestError maps a storage failure to the client response
+func storageRequestError(err error) *requestError {
+	var storeErr *storageError
+	if errors.As(err, &storeErr) {
+		switch storeErr.status {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return &requestError{status: http.StatusForbidden, message: "Storage denied access to the object"}
+		case http.StatusNotFound:
+			return &requestError{status: http.StatusNotFound, message: "Object not found"}
+		}
+	}
+	if errors.Is(err, context.Canceled) {
+		return &requestError{status: http.StatusRequestTimeout, message: "Request cancelled"}
+	}
+	return &requestError{status: http.StatusBadGateway, message: "Failed to download object"}
+}
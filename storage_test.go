@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeStore serves objects from memory; missing objects return 404
+type fakeStore struct {
+	objects map[string]string // By bucket/object
+}
+
+func (s *fakeStore) Locate(bucket, object string) (string, error) {
+	if bucket == "" || object == "" {
+		return "", errors.New("empty name")
+	}
+	return "fake://" + bucket + "/" + object, nil
+}
+
+func (s *fakeStore) Open(ctx context.Context, bucket, object string) (io.ReadCloser, error) {
+	data, ok := s.objects[bucket+"/"+object]
+	if !ok {
+		return nil, &storageError{status: http.StatusNotFound, message: "no such object"}
+	}
+	return io.NopCloser(strings.NewReader(data)), nil
+}
+
+// useObjectScanner sets the globals for /scan/object with the fake clamd
+// and store registered as the gcs provider
+func useObjectScanner(t *testing.T, store ObjectStore) *Config {
+	t.Helper()
+	cfg := useFakeClamdScanner(t)
+
+	oldConfig, oldScanner, oldObjectScanner := config, scanner, objectScanner
+	config, scanner = cfg, NewScanner(cfg)
+	objectScanner = &ObjectScanner{stores: map[string]ObjectStore{storageGCS: store}}
+	t.Cleanup(func() { config, scanner, objectScanner = oldConfig, oldScanner, oldObjectScanner })
+	return cfg
+}
+
+func postObjectScan(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/scan/object", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	objectScanHandler(recorder, req)
+	return recorder
+}
+
+func TestObjectScanHandler(t *testing.T) {
+	useObjectScanner(t, &fakeStore{objects: map[string]string{
+		"uploads/clean.txt":     "hello",
+		"uploads/in/payload.js": "EICAR test",
+	}})
+
+	tests := []struct {
+		object string
+		want   string
+	}{
+		{object: "clean.txt", want: "clean"},
+		{object: "in/payload.js", want: "infected"},
+	}
+	for _, tt := range tests {
+		recorder := postObjectScan(t, `{"provider": "gcs", "bucket": "uploads", "object": "`+tt.object+`"}`)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body %s", tt.object, recorder.Code, recorder.Body)
+		}
+		var response ScanResponse
+		json.NewDecoder(recorder.Body).Decode(&response)
+		if response.Status != tt.want {
+			t.Errorf("%s: status = %q, want %q", tt.object, response.Status, tt.want)
+		}
+	}
+}
+
+func TestObjectScanHandlerErrors(t *testing.T) {
+	cfg := useObjectScanner(t, &fakeStore{objects: map[string]string{"uploads/big.bin": "0123456789"}})
+	cfg.MaxUploadSize = 4
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "invalid JSON", body: `{"provider":`, want: http.StatusBadRequest},
+		{name: "credentials in request", body: `{"provider": "gcs", "bucket": "b", "object": "o", "key": "secret"}`, want: http.StatusBadRequest},
+		{name: "disabled provider", body: `{"provider": "azure", "bucket": "b", "object": "o"}`, want: http.StatusBadRequest},
+		{name: "invalid reference", body: `{"provider": "gcs", "bucket": "uploads", "object": ""}`, want: http.StatusBadRequest},
+		{name: "missing object", body: `{"provider": "gcs", "bucket": "uploads", "object": "gone"}`, want: http.StatusNotFound},
+		{name: "too large", body: `{"provider": "gcs", "bucket": "uploads", "object": "big.bin"}`, want: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		if recorder := postObjectScan(t, tt.body); recorder.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, recorder.Code, tt.want)
+		}
+	}
+}
+
+func TestStorageRequestError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{err: &storageError{status: http.StatusUnauthorized}, want: http.StatusForbidden},
+		{err: &storageError{status: http.StatusForbidden}, want: http.StatusForbidden},
+		{err: &storageError{status: http.StatusNotFound}, want: http.StatusNotFound},
+		{err: &storageError{status: http.StatusServiceUnavailable}, want: http.StatusBadGateway},
+		{err: context.Canceled, want: http.StatusRequestTimeout},
+		{err: errors.New("connection refused"), want: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		if got := storageRequestError(tt.err); got.status != tt.want {
+			t.Errorf("storageRequestError(%v) = %d, want %d", tt.err, got.status, tt.want)
+		}
+	}
+}
+
+func TestNewObjectScanner(t *testing.T) {
+	if s, err := NewObjectScanner(&Config{}); s != nil || err != nil {
+		t.Errorf("NewObjectScanner() = %v, %v; want disabled", s, err)
+	}
+
+	s, err := NewObjectScanner(&Config{ObjectStorageProviders: []string{storageGCS, storageAzure}, AzureStorageAccount: "scans"})
+	if err != nil {
+		t.Fatalf("NewObjectScanner() error: %v", err)
+	}
+	if s.stores[storageGCS] == nil || s.stores[storageAzure] == nil {
+		t.Errorf("stores = %v, want gcs and azure", s.stores)
+	}
+
+	if _, err := NewObjectScanner(&Config{ObjectStorageProviders: []string{"s3"}}); err == nil {
+		t.Error("NewObjectScanner() accepted an unknown provider")
+	}
+}
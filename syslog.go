@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Syslog severities (RFC 5424)
+const (
+	syslogSeverityWarning = 4
+	syslogSeverityNotice  = 5
+	syslogSeverityInfo    = 6
+)
+
+// syslogFacilities maps facility names to their RFC 5424 codes
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Timeout for connecting and writing to the syslog server
+const syslogTimeout = 5 * time.Second
+
+// SyslogWriter sends RFC 5424 messages to a syslog server.
+// Supported addresses: udp://host:port, tcp://host:port, tls://host:port,
+// unix:///dev/log. TCP and TLS use octet-counting framing (RFC 6587/5425).
+// Broken connections are re-established on the next write.
+type SyslogWriter struct {
+	network  string
+	address  string
+	facility int
+	appName  string
+	hostname string
+	tls      *tls.Config // Set for tls:// addresses
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslogWriter parses the address and facility name. tlsConfig is used
+// for tls:// addresses (nil = system roots). The connection is opened lazily
+// on the first write.
+func NewSyslogWriter(address, facility, appName string, tlsConfig *tls.Config) (*SyslogWriter, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid syslog address %q: %w", address, err)
+	}
+
+	w := &SyslogWriter{appName: appName}
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid syslog address %q: missing host", address)
+		}
+		w.network, w.address = u.Scheme, u.Host
+		if u.Scheme == "tls" {
+			w.network = "tcp"
+			w.tls = tlsConfig
+			if w.tls == nil {
+				w.tls = &tls.Config{MinVersion: tls.VersionTLS12}
+			}
+		}
+	case "unix":
+		w.network, w.address = "unixgram", u.Path
+	default:
+		return nil, fmt.Errorf("unsupported syslog scheme %q (use udp, tcp, tls or unix)", u.Scheme)
+	}
+
+	code, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	w.facility = code
+
+	w.hostname, _ = os.Hostname()
+	if w.hostname == "" {
+		w.hostname = "-"
+	}
+
+	return w, nil
+}
+
+// Write sends one message with the given severity and message ID
+func (w *SyslogWriter) Write(severity int, msgID, message string) error {
+	line := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		w.facility*8+severity,
+		time.Now().UTC().Format(time.RFC3339Nano),
+		w.hostname, w.appName, os.Getpid(), msgID, message)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Retry once on a fresh connection (server restarts, idle TCP timeouts)
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if w.conn, err = w.dial(); err != nil {
+				return err
+			}
+		}
+		if err = w.send(line); err == nil {
+			return nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+// dial opens the connection to the syslog server
+func (w *SyslogWriter) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogTimeout}
+	if w.tls != nil {
+		return tls.DialWithDialer(dialer, w.network, w.address, w.tls)
+	}
+	return dialer.Dial(w.network, w.address)
+}
+
+// send writes a message with the framing required by the transport
+func (w *SyslogWriter) send(line string) error {
+	w.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	if w.network == "tcp" {
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+	_, err := w.conn.Write([]byte(line))
+	return err
+}
+
+// Close closes the connection
+func (w *SyslogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
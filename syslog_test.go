@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewSyslogWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		address  string
+		facility string
+		wantErr  bool
+	}{
+		{name: "udp", address: "udp://localhost:514", facility: "auth"},
+		{name: "tcp", address: "tcp://localhost:601", facility: "LOCAL0"},
+		{name: "tls", address: "tls://localhost:6514", facility: "auth"},
+		{name: "unix", address: "unix:///dev/log", facility: "daemon"},
+		{name: "missing host", address: "udp://", facility: "auth", wantErr: true},
+		{name: "bad scheme", address: "http://localhost", facility: "auth", wantErr: true},
+		{name: "bad facility", address: "udp://localhost:514", facility: "nope", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSyslogWriter(tt.address, tt.facility, "test", nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewSyslogWriter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSyslogWriterUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	w, err := NewSyslogWriter("udp://"+conn.LocalAddr().String(), "auth", "clamav-rest", nil)
+	if err != nil {
+		t.Fatalf("NewSyslogWriter() error: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.Write(syslogSeverityWarning, "detection", `{"event":"detection"}`); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom() error: %v", err)
+	}
+
+	msg := string(buf[:n])
+	// auth (4) * 8 + warning (4) = 36
+	if !strings.HasPrefix(msg, "<36>1 ") {
+		t.Errorf("message = %q, want <36>1 prefix", msg)
+	}
+	if !strings.Contains(msg, " clamav-rest ") || !strings.HasSuffix(msg, ` detection - {"event":"detection"}`) {
+		t.Errorf("message = %q, missing app name or payload", msg)
+	}
+}
+
+func TestSyslogWriterTCPFraming(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		length, _ := reader.ReadString(' ')
+		n, err := strconv.Atoi(strings.TrimSpace(length))
+		if err != nil {
+			received <- "bad frame: " + length
+			return
+		}
+		msg := make([]byte, n)
+		io.ReadFull(reader, msg)
+		received <- string(msg)
+	}()
+
+	w, err := NewSyslogWriter("tcp://"+listener.Addr().String(), "local0", "clamav-rest", nil)
+	if err != nil {
+		t.Fatalf("NewSyslogWriter() error: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.Write(syslogSeverityInfo, "test", "hello"); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+
+	select {
+	case msg := <-received:
+		// local0 (16) * 8 + info (6) = 134
+		if !strings.HasPrefix(msg, "<134>1 ") || !strings.HasSuffix(msg, "test - hello") {
+			t.Errorf("message = %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tarSniffSize is how much of an upload is buffered to recognize a tar or
+// tar.gz archive before reading it
+const tarSniffSize = 64 << 10
+
+// limitError is an extraction stopped by MAX_FILE_COUNT, MAX_SINGLE_FILE_MB
+// or MAX_EXTRACTED_SIZE_MB
+type limitError struct{ error }
+
+// sniffTar reports whether the buffered upload is a tar archive, and
+// whether it is gzip-compressed, without consuming any of it. Only tars with
+// a ustar (POSIX, GNU or PAX) header are recognized.
+func sniffTar(r *bufio.Reader) (gzipped, isTar bool) {
+	head, _ := r.Peek(tarSniffSize)
+	if bytes.HasPrefix(head, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(bytes.NewReader(head))
+		if err != nil {
+			return false, false
+		}
+		block := make([]byte, 512)
+		n, _ := io.ReadFull(gz, block)
+		head, gzipped = block[:n], true
+	}
+	return gzipped, len(head) >= 262 && bytes.Equal(head[257:262], []byte("ustar"))
+}
+
+// receiveTarUpload extracts a tar or tar.gz upload into a temp directory as
+// it is read, hashing the upload on the way, so the archive itself is never
+// written to disk. The entries are scanned together once the whole upload
+// was read. The extracted files count against budget (if set). The returned
+// upload has no path; the caller fills in the file name and metadata.
+func receiveTarUpload(r io.Reader, gzipped bool, config *Config, budget *requestBudget) (*uploadedFile, *requestError) {
+	dir, err := os.MkdirTemp(scanTmpDir, "clamav-extract-")
+	if err != nil {
+		log.Printf("Failed to create temp dir: %v", err)
+		return nil, &requestError{status: http.StatusInternalServerError, message: "Server error during file processing"}
+	}
+
+	hashers := map[string]hash.Hash{"sha256": sha256.New()}
+	for _, name := range config.HashAlgorithms {
+		if hashers[name] == nil {
+			hashers[name] = hashAlgorithms[name]()
+		}
+	}
+	counter := &countingWriter{}
+	writers := []io.Writer{counter}
+	for _, h := range hashers {
+		writers = append(writers, h)
+	}
+	body := io.TeeReader(r, io.MultiWriter(writers...))
+
+	index := newEntryIndex(config, dir)
+	fileCount, skipped, extracted, err := extractUploadTar(body, gzipped, dir, config, index, budget)
+	var bomb *bombError
+	if errors.As(err, &bomb) {
+		// The request's budget is spent: the upload is rejected (or flagged
+		// and scanned as far as it was extracted) like a decompression bomb
+		log.Printf("Stopped extracting tar upload: %v", err)
+		fileCount, extracted, err = countExtracted(dir), 0, nil
+	}
+	if err == nil {
+		// Read the end-of-archive padding (or the rest of a rejected
+		// upload) so the hashes and size cover the whole upload
+		_, err = io.Copy(io.Discard, body)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		log.Printf("Failed to extract tar upload: %v", err)
+		return nil, tarRequestError(err)
+	}
+
+	digests := make(map[string]string, len(hashers))
+	for name, h := range hashers {
+		digests[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	upload := &uploadedFile{
+		dir:       dir,
+		fileCount: fileCount,
+		entries:   index,
+		skipped:   skipped,
+		size:      counter.n,
+		digests:   digests,
+		rejected:  checkCompressionRatio(config, counter.n, extracted),
+	}
+	if bomb != nil {
+		upload.rejected = bomb.reason
+	}
+	return upload, nil
+}
+
+// extractUploadTar extracts a tar upload, decompressing it first if
+// gzipped. Returns the number of files, the entries skipped and the size
+// of the tar stream.
+func extractUploadTar(r io.Reader, gzipped bool, dir string, config *Config, index *entryIndex, budget *requestBudget) (int, []SkippedFile, int64, error) {
+	if !gzipped {
+		fileCount, skipped, err := extractTar(r, dir, config, "archive", nil, index, budget)
+		return fileCount, skipped, 0, err
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	defer gz.Close()
+	decompressed := &countingWriter{}
+	tarStream := io.TeeReader(gz, decompressed)
+	fileCount, skipped, err := extractTar(tarStream, dir, config, "archive", nil, index, budget)
+	if err == nil {
+		// Reach the gzip trailer so its checksum is verified
+		_, err = io.Copy(io.Discard, tarStream)
+	}
+	return fileCount, skipped, decompressed.n, err
+}
+
+// tarRequestError maps a failed streaming extraction to the client error
+func tarRequestError(err error) *requestError {
+	var tooLarge *http.MaxBytesError
+	var limit limitError
+	switch {
+	case errors.As(err, &tooLarge):
+		return uploadTooLarge(tooLarge.Limit)
+	case errors.As(err, &limit):
+		return &requestError{status: http.StatusRequestEntityTooLarge, message: "Archive exceeds extraction limits"}
+	case isCorruptCompression(err), errors.Is(err, tar.ErrHeader), errors.Is(err, io.ErrUnexpectedEOF):
+		return &requestError{status: http.StatusBadRequest, message: "Invalid tar archive"}
+	}
+	return &requestError{status: http.StatusInternalServerError, message: "Server error during file processing"}
+}
+
+// extractTar extracts the regular files of a tar stream below targetDir,
+// enforcing MAX_FILE_COUNT, MAX_SINGLE_FILE_MB and MAX_EXTRACTED_SIZE_MB.
+// kind names the archive in errors; entries for which skip (if set) returns
+// true are not extracted or counted. Entries identical to an earlier one
+// are recorded in index (if set) and not kept. The files also count against
+// budget (if set). Returns the number of files and the other entries
+// (links, devices) that were left out.
+func extractTar(r io.Reader, targetDir string, config *Config, kind string, skip func(name string) bool, index *entryIndex, budget *requestBudget) (int, []SkippedFile, error) {
+	tr := tar.NewReader(r)
+	fileCount := 0
+	var skipped []SkippedFile
+	var totalSize int64
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return fileCount, skipped, nil
+		}
+		if err != nil {
+			return fileCount, nil, fmt.Errorf("invalid %s: %w", kind, err)
+		}
+		if header.Typeflag == tar.TypeDir || (skip != nil && skip(header.Name)) {
+			continue
+		}
+		if header.Typeflag != tar.TypeReg {
+			skipped = append(skipped, SkippedFile{File: normalizeEntryName(header.Name), Reason: skipNotRegular})
+			continue
+		}
+
+		fileCount++
+		if fileCount > config.MaxFileCount {
+			return 0, nil, limitError{fmt.Errorf("%s contains too many files (limit: %d)", kind, config.MaxFileCount)}
+		}
+		if uint64(header.Size) > config.MaxSingleFileSize {
+			skipped = append(skipped, SkippedFile{File: normalizeEntryName(header.Name), Reason: skipTooLarge})
+			continue
+		}
+		totalSize += header.Size
+		if totalSize > config.MaxExtractedSize {
+			return 0, nil, limitError{fmt.Errorf("%s exceeds total size limit (%d bytes)", kind, config.MaxExtractedSize)}
+		}
+
+		name := normalizeEntryName(header.Name)
+		if entryPathTooLong(name, config.MaxEntryPath) {
+			skipped = append(skipped, SkippedFile{File: truncateName(name, maxEntryNameLength), Reason: skipLongPath})
+			continue
+		}
+
+		// Cleaning against the root keeps every path inside targetDir
+		targetPath := filepath.Join(targetDir, filepath.Clean("/"+name))
+		if !strings.HasPrefix(targetPath, filepath.Clean(targetDir)+string(os.PathSeparator)) {
+			skipped = append(skipped, SkippedFile{File: name, Reason: skipUnsafePath})
+			continue
+		}
+		targetPath = index.unique(targetPath, fileCount)
+		if err := budget.addFile(targetDir, targetPath); err != nil {
+			return fileCount, nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+			return fileCount, nil, err
+		}
+		dst, err := index.create(targetPath)
+		if err != nil {
+			return fileCount, nil, err
+		}
+		if _, err := io.Copy(dst, budget.reader(tr)); err != nil {
+			dst.Close()
+			return fileCount, nil, err
+		}
+		if err := dst.finish(); err != nil {
+			return fileCount, nil, err
+		}
+	}
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct{ n int64 }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSniffTar(t *testing.T) {
+	archive := testLayer(t, map[string]string{"a.txt": "hello"})
+	gz, _ := gzip.NewReader(bytes.NewReader(archive))
+	var plainTar bytes.Buffer
+	plainTar.ReadFrom(gz)
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte(strings.Repeat("not a tar ", 100)))
+	gw.Close()
+
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	w, _ := zw.Create("a.txt")
+	w.Write([]byte("hello"))
+	zw.Close()
+
+	tests := []struct {
+		name        string
+		data        []byte
+		wantGzipped bool
+		wantTar     bool
+	}{
+		{name: "tar", data: plainTar.Bytes(), wantTar: true},
+		{name: "tar.gz", data: archive, wantGzipped: true, wantTar: true},
+		{name: "gzip", data: gzipped.Bytes(), wantGzipped: true},
+		{name: "zip", data: zipped.Bytes()},
+		{name: "text", data: []byte("hello")},
+	}
+	for _, tt := range tests {
+		r := bufio.NewReaderSize(bytes.NewReader(tt.data), tarSniffSize)
+		gzipped, isTar := sniffTar(r)
+		if gzipped != tt.wantGzipped || isTar != tt.wantTar {
+			t.Errorf("%s: sniffTar() = %v, %v; want %v, %v", tt.name, gzipped, isTar, tt.wantGzipped, tt.wantTar)
+		}
+		if r.Buffered() != len(tt.data) {
+			t.Errorf("%s: sniffTar() consumed the upload", tt.name)
+		}
+	}
+}
+
+func TestScanHandlerStreamExtraction(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	cfg.StreamExtraction = true
+	cfg.HashAlgorithms = []string{"md5"}
+	archive := testLayer(t, map[string]string{"docs/readme.txt": "hello", "bin/eicar.com": "EICAR"})
+
+	body, contentType := multipartUpload(t, "release.tar.gz", archive)
+	req := httptest.NewRequest(http.MethodPost, "/scan", body)
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+	handleScan(recorder, req, cfg, NewScanner(cfg))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", recorder.Code, recorder.Body)
+	}
+	var response ScanResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if response.Status != "infected" || response.ScannedFiles != 2 || len(response.Threats) != 1 || response.Threats[0].File != "bin/eicar.com" {
+		t.Fatalf("response = %+v, want bin/eicar.com infected", response)
+	}
+	if response.Hashes["md5"] == "" {
+		t.Errorf("hashes = %v, want md5 of the upload", response.Hashes)
+	}
+}
+
+func TestReceiveTarUpload(t *testing.T) {
+	cfg := &Config{MaxFileCount: 10, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20, HashAlgorithms: []string{"sha256"}}
+	archive := testLayer(t, map[string]string{"a/b.txt": "hello", "../escape.txt": "data"})
+
+	upload, reqErr := receiveTarUpload(bytes.NewReader(archive), true, cfg, nil)
+	if reqErr != nil {
+		t.Fatalf("receiveTarUpload() error: %+v", reqErr)
+	}
+	defer upload.remove()
+	sum := sha256.Sum256(archive)
+	if upload.size != int64(len(archive)) || upload.digests["sha256"] != hex.EncodeToString(sum[:]) {
+		t.Errorf("upload size %d, digests %v; want the whole archive", upload.size, upload.digests)
+	}
+	files := readTree(t, upload.dir)
+	if upload.fileCount != 2 || files["a/b.txt"] != "hello" || files["escape.txt"] != "data" {
+		t.Errorf("extracted %d files: %v", upload.fileCount, files)
+	}
+	if upload.remove(); dirExists(upload.dir) {
+		t.Error("remove() left the extracted directory")
+	}
+
+	tests := []struct {
+		name   string
+		config *Config
+		data   []byte
+		want   int
+	}{
+		{name: "too many files", config: &Config{MaxFileCount: 1, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20}, data: archive, want: http.StatusRequestEntityTooLarge},
+		{name: "truncated", config: cfg, data: archive[:len(archive)/2], want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if _, reqErr := receiveTarUpload(bytes.NewReader(tt.data), true, tt.config, nil); reqErr == nil || reqErr.status != tt.want {
+			t.Errorf("%s: error = %+v, want %d", tt.name, reqErr, tt.want)
+		}
+	}
+}
+
+func dirExists(dir string) bool {
+	_, err := os.Stat(dir)
+	return err == nil
+}
+
+func TestReceiveTarUploadSkipsLinks(t *testing.T) {
+	cfg := &Config{MaxFileCount: 10, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "docs/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "docs/readme.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.WriteHeader(&tar.Header{Name: "docs/passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"})
+	tw.Close()
+
+	upload, reqErr := receiveTarUpload(bytes.NewReader(buf.Bytes()), false, cfg, nil)
+	if reqErr != nil {
+		t.Fatalf("receiveTarUpload() error: %+v", reqErr)
+	}
+	defer upload.remove()
+	want := []SkippedFile{{File: "docs/passwd", Reason: skipNotRegular}}
+	if upload.fileCount != 1 || !reflect.DeepEqual(upload.skipped, want) {
+		t.Errorf("extracted %d files, skipped %+v; want 1, %+v", upload.fileCount, upload.skipped, want)
+	}
+}
+
+func TestReceiveTarUploadSkipsLongPaths(t *testing.T) {
+	cfg := &Config{MaxFileCount: 10, MaxSingleFileSize: 1 << 20, MaxExtractedSize: 1 << 20, MaxEntryPath: 32}
+	upload, reqErr := receiveTarUpload(bytes.NewReader(testLayer(t, map[string]string{
+		"readme.txt":                   "hello",
+		strings.Repeat("d/", 20) + "x": "deep",
+		"evil\r\nX-Injected: 1.txt":    "crlf",
+	})), true, cfg, nil)
+	if reqErr != nil {
+		t.Fatalf("receiveTarUpload() error: %+v", reqErr)
+	}
+	defer upload.remove()
+	want := []SkippedFile{{File: strings.Repeat("d/", 20) + "x", Reason: skipLongPath}}
+	if upload.fileCount != 3 || !reflect.DeepEqual(upload.skipped, want) {
+		t.Errorf("extracted %d files, skipped %+v; want 3, %+v", upload.fileCount, upload.skipped, want)
+	}
+	if files := readTree(t, upload.dir); files["evil\uFFFD\uFFFDX-Injected: 1.txt"] != "crlf" {
+		t.Errorf("extracted %v, want the CRLF name cleaned", files)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Directory for upload temp files and extracted archives, from SCAN_TMP_DIR
+// ("" = os.TempDir(), which honors TMPDIR)
+var scanTmpDir string
+
+// tempDirMetricsInterval is how often temp-dir usage is sent as gauges
+const tempDirMetricsInterval = 30 * time.Second
+
+// orphanTempPrefixes are the temp files and directories left behind by
+// scans that were running when the process died. Other "clamav-" entries
+// (e.g. clamd's own temp files) are left alone.
+var orphanTempPrefixes = []string{"clamav-scan-", "clamav-extract-", "clamav-layer-", "clamav-upload-", "clamav-restore-"}
+
+// errInsufficientSpace fails an upload or extraction that would not fit in
+// the temp directory
+var errInsufficientSpace = errors.New("insufficient disk space")
+
+// tempDir returns the directory scan temp data is written to
+func tempDir() string {
+	if scanTmpDir != "" {
+		return scanTmpDir
+	}
+	return os.TempDir()
+}
+
+// checkDiskSpace returns an error wrapping errInsufficientSpace if writing
+// need bytes to dir would leave less than reserve bytes free. Platforms
+// where free space can't be read are not checked.
+func checkDiskSpace(dir string, need, reserve int64) error {
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		return nil
+	}
+	if need+reserve > free {
+		return fmt.Errorf("%w in %s: %d bytes needed, %d available (%d reserved)", errInsufficientSpace, dir, need, free, reserve)
+	}
+	return nil
+}
+
+// cleanOrphanedTemp removes scan temp files and directories in dir, left
+// behind by a previous process that crashed or was killed mid-scan. Run on
+// startup, before any scan, so nothing removed can be in use by this
+// process; the directory must not be shared with another instance.
+func cleanOrphanedTemp(dir string) (removed int, bytes int64) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, 0
+	}
+	for _, entry := range entries {
+		if !hasOrphanPrefix(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		_, size := measureTempEntry(path)
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Failed to remove orphaned temp data %s: %v", path, err)
+			continue
+		}
+		removed++
+		bytes += size
+	}
+	return removed, bytes
+}
+
+func hasOrphanPrefix(name string) bool {
+	for _, prefix := range orphanTempPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// startTempDirMetrics reports temp-dir usage as gauges in the background
+func startTempDirMetrics() {
+	go func() {
+		ticker := time.NewTicker(tempDirMetricsInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			usage := measureTempDir(tempDir())
+			if usage.Error != "" {
+				continue
+			}
+			metrics.Gauge("tempdir.entries", float64(usage.Entries))
+			metrics.Gauge("tempdir.bytes", float64(usage.Bytes))
+			if usage.FreeBytes > 0 {
+				metrics.Gauge("tempdir.free_bytes", float64(usage.FreeBytes))
+			}
+		}
+	}()
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "errors"
+
+// freeDiskSpace is not implemented on this platform; disk space isn't checked
+func freeDiskSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
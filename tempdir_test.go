@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := freeDiskSpace(dir); err != nil {
+		t.Skipf("free space unavailable: %v", err)
+	}
+	if err := checkDiskSpace(dir, 1024, 0); err != nil {
+		t.Errorf("checkDiskSpace(1 KB) error: %v", err)
+	}
+	if err := checkDiskSpace(dir, 1024, math.MaxInt64/2); !errors.Is(err, errInsufficientSpace) {
+		t.Errorf("checkDiskSpace() with a huge reserve = %v, want errInsufficientSpace", err)
+	}
+}
+
+func TestCleanOrphanedTemp(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "clamav-extract-123", "sub"), 0755)
+	writeTestFile(t, filepath.Join(dir, "clamav-extract-123", "sub", "a.txt"), "12345")
+	writeTestFile(t, filepath.Join(dir, "clamav-scan-456"), "1234567890")
+	writeTestFile(t, filepath.Join(dir, "clamav-upload-789"), "")
+	writeTestFile(t, filepath.Join(dir, "clamav-0123abcd.tmp"), "clamd's")
+	writeTestFile(t, filepath.Join(dir, "unrelated.txt"), "kept")
+
+	removed, bytes := cleanOrphanedTemp(dir)
+	if removed != 3 || bytes != 15 {
+		t.Errorf("cleanOrphanedTemp() = %d entries, %d bytes; want 3, 15", removed, bytes)
+	}
+	entries, _ := os.ReadDir(dir)
+	var kept []string
+	for _, entry := range entries {
+		kept = append(kept, entry.Name())
+	}
+	if len(kept) != 2 || kept[0] != "clamav-0123abcd.tmp" || kept[1] != "unrelated.txt" {
+		t.Errorf("kept %v, want clamd's temp file and unrelated.txt", kept)
+	}
+}
+
+func TestScanInsufficientSpace(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	if _, err := freeDiskSpace(os.TempDir()); err != nil {
+		t.Skipf("free space unavailable: %v", err)
+	}
+	cfg.ScanTmpMinFree = math.MaxInt64 / 2
+
+	// Uploads are refused before anything is written
+	body, contentType := multipartUpload(t, "test.txt", []byte("hello"))
+	req := httptest.NewRequest(http.MethodPost, "/scan", body)
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+	handleScan(recorder, req, cfg, NewScanner(cfg))
+	if recorder.Code != http.StatusInsufficientStorage {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusInsufficientStorage)
+	}
+
+	// Archives fail instead of falling back to a single-file scan
+	zipPath := createTestZip(t, map[string]string{"a.txt": "hello"})
+	defer os.Remove(zipPath)
+	if _, err := NewScanner(cfg).ScanFile(context.Background(), zipPath); !errors.Is(err, errInsufficientSpace) {
+		t.Errorf("ScanFile() error = %v, want errInsufficientSpace", err)
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TenantsConfig is the structure of the TENANTS_FILE JSON document.
+//
+// Example:
+//
+//	{
+//	  "tenants": [
+//	    {
+//	      "name": "acme",
+//	      "identities": ["api-key:acme-ci", "jwt:acme-web"],
+//	      "max_upload_size_mb": 100,
+//	      "max_concurrent_scans": 4,
+//	      "daily_quota": 10000,
+//	      "scan_timeout_seconds": 15,
+//	      "labels": {"plan": "gold"}
+//	    }
+//	  ]
+//	}
+type TenantsConfig struct {
+	Tenants []*Tenant `json:"tenants"`
+}
+
+// Tenant groups identities (API key names, users, token subjects) that
+// share limits. Zero limits are unlimited.
+type Tenant struct {
+	Name               string            `json:"name"`
+	Identities         []string          `json:"identities"` // Identity keys (method:name), as in AUTH_SCOPES
+	MaxUploadSizeMB    int               `json:"max_upload_size_mb,omitempty"`
+	MaxConcurrentScans int               `json:"max_concurrent_scans,omitempty"`
+	DailyQuota         int               `json:"daily_quota,omitempty"`          // Scan requests per UTC day
+	ScanTimeoutSeconds int               `json:"scan_timeout_seconds,omitempty"` // Default scan timeout, up to SCAN_TIMEOUT_MAX_MINUTES
+	Labels             map[string]string `json:"labels,omitempty"`               // Added as metric tags
+}
+
+// TenantStatus is a tenant with its current usage (admin API)
+type TenantStatus struct {
+	*Tenant
+	InFlight  int `json:"in_flight"`
+	UsedToday int `json:"used_today"`
+}
+
+// errSaveTenants wraps failures to write the tenants file
+var errSaveTenants = errors.New("failed to save tenants")
+
+// tenantUsage tracks a tenant's in-flight scans and daily count
+type tenantUsage struct {
+	inFlight int
+	day      string // UTC date the count belongs to
+	used     int
+}
+
+// TenantRegistry holds the tenants and their usage.
+// Changes made through the admin API are written back to the tenants file.
+type TenantRegistry struct {
+	path string
+	now  func() time.Time
+
+	mu         sync.Mutex
+	tenants    map[string]*Tenant
+	byIdentity map[string]*Tenant // Keyed by Identity.Key()
+	usage      map[string]*tenantUsage
+}
+
+// Global tenant registry (nil when multi-tenancy is disabled)
+var tenants *TenantRegistry
+
+// LoadTenants reads the tenants file. A missing file starts an empty
+// registry that the admin API can populate.
+func LoadTenants(path string) (*TenantRegistry, error) {
+	reg := &TenantRegistry{
+		path:       path,
+		now:        time.Now,
+		tenants:    make(map[string]*Tenant),
+		byIdentity: make(map[string]*Tenant),
+		usage:      make(map[string]*tenantUsage),
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("Tenants file %s not found, starting with no tenants", path)
+		return reg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tenants file: %w", err)
+	}
+	defer f.Close()
+
+	var tenantsConfig TenantsConfig
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&tenantsConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants file: %w", err)
+	}
+
+	for _, tenant := range tenantsConfig.Tenants {
+		if err := reg.add(tenant); err != nil {
+			return nil, err
+		}
+	}
+	return reg, nil
+}
+
+// validate checks a tenant definition
+func (t *Tenant) validate() error {
+	if t.Name == "" || strings.ContainsAny(t.Name, "/ ") {
+		return fmt.Errorf("invalid tenant name %q", t.Name)
+	}
+	if len(t.Identities) == 0 {
+		return fmt.Errorf("tenant %q has no identities", t.Name)
+	}
+	for _, identity := range t.Identities {
+		// The same name may belong to someone else under another method,
+		// e.g. an API key named like a basic auth user
+		method, name, _ := strings.Cut(identity, ":")
+		if !containsString(authMethods, method) || name == "" {
+			return fmt.Errorf("tenant %q: identity %q must name the auth method and identity, e.g. %s:%s", t.Name, identity, AuthMethodAPIKey, identity)
+		}
+	}
+	if t.MaxUploadSizeMB < 0 || t.MaxConcurrentScans < 0 || t.DailyQuota < 0 || t.ScanTimeoutSeconds < 0 {
+		return fmt.Errorf("tenant %q has negative limits", t.Name)
+	}
+	return nil
+}
+
+// add registers a tenant. Caller holds reg.mu or owns reg exclusively.
+func (reg *TenantRegistry) add(tenant *Tenant) error {
+	if err := tenant.validate(); err != nil {
+		return err
+	}
+	if _, exists := reg.tenants[tenant.Name]; exists {
+		return fmt.Errorf("duplicate tenant %q", tenant.Name)
+	}
+	for _, identity := range tenant.Identities {
+		if other, claimed := reg.byIdentity[identity]; claimed {
+			return fmt.Errorf("identity %q belongs to tenants %q and %q", identity, other.Name, tenant.Name)
+		}
+	}
+
+	reg.tenants[tenant.Name] = tenant
+	for _, identity := range tenant.Identities {
+		reg.byIdentity[identity] = tenant
+	}
+	return nil
+}
+
+// remove unregisters a tenant. Caller holds reg.mu.
+func (reg *TenantRegistry) remove(name string) *Tenant {
+	tenant, ok := reg.tenants[name]
+	if !ok {
+		return nil
+	}
+	delete(reg.tenants, name)
+	for _, identity := range tenant.Identities {
+		delete(reg.byIdentity, identity)
+	}
+	return tenant
+}
+
+// Lookup returns the tenant an identity belongs to, or nil
+func (reg *TenantRegistry) Lookup(identity *Identity) *Tenant {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.byIdentity[identity.Key()]
+}
+
+// Put creates or replaces a tenant and saves the file. If saving fails, the
+// previous definition stays in effect.
+func (reg *TenantRegistry) Put(tenant *Tenant) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	previous := reg.remove(tenant.Name)
+	if err := reg.add(tenant); err != nil {
+		if previous != nil {
+			reg.add(previous)
+		}
+		return err
+	}
+	if err := reg.save(); err != nil {
+		reg.remove(tenant.Name)
+		if previous != nil {
+			reg.add(previous)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes a tenant and saves the file. If saving fails, the tenant
+// stays in effect.
+// Returns false if the tenant does not exist.
+func (reg *TenantRegistry) Delete(name string) (bool, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	tenant := reg.remove(name)
+	if tenant == nil {
+		return false, nil
+	}
+	if err := reg.save(); err != nil {
+		reg.add(tenant)
+		return true, err
+	}
+	delete(reg.usage, name)
+	return true, nil
+}
+
+// Status returns tenants with usage, sorted by name
+func (reg *TenantRegistry) Status() []TenantStatus {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	today := reg.today()
+	statuses := make([]TenantStatus, 0, len(reg.tenants))
+	for _, tenant := range reg.tenants {
+		status := TenantStatus{Tenant: tenant}
+		if u := reg.usage[tenant.Name]; u != nil {
+			status.InFlight = u.inFlight
+			if u.day == today {
+				status.UsedToday = u.used
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// Acquire reserves a scan slot for the tenant. On success it returns a
+// release function; otherwise the client message and how long to wait.
+func (reg *TenantRegistry) Acquire(tenant *Tenant) (release func(), message string, retryAfter time.Duration) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	u := reg.usage[tenant.Name]
+	if u == nil {
+		u = &tenantUsage{}
+		reg.usage[tenant.Name] = u
+	}
+	if today := reg.today(); u.day != today {
+		u.day, u.used = today, 0
+	}
+
+	if tenant.DailyQuota > 0 && u.used >= tenant.DailyQuota {
+		now := reg.now().UTC()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		return nil, "Daily quota exceeded", midnight.Sub(now)
+	}
+	if tenant.MaxConcurrentScans > 0 && u.inFlight >= tenant.MaxConcurrentScans {
+		return nil, "Too many concurrent scans", time.Second
+	}
+
+	u.used++
+	u.inFlight++
+	return func() {
+		reg.mu.Lock()
+		u.inFlight--
+		reg.mu.Unlock()
+	}, "", 0
+}
+
+// today returns the current UTC date. Caller holds reg.mu.
+func (reg *TenantRegistry) today() string {
+	return reg.now().UTC().Format("2006-01-02")
+}
+
+// save writes the tenants file atomically. Caller holds reg.mu.
+func (reg *TenantRegistry) save() error {
+	doc := TenantsConfig{Tenants: make([]*Tenant, 0, len(reg.tenants))}
+	for _, tenant := range reg.tenants {
+		doc.Tenants = append(doc.Tenants, tenant)
+	}
+	sort.Slice(doc.Tenants, func(i, j int) bool { return doc.Tenants[i].Name < doc.Tenants[j].Name })
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(reg.path), ".tenants-*")
+	if err != nil {
+		return fmt.Errorf("%w: %v", errSaveTenants, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("%w: %v", errSaveTenants, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("%w: %v", errSaveTenants, err)
+	}
+	if err := os.Rename(tmp.Name(), reg.path); err != nil {
+		return fmt.Errorf("%w: %v", errSaveTenants, err)
+	}
+	return nil
+}
+
+// tenantKey is the context key for the request's Tenant
+type tenantKey struct{}
+
+// tenantFromContext returns the tenant stored by enforceTenant, or nil
+func tenantFromContext(ctx context.Context) *Tenant {
+	tenant, _ := ctx.Value(tenantKey{}).(*Tenant)
+	return tenant
+}
+
+// tenantSlotKey is the context key for the request's tenant concurrency slot
+type tenantSlotKey struct{}
+
+// tenantSlot is a tenant concurrency slot held for the duration of a request
+type tenantSlot struct {
+	release  func()
+	detached atomic.Bool
+}
+
+// detachTenantSlot hands the request's tenant concurrency slot to the caller,
+// which must release it, so work that outlives the request (async scans)
+// keeps counting against the tenant. Returns nil if the request holds none.
+func detachTenantSlot(ctx context.Context) func() {
+	slot, _ := ctx.Value(tenantSlotKey{}).(*tenantSlot)
+	if slot == nil || !slot.detached.CompareAndSwap(false, true) {
+		return nil
+	}
+	return slot.release
+}
+
+// enforceTenant applies the limits of the caller's tenant: daily quota and
+// concurrency (429) and upload size (413). Must run after requireAuth.
+// Callers without a tenant are not limited. A nil registry disables it.
+func enforceTenant(reg *TenantRegistry, next http.Handler) http.Handler {
+	if reg == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := identityFromContext(r.Context())
+		if identity == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tenant := reg.Lookup(identity)
+		if tenant == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if tenant.MaxUploadSizeMB > 0 {
+			limit := int64(tenant.MaxUploadSizeMB) * 1024 * 1024
+			if r.ContentLength > limit {
+				sendErrorStatus(w, http.StatusRequestEntityTooLarge, "Upload exceeds tenant size limit")
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+
+		release, message, retryAfter := reg.Acquire(tenant)
+		if release == nil {
+			metrics.Count("tenant_limited", 1, "tenant:"+tenant.Name)
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds()+0.999)))
+			sendErrorStatus(w, http.StatusTooManyRequests, message)
+			return
+		}
+		slot := &tenantSlot{release: release}
+		defer func() {
+			if !slot.detached.Load() {
+				release()
+			}
+		}()
+
+		ctx := context.WithValue(r.Context(), tenantKey{}, tenant)
+		ctx = context.WithValue(ctx, tenantSlotKey{}, slot)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// tenantsHandler manages tenants (admin scope):
+//
+//	GET    /admin/tenants         list tenants with usage
+//	GET    /admin/tenants/{name}  show one tenant
+//	PUT    /admin/tenants/{name}  create or replace a tenant
+//	DELETE /admin/tenants/{name}  delete a tenant
+func tenantsHandler(w http.ResponseWriter, r *http.Request) {
+	if tenants == nil {
+		sendErrorStatus(w, http.StatusNotFound, "Multi-tenancy is not enabled")
+		return
+	}
+
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/tenants"), "/")
+
+	if name == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tenants.Status())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		for _, status := range tenants.Status() {
+			if status.Name == name {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(status)
+				return
+			}
+		}
+		sendErrorStatus(w, http.StatusNotFound, "Tenant not found")
+
+	case http.MethodPut:
+		var tenant Tenant
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&tenant); err != nil {
+			sendErrorStatus(w, http.StatusBadRequest, "Invalid tenant definition")
+			return
+		}
+		tenant.Name = name
+		if err := tenants.Put(&tenant); err != nil {
+			log.Printf("Failed to update tenant %s: %v", name, err)
+			if errors.Is(err, errSaveTenants) {
+				sendError(w, "Failed to save tenants")
+				return
+			}
+			// Validation errors only echo the admin's own input
+			sendErrorStatus(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("Tenant %s updated by %s", name, identityFromContext(r.Context()).Name)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&tenant)
+
+	case http.MethodDelete:
+		found, err := tenants.Delete(name)
+		if err != nil {
+			log.Printf("Failed to delete tenant %s: %v", name, err)
+			sendError(w, "Failed to save tenants")
+			return
+		}
+		if !found {
+			sendErrorStatus(w, http.StatusNotFound, "Tenant not found")
+			return
+		}
+		log.Printf("Tenant %s deleted by %s", name, identityFromContext(r.Context()).Name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
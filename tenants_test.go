@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTenantsFile writes a tenants file and returns its path
+func writeTenantsFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	writeTestFile(t, path, content)
+	return path
+}
+
+// requestAs returns a scan request authenticated as the identity
+func requestAs(method, target, identity string, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	ctx := context.WithValue(req.Context(), identityKey{}, &Identity{Name: identity, Method: AuthMethodAPIKey})
+	return req.WithContext(ctx)
+}
+
+const testTenants = `{"tenants": [
+	{"name": "acme", "identities": ["api-key:acme-ci"], "max_concurrent_scans": 1, "daily_quota": 2, "labels": {"plan": "gold"}},
+	{"name": "small", "identities": ["api-key:small-ci"], "max_upload_size_mb": 1}
+]}`
+
+func TestLoadTenants(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "valid", content: testTenants},
+		{name: "unknown field", content: `{"tenants": [{"name": "a", "identities": ["api-key:x"], "quota": 1}]}`, wantErr: "unknown field"},
+		{name: "no identities", content: `{"tenants": [{"name": "a"}]}`, wantErr: "no identities"},
+		{name: "duplicate tenant", content: `{"tenants": [{"name": "a", "identities": ["api-key:x"]}, {"name": "a", "identities": ["api-key:y"]}]}`, wantErr: "duplicate tenant"},
+		{name: "shared identity", content: `{"tenants": [{"name": "a", "identities": ["api-key:x"]}, {"name": "b", "identities": ["api-key:x"]}]}`, wantErr: "belongs to tenants"},
+		{name: "invalid name", content: `{"tenants": [{"name": "a/b", "identities": ["api-key:x"]}]}`, wantErr: "invalid tenant name"},
+		{name: "identity without method", content: `{"tenants": [{"name": "a", "identities": ["x"]}]}`, wantErr: "must name the auth method"},
+		{name: "unknown method", content: `{"tenants": [{"name": "a", "identities": ["token:x"]}]}`, wantErr: "must name the auth method"},
+		{name: "negative limit", content: `{"tenants": [{"name": "a", "identities": ["api-key:x"], "daily_quota": -1}]}`, wantErr: "negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadTenants(writeTenantsFile(t, tt.content))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadTenants() error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadTenants() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadTenantsMissingFile(t *testing.T) {
+	reg, err := LoadTenants(filepath.Join(t.TempDir(), "tenants.json"))
+	if err != nil {
+		t.Fatalf("LoadTenants() error: %v", err)
+	}
+	if len(reg.Status()) != 0 {
+		t.Error("expected empty registry")
+	}
+}
+
+func TestTenantAcquire(t *testing.T) {
+	reg, err := LoadTenants(writeTenantsFile(t, testTenants))
+	if err != nil {
+		t.Fatalf("LoadTenants() error: %v", err)
+	}
+	now := time.Date(2024, 1, 1, 18, 0, 0, 0, time.UTC)
+	reg.now = func() time.Time { return now }
+	acme := reg.Lookup(&Identity{Name: "acme-ci", Method: AuthMethodAPIKey})
+
+	release, _, _ := reg.Acquire(acme)
+	if release == nil {
+		t.Fatal("first scan should be allowed")
+	}
+
+	// Concurrency limit of 1
+	if r, msg, _ := reg.Acquire(acme); r != nil || msg != "Too many concurrent scans" {
+		t.Fatalf("concurrent scan: message = %q, want concurrency rejection", msg)
+	}
+	release()
+
+	second, _, _ := reg.Acquire(acme)
+	if second == nil {
+		t.Fatal("second scan should be allowed after release")
+	}
+	second()
+
+	// Daily quota of 2 is used up until midnight UTC
+	r, msg, wait := reg.Acquire(acme)
+	if r != nil || msg != "Daily quota exceeded" {
+		t.Fatalf("message = %q, want quota rejection", msg)
+	}
+	if wait != 6*time.Hour {
+		t.Errorf("retry after = %v, want 6h", wait)
+	}
+
+	now = now.Add(7 * time.Hour)
+	if r, _, _ := reg.Acquire(acme); r == nil {
+		t.Error("quota should reset on the next day")
+	}
+}
+
+func TestEnforceTenant(t *testing.T) {
+	reg, err := LoadTenants(writeTenantsFile(t, testTenants))
+	if err != nil {
+		t.Fatalf("LoadTenants() error: %v", err)
+	}
+
+	var seenTenant *Tenant
+	handler := enforceTenant(reg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenTenant = tenantFromContext(r.Context())
+	}))
+
+	t.Run("tenant in context", func(t *testing.T) {
+		seenTenant = nil
+		handler.ServeHTTP(httptest.NewRecorder(), requestAs("POST", "/scan", "acme-ci", ""))
+		if seenTenant == nil || seenTenant.Name != "acme" {
+			t.Errorf("tenant = %v, want acme", seenTenant)
+		}
+	})
+
+	t.Run("no tenant", func(t *testing.T) {
+		seenTenant = nil
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, requestAs("POST", "/scan", "other", ""))
+		if recorder.Code != http.StatusOK || seenTenant != nil {
+			t.Errorf("status = %d, tenant = %v; want pass-through", recorder.Code, seenTenant)
+		}
+	})
+
+	t.Run("same name under another method", func(t *testing.T) {
+		seenTenant = nil
+		req := requestAs("POST", "/scan", "acme-ci", "")
+		req = req.WithContext(context.WithValue(req.Context(), identityKey{}, &Identity{Name: "acme-ci", Method: AuthMethodBasic}))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if seenTenant != nil {
+			t.Errorf("tenant = %v, want none for basic:acme-ci", seenTenant)
+		}
+	})
+
+	t.Run("upload too large", func(t *testing.T) {
+		req := requestAs("POST", "/scan", "small-ci", strings.Repeat("x", 2*1024*1024))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("status = %d, want 413", recorder.Code)
+		}
+	})
+
+	t.Run("quota exceeded", func(t *testing.T) {
+		// acme has used 1 of 2 scans above
+		handler.ServeHTTP(httptest.NewRecorder(), requestAs("POST", "/scan", "acme-ci", ""))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, requestAs("POST", "/scan", "acme-ci", ""))
+		if recorder.Code != http.StatusTooManyRequests {
+			t.Errorf("status = %d, want 429", recorder.Code)
+		}
+		if recorder.Header().Get("Retry-After") == "" {
+			t.Error("missing Retry-After header")
+		}
+	})
+}
+
+func TestTenantsHandler(t *testing.T) {
+	path := writeTenantsFile(t, testTenants)
+	reg, err := LoadTenants(path)
+	if err != nil {
+		t.Fatalf("LoadTenants() error: %v", err)
+	}
+	tenants = reg
+	t.Cleanup(func() { tenants = nil })
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		tenantsHandler(recorder, requestAs(method, target, "admin", body))
+		return recorder
+	}
+
+	// Create
+	recorder := serve("PUT", "/admin/tenants/globex", `{"identities": ["api-key:globex-ci"], "daily_quota": 5}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("PUT status = %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if reg.Lookup(&Identity{Name: "globex-ci", Method: AuthMethodAPIKey}) == nil {
+		t.Error("new tenant should be active immediately")
+	}
+
+	// Conflicting identity is rejected and the old definition kept
+	recorder = serve("PUT", "/admin/tenants/globex", `{"identities": ["api-key:acme-ci"]}`)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("conflicting PUT status = %d, want 400", recorder.Code)
+	}
+	if reg.Lookup(&Identity{Name: "globex-ci", Method: AuthMethodAPIKey}) == nil {
+		t.Error("failed update should keep the previous definition")
+	}
+
+	// Persisted to the file
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read tenants file: %v", err)
+	}
+	if !strings.Contains(string(data), `"globex"`) {
+		t.Error("tenants file should contain the new tenant")
+	}
+
+	// List
+	recorder = serve("GET", "/admin/tenants", "")
+	var statuses []TenantStatus
+	json.Unmarshal(recorder.Body.Bytes(), &statuses)
+	if len(statuses) != 3 || statuses[1].Name != "globex" {
+		t.Errorf("GET statuses = %+v, want 3 sorted tenants", statuses)
+	}
+
+	// Delete
+	if recorder = serve("DELETE", "/admin/tenants/globex", ""); recorder.Code != http.StatusNoContent {
+		t.Errorf("DELETE status = %d, want 204", recorder.Code)
+	}
+	if recorder = serve("GET", "/admin/tenants/globex", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("GET deleted status = %d, want 404", recorder.Code)
+	}
+	if recorder = serve("POST", "/admin/tenants", ""); recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want 405", recorder.Code)
+	}
+}
+
+func TestTenantsSaveFailure(t *testing.T) {
+	path := writeTenantsFile(t, testTenants)
+	reg, err := LoadTenants(path)
+	if err != nil {
+		t.Fatalf("LoadTenants() error: %v", err)
+	}
+	acmeCI := &Identity{Name: "acme-ci", Method: AuthMethodAPIKey}
+	reg.path = filepath.Join(t.TempDir(), "missing", "tenants.json")
+
+	// A failed save leaves the tenants as they were
+	err = reg.Put(&Tenant{Name: "acme", Identities: []string{"api-key:acme-web"}})
+	if !errors.Is(err, errSaveTenants) {
+		t.Fatalf("Put() error = %v, want errSaveTenants", err)
+	}
+	if tenant := reg.Lookup(acmeCI); tenant == nil || tenant.DailyQuota != 2 {
+		t.Errorf("after failed Put, acme-ci tenant = %+v, want the previous acme", tenant)
+	}
+	if reg.Lookup(&Identity{Name: "acme-web", Method: AuthMethodAPIKey}) != nil {
+		t.Error("failed Put took effect")
+	}
+
+	if err := reg.Put(&Tenant{Name: "globex", Identities: []string{"api-key:globex-ci"}}); err == nil {
+		t.Fatal("Put() of a new tenant succeeded without saving")
+	}
+	if reg.Lookup(&Identity{Name: "globex-ci", Method: AuthMethodAPIKey}) != nil {
+		t.Error("failed Put of a new tenant took effect")
+	}
+
+	found, err := reg.Delete("acme")
+	if !found || !errors.Is(err, errSaveTenants) {
+		t.Fatalf("Delete() = %v, %v, want found with errSaveTenants", found, err)
+	}
+	if reg.Lookup(acmeCI) == nil {
+		t.Error("failed Delete took effect")
+	}
+}
+
+func TestTenantsHandlerDisabled(t *testing.T) {
+	tenants = nil
+	recorder := httptest.NewRecorder()
+	tenantsHandler(recorder, requestAs("GET", "/admin/tenants", "admin", ""))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", recorder.Code)
+	}
+}
+
+func TestScanTagsWithTenant(t *testing.T) {
+	req := httptest.NewRequest("POST", "/scan", nil)
+	tenant := &Tenant{Name: "acme", Labels: map[string]string{"plan": "gold", "env": "prod"}}
+	req = req.WithContext(context.WithValue(req.Context(), tenantKey{}, tenant))
+
+	got := strings.Join(scanTags(req), ",")
+	if got != "route:/scan,tenant:acme,env:prod,plan:gold" {
+		t.Errorf("scanTags() = %q", got)
+	}
+}
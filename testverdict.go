@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Header forcing a synthetic verdict, honored with ENABLE_TEST_VERDICTS
+const testVerdictHeader = "X-Test-Verdict"
+
+// Synthetic verdicts a caller can force
+const (
+	testVerdictInfected = "infected" // One threat in the upload
+	testVerdictError    = "error"    // The 500 of a failed scan
+)
+
+// testSignature is the detection name of synthetic threats: the one clamd
+// reports for the EICAR test file
+const testSignature = "Win.Test.EICAR_HDB-1"
+
+// requestTestVerdict returns the synthetic verdict the request asks for,
+// "" if none or test verdicts are disabled, or an error for an unknown one
+func requestTestVerdict(r *http.Request, config *Config) (string, *requestError) {
+	if !config.EnableTestVerdicts {
+		return "", nil
+	}
+	switch verdict := strings.ToLower(r.Header.Get(testVerdictHeader)); verdict {
+	case "", testVerdictInfected, testVerdictError:
+		return verdict, nil
+	}
+	return "", &requestError{status: http.StatusBadRequest, message: "X-Test-Verdict must be infected or error"}
+}
+
+// testVerdictResponse returns the response of a forced verdict, shaped like
+// a real one but produced without clamd. It is not recorded in metrics,
+// history, detection reports or the result index, and not signed.
+func testVerdictResponse(config *Config, scanner *Scanner, upload *uploadedFile, verdict string, startTime time.Time) (*ScanResponse, *requestError) {
+	log.Printf("Returning test verdict %q for %s", verdict, upload.safeFilename)
+	if verdict == testVerdictError {
+		return nil, &requestError{status: http.StatusInternalServerError, message: "Scan operation failed"}
+	}
+
+	hashes, err := upload.fileHashes(config.HashAlgorithms)
+	if err != nil {
+		log.Printf("Failed to hash %s: %v", upload.safeFilename, err)
+	}
+	sha256, _ := upload.fileHash()
+	file := path.Base(strings.ReplaceAll(reportedName(upload.filename), "\\", "/"))
+	if file == "." || file == "/" {
+		file = "upload"
+	}
+	threat := Threat{
+		Name:     testSignature,
+		File:     file,
+		FileHash: sha256,
+		Severity: "critical",
+		Hashes:   hashes,
+	}
+	enrichThreat(&threat)
+	response := &ScanResponse{
+		Status:       "infected",
+		Threats:      []Threat{threat},
+		ScannedFiles: 1,
+		ScanTimeMs:   time.Since(startTime).Milliseconds(),
+		Hashes:       hashes,
+		Metadata:     upload.metadata,
+		ScannedBytes: upload.size,
+		EngineInfo:   scanner.cachedEngine(),
+	}
+	return response, nil
+}
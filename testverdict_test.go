@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTestVerdict(t *testing.T) {
+	// No clamd: only forced verdicts can succeed
+	cfg := &Config{
+		MaxUploadSize:      1 << 20,
+		MaxExtractedSize:   1 << 20,
+		MaxFileCount:       10,
+		MaxSingleFileSize:  1 << 20,
+		ScanTimeout:        time.Minute,
+		ClamdscanPath:      "/nonexistent/clamdscan",
+		HashAlgorithms:     []string{"md5"},
+		EnableTestVerdicts: true,
+	}
+	scan := func(verdict string) *httptest.ResponseRecorder {
+		body, contentType := multipartUpload(t, "reports/q1.pdf", []byte("hello"))
+		req := httptest.NewRequest(http.MethodPost, "/scan", body)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set(testVerdictHeader, verdict)
+		recorder := httptest.NewRecorder()
+		handleScan(recorder, req, cfg, NewScanner(cfg))
+		return recorder
+	}
+
+	recorder := scan("infected")
+	var response ScanResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("infected: status %d, decode error %v", recorder.Code, err)
+	}
+	sha256 := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if response.Status != "infected" || len(response.Threats) != 1 || response.ScannedFiles != 1 || response.ScannedBytes != 5 {
+		t.Fatalf("infected: response = %+v", response)
+	}
+	threat := response.Threats[0]
+	if threat.Name != testSignature || threat.File != "q1.pdf" || threat.FileHash != sha256 || threat.Severity != "critical" ||
+		threat.Hashes["md5"] != "5d41402abc4b2a76b9719d911017c592" || response.Hashes["md5"] == "" {
+		t.Errorf("infected: threat = %+v, hashes %v", threat, response.Hashes)
+	}
+
+	if recorder := scan("ERROR"); recorder.Code != http.StatusInternalServerError {
+		t.Errorf("error: status %d, want 500", recorder.Code)
+	}
+	if recorder := scan("clean"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("unknown verdict: status %d, want 400", recorder.Code)
+	}
+
+	// Disabled, the header is ignored and the upload really scanned
+	cfg.EnableTestVerdicts = false
+	if recorder := scan("infected"); recorder.Code != http.StatusInternalServerError {
+		t.Errorf("disabled: status %d, want 500 from the missing clamdscan", recorder.Code)
+	}
+}
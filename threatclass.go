@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ThreatClassesConfig is the structure of the THREAT_CLASSES_FILE JSON
+// document. Rules are tried in order; the first whose pattern matches the
+// signature name replaces the fields it sets.
+//
+// Example:
+//
+//	{
+//	  "classes": [
+//	    {"match": "Sanesecurity.Phish.*", "platform": "Email", "category": "Phishing"},
+//	    {"match": "Win.Malware.Agent*", "category": "Trojan"}
+//	  ]
+//	}
+type ThreatClassesConfig struct {
+	Classes []*ThreatClassRule `json:"classes"`
+}
+
+// ThreatClassRule overrides the classification of signatures matching a
+// glob pattern (path.Match syntax). Empty fields keep the parsed value.
+type ThreatClassRule struct {
+	Match    string `json:"match"`
+	Platform string `json:"platform,omitempty"`
+	Category string `json:"category,omitempty"`
+	Family   string `json:"family,omitempty"`
+}
+
+// ThreatClassifier fills in the platform, category and family of threats
+type ThreatClassifier struct {
+	rules []*ThreatClassRule
+}
+
+// Global classification overrides (nil = signature names are only parsed)
+var threatClasses *ThreatClassifier
+
+// Signature variant suffix, e.g. -9953208-0 in Win.Trojan.Emotet-9953208-0
+var signatureVariantRegex = regexp.MustCompile(`(-\d+)+$`)
+
+// LoadThreatClasses reads the classification overrides file
+func LoadThreatClasses(filename string) (*ThreatClassifier, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open threat classes file: %w", err)
+	}
+	defer f.Close()
+
+	var classesConfig ThreatClassesConfig
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&classesConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse threat classes file: %w", err)
+	}
+
+	for i, rule := range classesConfig.Classes {
+		if rule == nil || rule.Match == "" {
+			return nil, fmt.Errorf("threat class %d: match is required", i)
+		}
+		if _, err := path.Match(rule.Match, ""); err != nil {
+			return nil, fmt.Errorf("threat class %d: invalid match %q: %w", i, rule.Match, err)
+		}
+		if rule.Platform == "" && rule.Category == "" && rule.Family == "" {
+			return nil, fmt.Errorf("threat class %d (%s): set platform, category or family", i, rule.Match)
+		}
+	}
+	return &ThreatClassifier{rules: classesConfig.Classes}, nil
+}
+
+// parseSignatureName splits a ClamAV signature name following its
+// Platform.Category.Family-Variant convention. PUA signatures
+// (PUA.Win.Packer.Upx-1) get the category PUA, heuristic alerts
+// (Heuristics.Encrypted.Zip) the category Heuristics. Parts a name doesn't
+// have are left empty.
+func parseSignatureName(name string) (platform, category, family string) {
+	name = strings.TrimSuffix(name, ".UNOFFICIAL")
+	parts := strings.Split(name, ".")
+	switch {
+	case parts[0] == "Heuristics" && len(parts) > 1:
+		return "", "Heuristics", strings.Join(parts[1:], ".")
+	case parts[0] == "PUA" && len(parts) > 3:
+		platform, category, family = parts[1], "PUA", strings.Join(parts[3:], ".")
+	case parts[0] == "PUA" && len(parts) == 3:
+		platform, category, family = parts[1], "PUA", parts[2]
+	case len(parts) >= 3:
+		platform, category, family = parts[0], parts[1], strings.Join(parts[2:], ".")
+	case len(parts) == 2:
+		category, family = parts[0], parts[1]
+	default:
+		family = parts[0]
+	}
+	return platform, category, signatureVariantRegex.ReplaceAllString(family, "")
+}
+
+// classify sets the platform, category and family of threat from its
+// signature name and the first matching override
+func (c *ThreatClassifier) classify(threat *Threat) {
+	threat.Platform, threat.Category, threat.Family = parseSignatureName(threat.Name)
+	if c == nil {
+		return
+	}
+	for _, rule := range c.rules {
+		if ok, _ := path.Match(rule.Match, threat.Name); !ok {
+			continue
+		}
+		if rule.Platform != "" {
+			threat.Platform = rule.Platform
+		}
+		if rule.Category != "" {
+			threat.Category = rule.Category
+		}
+		if rule.Family != "" {
+			threat.Family = rule.Family
+		}
+		return
+	}
+}
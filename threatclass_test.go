@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSignatureName(t *testing.T) {
+	tests := []struct {
+		name                    string
+		platform, category, fam string
+	}{
+		{"Win.Trojan.Emotet-9953208-0", "Win", "Trojan", "Emotet"},
+		{"Win.Test.EICAR_HDB-1", "Win", "Test", "EICAR_HDB"},
+		{"Doc.Downloader.Emotet-7155442-0", "Doc", "Downloader", "Emotet"},
+		{"Unix.Malware.Agent-1234567-0.UNOFFICIAL", "Unix", "Malware", "Agent"},
+		{"PUA.Win.Packer.Upx-1", "Win", "PUA", "Upx"},
+		{"PUA.Win.Tool.Netcat", "Win", "PUA", "Netcat"},
+		{"Heuristics.Encrypted.Zip", "", "Heuristics", "Encrypted.Zip"},
+		{"Html.Phishing.Bank.Paypal-42", "Html", "Phishing", "Bank.Paypal"},
+		{"Trojan.Agent-123", "", "Trojan", "Agent"},
+		{"Eicar-Signature", "", "", "Eicar-Signature"},
+		{"Eicar-Test-Signature-1", "", "", "Eicar-Test-Signature"},
+	}
+	for _, tt := range tests {
+		platform, category, family := parseSignatureName(tt.name)
+		if platform != tt.platform || category != tt.category || family != tt.fam {
+			t.Errorf("parseSignatureName(%q) = %q, %q, %q; want %q, %q, %q",
+				tt.name, platform, category, family, tt.platform, tt.category, tt.fam)
+		}
+	}
+}
+
+func TestThreatClassifierOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "classes.json")
+	os.WriteFile(path, []byte(`{"classes": [
+		{"match": "Sanesecurity.Phish.*", "platform": "Email", "category": "Phishing"},
+		{"match": "Win.Malware.Agent*", "category": "Trojan"},
+		{"match": "Win.Malware.*", "category": "Generic"}
+	]}`), 0o644)
+	classifier, err := LoadThreatClasses(path)
+	if err != nil {
+		t.Fatalf("LoadThreatClasses() error: %v", err)
+	}
+
+	tests := []struct {
+		name                    string
+		platform, category, fam string
+	}{
+		{"Sanesecurity.Phish.Bank.12345", "Email", "Phishing", "Bank.12345"},
+		{"Win.Malware.Agent-6929401-0", "Win", "Trojan", "Agent"}, // First match wins
+		{"Win.Malware.Zusy-1", "Win", "Generic", "Zusy"},
+		{"Win.Trojan.Emotet-1", "Win", "Trojan", "Emotet"}, // No match: parsed
+	}
+	for _, tt := range tests {
+		threat := Threat{Name: tt.name}
+		classifier.classify(&threat)
+		if threat.Platform != tt.platform || threat.Category != tt.category || threat.Family != tt.fam {
+			t.Errorf("classify(%q) = %q, %q, %q; want %q, %q, %q",
+				tt.name, threat.Platform, threat.Category, threat.Family, tt.platform, tt.category, tt.fam)
+		}
+	}
+
+	// Without overrides names are only parsed
+	var none *ThreatClassifier
+	threat := Threat{Name: "Win.Malware.Zusy-1"}
+	none.classify(&threat)
+	if threat.Category != "Malware" {
+		t.Errorf("nil classifier category = %q, want Malware", threat.Category)
+	}
+}
+
+func TestLoadThreatClassesInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"not json", `{`},
+		{"unknown field", `{"classes": [{"match": "Win.*", "severity": "low"}]}`},
+		{"missing match", `{"classes": [{"category": "Trojan"}]}`},
+		{"bad pattern", `{"classes": [{"match": "Win.[", "category": "Trojan"}]}`},
+		{"no fields", `{"classes": [{"match": "Win.*"}]}`},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "classes.json")
+		os.WriteFile(path, []byte(tt.content), 0o644)
+		if _, err := LoadThreatClasses(path); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+	if _, err := LoadThreatClasses(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing file: expected error")
+	}
+}
+
+func TestParseClamAVOutputClassifiesThreats(t *testing.T) {
+	threats := parseClamAVOutput("/tmp/scan/a.exe: Win.Trojan.Emotet-9953208-0 FOUND\n", "/tmp/scan")
+	if len(threats) != 1 {
+		t.Fatalf("got %d threats, want 1", len(threats))
+	}
+	if threats[0].Platform != "Win" || threats[0].Category != "Trojan" || threats[0].Family != "Emotet" {
+		t.Errorf("threat = %+v, want Win/Trojan/Emotet", threats[0])
+	}
+}
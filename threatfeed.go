@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Threat feed page sizes (GET /threats/feed)
+const (
+	defaultFeedLimit = 100
+	maxFeedLimit     = 1000
+)
+
+// FeedItem is one detection in the threat feed
+type FeedItem struct {
+	Time         time.Time         `json:"time"`
+	Signature    string            `json:"signature"`
+	Platform     string            `json:"platform,omitempty"` // Parsed from the signature name
+	Category     string            `json:"category,omitempty"`
+	Family       string            `json:"family,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`          // From THREAT_TAGS_FILE when detected
+	SHA256       string            `json:"sha256,omitempty"`        // Infected file
+	Hashes       map[string]string `json:"hashes,omitempty"`        // Digests of the infected file (HASH_ALGORITHMS)
+	UploadSHA256 string            `json:"upload_sha256,omitempty"` // Upload it was found in, if hashed (differs for archive entries)
+	Route        string            `json:"route"`
+}
+
+// ThreatFeed is a page of the threat feed. NextCursor resumes after the
+// last item, also when the page is empty, so subscribers can keep polling
+// with it.
+type ThreatFeed struct {
+	Items      []FeedItem `json:"items"`
+	NextCursor string     `json:"next_cursor"`
+	More       bool       `json:"more"` // More items follow NextCursor in the window
+}
+
+// feedItems lists the detections of the history records, oldest first
+func feedItems(records []*HistoryRecord) []FeedItem {
+	var items []FeedItem
+	for _, record := range records {
+		for _, threat := range record.Threats {
+			items = append(items, FeedItem{
+				Time:         record.Time,
+				Signature:    threat.Name,
+				Platform:     threat.Platform,
+				Category:     threat.Category,
+				Family:       threat.Family,
+				Tags:         threat.Tags,
+				SHA256:       threat.FileHash,
+				Hashes:       threat.Hashes,
+				UploadSHA256: record.Hashes["sha256"],
+				Route:        record.Route,
+			})
+		}
+	}
+	return items
+}
+
+// feedCursor is a position in the feed: after the first n items at time t
+type feedCursor struct {
+	t time.Time
+	n int
+}
+
+// parseFeedCursor parses a cursor written by String
+func parseFeedCursor(value string) (feedCursor, error) {
+	nanos, n, ok := strings.Cut(value, ".")
+	t, err1 := strconv.ParseInt(nanos, 10, 64)
+	count, err2 := strconv.Atoi(n)
+	if !ok || err1 != nil || err2 != nil || count < 0 {
+		return feedCursor{}, fmt.Errorf("invalid cursor %q", value)
+	}
+	return feedCursor{time.Unix(0, t).UTC(), count}, nil
+}
+
+// String encodes the cursor as "<unix nanoseconds>.<n>"
+func (c feedCursor) String() string {
+	return strconv.FormatInt(c.t.UnixNano(), 10) + "." + strconv.Itoa(c.n)
+}
+
+// pageFeed returns up to limit items after the cursor (nil = from the
+// start) and the cursor after them. until is the cursor of an empty feed.
+func pageFeed(items []FeedItem, cursor *feedCursor, limit int, until time.Time) *ThreatFeed {
+	start, seen := 0, 0
+	for cursor != nil && start < len(items) && !items[start].Time.After(cursor.t) {
+		if items[start].Time.Equal(cursor.t) {
+			if seen == cursor.n {
+				break
+			}
+			seen++
+		}
+		start++
+	}
+	end := min(start+limit, len(items))
+
+	feed := &ThreatFeed{Items: items[start:end], More: end < len(items)}
+	switch {
+	case end > 0:
+		next := feedCursor{t: items[end-1].Time}
+		for i := end - 1; i >= 0 && items[i].Time.Equal(next.t); i-- {
+			next.n++
+		}
+		feed.NextCursor = next.String()
+	case cursor != nil:
+		feed.NextCursor = cursor.String()
+	default:
+		feed.NextCursor = feedCursor{t: until}.String()
+	}
+	if feed.Items == nil {
+		feed.Items = []FeedItem{}
+	}
+	return feed
+}
+
+// stixBundle converts a feed page to a STIX 2.1 bundle of indicators
+// ("STIX-lite": file hash patterns only, no relationships). Detections
+// without a file hash have no pattern and are left out. The paging fields
+// are carried as custom bundle properties.
+func stixBundle(feed *ThreatFeed) map[string]any {
+	objects := make([]map[string]any, 0, len(feed.Items))
+	for _, item := range feed.Items {
+		if item.SHA256 == "" {
+			continue
+		}
+		created := item.Time.UTC().Format(time.RFC3339Nano)
+		objects = append(objects, map[string]any{
+			"type":            "indicator",
+			"spec_version":    "2.1",
+			"id":              "indicator--" + stixUUID(item.Signature+"\x00"+item.SHA256+"\x00"+created),
+			"created":         created,
+			"modified":        created,
+			"name":            item.Signature,
+			"indicator_types": []string{"malicious-activity"},
+			"pattern":         fmt.Sprintf("[file:hashes.'SHA-256' = '%s']", item.SHA256),
+			"pattern_type":    "stix",
+			"valid_from":      created,
+		})
+	}
+	return map[string]any{
+		"type":        "bundle",
+		"id":          "bundle--" + stixUUID(randomID()),
+		"objects":     objects,
+		"next_cursor": feed.NextCursor,
+		"more":        feed.More,
+	}
+}
+
+// stixUUID derives a UUID (version 5 layout) from a name, so a detection
+// keeps its STIX ID when it is fetched again
+func stixUUID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	h := hex.EncodeToString(sum[:16])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// threatFeedHandler serves GET /threats/feed: detections from the scan
+// history, oldest first. The window is set as for GET /stats; ?cursor=
+// (from next_cursor) resumes after an earlier page instead of ?since=.
+// ?limit= sets the page size and ?format=stix returns a STIX bundle.
+func threatFeedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+
+	since, until, reqErr := historyWindow(r, history.now())
+	if reqErr != nil {
+		sendRequestError(w, reqErr)
+		return
+	}
+	var cursor *feedCursor
+	if value := query.Get("cursor"); value != "" {
+		c, err := parseFeedCursor(value)
+		if err != nil {
+			sendErrorStatus(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+		cursor, since = &c, c.t
+	}
+	limit := defaultFeedLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxFeedLimit {
+			sendErrorStatus(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxFeedLimit))
+			return
+		}
+		limit = n
+	}
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "stix" {
+		sendErrorStatus(w, http.StatusBadRequest, "format must be json or stix")
+		return
+	}
+
+	records, _ := history.Between(since, until)
+	feed := pageFeed(feedItems(records), cursor, limit, until)
+	if format == "stix" {
+		w.Header().Set("Content-Type", "application/stix+json;version=2.1")
+		json.NewEncoder(w).Encode(stixBundle(feed))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(feed)
+}
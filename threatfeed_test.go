@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPageFeed(t *testing.T) {
+	start := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	// Two detections in one scan share a time
+	items := []FeedItem{
+		{Time: start, Signature: "a"},
+		{Time: start.Add(time.Second), Signature: "b"},
+		{Time: start.Add(time.Second), Signature: "c"},
+		{Time: start.Add(2 * time.Second), Signature: "d"},
+	}
+
+	var got []string
+	var cursor *feedCursor
+	for page := 0; page < 10; page++ {
+		feed := pageFeed(items, cursor, 2, start.Add(time.Hour))
+		for _, item := range feed.Items {
+			got = append(got, item.Signature)
+		}
+		c, err := parseFeedCursor(feed.NextCursor)
+		if err != nil {
+			t.Fatalf("next cursor: %v", err)
+		}
+		cursor = &c
+		if !feed.More {
+			break
+		}
+	}
+	if strings.Join(got, ",") != "a,b,c,d" {
+		t.Errorf("paged items = %v, want a,b,c,d", got)
+	}
+
+	// Polling at the end returns nothing new and the same cursor
+	if feed := pageFeed(items, cursor, 2, start.Add(time.Hour)); len(feed.Items) != 0 || feed.NextCursor != cursor.String() || feed.More {
+		t.Errorf("page after the end = %+v", feed)
+	}
+	// Ending mid-time resumes with the other detection at that time
+	feed := pageFeed(items, nil, 2, start.Add(time.Hour))
+	c, _ := parseFeedCursor(feed.NextCursor)
+	if next := pageFeed(items, &c, 1, start.Add(time.Hour)); len(next.Items) != 1 || next.Items[0].Signature != "c" {
+		t.Errorf("page after %s = %+v", feed.NextCursor, next.Items)
+	}
+
+	if _, err := parseFeedCursor("yesterday"); err == nil {
+		t.Error("parseFeedCursor() accepted an invalid cursor")
+	}
+}
+
+func TestThreatFeedHandler(t *testing.T) {
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	history, _ = NewScanHistory(&Config{ScanHistorySize: 10})
+	history.now = func() time.Time { return now }
+	t.Cleanup(func() { history = nil })
+	history.Add(&HistoryRecord{Time: now.Add(-2 * time.Hour), Status: "clean", Route: "/scan"})
+	history.Add(&HistoryRecord{Time: now.Add(-time.Hour), Status: "infected", Route: "/scan",
+		Hashes:  map[string]string{"sha256": "upload"},
+		Threats: []Threat{{Name: "Eicar-Signature", FileHash: "abc"}, {Name: "Heuristics.Encrypted"}}})
+
+	get := func(query string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		threatFeedHandler(recorder, httptest.NewRequest(http.MethodGet, "/threats/feed"+query, nil))
+		return recorder
+	}
+
+	var feed ThreatFeed
+	json.NewDecoder(get("").Body).Decode(&feed)
+	if len(feed.Items) != 2 || feed.Items[0].SHA256 != "abc" || feed.Items[0].UploadSHA256 != "upload" || feed.More {
+		t.Errorf("feed = %+v", feed)
+	}
+
+	recorder := get("?format=stix")
+	var bundle struct {
+		Type    string `json:"type"`
+		Objects []struct {
+			ID      string `json:"id"`
+			Name    string `json:"name"`
+			Pattern string `json:"pattern"`
+		} `json:"objects"`
+	}
+	json.NewDecoder(recorder.Body).Decode(&bundle)
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "application/stix+json") || bundle.Type != "bundle" || len(bundle.Objects) != 1 {
+		t.Fatalf("STIX bundle = %+v", bundle)
+	}
+	if object := bundle.Objects[0]; object.Name != "Eicar-Signature" || object.Pattern != "[file:hashes.'SHA-256' = 'abc']" || !strings.HasPrefix(object.ID, "indicator--") {
+		t.Errorf("indicator = %+v", object)
+	}
+
+	for _, query := range []string{"?limit=0", "?cursor=x", "?format=xml", "?window=soon"} {
+		if recorder := get(query); recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, recorder.Code)
+		}
+	}
+}
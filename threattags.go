@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the tag database is checked for changes
+const threatTagsRecheck = 10 * time.Second
+
+// ThreatTagsConfig is the structure of a JSON THREAT_TAGS_FILE. Each rule
+// names a malware family (case-insensitive, as classified) or a signature
+// name pattern (path.Match syntax); the tags of every matching rule are
+// added to the threat.
+//
+// Example:
+//
+//	{
+//	  "tags": [
+//	    {"family": "Emotet", "tags": ["attack:T1566.001", "attack:T1204.002", "alias:Geodo"]},
+//	    {"match": "Doc.Downloader.*", "tags": ["attack:T1204.002"]}
+//	  ]
+//	}
+//
+// The same rules can be kept as CSV with a family,match,tag header and one
+// tag per row.
+type ThreatTagsConfig struct {
+	Tags []*ThreatTagRule `json:"tags"`
+}
+
+// ThreatTagRule tags threats of a family or matching a signature pattern
+type ThreatTagRule struct {
+	Family string   `json:"family,omitempty"`
+	Match  string   `json:"match,omitempty"`
+	Tags   []string `json:"tags"`
+}
+
+// ThreatTagger attaches tags, such as ATT&CK techniques and family aliases,
+// to threats. The database is read again when the file changes, so
+// operators can update it without a restart.
+type ThreatTagger struct {
+	path string
+	now  func() time.Time
+
+	mu       sync.Mutex
+	byFamily map[string][]string // Lower-case family -> tags
+	patterns []*ThreatTagRule
+	modTime  time.Time // Of the loaded file
+	checked  time.Time // Last check for changes
+}
+
+// Global threat tagger (nil when THREAT_TAGS_FILE is not set)
+var threatTags *ThreatTagger
+
+// LoadThreatTags reads the tag database (.csv, otherwise JSON)
+func LoadThreatTags(filename string) (*ThreatTagger, error) {
+	t := &ThreatTagger{path: filename, now: time.Now}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// load reads the tag database and replaces the rules
+func (t *ThreatTagger) load() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return fmt.Errorf("failed to open threat tags file: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open threat tags file: %w", err)
+	}
+
+	var rules []*ThreatTagRule
+	if strings.EqualFold(filepath.Ext(t.path), ".csv") {
+		rules, err = parseThreatTagsCSV(f)
+	} else {
+		var tagsConfig ThreatTagsConfig
+		decoder := json.NewDecoder(f)
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&tagsConfig)
+		rules = tagsConfig.Tags
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse threat tags file: %w", err)
+	}
+
+	byFamily := make(map[string][]string)
+	var patterns []*ThreatTagRule
+	for i, rule := range rules {
+		if rule == nil || (rule.Family == "") == (rule.Match == "") {
+			return fmt.Errorf("threat tag rule %d: set either family or match", i)
+		}
+		if rule.Match != "" {
+			if _, err := path.Match(rule.Match, ""); err != nil {
+				return fmt.Errorf("threat tag rule %d: invalid match %q: %w", i, rule.Match, err)
+			}
+		}
+		if len(rule.Tags) == 0 || containsString(rule.Tags, "") {
+			return fmt.Errorf("threat tag rule %d: tags must not be empty", i)
+		}
+		if rule.Family != "" {
+			family := strings.ToLower(rule.Family)
+			byFamily[family] = append(byFamily[family], rule.Tags...)
+		} else {
+			patterns = append(patterns, rule)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.byFamily, t.patterns, t.modTime = byFamily, patterns, info.ModTime()
+	return nil
+}
+
+// parseThreatTagsCSV reads rules from CSV with a family,match,tag header
+func parseThreatTagsCSV(r io.Reader) ([]*ThreatTagRule, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	if strings.Join(header, ",") != "family,match,tag" {
+		return nil, errors.New("expected a family,match,tag header")
+	}
+	var rules []*ThreatTagRule
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rules, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, &ThreatTagRule{Family: record[0], Match: record[1], Tags: []string{record[2]}})
+	}
+}
+
+// reloadIfChanged reads the database again if the file changed since it was
+// loaded. An invalid update is logged and the previous rules are kept.
+func (t *ThreatTagger) reloadIfChanged() {
+	t.mu.Lock()
+	now := t.now()
+	if now.Sub(t.checked) < threatTagsRecheck {
+		t.mu.Unlock()
+		return
+	}
+	t.checked = now
+	modTime := t.modTime
+	t.mu.Unlock()
+
+	info, err := os.Stat(t.path)
+	if err != nil || info.ModTime().Equal(modTime) {
+		return
+	}
+	if err := t.load(); err != nil {
+		log.Printf("Keeping previous threat tags: %v", err)
+		metrics.Count("threat_tags.reload_errors", 1)
+		return
+	}
+	log.Printf("Reloaded threat tags from %s", t.path)
+}
+
+// tag adds the tags of the rules matching threat's family or signature name
+func (t *ThreatTagger) tag(threat *Threat) {
+	if t == nil {
+		return
+	}
+	t.reloadIfChanged()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var tags []string
+	if threat.Family != "" {
+		tags = append(tags, t.byFamily[strings.ToLower(threat.Family)]...)
+	}
+	for _, rule := range t.patterns {
+		if ok, _ := path.Match(rule.Match, threat.Name); ok {
+			tags = append(tags, rule.Tags...)
+		}
+	}
+	for _, tag := range tags {
+		if !containsString(threat.Tags, tag) {
+			threat.Tags = append(threat.Tags, tag)
+		}
+	}
+}
+
+// enrichThreat runs the enrichment stages on a detected threat: the
+// classification from its signature name first, then what later stages
+// derive from it
+func enrichThreat(threat *Threat) {
+	threatClasses.classify(threat)
+	threatTags.tag(threat)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestThreatTaggerJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tags.json")
+	os.WriteFile(path, []byte(`{"tags": [
+		{"family": "Emotet", "tags": ["attack:T1566.001", "alias:Geodo"]},
+		{"match": "Doc.Downloader.*", "tags": ["attack:T1204.002", "attack:T1566.001"]}
+	]}`), 0o644)
+	tagger, err := LoadThreatTags(path)
+	if err != nil {
+		t.Fatalf("LoadThreatTags() error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"Win.Trojan.Emotet-9953208-0", []string{"attack:T1566.001", "alias:Geodo"}},
+		{"Doc.Downloader.Emotet-7155442-0", []string{"attack:T1566.001", "alias:Geodo", "attack:T1204.002"}},
+		{"Doc.Downloader.Agent-1", []string{"attack:T1204.002", "attack:T1566.001"}},
+		{"Win.Test.EICAR_HDB-1", nil},
+	}
+	for _, tt := range tests {
+		threat := Threat{Name: tt.name}
+		threatClasses.classify(&threat)
+		tagger.tag(&threat)
+		if !reflect.DeepEqual(threat.Tags, tt.want) {
+			t.Errorf("tag(%q) = %v, want %v", tt.name, threat.Tags, tt.want)
+		}
+	}
+}
+
+func TestThreatTaggerCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tags.csv")
+	os.WriteFile(path, []byte("family,match,tag\n"+
+		"# Loaders\n"+
+		"emotet,,attack:T1566.001\n"+
+		"Emotet,,alias:Heodo\n"+
+		",Win.Ransomware.*,attack:T1486\n"), 0o644)
+	tagger, err := LoadThreatTags(path)
+	if err != nil {
+		t.Fatalf("LoadThreatTags() error: %v", err)
+	}
+
+	threat := Threat{Name: "Win.Trojan.Emotet-1", Family: "Emotet"}
+	tagger.tag(&threat)
+	if want := []string{"attack:T1566.001", "alias:Heodo"}; !reflect.DeepEqual(threat.Tags, want) {
+		t.Errorf("family tags = %v, want %v", threat.Tags, want)
+	}
+	threat = Threat{Name: "Win.Ransomware.Lockbit-1", Family: "Lockbit"}
+	tagger.tag(&threat)
+	if want := []string{"attack:T1486"}; !reflect.DeepEqual(threat.Tags, want) {
+		t.Errorf("pattern tags = %v, want %v", threat.Tags, want)
+	}
+}
+
+func TestThreatTaggerReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tags.json")
+	os.WriteFile(path, []byte(`{"tags": [{"family": "Emotet", "tags": ["alias:Geodo"]}]}`), 0o644)
+	tagger, err := LoadThreatTags(path)
+	if err != nil {
+		t.Fatalf("LoadThreatTags() error: %v", err)
+	}
+	now := time.Now()
+	tagger.now = func() time.Time { return now }
+
+	update := func(content string) {
+		os.WriteFile(path, []byte(content), 0o644)
+		modTime := now.Add(time.Minute)
+		os.Chtimes(path, modTime, modTime)
+		now = now.Add(threatTagsRecheck)
+	}
+	tags := func() []string {
+		threat := Threat{Name: "Win.Trojan.Emotet-1", Family: "Emotet"}
+		tagger.tag(&threat)
+		return threat.Tags
+	}
+
+	update(`{"tags": [{"family": "Emotet", "tags": ["alias:Heodo"]}]}`)
+	if got := tags(); !reflect.DeepEqual(got, []string{"alias:Heodo"}) {
+		t.Errorf("after update: tags = %v, want [alias:Heodo]", got)
+	}
+
+	// An invalid update keeps the previous rules
+	update(`{"tags": [{"family": "Emotet"}]}`)
+	if got := tags(); !reflect.DeepEqual(got, []string{"alias:Heodo"}) {
+		t.Errorf("after invalid update: tags = %v, want [alias:Heodo]", got)
+	}
+}
+
+func TestLoadThreatTagsInvalid(t *testing.T) {
+	tests := []struct {
+		name, file, content string
+	}{
+		{"not json", "tags.json", `{`},
+		{"unknown field", "tags.json", `{"tags": [{"family": "Emotet", "tags": ["x"], "severity": "low"}]}`},
+		{"family and match", "tags.json", `{"tags": [{"family": "Emotet", "match": "Win.*", "tags": ["x"]}]}`},
+		{"neither", "tags.json", `{"tags": [{"tags": ["x"]}]}`},
+		{"no tags", "tags.json", `{"tags": [{"family": "Emotet"}]}`},
+		{"bad pattern", "tags.json", `{"tags": [{"match": "Win.[", "tags": ["x"]}]}`},
+		{"csv header", "tags.csv", "family,tag\nEmotet,x\n"},
+		{"csv columns", "tags.csv", "family,match,tag\nEmotet,x\n"},
+		{"csv empty tag", "tags.csv", "family,match,tag\nEmotet,,\n"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), tt.file)
+		os.WriteFile(path, []byte(tt.content), 0o644)
+		if _, err := LoadThreatTags(path); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestParseClamAVOutputTagsThreats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tags.json")
+	os.WriteFile(path, []byte(`{"tags": [{"family": "Emotet", "tags": ["attack:T1566.001"]}]}`), 0o644)
+	tagger, err := LoadThreatTags(path)
+	if err != nil {
+		t.Fatalf("LoadThreatTags() error: %v", err)
+	}
+	threatTags = tagger
+	t.Cleanup(func() { threatTags = nil })
+
+	threats := parseClamAVOutput("/tmp/scan/a.exe: Win.Trojan.Emotet-9953208-0 FOUND\n", "/tmp/scan")
+	if len(threats) != 1 || !reflect.DeepEqual(threats[0].Tags, []string{"attack:T1566.001"}) {
+		t.Errorf("threats = %+v, want one tagged attack:T1566.001", threats)
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing uses the OTLP/HTTP JSON encoding, so no OpenTelemetry SDK dependency
+// is needed. Spans are batched and exported in the background; when the
+// export queue is full, spans are dropped rather than blocking scans.
+
+// Standard OpenTelemetry environment variables
+const (
+	EnvOTelSDKDisabled      = "OTEL_SDK_DISABLED"
+	EnvOTelTracesExporter   = "OTEL_TRACES_EXPORTER"
+	EnvOTelEndpoint         = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	EnvOTelTracesEndpoint   = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+	EnvOTelHeaders          = "OTEL_EXPORTER_OTLP_HEADERS"
+	EnvOTelProtocol         = "OTEL_EXPORTER_OTLP_PROTOCOL"
+	EnvOTelServiceName      = "OTEL_SERVICE_NAME"
+	EnvOTelTracesSampler    = "OTEL_TRACES_SAMPLER"
+	EnvOTelTracesSamplerArg = "OTEL_TRACES_SAMPLER_ARG"
+)
+
+// Span kinds (OTLP enum values)
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// Span status codes (OTLP enum values)
+const (
+	spanStatusUnset = 0
+	spanStatusError = 2
+)
+
+// Batching settings for the exporter
+const (
+	traceQueueSize     = 2048
+	traceBatchSize     = 512
+	traceExportTimeout = 10 * time.Second
+	traceFlushInterval = 5 * time.Second
+)
+
+// TracingConfig holds OTLP exporter settings read from the standard env vars
+type TracingConfig struct {
+	Endpoint    string            // Full URL of the traces endpoint
+	Headers     map[string]string // Extra request headers (e.g. auth tokens)
+	ServiceName string
+	SampleRatio float64 // Fraction of root spans to sample (0..1)
+}
+
+// LoadTracingConfig reads OpenTelemetry settings from the environment.
+// Returns nil when tracing is disabled or no endpoint is configured.
+func LoadTracingConfig() *TracingConfig {
+	if getEnvBool(EnvOTelSDKDisabled, false) {
+		return nil
+	}
+	if exporter := getEnvStr(EnvOTelTracesExporter, "otlp"); exporter != "otlp" {
+		return nil
+	}
+
+	endpoint := getEnvStr(EnvOTelTracesEndpoint, "")
+	if endpoint == "" {
+		base := getEnvStr(EnvOTelEndpoint, "")
+		if base == "" {
+			return nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+
+	if protocol := getEnvStr(EnvOTelProtocol, "http/json"); protocol != "http/json" {
+		log.Printf("Warning: %s=%s not supported, using http/json", EnvOTelProtocol, protocol)
+	}
+
+	headers := make(map[string]string)
+	for _, item := range getEnvList(EnvOTelHeaders, "") {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok {
+			continue
+		}
+		if unescaped, err := url.QueryUnescape(value); err == nil {
+			value = unescaped
+		}
+		headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	return &TracingConfig{
+		Endpoint:    endpoint,
+		Headers:     headers,
+		ServiceName: getEnvStr(EnvOTelServiceName, "clamav-rest"),
+		SampleRatio: parseSampleRatio(getEnvStr(EnvOTelTracesSampler, "parentbased_always_on"), getEnvStr(EnvOTelTracesSamplerArg, "")),
+	}
+}
+
+// parseSampleRatio maps the OTEL_TRACES_SAMPLER setting to a root sampling ratio.
+// Parent-based samplers additionally follow the caller's sampled flag.
+func parseSampleRatio(sampler, arg string) float64 {
+	switch sampler {
+	case "always_off", "parentbased_always_off":
+		return 0
+	case "traceidratio", "parentbased_traceidratio":
+		ratio, err := strconv.ParseFloat(arg, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return 1
+		}
+		return ratio
+	}
+	return 1
+}
+
+// Tracer creates spans and exports them in batches
+type Tracer struct {
+	config *TracingConfig
+	client *http.Client
+	queue  chan *Span
+}
+
+// Global tracer instance (nil when tracing is disabled)
+var tracer *Tracer
+
+// NewTracer creates a tracer and starts its background exporter
+func NewTracer(config *TracingConfig) *Tracer {
+	t := &Tracer{
+		config: config,
+		client: newOutboundClient(traceExportTimeout),
+		queue:  make(chan *Span, traceQueueSize),
+	}
+	go t.exportLoop()
+	return t
+}
+
+// Span is a timed operation within a trace.
+// A nil *Span is valid and records nothing, so callers never need to check
+// whether tracing is enabled.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu      sync.Mutex
+	end     time.Time
+	attrs   map[string]interface{}
+	errMsg  string
+	isError bool
+}
+
+// spanKey is the context key for the active span
+type spanKey struct{}
+
+// remoteParent is a sampled span context received from a caller
+type remoteParent struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+// remoteParentKey is the context key for a remote parent span
+type remoteParentKey struct{}
+
+// StartSpan starts a child of the span in ctx (or a new trace).
+// Returns ctx unchanged and a nil span when tracing is disabled or the trace
+// is not sampled.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	return startSpan(ctx, name, spanKindInternal)
+}
+
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	span := &Span{tracer: tracer, name: name, kind: kind, start: time.Now()}
+
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok && parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	} else if remote, ok := ctx.Value(remoteParentKey{}).(remoteParent); ok {
+		span.traceID = remote.traceID
+		span.parentID = remote.spanID
+	} else {
+		rand.Read(span.traceID[:])
+		if !tracer.sampleRoot(span.traceID) {
+			return ctx, nil
+		}
+	}
+	rand.Read(span.spanID[:])
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// sampleRoot decides whether a new trace is recorded, based on the trace ID
+// so the decision is consistent for a given trace
+func (t *Tracer) sampleRoot(traceID [16]byte) bool {
+	if t.config.SampleRatio >= 1 {
+		return true
+	}
+	bound := uint64(t.config.SampleRatio * float64(1<<63))
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < bound
+}
+
+// SetAttribute records a key/value on the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+}
+
+// RecordError marks the span as failed
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.isError = true
+	s.errMsg = err.Error()
+}
+
+// End finishes the span and queues it for export
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	select {
+	case s.tracer.queue <- s:
+	default:
+		// Queue full - drop rather than slow down scanning
+	}
+}
+
+// traceparent returns the W3C traceparent header value for the span
+func (s *Span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+// parseTraceparent extracts a sampled remote parent from a W3C traceparent header.
+// Returns false when the header is missing, malformed, or not sampled.
+func parseTraceparent(header string) (remoteParent, bool) {
+	var parent remoteParent
+
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return parent, false
+	}
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || len(traceID) != 16 || len(spanID) != 8 || len(flags) != 1 {
+		return parent, false
+	}
+
+	copy(parent.traceID[:], traceID)
+	copy(parent.spanID[:], spanID)
+	if parent.traceID == [16]byte{} || parent.spanID == [8]byte{} {
+		return parent, false
+	}
+	return parent, flags[0]&1 == 1
+}
+
+// statusRecorder captures the response status code for tracing
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// traceRequests wraps a handler with a server span per request.
+// Honors an incoming W3C traceparent header; an unsampled parent disables
+// tracing for the request.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		if header := r.Header.Get("traceparent"); header != "" {
+			parent, sampled := parseTraceparent(header)
+			if !sampled {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx = context.WithValue(ctx, remoteParentKey{}, parent)
+		}
+
+		ctx, span := startSpan(ctx, r.Method+" "+r.URL.Path, spanKindServer)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("url.path", r.URL.Path)
+		span.SetAttribute("http.request.body.size", r.ContentLength)
+		w.Header().Set("traceresponse", span.traceparent())
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttribute("http.response.status_code", recorder.status)
+		if recorder.status >= 500 {
+			span.RecordError(fmt.Errorf("HTTP %d", recorder.status))
+		}
+	})
+}
+
+// exportLoop batches queued spans and sends them to the collector
+func (t *Tracer) exportLoop() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, traceBatchSize)
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := t.export(batch); err != nil {
+			log.Printf("Warning: failed to export %d spans: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+}
+
+// export sends a batch of spans as an OTLP/HTTP JSON request
+func (t *Tracer) export(spans []*Span) error {
+	body, err := json.Marshal(t.encode(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.config.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// OTLP JSON structures (subset of ExportTraceServiceRequest)
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// encode converts spans to the OTLP JSON request structure
+func (t *Tracer) encode(spans []*Span) otlpTraceRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        encodeAttributes(s.attrs),
+			Status:            otlpStatus{Code: spanStatusUnset},
+		}
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.isError {
+			span.Status = otlpStatus{Code: spanStatusError, Message: s.errMsg}
+		}
+		s.mu.Unlock()
+		encoded = append(encoded, span)
+	}
+
+	return otlpTraceRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: encodeAttributes(map[string]interface{}{
+				"service.name": t.config.ServiceName,
+			})},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "clamav-rest"},
+				Spans: encoded,
+			}},
+		}},
+	}
+}
+
+// encodeAttributes converts attributes to OTLP AnyValue form
+func encodeAttributes(attrs map[string]interface{}) []otlpKeyValue {
+	var result []otlpKeyValue
+	for key, value := range attrs {
+		var v map[string]interface{}
+		switch val := value.(type) {
+		case string:
+			v = map[string]interface{}{"stringValue": val}
+		case bool:
+			v = map[string]interface{}{"boolValue": val}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(val)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(val, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": val}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(val)}
+		}
+		result = append(result, otlpKeyValue{Key: key, Value: v})
+	}
+	return result
+}
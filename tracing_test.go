@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestTracer installs a tracer without the background exporter so tests
+// can inspect queued spans directly
+func newTestTracer(t *testing.T, config *TracingConfig) *Tracer {
+	t.Helper()
+
+	tr := &Tracer{config: config, client: http.DefaultClient, queue: make(chan *Span, 100)}
+	tracer = tr
+	t.Cleanup(func() { tracer = nil })
+	return tr
+}
+
+func TestLoadTracingConfig(t *testing.T) {
+	t.Run("disabled without endpoint", func(t *testing.T) {
+		t.Setenv(EnvOTelEndpoint, "")
+		t.Setenv(EnvOTelTracesEndpoint, "")
+		if cfg := LoadTracingConfig(); cfg != nil {
+			t.Errorf("LoadTracingConfig() = %+v, want nil", cfg)
+		}
+	})
+
+	t.Run("base endpoint gets traces path", func(t *testing.T) {
+		t.Setenv(EnvOTelEndpoint, "http://collector:4318/")
+		t.Setenv(EnvOTelHeaders, "x-api-key=abc%20def,invalid")
+		t.Setenv(EnvOTelTracesSampler, "traceidratio")
+		t.Setenv(EnvOTelTracesSamplerArg, "0.25")
+
+		cfg := LoadTracingConfig()
+		if cfg == nil {
+			t.Fatal("LoadTracingConfig() = nil")
+		}
+		if cfg.Endpoint != "http://collector:4318/v1/traces" {
+			t.Errorf("Endpoint = %q", cfg.Endpoint)
+		}
+		if cfg.Headers["x-api-key"] != "abc def" {
+			t.Errorf("Headers = %v", cfg.Headers)
+		}
+		if cfg.SampleRatio != 0.25 {
+			t.Errorf("SampleRatio = %v, want 0.25", cfg.SampleRatio)
+		}
+		if cfg.ServiceName != "clamav-rest" {
+			t.Errorf("ServiceName = %q, want clamav-rest", cfg.ServiceName)
+		}
+	})
+
+	t.Run("SDK disabled", func(t *testing.T) {
+		t.Setenv(EnvOTelEndpoint, "http://collector:4318")
+		t.Setenv(EnvOTelSDKDisabled, "true")
+		if cfg := LoadTracingConfig(); cfg != nil {
+			t.Error("expected nil config when SDK disabled")
+		}
+	})
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		wantSampled bool
+	}{
+		{name: "sampled", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", wantSampled: true},
+		{name: "not sampled", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+		{name: "zero trace id", header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "invalid version", header: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "malformed", header: "garbage"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, sampled := parseTraceparent(tt.header)
+			if sampled != tt.wantSampled {
+				t.Errorf("sampled = %v, want %v", sampled, tt.wantSampled)
+			}
+		})
+	}
+}
+
+func TestStartSpanDisabled(t *testing.T) {
+	tracer = nil
+
+	ctx, span := StartSpan(context.Background(), "noop")
+	if span != nil {
+		t.Error("expected nil span when tracing is disabled")
+	}
+
+	// Methods on a nil span must be safe
+	span.SetAttribute("key", "value")
+	span.RecordError(errors.New("boom"))
+	span.End()
+
+	if ctx == nil {
+		t.Error("context should be returned unchanged")
+	}
+}
+
+func TestSpanHierarchy(t *testing.T) {
+	tr := newTestTracer(t, &TracingConfig{ServiceName: "test", SampleRatio: 1})
+
+	ctx, parent := StartSpan(context.Background(), "parent")
+	_, child := StartSpan(ctx, "child")
+	child.RecordError(errors.New("boom"))
+	child.End()
+	parent.End()
+
+	if child.traceID != parent.traceID {
+		t.Error("child should share the parent's trace ID")
+	}
+	if child.parentID != parent.spanID {
+		t.Error("child parent ID should be the parent span ID")
+	}
+
+	request := tr.encode([]*Span{<-tr.queue, <-tr.queue})
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	if spans[0].Name != "child" || spans[0].Status.Code != spanStatusError {
+		t.Errorf("first span = %+v, want failed child", spans[0])
+	}
+	if spans[1].ParentSpanID != "" {
+		t.Error("root span should have no parent")
+	}
+}
+
+func TestSampleRatioZero(t *testing.T) {
+	newTestTracer(t, &TracingConfig{SampleRatio: 0})
+
+	if _, span := StartSpan(context.Background(), "root"); span != nil {
+		t.Error("expected unsampled root span")
+	}
+}
+
+func TestTraceRequests(t *testing.T) {
+	tr := newTestTracer(t, &TracingConfig{ServiceName: "test", SampleRatio: 1})
+
+	var innerSpan *Span
+	handler := traceRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, innerSpan = StartSpan(r.Context(), "inner")
+		innerSpan.End()
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	recorder := httptest.NewRecorder()
+
+	handler.ServeHTTP(recorder, req)
+
+	<-tr.queue // inner
+	server := <-tr.queue
+
+	if server.kind != spanKindServer {
+		t.Errorf("kind = %d, want server", server.kind)
+	}
+	if got := server.attrs["http.response.status_code"]; got != http.StatusTeapot {
+		t.Errorf("status attribute = %v, want %d", got, http.StatusTeapot)
+	}
+	if innerSpan.traceID != server.traceID {
+		t.Error("inner span should belong to the request trace")
+	}
+	if recorder.Header().Get("traceresponse") == "" {
+		t.Error("missing traceresponse header")
+	}
+}
+
+func TestTracerExport(t *testing.T) {
+	var received otlpTraceRequest
+	var authHeader string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer collector.Close()
+
+	tr := newTestTracer(t, &TracingConfig{
+		Endpoint:    collector.URL + "/v1/traces",
+		Headers:     map[string]string{"Authorization": "Bearer token"},
+		ServiceName: "clamav-rest",
+		SampleRatio: 1,
+	})
+
+	_, span := StartSpan(context.Background(), "clamd")
+	span.SetAttribute("threat.count", 2)
+	span.End()
+
+	if err := tr.export([]*Span{<-tr.queue}); err != nil {
+		t.Fatalf("export() error: %v", err)
+	}
+
+	if authHeader != "Bearer token" {
+		t.Errorf("Authorization = %q, want configured header", authHeader)
+	}
+	spans := received.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 || spans[0].Name != "clamd" {
+		t.Fatalf("spans = %+v, want one clamd span", spans)
+	}
+	if spans[0].Attributes[0].Value["intValue"] != "2" {
+		t.Errorf("attribute = %+v, want intValue 2", spans[0].Attributes[0])
+	}
+}
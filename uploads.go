@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tus protocol version and extensions served at /uploads (https://tus.io)
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+)
+
+// errUploadsFull is returned when the maximum number of uploads are in progress
+var errUploadsFull = errors.New("too many uploads in progress")
+
+// UploadSession is a resumable upload in progress
+type UploadSession struct {
+	ID       string
+	owner    string          // Identity that created the upload ("" = anonymous)
+	filename string          // Client filename from the upload metadata
+	metadata json.RawMessage // Caller metadata to echo with the result
+	path     string          // Temp file receiving the data
+	length   int64           // Total size declared at creation
+
+	mu     sync.Mutex   // Held while a chunk is written
+	offset atomic.Int64 // Bytes received so far
+	closed bool         // Scanned or deleted; no more chunks accepted
+
+	expires time.Time // Guarded by the store's mutex
+}
+
+// UploadStore keeps resumable uploads until they are scanned, deleted or
+// idle for longer than the TTL
+type UploadStore struct {
+	mu         sync.Mutex
+	uploads    map[string]*UploadSession
+	maxUploads int
+	ttl        time.Duration
+	now        func() time.Time
+}
+
+// Global resumable upload store (nil = resumable uploads disabled)
+var uploads *UploadStore
+
+// NewUploadStore creates the resumable upload store. Returns nil when
+// maxUploads is not positive (resumable uploads disabled).
+func NewUploadStore(maxUploads int, ttl time.Duration) *UploadStore {
+	if maxUploads <= 0 {
+		return nil
+	}
+	return &UploadStore{
+		uploads:    make(map[string]*UploadSession),
+		maxUploads: maxUploads,
+		ttl:        ttl,
+		now:        time.Now,
+	}
+}
+
+// Create starts an upload of length bytes for owner, backed by a new temp file
+func (s *UploadStore) Create(owner, filename string, length int64) (*UploadSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	if len(s.uploads) >= s.maxUploads {
+		return nil, errUploadsFull
+	}
+
+	f, err := os.CreateTemp(scanTmpDir, "clamav-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	session := &UploadSession{
+		ID:       randomID(),
+		owner:    owner,
+		filename: filename,
+		path:     f.Name(),
+		length:   length,
+		expires:  s.now().Add(s.ttl),
+	}
+	s.uploads[session.ID] = session
+	metrics.Gauge("uploads.active", float64(len(s.uploads)))
+	return session, nil
+}
+
+// Get returns the upload if it exists and belongs to owner
+func (s *UploadStore) Get(id, owner string) *UploadSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	session := s.uploads[id]
+	if session == nil || session.owner != owner {
+		return nil
+	}
+	return session
+}
+
+// Touch extends an upload's expiry after activity and returns the new expiry
+func (s *UploadStore) Touch(session *UploadSession) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session.expires = s.now().Add(s.ttl)
+	return session.expires
+}
+
+// Expires returns when an idle upload will be discarded
+func (s *UploadStore) Expires(session *UploadSession) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return session.expires
+}
+
+// Remove forgets an upload. Its temp file is left to the caller.
+func (s *UploadStore) Remove(session *UploadSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, session.ID)
+	metrics.Gauge("uploads.active", float64(len(s.uploads)))
+}
+
+// expire discards idle uploads and their data. Callers hold s.mu.
+func (s *UploadStore) expire() {
+	now := s.now()
+	expired := 0
+	for id, session := range s.uploads {
+		if now.Before(session.expires) || !session.mu.TryLock() {
+			continue // A chunk being written keeps the upload alive
+		}
+		session.closed = true
+		session.mu.Unlock()
+		delete(s.uploads, id)
+		os.Remove(session.path)
+		log.Printf("Discarded idle upload %s after %d of %d bytes", id, session.offset.Load(), session.length)
+		expired++
+	}
+	if expired > 0 {
+		metrics.Gauge("uploads.active", float64(len(s.uploads)))
+	}
+}
+
+// uploadRoutes sends requests to trigger a scan of a finished upload to scan
+// and all other resumable upload requests to upload. Only the scan counts
+// against tenant limits; the chunks of one file are a single scan.
+func uploadRoutes(upload, scan http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/scan") {
+			scan.ServeHTTP(w, r)
+			return
+		}
+		upload.ServeHTTP(w, r)
+	})
+}
+
+// uploadsHandler implements the tus resumable upload protocol with the
+// creation, expiration and termination extensions:
+//
+//	POST   /uploads       create an upload (Upload-Length, Upload-Metadata)
+//	HEAD   /uploads/{id}  current Upload-Offset, to resume after a failure
+//	PATCH  /uploads/{id}  append a chunk at Upload-Offset
+//	DELETE /uploads/{id}  abandon the upload
+func uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(config.MaxUploadSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		sendErrorStatus(w, http.StatusPreconditionFailed, "Unsupported tus version")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/uploads"), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		createUpload(w, r)
+		return
+	}
+
+	session := uploads.Get(id, jobOwner(r))
+	if session == nil {
+		sendErrorStatus(w, http.StatusNotFound, "Upload not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		header := w.Header()
+		header.Set("Upload-Offset", strconv.FormatInt(session.offset.Load(), 10))
+		header.Set("Upload-Length", strconv.FormatInt(session.length, 10))
+		header.Set("Upload-Expires", uploads.Expires(session).UTC().Format(http.TimeFormat))
+		header.Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		appendUpload(w, r, session)
+	case http.MethodDelete:
+		if !session.mu.TryLock() {
+			sendErrorStatus(w, http.StatusConflict, "Upload in progress")
+			return
+		}
+		session.closed = true
+		session.mu.Unlock()
+		uploads.Remove(session)
+		os.Remove(session.path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// uploadLimit returns the largest upload the caller may create: the global
+// limit, or the caller's tenant limit if lower
+func uploadLimit(r *http.Request) int64 {
+	limit := config.MaxUploadSize
+	identity := identityFromContext(r.Context())
+	if tenants == nil || identity == nil {
+		return limit
+	}
+	if tenant := tenants.Lookup(identity); tenant != nil && tenant.MaxUploadSizeMB > 0 {
+		limit = min(limit, int64(tenant.MaxUploadSizeMB)*1024*1024)
+	}
+	return limit
+}
+
+// createUpload starts a resumable upload (POST /uploads)
+func createUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		sendErrorStatus(w, http.StatusBadRequest, "Upload-Length required")
+		return
+	}
+	if limit := uploadLimit(r); length > limit {
+		log.Printf("Rejected resumable upload: length %d exceeds limit %d", length, limit)
+		sendRequestError(w, uploadTooLarge(limit))
+		return
+	}
+
+	metadata := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"] // Uppy's key
+	}
+	scanMetadata, reqErr := parseScanMetadata([]byte(metadata[metadataField]), config.MetadataMaxBytes)
+	if reqErr != nil {
+		sendRequestError(w, reqErr)
+		return
+	}
+
+	session, err := uploads.Create(jobOwner(r), filename, length)
+	if errors.Is(err, errUploadsFull) {
+		log.Printf("Resumable upload limit reached, rejecting %s", sanitizeFilename(filename))
+		sendErrorStatus(w, http.StatusServiceUnavailable, "Too many uploads in progress, try again later")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create temp file: %v", err)
+		sendError(w, "Server error during file processing")
+		return
+	}
+
+	session.metadata = scanMetadata
+
+	log.Printf("Started resumable upload %s: %s (%d bytes)", session.ID, sanitizeFilename(filename), length)
+	w.Header().Set("Location", config.BasePath+"/uploads/"+session.ID)
+	w.Header().Set("Upload-Expires", uploads.Expires(session).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header: comma-separated
+// keys, each followed by a space and a base64 value. Malformed pairs are
+// skipped.
+func parseUploadMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(value)
+	}
+	return metadata
+}
+
+// appendUpload writes a chunk at the client's Upload-Offset (PATCH
+// /uploads/{id}). Data received before a connection drops is kept, so
+// the client can resume from the offset HEAD reports.
+func appendUpload(w http.ResponseWriter, r *http.Request, session *UploadSession) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		sendErrorStatus(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		sendErrorStatus(w, http.StatusBadRequest, "Upload-Offset required")
+		return
+	}
+
+	if !session.mu.TryLock() {
+		sendErrorStatus(w, http.StatusConflict, "Upload in progress")
+		return
+	}
+	defer session.mu.Unlock()
+	if session.closed {
+		sendErrorStatus(w, http.StatusNotFound, "Upload not found")
+		return
+	}
+	if offset != session.offset.Load() {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.offset.Load(), 10))
+		sendErrorStatus(w, http.StatusConflict, "Upload-Offset does not match the upload")
+		return
+	}
+
+	remaining := session.length - offset
+	if r.ContentLength > remaining {
+		sendRequestError(w, uploadTooLarge(session.length))
+		return
+	}
+	uploads.Touch(session)
+
+	f, err := os.OpenFile(session.path, os.O_WRONLY, 0)
+	if err != nil {
+		log.Printf("Failed to open upload %s: %v", session.ID, err)
+		sendError(w, "Server error during file processing")
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		log.Printf("Failed to seek upload %s: %v", session.ID, err)
+		sendError(w, "Server error during file processing")
+		return
+	}
+
+	n, err := io.Copy(f, http.MaxBytesReader(w, r.Body, remaining))
+	offset = session.offset.Add(n)
+	expires := uploads.Touch(session)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			sendRequestError(w, uploadTooLarge(session.length))
+			return
+		}
+		log.Printf("Upload %s interrupted at %d of %d bytes: %v", session.ID, offset, session.length, err)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadScanHandler scans a finished resumable upload (POST
+// /uploads/{id}/scan) and responds like /scan, including async jobs.
+// The upload is consumed by the scan.
+func uploadScanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	startTime := time.Now()
+	if rejectWhileStarting(w, r, startTime) {
+		return
+	}
+
+	metadata, reqErr := requestMetadata(r, config)
+	if reqErr != nil {
+		sendRequestError(w, reqErr)
+		return
+	}
+	passwords, reqErr := requestPasswords(r, nil)
+	if reqErr != nil {
+		sendRequestError(w, reqErr)
+		return
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/uploads/"), "/scan")
+	session := uploads.Get(id, jobOwner(r))
+	if session == nil {
+		sendErrorStatus(w, http.StatusNotFound, "Upload not found")
+		return
+	}
+
+	if !session.mu.TryLock() {
+		sendErrorStatus(w, http.StatusConflict, "Upload in progress")
+		return
+	}
+	if session.closed || session.offset.Load() != session.length {
+		session.mu.Unlock()
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.offset.Load(), 10))
+		sendErrorStatus(w, http.StatusConflict, "Upload incomplete")
+		return
+	}
+	session.closed = true
+	session.mu.Unlock()
+	uploads.Remove(session)
+
+	upload := &uploadedFile{
+		path:         session.path,
+		filename:     session.filename,
+		safeFilename: sanitizeFilename(session.filename),
+		size:         session.length,
+		metadata:     session.metadata,
+		passwords:    passwords,
+	}
+	if metadata != nil {
+		upload.metadata = metadata
+	}
+	log.Printf("Received file: %s (%d bytes, resumable upload %s)", upload.safeFilename, upload.size, session.ID)
+	respondScan(w, r, config, scanner, upload, startTime)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// useUploadStore sets the resumable upload store for a test
+func useUploadStore(t *testing.T, store *UploadStore) {
+	t.Helper()
+	uploads = store
+	t.Cleanup(func() { uploads = nil })
+}
+
+// tusRequest builds a tus request with the protocol version header
+func tusRequest(method, target string, body []byte, header map[string]string) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	return req
+}
+
+// serveUploads sends a request to the resumable upload routes
+func serveUploads(req *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	uploadRoutes(http.HandlerFunc(uploadsHandler), http.HandlerFunc(uploadScanHandler)).ServeHTTP(recorder, req)
+	return recorder
+}
+
+// createTestUpload creates an upload and returns its path
+func createTestUpload(t *testing.T, length int, filename string) string {
+	t.Helper()
+	recorder := serveUploads(tusRequest(http.MethodPost, "/uploads", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(filename)),
+	}))
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", recorder.Code, recorder.Body)
+	}
+	return recorder.Header().Get("Location")
+}
+
+// patchTestUpload sends a chunk at offset
+func patchTestUpload(location string, offset int, chunk []byte) *httptest.ResponseRecorder {
+	return serveUploads(tusRequest(http.MethodPatch, location, chunk, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	}))
+}
+
+func TestResumableUploadScan(t *testing.T) {
+	config = useFakeClamdScanner(t)
+	scanner = NewScanner(config)
+	t.Cleanup(func() { scanner = nil })
+	useUploadStore(t, NewUploadStore(10, time.Hour))
+
+	content := []byte("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*")
+	location := createTestUpload(t, len(content), "eicar.com")
+
+	// Scanning before the upload is complete fails
+	recorder := patchTestUpload(location, 0, content[:30])
+	if recorder.Code != http.StatusNoContent || recorder.Header().Get("Upload-Offset") != "30" {
+		t.Fatalf("first chunk: status %d, offset %q", recorder.Code, recorder.Header().Get("Upload-Offset"))
+	}
+	if recorder := serveUploads(httptest.NewRequest(http.MethodPost, location+"/scan", nil)); recorder.Code != http.StatusConflict {
+		t.Errorf("early scan status = %d, want 409", recorder.Code)
+	}
+
+	// The client resumes from the offset HEAD reports
+	recorder = serveUploads(tusRequest(http.MethodHead, location, nil, nil))
+	if recorder.Header().Get("Upload-Offset") != "30" || recorder.Header().Get("Upload-Length") != strconv.Itoa(len(content)) {
+		t.Errorf("HEAD headers = %v", recorder.Header())
+	}
+	if recorder := patchTestUpload(location, 0, content); recorder.Code != http.StatusConflict {
+		t.Errorf("stale offset status = %d, want 409", recorder.Code)
+	}
+	if recorder := patchTestUpload(location, 30, content[30:]); recorder.Code != http.StatusNoContent {
+		t.Fatalf("second chunk status = %d", recorder.Code)
+	}
+
+	recorder = serveUploads(httptest.NewRequest(http.MethodPost, location+"/scan", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("scan status = %d: %s", recorder.Code, recorder.Body)
+	}
+	var response ScanResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	if response.Status != "infected" {
+		t.Errorf("scan = %+v, want infected", response)
+	}
+
+	// The scan consumes the upload
+	if recorder := serveUploads(tusRequest(http.MethodHead, location, nil, nil)); recorder.Code != http.StatusNotFound {
+		t.Errorf("HEAD after scan status = %d, want 404", recorder.Code)
+	}
+}
+
+func TestResumableUploadLimits(t *testing.T) {
+	config = &Config{MaxUploadSize: 100}
+	useUploadStore(t, NewUploadStore(1, time.Hour))
+
+	recorder := serveUploads(tusRequest(http.MethodPost, "/uploads", nil, map[string]string{"Upload-Length": "101"}))
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversize create status = %d, want 413", recorder.Code)
+	}
+
+	location := createTestUpload(t, 10, "a.txt")
+	if recorder := patchTestUpload(location, 0, make([]byte, 11)); recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversize chunk status = %d, want 413", recorder.Code)
+	}
+
+	recorder = serveUploads(tusRequest(http.MethodPost, "/uploads", nil, map[string]string{"Upload-Length": "10"}))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("create over session limit status = %d, want 503", recorder.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/uploads", nil)
+	req.Header.Set("Upload-Length", "10")
+	if recorder := serveUploads(req); recorder.Code != http.StatusPreconditionFailed {
+		t.Errorf("missing Tus-Resumable status = %d, want 412", recorder.Code)
+	}
+}
+
+func TestResumableUploadDeleteAndExpiry(t *testing.T) {
+	config = &Config{MaxUploadSize: 100}
+	store := NewUploadStore(10, time.Minute)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	useUploadStore(t, store)
+
+	deleted := createTestUpload(t, 10, "a.txt")
+	if recorder := serveUploads(tusRequest(http.MethodDelete, deleted, nil, nil)); recorder.Code != http.StatusNoContent {
+		t.Errorf("DELETE status = %d, want 204", recorder.Code)
+	}
+	if recorder := serveUploads(tusRequest(http.MethodHead, deleted, nil, nil)); recorder.Code != http.StatusNotFound {
+		t.Errorf("HEAD after DELETE status = %d, want 404", recorder.Code)
+	}
+
+	idle := createTestUpload(t, 10, "b.txt")
+	var path string
+	for _, session := range store.uploads {
+		path = session.path
+	}
+	now = now.Add(2 * time.Minute)
+	if recorder := serveUploads(tusRequest(http.MethodHead, idle, nil, nil)); recorder.Code != http.StatusNotFound {
+		t.Errorf("HEAD after expiry status = %d, want 404", recorder.Code)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expired upload data not removed: %v", err)
+	}
+}
+
+func TestResumableUploadOwner(t *testing.T) {
+	config = &Config{MaxUploadSize: 100}
+	useUploadStore(t, NewUploadStore(10, time.Hour))
+
+	location := createTestUpload(t, 10, "a.txt")
+	req := tusRequest(http.MethodHead, location, nil, nil)
+	req = req.WithContext(context.WithValue(req.Context(), identityKey{}, &Identity{Name: "other", Method: AuthMethodAPIKey}))
+	if recorder := serveUploads(req); recorder.Code != http.StatusNotFound {
+		t.Errorf("HEAD by another identity status = %d, want 404", recorder.Code)
+	}
+}
+
+func TestParseUploadMetadata(t *testing.T) {
+	got := parseUploadMetadata("filename cmVwb3J0LnppcA==,is_confidential,bad !!!")
+	if got["filename"] != "report.zip" {
+		t.Errorf("filename = %q", got["filename"])
+	}
+	if _, ok := got["is_confidential"]; !ok {
+		t.Error("key without value missing")
+	}
+	if _, ok := got["bad"]; ok {
+		t.Error("malformed value decoded")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set at build time with
+//
+//	go build -ldflags "-X main.buildVersion=1.2.3 -X main.buildCommit=abc123 -X main.buildDate=2024-01-01T00:00:00Z"
+//
+// Commit and date fall back to the VCS stamp Go embeds in builds from a git
+// checkout.
+var (
+	buildVersion = "dev"
+	buildCommit  = ""
+	buildDate    = ""
+)
+
+// VersionResponse for GET /version
+type VersionResponse struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit,omitempty"`
+	BuildDate string   `json:"build_date,omitempty"`
+	GoVersion string   `json:"go_version"`
+	Features  []string `json:"features"` // Optional features enabled on this instance
+}
+
+// buildInfo returns the service's build information
+func buildInfo() VersionResponse {
+	info := VersionResponse{
+		Version:   buildVersion,
+		Commit:    buildCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+// enabledFeatures lists the optional features turned on in this instance,
+// in a fixed order
+func enabledFeatures(config *Config) []string {
+	features := []string{}
+	for _, f := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"image_scan", imageScanner != nil},
+		{"path_scan", len(config.ScanPathRoots) > 0},
+		{"object_scan", objectScanner != nil},
+		{"remote_scan", remoteScanner != nil},
+		{"batch_scan", remoteScanner != nil || objectScanner != nil},
+		{"sanitize", config.EnableSanitize},
+		{"resumable_uploads", uploads != nil},
+		{"scan_history", history != nil},
+		{"tenants", tenants != nil},
+		{"coordinator", coordinator != nil},
+		{"signed_results", resultSigner != nil},
+		{"notifications", notifier != nil},
+		{"siem", siem != nil},
+		{"indexing", indexer != nil},
+		{"malwarebazaar", malwareBazaar != nil},
+		{"tracing", tracer != nil},
+		{"heuristic_alerts", len(config.HeuristicAlerts) > 0},
+		{"diagnostics", config.EnableDiagnostics},
+		{"test_verdicts", config.EnableTestVerdicts},
+		{"fault_injection", faults != nil},
+	} {
+		if f.enabled {
+			features = append(features, f.name)
+		}
+	}
+	return features
+}
+
+// versionHandler serves GET /version with the service's build information
+// and enabled features. ClamAV's versions are in /health.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	info := buildInfo()
+	info.Features = enabledFeatures(config)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
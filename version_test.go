@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestVersionHandler(t *testing.T) {
+	oldConfig, oldVersion, oldCommit, oldDate := config, buildVersion, buildCommit, buildDate
+	t.Cleanup(func() { config, buildVersion, buildCommit, buildDate = oldConfig, oldVersion, oldCommit, oldDate })
+	config = &Config{EnableSanitize: true, ScanPathRoots: []string{"/data"}}
+	buildVersion, buildCommit, buildDate = "1.2.3", "abc123", "2024-01-01T00:00:00Z"
+
+	recorder := httptest.NewRecorder()
+	versionHandler(recorder, httptest.NewRequest(http.MethodGet, "/version", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	var got VersionResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := VersionResponse{
+		Version:   "1.2.3",
+		Commit:    "abc123",
+		BuildDate: "2024-01-01T00:00:00Z",
+		GoVersion: runtime.Version(),
+		Features:  []string{"path_scan", "sanitize"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("response = %+v, want %+v", got, want)
+	}
+
+	recorder = httptest.NewRecorder()
+	versionHandler(recorder, httptest.NewRequest(http.MethodPost, "/version", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want %d", recorder.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestEnabledFeaturesNone(t *testing.T) {
+	if features := enabledFeatures(&Config{}); features == nil || len(features) != 0 {
+		t.Errorf("enabledFeatures() = %#v, want empty list", features)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Startup polling backoff and health check interval
+const (
+	clamdWatchBaseDelay = time.Second
+	clamdWatchInterval  = 10 * time.Second
+)
+
+// clamdStarting is set while waiting for clamd after startup. Scans are
+// rejected and /readyz reports not ready until clamd answers.
+var clamdStarting atomic.Bool
+
+// clamdStartup records the wait for clamd after startup, for /startupz
+var clamdStartup startupProgress
+
+// startupProgress is how far the wait for clamd after startup has got.
+// clamd reports nothing while it loads its signatures, so progress is the
+// time spent against the startup wait and the pings tried so far.
+type startupProgress struct {
+	mu        sync.Mutex
+	began     time.Time
+	wait      time.Duration // CLAMD_STARTUP_WAIT_SECONDS
+	attempts  int
+	lastError string
+	took      time.Duration // Time until clamd answered (0 = still waiting)
+}
+
+// begin starts recording a wait of up to wait
+func (p *startupProgress) begin(wait time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.began, p.wait, p.attempts, p.lastError, p.took = time.Now(), wait, 0, "", 0
+}
+
+// attempt records a ping of clamd and its error, if any
+func (p *startupProgress) attempt(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.attempts++
+	p.lastError = ""
+	if err != nil {
+		p.lastError = err.Error()
+	}
+}
+
+// done records that clamd answered
+func (p *startupProgress) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.took = max(time.Since(p.began), time.Millisecond)
+}
+
+// snapshot returns the progress for /startupz. A service that didn't wait
+// for clamd is reported as started.
+func (p *startupProgress) snapshot(starting bool) StartupResponse {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	resp := StartupResponse{Status: "started", Attempts: p.attempts}
+	if p.began.IsZero() {
+		return resp
+	}
+	resp.TimeoutSeconds = int(p.wait / time.Second)
+	if !starting {
+		resp.ElapsedSeconds = int(p.took / time.Second)
+		return resp
+	}
+	resp.Status = "starting"
+	resp.ElapsedSeconds = int(time.Since(p.began) / time.Second)
+	resp.LastError = p.lastError
+	return resp
+}
+
+// ClamdWatchdog waits for clamd to come up before the service takes
+// traffic, and optionally exits the process when clamd stays unreachable,
+// so the container is restarted instead of failing every scan.
+type ClamdWatchdog struct {
+	ping             func() error  // Checks that clamd answers
+	startupWait      time.Duration // Max wait for clamd on startup (0 = don't wait)
+	unreachableAfter time.Duration // Exit after clamd is down this long (0 = never)
+	baseDelay        time.Duration // First startup retry delay, doubled up to interval
+	interval         time.Duration // Health check interval once running
+	exit             func()
+}
+
+// NewClamdWatchdog creates the watchdog described by the config. Returns nil
+// when neither the startup wait nor self-healing is enabled.
+func NewClamdWatchdog(config *Config, ping func() error) *ClamdWatchdog {
+	if config.ClamdStartupWait <= 0 && config.ClamdUnreachableExit <= 0 {
+		return nil
+	}
+	return &ClamdWatchdog{
+		ping:             ping,
+		startupWait:      config.ClamdStartupWait,
+		unreachableAfter: config.ClamdUnreachableExit,
+		baseDelay:        clamdWatchBaseDelay,
+		interval:         clamdWatchInterval,
+		exit:             func() { os.Exit(1) },
+	}
+}
+
+// Start marks the service as starting and runs the watchdog in the
+// background
+func (d *ClamdWatchdog) Start() {
+	if d.startupWait > 0 {
+		clamdStartup.begin(d.startupWait)
+		clamdStarting.Store(true)
+	}
+	go d.run()
+}
+
+// run waits for clamd, then watches it
+func (d *ClamdWatchdog) run() {
+	if d.startupWait > 0 {
+		start := time.Now()
+		if err := d.WaitReady(); err != nil {
+			log.Printf("Error: %v", err)
+			d.exit()
+			return
+		}
+		clamdStartup.done()
+		clamdStarting.Store(false)
+		log.Printf("clamd ready after %v", time.Since(start).Round(time.Second))
+	}
+
+	if d.unreachableAfter > 0 {
+		d.Watch()
+	}
+}
+
+// WaitReady polls clamd with exponential backoff until it answers or the
+// startup wait elapses
+func (d *ClamdWatchdog) WaitReady() error {
+	deadline := time.Now().Add(d.startupWait)
+	delay := d.baseDelay
+	for {
+		err := d.ping()
+		clamdStartup.attempt(err)
+		if err == nil {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("clamd not ready after %v: %w", d.startupWait, err)
+		}
+		log.Printf("Waiting for clamd: %v", err)
+
+		time.Sleep(min(delay, remaining))
+		if delay *= 2; delay > d.interval {
+			delay = d.interval
+		}
+	}
+}
+
+// Watch checks clamd every interval and exits the process once it has been
+// unreachable for longer than the threshold. It only returns after exiting.
+func (d *ClamdWatchdog) Watch() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	lastOK := time.Now()
+	for range ticker.C {
+		err := d.ping()
+		if err == nil {
+			lastOK = time.Now()
+			continue
+		}
+
+		down := time.Since(lastOK)
+		if down > d.unreachableAfter {
+			log.Printf("Error: clamd unreachable for %v, exiting for restart: %v", down.Round(time.Second), err)
+			d.exit()
+			return
+		}
+		log.Printf("Warning: clamd unreachable for %v: %v", down.Round(time.Second), err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestWatchdog returns a watchdog with millisecond timings whose exit
+// is recorded instead of ending the process
+func newTestWatchdog(ping func() error, startupWait, unreachableAfter time.Duration) (*ClamdWatchdog, chan struct{}) {
+	exited := make(chan struct{})
+	return &ClamdWatchdog{
+		ping:             ping,
+		startupWait:      startupWait,
+		unreachableAfter: unreachableAfter,
+		baseDelay:        time.Millisecond,
+		interval:         5 * time.Millisecond,
+		exit:             func() { close(exited) },
+	}, exited
+}
+
+func TestNewClamdWatchdogDisabled(t *testing.T) {
+	if d := NewClamdWatchdog(&Config{}, nil); d != nil {
+		t.Error("expected nil watchdog when startup wait and self-heal are disabled")
+	}
+}
+
+func TestClamdWatchdogWaitReady(t *testing.T) {
+	var calls atomic.Int32
+	d, _ := newTestWatchdog(func() error {
+		if calls.Add(1) < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}, time.Second, 0)
+
+	if err := d.WaitReady(); err != nil {
+		t.Fatalf("WaitReady() error = %v", err)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("ping called %d times, want 3", got)
+	}
+}
+
+func TestClamdWatchdogWaitReadyTimeout(t *testing.T) {
+	d, _ := newTestWatchdog(func() error { return errors.New("connection refused") }, 20*time.Millisecond, 0)
+
+	if err := d.WaitReady(); err == nil {
+		t.Fatal("WaitReady() succeeded while clamd is down")
+	}
+}
+
+func TestClamdWatchdogStartClearsStarting(t *testing.T) {
+	d, _ := newTestWatchdog(func() error { return nil }, time.Second, 0)
+	t.Cleanup(func() { clamdStarting.Store(false) })
+
+	d.Start()
+	deadline := time.Now().Add(time.Second)
+	for clamdStarting.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("still starting after clamd answered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClamdWatchdogExitsWhenUnreachable(t *testing.T) {
+	d, exited := newTestWatchdog(func() error { return errors.New("connection refused") }, 0, 20*time.Millisecond)
+
+	go d.Watch()
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("watchdog did not exit while clamd was unreachable")
+	}
+}
+
+func TestScanRejectedWhileStarting(t *testing.T) {
+	clamdStarting.Store(true)
+	t.Cleanup(func() { clamdStarting.Store(false) })
+
+	recorder := httptest.NewRecorder()
+	handleScan(recorder, httptest.NewRequest(http.MethodPost, "/scan", nil), LoadConfig(), nil)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("scan status = %d while starting, want 503", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	readyzHandler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz status = %d while starting, want 503", recorder.Code)
+	}
+}
+
+func TestStartupzReportsProgress(t *testing.T) {
+	t.Cleanup(func() {
+		clamdStarting.Store(false)
+		clamdStartup.mu.Lock()
+		clamdStartup.began = time.Time{}
+		clamdStartup.mu.Unlock()
+	})
+
+	// Without a startup wait the service is started right away
+	recorder := httptest.NewRecorder()
+	startupzHandler(recorder, httptest.NewRequest(http.MethodGet, "/startupz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status = %d without a startup wait, want 200", recorder.Code)
+	}
+
+	d, _ := newTestWatchdog(func() error { return errors.New("connection refused") }, time.Minute, 0)
+	clamdStartup.begin(d.startupWait)
+	clamdStarting.Store(true)
+	clamdStartup.attempt(d.ping())
+	clamdStartup.attempt(d.ping())
+
+	recorder = httptest.NewRecorder()
+	startupzHandler(recorder, httptest.NewRequest(http.MethodGet, "/startupz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d while starting, want 503", recorder.Code)
+	}
+	var resp StartupResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	want := StartupResponse{Status: "starting", TimeoutSeconds: 60, Attempts: 2, LastError: "connection refused"}
+	if resp != want {
+		t.Errorf("response = %+v, want %+v", resp, want)
+	}
+
+	clamdStartup.attempt(nil)
+	clamdStartup.done()
+	clamdStarting.Store(false)
+	recorder = httptest.NewRecorder()
+	startupzHandler(recorder, httptest.NewRequest(http.MethodGet, "/startupz", nil))
+	resp = StartupResponse{}
+	json.NewDecoder(recorder.Body).Decode(&resp)
+	if recorder.Code != http.StatusOK || resp.Status != "started" || resp.Attempts != 3 || resp.LastError != "" {
+		t.Errorf("after clamd answered: status %d, response %+v", recorder.Code, resp)
+	}
+}
+
+func TestLivezIgnoresClamd(t *testing.T) {
+	clamdStarting.Store(true)
+	t.Cleanup(func() { clamdStarting.Store(false) })
+
+	recorder := httptest.NewRecorder()
+	livezHandler(recorder, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("livez status = %d while starting, want 200", recorder.Code)
+	}
+}
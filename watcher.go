@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// infectedSuffix marks infected files flagged in place
+const infectedSuffix = ".infected"
+
+// DirWatcher scans files dropped into watched directories, such as SFTP
+// landing zones. The directories are polled rather than watched with
+// inotify, which misses changes on network file systems; a file is scanned
+// once its size and modification time have not changed for one interval,
+// so uploads still in progress are left alone.
+type DirWatcher struct {
+	config   *Config
+	scanner  *Scanner
+	dirs     []string
+	interval time.Duration
+	files    map[string]*watchedFile // Files seen in the last poll, by path
+}
+
+// watchedFile is the state of a file between polls
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	done    bool // Scanned (or skipped) in this state
+}
+
+// NewDirWatcher creates a watcher for the configured directories. Returns
+// nil when no directories are configured.
+func NewDirWatcher(config *Config, scanner *Scanner) (*DirWatcher, error) {
+	if len(config.WatchDirs) == 0 {
+		return nil, nil
+	}
+	for _, dir := range config.WatchDirs {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, fmt.Errorf("watched directory: %w", err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("watched directory %s is not a directory", dir)
+		}
+	}
+	return &DirWatcher{
+		config:   config,
+		scanner:  scanner,
+		dirs:     absPaths(config.WatchDirs),
+		interval: config.WatchInterval,
+		files:    make(map[string]*watchedFile),
+	}, nil
+}
+
+// Start polls the directories in the background
+func (w *DirWatcher) Start() {
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			w.Poll(context.Background())
+		}
+	}()
+}
+
+// Poll checks the directories once and scans the files that have settled
+// since the previous poll
+func (w *DirWatcher) Poll(ctx context.Context) {
+	if clamdStarting.Load() {
+		return
+	}
+	seen := make(map[string]*watchedFile)
+	for _, dir := range w.dirs {
+		filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if path == dir {
+					log.Printf("Failed to read watched directory %s: %v", dir, err)
+				}
+				return nil
+			}
+			name := entry.Name()
+			if path != dir && strings.HasPrefix(name, ".") {
+				// Hidden files are usually uploads in progress
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !entry.Type().IsRegular() || strings.HasSuffix(name, infectedSuffix) {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil
+			}
+
+			file := w.files[path]
+			if file == nil || file.size != info.Size() || !file.modTime.Equal(info.ModTime()) {
+				// New or still being written
+				seen[path] = &watchedFile{size: info.Size(), modTime: info.ModTime()}
+				return nil
+			}
+			seen[path] = file
+			if !file.done {
+				file.done = w.scan(ctx, dir, path, info.Size())
+			}
+			return nil
+		})
+	}
+	w.files = seen
+}
+
+// scan scans a settled file and moves or flags it by verdict. Returns false
+// if the scan should be retried on the next poll.
+func (w *DirWatcher) scan(ctx context.Context, dir, path string, size int64) bool {
+	startTime := time.Now()
+	r := backgroundRequest(ctx, dir)
+	file := &uploadedFile{path: path, filename: path, safeFilename: sanitizeFilename(path), size: size}
+
+	if size > w.config.MaxUploadSize {
+		log.Printf("Watched file %s exceeds the upload size limit, skipping", file.safeFilename)
+		recordScan(scanTags(r), "rejected", time.Since(startTime), size, nil)
+		return true
+	}
+
+	result, err := runScan(ctx, w.scanner, path)
+	if errors.Is(err, errQueueFull) || errors.Is(err, errCircuitOpen) || errors.Is(err, errClamdUnavailable) {
+		// Retried on the next poll
+		return false
+	}
+	if err != nil {
+		// Left in place, and scanned again if it changes
+		log.Printf("Scan failed for watched file %s: %v", file.safeFilename, err)
+		recordScan(scanTags(r), "error", time.Since(startTime), size, nil)
+		indexScan(r, file, &ScanResponse{Status: "error", Error: "Scan operation failed", ScanTimeMs: time.Since(startTime).Milliseconds()})
+		return true
+	}
+
+	status := cleanStatus(result.Skipped)
+	if len(result.Threats) > 0 {
+		status = "infected"
+	}
+	response := &ScanResponse{
+		Status:       status,
+		Threats:      result.Threats,
+		ScannedFiles: result.ScannedFiles,
+		ScanTimeMs:   time.Since(startTime).Milliseconds(),
+		Files:        result.Files,
+		Indicators:   result.Indicators,
+	}
+	response.setSummary(result)
+	if hashes, err := computeFileHashes(path, w.config.HashAlgorithms); err == nil {
+		response.Hashes = hashes
+	}
+
+	// Infected files are quarantined or flagged; clean ones are moved on
+	target := ""
+	rel, _ := filepath.Rel(dir, path)
+	switch {
+	case status == "infected" && w.config.WatchQuarantineDir != "":
+		target = filepath.Join(w.config.WatchQuarantineDir, rel)
+	case status == "infected":
+		target = path + infectedSuffix
+	case w.config.WatchCleanDir != "":
+		target = filepath.Join(w.config.WatchCleanDir, rel)
+	}
+	if target != "" {
+		moved, err := moveFile(path, target)
+		if err != nil {
+			log.Printf("Failed to move watched file %s: %v", file.safeFilename, err)
+		} else {
+			file.path = moved
+			if status == "infected" && w.config.WatchQuarantineDir != "" {
+				// Quarantine retention counts from the move, not the upload
+				now := time.Now()
+				os.Chtimes(moved, now, now)
+			}
+		}
+	}
+
+	log.Printf("Watched file scanned: %s - %s (%d threats, %d files, %dms)",
+		file.safeFilename, status, len(result.Threats), result.ScannedFiles, response.ScanTimeMs)
+	recordScan(scanTags(r), status, time.Since(startTime), size, result)
+	if status == "infected" {
+		reportDetection(r, file, result.Threats)
+	}
+	indexScan(r, file, response)
+	return true
+}
+
+// backgroundRequest stands in for the HTTP request when reporting a scan
+// the service started itself: the route is the directory scanned and there
+// is no client
+func backgroundRequest(ctx context.Context, dir string) *http.Request {
+	r := &http.Request{Method: http.MethodPost, URL: &url.URL{Path: dir}, Header: make(http.Header)}
+	return r.WithContext(ctx)
+}
+
+// moveFile moves a file to target, creating its directory, and returns the
+// path it ended up at. An existing file is not replaced; a timestamp is
+// added before the extension instead. Files are copied across file systems.
+func moveFile(path, target string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(target); err == nil {
+		ext := filepath.Ext(target)
+		target = strings.TrimSuffix(target, ext) + "-" + strconv.FormatInt(time.Now().UnixNano(), 10) + ext
+	}
+
+	err := os.Rename(path, target)
+	if !errors.Is(err, syscall.EXDEV) {
+		return target, err
+	}
+	if err := copyFile(path, target); err != nil {
+		os.Remove(target)
+		return "", err
+	}
+	return target, os.Remove(path)
+}
+
+// copyFile copies a file's contents and permissions
+func copyFile(path, target string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// absPath returns the absolute form of path, or path if it can't be made
+// absolute
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// absPaths returns the absolute form of each path
+func absPaths(paths []string) []string {
+	abs := make([]string, len(paths))
+	for i, path := range paths {
+		abs[i] = absPath(path)
+	}
+	return abs
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useDirWatcher creates a watcher for dir with the fake clamd
+func useDirWatcher(t *testing.T, dir string, configure func(*Config)) *DirWatcher {
+	t.Helper()
+	cfg := useFakeClamdScanner(t)
+	cfg.WatchDirs = []string{dir}
+	cfg.WatchInterval = time.Second
+	if configure != nil {
+		configure(cfg)
+	}
+	w, err := NewDirWatcher(cfg, NewScanner(cfg))
+	if err != nil {
+		t.Fatalf("NewDirWatcher() error: %v", err)
+	}
+	return w
+}
+
+func TestDirWatcherFlagsInPlace(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "partner"), 0755)
+	writeTestFile(t, filepath.Join(dir, "partner", "orders.csv"), "id,total")
+	writeTestFile(t, filepath.Join(dir, "partner", "payload.exe"), "EICAR test")
+	writeTestFile(t, filepath.Join(dir, ".upload.part"), "EICAR in progress")
+	w := useDirWatcher(t, dir, nil)
+
+	// Files are only scanned once they have settled
+	w.Poll(context.Background())
+	if _, err := os.Stat(filepath.Join(dir, "partner", "payload.exe")); err != nil {
+		t.Fatalf("file handled before it settled: %v", err)
+	}
+
+	w.Poll(context.Background())
+	files := readTree(t, dir)
+	want := map[string]string{
+		"partner/orders.csv":           "id,total",
+		"partner/payload.exe.infected": "EICAR test",
+		".upload.part":                 "EICAR in progress",
+	}
+	if len(files) != len(want) {
+		t.Errorf("files = %v, want %v", files, want)
+	}
+	for name, content := range want {
+		if files[name] != content {
+			t.Errorf("%s = %q, want %q", name, files[name], content)
+		}
+	}
+
+	// Clean files left in place are not scanned again until they change
+	if !w.files[filepath.Join(dir, "partner", "orders.csv")].done {
+		t.Error("clean file should be marked scanned")
+	}
+	w.Poll(context.Background())
+	writeTestFile(t, filepath.Join(dir, "partner", "orders.csv"), "id,total,EICAR")
+	w.Poll(context.Background())
+	w.Poll(context.Background())
+	if _, err := os.Stat(filepath.Join(dir, "partner", "orders.csv.infected")); err != nil {
+		t.Errorf("changed file was not scanned again: %v", err)
+	}
+}
+
+func TestDirWatcherMovesFiles(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "incoming")
+	quarantine := filepath.Join(base, "quarantine")
+	clean := filepath.Join(base, "clean")
+	os.Mkdir(dir, 0755)
+	os.MkdirAll(filepath.Join(quarantine, "sub"), 0755)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	writeTestFile(t, filepath.Join(dir, "sub", "report.pdf"), "report")
+	writeTestFile(t, filepath.Join(dir, "sub", "invoice.exe"), "EICAR test")
+	writeTestFile(t, filepath.Join(quarantine, "sub", "invoice.exe"), "earlier detection")
+
+	logPath := filepath.Join(base, "audit.log")
+	a, err := NewAuditLogger(&Config{AuditLogFile: logPath})
+	if err != nil {
+		t.Fatalf("NewAuditLogger() error: %v", err)
+	}
+	auditLog = a
+	t.Cleanup(func() { auditLog = nil })
+
+	w := useDirWatcher(t, dir, func(cfg *Config) {
+		cfg.WatchQuarantineDir = quarantine
+		cfg.WatchCleanDir = clean
+	})
+	w.Poll(context.Background())
+	w.Poll(context.Background())
+
+	if files := readTree(t, dir); len(files) != 0 {
+		t.Errorf("watched directory still holds %v", files)
+	}
+	if files := readTree(t, clean); files["sub/report.pdf"] != "report" {
+		t.Errorf("clean directory = %v", files)
+	}
+	quarantined := readTree(t, quarantine)
+	if len(quarantined) != 2 || quarantined["sub/invoice.exe"] != "earlier detection" {
+		t.Errorf("quarantine = %v, want the existing file kept", quarantined)
+	}
+
+	// The detection is reported with the file's new location
+	f, err := os.Open(logPath)
+	if err != nil {
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+	defer f.Close()
+	lines := bufio.NewScanner(f)
+	if !lines.Scan() {
+		t.Fatal("no detection recorded")
+	}
+	var record AuditRecord
+	json.Unmarshal(lines.Bytes(), &record)
+	if record.Route != dir || record.Filename != filepath.Join(dir, "sub", "invoice.exe") || len(record.Threats) != 1 {
+		t.Errorf("record = %+v", record)
+	}
+	if record.FileSHA256 == "" {
+		t.Error("record should carry the hash of the moved file")
+	}
+}
+
+func TestNewDirWatcher(t *testing.T) {
+	if w, err := NewDirWatcher(&Config{}, nil); w != nil || err != nil {
+		t.Errorf("NewDirWatcher() = %v, %v; want disabled", w, err)
+	}
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "file"), "text")
+	for _, invalid := range []string{filepath.Join(dir, "missing"), filepath.Join(dir, "file")} {
+		if _, err := NewDirWatcher(&Config{WatchDirs: []string{invalid}}, nil); err == nil {
+			t.Errorf("NewDirWatcher(%s) should fail", invalid)
+		}
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "a.txt"), "first")
+	writeTestFile(t, filepath.Join(dir, "b.txt"), "second")
+
+	moved, err := moveFile(filepath.Join(dir, "a.txt"), filepath.Join(dir, "out", "a.txt"))
+	if err != nil || moved != filepath.Join(dir, "out", "a.txt") {
+		t.Fatalf("moveFile() = %s, %v", moved, err)
+	}
+
+	// An existing file is kept; the moved one gets a unique name
+	moved, err = moveFile(filepath.Join(dir, "b.txt"), filepath.Join(dir, "out", "a.txt"))
+	if err != nil || filepath.Ext(moved) != ".txt" || moved == filepath.Join(dir, "out", "a.txt") {
+		t.Fatalf("moveFile() = %s, %v", moved, err)
+	}
+	if files := readTree(t, dir); len(files) != 2 || files["out/a.txt"] != "first" {
+		t.Errorf("files = %v", files)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes (RFC 6455)
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// WebSocket close codes (RFC 6455)
+const (
+	wsCloseNormal          = 1000
+	wsCloseProtocolError   = 1002
+	wsClosePolicyViolation = 1008
+	wsCloseTooBig          = 1009
+	wsCloseInternalError   = 1011
+	wsCloseTryAgainLater   = 1013
+)
+
+// Appended to the client's key to compute Sec-WebSocket-Accept
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket timeouts
+const (
+	wsReadTimeout  = time.Minute // Max wait for the client's next frame
+	wsWriteTimeout = 30 * time.Second
+	wsCloseTimeout = 2 * time.Second // Wait for the client's close frame
+)
+
+// errWebSocketClosed is returned by ReadMessage once the client closed the connection
+var errWebSocketClosed = errors.New("websocket closed by client")
+
+// WebSocketConn is a server-side WebSocket connection. Reads are not safe for
+// concurrent use; writes are.
+type WebSocketConn struct {
+	conn       net.Conn
+	br         *bufio.Reader
+	maxMessage int64 // Largest message ReadMessage accepts
+
+	mu        sync.Mutex // Serializes writes
+	closeSent bool
+}
+
+// isWebSocketUpgrade reports whether the request asks to switch to WebSocket
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+// headerHasToken reports whether a comma-separated header contains token
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// websocketAccept computes the Sec-WebSocket-Accept value for a client key
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// upgradeWebSocket completes the WebSocket handshake and takes over the
+// connection. On failure it sends an error response and returns nil.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, maxMessage int64) *WebSocketConn {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	if !isWebSocketUpgrade(r) || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		sendErrorStatus(w, http.StatusUpgradeRequired, "WebSocket upgrade required")
+		return nil
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		sendErrorStatus(w, http.StatusBadRequest, "Invalid Sec-WebSocket-Key")
+		return nil
+	}
+
+	// Hijacking fails on HTTP/2 connections, which only carry WebSockets
+	// with extended CONNECT (RFC 8441)
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		sendErrorStatus(w, http.StatusHTTPVersionNotSupported, "WebSocket requires HTTP/1.1")
+		return nil
+	}
+
+	// The server's read and write timeouts no longer apply
+	conn.SetDeadline(time.Time{})
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", websocketAccept(key))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil
+	}
+	return &WebSocketConn{conn: conn, br: rw.Reader, maxMessage: maxMessage}
+}
+
+// WebSocketError is a protocol violation by the client, closed with Code
+type WebSocketError struct {
+	Code   int
+	Reason string
+}
+
+func (e *WebSocketError) Error() string {
+	return fmt.Sprintf("websocket error %d: %s", e.Code, e.Reason)
+}
+
+// readFrame reads one frame and unmasks its payload
+func (c *WebSocketConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	c.conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0f
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, &WebSocketError{wsCloseProtocolError, "reserved bits set"}
+	}
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, &WebSocketError{wsCloseProtocolError, "client frames must be masked"}
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsClose && (length > 125 || !fin) {
+		return false, 0, nil, &WebSocketError{wsCloseProtocolError, "invalid control frame"}
+	}
+	if length > uint64(c.maxMessage) {
+		return false, 0, nil, &WebSocketError{wsCloseTooBig, "message too large"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// ReadMessage reads the next text or binary message, joining fragments.
+// Pings are answered and pongs skipped. Returns errWebSocketClosed after
+// the client's close frame has been acknowledged.
+func (c *WebSocketConn) ReadMessage() (opcode byte, data []byte, err error) {
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case wsPing:
+			if err := c.WriteMessage(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			// Echo the status code and stop reading
+			c.mu.Lock()
+			if !c.closeSent {
+				c.closeSent = true
+				c.writeFrame(wsClose, payload[:min(len(payload), 2)])
+			}
+			c.mu.Unlock()
+			return 0, nil, errWebSocketClosed
+		case wsContinuation:
+			if opcode == 0 {
+				return 0, nil, &WebSocketError{wsCloseProtocolError, "unexpected continuation frame"}
+			}
+		case wsText, wsBinary:
+			if opcode != 0 {
+				return 0, nil, &WebSocketError{wsCloseProtocolError, "expected continuation frame"}
+			}
+			opcode = op
+		default:
+			return 0, nil, &WebSocketError{wsCloseProtocolError, "unknown opcode"}
+		}
+
+		if int64(len(data)+len(payload)) > c.maxMessage {
+			return 0, nil, &WebSocketError{wsCloseTooBig, "message too large"}
+		}
+		data = append(data, payload...)
+		if fin {
+			return opcode, data, nil
+		}
+	}
+}
+
+// writeFrame sends one unmasked frame. Callers hold c.mu.
+func (c *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, 126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 127), uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// WriteMessage sends a message or control frame
+func (c *WebSocketConn) WriteMessage(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	return c.writeFrame(opcode, payload)
+}
+
+// WriteJSON sends v as a text message
+func (c *WebSocketConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(wsText, data)
+}
+
+// KeepAlive pings the client every interval until stop is called, so
+// proxies don't drop a connection that is quiet during a long scan
+func (c *WebSocketConn) KeepAlive(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.WriteMessage(wsPing, nil)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Close sends a close frame with code and reason and closes the connection.
+// It first waits briefly for the client's close frame: closing with unread
+// data would reset the connection and could lose the final messages.
+func (c *WebSocketConn) Close(code int, reason string) error {
+	c.mu.Lock()
+	alreadySent := c.closeSent
+	if !alreadySent {
+		c.closeSent = true
+		payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+		c.writeFrame(wsClose, append(payload, reason...))
+	}
+	c.mu.Unlock()
+
+	if !alreadySent {
+		c.conn.SetReadDeadline(time.Now().Add(wsCloseTimeout))
+		io.Copy(io.Discard, c.br)
+	}
+	return c.conn.Close()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testWebSocketClient is the client end of a WebSocket for tests
+type testWebSocketClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// dialTestWebSocket opens a WebSocket to path on an httptest server
+func dialTestWebSocket(t *testing.T, serverURL, path string, header http.Header) (*testWebSocketClient, *http.Response) {
+	t.Helper()
+	u, _ := url.Parse(serverURL)
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n", path, u.Host)
+	for name, values := range header {
+		for _, value := range values {
+			fmt.Fprintf(conn, "%s: %s\r\n", name, value)
+		}
+	}
+	fmt.Fprint(conn, "\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse() error: %v", err)
+	}
+	return &testWebSocketClient{conn: conn, br: br}, resp
+}
+
+// send writes one masked frame
+func (c *testWebSocketClient) send(fin bool, opcode byte, payload []byte) error {
+	return writeMaskedFrame(c.conn, fin, opcode, payload)
+}
+
+// sendJSON sends v as a text message
+func (c *testWebSocketClient) sendJSON(v interface{}) error {
+	data, _ := json.Marshal(v)
+	return c.send(true, wsText, data)
+}
+
+// read reads one unmasked server frame
+func (c *testWebSocketClient) read() (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return 0, nil, err
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.br, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return 0, nil, err
+	}
+	return head[0] & 0x0f, payload, nil
+}
+
+// readMessage reads the next JSON message, skipping pings. A close frame
+// returns a zero message with ok false.
+func (c *testWebSocketClient) readMessage(t *testing.T) (msg SocketMessage, ok bool) {
+	t.Helper()
+	for {
+		opcode, payload, err := c.read()
+		if err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		switch opcode {
+		case wsPing:
+			continue
+		case wsClose:
+			return SocketMessage{}, false
+		}
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			t.Fatalf("invalid message %q: %v", payload, err)
+		}
+		return msg, true
+	}
+}
+
+// writeMaskedFrame writes a client frame with a fixed mask
+func writeMaskedFrame(conn net.Conn, fin bool, opcode byte, payload []byte) error {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 0x80|127), uint64(n))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := conn.Write(frame)
+	return err
+}
+
+// pipeWebSocket returns a server WebSocketConn and the raw client end
+func pipeWebSocket(t *testing.T, maxMessage int64) (*WebSocketConn, net.Conn) {
+	server, client := net.Pipe()
+	t.Cleanup(func() { server.Close(); client.Close() })
+	return &WebSocketConn{conn: server, br: bufio.NewReader(server), maxMessage: maxMessage}, client
+}
+
+func TestWebSocketAccept(t *testing.T) {
+	// Example from RFC 6455 section 1.3
+	if got := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("websocketAccept() = %q", got)
+	}
+}
+
+func TestWebSocketReadMessageFragments(t *testing.T) {
+	ws, client := pipeWebSocket(t, 64)
+	clientReader := bufio.NewReader(client)
+
+	go func() {
+		writeMaskedFrame(client, false, wsBinary, []byte("hello "))
+		writeMaskedFrame(client, true, wsPing, []byte("p"))
+		writeMaskedFrame(client, true, wsContinuation, []byte("world"))
+	}()
+
+	// The ping is answered while the message is being joined
+	pong := make(chan []byte, 1)
+	go func() {
+		var frame [3]byte
+		io.ReadFull(clientReader, frame[:])
+		pong <- frame[:]
+	}()
+
+	opcode, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() error: %v", err)
+	}
+	if opcode != wsBinary || string(data) != "hello world" {
+		t.Errorf("ReadMessage() = %d %q, want binary \"hello world\"", opcode, data)
+	}
+	if got := <-pong; got[0] != 0x80|wsPong || string(got[2:]) != "p" {
+		t.Errorf("pong frame = %x", got)
+	}
+}
+
+func TestWebSocketReadMessageErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(net.Conn)
+		code  int
+	}{
+		{"unmasked", func(c net.Conn) { c.Write([]byte{0x82, 0x01, 'x'}) }, wsCloseProtocolError},
+		{"too large", func(c net.Conn) { writeMaskedFrame(c, true, wsBinary, make([]byte, 65)) }, wsCloseTooBig},
+		{"stray continuation", func(c net.Conn) { writeMaskedFrame(c, true, wsContinuation, []byte("x")) }, wsCloseProtocolError},
+		{"fragmented ping", func(c net.Conn) { writeMaskedFrame(c, false, wsPing, nil) }, wsCloseProtocolError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, client := pipeWebSocket(t, 64)
+			go tt.write(client)
+
+			_, _, err := ws.ReadMessage()
+			var wsErr *WebSocketError
+			if !errors.As(err, &wsErr) || wsErr.Code != tt.code {
+				t.Errorf("ReadMessage() error = %v, want close code %d", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestWebSocketReadMessageClose(t *testing.T) {
+	ws, client := pipeWebSocket(t, 64)
+	go writeMaskedFrame(client, true, wsClose, []byte{0x03, 0xe8})
+
+	echo := make(chan []byte, 1)
+	go func() {
+		frame := make([]byte, 4)
+		io.ReadFull(client, frame)
+		echo <- frame
+	}()
+
+	if _, _, err := ws.ReadMessage(); err != errWebSocketClosed {
+		t.Fatalf("ReadMessage() error = %v, want errWebSocketClosed", err)
+	}
+	if got := <-echo; got[0] != 0x80|wsClose || binary.BigEndian.Uint16(got[2:]) != wsCloseNormal {
+		t.Errorf("close echo = %x", got)
+	}
+	if err := ws.WriteMessage(wsText, []byte("late")); err == nil {
+		t.Error("WriteMessage() after close succeeded")
+	}
+}
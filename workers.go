@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// errQueueFull is returned when no queue slot frees up within the wait limit
+var errQueueFull = errors.New("scan queue full")
+
+// errScanPanic is returned for a scan that panicked on a worker
+var errScanPanic = errors.New("scan panicked")
+
+// Scan job states
+const (
+	jobQueued int32 = iota
+	jobRunning
+	jobCancelled
+)
+
+// scanJob is a scan waiting for or running on a worker
+type scanJob struct {
+	ctx      context.Context
+	run      func(ctx context.Context)
+	enqueued time.Time
+	state    atomic.Int32
+	done     chan struct{}
+	err      error // Set if run panicked
+}
+
+// WorkerPool runs scans on a fixed number of workers fed by a bounded
+// queue, so the number of concurrent clamdscan processes and temp files
+// stays predictable under load.
+type WorkerPool struct {
+	jobs      chan *scanJob
+	queueWait time.Duration // How long to wait for a queue slot before rejecting
+	busy      atomic.Int64  // Workers currently scanning
+}
+
+// Global scan worker pool (nil = scans run on the request goroutine)
+var scanPool *WorkerPool
+
+// NewWorkerPool starts the workers. Returns nil when workers is not
+// positive (unbounded concurrency).
+func NewWorkerPool(workers, queueSize int, queueWait time.Duration) *WorkerPool {
+	if workers <= 0 {
+		return nil
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	p := &WorkerPool{
+		jobs:      make(chan *scanJob, queueSize),
+		queueWait: queueWait,
+	}
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+// worker runs queued jobs. Jobs whose request was cancelled while queued
+// are skipped.
+func (p *WorkerPool) worker() {
+	for job := range p.jobs {
+		metrics.Gauge("scan.queue_depth", float64(len(p.jobs)))
+		if !job.state.CompareAndSwap(jobQueued, jobRunning) {
+			continue
+		}
+		metrics.Timing("scan.queue_wait", time.Since(job.enqueued))
+
+		p.busy.Add(1)
+		p.runJob(job)
+		p.busy.Add(-1)
+		close(job.done)
+	}
+}
+
+// runJob runs a job, turning a panic into the job's error so one bad scan
+// doesn't take the whole service down with it
+func (p *WorkerPool) runJob(job *scanJob) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("Panic in scan worker: %v\n%s", v, debug.Stack())
+			metrics.Count("http.panics", 1)
+			job.err = fmt.Errorf("%w: %v", errScanPanic, v)
+		}
+	}()
+	job.run(job.ctx)
+}
+
+// Submit queues run and waits for it to finish. It returns errQueueFull if
+// no queue slot frees up within the wait limit, or the context error if the
+// request is cancelled while queued.
+func (p *WorkerPool) Submit(ctx context.Context, run func(ctx context.Context)) error {
+	job := &scanJob{ctx: ctx, run: run, enqueued: time.Now(), done: make(chan struct{})}
+
+	select {
+	case p.jobs <- job:
+	default:
+		// Queue is full: wait a bounded time for a slot
+		timer := time.NewTimer(p.queueWait)
+		defer timer.Stop()
+		select {
+		case p.jobs <- job:
+		case <-timer.C:
+			metrics.Count("scan.queue_rejected", 1)
+			return errQueueFull
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	metrics.Gauge("scan.queue_depth", float64(len(p.jobs)))
+
+	select {
+	case <-job.done:
+		return job.err
+	case <-ctx.Done():
+		if job.state.CompareAndSwap(jobQueued, jobCancelled) {
+			return ctx.Err()
+		}
+		// A running scan observes ctx and ends shortly; wait so its results
+		// are not written after we return
+		<-job.done
+		if job.err != nil {
+			return job.err
+		}
+		return ctx.Err()
+	}
+}
+
+// QueueDepth returns the number of scans waiting for a worker
+func (p *WorkerPool) QueueDepth() int {
+	return len(p.jobs)
+}
+
+// Busy returns the number of workers currently scanning
+func (p *WorkerPool) Busy() int {
+	return int(p.busy.Load())
+}
+
+// runScan scans the file on the worker pool, or directly if there is none
+func runScan(ctx context.Context, scanner *Scanner, path string) (*ScanResult, error) {
+	return runPooled(ctx, func(ctx context.Context) (*ScanResult, error) {
+		return scanner.ScanFile(ctx, path)
+	})
+}
+
+// scanUpload scans an upload on the worker pool: its file, or the entries
+// extracted while it was received
+func scanUpload(ctx context.Context, scanner *Scanner, upload *uploadedFile) (*ScanResult, error) {
+	if upload.dir == "" {
+		return runScan(ctx, scanner, upload.path)
+	}
+	return runPooled(ctx, func(ctx context.Context) (*ScanResult, error) {
+		return scanner.ScanExtracted(ctx, upload.dir, upload.fileCount, upload.entries, upload.skipped)
+	})
+}
+
+// runPooled runs a scan on the worker pool, or directly if there is none
+func runPooled(ctx context.Context, scan func(ctx context.Context) (*ScanResult, error)) (*ScanResult, error) {
+	if scanPool == nil {
+		return scan(ctx)
+	}
+
+	var result *ScanResult
+	var scanErr error
+	if err := scanPool.Submit(ctx, func(ctx context.Context) {
+		result, scanErr = scan(ctx)
+	}); err != nil {
+		return nil, err
+	}
+	return result, scanErr
+}
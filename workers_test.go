@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewWorkerPoolDisabled(t *testing.T) {
+	if p := NewWorkerPool(0, 10, time.Second); p != nil {
+		t.Error("expected nil pool for zero workers")
+	}
+}
+
+func TestWorkerPoolLimitsConcurrency(t *testing.T) {
+	p := NewWorkerPool(2, 10, time.Second)
+
+	var running, peak atomic.Int32
+	done := make(chan struct{})
+	for i := 0; i < 6; i++ {
+		go func() {
+			p.Submit(context.Background(), func(ctx context.Context) {
+				n := running.Add(1)
+				for {
+					old := peak.Load()
+					if n <= old || peak.CompareAndSwap(old, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				running.Add(-1)
+			})
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 6; i++ {
+		<-done
+	}
+
+	if got := peak.Load(); got > 2 {
+		t.Errorf("peak concurrency = %d, want at most 2", got)
+	}
+}
+
+func TestWorkerPoolQueueFull(t *testing.T) {
+	p := NewWorkerPool(1, 0, 50*time.Millisecond)
+
+	// Occupy the only worker
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go p.Submit(context.Background(), func(ctx context.Context) {
+		close(started)
+		<-release
+	})
+	<-started
+	defer close(release)
+
+	start := time.Now()
+	err := p.Submit(context.Background(), func(ctx context.Context) {
+		t.Error("rejected job should not run")
+	})
+	if !errors.Is(err, errQueueFull) {
+		t.Fatalf("Submit() error = %v, want errQueueFull", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("rejected after %v, want to wait for the queue timeout", waited)
+	}
+}
+
+func TestWorkerPoolCancelWhileQueued(t *testing.T) {
+	p := NewWorkerPool(1, 1, time.Second)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go p.Submit(context.Background(), func(ctx context.Context) {
+		close(started)
+		<-release
+	})
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var ran atomic.Bool
+	result := make(chan error, 1)
+	go func() {
+		result <- p.Submit(ctx, func(ctx context.Context) { ran.Store(true) })
+	}()
+
+	// Wait until the job is queued, then cancel: Submit must return
+	// without waiting for the busy worker
+	for p.QueueDepth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Submit() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Submit did not return after cancellation")
+	}
+
+	close(release)
+	// Let the worker drain the cancelled job
+	for p.QueueDepth() > 0 || p.Busy() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if ran.Load() {
+		t.Error("cancelled job should be skipped")
+	}
+}
+
+func TestWorkerPoolRecoversPanic(t *testing.T) {
+	scanPool = NewWorkerPool(1, 1, time.Second)
+	defer func() { scanPool = nil }()
+
+	_, err := runPooled(context.Background(), func(ctx context.Context) (*ScanResult, error) {
+		panic("boom")
+	})
+	if !errors.Is(err, errScanPanic) {
+		t.Fatalf("runPooled() error = %v, want errScanPanic", err)
+	}
+
+	// The worker survives and is free for the next scan
+	if busy := scanPool.Busy(); busy != 0 {
+		t.Errorf("Busy() = %d after the panic, want 0", busy)
+	}
+	result, err := runPooled(context.Background(), func(ctx context.Context) (*ScanResult, error) {
+		return &ScanResult{}, nil
+	})
+	if err != nil || result == nil {
+		t.Errorf("runPooled() after a panic = %v, %v", result, err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"hash/crc32"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// infoZipUnicodePathID is the extra field in which Info-ZIP, WinRAR and
+// others store the UTF-8 name of an entry whose header name is in a legacy
+// code page
+const infoZipUnicodePathID = 0x7075
+
+// cp437 maps the upper half of IBM code page 437, the encoding the ZIP
+// specification assumes for names without the UTF-8 flag
+var cp437 = []rune("ÇüéâäàåçêëèïîìÄÅÉæÆôöòûùÿÖÜ¢£¥₧ƒáíóúñÑªº¿⌐¬½¼¡«»" +
+	"░▒▓│┤╡╢╖╕╣║╗╝╜╛┐└┴┬├─┼╞╟╚╔╩╦╠═╬╧╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀" +
+	"αßΓπΣσµτΦΘΩδ∞φε∩≡±≥≤⌠⌡÷≈°∙·√ⁿ²■\u00a0")
+
+// zipEntryName returns the name of a ZIP entry as UTF-8: the Info-ZIP
+// Unicode path if present and current, the header name if it is valid
+// UTF-8 (whether or not the UTF-8 flag is set, as macOS and older Windows
+// archivers omit it), and otherwise the header name decoded as CP437
+func zipEntryName(file *zip.File) string {
+	if name, ok := unicodePathExtra(file.Extra, file.Name); ok {
+		return normalizeEntryName(name)
+	}
+	return normalizeEntryName(file.Name)
+}
+
+// normalizeEntryName makes an archive entry name safe to extract and
+// report: legacy bytes are decoded as CP437, backslash separators become
+// slashes, and the characters cleanName removes are replaced with U+FFFD
+func normalizeEntryName(name string) string {
+	if !utf8.ValidString(name) {
+		name = decodeCP437(name)
+	}
+	return cleanName(strings.ReplaceAll(name, `\`, "/"), utf8.RuneError)
+}
+
+// cleanName replaces the characters of a client-controlled name that could
+// inject lines into logs, headers and clamd's line-based output, or disguise
+// the name where it is shown: control characters, line and paragraph
+// separators, format characters such as the bidi overrides that turn
+// "fdp.exe" into "exe.pdf" on screen, and invalid UTF-8
+func cleanName(name string, replacement rune) string {
+	return strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) || unicode.In(r, unicode.Cf, unicode.Zl, unicode.Zp) {
+			return replacement
+		}
+		return r
+	}, name)
+}
+
+// reportedName returns a client-supplied name as results, records and
+// notifications report it
+func reportedName(name string) string {
+	return cleanName(name, utf8.RuneError)
+}
+
+// truncateName shortens a name to at most n bytes plus "...", without
+// splitting a character
+func truncateName(name string, n int) string {
+	if len(name) <= n {
+		return name
+	}
+	for n > 0 && !utf8.RuneStart(name[n]) {
+		n--
+	}
+	return name[:n] + "..."
+}
+
+// Longest path element most file systems accept (NAME_MAX)
+const maxEntryNameLength = 255
+
+// entryPathTooLong reports whether an entry can't be extracted under its
+// name: the path is longer than limit bytes (0 = unlimited), or one of its
+// elements is longer than file systems allow
+func entryPathTooLong(name string, limit int) bool {
+	if limit > 0 && len(name) > limit {
+		return true
+	}
+	for _, element := range strings.Split(name, "/") {
+		if len(element) > maxEntryNameLength {
+			return true
+		}
+	}
+	return false
+}
+
+// shortenElement shortens a file name longer than file systems allow to
+// maxEntryNameLength bytes, keeping its extension so the part is still
+// recognized as what it claims to be
+func shortenElement(name string) string {
+	if len(name) <= maxEntryNameLength {
+		return name
+	}
+	ext := path.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	n := maxEntryNameLength - len(ext)
+	for n > 0 && !utf8.RuneStart(name[n]) {
+		n--
+	}
+	return name[:n] + ext
+}
+
+// decodeCP437 decodes a CP437 string to UTF-8
+func decodeCP437(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) * 2)
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x80 {
+			b.WriteByte(c)
+		} else {
+			b.WriteRune(cp437[c-0x80])
+		}
+	}
+	return b.String()
+}
+
+// unicodePathExtra returns the UTF-8 name from an Info-ZIP Unicode Path
+// extra field. The field is ignored if its checksum doesn't match the
+// header name, which means the entry was renamed by a tool unaware of it.
+func unicodePathExtra(extra []byte, headerName string) (string, bool) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return "", false
+		}
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+
+		// Version 1, CRC-32 of the header name, then the UTF-8 name
+		if id != infoZipUnicodePathID || len(field) < 5 || field[0] != 1 {
+			continue
+		}
+		name := string(field[5:])
+		if binary.LittleEndian.Uint32(field[1:]) != crc32.ChecksumIEEE([]byte(headerName)) || name == "" || !utf8.ValidString(name) {
+			return "", false
+		}
+		return name, true
+	}
+	return "", false
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// unicodePathField builds an Info-ZIP Unicode Path extra field for name
+// stored under headerName
+func unicodePathField(headerName, name string) []byte {
+	field := make([]byte, 9, 9+len(name))
+	binary.LittleEndian.PutUint16(field, infoZipUnicodePathID)
+	binary.LittleEndian.PutUint16(field[2:], uint16(5+len(name)))
+	field[4] = 1
+	binary.LittleEndian.PutUint32(field[5:], crc32.ChecksumIEEE([]byte(headerName)))
+	return append(field, name...)
+}
+
+func TestZipEntryName(t *testing.T) {
+	tests := []struct {
+		name   string
+		header zip.FileHeader
+		want   string
+	}{
+		{name: "utf-8 flag", header: zip.FileHeader{Name: "résumé.pdf"}, want: "résumé.pdf"},
+		{name: "utf-8 without flag", header: zip.FileHeader{Name: "résumé.pdf", NonUTF8: true}, want: "résumé.pdf"},
+		{name: "cp437", header: zip.FileHeader{Name: "caf\x82/r\x82sum\x82.pdf", NonUTF8: true}, want: "café/résumé.pdf"},
+		{name: "backslashes", header: zip.FileHeader{Name: `docs\report.doc`}, want: "docs/report.doc"},
+		{name: "control characters", header: zip.FileHeader{Name: "evil\n/x: Eicar FOUND"}, want: "evil\uFFFD/x: Eicar FOUND"},
+		{name: "bidi override", header: zip.FileHeader{Name: "invoice\u202efdp.exe"}, want: "invoice\uFFFDfdp.exe"},
+		{
+			name:   "unicode path extra field",
+			header: zip.FileHeader{Name: "\x93\xfa\x96{.txt", NonUTF8: true, Extra: unicodePathField("\x93\xfa\x96{.txt", "日本.txt")},
+			want:   "日本.txt",
+		},
+		{
+			name:   "stale unicode path extra field",
+			header: zip.FileHeader{Name: "caf\x82.txt", NonUTF8: true, Extra: unicodePathField("old.txt", "日本.txt")},
+			want:   "café.txt",
+		},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		header := tt.header
+		if _, err := zw.CreateHeader(&header); err != nil {
+			t.Fatalf("%s: failed to create entry: %v", tt.name, err)
+		}
+		zw.Close()
+		reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("%s: invalid zip: %v", tt.name, err)
+		}
+		if got := zipEntryName(reader.File[0]); got != tt.want {
+			t.Errorf("%s: zipEntryName() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEntryPathTooLong(t *testing.T) {
+	long := strings.Repeat("a", maxEntryNameLength+1)
+	tests := []struct {
+		name  string
+		limit int
+		want  bool
+	}{
+		{"docs/report.pdf", 1024, false},
+		{"docs/report.pdf", 10, true},
+		{"docs/" + long, 1024, true},
+		{"docs/" + long, 0, true},
+		{strings.Repeat("a/", 600), 0, false},
+	}
+	for _, tt := range tests {
+		if got := entryPathTooLong(tt.name, tt.limit); got != tt.want {
+			t.Errorf("entryPathTooLong(%.20q..., %d) = %v, want %v", tt.name, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestShortenElement(t *testing.T) {
+	if got := shortenElement("invoice.pdf"); got != "invoice.pdf" {
+		t.Errorf("shortenElement(short) = %q", got)
+	}
+	got := shortenElement(strings.Repeat("é", 200) + ".exe")
+	if len(got) > maxEntryNameLength || !strings.HasSuffix(got, "é.exe") || !utf8.ValidString(got) {
+		t.Errorf("shortenElement(long) = %q (%d bytes)", got, len(got))
+	}
+}
+
+func TestExtractZipLongPaths(t *testing.T) {
+	s := NewScanner(&Config{MaxExtractedSize: 1 << 20, MaxFileCount: 10, MaxSingleFileSize: 1 << 20, MaxEntryPath: 64})
+	deep := strings.Repeat("d/", 40) + "deep.txt"
+	long := strings.Repeat("n", 300) + ".txt"
+	zipPath := createTestZip(t, map[string]string{
+		deep:        "deep",
+		long:        "long",
+		"short.txt": "short",
+	})
+
+	targetDir := t.TempDir()
+	_, skipped, err := s.extractZipSafe(context.Background(), zipPath, targetDir, nil)
+	if err != nil {
+		t.Fatalf("extractZipSafe() error: %v", err)
+	}
+	if len(skipped) != 2 || cleanStatus(skipped) != "clean_with_skips" {
+		t.Fatalf("skipped = %+v, want 2 path_too_long entries", skipped)
+	}
+	for _, file := range skipped {
+		if file.Reason != skipLongPath || len(file.File) > maxEntryNameLength+3 {
+			t.Errorf("skipped %q (%d bytes) as %s", file.File, len(file.File), file.Reason)
+		}
+	}
+	if content, _ := os.ReadFile(filepath.Join(targetDir, "short.txt")); string(content) != "short" {
+		t.Errorf("short.txt = %q, want short", content)
+	}
+}
+
+func TestScanFileLegacyZipNames(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "fa\x87ade\\eicar.com", NonUTF8: true})
+	w.Write([]byte("EICAR"))
+	zw.Close()
+	zipPath := filepath.Join(t.TempDir(), "legacy.zip")
+	os.WriteFile(zipPath, buf.Bytes(), 0644)
+
+	result, err := NewScanner(cfg).ScanFile(context.Background(), zipPath)
+	if err != nil {
+		t.Fatalf("ScanFile() error: %v", err)
+	}
+	if len(result.Threats) != 1 || result.Threats[0].File != "façade/eicar.com" || result.Threats[0].FileHash == "" {
+		t.Errorf("threats = %+v, want façade/eicar.com with its hash", result.Threats)
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Header and form field carrying passwords for the encrypted entries of an
+// uploaded archive; both may be repeated
+const (
+	archivePasswordHeader = "X-Archive-Password"
+	archivePasswordField  = "password"
+)
+
+// Limits on the passwords sent with one request
+const (
+	maxRequestPasswords = 16
+	maxPasswordLength   = 256
+)
+
+// WinZip AES entries: their compression method, and the extra field with
+// the key strength and the real method
+const (
+	methodWinZipAES  = 99
+	winZipAESExtraID = 0x9901
+)
+
+// Iterations of PBKDF2-HMAC-SHA1 WinZip AES derives its keys with
+const winZipAESIterations = 1000
+
+// Limit on the WinZip AES keys derived for one request. Each derivation
+// runs PBKDF2, and every AES entry can have its own salt, so the entries
+// left once it is reached are skipped as encrypted rather than having
+// every password tried on them.
+const maxKeyDerivations = 64
+
+// errWrongPassword is returned for an encrypted entry none of the
+// passwords decrypts
+var errWrongPassword = errors.New("no password decrypts the entry")
+
+// errKeyLimit is returned for the AES entries of a request that reached
+// maxKeyDerivations
+var errKeyLimit = fmt.Errorf("%w: key derivation limit reached", errWrongPassword)
+
+// archivePasswordsKey is the context key for the passwords sent with a scan
+type archivePasswordsKey struct{}
+
+// zipKeys holds the WinZip AES keys derived for a request, by key length,
+// salt and password, so passwords tried on entries sharing a salt are
+// derived once
+type zipKeys struct {
+	mu          sync.Mutex
+	derived     map[string][]byte
+	derivations int
+}
+
+// zipKeysKey is the context key for the keys derived for a request
+type zipKeysKey struct{}
+
+// withZipKeys returns a context that collects the keys derived for a request
+func withZipKeys(ctx context.Context) context.Context {
+	return context.WithValue(ctx, zipKeysKey{}, &zipKeys{derived: make(map[string][]byte)})
+}
+
+// zipKeysFrom returns the keys derived for the request ctx belongs to (nil
+// = not collected)
+func zipKeysFrom(ctx context.Context) *zipKeys {
+	keys, _ := ctx.Value(zipKeysKey{}).(*zipKeys)
+	return keys
+}
+
+// derive returns the n bytes of key material for password and salt,
+// deriving them unless that was done before. Returns errKeyLimit once
+// maxKeyDerivations keys were derived. A nil zipKeys derives every time.
+func (k *zipKeys) derive(password string, salt []byte, n int) ([]byte, error) {
+	if k == nil {
+		return pbkdf2SHA1([]byte(password), salt, winZipAESIterations, n), nil
+	}
+	id := fmt.Sprintf("%d:%x:%s", n, salt, password)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.derived[id]; ok {
+		return key, nil
+	}
+	if k.derivations >= maxKeyDerivations {
+		return nil, errKeyLimit
+	}
+	k.derivations++
+	key := pbkdf2SHA1([]byte(password), salt, winZipAESIterations, n)
+	k.derived[id] = key
+	return key, nil
+}
+
+// withArchivePasswords returns a context carrying a request's passwords
+func withArchivePasswords(ctx context.Context, passwords []string) context.Context {
+	if len(passwords) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, archivePasswordsKey{}, passwords)
+}
+
+// archivePasswords returns the passwords to try on encrypted entries: those
+// sent with the request, then ARCHIVE_PASSWORDS
+func archivePasswords(ctx context.Context, config *Config) []string {
+	passwords, _ := ctx.Value(archivePasswordsKey{}).([]string)
+	if len(passwords) == 0 {
+		return config.ArchivePasswords
+	}
+	return append(passwords[:len(passwords):len(passwords)], config.ArchivePasswords...)
+}
+
+// requestPasswords returns the passwords sent in X-Archive-Password headers
+// plus those of the form, checked against the per-request limits
+func requestPasswords(r *http.Request, form []string) ([]string, *requestError) {
+	passwords := append(r.Header.Values(archivePasswordHeader), form...)
+	if len(passwords) > maxRequestPasswords {
+		return nil, &requestError{status: http.StatusBadRequest, message: fmt.Sprintf("At most %d archive passwords allowed", maxRequestPasswords)}
+	}
+	for _, password := range passwords {
+		if password == "" || len(password) > maxPasswordLength {
+			return nil, &requestError{status: http.StatusBadRequest, message: fmt.Sprintf("Archive passwords must be 1 to %d bytes", maxPasswordLength)}
+		}
+	}
+	return passwords, nil
+}
+
+// parsePasswordList splits ARCHIVE_PASSWORDS into passwords, one per line,
+// so they may contain commas and spaces
+func parsePasswordList(value string) []string {
+	var passwords []string
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSuffix(line, "\r"); line != "" {
+			passwords = append(passwords, line)
+		}
+	}
+	return passwords
+}
+
+// extractEncrypted extracts an encrypted ZIP entry with the first of
+// passwords that decrypts it. Returns errWrongPassword if none does, and
+// zip.ErrAlgorithm for encryption or compression methods not supported.
+// Stops trying once ctx is done.
+func (s *Scanner) extractEncrypted(ctx context.Context, file *zip.File, targetPath string, index *entryIndex, budget *requestBudget, passwords []string) error {
+	created := false
+	keys := zipKeysFrom(ctx)
+	for _, password := range passwords {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		src, err := openEncrypted(file, password, keys)
+		if errors.Is(err, errKeyLimit) {
+			break
+		}
+		if errors.Is(err, errWrongPassword) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Passing the quick check only makes a match likely; a wrong
+		// password still fails the checksum or authentication code at the end
+		created = true
+		err = s.writeEntry(src, file.Name, targetPath, index, budget)
+		src.Close()
+		if !errors.Is(err, errWrongPassword) {
+			if err == nil {
+				metrics.Count("archive.decrypted", 1)
+			}
+			return err
+		}
+	}
+	if created {
+		os.Remove(targetPath)
+	}
+	return errWrongPassword
+}
+
+// openEncrypted opens an encrypted ZIP entry with password, as traditional
+// PKWARE (ZipCrypto) or WinZip AES encryption. Returns errWrongPassword if
+// the password fails the quick check in the entry's header; reads return it
+// if the content fails its checksum or authentication code. WinZip AES keys
+// are derived through keys (if set).
+func openEncrypted(file *zip.File, password string, keys *zipKeys) (io.ReadCloser, error) {
+	// PKWARE's strong encryption isn't documented openly
+	if file.Flags&0x40 != 0 {
+		return nil, zip.ErrAlgorithm
+	}
+	raw, err := file.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	var plain io.Reader
+	method := file.Method
+	crc := true
+	if method == methodWinZipAES {
+		var strength byte
+		var version uint16
+		if version, strength, method, err = winZipAESExtra(file.Extra); err != nil {
+			return nil, err
+		}
+		// AE-2 leaves the CRC out, the authentication code covers the content
+		crc = version == 1
+		plain, err = newWinZipAESReader(raw, int64(file.CompressedSize64), strength, password, keys)
+	} else {
+		plain, err = newZipCryptoReader(raw, file, password)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rc io.ReadCloser
+	switch method {
+	case zip.Store:
+		rc = io.NopCloser(plain)
+	case zip.Deflate:
+		rc = flate.NewReader(plain)
+	default:
+		return nil, zip.ErrAlgorithm
+	}
+	return &decryptedReader{rc: rc, plain: plain, hash: crc32.NewIEEE(), crc: file.CRC32, checkCRC: crc}, nil
+}
+
+// decryptedReader checks the content of a decrypted entry against its CRC,
+// reporting a mismatch, or data that doesn't decompress, as a wrong password
+type decryptedReader struct {
+	rc       io.ReadCloser
+	plain    io.Reader // The decrypted data rc decompresses
+	hash     hash.Hash32
+	crc      uint32
+	checkCRC bool
+}
+
+func (r *decryptedReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		if r.checkCRC && r.hash.Sum32() != r.crc {
+			return n, errWrongPassword
+		}
+		// The decompressor may stop short of the end; WinZip AES
+		// authenticates the data only once all of it was read
+		if _, err := io.Copy(io.Discard, r.plain); err != nil {
+			return n, fmt.Errorf("%w: %v", errWrongPassword, err)
+		}
+		return n, io.EOF
+	}
+	if err != nil && !errors.Is(err, errWrongPassword) {
+		return n, fmt.Errorf("%w: %v", errWrongPassword, err)
+	}
+	return n, err
+}
+
+func (r *decryptedReader) Close() error {
+	return r.rc.Close()
+}
+
+// zipCryptoReader decrypts traditional PKWARE encryption
+type zipCryptoReader struct {
+	r    io.Reader
+	keys [3]uint32
+}
+
+// newZipCryptoReader reads and checks the 12-byte encryption header: its
+// last byte must match the high byte of the CRC, or of the modification
+// time for entries with a data descriptor, which 255 of 256 wrong
+// passwords fail
+func newZipCryptoReader(raw io.Reader, file *zip.File, password string) (io.Reader, error) {
+	z := &zipCryptoReader{r: raw, keys: [3]uint32{0x12345678, 0x23456789, 0x34567890}}
+	for i := 0; i < len(password); i++ {
+		z.update(password[i])
+	}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(z, header); err != nil {
+		return nil, err
+	}
+	check := header[11]
+	if check != byte(file.CRC32>>24) && (file.Flags&0x8 == 0 || check != byte(file.ModifiedTime>>8)) {
+		return nil, errWrongPassword
+	}
+	return z, nil
+}
+
+func (z *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	for i := range p[:n] {
+		temp := z.keys[2] | 2
+		p[i] ^= byte((temp * (temp ^ 1)) >> 8)
+		z.update(p[i])
+	}
+	return n, err
+}
+
+func (z *zipCryptoReader) update(b byte) {
+	z.keys[0] = crc32.IEEETable[byte(z.keys[0])^b] ^ z.keys[0]>>8
+	z.keys[1] = (z.keys[1]+z.keys[0]&0xff)*134775813 + 1
+	z.keys[2] = crc32.IEEETable[byte(z.keys[2])^byte(z.keys[1]>>24)] ^ z.keys[2]>>8
+}
+
+// winZipAESExtra returns the AE version, key strength (1-3 for 128 to 256
+// bits) and real compression method of a WinZip AES entry
+func winZipAESExtra(extra []byte) (version uint16, strength byte, method uint16, err error) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+		if id != winZipAESExtraID || len(field) < 7 || field[2] != 'A' || field[3] != 'E' || field[4] < 1 || field[4] > 3 {
+			continue
+		}
+		return binary.LittleEndian.Uint16(field), field[4], binary.LittleEndian.Uint16(field[5:]), nil
+	}
+	return 0, 0, 0, zip.ErrAlgorithm
+}
+
+// winZipAESReader decrypts WinZip AES: AES in counter mode with a
+// little-endian counter, authenticated by HMAC-SHA1 over the ciphertext
+type winZipAESReader struct {
+	raw     io.Reader // Whole entry data, for the trailing authentication code
+	r       io.Reader // The ciphertext
+	block   cipher.Block
+	counter uint64
+	stream  [aes.BlockSize]byte
+	used    int
+	mac     hash.Hash
+}
+
+// newWinZipAESReader reads the salt and checks the 2-byte password
+// verifier, which 65535 of 65536 wrong passwords fail
+func newWinZipAESReader(raw io.Reader, size int64, strength byte, password string, derived *zipKeys) (io.Reader, error) {
+	keyLen := 8 + 8*int(strength)
+	saltLen := keyLen / 2
+	dataLen := size - int64(saltLen) - 2 - 10
+	if dataLen < 0 {
+		return nil, zip.ErrFormat
+	}
+	header := make([]byte, saltLen+2)
+	if _, err := io.ReadFull(raw, header); err != nil {
+		return nil, err
+	}
+
+	keys, err := derived.derive(password, header[:saltLen], 2*keyLen+2)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(keys[2*keyLen:], header[saltLen:]) {
+		return nil, errWrongPassword
+	}
+	block, err := aes.NewCipher(keys[:keyLen])
+	if err != nil {
+		return nil, err
+	}
+	return &winZipAESReader{
+		raw:   raw,
+		r:     io.LimitReader(raw, dataLen),
+		block: block,
+		used:  aes.BlockSize,
+		mac:   hmac.New(sha1.New, keys[keyLen:2*keyLen]),
+	}, nil
+}
+
+func (z *winZipAESReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	z.mac.Write(p[:n])
+	for i := range p[:n] {
+		if z.used == aes.BlockSize {
+			z.counter++
+			var counter [aes.BlockSize]byte
+			binary.LittleEndian.PutUint64(counter[:], z.counter)
+			z.block.Encrypt(z.stream[:], counter[:])
+			z.used = 0
+		}
+		p[i] ^= z.stream[z.used]
+		z.used++
+	}
+	if err == io.EOF {
+		code := make([]byte, 10)
+		if _, err := io.ReadFull(z.raw, code); err != nil {
+			return n, err
+		}
+		if !hmac.Equal(code, z.mac.Sum(nil)[:10]) {
+			return n, errWrongPassword
+		}
+	}
+	return n, err
+}
+
+// pbkdf2SHA1 derives keyLen bytes from password with PBKDF2-HMAC-SHA1
+// (RFC 8018)
+func pbkdf2SHA1(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// zipCryptoEntry encrypts content with traditional PKWARE encryption, as
+// the raw data of a stored entry
+func zipCryptoEntry(password string, content []byte) []byte {
+	z := &zipCryptoReader{keys: [3]uint32{0x12345678, 0x23456789, 0x34567890}}
+	for i := 0; i < len(password); i++ {
+		z.update(password[i])
+	}
+	plain := append(make([]byte, 11), byte(crc32.ChecksumIEEE(content)>>24))
+	plain = append(plain, content...)
+	data := make([]byte, len(plain))
+	for i, b := range plain {
+		temp := z.keys[2] | 2
+		data[i] = b ^ byte((temp*(temp^1))>>8)
+		z.update(b)
+	}
+	return data
+}
+
+// winZipAESEntry encrypts content with AES-256 as WinZip does (AE-2), as
+// the raw data of an entry stored inside the encryption
+func winZipAESEntry(password string, content []byte) []byte {
+	salt := []byte("0123456789abcdef")
+	keys := pbkdf2SHA1([]byte(password), salt, winZipAESIterations, 66)
+	block, _ := aes.NewCipher(keys[:32])
+	data := append([]byte(nil), content...)
+	for i := 0; i < len(data); i += aes.BlockSize {
+		var counter, stream [aes.BlockSize]byte
+		binary.LittleEndian.PutUint64(counter[:], uint64(i/aes.BlockSize+1))
+		block.Encrypt(stream[:], counter[:])
+		for j := i; j < len(data) && j < i+aes.BlockSize; j++ {
+			data[j] ^= stream[j-i]
+		}
+	}
+	mac := hmac.New(sha1.New, keys[32:64])
+	mac.Write(data)
+
+	raw := append(append(salt, keys[64:]...), data...)
+	return append(raw, mac.Sum(nil)[:10]...)
+}
+
+// encryptedZip returns a ZIP with a ZipCrypto entry zipcrypto.txt, an AES
+// entry aes.txt and a plain entry plain.txt, each holding content
+func encryptedZip(t *testing.T, password string, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	data := zipCryptoEntry(password, content)
+	w, _ := zw.CreateRaw(&zip.FileHeader{
+		Name: "zipcrypto.txt", Method: zip.Store, Flags: 0x1, CRC32: crc32.ChecksumIEEE(content),
+		CompressedSize64: uint64(len(data)), UncompressedSize64: uint64(len(content)),
+	})
+	w.Write(data)
+
+	// Version 2 (AE-2), vendor AE, 256-bit key, stored
+	extra := []byte{0x01, 0x99, 7, 0, 2, 0, 'A', 'E', 3, 0, 0}
+	data = winZipAESEntry(password, content)
+	w, _ = zw.CreateRaw(&zip.FileHeader{
+		Name: "aes.txt", Method: methodWinZipAES, Flags: 0x1, Extra: extra,
+		CompressedSize64: uint64(len(data)), UncompressedSize64: uint64(len(content)),
+	})
+	w.Write(data)
+
+	w, _ = zw.Create("plain.txt")
+	w.Write([]byte("plain"))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to write zip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestPBKDF2SHA1(t *testing.T) {
+	// RFC 6070 test vectors
+	tests := []struct {
+		iterations int
+		want       string
+	}{
+		{1, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{2, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{4096, "4b007901b765489abead49d926f721d065a429c1"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(pbkdf2SHA1([]byte("password"), []byte("salt"), tt.iterations, 20)); got != tt.want {
+			t.Errorf("pbkdf2SHA1(%d iterations) = %s, want %s", tt.iterations, got, tt.want)
+		}
+	}
+}
+
+func TestOpenEncrypted(t *testing.T) {
+	archive := encryptedZip(t, "s3cret, really", []byte("top secret content"))
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("invalid zip: %v", err)
+	}
+
+	for _, file := range reader.File[:2] {
+		rc, err := openEncrypted(file, "s3cret, really", nil)
+		if err != nil {
+			t.Fatalf("%s: openEncrypted() error: %v", file.Name, err)
+		}
+		content, err := io.ReadAll(rc)
+		if err != nil || string(content) != "top secret content" {
+			t.Errorf("%s: content = %q, %v", file.Name, content, err)
+		}
+
+		// A wrong password fails the header check, or at the latest the checksum
+		for _, password := range []string{"wrong", "s3cret", "S3CRET, REALLY"} {
+			if rc, err := openEncrypted(file, password, nil); err == nil {
+				_, err = io.ReadAll(rc)
+				if !errors.Is(err, errWrongPassword) {
+					t.Errorf("%s: password %q read error = %v, want errWrongPassword", file.Name, password, err)
+				}
+			} else if !errors.Is(err, errWrongPassword) {
+				t.Errorf("%s: password %q error = %v, want errWrongPassword", file.Name, password, err)
+			}
+		}
+	}
+}
+
+func TestExtractZipPasswords(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "protected.zip")
+	os.WriteFile(zipPath, encryptedZip(t, "infected", []byte("sample")), 0644)
+
+	extract := func(ctx context.Context, config *Config) (string, []SkippedFile) {
+		t.Helper()
+		targetDir := t.TempDir()
+		_, skipped, err := NewScanner(config).extractZipSafe(ctx, zipPath, targetDir, nil)
+		if err != nil {
+			t.Fatalf("extractZipSafe() error: %v", err)
+		}
+		var names []string
+		for name := range readTree(t, targetDir) {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ","), skipped
+	}
+	config := &Config{MaxExtractedSize: 1 << 20, MaxFileCount: 10, MaxSingleFileSize: 1 << 20}
+
+	files, skipped := extract(context.Background(), config)
+	want := []SkippedFile{{File: "zipcrypto.txt", Reason: skipEncrypted}, {File: "aes.txt", Reason: skipEncrypted}}
+	if files != "plain.txt" || !reflect.DeepEqual(skipped, want) {
+		t.Errorf("no passwords: extracted %s, skipped %+v", files, skipped)
+	}
+
+	config.ArchivePasswords = []string{"password", "infected"}
+	if files, skipped := extract(context.Background(), config); files != "aes.txt,plain.txt,zipcrypto.txt" || skipped != nil {
+		t.Errorf("configured passwords: extracted %s, skipped %+v", files, skipped)
+	}
+
+	config.ArchivePasswords = []string{"password"}
+	ctx := withArchivePasswords(context.Background(), []string{"infected"})
+	if files, skipped := extract(ctx, config); files != "aes.txt,plain.txt,zipcrypto.txt" || skipped != nil {
+		t.Errorf("request passwords: extracted %s, skipped %+v", files, skipped)
+	}
+
+	if files, skipped := extract(context.Background(), config); files != "plain.txt" || !reflect.DeepEqual(skipped, want) {
+		t.Errorf("wrong passwords: extracted %s, skipped %+v", files, skipped)
+	}
+}
+
+func TestZipKeysDerive(t *testing.T) {
+	keys := zipKeysFrom(withZipKeys(context.Background()))
+	salt := []byte("0123456789abcdef")
+	first, err := keys.derive("infected", salt, 66)
+	if err != nil || !bytes.Equal(first, pbkdf2SHA1([]byte("infected"), salt, winZipAESIterations, 66)) {
+		t.Fatalf("derive() = %x, %v", first, err)
+	}
+	// Keys derived before don't count again
+	for i := 0; i < maxKeyDerivations; i++ {
+		keys.derive("infected", salt, 66)
+	}
+	if keys.derivations != 1 {
+		t.Errorf("derivations = %d, want 1", keys.derivations)
+	}
+	for i := 1; i < maxKeyDerivations; i++ {
+		if _, err := keys.derive("infected", []byte{byte(i)}, 66); err != nil {
+			t.Fatalf("derive() %d error: %v", i, err)
+		}
+	}
+	if _, err := keys.derive("other", salt, 66); !errors.Is(err, errKeyLimit) || !errors.Is(err, errWrongPassword) {
+		t.Errorf("derive() past the limit error = %v, want errKeyLimit", err)
+	}
+}
+
+func TestExtractZipPasswordLimits(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "protected.zip")
+	os.WriteFile(zipPath, encryptedZip(t, "infected", []byte("sample")), 0644)
+	config := &Config{MaxExtractedSize: 1 << 20, MaxFileCount: 10, MaxSingleFileSize: 1 << 20, ArchivePasswords: []string{"infected"}}
+
+	// A request that spent its key derivations only opens ZipCrypto entries
+	ctx := withZipKeys(context.Background())
+	zipKeysFrom(ctx).derivations = maxKeyDerivations
+	_, skipped, err := NewScanner(config).extractZipSafe(ctx, zipPath, t.TempDir(), nil)
+	if want := []SkippedFile{{File: "aes.txt", Reason: skipEncrypted}}; err != nil || !reflect.DeepEqual(skipped, want) {
+		t.Errorf("extractZipSafe() = %+v, %v; want %+v", skipped, err, want)
+	}
+
+	// Nor are passwords tried past the request's deadline
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := NewScanner(config).extractEncrypted(ctx, nil, "", nil, nil, config.ArchivePasswords); !errors.Is(err, context.Canceled) {
+		t.Errorf("extractEncrypted() after the deadline error = %v, want context.Canceled", err)
+	}
+}
+
+func TestParsePasswordList(t *testing.T) {
+	got := parsePasswordList("infected\r\nwith, comma\n\n  spaced  \n")
+	want := []string{"infected", "with, comma", "  spaced  "}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsePasswordList() = %q, want %q", got, want)
+	}
+}
+
+func TestScanHandlerArchivePasswords(t *testing.T) {
+	cfg := useFakeClamdScanner(t)
+	archive := encryptedZip(t, "infected", []byte("EICAR"))
+
+	scan := func(header []string, form []string) (int, ScanResponse) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for _, password := range form {
+			writer.WriteField(archivePasswordField, password)
+		}
+		part, _ := writer.CreateFormFile("file", "protected.zip")
+		part.Write(archive)
+		writer.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/scan", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		for _, password := range header {
+			req.Header.Add(archivePasswordHeader, password)
+		}
+		recorder := httptest.NewRecorder()
+		handleScan(recorder, req, cfg, NewScanner(cfg))
+		var response ScanResponse
+		json.NewDecoder(recorder.Body).Decode(&response)
+		return recorder.Code, response
+	}
+
+	if status, response := scan(nil, nil); status != http.StatusOK || response.Status != "clean_with_skips" {
+		t.Errorf("no password: status %d, response %+v", status, response)
+	}
+	if status, response := scan(nil, []string{"wrong", "infected"}); status != http.StatusOK || response.Status != "infected" || len(response.Threats) != 2 {
+		t.Errorf("form password: status %d, response %+v", status, response)
+	}
+	if status, response := scan([]string{"infected"}, nil); status != http.StatusOK || response.Status != "infected" {
+		t.Errorf("header password: status %d, response %+v", status, response)
+	}
+	if status, _ := scan(make([]string, maxRequestPasswords+1), nil); status != http.StatusBadRequest {
+		t.Errorf("too many passwords: status %d, want 400", status)
+	}
+	if status, _ := scan(nil, []string{strings.Repeat("x", maxPasswordLength+1)}); status != http.StatusBadRequest {
+		t.Errorf("long password: status %d, want 400", status)
+	}
+}
@@ -0,0 +1,1032 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// zstd decoding (RFC 8878) for Content-Encoding: zstd request bodies. The Go
+// standard library has no zstd package, so this is a plain decoder: frames
+// without dictionaries, read block by block, with the window bounded.
+
+// errZstdCorrupt is wrapped by the errors of malformed zstd data
+var errZstdCorrupt = errors.New("corrupt zstd data")
+
+const (
+	zstdMagic    = 0xfd2fb528
+	zstdMaxBlock = 128 << 10
+
+	// zstdMaxWindow bounds the window kept for matches to reach back into.
+	// It is the 8 MiB decoders are expected to support, which zstd's
+	// compression levels stay within unless --long or --ultra is used; frames
+	// declaring a larger window are decoded until a match reaches further.
+	zstdMaxWindow = 8 << 20
+)
+
+// zstdCorrupt returns an error wrapping errZstdCorrupt
+func zstdCorrupt(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", errZstdCorrupt, fmt.Sprintf(format, args...))
+}
+
+// zstdTruncated turns the end of the input inside a frame into
+// io.ErrUnexpectedEOF
+func zstdTruncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// zstdReader decompresses a zstd stream of one or more frames
+type zstdReader struct {
+	r      io.Reader
+	header [18]byte
+	frames int
+	err    error
+
+	// Current frame
+	inFrame   bool
+	window    int
+	sized     bool   // Content size given
+	remaining uint64 // Content left, when sized
+	checksum  bool
+	hash      xxhash64
+
+	// Decoded data: the window followed by what hasn't been read yet
+	hist []byte
+	pos  int
+
+	// Block decoding state, kept across the blocks of a frame
+	block    []byte
+	literals []byte
+	huffman  [1 << zstdMaxHuffmanBits]uint16 // Symbol<<8 | code length
+	huffBits int                             // 0 = no table yet
+	seqs     [3][]fseEntry                   // Literal length, offset and match length tables
+	seqBufs  [3][]fseEntry
+	repeat   [3]int // Repeated offsets
+}
+
+// newZstdReader returns a reader decompressing r, after reading the first
+// frame header so a body that isn't zstd is refused before it's used
+func newZstdReader(r io.Reader) (*zstdReader, error) {
+	z := &zstdReader{r: r}
+	if err := z.readFrameHeader(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	for z.pos == len(z.hist) {
+		if z.err != nil {
+			return 0, z.err
+		}
+		if z.inFrame {
+			z.err = z.readBlock()
+		} else {
+			z.err = z.readFrameHeader()
+		}
+	}
+	n := copy(p, z.hist[z.pos:])
+	z.pos += n
+	return n, nil
+}
+
+func (z *zstdReader) Close() error {
+	return nil
+}
+
+// readFrameHeader starts the next frame, skipping skippable frames; it
+// returns io.EOF at the end of the input after a frame
+func (z *zstdReader) readFrameHeader() error {
+	for {
+		if _, err := io.ReadFull(z.r, z.header[:4]); err != nil {
+			if err == io.EOF && z.frames > 0 {
+				return io.EOF
+			}
+			return zstdTruncated(err)
+		}
+		magic := binary.LittleEndian.Uint32(z.header[:4])
+		if magic == zstdMagic {
+			break
+		}
+		if magic&0xfffffff0 != 0x184d2a50 {
+			return zstdCorrupt("not a zstd frame")
+		}
+		if _, err := io.ReadFull(z.r, z.header[:4]); err != nil {
+			return zstdTruncated(err)
+		}
+		if _, err := io.CopyN(io.Discard, z.r, int64(binary.LittleEndian.Uint32(z.header[:4]))); err != nil {
+			return zstdTruncated(err)
+		}
+		z.frames++
+	}
+
+	if _, err := io.ReadFull(z.r, z.header[:1]); err != nil {
+		return zstdTruncated(err)
+	}
+	descriptor := z.header[0]
+	if descriptor&0x08 != 0 {
+		return zstdCorrupt("reserved frame header bit set")
+	}
+	singleSegment := descriptor&0x20 != 0
+	sizeBytes := [4]int{0, 2, 4, 8}[descriptor>>6]
+	if sizeBytes == 0 && singleSegment {
+		sizeBytes = 1
+	}
+	dictBytes := [4]int{0, 1, 2, 4}[descriptor&3]
+	windowBytes := 1
+	if singleSegment {
+		windowBytes = 0
+	}
+	header := z.header[:windowBytes+dictBytes+sizeBytes]
+	if _, err := io.ReadFull(z.r, header); err != nil {
+		return zstdTruncated(err)
+	}
+
+	var window uint64
+	if !singleSegment {
+		base := uint64(1) << (10 + header[0]>>3)
+		window = base + base/8*uint64(header[0]&7)
+		header = header[1:]
+	}
+	for _, b := range header[:dictBytes] {
+		if b != 0 {
+			return zstdCorrupt("dictionaries are not supported")
+		}
+	}
+	header = header[dictBytes:]
+	z.sized = true
+	switch sizeBytes {
+	case 0:
+		z.sized = false
+	case 1:
+		z.remaining = uint64(header[0])
+	case 2:
+		z.remaining = 256 + uint64(binary.LittleEndian.Uint16(header))
+	case 4:
+		z.remaining = uint64(binary.LittleEndian.Uint32(header))
+	case 8:
+		z.remaining = binary.LittleEndian.Uint64(header)
+	}
+	if singleSegment {
+		window = z.remaining
+	}
+	window = min(window, zstdMaxWindow)
+
+	// Matches don't reach into earlier frames, and everything decoded has
+	// been read by the time a frame starts
+	z.hist, z.pos = z.hist[:0], 0
+	z.window = int(window)
+	z.checksum = descriptor&0x04 != 0
+	z.hash.reset()
+	z.huffBits = 0
+	z.seqs = [3][]fseEntry{}
+	z.repeat = [3]int{1, 4, 8}
+	z.inFrame = true
+	z.frames++
+	return nil
+}
+
+// readBlock decodes the next block of the frame
+func (z *zstdReader) readBlock() error {
+	if _, err := io.ReadFull(z.r, z.header[:3]); err != nil {
+		return zstdTruncated(err)
+	}
+	header := uint32(z.header[0]) | uint32(z.header[1])<<8 | uint32(z.header[2])<<16
+	last := header&1 != 0
+	size := int(header >> 3)
+	if size > zstdMaxBlock || z.window > 0 && size > z.window {
+		return zstdCorrupt("block of %d bytes exceeds the window", size)
+	}
+
+	z.slide()
+	start := len(z.hist)
+	var err error
+	switch header >> 1 & 3 {
+	case 0: // Raw
+		z.grow(size)
+		_, err = io.ReadFull(z.r, z.hist[start:])
+	case 1: // Run of one byte
+		if _, err = io.ReadFull(z.r, z.header[:1]); err == nil {
+			z.grow(size)
+			for i := start; i < len(z.hist); i++ {
+				z.hist[i] = z.header[0]
+			}
+		}
+	case 2: // Compressed
+		if cap(z.block) < size {
+			z.block = make([]byte, size, zstdMaxBlock)
+		}
+		z.block = z.block[:size]
+		if _, err = io.ReadFull(z.r, z.block); err == nil {
+			err = z.decodeBlock(z.block)
+		}
+	default:
+		err = zstdCorrupt("reserved block type")
+	}
+	if err != nil {
+		z.hist = z.hist[:start]
+		return zstdTruncated(err)
+	}
+
+	out := z.hist[start:]
+	if z.sized {
+		if uint64(len(out)) > z.remaining {
+			return zstdCorrupt("frame larger than its content size")
+		}
+		z.remaining -= uint64(len(out))
+	}
+	if z.checksum {
+		z.hash.write(out)
+	}
+	if !last {
+		return nil
+	}
+
+	z.inFrame = false
+	if z.sized && z.remaining != 0 {
+		return zstdCorrupt("frame smaller than its content size")
+	}
+	if z.checksum {
+		if _, err := io.ReadFull(z.r, z.header[:4]); err != nil {
+			return zstdTruncated(err)
+		}
+		if binary.LittleEndian.Uint32(z.header[:4]) != uint32(z.hash.sum()) {
+			return zstdCorrupt("checksum mismatch")
+		}
+	}
+	return nil
+}
+
+// slide drops read data matches can no longer reach, once there is as much
+// of it as the window holds, so each byte is moved at most once
+func (z *zstdReader) slide() {
+	if drop := len(z.hist) - z.window; drop > 0 && drop >= z.window {
+		z.hist = z.hist[:copy(z.hist, z.hist[drop:])]
+		z.pos = len(z.hist)
+	}
+}
+
+// grow extends hist by n bytes
+func (z *zstdReader) grow(n int) {
+	if len(z.hist)+n > cap(z.hist) {
+		hist := make([]byte, len(z.hist), 2*cap(z.hist)+n)
+		copy(hist, z.hist)
+		z.hist = hist
+	}
+	z.hist = z.hist[:len(z.hist)+n]
+}
+
+// decodeBlock decodes a compressed block: its literals, then the sequences
+// that interleave them with matches
+func (z *zstdReader) decodeBlock(data []byte) error {
+	literals, data, err := z.readLiterals(data)
+	if err != nil {
+		return err
+	}
+	count, data, err := z.readSequencesHeader(data)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		if len(data) != 0 {
+			return zstdCorrupt("data after literals")
+		}
+		z.hist = append(z.hist, literals...)
+		return nil
+	}
+	return z.execSequences(data, literals, count)
+}
+
+// readLiterals reads the literals section of a block
+func (z *zstdReader) readLiterals(data []byte) (literals, rest []byte, err error) {
+	if len(data) == 0 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	kind, format := data[0]&3, data[0]>>2&3
+
+	if kind < 2 {
+		// Raw or a run of one byte
+		headerBytes := [4]int{1, 2, 1, 3}[format]
+		if len(data) < headerBytes {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		size := int(data[0] >> 3)
+		switch format {
+		case 1:
+			size = int(data[0]>>4) | int(data[1])<<4
+		case 3:
+			size = int(data[0]>>4) | int(data[1])<<4 | int(data[2])<<12
+		}
+		if size > zstdMaxBlock {
+			return nil, nil, zstdCorrupt("%d literals exceed a block", size)
+		}
+		data = data[headerBytes:]
+		if kind == 0 {
+			if len(data) < size {
+				return nil, nil, io.ErrUnexpectedEOF
+			}
+			return data[:size], data[size:], nil
+		}
+		if len(data) == 0 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		z.literals = z.literals[:0]
+		for i := 0; i < size; i++ {
+			z.literals = append(z.literals, data[0])
+		}
+		return z.literals, data[1:], nil
+	}
+
+	// Huffman-coded, with a new table or the previous block's
+	headerBytes := [4]int{3, 3, 4, 5}[format]
+	if len(data) < headerBytes {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	var size, compressed int
+	switch format {
+	case 0, 1:
+		size = int(data[0]>>4) | int(data[1]&0x3f)<<4
+		compressed = int(data[1]>>6) | int(data[2])<<2
+	case 2:
+		size = int(data[0]>>4) | int(data[1])<<4 | int(data[2]&3)<<12
+		compressed = int(data[2]>>2) | int(data[3])<<6
+	case 3:
+		size = int(data[0]>>4) | int(data[1])<<4 | int(data[2]&0x3f)<<12
+		compressed = int(data[2]>>6) | int(data[3])<<2 | int(data[4])<<10
+	}
+	if size > zstdMaxBlock {
+		return nil, nil, zstdCorrupt("%d literals exceed a block", size)
+	}
+	data = data[headerBytes:]
+	if len(data) < compressed {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	streams, rest := data[:compressed], data[compressed:]
+	if kind == 2 {
+		n, err := z.readHuffmanTable(streams)
+		if err != nil {
+			return nil, nil, err
+		}
+		streams = streams[n:]
+	} else if z.huffBits == 0 {
+		return nil, nil, zstdCorrupt("literals reuse a missing Huffman table")
+	}
+
+	if cap(z.literals) < size {
+		z.literals = make([]byte, size, zstdMaxBlock)
+	}
+	z.literals = z.literals[:size]
+	if format == 0 {
+		return z.literals, rest, z.decodeHuffman(streams, z.literals)
+	}
+
+	// Four streams, the sizes of the first three in a jump table
+	if len(streams) < 6 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	quarter := (size + 3) / 4
+	if size < 3*quarter {
+		return nil, nil, zstdCorrupt("%d literals can't be split into four streams", size)
+	}
+	out := z.literals
+	in := streams[6:]
+	for i := 0; i < 4; i++ {
+		n, length := len(in), len(out)
+		if i < 3 {
+			n, length = int(binary.LittleEndian.Uint16(streams[2*i:])), quarter
+			if n > len(in) {
+				return nil, nil, io.ErrUnexpectedEOF
+			}
+		}
+		if err := z.decodeHuffman(in[:n], out[:length]); err != nil {
+			return nil, nil, err
+		}
+		in, out = in[n:], out[length:]
+	}
+	return z.literals, rest, nil
+}
+
+// Longest Huffman code for literals
+const zstdMaxHuffmanBits = 11
+
+// readHuffmanTable reads the Huffman table of a block's literals, given as
+// the weights of the symbols, and returns the bytes it took
+func (z *zstdReader) readHuffmanTable(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	var weights [256]uint8
+	count, used := 0, 1+int(data[0])
+
+	if header := int(data[0]); header >= 128 {
+		// Four bits each
+		count = header - 127
+		used = 1 + (count+1)/2
+		if len(data) < used {
+			return 0, io.ErrUnexpectedEOF
+		}
+		for i := 0; i < count; i++ {
+			weights[i] = data[1+i/2] >> (4 - 4*(i%2)) & 0xf
+		}
+	} else {
+		// FSE-coded, by two states taking turns
+		if len(data) < used {
+			return 0, io.ErrUnexpectedEOF
+		}
+		var table [1 << 6]fseEntry
+		accuracy, n, err := readFSETable(data[1:used], 255, 6, table[:])
+		if err != nil {
+			return 0, err
+		}
+		in, err := newBackwardBits(data[1+n : used])
+		if err != nil {
+			return 0, err
+		}
+		states := [2]uint32{in.read(uint(accuracy)), in.read(uint(accuracy))}
+		for i := 0; ; i ^= 1 {
+			if count >= 254 {
+				return 0, zstdCorrupt("too many Huffman weights")
+			}
+			entry := table[states[i]]
+			weights[count] = entry.symbol
+			count++
+			if in.available() < uint(entry.bits) {
+				// The other state gives the last weight
+				weights[count] = table[states[i^1]].symbol
+				count++
+				break
+			}
+			states[i] = uint32(entry.base) + in.read(uint(entry.bits))
+		}
+		if in.overflow {
+			return 0, zstdCorrupt("Huffman weights overrun their stream")
+		}
+	}
+
+	// The last symbol's weight is left out: it's whatever makes the code
+	// lengths fill the table exactly
+	var total uint32
+	var ranks [zstdMaxHuffmanBits + 2]uint32
+	for _, w := range weights[:count] {
+		if w > zstdMaxHuffmanBits {
+			return 0, zstdCorrupt("Huffman weight %d too large", w)
+		}
+		ranks[w]++
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return 0, zstdCorrupt("no Huffman weights")
+	}
+	tableBits := bits.Len32(total)
+	left := uint32(1)<<tableBits - total
+	if tableBits > zstdMaxHuffmanBits || left&(left-1) != 0 {
+		return 0, zstdCorrupt("invalid Huffman weights")
+	}
+	last := uint8(bits.Len32(left))
+	weights[count] = last
+	count++
+	ranks[last]++
+	if ranks[1] < 2 || ranks[1]%2 != 0 {
+		return 0, zstdCorrupt("invalid Huffman weights")
+	}
+
+	// Symbols take consecutive runs of table entries by weight, the
+	// lowest weights (longest codes) first
+	var next uint32
+	for w := 1; w <= tableBits; w++ {
+		next, ranks[w] = next+ranks[w]<<(w-1), next
+	}
+	for symbol, w := range weights[:count] {
+		if w == 0 {
+			continue
+		}
+		entry := uint16(symbol)<<8 | uint16(tableBits+1-int(w))
+		for i := uint32(0); i < 1<<(w-1); i++ {
+			z.huffman[ranks[w]+i] = entry
+		}
+		ranks[w] += 1 << (w - 1)
+	}
+	z.huffBits = tableBits
+	return used, nil
+}
+
+// decodeHuffman decodes a stream of Huffman-coded literals into out
+func (z *zstdReader) decodeHuffman(data, out []byte) error {
+	in, err := newBackwardBits(data)
+	if err != nil {
+		return err
+	}
+	tableBits := uint(z.huffBits)
+	for i := range out {
+		entry := z.huffman[in.peek(tableBits)]
+		out[i] = byte(entry >> 8)
+		in.skip(uint(entry & 0xff))
+	}
+	if !in.done() {
+		return zstdCorrupt("Huffman stream doesn't match its literals")
+	}
+	return nil
+}
+
+// Sequence codes: literal lengths, offsets and match lengths, in the order
+// of their tables
+const (
+	seqLiteralLength = iota
+	seqOffset
+	seqMatchLength
+)
+
+// zstdSeqCodes describes each code's tables: the largest symbol, the largest
+// accuracy log and the predefined distribution
+var zstdSeqCodes = [3]struct {
+	maxSymbol   int
+	maxAccuracy int
+	predefined  []fseEntry
+}{
+	{35, 9, mustBuildFSETable(6, []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2,
+		2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1})},
+	{31, 8, mustBuildFSETable(5, []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1, -1})},
+	{52, 9, mustBuildFSETable(6, []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1})},
+}
+
+// Baselines and extra bits of the literal length codes from 16 and the
+// match length codes from 32; lower codes are the length itself (plus 3
+// for match lengths)
+var (
+	zstdLiteralLengths = [20][2]uint32{
+		{16, 1}, {18, 1}, {20, 1}, {22, 1}, {24, 2}, {28, 2}, {32, 3}, {40, 3}, {48, 4}, {64, 6},
+		{128, 7}, {256, 8}, {512, 9}, {1024, 10}, {2048, 11}, {4096, 12}, {8192, 13}, {16384, 14}, {32768, 15}, {65536, 16},
+	}
+	zstdMatchLengths = [21][2]uint32{
+		{35, 1}, {37, 1}, {39, 1}, {41, 1}, {43, 2}, {47, 2}, {51, 3}, {59, 3}, {67, 4}, {83, 4}, {99, 5},
+		{131, 7}, {259, 8}, {515, 9}, {1027, 10}, {2051, 11}, {4099, 12}, {8195, 13}, {16387, 14}, {32771, 15}, {65539, 16},
+	}
+)
+
+// readSequencesHeader reads the number of sequences in a block and the
+// tables their codes are decoded with
+func (z *zstdReader) readSequencesHeader(data []byte) (int, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	count := int(data[0])
+	switch {
+	case count == 0:
+		return 0, data[1:], nil
+	case count < 128:
+		data = data[1:]
+	case count < 255:
+		if len(data) < 2 {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		count = (count-128)<<8 | int(data[1])
+		data = data[2:]
+	default:
+		if len(data) < 3 {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		count = int(binary.LittleEndian.Uint16(data[1:])) + 0x7f00
+		data = data[3:]
+	}
+	if len(data) == 0 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	modes := data[0]
+	if modes&3 != 0 {
+		return 0, nil, zstdCorrupt("reserved sequence mode bits set")
+	}
+	data = data[1:]
+
+	for code := range zstdSeqCodes {
+		info := &zstdSeqCodes[code]
+		switch modes >> (6 - 2*code) & 3 {
+		case 0: // Predefined
+			z.seqs[code] = info.predefined
+		case 1: // One symbol
+			if len(data) == 0 {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+			if int(data[0]) > info.maxSymbol {
+				return 0, nil, zstdCorrupt("sequence code %d out of range", data[0])
+			}
+			z.seqBufs[code] = append(z.seqBufs[code][:0], fseEntry{symbol: data[0]})
+			z.seqs[code] = z.seqBufs[code]
+			data = data[1:]
+		case 2: // FSE-coded distribution
+			if cap(z.seqBufs[code]) < 1<<info.maxAccuracy {
+				z.seqBufs[code] = make([]fseEntry, 1<<info.maxAccuracy)
+			}
+			accuracy, n, err := readFSETable(data, info.maxSymbol, info.maxAccuracy, z.seqBufs[code][:cap(z.seqBufs[code])])
+			if err != nil {
+				return 0, nil, err
+			}
+			z.seqs[code] = z.seqBufs[code][:1<<accuracy]
+			data = data[n:]
+		case 3: // The previous block's
+			if z.seqs[code] == nil {
+				return 0, nil, zstdCorrupt("sequences reuse a missing table")
+			}
+		}
+	}
+	return count, data, nil
+}
+
+// execSequences decodes the sequences of a block, each some literals
+// followed by a match copied from earlier output, and appends the result to
+// hist
+func (z *zstdReader) execSequences(data, literals []byte, count int) error {
+	in, err := newBackwardBits(data)
+	if err != nil {
+		return err
+	}
+	var states [3]uint32
+	for code, table := range z.seqs {
+		states[code] = in.read(uint(bits.Len(uint(len(table))) - 1))
+	}
+
+	start := len(z.hist)
+	for i := 0; i < count; i++ {
+		litEntry := z.seqs[seqLiteralLength][states[seqLiteralLength]]
+		offEntry := z.seqs[seqOffset][states[seqOffset]]
+		matchEntry := z.seqs[seqMatchLength][states[seqMatchLength]]
+
+		offsetCode := uint(offEntry.symbol)
+		offsetValue := int(uint32(1)<<offsetCode + in.read(offsetCode))
+		matchLength := int(matchEntry.symbol) + 3
+		if matchEntry.symbol >= 32 {
+			length := zstdMatchLengths[matchEntry.symbol-32]
+			matchLength = int(length[0] + in.read(uint(length[1])))
+		}
+		literalLength := int(litEntry.symbol)
+		if litEntry.symbol >= 16 {
+			length := zstdLiteralLengths[litEntry.symbol-16]
+			literalLength = int(length[0] + in.read(uint(length[1])))
+		}
+
+		var offset int
+		if offsetValue > 3 {
+			offset = offsetValue - 3
+			z.repeat = [3]int{offset, z.repeat[0], z.repeat[1]}
+		} else {
+			if literalLength == 0 {
+				offsetValue++
+			}
+			switch offsetValue {
+			case 1:
+				offset = z.repeat[0]
+			case 2:
+				offset = z.repeat[1]
+				z.repeat = [3]int{offset, z.repeat[0], z.repeat[2]}
+			case 3:
+				offset = z.repeat[2]
+				z.repeat = [3]int{offset, z.repeat[0], z.repeat[1]}
+			case 4:
+				offset = z.repeat[0] - 1
+				z.repeat = [3]int{offset, z.repeat[0], z.repeat[1]}
+			}
+		}
+
+		if i < count-1 {
+			states[seqLiteralLength] = uint32(litEntry.base) + in.read(uint(litEntry.bits))
+			states[seqMatchLength] = uint32(matchEntry.base) + in.read(uint(matchEntry.bits))
+			states[seqOffset] = uint32(offEntry.base) + in.read(uint(offEntry.bits))
+		}
+		if in.overflow {
+			return zstdCorrupt("sequences overrun their stream")
+		}
+
+		if literalLength > len(literals) {
+			return zstdCorrupt("sequence uses more literals than the block has")
+		}
+		if len(z.hist)-start+literalLength+matchLength > zstdMaxBlock {
+			return zstdCorrupt("block expands past %d bytes", zstdMaxBlock)
+		}
+		z.hist = append(z.hist, literals[:literalLength]...)
+		literals = literals[literalLength:]
+		if offset <= 0 || offset > len(z.hist) || z.window > 0 && offset > z.window {
+			return zstdCorrupt("match offset %d out of range", offset)
+		}
+		from := len(z.hist) - offset
+		if offset >= matchLength {
+			z.hist = append(z.hist, z.hist[from:from+matchLength]...)
+			continue
+		}
+		// The match overlaps what it produces
+		for j := 0; j < matchLength; j++ {
+			z.hist = append(z.hist, z.hist[from+j])
+		}
+	}
+	if len(z.hist)-start+len(literals) > zstdMaxBlock {
+		return zstdCorrupt("block expands past %d bytes", zstdMaxBlock)
+	}
+	z.hist = append(z.hist, literals...)
+	if !in.done() {
+		return zstdCorrupt("sequence stream doesn't match its count")
+	}
+	return nil
+}
+
+// fseEntry is a state of an FSE decoding table: the symbol it decodes, and
+// the next state, base plus the given number of bits
+type fseEntry struct {
+	symbol uint8
+	bits   uint8
+	base   uint16
+}
+
+// readFSETable reads an FSE distribution, the probabilities of the symbols
+// up to maxSymbol, and builds its decoding table. It returns the table's
+// accuracy log (it has 1<<accuracy states) and the bytes read.
+func readFSETable(data []byte, maxSymbol, maxAccuracy int, table []fseEntry) (int, int, error) {
+	in := forwardBits{data: data}
+	accuracy := int(in.read(4)) + 5
+	if accuracy > maxAccuracy {
+		return 0, 0, zstdCorrupt("FSE accuracy log %d too large", accuracy)
+	}
+
+	// Each probability takes as many bits as the remaining total needs,
+	// small values one bit fewer; a probability of 0 is followed by a
+	// count of further zeros
+	var probabilities [256]int16
+	remaining := 1<<accuracy + 1
+	threshold, width := 1<<accuracy, accuracy+1
+	symbol := 0
+	for remaining > 1 && symbol <= maxSymbol {
+		max := 2*threshold - 1 - remaining
+		var value int
+		if low := int(in.peek(width - 1)); low < max {
+			value = low
+			in.skip(width - 1)
+		} else {
+			value = int(in.read(width))
+			if value >= threshold {
+				value -= max
+			}
+		}
+		probability := value - 1
+		if probability < 0 {
+			remaining--
+		} else {
+			remaining -= probability
+		}
+		probabilities[symbol] = int16(probability)
+		symbol++
+		if remaining < 1 {
+			break
+		}
+		for remaining < threshold {
+			width--
+			threshold >>= 1
+		}
+
+		if probability == 0 {
+			for {
+				repeat := int(in.read(2))
+				symbol += repeat
+				if repeat < 3 {
+					break
+				}
+			}
+		}
+	}
+	if remaining != 1 || symbol > maxSymbol+1 || in.overflow() {
+		return 0, 0, zstdCorrupt("invalid FSE distribution")
+	}
+	if err := buildFSETable(accuracy, probabilities[:symbol], table); err != nil {
+		return 0, 0, err
+	}
+	return accuracy, (in.pos + 7) / 8, nil
+}
+
+// buildFSETable builds the decoding table of a distribution: symbols with
+// probability -1 (less than 1) take one state each at the end, and the rest
+// are spread over the others
+func buildFSETable(accuracy int, probabilities []int16, table []fseEntry) error {
+	size := 1 << accuracy
+	high := size - 1
+	var next [256]uint16
+	for symbol, p := range probabilities {
+		if p == -1 {
+			table[high].symbol = uint8(symbol)
+			high--
+			next[symbol] = 1
+		} else {
+			next[symbol] = uint16(p)
+		}
+	}
+
+	position, step := 0, size>>1+size>>3+3
+	for symbol, p := range probabilities {
+		for i := 0; i < int(p); i++ {
+			table[position].symbol = uint8(symbol)
+			for position = (position + step) & (size - 1); position > high; {
+				position = (position + step) & (size - 1)
+			}
+		}
+	}
+	if position != 0 {
+		return zstdCorrupt("invalid FSE distribution")
+	}
+
+	for i := range table[:size] {
+		state := next[table[i].symbol]
+		next[table[i].symbol]++
+		width := accuracy + 1 - bits.Len16(state)
+		table[i].bits = uint8(width)
+		table[i].base = state<<width - uint16(size)
+	}
+	return nil
+}
+
+// mustBuildFSETable builds a predefined decoding table
+func mustBuildFSETable(accuracy int, probabilities []int16) []fseEntry {
+	table := make([]fseEntry, 1<<accuracy)
+	if err := buildFSETable(accuracy, probabilities, table); err != nil {
+		panic(err)
+	}
+	return table
+}
+
+// forwardBits reads bits from the lowest of the first byte on, as FSE
+// distributions are written. Bits past the end read as zeros and are
+// reported by overflow.
+type forwardBits struct {
+	data []byte
+	pos  int // In bits
+}
+
+func (f *forwardBits) peek(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if p := f.pos + i; p/8 < len(f.data) {
+			v |= uint32(f.data[p/8]>>(p%8)&1) << i
+		}
+	}
+	return v
+}
+
+func (f *forwardBits) skip(n int) {
+	f.pos += n
+}
+
+func (f *forwardBits) read(n int) uint32 {
+	v := f.peek(n)
+	f.skip(n)
+	return v
+}
+
+func (f *forwardBits) overflow() bool {
+	return f.pos > 8*len(f.data)
+}
+
+// backwardBits reads bits from the end of a stream, as zstd writes its
+// Huffman and sequence streams: the highest set bit of the last byte marks
+// where they start. Bits before the start read as zeros; using them sets
+// overflow.
+type backwardBits struct {
+	data     []byte // Not loaded yet
+	bits     uint64 // Loaded, the next ones lowest of the top count
+	count    uint
+	overflow bool
+}
+
+func newBackwardBits(data []byte) (backwardBits, error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return backwardBits{}, zstdCorrupt("bit stream without an end mark")
+	}
+	last := data[len(data)-1]
+	return backwardBits{data: data[:len(data)-1], bits: uint64(last), count: uint(bits.Len8(last)) - 1}, nil
+}
+
+func (b *backwardBits) peek(n uint) uint32 {
+	for b.count <= 56 && len(b.data) > 0 {
+		b.bits = b.bits<<8 | uint64(b.data[len(b.data)-1])
+		b.data = b.data[:len(b.data)-1]
+		b.count += 8
+	}
+	if b.count >= n {
+		return uint32(b.bits>>(b.count-n)) & (1<<n - 1)
+	}
+	return uint32(b.bits<<(n-b.count)) & (1<<n - 1)
+}
+
+func (b *backwardBits) skip(n uint) {
+	if n > b.count {
+		b.overflow = true
+		b.count = 0
+		return
+	}
+	b.count -= n
+}
+
+func (b *backwardBits) read(n uint) uint32 {
+	v := b.peek(n)
+	b.skip(n)
+	return v
+}
+
+// available returns the number of bits left
+func (b *backwardBits) available() uint {
+	return b.count + 8*uint(len(b.data))
+}
+
+// done reports whether the stream was read exactly to its start
+func (b *backwardBits) done() bool {
+	return !b.overflow && b.available() == 0
+}
+
+// xxhash64 is the XXH64 hash (seed 0), whose low 32 bits are a zstd frame's
+// checksum
+type xxhash64 struct {
+	v     [4]uint64
+	buf   [32]byte
+	n     int
+	total uint64
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func (h *xxhash64) reset() {
+	prime1 := xxPrime1
+	*h = xxhash64{v: [4]uint64{prime1 + xxPrime2, xxPrime2, 0, -prime1}}
+}
+
+func xxRound(acc, input uint64) uint64 {
+	return bits.RotateLeft64(acc+input*xxPrime2, 31) * xxPrime1
+}
+
+func (h *xxhash64) write(p []byte) {
+	h.total += uint64(len(p))
+	if h.n > 0 {
+		n := copy(h.buf[h.n:], p)
+		h.n += n
+		p = p[n:]
+		if h.n < len(h.buf) {
+			return
+		}
+		h.stripe(h.buf[:])
+		h.n = 0
+	}
+	for ; len(p) >= 32; p = p[32:] {
+		h.stripe(p)
+	}
+	h.n = copy(h.buf[:], p)
+}
+
+func (h *xxhash64) stripe(p []byte) {
+	for i := range h.v {
+		h.v[i] = xxRound(h.v[i], binary.LittleEndian.Uint64(p[8*i:]))
+	}
+}
+
+func (h *xxhash64) sum() uint64 {
+	var sum uint64
+	if h.total >= 32 {
+		v := h.v
+		sum = bits.RotateLeft64(v[0], 1) + bits.RotateLeft64(v[1], 7) + bits.RotateLeft64(v[2], 12) + bits.RotateLeft64(v[3], 18)
+		for _, x := range v {
+			sum = (sum^xxRound(0, x))*xxPrime1 + xxPrime4
+		}
+	} else {
+		sum = xxPrime5
+	}
+	sum += h.total
+
+	p := h.buf[:h.n]
+	for ; len(p) >= 8; p = p[8:] {
+		sum = bits.RotateLeft64(sum^xxRound(0, binary.LittleEndian.Uint64(p)), 27)*xxPrime1 + xxPrime4
+	}
+	if len(p) >= 4 {
+		sum = bits.RotateLeft64(sum^uint64(binary.LittleEndian.Uint32(p))*xxPrime1, 23)*xxPrime2 + xxPrime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		sum = bits.RotateLeft64(sum^uint64(b)*xxPrime5, 11) * xxPrime1
+	}
+
+	sum ^= sum >> 33
+	sum *= xxPrime2
+	sum ^= sum >> 29
+	sum *= xxPrime3
+	sum ^= sum >> 32
+	return sum
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// zstdRawFrame returns data as a zstd frame of uncompressed blocks, with a
+// checksum
+func zstdRawFrame(data []byte) []byte {
+	var hash xxhash64
+	hash.reset()
+	hash.write(data)
+	frame := binary.LittleEndian.AppendUint32(nil, zstdMagic)
+	frame = append(frame, 0x04, 7<<3) // Checksum, 128 KiB window
+	for last := false; !last; {
+		n := min(len(data), zstdMaxBlock)
+		last = n == len(data)
+		header := uint32(n) << 3
+		if last {
+			header |= 1
+		}
+		frame = append(frame, byte(header), byte(header>>8), byte(header>>16))
+		frame = append(frame, data[:n]...)
+		data = data[n:]
+	}
+	return binary.LittleEndian.AppendUint32(frame, uint32(hash.sum()))
+}
+
+// zstdTestText is the text compressed in zstdCompressed
+func zstdTestText() []byte {
+	var text bytes.Buffer
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&text, "line %d: the quick brown fox jumps over the lazy dog %d times\n", i, i*i%97)
+	}
+	return text.Bytes()
+}
+
+// zstdCompressed is zstdTestText compressed by zstd -19: Huffman-coded
+// literals and FSE-coded sequences
+var zstdCompressed, _ = hex.DecodeString("" +
+	"28b52ffd643548b51b00aa4120081a5035a8e40f253d94f45012a8aa4a6bb95b56444aeceecc8859039a006f006f00eb1522" +
+	"c83c3c32997123b67e282f2829786ecf54468fc2e519b38b42429c322172714cf035471b350df53d2349d0727cbab1b119c9" +
+	"02c39f0921bdd9d0dbd21f43535890931397d962a8134ad789419ad7f38ae958583d3b09000a0c7040810a0ec20102101470" +
+	"a0c10602343081011740704041040e58b0c04106101c70f00006104c30c00103042860810407062450c14100e1c080071468" +
+	"207c8898f7320d91ba9468487b6163565e75e8e81c8753b1e9094a659094c78fb80536be99994c16f62616a2eb3976d3b536" +
+	"ccbf18a34914c42243f16aa6c4499320e9bba1685cc75b93b1054b0f41bd2688dc782dc666ea0dafaf194a67694c3a8a9b15" +
+	"0f433ec84cc2b01f6d75b2019b89c9ba30375b08ad0f632f7dd48a7c8b119aaa201439c5a53948fc4c44ea2e580debbd3243" +
+	"58ecb7e697d7573cf4e2bb5fb7c2631f73e695a93d9a18763a8e74a25918f1f3c485749098caa0bf567a10f6eec721c60e87" +
+	"65f50cdd9837f9132c3f8213928cc38e983646c66861457f4d79ccb7e2efcb6b0fbac2fbf98c2513f398316fa7e66836d474" +
+	"61a49799889e235e9241368911c4bfdbb12e66ed3e1ca21e3a3ccbe499e0c6639bf848c88e6084d461d88ba9620c317a3de5" +
+	"a531ee251ad2b2943544bd84c69cfcd0c2913906a735b951128381f2f7996db286038253a82240f1edd76e22e7949d031248" +
+	"1058c20c1982ffbf9f0e159c95bd610c12eb5ff11bb48f4fd66d9c86ff9c6e98ac311fb0e4b5b8c3315f7ff6c8d79ffdf37a" +
+	"fb2927340f83373dd36b5de86bb9f7fcc1fb1ef757f5e3db1f79f271997a0fd45f80a22a7bbcf3b1cfe70e4fb83fe73f07d7" +
+	"719ce5b0d0e15477bcf3217937edeef0d7bf9587c7b5aeb8af17e7ae2ef33c677727eb9d8e2d7ec970de7d1ff9e2db47bef8" +
+	"ecd179cd267dbbde50f37f9dd1b55ee36509d6f43ffc1fd37b0f0fd08f6f7fe494e665e027eb706feffcce81597338befbbc" +
+	"e76dfae7673cd7258c61627a3b077cefe82f9f399a9ec08fd74db8bfb18377df70f8d80fc7fd92773a3a37fb41eda3c39417" +
+	"a7c3cc75f931aee9497c7759f81e37cecd3236b918cee5d8bdc6ef6be1f48773cf05137432187ea61fcbcf66f1793c76f67f" +
+	"bd33b8360ec79c313effe3f2844968b93ec8641c0714ece2406fb18be101d0dbdcd10537695bfa6900ad0580d60a7f917803")
+
+// zstdRepeated is "hello, hello, hello, zstd!" compressed by zstd, a match
+// on a repeated offset
+var zstdRepeated, _ = hex.DecodeString("28b52ffd04589500006068656c6c6f2c207a737464210100928b1197dd9e84")
+
+func TestZstdReader(t *testing.T) {
+	raw := bytes.Repeat([]byte("raw block "), 20000)
+	skippable := []byte{0x50, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 1, 2, 3}
+	// A single-segment frame of 10 bytes in one run-of-one-byte block
+	run := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x20, 10, 1 | 1<<1 | 10<<3, 0, 0, 'x'}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  []byte
+	}{
+		{"compressed", zstdCompressed, zstdTestText()},
+		{"repeated offset", zstdRepeated, []byte("hello, hello, hello, zstd!")},
+		{"raw blocks", zstdRawFrame(raw), raw},
+		{"run of one byte", run, []byte("xxxxxxxxxx")},
+		{"frames", bytes.Join([][]byte{zstdRepeated, skippable, run}, nil), []byte("hello, hello, hello, zstd!xxxxxxxxxx")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z, err := newZstdReader(bytes.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("newZstdReader() error: %v", err)
+			}
+			got, err := io.ReadAll(z)
+			if err != nil {
+				t.Fatalf("read error: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("decoded %d bytes %.40q, want %d bytes %.40q", len(got), got, len(tt.want), tt.want)
+			}
+		})
+	}
+}
+
+func TestZstdReaderErrors(t *testing.T) {
+	badChecksum := bytes.Clone(zstdCompressed)
+	badChecksum[len(badChecksum)-1] ^= 1
+	badLiterals := bytes.Clone(zstdCompressed)
+	badLiterals[40] ^= 0xff
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  error
+	}{
+		{"empty", nil, io.ErrUnexpectedEOF},
+		{"not zstd", []byte("plain text body"), errZstdCorrupt},
+		{"truncated", zstdCompressed[:len(zstdCompressed)/2], io.ErrUnexpectedEOF},
+		{"checksum", badChecksum, errZstdCorrupt},
+		{"corrupt block", badLiterals, errZstdCorrupt},
+		{"dictionary", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x21, 7, 10, 1 | 1<<1 | 10<<3, 0, 0, 'x'}, errZstdCorrupt},
+		{"content size", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x20, 11, 1 | 1<<1 | 10<<3, 0, 0, 'x'}, errZstdCorrupt},
+		{"reserved block type", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x20, 10, 1 | 3<<1 | 10<<3, 0, 0}, errZstdCorrupt},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z, err := newZstdReader(bytes.NewReader(tt.input))
+			if err == nil {
+				_, err = io.ReadAll(z)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestXXHash64(t *testing.T) {
+	tests := []struct {
+		input string
+		want  uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"abc", 0x44bc2cf5ad770999},
+		{"hello, world", 0xb33a384e6d1b1242},
+		{"abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789$", 0x1032d841e824f998},
+	}
+	for _, tt := range tests {
+		var h xxhash64
+		h.reset()
+		h.write([]byte(tt.input))
+		if got := h.sum(); got != tt.want {
+			t.Errorf("xxhash64(%q) = %#x, want %#x", tt.input, got, tt.want)
+		}
+
+		// Written in pieces
+		h.reset()
+		for _, piece := range strings.SplitAfter(tt.input, "z") {
+			h.write([]byte(piece))
+		}
+		if got := h.sum(); got != tt.want {
+			t.Errorf("xxhash64(%q) in pieces = %#x, want %#x", tt.input, got, tt.want)
+		}
+	}
+}